@@ -0,0 +1,85 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/awslabs/soci-snapshotter/benchmark"
+	"github.com/awslabs/soci-snapshotter/benchmark/framework"
+)
+
+var (
+	outputDir = "./output"
+)
+
+// Runs cold starts of the images in a CSV file, lazily loaded with SOCI and fully pulled,
+// and writes a report comparing their pull time, time to ready and bytes transferred.
+func main() {
+	commit := os.Args[1]
+	configCsv := os.Args[2]
+	numberOfTests, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to parse number of test %s with error:%v\n", os.Args[3], err)
+		panic(errMsg)
+	}
+	imageList, err := benchmark.GetImageListFromCsv(configCsv)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read csv file %s with error:%v\n", configCsv, err)
+		panic(errMsg)
+	}
+
+	err = os.Mkdir(outputDir, 0755)
+	if err != nil && !os.IsExist(err) {
+		panic(err)
+	}
+
+	logFile, err := os.OpenFile(outputDir+"/benchmark_log", os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		panic(err)
+	}
+	defer logFile.Close()
+	ctx, cancelCtx := framework.GetTestContext(logFile)
+	defer cancelCtx()
+
+	modes := []struct {
+		name string
+		run  func(context.Context, benchmark.ImageDescriptor, int) framework.ColdStartResult
+	}{
+		{benchmark.ColdStartModeOverlayFS, benchmark.OverlayFSColdStart},
+		{benchmark.ColdStartModeSoci, benchmark.SociColdStart},
+	}
+	report := framework.ColdStartReport{CommitID: commit}
+	for _, image := range imageList {
+		for _, mode := range modes {
+			for i := 0; i < numberOfTests; i++ {
+				fmt.Printf("Running cold start %d of %d of %s with %s\n", i+1, numberOfTests, image.ShortName, mode.name)
+				result := mode.run(ctx, image, i+1)
+				if result.Error != "" {
+					fmt.Printf("Cold start failed: %s\n", result.Error)
+				}
+				report.Add(result)
+			}
+		}
+	}
+	if err := report.Write(outputDir); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/benchmark/framework"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// ColdStartModeSoci lazily loads the image with the SOCI snapshotter.
+	ColdStartModeSoci = "soci"
+	// ColdStartModeOverlayFS fully pulls and unpacks the image with the overlayfs snapshotter.
+	ColdStartModeOverlayFS = "overlayfs"
+)
+
+// coldStart measures a cold start: pull pulls the image, and newContainer creates the
+// container which is run until it prints the ready line of the image.
+func coldStart(
+	ctx context.Context,
+	proc *framework.ContainerdProcess,
+	image ImageDescriptor,
+	result *framework.ColdStartResult,
+	pull func() (containerd.Image, error),
+	newContainer func(containerd.Image) (containerd.Container, func(), error)) error {
+	rxStart, err := framework.NetworkRxBytes()
+	if err != nil {
+		return fmt.Errorf("cannot read network counters: %w", err)
+	}
+	start := time.Now()
+	img, err := pull()
+	if err != nil {
+		return fmt.Errorf("cannot pull image: %w", err)
+	}
+	result.PullSec = time.Since(start).Seconds()
+
+	container, cleanupContainer, err := newContainer(img)
+	if err != nil {
+		return fmt.Errorf("cannot create container: %w", err)
+	}
+	defer cleanupContainer()
+	taskDetails, cleanupTask, err := proc.CreateTask(ctx, container)
+	if err != nil {
+		return fmt.Errorf("cannot create task: %w", err)
+	}
+	defer cleanupTask()
+	ready, cleanupRun, err := proc.RunContainerTaskUntilReady(ctx, taskDetails, image.ReadyLine)
+	if err != nil {
+		return fmt.Errorf("cannot run task: %w", err)
+	}
+	defer cleanupRun()
+	result.TimeToReadySec = time.Since(start).Seconds()
+	if !ready {
+		return fmt.Errorf("container exited or timed out before printing %q", image.ReadyLine)
+	}
+	result.Ready = true
+
+	rxEnd, err := framework.NetworkRxBytes()
+	if err != nil {
+		return fmt.Errorf("cannot read network counters: %w", err)
+	}
+	result.BytesTransferred = rxEnd - rxStart
+	return nil
+}
+
+// SociColdStart measures a cold start of the image lazily loaded with the SOCI snapshotter,
+// starting containerd and the snapshotter with empty roots.
+func SociColdStart(ctx context.Context, image ImageDescriptor, run int) framework.ColdStartResult {
+	result := framework.ColdStartResult{Image: image.ShortName, Mode: ColdStartModeSoci, Run: run}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("test_name", "SociColdStart"+image.ShortName))
+	containerdProcess, err := getContainerdProcess(ctx, containerdSociConfig)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create containerd proc: %v", err)
+		return result
+	}
+	defer containerdProcess.StopProcess()
+	sociProcess, err := getSociProcess()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create soci proc: %v", err)
+		return result
+	}
+	defer sociProcess.StopProcess()
+	sociContainerdProc := SociContainerdProcess{containerdProcess}
+
+	err = coldStart(ctx, containerdProcess, image, &result,
+		func() (containerd.Image, error) {
+			return sociContainerdProc.SociRPullImageFromECR(ctx, image.ImageRef, image.SociIndexManifestRef, awsSecretFile)
+		},
+		func(img containerd.Image) (containerd.Container, func(), error) {
+			return sociContainerdProc.CreateSociContainer(ctx, img)
+		})
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// OverlayFSColdStart measures a cold start of the image fully pulled and unpacked with
+// the overlayfs snapshotter, starting containerd with an empty root.
+func OverlayFSColdStart(ctx context.Context, image ImageDescriptor, run int) framework.ColdStartResult {
+	result := framework.ColdStartResult{Image: image.ShortName, Mode: ColdStartModeOverlayFS, Run: run}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("test_name", "OverlayFSColdStart"+image.ShortName))
+	containerdProcess, err := getContainerdProcess(ctx, containerdSociConfig)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create containerd proc: %v", err)
+		return result
+	}
+	defer containerdProcess.StopProcess()
+
+	err = coldStart(ctx, containerdProcess, image, &result,
+		func() (containerd.Image, error) {
+			img, err := containerdProcess.PullImageFromECR(ctx, image.ImageRef, platform, awsSecretFile)
+			if err != nil {
+				return nil, err
+			}
+			return img, img.Unpack(ctx, "overlayfs")
+		},
+		func(img containerd.Image) (containerd.Container, func(), error) {
+			return containerdProcess.CreateContainer(ctx, img)
+		})
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
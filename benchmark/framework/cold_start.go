@@ -0,0 +1,239 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package framework
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/montanaflynn/stats"
+)
+
+var (
+	coldStartJSONFilename = "cold_start.json"
+	coldStartCSVFilename  = "cold_start.csv"
+	netDevFile            = "/proc/net/dev"
+)
+
+// ColdStartResult is the result of a single cold start of an image: pulling it on an
+// empty node and running a container until it's ready.
+type ColdStartResult struct {
+	Image string `json:"image"`
+	Mode  string `json:"mode"`
+	Run   int    `json:"run"`
+	// PullSec is the time to pull (and unpack) the image.
+	PullSec float64 `json:"pullSec"`
+	// TimeToReadySec is the time from the start of the pull until the container
+	// printed its ready line.
+	TimeToReadySec float64 `json:"timeToReadySec"`
+	// BytesTransferred is the number of bytes received by the node's network interfaces
+	// until the container was ready.
+	BytesTransferred int64  `json:"bytesTransferred"`
+	Ready            bool   `json:"ready"`
+	Error            string `json:"error,omitempty"`
+}
+
+// ColdStartSummary is the median of the successful cold starts of an image in a mode.
+type ColdStartSummary struct {
+	Image            string  `json:"image"`
+	Mode             string  `json:"mode"`
+	Runs             int     `json:"runs"`
+	Failures         int     `json:"failures"`
+	PullSec          float64 `json:"pullSec"`
+	TimeToReadySec   float64 `json:"timeToReadySec"`
+	BytesTransferred float64 `json:"bytesTransferred"`
+}
+
+// ColdStartReport compares the cold starts of a matrix of images in several modes,
+// e.g. lazily loaded with SOCI against fully pulled.
+type ColdStartReport struct {
+	CommitID  string             `json:"commit"`
+	Results   []ColdStartResult  `json:"results"`
+	Summaries []ColdStartSummary `json:"summaries"`
+}
+
+// Add records the result of a cold start.
+func (r *ColdStartReport) Add(result ColdStartResult) {
+	r.Results = append(r.Results, result)
+}
+
+// Summarize computes the summaries of the results per image and mode, in the order
+// the images and modes were first run.
+func (r *ColdStartReport) Summarize() {
+	r.Summaries = nil
+	index := make(map[[2]string]int)
+	var pulls, readies, bytes [][]float64
+	for _, res := range r.Results {
+		key := [2]string{res.Image, res.Mode}
+		i, ok := index[key]
+		if !ok {
+			i = len(r.Summaries)
+			index[key] = i
+			r.Summaries = append(r.Summaries, ColdStartSummary{Image: res.Image, Mode: res.Mode})
+			pulls, readies, bytes = append(pulls, nil), append(readies, nil), append(bytes, nil)
+		}
+		r.Summaries[i].Runs++
+		if !res.Ready {
+			r.Summaries[i].Failures++
+			continue
+		}
+		pulls[i] = append(pulls[i], res.PullSec)
+		readies[i] = append(readies[i], res.TimeToReadySec)
+		bytes[i] = append(bytes[i], float64(res.BytesTransferred))
+	}
+	for i := range r.Summaries {
+		r.Summaries[i].PullSec = median(pulls[i])
+		r.Summaries[i].TimeToReadySec = median(readies[i])
+		r.Summaries[i].BytesTransferred = median(bytes[i])
+	}
+}
+
+// median returns the median of values, or -1 if there are none.
+func median(values []float64) float64 {
+	m, err := stats.Median(values)
+	if err != nil {
+		return -1
+	}
+	return m
+}
+
+// Write summarizes the results and writes the report as JSON, and the summaries
+// side by side per image as CSV, to outputDir.
+func (r *ColdStartReport) Write(outputDir string) error {
+	r.Summarize()
+	if err := os.MkdirAll(outputDir, resultFilePerm); err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(outputDir+"/"+coldStartJSONFilename, js, resultFilePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(outputDir + "/" + coldStartCSVFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if err := w.Write(r.csvHeader()); err != nil {
+		return err
+	}
+	for _, row := range r.csvRows() {
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// modes returns the modes of the results in the order they were first run.
+func (r *ColdStartReport) modes() []string {
+	var modes []string
+	seen := make(map[string]bool)
+	for _, s := range r.Summaries {
+		if !seen[s.Mode] {
+			seen[s.Mode] = true
+			modes = append(modes, s.Mode)
+		}
+	}
+	return modes
+}
+
+func (r *ColdStartReport) csvHeader() []string {
+	header := []string{"image"}
+	for _, mode := range r.modes() {
+		header = append(header,
+			mode+"_runs",
+			mode+"_failures",
+			mode+"_pull_sec",
+			mode+"_time_to_ready_sec",
+			mode+"_bytes_transferred")
+	}
+	return header
+}
+
+// csvRows returns a row per image with the summaries of all modes side by side.
+// Modes an image wasn't run in are left empty.
+func (r *ColdStartReport) csvRows() [][]string {
+	modes := r.modes()
+	var rows [][]string
+	rowOf := make(map[string]int)
+	for _, s := range r.Summaries {
+		i, ok := rowOf[s.Image]
+		if !ok {
+			i = len(rows)
+			rowOf[s.Image] = i
+			rows = append(rows, append([]string{s.Image}, make([]string, 5*len(modes))...))
+		}
+		for m, mode := range modes {
+			if mode != s.Mode {
+				continue
+			}
+			copy(rows[i][1+5*m:], []string{
+				strconv.Itoa(s.Runs),
+				strconv.Itoa(s.Failures),
+				formatFloat(s.PullSec),
+				formatFloat(s.TimeToReadySec),
+				formatFloat(s.BytesTransferred),
+			})
+		}
+	}
+	return rows
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// NetworkRxBytes returns the number of bytes received by the network interfaces of
+// the node, except the loopback interface.
+func NetworkRxBytes() (int64, error) {
+	f, err := os.Open(netDevFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var total int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines of interfaces look like "  eth0: <rx bytes> <rx packets> ..."; the
+		// first two lines are headers without a colon.
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse received bytes of interface %s: %w", strings.TrimSpace(name), err)
+		}
+		total += n
+	}
+	return total, scanner.Err()
+}
@@ -206,12 +206,22 @@ func (proc *ContainerdProcess) RunContainerTaskForReadyLine(
 	ctx context.Context,
 	taskDetails *TaskDetails,
 	readyLine string) (func(), error) {
+	_, cleanupFunc, err := proc.RunContainerTaskUntilReady(ctx, taskDetails, readyLine)
+	return cleanupFunc, err
+}
+
+// RunContainerTaskUntilReady starts the task and waits until it prints readyLine,
+// exits or times out. ready is true only if the task printed readyLine.
+func (proc *ContainerdProcess) RunContainerTaskUntilReady(
+	ctx context.Context,
+	taskDetails *TaskDetails,
+	readyLine string) (bool, func(), error) {
 	stdoutScanner := bufio.NewScanner(taskDetails.stdoutReader)
 	stderrScanner := bufio.NewScanner(taskDetails.stderrReader)
 
 	exitStatusC, err := taskDetails.task.Wait(ctx)
 	if err != nil {
-		return nil, err
+		return false, nil, err
 	}
 	resultChannel := make(chan string, 1)
 	timeoutCtx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
@@ -256,12 +266,13 @@ func (proc *ContainerdProcess) RunContainerTaskForReadyLine(
 	}()
 
 	if err := taskDetails.task.Start(ctx); err != nil {
-		return nil, err
+		return false, nil, err
 	}
 
+	var ready bool
 	select {
-	case <-resultChannel:
-		break
+	case result := <-resultChannel:
+		ready = strings.HasPrefix(result, "READYLINE")
 	case <-timeoutCtx.Done():
 		break
 	}
@@ -277,7 +288,7 @@ func (proc *ContainerdProcess) RunContainerTaskForReadyLine(
 			<-exitChannel
 		}
 	}
-	return cleanupFunc, nil
+	return ready, cleanupFunc, nil
 }
 
 func GetRemoteOpts(ctx context.Context, platform string) []containerd.RemoteOpt {
@@ -48,6 +48,12 @@ import (
 const (
 	defaultMaxLRUCacheEntry = 10
 	defaultMaxCacheFds      = 10
+
+	// shardPrefixLen is the length of the key prefix that names the directory
+	// an entry is stored in, so that large caches don't keep all of their entries
+	// in a single directory.
+	shardPrefixLen = 2
+	wipDirName     = "wip"
 )
 
 type DirectoryCacheConfig struct {
@@ -64,7 +70,8 @@ type DirectoryCacheConfig struct {
 	SyncAdd bool
 
 	// DataCache is an on-memory cache of the data.
-	// OnEvicted will be overridden and replaced for internal use.
+	// OnEvicted will be wrapped to account for the memory of the data, so a
+	// DataCache must not be shared by several directory caches.
 	DataCache *lrucache.Cache
 
 	// FdCache is a cache for opened file descriptors.
@@ -77,6 +84,10 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// Cipher encrypts the files of the cache, if it's set. The on-memory data cache
+	// isn't encrypted.
+	Cipher *Cipher
 }
 
 // TODO: contents validation.
@@ -150,6 +161,13 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 			bufPool.Put(value)
 		}
 	}
+	onEvicted := dataCache.OnEvicted
+	dataCache.OnEvicted = func(key string, value interface{}) {
+		addMemory(-value.(*bytes.Buffer).Len())
+		if onEvicted != nil {
+			onEvicted(key, value)
+		}
+	}
 	fdCache := config.FdCache
 	if fdCache == nil {
 		maxEntry := config.MaxCacheFds
@@ -164,10 +182,14 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 	if err := os.MkdirAll(directory, 0700); err != nil {
 		return nil, err
 	}
-	wipdir := filepath.Join(directory, "wip")
+	wipdir := filepath.Join(directory, wipDirName)
 	if err := os.MkdirAll(wipdir, 0700); err != nil {
 		return nil, err
 	}
+	// Entries of an existing cache may be stored in the flat layout of older versions.
+	if err := migrateFlatLayout(directory, wipdir); err != nil {
+		return nil, fmt.Errorf("failed to migrate cache directory %q: %w", directory, err)
+	}
 	dc := &directoryCache{
 		cache:        dataCache,
 		fileCache:    fdCache,
@@ -176,8 +198,12 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		wipDirectory: wipdir,
 		bufPool:      bufPool,
 		direct:       config.Direct,
+		cipher:       config.Cipher,
 	}
 	dc.syncAdd = config.SyncAdd
+	if !dc.direct {
+		sheddable.Store(dc, struct{}{})
+	}
 	return dc, nil
 }
 
@@ -193,6 +219,7 @@ type directoryCache struct {
 
 	syncAdd bool
 	direct  bool
+	cipher  *Cipher
 
 	closed   bool
 	closedMu sync.Mutex
@@ -222,8 +249,13 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
+			r, err := dc.readerAt(f.(*os.File), key)
+			if err != nil {
+				done()
+				return nil, err
+			}
 			return &reader{
-				ReaderAt: f.(*os.File),
+				ReaderAt: r,
 				closeFunc: func() error {
 					done() // file will be closed when it's evicted from the cache
 					return nil
@@ -239,13 +271,18 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
 	}
+	r, err := dc.readerAt(file, key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	// If "direct" option is specified, do not cache the file on memory.
 	// This option is useful for preventing memory cache from being polluted by data
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt:  file,
+			ReaderAt:  r,
 			closeFunc: func() error { return file.Close() },
 		}, nil
 	}
@@ -254,7 +291,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       but making I/O (possibly huge) on every fetching
 	//       might be costly.
 	return &reader{
-		ReaderAt: file,
+		ReaderAt: r,
 		closeFunc: func() error {
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
@@ -280,12 +317,29 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if err != nil {
 		return nil, err
 	}
+	var wc io.WriteCloser = wip
+	var ew io.WriteCloser
+	if dc.cipher != nil {
+		if ew, err = dc.cipher.NewWriter(wip, key); err != nil {
+			wip.Close()
+			os.Remove(wip.Name())
+			return nil, err
+		}
+		wc = &writeCloser{ew, wip.Close}
+	}
 	w := &writer{
-		WriteCloser: wip,
+		WriteCloser: wc,
 		commitFunc: func() error {
 			if dc.isClosed() {
 				return fmt.Errorf("cache is already closed")
 			}
+			if ew != nil {
+				// write the last chunk.
+				if err := ew.Close(); err != nil {
+					os.Remove(wip.Name())
+					return err
+				}
+			}
 			// Commit the cache contents
 			c := dc.cachePath(key)
 			if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
@@ -319,7 +373,9 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return fmt.Errorf("cache is already closed")
 			}
 			cached, done, added := dc.cache.Add(key, b)
-			if !added {
+			if added {
+				addMemory(b.Len())
+			} else {
 				dc.putBuffer(b) // already exists in the cache. abort it.
 			}
 			commit := func() error {
@@ -365,6 +421,8 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
+	sheddable.Delete(dc)
+	dc.cache.Clear()
 	return os.RemoveAll(dc.directory)
 }
 
@@ -375,8 +433,66 @@ func (dc *directoryCache) isClosed() bool {
 	return closed
 }
 
+// readerAt returns a reader of the contents of key in f, which is its file.
+func (dc *directoryCache) readerAt(f *os.File, key string) (io.ReaderAt, error) {
+	if dc.cipher == nil {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := dc.cipher.NewReaderAt(f, fi.Size(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob file for %q: %w", key, err)
+	}
+	return r, nil
+}
+
 func (dc *directoryCache) cachePath(key string) string {
-	return filepath.Join(dc.directory, key)
+	return filepath.Join(dc.directory, shardOf(key), key)
+}
+
+// shardOf returns the name of the directory the entry of key is stored in.
+// Keys shorter than the prefix (e.g. the IDs of the first spans of a layer) are
+// stored in a directory of their own.
+func shardOf(key string) string {
+	if len(key) <= shardPrefixLen {
+		return key
+	}
+	return key[:shardPrefixLen]
+}
+
+// migrateFlatLayout moves the entries stored directly in the cache directory into
+// their shards.
+func migrateFlatLayout(directory, wipdir string) error {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		key := e.Name()
+		flat := filepath.Join(directory, key)
+		if key == shardOf(key) {
+			// short keys have the same path as their shard, so move them aside first.
+			tmp := filepath.Join(wipdir, key+"-migrate")
+			if err := os.Rename(flat, tmp); err != nil {
+				return err
+			}
+			flat = tmp
+		}
+		c := filepath.Join(directory, shardOf(key), key)
+		if err := os.MkdirAll(filepath.Dir(c), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(flat, c); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (dc *directoryCache) wipFile(key string) (*os.File, error) {
@@ -412,14 +528,25 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 		commitFunc: func() error {
 			mc.mu.Lock()
 			defer mc.mu.Unlock()
+			if old, ok := mc.Membuf[key]; ok {
+				addMemory(-old.Len())
+			}
 			mc.Membuf[key] = b
+			addMemory(b.Len())
 			return nil
 		},
 		abortFunc: func() error { return nil },
 	}, nil
 }
 
+// Close releases the contents of the cache.
 func (mc *MemoryCache) Close() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for key, b := range mc.Membuf {
+		addMemory(-b.Len())
+		delete(mc.Membuf, key)
+	}
 	return nil
 }
 
@@ -43,6 +43,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -85,6 +86,225 @@ func TestDirectoryCache(t *testing.T) {
 		return c, func() { os.RemoveAll(tmp) }
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with encrypted files
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			Cipher:           testCipher(t),
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-encrypted", newCache)
+}
+
+func TestDirectoryCacheMigration(t *testing.T) {
+	tmp := t.TempDir()
+	digestKey := fmt.Sprintf("%x", sha256.Sum256([]byte(sampleData)))
+	// entries in the flat layout of older versions
+	flat := map[string]string{
+		digestKey: sampleData,
+		"7":       "span",
+	}
+	for key, data := range flat {
+		if err := os.WriteFile(filepath.Join(tmp, key), []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write entry %q: %v", key, err)
+		}
+	}
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{Direct: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+
+	for key, data := range flat {
+		if _, err := os.Stat(filepath.Join(tmp, shardOf(key), key)); err != nil {
+			t.Fatalf("expected entry %q to be moved into its shard: %v", key, err)
+		}
+		r, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get migrated entry %q: %v", key, err)
+		}
+		b := make([]byte, len(data))
+		_, err = r.ReadAt(b, 0)
+		r.Close()
+		if err != nil && err != io.EOF {
+			t.Fatalf("failed to read migrated entry %q: %v", key, err)
+		}
+		if string(b) != data {
+			t.Fatalf("expected %q for key %q, got %q", data, key, string(b))
+		}
+	}
+}
+
+func TestPackfileCache(t *testing.T) {
+	testCache(t, "packfile", func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewPackfileCache(tmp, PackfileCacheConfig{})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	})
+	testCache(t, "packfile-encrypted", func() (BlobCache, cleanFunc) {
+		tmp, err := os.MkdirTemp("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewPackfileCache(tmp, PackfileCacheConfig{Cipher: testCipher(t)})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	})
+}
+
+func TestPackfileCacheCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	c, err := NewPackfileCache(tmp, PackfileCacheConfig{})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	pc := c.(*packfileCache)
+	pc.compactMinGarbage = int64(len(sampleData))
+
+	entries := map[string]string{"1": "a", "2": sampleData}
+	for key, data := range entries {
+		if err := addData(c, key, data); err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+	}
+	// a reader of the packfile before compaction keeps reading its entry.
+	r, err := c.Get("2")
+	if err != nil {
+		t.Fatalf("failed to get entry: %v", err)
+	}
+	defer r.Close()
+
+	// replaced entries are read from their latest contents, and compacted once
+	// they take up most of the packfile.
+	entries["2"] = "short"
+	if err := addData(c, "2", entries["2"]); err != nil {
+		t.Fatalf("failed to replace entry: %v", err)
+	}
+	if pc.garbage != 0 {
+		t.Fatalf("expected the packfile to be compacted, got %d bytes of replaced entries", pc.garbage)
+	}
+	if expected := int64(len(entries["1"]) + len(entries["2"])); pc.size != expected {
+		t.Fatalf("expected packfile of %d bytes, got %d", expected, pc.size)
+	}
+	b := make([]byte, len(sampleData))
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != sampleData {
+		t.Fatalf("expected the replaced entry to be readable until it's closed, got %q: %v", string(b), err)
+	}
+	for key, data := range entries {
+		r, err := c.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get %q: %v", key, err)
+		}
+		b := make([]byte, len(data))
+		if _, err := r.ReadAt(b, 0); err != nil {
+			t.Fatalf("failed to read %q: %v", key, err)
+		}
+		r.Close()
+		if string(b) != data {
+			t.Fatalf("expected %q for key %q, got %q", data, key, string(b))
+		}
+	}
+	files, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatalf("failed to read cache directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected a single packfile after compaction, got %d files", len(files))
+	}
+}
+
+func TestPackfileCacheCompactionFailure(t *testing.T) {
+	tmp := t.TempDir()
+	c, err := NewPackfileCache(tmp, PackfileCacheConfig{})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	pc := c.(*packfileCache)
+	pc.compactMinGarbage = 1
+	// the new packfile can't be created if the directory is gone.
+	pc.directory = filepath.Join(tmp, "missing")
+
+	for _, data := range []string{sampleData, "short"} {
+		if err := addData(c, "1", data); err != nil {
+			t.Fatalf("failed to add entry when compaction fails: %v", err)
+		}
+	}
+	if pc.garbage == 0 {
+		t.Fatalf("expected compaction to fail")
+	}
+	r, err := c.Get("1")
+	if err != nil {
+		t.Fatalf("failed to get entry: %v", err)
+	}
+	defer r.Close()
+	b := make([]byte, len("short"))
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != "short" {
+		t.Fatalf("expected the entry to be read from the current packfile, got %q: %v", string(b), err)
+	}
+}
+
+func TestPackfileCacheClose(t *testing.T) {
+	tmp := t.TempDir()
+	c, err := NewPackfileCache(tmp, PackfileCacheConfig{})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	if err := addData(c, "1", sampleData); err != nil {
+		t.Fatalf("failed to add entry: %v", err)
+	}
+	r, err := c.Get("1")
+	if err != nil {
+		t.Fatalf("failed to get entry: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+	if _, err := c.Get("1"); err == nil {
+		t.Fatalf("got entry of closed cache")
+	}
+	// readers of the closed cache keep reading their entries until they're closed.
+	b := make([]byte, len(sampleData))
+	if _, err := r.ReadAt(b, 0); err != nil || string(b) != sampleData {
+		t.Fatalf("expected the entry to be readable until it's closed, got %q: %v", string(b), err)
+	}
+	pack := c.(*packfileCache).pack
+	r.Close()
+	if _, err := pack.f.Stat(); err == nil {
+		t.Fatalf("expected the packfile to be closed with its last reader")
+	}
+}
+
+func addData(c BlobCache, key, data string) error {
+	w, err := c.Add(key)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte(data)); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
 }
 
 func TestMemoryCache(t *testing.T) {
@@ -216,3 +436,43 @@ func miss(sample string) check {
 		}
 	}
 }
+
+func TestMemoryAccounting(t *testing.T) {
+	dc, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := NewMemoryCache()
+	// the usage is global, so drop the data of the caches of other tests first.
+	ShedMemory()
+	start := MemoryUsage()
+	if err := addData(dc, "a", sampleData); err != nil {
+		t.Fatal(err)
+	}
+	if err := addData(mc, "b", sampleData); err != nil {
+		t.Fatal(err)
+	}
+	if err := addData(mc, "b", sampleData+sampleData); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := MemoryUsage()-start, int64(3*len(sampleData)); got != expected {
+		t.Fatalf("unexpected memory usage; expected %d, got %d", expected, got)
+	}
+
+	// shedding drops the data cache of the directory cache, which still reads from disk.
+	ShedMemory()
+	if got, expected := MemoryUsage()-start, int64(2*len(sampleData)); got != expected {
+		t.Fatalf("unexpected memory usage after shedding; expected %d, got %d", expected, got)
+	}
+	testBlob(t, dc, "a", 0, sampleData)
+
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := MemoryUsage() - start; got != 0 {
+		t.Fatalf("memory is still used after closing the caches: %d", got)
+	}
+}
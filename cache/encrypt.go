@@ -0,0 +1,309 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// KeySize is the size of the keys of ciphers (AES-256).
+	KeySize = 32
+
+	// encryptedChunkSize is the size of the plaintext of the chunks contents are
+	// encrypted in, so that they can be read at any offset without decrypting all of
+	// them.
+	encryptedChunkSize = 64 << 10
+
+	// encryptedMagic starts every encrypted content, followed by the nonce prefix.
+	encryptedMagic      = "SCE1"
+	encryptedPrefixSize = 8
+	encryptedHeaderSize = len(encryptedMagic) + encryptedPrefixSize
+)
+
+// ErrDecrypt is returned when encrypted contents can't be decrypted, e.g. because
+// they were modified or truncated, or were encrypted with another key.
+var ErrDecrypt = errors.New("failed to decrypt cache contents")
+
+// Cipher encrypts the contents of caches at rest with AES-256-GCM.
+//
+// Contents are split into chunks of 64 KiB, which are encrypted separately so that
+// they can be read at any offset. The nonce of each chunk is a random prefix of the
+// contents followed by the index of the chunk. Each chunk is authenticated with the
+// ID of the contents (e.g. the key of a cache entry) and whether it's the last chunk,
+// so that chunks can't be moved between contents and contents can't be truncated.
+type Cipher struct {
+	aead    cipher.AEAD
+	bufPool sync.Pool
+}
+
+// NewCipher returns a cipher with key, which must be KeySize bytes.
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cipher{aead: aead}
+	c.bufPool.New = func() interface{} {
+		b := make([]byte, 0, encryptedChunkSize+aead.Overhead())
+		return &b
+	}
+	return c, nil
+}
+
+// ParseKey parses a key of KeySize bytes, which is either raw, hex encoded or base64
+// encoded (e.g. the plaintext of a data key of a KMS). Surrounding whitespace of
+// encoded keys is ignored.
+func ParseKey(b []byte) ([]byte, error) {
+	if len(b) == KeySize {
+		return b, nil
+	}
+	s := string(bytes.TrimSpace(b))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be %d bytes, raw or hex or base64 encoded", KeySize)
+}
+
+// EncryptedSize returns the size of size bytes of contents once encrypted.
+func (c *Cipher) EncryptedSize(size int64) int64 {
+	chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		// empty contents have an empty last chunk.
+		chunks = 1
+	}
+	return int64(encryptedHeaderSize) + size + chunks*int64(c.aead.Overhead())
+}
+
+func (c *Cipher) nonce(prefix []byte, chunk uint32) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], chunk)
+	return nonce
+}
+
+func additionalData(id string, last bool) []byte {
+	ad := make([]byte, 0, len(id)+1)
+	ad = append(ad, id...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// Encrypt returns plaintext encrypted as the contents with id.
+func (c *Cipher) Encrypt(plaintext []byte, id string) ([]byte, error) {
+	var b bytes.Buffer
+	b.Grow(int(c.EncryptedSize(int64(len(plaintext)))))
+	w, err := c.NewWriter(&b, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decrypt returns the plaintext of the encrypted contents with id.
+func (c *Cipher) Decrypt(encrypted []byte, id string) ([]byte, error) {
+	r, size, err := c.NewReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), id)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, size)
+	if _, err := r.ReadAt(plaintext, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// NewWriter returns a writer which writes the contents with id to w encrypted. The
+// last chunk is written when the writer is closed, which doesn't close w.
+func (c *Cipher) NewWriter(w io.Writer, id string) (io.WriteCloser, error) {
+	prefix := make([]byte, encryptedPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	if _, err := w.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		c:      c,
+		w:      w,
+		id:     id,
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptedChunkSize),
+		sealed: make([]byte, 0, encryptedChunkSize+c.aead.Overhead()),
+	}, nil
+}
+
+type encryptWriter struct {
+	c      *Cipher
+	w      io.Writer
+	id     string
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+	sealed []byte
+	closed bool
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("writer is already closed")
+	}
+	var n int
+	for len(p) > 0 {
+		// a full chunk is only written once more data follows, since the last chunk
+		// is encrypted differently.
+		if len(ew.buf) == encryptedChunkSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.buf[len(ew.buf):encryptedChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	if !last && ew.chunk == ^uint32(0) {
+		return fmt.Errorf("contents are too large to encrypt")
+	}
+	ew.sealed = ew.c.aead.Seal(ew.sealed[:0], ew.c.nonce(ew.prefix, ew.chunk), ew.buf, additionalData(ew.id, last))
+	if _, err := ew.w.Write(ew.sealed); err != nil {
+		return err
+	}
+	ew.chunk++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Close writes the last chunk.
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.seal(true)
+}
+
+// NewReaderAt returns a reader of the plaintext of the encrypted contents with id,
+// which are read from the size bytes of r. It also returns the size of the plaintext.
+func (c *Cipher) NewReaderAt(r io.ReaderAt, size int64, id string) (io.ReaderAt, int64, error) {
+	header := make([]byte, encryptedHeaderSize)
+	if n, err := r.ReadAt(header, 0); n < len(header) {
+		return nil, 0, fmt.Errorf("%w: failed to read header: %v", ErrDecrypt, err)
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, 0, fmt.Errorf("%w: contents aren't encrypted", ErrDecrypt)
+	}
+	sealedChunkSize := int64(encryptedChunkSize + c.aead.Overhead())
+	body := size - int64(encryptedHeaderSize)
+	chunks := (body + sealedChunkSize - 1) / sealedChunkSize
+	if body < int64(c.aead.Overhead()) || chunks-1 > int64(^uint32(0)) ||
+		body-(chunks-1)*sealedChunkSize < int64(c.aead.Overhead()) {
+		return nil, 0, fmt.Errorf("%w: contents are truncated", ErrDecrypt)
+	}
+	dr := &decryptReader{
+		c:         c,
+		r:         r,
+		id:        id,
+		prefix:    header[len(encryptedMagic):],
+		body:      body,
+		chunks:    chunks,
+		plainSize: body - chunks*int64(c.aead.Overhead()),
+	}
+	return dr, dr.plainSize, nil
+}
+
+type decryptReader struct {
+	c      *Cipher
+	r      io.ReaderAt
+	id     string
+	prefix []byte
+	// body is the size of the encrypted chunks.
+	body      int64
+	chunks    int64
+	plainSize int64
+}
+
+func (dr *decryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= dr.plainSize {
+		return 0, io.EOF
+	}
+	sealedChunkSize := int64(encryptedChunkSize + dr.c.aead.Overhead())
+	bufp := dr.c.bufPool.Get().(*[]byte)
+	defer dr.c.bufPool.Put(bufp)
+	var n int
+	for n < len(p) && off < dr.plainSize {
+		chunk := off / encryptedChunkSize
+		last := chunk == dr.chunks-1
+		sealedLen := sealedChunkSize
+		if last {
+			sealedLen = dr.body - chunk*sealedChunkSize
+		}
+		sealed := (*bufp)[:sealedLen]
+		if k, err := dr.r.ReadAt(sealed, int64(encryptedHeaderSize)+chunk*sealedChunkSize); k < len(sealed) {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("%w: contents are truncated", ErrDecrypt)
+			}
+			return n, err
+		}
+		plain, err := dr.c.aead.Open(sealed[:0], dr.c.nonce(dr.prefix, uint32(chunk)), sealed, additionalData(dr.id, last))
+		if err != nil {
+			return n, fmt.Errorf("%w: chunk %d: %v", ErrDecrypt, chunk, err)
+		}
+		m := copy(p[n:], plain[off-chunk*encryptedChunkSize:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testCipher(t *testing.T) *Cipher {
+	c, err := NewCipher(bytes.Repeat([]byte{7}, KeySize))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	return c
+}
+
+func TestCipherReadAt(t *testing.T) {
+	c := testCipher(t)
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		encrypted, err := c.Encrypt(plaintext, "key")
+		if err != nil {
+			t.Fatalf("size %d: failed to encrypt: %v", size, err)
+		}
+		if int64(len(encrypted)) != c.EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted size is %d; want %d", size, len(encrypted), c.EncryptedSize(int64(size)))
+		}
+		r, plainSize, err := c.NewReaderAt(bytes.NewReader(encrypted), int64(len(encrypted)), "key")
+		if err != nil {
+			t.Fatalf("size %d: failed to read: %v", size, err)
+		}
+		if plainSize != int64(size) {
+			t.Fatalf("size %d: plaintext size is %d", size, plainSize)
+		}
+		for _, off := range []int{0, 1, encryptedChunkSize - 3, encryptedChunkSize, 2*encryptedChunkSize + 1} {
+			if off >= size {
+				continue
+			}
+			for _, n := range []int{1, 10, encryptedChunkSize + 7} {
+				want := plaintext[off:]
+				if len(want) > n {
+					want = want[:n]
+				}
+				got := make([]byte, n)
+				m, err := r.ReadAt(got, int64(off))
+				if m < n && err != io.EOF || m == n && err != nil {
+					t.Fatalf("size %d: ReadAt(%d, %d) = %d, %v", size, n, off, m, err)
+				}
+				if !bytes.Equal(got[:m], want) {
+					t.Errorf("size %d: ReadAt(%d, %d) read wrong contents", size, n, off)
+				}
+			}
+		}
+	}
+}
+
+func TestCipherRejectsModifiedContents(t *testing.T) {
+	c := testCipher(t)
+	plaintext := bytes.Repeat([]byte("x"), 2*encryptedChunkSize+10)
+	encrypted, err := c.Encrypt(plaintext, "key")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	modified := append([]byte{}, encrypted...)
+	modified[len(modified)/2]++
+	// truncated at the end of a chunk, so that the rest looks like whole chunks.
+	truncated := encrypted[:encryptedHeaderSize+encryptedChunkSize+c.aead.Overhead()]
+	other, err := NewCipher(bytes.Repeat([]byte{8}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		c         *Cipher
+		encrypted []byte
+		id        string
+	}{
+		{"modified", c, modified, "key"},
+		{"truncated", c, truncated, "key"},
+		{"other id", c, encrypted, "other"},
+		{"other key", other, encrypted, "key"},
+		{"plaintext", c, plaintext, "key"},
+	}
+	for _, tt := range tests {
+		if _, err := tt.c.Decrypt(tt.encrypted, tt.id); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: got error %v; want %v", tt.name, err, ErrDecrypt)
+		}
+	}
+}
+
+func TestDirectoryCacheEncryptsFiles(t *testing.T) {
+	tmp := t.TempDir()
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true, Direct: true, Cipher: testCipher(t)})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	if err := addData(c, "key", sampleData); err != nil {
+		t.Fatalf("failed to add data: %v", err)
+	}
+	b, err := os.ReadFile(c.(*directoryCache).cachePath("key"))
+	if err != nil {
+		t.Fatalf("failed to read cache file: %v", err)
+	}
+	if bytes.Contains(b, []byte(sampleData)) {
+		t.Errorf("cache file isn't encrypted")
+	}
+	// a file moved to another key can't be read.
+	if err := os.MkdirAll(filepath.Dir(c.(*directoryCache).cachePath("other")), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.(*directoryCache).cachePath("other"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Get("other")
+	if err != nil {
+		t.Fatalf("failed to get moved file: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.ReadAt(make([]byte, len(sampleData)), 0); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("got error %v reading a moved file; want %v", err, ErrDecrypt)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, KeySize)
+	for _, encoded := range [][]byte{
+		key,
+		[]byte(hex.EncodeToString(key) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(key)),
+	} {
+		got, err := ParseKey(encoded)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("ParseKey(%q) = %x, %v; want %x", encoded, got, err, key)
+		}
+	}
+	if _, err := ParseKey([]byte("too short")); err == nil {
+		t.Errorf("short key was accepted")
+	}
+}
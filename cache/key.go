@@ -0,0 +1,60 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// keyCommandTimeout is how long the command which prints a key may run, e.g. to
+// decrypt a data key with a KMS.
+const keyCommandTimeout = time.Minute
+
+// LoadCipher returns a cipher with the key read from keyFile, or printed by
+// keyCommand if keyFile is empty. The key is parsed with ParseKey.
+func LoadCipher(keyFile string, keyCommand []string) (*Cipher, error) {
+	var b []byte
+	var err error
+	if keyFile != "" {
+		b, err = os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key: %w", err)
+		}
+	} else if len(keyCommand) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, keyCommand[0], keyCommand[1:]...)
+		cmd.Stderr = &stderr
+		b, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run key command: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	} else {
+		return nil, fmt.Errorf("no key file or key command")
+	}
+	key, err := ParseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return NewCipher(key)
+}
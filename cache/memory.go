@@ -0,0 +1,50 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBytes is the number of bytes of data held in memory by all caches.
+var memoryBytes int64
+
+// sheddable are the directory caches whose on-memory data caches can be dropped,
+// since their data is also on disk.
+var sheddable sync.Map // *directoryCache -> struct{}
+
+// MemoryUsage returns the number of bytes of data held in memory by all caches: the
+// on-memory data caches of directory caches and the contents of memory caches.
+func MemoryUsage() int64 {
+	return atomic.LoadInt64(&memoryBytes)
+}
+
+// ShedMemory drops the on-memory data caches of all directory caches, e.g. when the
+// process is running out of memory. Their data is still read from disk. Data which is
+// being read is released once the reads are done. Memory caches can't be shed, since
+// memory is their only copy of the data.
+func ShedMemory() {
+	sheddable.Range(func(key, _ interface{}) bool {
+		key.(*directoryCache).cache.Clear()
+		return true
+	})
+}
+
+func addMemory(n int) {
+	atomic.AddInt64(&memoryBytes, int64(n))
+}
@@ -0,0 +1,287 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	packfileName = "pack"
+
+	// packfileCompactMinGarbage is the size of replaced entries the packfile must
+	// hold before it's compacted, so that small caches aren't rewritten often.
+	packfileCompactMinGarbage = 16 << 20 // 16 MiB
+)
+
+type PackfileCacheConfig struct {
+	// BufPool will be used for pooling bytes.Buffer.
+	BufPool *sync.Pool
+
+	// Cipher encrypts the entries of the packfile, if it's set.
+	Cipher *Cipher
+}
+
+// packfileCache is a cache implementation which stores all entries in a single
+// append-only file, so that it uses one inode however many entries it has.
+// The location of each entry is only kept in memory, since the cache is
+// removed when it's closed.
+//
+// Entries that are added again (e.g. spans that are replaced by their uncompressed
+// contents) are appended as well. Once the replaced entries take up most of the
+// packfile, the live entries are copied into a new packfile.
+type packfileCache struct {
+	directory string
+	pack      *packfile
+	bufPool   *sync.Pool
+	cipher    *Cipher
+
+	mu      sync.RWMutex
+	entries map[string]packfileEntry
+	size    int64
+	// garbage is the size of the replaced entries in the packfile.
+	garbage int64
+	// compactMinGarbage is packfileCompactMinGarbage, unless it's changed by tests.
+	compactMinGarbage int64
+	closed            bool
+}
+
+type packfileEntry struct {
+	offset int64
+	length int64
+}
+
+// packfile is an open packfile. A packfile replaced by compaction, or by closing
+// the cache, is closed once the readers of its entries are closed.
+type packfile struct {
+	f         *os.File
+	refs      int32
+	replaced  int32
+	closeOnce sync.Once
+}
+
+func (p *packfile) acquire() {
+	atomic.AddInt32(&p.refs, 1)
+}
+
+func (p *packfile) release() {
+	if atomic.AddInt32(&p.refs, -1) == 0 && atomic.LoadInt32(&p.replaced) == 1 {
+		p.close()
+	}
+}
+
+// replace marks the packfile as replaced, closing it if it has no readers.
+func (p *packfile) replace() {
+	atomic.StoreInt32(&p.replaced, 1)
+	if atomic.LoadInt32(&p.refs) == 0 {
+		p.close()
+	}
+}
+
+func (p *packfile) close() {
+	p.closeOnce.Do(func() { p.f.Close() })
+}
+
+// NewPackfileCache returns a cache that stores its entries in a single file under directory.
+func NewPackfileCache(directory string, config PackfileCacheConfig) (BlobCache, error) {
+	if !filepath.IsAbs(directory) {
+		return nil, fmt.Errorf("packfile cache path must be an absolute path; got %q", directory)
+	}
+	bufPool := config.BufPool
+	if bufPool == nil {
+		bufPool = &sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		}
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(directory, packfileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packfile: %w", err)
+	}
+	return &packfileCache{
+		directory:         directory,
+		pack:              &packfile{f: f},
+		bufPool:           bufPool,
+		cipher:            config.Cipher,
+		entries:           make(map[string]packfileEntry),
+		compactMinGarbage: packfileCompactMinGarbage,
+	}, nil
+}
+
+func (pc *packfileCache) Get(key string, opts ...Option) (Reader, error) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	if pc.closed {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	e, ok := pc.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("failed to get blob for %q: %w", key, os.ErrNotExist)
+	}
+	p := pc.pack
+	var r io.ReaderAt = io.NewSectionReader(p.f, e.offset, e.length)
+	if pc.cipher != nil {
+		var err error
+		if r, _, err = pc.cipher.NewReaderAt(r, e.length, key); err != nil {
+			return nil, fmt.Errorf("failed to read blob for %q: %w", key, err)
+		}
+	}
+	p.acquire()
+	var once sync.Once
+	return &reader{
+		ReaderAt: r,
+		closeFunc: func() error {
+			once.Do(p.release)
+			return nil
+		},
+	}, nil
+}
+
+// Add returns a writer which buffers the contents of the entry in memory until
+// they're committed. With the Direct option, the buffer isn't pooled, so that
+// contents which won't be read soon don't keep pooled buffers large.
+func (pc *packfileCache) Add(key string, opts ...Option) (Writer, error) {
+	if pc.isClosed() {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	opt := &cacheOpt{}
+	for _, o := range opts {
+		opt = o(opt)
+	}
+	var b *bytes.Buffer
+	if opt.direct {
+		b = new(bytes.Buffer)
+	} else {
+		b = pc.bufPool.Get().(*bytes.Buffer)
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if opt.direct {
+				return
+			}
+			b.Reset()
+			pc.bufPool.Put(b)
+		})
+	}
+	return &writer{
+		WriteCloser: nopWriteCloser(b),
+		commitFunc: func() error {
+			defer release()
+			return pc.append(key, b.Bytes())
+		},
+		abortFunc: func() error {
+			release()
+			return nil
+		},
+	}, nil
+}
+
+// append writes data at the end of the packfile and records its location.
+func (pc *packfileCache) append(key string, data []byte) error {
+	if pc.cipher != nil {
+		var err error
+		if data, err = pc.cipher.Encrypt(data, key); err != nil {
+			return err
+		}
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return fmt.Errorf("cache is already closed")
+	}
+	e := packfileEntry{offset: pc.size, length: int64(len(data))}
+	if _, err := pc.pack.f.WriteAt(data, e.offset); err != nil {
+		return fmt.Errorf("failed to write to packfile: %w", err)
+	}
+	pc.size += e.length
+	if old, ok := pc.entries[key]; ok {
+		pc.garbage += old.length
+	}
+	pc.entries[key] = e
+	if pc.garbage >= pc.compactMinGarbage && pc.garbage*2 >= pc.size {
+		// if compaction fails, the entries are still read from the current packfile.
+		if err := pc.compact(); err != nil {
+			log.L.WithError(err).WithField("directory", pc.directory).Warn("failed to compact packfile")
+		}
+	}
+	return nil
+}
+
+// compact copies the live entries into a new packfile which replaces the current one.
+// Readers of the current packfile keep reading it until they're closed.
+// pc.mu must be held.
+func (pc *packfileCache) compact() error {
+	tmp, err := os.CreateTemp(pc.directory, packfileName+"-*")
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]packfileEntry, len(pc.entries))
+	var size int64
+	for key, e := range pc.entries {
+		if _, err := io.Copy(tmp, io.NewSectionReader(pc.pack.f, e.offset, e.length)); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		entries[key] = packfileEntry{offset: size, length: e.length}
+		size += e.length
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(pc.directory, packfileName)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	pc.pack.replace()
+	pc.pack = &packfile{f: tmp}
+	pc.entries = entries
+	pc.size = size
+	pc.garbage = 0
+	return nil
+}
+
+// Close removes the packfile. Readers of its entries keep reading them until
+// they're closed, since the packfile is only closed after them.
+func (pc *packfileCache) Close() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return nil
+	}
+	pc.closed = true
+	pc.pack.replace()
+	return os.RemoveAll(pc.directory)
+}
+
+func (pc *packfileCache) isClosed() bool {
+	pc.mu.RLock()
+	closed := pc.closed
+	pc.mu.RUnlock()
+	return closed
+}
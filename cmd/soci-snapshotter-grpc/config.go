@@ -0,0 +1,358 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// envOverridePrefix is the prefix of environment variables which override config values,
+	// e.g. SOCI_CONFIG_MAX_CONCURRENCY=10.
+	envOverridePrefix = "SOCI_CONFIG_"
+	// envKeySeparator separates the keys of nested tables in environment variables, since
+	// single underscores are part of the keys, e.g. SOCI_CONFIG_BACKGROUND_FETCH__DISABLE=true.
+	envKeySeparator = "__"
+)
+
+// overrideFlags are the values of -set flags, which override config values.
+type overrideFlags []string
+
+func (f *overrideFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *overrideFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// errUnknownConfigKey is returned for overrides of keys which don't match any config.
+var errUnknownConfigKey = errors.New("unknown config key")
+
+// override replaces the value of the config key at path.
+type override struct {
+	source string
+	path   []string
+	value  string
+	// ignoreUnknown only warns about unknown keys. The environment may be shared with
+	// other versions of the snapshotter, whose keys this version doesn't know.
+	ignoreUnknown bool
+}
+
+// loadConfig parses the config file at path. Keys which don't match any config
+// are rejected, so that typos don't silently leave the defaults in place.
+// A missing config file is only allowed at the default path.
+//
+// Values of the config file are overridden by the SOCI_CONFIG_ environment variables
+// in environ, which are overridden in turn by the key=value pairs of sets.
+func loadConfig(path string, environ, sets []string) (snapshotterConfig, error) {
+	var config snapshotterConfig
+	var r io.Reader = strings.NewReader("")
+	f, err := os.Open(path)
+	if err == nil {
+		defer f.Close()
+		r = f
+	} else if !(os.IsNotExist(err) && path == defaultConfigPath) {
+		return config, fmt.Errorf("failed to load config file %q: %w", path, err)
+	}
+	tree, err := toml.LoadReader(r)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	overrides := envOverrides(environ)
+	setOverrides, err := flagOverrides(sets)
+	if err != nil {
+		return config, err
+	}
+	if err := applyOverrides(tree, append(overrides, setOverrides...)); err != nil {
+		return config, err
+	}
+	// Defaults are only applied by the decoder, so an empty config is decoded as well.
+	if err := toml.NewDecoder(strings.NewReader(tree.String())).Strict(true).Decode(&config); err != nil {
+		return config, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("invalid config file %q: %w", path, err)
+	}
+	return config, nil
+}
+
+// validate checks that the values of c are in range.
+func (c *snapshotterConfig) validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	switch c.MetadataStore {
+	case "", dbMetadataType, flatMetadataType:
+	default:
+		return fmt.Errorf("unknown metadata_store %q; must be %q or %q", c.MetadataStore, dbMetadataType, flatMetadataType)
+	}
+	switch c.MetricsNetwork {
+	case "", "tcp", "unix":
+	default:
+		return fmt.Errorf("metrics_network must be \"tcp\" or \"unix\", got %q", c.MetricsNetwork)
+	}
+	for _, a := range c.AdditionalAddresses {
+		if a == "" {
+			return fmt.Errorf("additional_addresses must not contain empty addresses")
+		}
+	}
+	compaction := c.MetadataDBCompaction
+	if compaction.IntervalSec < 0 {
+		return fmt.Errorf("metadata_db_compaction.interval_sec must not be negative")
+	}
+	if compaction.Threshold < 0 || compaction.Threshold > 1 {
+		return fmt.Errorf("metadata_db_compaction.threshold must be between 0 and 1, got %v", compaction.Threshold)
+	}
+	return c.GRPC.validate()
+}
+
+// printConfig writes the effective config (including defaults) to w as TOML or JSON.
+func printConfig(w io.Writer, config snapshotterConfig, format string) error {
+	switch format {
+	case "toml":
+		b, err := toml.Marshal(config)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(config)
+	default:
+		return fmt.Errorf("unknown config format %q; must be \"toml\" or \"json\"", format)
+	}
+}
+
+// redactedValue replaces the values of secret-bearing config keys in diagnostic bundles.
+const redactedValue = "<redacted>"
+
+// redactConfig returns the config as a tree of TOML keys without the values which may
+// carry credentials or point at them, so that it can be shared in diagnostic bundles.
+func redactConfig(config snapshotterConfig) (map[string]interface{}, error) {
+	b, err := toml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	m := tree.ToMap()
+	redactSecrets(m)
+	return m, nil
+}
+
+func redactSecrets(m map[string]interface{}) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if isSecretKey(k) {
+				m[k] = redactedValue
+			} else {
+				redactSecrets(v)
+			}
+		case []interface{}:
+			for _, e := range v {
+				if e, ok := e.(map[string]interface{}); ok {
+					redactSecrets(e)
+				}
+			}
+			if isSecretKey(k) && len(v) > 0 {
+				m[k] = redactedValue
+			}
+		default:
+			if isSecretKey(k) && v != "" {
+				m[k] = redactedValue
+			}
+		}
+	}
+}
+
+// isSecretKey reports whether the values of the config key may be credentials,
+// or paths to files which contain them.
+func isSecretKey(k string) bool {
+	switch k {
+	case "auth", "headers", "kubeconfig_path", "key_file", "identitytoken":
+		return true
+	}
+	for _, s := range []string{"password", "secret", "token", "credential"} {
+		if strings.Contains(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func envOverrides(environ []string) []override {
+	var overrides []override
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envOverridePrefix) {
+			continue
+		}
+		name, value, _ := strings.Cut(kv, "=")
+		key := strings.ToLower(strings.TrimPrefix(name, envOverridePrefix))
+		overrides = append(overrides, override{
+			source:        name,
+			path:          strings.Split(key, envKeySeparator),
+			value:         value,
+			ignoreUnknown: true,
+		})
+	}
+	return overrides
+}
+
+func flagOverrides(sets []string) ([]override, error) {
+	var overrides []override
+	for _, kv := range sets {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -set %q; must be key=value", kv)
+		}
+		path, err := splitKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -set %q: %w", kv, err)
+		}
+		overrides = append(overrides, override{source: "-set " + key, path: path, value: value})
+	}
+	return overrides, nil
+}
+
+// splitKey splits a dotted config key (e.g. resolver.host."docker.io".mirrors) into its keys.
+func splitKey(key string) ([]string, error) {
+	var (
+		path   []string
+		cur    strings.Builder
+		quoted bool
+	)
+	for _, c := range key {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			path = append(path, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in key %q", key)
+	}
+	path = append(path, cur.String())
+	for _, k := range path {
+		if k == "" {
+			return nil, fmt.Errorf("empty key in %q", key)
+		}
+	}
+	return path, nil
+}
+
+func applyOverrides(tree *toml.Tree, overrides []override) error {
+	for _, o := range overrides {
+		t, err := configKeyType(reflect.TypeOf(snapshotterConfig{}), o.path)
+		if errors.Is(err, errUnknownConfigKey) && o.ignoreUnknown {
+			log.L.WithError(err).Warnf("ignoring %s", o.source)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", o.source, err)
+		}
+		v, err := parseOverride(t, o.value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value %q: %w", o.source, o.value, err)
+		}
+		tree.SetPath(o.path, v)
+	}
+	return nil
+}
+
+// configKeyType returns the type of the config value at path in the config type t.
+func configKeyType(t reflect.Type, path []string) (reflect.Type, error) {
+	for i, key := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := structField(t, key)
+			if !ok {
+				return nil, fmt.Errorf("%w %q", errUnknownConfigKey, strings.Join(path[:i+1], "."))
+			}
+			t = f.Type
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, fmt.Errorf("%w %q: %q is not a table", errUnknownConfigKey, strings.Join(path[:i+1], "."), strings.Join(path[:i], "."))
+		}
+	}
+	return t, nil
+}
+
+// structField returns the field of t with the toml key, including the fields of embedded structs without a key.
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if name == key {
+			return f, true
+		}
+		if name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if sf, ok := structField(f.Type, key); ok {
+				return sf, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// parseOverride parses the value of an override for a config value of type t.
+// Arrays and tables are written as TOML values, e.g. ["a", "b"].
+func parseOverride(t reflect.Type, value string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(value, 10, 63)
+		return int64(v), err
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	default:
+		tree, err := toml.Load("v = " + value)
+		if err != nil {
+			return nil, err
+		}
+		return tree.Get("v"), nil
+	}
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactConfig(t *testing.T) {
+	var config snapshotterConfig
+	config.KubeconfigKeychainConfig.KubeconfigPath = "/root/.kube/secret-config"
+	config.MetricsAddress = "localhost:8000"
+
+	redacted, err := redactConfig(config)
+	if err != nil {
+		t.Fatalf("failed to redact config: %v", err)
+	}
+	b, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	if strings.Contains(string(b), "secret-config") {
+		t.Fatalf("kubeconfig path wasn't redacted: %s", b)
+	}
+	if !strings.Contains(string(b), "localhost:8000") {
+		t.Fatalf("metrics address was redacted: %s", b)
+	}
+}
+
+func TestLoadGRPCConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[grpc]\nmax_recv_message_size = 16777216\nkeepalive_permit_without_stream = true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, []string{"SOCI_CONFIG_GRPC__KEEPALIVE_MIN_TIME_SEC=10"}, nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	want := GRPCConfig{MaxRecvMessageSize: 16777216, KeepaliveMinTimeSec: 10, KeepalivePermitWithoutStream: true}
+	if config.GRPC != want {
+		t.Errorf("grpc config is %+v; want %+v", config.GRPC, want)
+	}
+	if n := len(config.GRPC.serverOptions()); n != 2 {
+		t.Errorf("got %d server options; want 2", n)
+	}
+
+	if _, err := loadConfig(path, nil, []string{"grpc.keepalive_time_sec=-1"}); err == nil {
+		t.Errorf("negative keepalive time was accepted")
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    []string
+		wantErr bool
+	}{
+		{key: "max_concurrency", want: []string{"max_concurrency"}},
+		{key: "background_fetch.disable", want: []string{"background_fetch", "disable"}},
+		{key: `resolver.host."docker.io".mirrors`, want: []string{"resolver", "host", "docker.io", "mirrors"}},
+		{key: `resolver.host."registry:5000".mirrors`, want: []string{"resolver", "host", "registry:5000", "mirrors"}},
+		{key: `resolver.host."docker.io`, wantErr: true},
+		{key: "", wantErr: true},
+		{key: "background_fetch.", wantErr: true},
+		{key: "background_fetch..disable", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := splitKey(tt.key)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to split key: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"SOCI_CONFIG_MAX_CONCURRENCY=10",
+		"SOCI_CONFIG_BACKGROUND_FETCH__FETCH_PERIOD_MSEC=100",
+		"SOCI_CONFIG_METRICS_ADDRESS=localhost:8000=x",
+		"SOCI_CONFIGMAX_CONCURRENCY=1",
+	}
+	want := []override{
+		{source: "SOCI_CONFIG_MAX_CONCURRENCY", path: []string{"max_concurrency"}, value: "10", ignoreUnknown: true},
+		{source: "SOCI_CONFIG_BACKGROUND_FETCH__FETCH_PERIOD_MSEC", path: []string{"background_fetch", "fetch_period_msec"}, value: "100", ignoreUnknown: true},
+		{source: "SOCI_CONFIG_METRICS_ADDRESS", path: []string{"metrics_address"}, value: "localhost:8000=x", ignoreUnknown: true},
+	}
+	if got := envOverrides(environ); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestParseOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    []string
+		value   string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "string", path: []string{"metrics_address"}, value: "localhost:8000", want: "localhost:8000"},
+		{name: "bool", path: []string{"background_fetch", "disable"}, value: "true", want: true},
+		{name: "invalid bool", path: []string{"background_fetch", "disable"}, value: "yes please", wantErr: true},
+		{name: "int", path: []string{"max_concurrency"}, value: "10", want: int64(10)},
+		{name: "invalid int", path: []string{"max_concurrency"}, value: "ten", wantErr: true},
+		{name: "array", path: []string{"additional_addresses"}, value: `["/run/a.sock", "/run/b.sock"]`, want: []interface{}{"/run/a.sock", "/run/b.sock"}},
+		{name: "invalid array", path: []string{"additional_addresses"}, value: `["/run/a.sock"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, err := configKeyType(reflect.TypeOf(snapshotterConfig{}), tt.path)
+			if err != nil {
+				t.Fatalf("failed to find config key: %v", err)
+			}
+			got, err := parseOverride(typ, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse override: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v; want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigKeyType(t *testing.T) {
+	for _, path := range [][]string{
+		{"no_such_key"},
+		{"background_fetch", "no_such_key"},
+		{"max_concurrency", "nested"},
+	} {
+		if _, err := configKeyType(reflect.TypeOf(snapshotterConfig{}), path); !errors.Is(err, errUnknownConfigKey) {
+			t.Errorf("expected unknown config key error for %q, got %v", path, err)
+		}
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("max_concurrency = 1\nmetrics_address = \"file\"\n[background_fetch]\nfetch_period_msec = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"SOCI_CONFIG_MAX_CONCURRENCY=2",
+		"SOCI_CONFIG_METRICS_ADDRESS=env",
+		"SOCI_CONFIG_NO_SUCH_KEY=1",
+	}
+	sets := []string{
+		"max_concurrency=3",
+		`resolver.host."docker.io".mirrors=[{host = "mirror.example.com"}]`,
+	}
+	config, err := loadConfig(path, environ, sets)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if config.MaxConcurrency != 3 {
+		t.Errorf("max_concurrency is %d; want the value of -set", config.MaxConcurrency)
+	}
+	if config.MetricsAddress != "env" {
+		t.Errorf("metrics_address is %q; want the value of the environment", config.MetricsAddress)
+	}
+	if config.BackgroundFetchConfig.FetchPeriodMsec != 1 {
+		t.Errorf("background_fetch.fetch_period_msec is %d; want the value of the config file", config.BackgroundFetchConfig.FetchPeriodMsec)
+	}
+	mirrors := config.ResolverConfig.Host["docker.io"].Mirrors
+	if len(mirrors) != 1 || mirrors[0].Host != "mirror.example.com" {
+		t.Errorf("docker.io mirrors are %+v; want mirror.example.com", mirrors)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		environ []string
+		sets    []string
+	}{
+		{name: "unknown -set key", sets: []string{"no_such_key=1"}},
+		{name: "invalid -set", sets: []string{"max_concurrency"}},
+		{name: "invalid environment value", environ: []string{"SOCI_CONFIG_MAX_CONCURRENCY=ten"}},
+		{name: "invalid environment nesting", environ: []string{"SOCI_CONFIG_BACKGROUND_FETCH=true"}},
+	} {
+		if _, err := loadConfig(path, tt.environ, tt.sets); err == nil {
+			t.Errorf("%s was accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// dbStatsInterval is how often the sizes and page allocations of the DBs are updated.
+	dbStatsInterval = time.Minute
+
+	defaultMetadataDBCompactThreshold = 0.5
+)
+
+// DBCompactionConfig is config for the compaction of the metadata DB, whose file
+// never shrinks as layers are unmounted.
+type DBCompactionConfig struct {
+	// IntervalSec is how often (in seconds) the metadata DB is checked for compaction
+	// while the snapshotter is running. 0 disables periodic compaction.
+	IntervalSec int64 `toml:"interval_sec"`
+
+	// Threshold is the fraction of the DB file which must be free for the DB to be
+	// compacted periodically. Defaults to 0.5.
+	Threshold float64 `toml:"threshold"`
+}
+
+// maintainDBs reports the sizes of the DB files and the page allocations of the
+// metadata DB, and compacts the metadata DB periodically until ctx is done.
+func maintainDBs(ctx context.Context, db *metadata.DB, cfg DBCompactionConfig) {
+	threshold := cfg.Threshold
+	if threshold == 0 {
+		threshold = defaultMetadataDBCompactThreshold
+	}
+	compactInterval := time.Duration(cfg.IntervalSec) * time.Second
+	lastCheck := time.Now()
+
+	var pages dbPageAllocations
+	updateDBStats(db, &pages)
+	t := time.NewTicker(dbStatsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if compactInterval > 0 && now.Sub(lastCheck) >= compactInterval {
+				lastCheck = now
+				ratio, err := db.FreeRatio()
+				if err != nil {
+					log.G(ctx).WithError(err).Warn("failed to get free pages of metadata DB")
+				} else if ratio >= threshold {
+					log.G(ctx).WithField("free", ratio).Info("compacting metadata DB")
+					compactMetadataDB(ctx, db)
+				}
+			}
+			updateDBStats(db, &pages)
+		}
+	}
+}
+
+func compactMetadataDB(ctx context.Context, db *metadata.DB) (dbutil.CompactStats, error) {
+	stats, err := db.Compact()
+	commonmetrics.IncDBCompactionCount(commonmetrics.MetadataDB, err)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to compact metadata DB")
+		return stats, err
+	}
+	log.G(ctx).WithField("before", stats.SizeBefore).WithField("after", stats.SizeAfter).Info("compacted metadata DB")
+	commonmetrics.SetDBFileSize(commonmetrics.MetadataDB, stats.SizeAfter)
+	return stats, nil
+}
+
+// dbPageAllocations are the page allocations of the metadata DB which were last reported.
+type dbPageAllocations struct {
+	pages int64
+	bytes int64
+}
+
+func updateDBStats(db *metadata.DB, reported *dbPageAllocations) {
+	pages, bytes := db.PageAllocations()
+	commonmetrics.AddDBPageAllocations(commonmetrics.MetadataDB, pages-reported.pages, bytes-reported.bytes)
+	reported.pages, reported.bytes = pages, bytes
+
+	if size, err := dbutil.FileSize(db.Path()); err == nil {
+		commonmetrics.SetDBFileSize(commonmetrics.MetadataDB, size)
+	}
+	// The artifacts DB is written by the soci CLI, so it might not exist.
+	if size, err := dbutil.FileSize(soci.ArtifactsDbPath()); err == nil {
+		commonmetrics.SetDBFileSize(commonmetrics.ArtifactsDB, size)
+	}
+}
+
+// compactHandler compacts the metadata DB on demand (e.g. `soci db compact`).
+func compactHandler(ctx context.Context, db *metadata.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		stats, err := compactMetadataDB(ctx, db)
+		if err != nil {
+			http.Error(w, "failed to compact metadata DB: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write compaction response")
+		}
+	})
+}
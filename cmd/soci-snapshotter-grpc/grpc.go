@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// GRPCConfig is config for the gRPC server of the snapshotter, which containerd
+// connects to. Values which are 0 use the defaults of gRPC.
+type GRPCConfig struct {
+	// MaxRecvMessageSize is the maximum size in bytes of a message the server
+	// receives. Defaults to 4 MiB.
+	MaxRecvMessageSize int `toml:"max_recv_message_size"`
+
+	// MaxSendMessageSize is the maximum size in bytes of a message the server sends.
+	MaxSendMessageSize int `toml:"max_send_message_size"`
+
+	// MaxConcurrentStreams is the maximum number of concurrent streams (i.e. calls)
+	// per connection.
+	MaxConcurrentStreams uint32 `toml:"max_concurrent_streams"`
+
+	// KeepaliveTimeSec is how long (in seconds) a connection is idle before the
+	// server pings the client. Defaults to 2 hours.
+	KeepaliveTimeSec int64 `toml:"keepalive_time_sec"`
+
+	// KeepaliveTimeoutSec is how long (in seconds) the server waits for the reply to
+	// a ping before it closes the connection. Defaults to 20 seconds.
+	KeepaliveTimeoutSec int64 `toml:"keepalive_timeout_sec"`
+
+	// KeepaliveMinTimeSec is the minimum time (in seconds) clients should wait
+	// between pings. Clients which ping more often are disconnected. Defaults to 5
+	// minutes.
+	KeepaliveMinTimeSec int64 `toml:"keepalive_min_time_sec"`
+
+	// KeepalivePermitWithoutStream allows clients to ping when there are no calls in
+	// progress. Otherwise, such clients are disconnected.
+	KeepalivePermitWithoutStream bool `toml:"keepalive_permit_without_stream"`
+}
+
+// validate checks that the values of c are in range.
+func (c GRPCConfig) validate() error {
+	for _, v := range []struct {
+		key   string
+		value int64
+	}{
+		{"max_recv_message_size", int64(c.MaxRecvMessageSize)},
+		{"max_send_message_size", int64(c.MaxSendMessageSize)},
+		{"keepalive_time_sec", c.KeepaliveTimeSec},
+		{"keepalive_timeout_sec", c.KeepaliveTimeoutSec},
+		{"keepalive_min_time_sec", c.KeepaliveMinTimeSec},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("grpc.%s must not be negative", v.key)
+		}
+	}
+	return nil
+}
+
+// serverOptions returns the options of the gRPC server.
+func (c GRPCConfig) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if c.MaxRecvMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMessageSize))
+	}
+	if c.MaxSendMessageSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMessageSize))
+	}
+	if c.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.KeepaliveTimeSec > 0 || c.KeepaliveTimeoutSec > 0 {
+		// gRPC uses its defaults for the parameters which are 0.
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    time.Duration(c.KeepaliveTimeSec) * time.Second,
+			Timeout: time.Duration(c.KeepaliveTimeoutSec) * time.Second,
+		}))
+	}
+	if c.KeepaliveMinTimeSec > 0 || c.KeepalivePermitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Duration(c.KeepaliveMinTimeSec) * time.Second,
+			PermitWithoutStream: c.KeepalivePermitWithoutStream,
+		}))
+	}
+	return opts
+}
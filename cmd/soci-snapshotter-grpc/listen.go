@@ -0,0 +1,76 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// activatedAPIName is the FileDescriptorName of a systemd socket which is used for the API
+// instead of the gRPC server.
+const activatedAPIName = "api"
+
+// listenUnix listens on the Unix domain socket at addr. Addresses starting with "@"
+// are sockets in the abstract namespace, which don't have a file.
+func listenUnix(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "@") {
+		// Prepare the directory for the socket
+		if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
+		}
+		// Try to remove the socket file to avoid EADDRINUSE
+		if err := os.RemoveAll(addr); err != nil {
+			return nil, fmt.Errorf("failed to remove %q: %w", addr, err)
+		}
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error on listen socket %q: %w", addr, err)
+	}
+	return l, nil
+}
+
+// activatedListeners returns the sockets passed by systemd socket activation, split into the
+// ones for the gRPC server and the ones for the API (named activatedAPIName).
+// The sockets stay open in systemd while the snapshotter restarts, so that clients aren't
+// refused in the meantime.
+func activatedListeners() (grpcLs, apiLs []net.Listener, err error) {
+	named, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get sockets from systemd: %w", err)
+	}
+	for name, ls := range named {
+		for _, l := range ls {
+			if l == nil {
+				// Not a socket which can be listened on, e.g. a FIFO.
+				continue
+			}
+			if name == activatedAPIName {
+				apiLs = append(apiLs, l)
+			} else {
+				grpcLs = append(grpcLs, l)
+			}
+		}
+	}
+	return grpcLs, apiLs, nil
+}
@@ -36,7 +36,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	golog "log"
 	"math/rand"
 	"net"
@@ -49,14 +48,21 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/awslabs/soci-snapshotter/fs"
+	fsconfig "github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/progress"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/service"
 	"github.com/awslabs/soci-snapshotter/service/keychain/cri"
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/service/keychain/kubeconfig"
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/diagnostics"
+	"github.com/awslabs/soci-snapshotter/util/fips"
 	"github.com/awslabs/soci-snapshotter/version"
-	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
 	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/defaults"
@@ -65,7 +71,6 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
 	metrics "github.com/docker/go-metrics"
-	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sys/unix"
@@ -82,6 +87,7 @@ const (
 	defaultRootDir             = "/var/lib/soci-snapshotter-grpc"
 	defaultImageServiceAddress = "/run/containerd/containerd.sock"
 	defaultMetricsNetwork      = "tcp"
+	diagnosticsErrorRingSize   = 100
 )
 
 var (
@@ -90,8 +96,16 @@ var (
 	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
 	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
 	printVersion = flag.Bool("version", false, "print the version")
+
+	validateConfig = flag.Bool("validate-config", false, "validate the configuration file, print the effective configuration and exit")
+	configFormat   = flag.String("config-format", "toml", "format of the configuration printed by -validate-config [toml, json]")
+	configSets     overrideFlags
 )
 
+func init() {
+	flag.Var(&configSets, "set", "override a configuration value, e.g. -set background_fetch.disable=true. Can be specified multiple times")
+}
+
 type snapshotterConfig struct {
 	service.Config
 
@@ -107,8 +121,24 @@ type snapshotterConfig struct {
 	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
 	DebugAddress string `toml:"debug_address"`
 
+	// APIAddress is a Unix domain socket address where the snapshotter exposes its API
+	// (e.g. for prefetching images). The API is disabled unless it's set or the socket
+	// is passed by systemd. The soci CLI uses /run/soci-snapshotter-grpc/soci-api.sock
+	// by default.
+	APIAddress string `toml:"api_address"`
+
+	// AdditionalAddresses are Unix domain socket addresses where the gRPC server listens
+	// in addition to -address. Addresses starting with "@" are abstract sockets.
+	AdditionalAddresses []string `toml:"additional_addresses"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"db"`
+
+	// MetadataDBCompaction is config for the compaction of the metadata DB.
+	MetadataDBCompaction DBCompactionConfig `toml:"metadata_db_compaction"`
+
+	// GRPC is config for the gRPC server of the snapshotter.
+	GRPC GRPCConfig `toml:"grpc"`
 }
 
 func main() {
@@ -120,17 +150,29 @@ func main() {
 	}
 	if *printVersion {
 		fmt.Println("soci-snapshotter-grpc version", version.Version, version.Revision)
+		fmt.Println("crypto:", fips.Mode())
+		return
+	}
+	if *validateConfig {
+		config, err := loadConfig(*configPath, os.Environ(), configSets)
+		if err == nil {
+			err = printConfig(os.Stdout, config, *configFormat)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
 	}
 	logrus.SetLevel(lvl)
 	logrus.SetFormatter(&logrus.JSONFormatter{
 		TimestampFormat: log.RFC3339NanoFixed,
 	})
+	errorRing := diagnostics.NewErrorRing(diagnosticsErrorRingSize)
+	logrus.AddHook(errorRing)
+	diagnostics.Register("errors", errorRing.Provider())
 
-	var (
-		ctx, cancel = context.WithCancel(log.WithLogger(context.Background(), log.L))
-		config      snapshotterConfig
-	)
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.L))
 	defer cancel()
 	// Streams log of standard lib (go-fuse uses this) into debug log
 	// Snapshotter should use "github.com/containerd/containerd/log" otherwize
@@ -139,31 +181,54 @@ func main() {
 	log.G(ctx).WithFields(logrus.Fields{
 		"version":  version.Version,
 		"revision": version.Revision,
+		"zlib":     compression.ZlibImplementation + " " + compression.ZlibVersion(),
+		"crypto":   fips.Mode(),
 	}).Info("starting soci-snapshotter-grpc")
 
 	// Get configuration from specified file
-	tree, err := toml.LoadFile(*configPath)
-	if err != nil && !(os.IsNotExist(err) && *configPath == defaultConfigPath) {
-		log.G(ctx).WithError(err).Fatalf("failed to load config file %q", *configPath)
-	}
-	if err := tree.Unmarshal(&config); err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to unmarshal config file %q", *configPath)
+	config, err := loadConfig(*configPath, os.Environ(), configSets)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to load config")
 	}
+	diagnostics.Register("config", func() (interface{}, error) {
+		redacted, err := redactConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Version  string                 `json:"version"`
+			Revision string                 `json:"revision"`
+			Root     string                 `json:"root"`
+			Config   map[string]interface{} `json:"config"`
+		}{version.Version, version.Revision, *rootDir, redacted}, nil
+	})
 
-	if err := service.Supported(*rootDir); err != nil {
+	if err := service.PrepareDirectories(ctx, *rootDir, config.DirectoriesConfig); err != nil {
 		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
 	}
+	// repair the state left by an unclean shutdown before anything uses it.
+	reconcileReport := service.Reconcile(ctx, *rootDir, config.DirectoriesConfig, soci.ArtifactsDbPath(), fsconfig.SociContentStorePath)
+	diagnostics.Register("reconcile", func() (interface{}, error) { return reconcileReport, nil })
 
 	// Create a gRPC server
-	rpc := grpc.NewServer()
+	rpc := grpc.NewServer(config.GRPC.serverOptions()...)
 
 	// Configure keychain
 	credsFuncs := []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)}
+	var fsOpts []fs.Option
+	// podTenants records the namespaces of the pods which pulled each image through the CRI keychain.
+	var podTenants *tenants.Tenants
+	if config.Config.KubeconfigKeychainConfig.IsolateNamespaces {
+		podTenants = tenants.New()
+	}
 	if config.Config.KubeconfigKeychainConfig.EnableKeychain {
 		var opts []kubeconfig.Option
 		if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
 			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
 		}
+		if podTenants != nil {
+			opts = append(opts, kubeconfig.WithTenants(podTenants))
+		}
 		credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
 	}
 	if config.Config.CRIKeychainConfig.EnableKeychain {
@@ -192,23 +257,32 @@ func main() {
 			}
 			return runtime.NewImageServiceClient(conn), nil
 		}
-		f, criServer := cri.NewCRIKeychain(ctx, connectCRI)
+		// pullProgress records the phases of lazy pulls for ImageStatus.
+		pullProgress := progress.New()
+		fsOpts = append(fsOpts, fs.WithPullProgress(pullProgress))
+		f, criServer := cri.NewCRIKeychain(ctx, connectCRI, cri.WithSnapshotterRoot(*rootDir),
+			cri.WithTenants(podTenants), cri.WithPullProgress(pullProgress))
 		runtime.RegisterImageServiceServer(rpc, criServer)
 		credsFuncs = append(credsFuncs, f)
 	}
-	var fsOpts []fs.Option
-	mt, err := getMetadataStore(*rootDir, config)
+	mt, db, err := getMetadataStore(*rootDir, config)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure metadata store")
 	}
 	fsOpts = append(fsOpts, fs.WithMetadataStore(mt))
+	apiMux := http.NewServeMux()
+	if db != nil {
+		apiMux.Handle(metadata.CompactPath, compactHandler(ctx, db))
+		go maintainDBs(ctx, db, config.MetadataDBCompaction)
+	}
+	fsOpts = append(fsOpts, fs.WithAPIMux(apiMux))
 	rs, err := service.NewSociSnapshotterService(ctx, *rootDir, &config.Config,
 		service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
 
-	cleanup, err := serve(ctx, rpc, *address, rs, config)
+	cleanup, err := serve(ctx, rpc, *address, rs, config, apiMux)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
@@ -220,23 +294,15 @@ func main() {
 	log.G(ctx).Info("Exiting")
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig) (bool, error) {
-	// Convert the snapshotter to a gRPC service,
-	snsvc := snapshotservice.FromSnapshotter(rs)
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig, apiMux *http.ServeMux) (bool, error) {
+	// Convert the snapshotter to a gRPC service, measuring its operations.
+	instrumented := snapshot.Instrument(rs)
+	apiMux.Handle(snapshot.OperationsPath, instrumented.OperationsHandler(ctx))
+	snsvc := snapshotservice.FromSnapshotter(instrumented)
 
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
 
-	// Prepare the directory for the socket
-	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
-		return false, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(addr), err)
-	}
-
-	// Try to remove the socket file to avoid EADDRINUSE
-	if err := os.RemoveAll(addr); err != nil {
-		return false, fmt.Errorf("failed to remove %q: %w", addr, err)
-	}
-
 	errCh := make(chan error, 1)
 
 	var cleanupFns []func() error
@@ -267,6 +333,7 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 
 	if config.DebugAddress != "" {
 		log.G(ctx).Infof("listen %q for debugging", config.DebugAddress)
+		http.Handle("/debug/dump", diagnostics.Handler())
 		go func() {
 			if err := http.ListenAndServe(config.DebugAddress, nil); err != nil {
 				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", addr, err)
@@ -274,17 +341,55 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}()
 	}
 
-	// Listen and serve
-	l, err := net.Listen("unix", addr)
+	// Sockets passed by systemd replace the ones at the configured addresses.
+	grpcLs, apiLs, err := activatedListeners()
 	if err != nil {
-		return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
+		return false, err
 	}
-	cleanupFns = append(cleanupFns, l.Close)
-	go func() {
-		if err := rpc.Serve(l); err != nil {
-			errCh <- fmt.Errorf("error on serving via socket %q: %w", addr, err)
+	if len(grpcLs) > 0 {
+		log.G(ctx).Infof("serving gRPC on %d socket(s) from systemd", len(grpcLs))
+	}
+	if len(apiLs) == 0 && config.APIAddress != "" {
+		apiL, err := listenUnix(config.APIAddress)
+		if err != nil {
+			return false, err
 		}
-	}()
+		apiLs = append(apiLs, apiL)
+	}
+	if len(apiLs) == 0 {
+		log.G(ctx).Debug("API socket is not configured")
+	}
+	for _, apiL := range apiLs {
+		apiL := apiL
+		cleanupFns = append(cleanupFns, apiL.Close)
+		go func() {
+			if err := http.Serve(apiL, apiMux); err != nil {
+				errCh <- fmt.Errorf("error on serving API via socket %q: %w", apiL.Addr(), err)
+			}
+		}()
+	}
+
+	// Listen and serve
+	var addrs []string
+	if len(grpcLs) == 0 {
+		addrs = append(addrs, addr)
+	}
+	for _, a := range append(addrs, config.AdditionalAddresses...) {
+		l, err := listenUnix(a)
+		if err != nil {
+			return false, err
+		}
+		grpcLs = append(grpcLs, l)
+	}
+	for _, l := range grpcLs {
+		l := l
+		cleanupFns = append(cleanupFns, l.Close)
+		go func() {
+			if err := rpc.Serve(l); err != nil {
+				errCh <- fmt.Errorf("error on serving via socket %q: %w", l.Addr(), err)
+			}
+		}()
+	}
 
 	if os.Getenv("NOTIFY_SOCKET") != "" {
 		notified, notifyErr := sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
@@ -297,6 +402,21 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}
 	}()
 
+	// Dump a diagnostic bundle on SIGUSR1
+	dumpCh := make(chan os.Signal, 1)
+	signal.Notify(dumpCh, unix.SIGUSR1)
+	defer signal.Stop(dumpCh)
+	go func() {
+		for range dumpCh {
+			path, err := diagnostics.DumpToFile(filepath.Join(*rootDir, "diagnostics"))
+			if err != nil {
+				log.G(ctx).WithError(err).Error("failed to dump diagnostics")
+				continue
+			}
+			log.G(ctx).Infof("dumped diagnostics to %q", path)
+		}
+	}()
+
 	var s os.Signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
@@ -313,10 +433,12 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 }
 
 const (
-	dbMetadataType = "db"
+	dbMetadataType   = "db"
+	flatMetadataType = "flat"
 )
 
-func getMetadataStore(rootDir string, config snapshotterConfig) (metadata.Store, error) {
+// getMetadataStore returns the configured metadata store, and the DB it's stored in if it's a DB.
+func getMetadataStore(rootDir string, config snapshotterConfig) (metadata.Store, *metadata.DB, error) {
 	switch config.MetadataStore {
 	case "", dbMetadataType:
 		bOpts := bolt.Options{
@@ -324,15 +446,33 @@ func getMetadataStore(rootDir string, config snapshotterConfig) (metadata.Store,
 			InitialMmapSize: 64 * 1024 * 1024,
 			FreelistType:    bolt.FreelistMapType,
 		}
-		db, err := bolt.Open(filepath.Join(rootDir, "metadata.db"), 0600, &bOpts)
+		if config.CacheEncryptionConfig.Enable {
+			// the metadata of layers would be stored unencrypted on disk. The DB
+			// only holds the metadata of the layers in use, which is rebuilt from
+			// their ztocs, so nothing is lost when it's gone on restart.
+			db, err := metadata.OpenMemoryDB(&bOpts)
+			if err != nil {
+				return nil, nil, err
+			}
+			return db.NewReader, nil, nil
+		}
+		db, err := metadata.OpenDB(config.DirectoriesConfig.MetadataDBPath(rootDir), &bOpts)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		return db.NewReader, db, nil
+	case flatMetadataType:
+		dir := config.DirectoriesConfig.MetadataIndexDir(rootDir)
+		if config.CacheEncryptionConfig.Enable {
+			dir = "" // keep the indexes in memory, as with the DB.
+		}
+		store, err := metadata.NewFlatStore(dir)
+		if err != nil {
+			return nil, nil, err
 		}
-		return func(sr *io.SectionReader, toc *ztoc.Ztoc, opts ...metadata.Option) (metadata.Reader, error) {
-			return metadata.NewReader(db, sr, toc, opts...)
-		}, nil
+		return store.NewReader, nil, nil
 	default:
-		return nil, fmt.Errorf("unknown metadata store type: %v; must be %v",
-			config.MetadataStore, dbMetadataType)
+		return nil, nil, fmt.Errorf("unknown metadata store type: %v; must be %v or %v",
+			config.MetadataStore, dbMetadataType, flatMetadataType)
 	}
 }
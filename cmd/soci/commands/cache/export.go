@@ -0,0 +1,111 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+const outputFlag = "output"
+
+var exportCommand = cli.Command{
+	Name:      "export",
+	Usage:     "export the cached spans of a lazily pulled image",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `write the spans of the image's lazily loaded layers which are cached by the
+   snapshotter to a bundle, which can be imported into the cache of another node
+   with "soci cache import". Use "soci prefetch" first to export all spans of the image.`,
+	Flags: append(
+		internal.PlatformFlags,
+		internal.APIAddressFlag,
+		cli.StringFlag{
+			Name:  outputFlag + ", o",
+			Usage: "path of the bundle to write",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return errors.New("image needs to be specified")
+		}
+		output := cliContext.String(outputFlag)
+		if output == "" {
+			return errors.New("output needs to be specified")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+		layers, err := internal.GetLayers(ctx, cs, img, ps)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(fs.CacheExportRequest{Layers: layers})
+		if err != nil {
+			return err
+		}
+		resp, err := internal.PostAPI(ctx, cliContext.String(internal.APIAddressFlagKey), fs.CacheExportPath, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to export cache: %w", err)
+		}
+		defer resp.Body.Close()
+
+		// write to a temporary file so that a failed export doesn't leave a truncated bundle behind.
+		f, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".tmp-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		n, err := io.Copy(f, resp.Body)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to export cache: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), output); err != nil {
+			return err
+		}
+		fmt.Printf("exported cache of %s to %s (%d bytes)\n", ref, output, n)
+		return nil
+	},
+}
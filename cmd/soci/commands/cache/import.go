@@ -0,0 +1,70 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+var importCommand = cli.Command{
+	Name:      "import",
+	Usage:     "import a bundle exported with \"soci cache export\"",
+	ArgsUsage: "[flags] <bundle>",
+	Description: `import the spans in a bundle into the cache of the snapshotter. Spans are keyed
+   by layer digest and ztoc digest, so they're used by layers lazily loaded with the same
+   SOCI index, whether the image is pulled before or after the import. Spans are verified
+   against the ztoc before they're used.`,
+	Flags: []cli.Flag{
+		internal.APIAddressFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		bundle := cliContext.Args().First()
+		if bundle == "" {
+			return errors.New("bundle needs to be specified")
+		}
+		f, err := os.Open(bundle)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		resp, err := internal.PostAPI(ctx, cliContext.String(internal.APIAddressFlagKey), fs.CacheImportPath, "application/x-tar", f)
+		if err != nil {
+			return fmt.Errorf("failed to import cache: %w", err)
+		}
+		defer resp.Body.Close()
+		var result fs.CacheImportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to decode cache import response: %w", err)
+		}
+		fmt.Printf("imported %d spans (%d into lazily loaded layers, %d rejected)\n", result.Spans, result.Imported, result.Rejected)
+		if result.Rejected > 0 {
+			return fmt.Errorf("%d spans failed verification", result.Rejected)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli"
+)
+
+// bashCompletion completes soci in bash with the suggestions of --generate-bash-completion.
+const bashCompletion = `_soci_bash_autocomplete() {
+  if [[ "${COMP_WORDS[0]}" != "source" ]]; then
+    local cur opts
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ "$cur" == "-"* ]]; then
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion )
+    else
+      opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion )
+    fi
+    COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+    return 0
+  fi
+}
+
+complete -o bashdefault -o default -o nospace -F _soci_bash_autocomplete soci
+`
+
+// zshCompletion completes soci in zsh with the suggestions of --generate-bash-completion,
+// which include their usage with _CLI_ZSH_AUTOCOMPLETE_HACK.
+const zshCompletion = `#compdef soci
+
+_soci_zsh_autocomplete() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion)}")
+  else
+    opts=("${(@f)$(_CLI_ZSH_AUTOCOMPLETE_HACK=1 ${words[@]:0:#words[@]-1} --generate-bash-completion)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+compdef _soci_zsh_autocomplete soci
+`
+
+// CompletionCommand prints the completion scripts of soci for shells.
+var CompletionCommand = cli.Command{
+	Name:      "completion",
+	Usage:     "print the completion script of a shell (bash, zsh or fish)",
+	ArgsUsage: "<bash|zsh|fish>",
+	Description: `print the script which completes the commands and flags of soci in a shell.
+   To enable it, source the output in the shell's profile, e.g.
+
+   source <(soci completion bash)                       # bash
+   source <(soci completion zsh)                        # zsh
+   soci completion fish > ~/.config/fish/completions/soci.fish  # fish`,
+	Action: func(cliContext *cli.Context) error {
+		switch shell := cliContext.Args().First(); shell {
+		case "bash":
+			fmt.Print(bashCompletion)
+		case "zsh":
+			fmt.Print(zshCompletion)
+		case "fish":
+			script, err := cliContext.App.ToFishCompletion()
+			if err != nil {
+				return fmt.Errorf("failed to generate fish completion: %w", err)
+			}
+			fmt.Print(script)
+		case "":
+			return errors.New("please provide a shell (bash, zsh or fish)")
+		default:
+			return fmt.Errorf("unsupported shell %q, must be bash, zsh or fish", shell)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,372 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/converter/zstdchunked"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	formatFlag           = "format"
+	chunkSizeFlag        = "chunk-size"
+	zstdLevelFlag        = "zstd-level"
+	zstdChunkedFormat    = "zstd:chunked"
+	defaultZstdLevel     = 3
+	convertRefPrefix     = "soci-convert-"
+	gcRefContentPrefix   = "containerd.io/gc.ref.content."
+	gcRefContentConfig   = gcRefContentPrefix + "config"
+	gcRefContentLayer    = gcRefContentPrefix + "l."
+	gcRefContentManifest = gcRefContentPrefix + "m."
+)
+
+// ConvertCommand converts the layers of an image into a different format.
+var ConvertCommand = cli.Command{
+	Name:      "convert",
+	Usage:     "convert an image",
+	ArgsUsage: "[flags] <source_ref> <target_ref>",
+	Description: `convert the gzip layers of an image and store the result as a new image.
+   With --format zstd:chunked, the layers are converted into zstd:chunked, which can be
+   lazily pulled by podman and CRI-O, and pulled as regular zstd layers by other clients.
+   The chunk boundaries are placed using the ztocs of the layers if they exist (see "soci create").`,
+	Flags: append(
+		internal.PlatformFlags,
+		cli.StringFlag{
+			Name:  formatFlag,
+			Usage: "format to convert the layers into. Supported formats: " + zstdChunkedFormat,
+			Value: zstdChunkedFormat,
+		},
+		cli.Int64Flag{
+			Name:  chunkSizeFlag,
+			Usage: "maximum size of a chunk of file contents. Larger files are split into multiple chunks. Defaults to the span size of the layer's ztoc, or 4 MiB",
+		},
+		cli.IntFlag{
+			Name:  zstdLevelFlag,
+			Usage: "zstd compression level",
+			Value: defaultZstdLevel,
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		dstRef := cliContext.Args().Get(1)
+		if srcRef == "" || dstRef == "" {
+			return errors.New("source and target images need to be specified")
+		}
+		if format := cliContext.String(formatFlag); format != zstdChunkedFormat {
+			return fmt.Errorf("unsupported format %q. supported formats: [%s]", format, zstdChunkedFormat)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		is := client.ImageService()
+		srcImg, err := is.Get(ctx, srcRef)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, srcImg, cs)
+		if err != nil {
+			return err
+		}
+
+		c := &imageConverter{
+			cs:        cs,
+			chunkSize: cliContext.Int64(chunkSizeFlag),
+			level:     cliContext.Int(zstdLevelFlag),
+			converted: make(map[digest.Digest]ocispec.Descriptor),
+		}
+		// ztocs are optional; they are only used to place the chunk boundaries without parsing the tar.
+		if _, err := os.Stat(config.SociContentStorePath); err == nil {
+			if c.blobStore, err = oci.New(config.SociContentStorePath); err != nil {
+				return err
+			}
+			if c.artifactsDb, err = soci.NewDB(soci.ArtifactsDbPath()); err != nil {
+				return err
+			}
+		}
+
+		target, err := c.convertTarget(ctx, srcImg.Target, platforms.Any(ps...))
+		if err != nil {
+			return err
+		}
+
+		img := images.Image{
+			Name:   dstRef,
+			Target: target,
+		}
+		if _, err := is.Create(ctx, img); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, img); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("converted %s to %s (%s)\n", srcRef, dstRef, target.Digest)
+		return nil
+	},
+}
+
+type imageConverter struct {
+	cs          content.Store
+	blobStore   *oci.Store
+	artifactsDb *soci.ArtifactsDb
+	chunkSize   int64
+	level       int
+
+	// converted maps the digests of converted layers to their converted descriptors.
+	converted map[digest.Digest]ocispec.Descriptor
+}
+
+// convertTarget converts the manifest, or the manifests in the index, matching platform.
+func (c *imageConverter) convertTarget(ctx context.Context, desc ocispec.Descriptor, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	switch soci.NormalizeMediaType(desc.MediaType) {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		return c.convertManifest(ctx, desc)
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("unsupported media type %s", desc.MediaType)
+	}
+
+	b, err := content.ReadBlob(ctx, c.cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var manifests []ocispec.Descriptor
+	for _, m := range index.Manifests {
+		if m.Platform == nil || !platform.Match(*m.Platform) {
+			continue
+		}
+		converted, err := c.convertManifest(ctx, m)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		manifests = append(manifests, converted)
+	}
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest in %s matches the platforms", desc.Digest)
+	}
+	index.MediaType = ocispec.MediaTypeImageIndex
+	index.Manifests = manifests
+
+	labels := make(map[string]string)
+	for i, m := range manifests {
+		labels[fmt.Sprintf("%s%d", gcRefContentManifest, i)] = m.Digest.String()
+	}
+	return c.writeJSON(ctx, ocispec.MediaTypeImageIndex, index, labels)
+}
+
+// convertManifest converts the gzip layers of a manifest into zstd:chunked.
+func (c *imageConverter) convertManifest(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	b, err := content.ReadBlob(ctx, c.cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for i, l := range manifest.Layers {
+		switch soci.NormalizeMediaType(l.MediaType) {
+		case ocispec.MediaTypeImageLayerGzip, images.MediaTypeDockerSchema2LayerGzip:
+		default:
+			continue
+		}
+		converted, err := c.convertLayer(ctx, l)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to convert layer %s: %w", l.Digest, err)
+		}
+		manifest.Layers[i] = converted
+	}
+	// zstd layers are only defined by OCI.
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	if manifest.Config.MediaType == images.MediaTypeDockerSchema2Config {
+		manifest.Config.MediaType = ocispec.MediaTypeImageConfig
+	}
+
+	labels := map[string]string{
+		gcRefContentConfig: manifest.Config.Digest.String(),
+	}
+	for i, l := range manifest.Layers {
+		labels[fmt.Sprintf("%s%d", gcRefContentLayer, i)] = l.Digest.String()
+	}
+	converted, err := c.writeJSON(ctx, ocispec.MediaTypeImageManifest, manifest, labels)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	converted.Platform = desc.Platform
+	return converted, nil
+}
+
+func (c *imageConverter) convertLayer(ctx context.Context, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	if converted, ok := c.converted[desc.Digest]; ok {
+		return converted, nil
+	}
+
+	ra, err := c.cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer ra.Close()
+
+	toc, spanSize, err := c.getTOC(ctx, desc, ra)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	chunkSize := c.chunkSize
+	if chunkSize == 0 {
+		chunkSize = spanSize
+	}
+	if chunkSize == 0 {
+		chunkSize = zstdchunked.DefaultChunkSize
+	}
+
+	gr, err := gzip.NewReader(content.NewReader(ra))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer gr.Close()
+
+	ref := convertRefPrefix + desc.Digest.String()
+	w, err := content.OpenWriter(ctx, c.cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	cw := &countingWriter{w: w}
+	annotations, err := zstdchunked.Convert(cw, gr, toc,
+		zstdchunked.WithChunkSize(chunkSize), zstdchunked.WithCompressionLevel(c.level))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dgst := w.Digest()
+	if err := w.Commit(ctx, cw.n, dgst); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+
+	converted := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerZstd,
+		Digest:      dgst,
+		Size:        cw.n,
+		Annotations: make(map[string]string),
+	}
+	for k, v := range desc.Annotations {
+		converted.Annotations[k] = v
+	}
+	for k, v := range annotations {
+		converted.Annotations[k] = v
+	}
+	c.converted[desc.Digest] = converted
+	return converted, nil
+}
+
+// getTOC returns the TOC of the layer from its ztoc, along with the span size of the ztoc.
+// If the layer has no ztoc, the TOC is built from the layer.
+func (c *imageConverter) getTOC(ctx context.Context, desc ocispec.Descriptor, ra content.ReaderAt) (ztoc.TOC, int64, error) {
+	if c.artifactsDb != nil {
+		ztocDigest, err := internal.GetZtocDigest(c.artifactsDb, desc.Digest.String())
+		if err != nil {
+			return ztoc.TOC{}, 0, err
+		}
+		if ztocDigest != "" {
+			toc, err := internal.GetZtoc(ctx, c.blobStore, ztocDigest)
+			if err != nil {
+				return ztoc.TOC{}, 0, err
+			}
+			var spanSize int64
+			if toc.MaxSpanID > 0 {
+				spanSize = int64(toc.UncompressedArchiveSize) / int64(toc.MaxSpanID+1)
+			}
+			return toc.TOC, spanSize, nil
+		}
+	}
+
+	f, err := os.CreateTemp("", "soci-convert-")
+	if err != nil {
+		return ztoc.TOC{}, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, content.NewReader(ra)); err != nil {
+		return ztoc.TOC{}, 0, err
+	}
+	tb := ztoc.NewTocBuilder()
+	tb.RegisterTarProvider(compression.Gzip, ztoc.TarProviderGzip)
+	toc, _, err := tb.TocFromFile(compression.Gzip, f.Name())
+	return toc, 0, err
+}
+
+func (c *imageConverter) writeJSON(ctx context.Context, mediaType string, v interface{}, labels map[string]string) (ocispec.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	ref := convertRefPrefix + desc.Digest.String()
+	if err := content.WriteBlob(ctx, c.cs, ref, bytes.NewReader(b), desc, content.WithLabels(labels)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -18,7 +18,6 @@ package commands
 
 import (
 	"errors"
-	"fmt"
 	"os"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
@@ -29,12 +28,6 @@ import (
 	"oras.land/oras-go/v2/content/oci"
 )
 
-const (
-	buildToolIdentifier = "AWS SOCI CLI v0.1"
-	spanSizeFlag        = "span-size"
-	minLayerSizeFlag    = "min-layer-size"
-)
-
 // CreateCommand creates SOCI index for an image
 // Output of this command is SOCI layers and SOCI index stored in a local directory
 // SOCI layer is named as <image-layer-digest>.soci.layer
@@ -43,20 +36,10 @@ var CreateCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create SOCI index",
 	ArgsUsage: "[flags] <image_ref>",
-	Flags: append(
+	Flags: append(append(
 		internal.PlatformFlags,
-		internal.ManifestTypeFlag,
-		cli.Int64Flag{
-			Name:  spanSizeFlag,
-			Usage: "Span size that soci index uses to segment layer data. Default is 4 MiB",
-			Value: 1 << 22,
-		},
-		cli.Int64Flag{
-			Name:  minLayerSizeFlag,
-			Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
-			Value: 10 << 20,
-		},
-	),
+		internal.ManifestTypeFlag),
+		internal.BuildFlags...),
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
 		if srcRef == "" {
@@ -75,8 +58,6 @@ var CreateCommand = cli.Command{
 		if err != nil {
 			return err
 		}
-		spanSize := cliContext.Int64(spanSizeFlag)
-		minLayerSize := cliContext.Int64(minLayerSizeFlag)
 		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
 		// it has the limited permission set as drwx--x--x.
 		// The subsequent oci.New creates a root path dir with too broad permission set.
@@ -102,20 +83,9 @@ var CreateCommand = cli.Command{
 			return err
 		}
 
-		builderOpts := []soci.BuildOption{
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithSpanSize(spanSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
-		}
-
-		manifestType := cliContext.String(internal.ManifestTypeFlagName)
-
-		if manifestType != internal.ImageManifestType && manifestType != internal.ArtifactManifestType {
-			return fmt.Errorf("undefined manifest type: %v. supported manifest types: [%s, %s]", manifestType, internal.ImageManifestType, internal.ArtifactManifestType)
-		}
-
-		if manifestType == internal.ArtifactManifestType {
-			builderOpts = append(builderOpts, soci.WithOCIArtifactRegistrySupport)
+		builderOpts, err := internal.BuildOptions(cliContext)
+		if err != nil {
+			return err
 		}
 
 		for _, plat := range ps {
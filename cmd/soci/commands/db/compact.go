@@ -0,0 +1,85 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+const (
+	metadataFlag = "metadata"
+
+	// lockTimeout is how long to wait for other soci commands to release the artifacts DB.
+	lockTimeout = 10 * time.Second
+)
+
+var compactCommand = cli.Command{
+	Name:  "compact",
+	Usage: "compact the databases to give their free space back to the filesystem",
+	Description: `compact the artifacts DB, which keeps the space of removed indices and ztocs.
+   With --metadata, the snapshotter also compacts its metadata DB, which keeps the space of
+   unmounted layers. The snapshotter's metadata is unavailable while it's compacted.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  metadataFlag,
+			Usage: "also compact the metadata DB of the running snapshotter",
+		},
+		internal.APIAddressFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		var stats dbutil.CompactStats
+		if _, err := os.Stat(soci.ArtifactsDbPath()); err == nil {
+			if stats, err = dbutil.CompactFile(soci.ArtifactsDbPath(), lockTimeout); err != nil {
+				return fmt.Errorf("failed to compact artifacts DB: %w", err)
+			}
+			printStats("artifacts", stats)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if !cliContext.Bool(metadataFlag) {
+			return nil
+		}
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		resp, err := internal.PostAPI(ctx, cliContext.String(internal.APIAddressFlagKey), metadata.CompactPath, "application/json", nil)
+		if err != nil {
+			return fmt.Errorf("failed to compact metadata DB: %w", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			return fmt.Errorf("failed to decode compaction response: %w", err)
+		}
+		printStats("metadata", stats)
+		return nil
+	},
+}
+
+func printStats(db string, stats dbutil.CompactStats) {
+	fmt.Printf("compacted %s DB: %d -> %d bytes\n", db, stats.SizeBefore, stats.SizeAfter)
+}
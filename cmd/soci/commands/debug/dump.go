@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package debug
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	addressFlag = "address"
+	outputFlag  = "output"
+)
+
+var dumpCommand = cli.Command{
+	Name:  "dump",
+	Usage: "dump a diagnostic bundle of a running snapshotter",
+	Description: `download a diagnostic bundle from the snapshotter's debug endpoint.
+   The bundle is a gzipped tar archive containing goroutine stacks, active mounts,
+   the background fetch queue, cache usage, the config, and recent errors.
+   It requires "debug_address" to be set in the snapshotter's config. Alternatively,
+   send SIGUSR1 to the snapshotter to dump a bundle into "<root>/diagnostics".`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:     addressFlag,
+			Usage:    "debug address of the snapshotter (debug_address in the snapshotter's config)",
+			Required: true,
+		},
+		cli.StringFlag{
+			Name:  outputFlag,
+			Usage: "path of the bundle. Defaults to soci-diagnostics-<time>.tar.gz in the current directory",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		output := cliContext.String(outputFlag)
+		if output == "" {
+			output = fmt.Sprintf("soci-diagnostics-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/debug/dump", cliContext.String(addressFlag)))
+		if err != nil {
+			return fmt.Errorf("failed to request diagnostics: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("failed to request diagnostics: %s: %s", resp.Status, msg)
+		}
+
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			f.Close()
+			os.Remove(output)
+			return fmt.Errorf("failed to write diagnostics: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("wrote diagnostics to %s\n", output)
+		return nil
+	},
+}
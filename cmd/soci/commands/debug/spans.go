@@ -0,0 +1,97 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package debug
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const layerFlag = "layer"
+
+var spansCommand = cli.Command{
+	Name:  "spans",
+	Usage: "display the states of the spans of the mounted layers",
+	Description: `display how many spans of each layer mounted by the running snapshotter are
+   not fetched yet (unrequested), being fetched (in flight), waited for by requests (queued),
+   cached compressed (fetched) or uncompressed, and how many failed to be fetched, with
+   the last error. A background fetch which makes no progress shows as in-flight or failed
+   spans which don't change.`,
+	Flags: []cli.Flag{
+		internal.APIAddressFlag,
+		cli.StringFlag{
+			Name:  layerFlag,
+			Usage: "only display the spans of the layer with this digest",
+		},
+		internal.OutputFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		path := fs.SpansPath
+		if l := cliContext.String(layerFlag); l != "" {
+			if _, err := digest.Parse(l); err != nil {
+				return fmt.Errorf("invalid layer digest: %w", err)
+			}
+			path += "?" + url.Values{"layer": {l}}.Encode()
+		}
+		resp, err := internal.GetAPI(ctx, cliContext.String(internal.APIAddressFlagKey), path)
+		if err != nil {
+			return fmt.Errorf("failed to get the snapshotter's spans: %w", err)
+		}
+		defer resp.Body.Close()
+		var layers []fs.LayerSpans
+		if err := json.NewDecoder(resp.Body).Decode(&layers); err != nil {
+			return fmt.Errorf("failed to decode the snapshotter's spans: %w", err)
+		}
+
+		if jsonOutput {
+			if layers == nil {
+				layers = []fs.LayerSpans{}
+			}
+			return internal.PrintJSON(layers)
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("MOUNTPOINT\tLAYER\tSPANS\tUNREQUESTED\tIN FLIGHT\tQUEUED\tFETCHED\tUNCOMPRESSED\tFAILED\tLAST ERROR\t\n"))
+		for _, l := range layers {
+			s := l.Spans
+			lastErr := "-"
+			if s.LastError != "" {
+				lastErr = fmt.Sprintf("%s (%s)", s.LastError, s.LastErrorTime.Format(time.RFC3339))
+			}
+			writer.Write([]byte(fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n",
+				l.Mountpoint, l.Layer, s.Total, s.Unrequested, s.InFlight, s.Queued, s.Fetched,
+				s.Uncompressed, s.Failed, lastErr)))
+		}
+		return writer.Flush()
+	},
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/service/gateway"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/platforms"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	gatewayAddressFlag  = "address"
+	gatewayPlatformFlag = "platform"
+)
+
+// GatewayCommand serves files from images in remote registries over HTTP
+// using their SOCI indices, without pulling the images.
+var GatewayCommand = cli.Command{
+	Name:  "gateway",
+	Usage: "serve files from indexed images in remote registries over HTTP",
+	Description: `start an HTTP server that streams single files from remote images.
+   Files are served at GET /image/<ref>/file/<path>[?range=<start>-<end>][&index=<digest>].
+   Registry credentials are read from the docker config.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  gatewayAddressFlag,
+			Usage: "address for the HTTP server to listen on",
+			Value: "127.0.0.1:8080",
+		},
+		cli.StringFlag{
+			Name:  gatewayPlatformFlag,
+			Usage: "platform to select from multi-platform images. Defaults to the host platform",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		var opts []gateway.Option
+		if p := cliContext.String(gatewayPlatformFlag); p != "" {
+			platform, err := platforms.Parse(p)
+			if err != nil {
+				return fmt.Errorf("could not parse platform %s: %w", p, err)
+			}
+			opts = append(opts, gateway.WithPlatform(platforms.Only(platform)))
+		}
+
+		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
+		// it has the limited permission set as drwx--x--x.
+		err := os.MkdirAll(config.SociSnapshotterRootPath, 0711)
+		if err != nil {
+			return err
+		}
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local store: %w", err)
+		}
+
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(context.Background()))
+		server := &http.Server{
+			Addr:    cliContext.String(gatewayAddressFlag),
+			Handler: gateway.NewServer(hosts, store, opts...),
+		}
+		fmt.Printf("serving on %s\n", server.Addr)
+		return server.ListenAndServe()
+	},
+}
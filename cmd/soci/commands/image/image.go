@@ -23,5 +23,8 @@ var Command = cli.Command{
 	Usage: "manage images",
 	Subcommands: []cli.Command{
 		rpullCommand,
+		listCommand,
+		mountCommand,
+		unmountCommand,
 	},
 }
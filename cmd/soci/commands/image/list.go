@@ -0,0 +1,220 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	staleFlag   = "stale"
+	rebuildFlag = "rebuild"
+
+	statusIndexed = "indexed"
+	statusStale   = "stale"
+	statusNone    = "none"
+)
+
+// imageEntry is a platform of an image and its index in the output of the list command.
+type imageEntry struct {
+	Ref      string `json:"ref"`
+	Platform string `json:"platform"`
+	Index    string `json:"index,omitempty"`
+	Status   string `json:"status"`
+}
+
+// listCommand lists images and the state of their SOCI indices.
+var listCommand = cli.Command{
+	Name:    "list",
+	Usage:   "list images and their SOCI indices",
+	Aliases: []string{"ls"},
+	Description: `List the images in containerd and the SOCI index of each of their platforms.
+
+An index is stale if it was built for a previous image of the same ref, e.g. because
+the image was rebuilt and pushed under the same tag, and the current image has no index.
+With --stale, only stale indices are listed. With --rebuild, indices are built for the
+current images of stale indices, with the same flags as "soci create". Indices built
+by older versions of soci don't record their image ref, so they are never stale.
+`,
+	Flags: append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "platform, p",
+			Usage: "only list the specified platforms of images. Defaults to all platforms of the images",
+		},
+		cli.BoolFlag{
+			Name:  staleFlag,
+			Usage: "only list stale indices",
+		},
+		cli.BoolFlag{
+			Name:  rebuildFlag,
+			Usage: "build indices for the current images of stale indices",
+		},
+		internal.ManifestTypeFlag,
+		internal.OutputFlag,
+	}, internal.BuildFlags...),
+	Action: func(cliContext *cli.Context) error {
+		var ps []ocispec.Platform
+		for _, p := range cliContext.StringSlice("platform") {
+			platform, err := platforms.Parse(p)
+			if err != nil {
+				return fmt.Errorf("could not parse platform %s: %w", p, err)
+			}
+			ps = append(ps, platform)
+		}
+		staleOnly := cliContext.Bool(staleFlag)
+		rebuild := cliContext.Bool(rebuildFlag)
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		// the latest index of each image manifest
+		latest := make(map[string]*soci.ArtifactEntry)
+		err = artifactsDb.Walk(func(ae *soci.ArtifactEntry) error {
+			if ae.Type != soci.ArtifactEntryTypeIndex {
+				return nil
+			}
+			if prev, ok := latest[ae.OriginalDigest]; !ok || ae.CreatedAt.After(prev.CreatedAt) {
+				latest[ae.OriginalDigest] = ae
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		cs := client.ContentStore()
+		imgs, err := client.ImageService().List(ctx)
+		if err != nil {
+			return err
+		}
+
+		entries := []imageEntry{}
+		var stale []soci.StaleIndex
+		var staleImages []images.Image
+		for _, img := range imgs {
+			imgPlatforms := ps
+			if len(imgPlatforms) == 0 {
+				imgPlatforms, err = images.Platforms(ctx, cs, img.Target)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "skipping %s: %v\n", img.Name, err)
+					continue
+				}
+			}
+			imgStale, err := soci.FindStaleIndices(ctx, cs, artifactsDb, img, imgPlatforms)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %s: %v\n", img.Name, err)
+				continue
+			}
+			staleByPlatform := make(map[string]soci.StaleIndex)
+			for _, s := range imgStale {
+				staleByPlatform[s.Platform] = s
+				stale = append(stale, s)
+				staleImages = append(staleImages, img)
+			}
+
+			for _, platform := range imgPlatforms {
+				p := platforms.Format(platform)
+				index, status := "", statusNone
+				if s, ok := staleByPlatform[p]; ok {
+					index, status = s.Index.Digest, statusStale
+				} else if staleOnly {
+					continue
+				} else if desc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform)); err == nil {
+					if ae, ok := latest[desc.Digest.String()]; ok {
+						index, status = ae.Digest, statusIndexed
+					}
+				}
+				entries = append(entries, imageEntry{Ref: img.Name, Platform: p, Index: index, Status: status})
+			}
+		}
+		// rebuilt indices are reported on stderr, so that they don't break the JSON output.
+		progress := os.Stdout
+		if jsonOutput {
+			progress = os.Stderr
+			if err := internal.PrintJSON(entries); err != nil {
+				return err
+			}
+		} else {
+			writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+			writer.Write([]byte("REF\tPLATFORM\tSOCI INDEX\tSTATUS\t\n"))
+			for _, e := range entries {
+				writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t\n", e.Ref, e.Platform, e.Index, e.Status)))
+			}
+			writer.Flush()
+		}
+
+		if !rebuild || len(stale) == 0 {
+			return nil
+		}
+		builderOpts, err := internal.BuildOptions(cliContext)
+		if err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local store: %w", err)
+		}
+		var failed []string
+		for i, s := range stale {
+			platform, err := platforms.Parse(s.Platform)
+			if err != nil {
+				return err
+			}
+			builder, err := soci.NewIndexBuilder(cs, blobStore, artifactsDb, append(builderOpts, soci.WithPlatform(platform))...)
+			if err != nil {
+				return err
+			}
+			indexWithMetadata, err := builder.Build(ctx, staleImages[i])
+			if err == nil {
+				err = soci.WriteSociIndex(ctx, indexWithMetadata, blobStore, artifactsDb)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot rebuild index of %s (%s): %v\n", s.ImageRef, s.Platform, err)
+				failed = append(failed, s.ImageRef)
+				continue
+			}
+			fmt.Fprintf(progress, "rebuilt index of %s (%s)\n", s.ImageRef, s.Platform)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to rebuild indices of %v", failed)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/urfave/cli"
+)
+
+const (
+	snapshotterFlag = "snapshotter"
+	// mountLeaseExpiration is how long the snapshot of a mounted image is protected
+	// from garbage collection if it isn't unmounted.
+	mountLeaseExpiration = 24 * time.Hour
+)
+
+// mountCommand mounts the filesystem of a lazily pulled image read-only, so that it
+// can be inspected (e.g. by vulnerability scanners) without creating a container.
+var mountCommand = cli.Command{
+	Name:      "mount",
+	Usage:     "mount a lazily pulled image read-only to a target path",
+	ArgsUsage: "[flags] <ref> <target>",
+	Description: `Mount the rootfs of an image pulled with "soci image rpull" read-only to a
+target path. Files are fetched from the registry as they are read, like in a container.
+
+The image isn't unpacked if it's not already, since that would fetch all of its layers.
+When you are done, use the unmount command.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  snapshotterFlag,
+			Usage: "snapshotter which pulled the image",
+			Value: remoteSnapshotterName,
+		},
+		cli.StringFlag{
+			Name:  internal.PlatformFlagKey,
+			Usage: "mount the image for the specified platform",
+			Value: platforms.DefaultString(),
+		},
+	},
+	Action: func(cliContext *cli.Context) (retErr error) {
+		var (
+			ref         = cliContext.Args().First()
+			target      = cliContext.Args().Get(1)
+			snapshotter = cliContext.String(snapshotterFlag)
+		)
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference to mount")
+		}
+		if target == "" {
+			return fmt.Errorf("please provide a target path to mount to")
+		}
+		p, err := platforms.Parse(cliContext.String(internal.PlatformFlagKey))
+		if err != nil {
+			return fmt.Errorf("unable to parse platform: %w", err)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		i := containerd.NewImageWithPlatform(client, img, platforms.Only(p))
+		unpacked, err := i.IsUnpacked(ctx, snapshotter)
+		if err != nil {
+			return err
+		}
+		if !unpacked {
+			return fmt.Errorf("image %q isn't pulled with snapshotter %q; pull it with \"soci image rpull\" first", ref, snapshotter)
+		}
+		diffIDs, err := i.RootFS(ctx)
+		if err != nil {
+			return err
+		}
+		chainID := identity.ChainID(diffIDs).String()
+
+		// The lease keeps the view from being garbage collected while it's mounted.
+		ctx, done, err := client.WithLease(ctx,
+			leases.WithID(target),
+			leases.WithExpiration(mountLeaseExpiration),
+			leases.WithLabels(map[string]string{
+				"containerd.io/gc.ref.snapshot." + snapshotter: target,
+			}),
+		)
+		if err != nil && !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		defer func() {
+			if retErr != nil && done != nil {
+				done(ctx)
+			}
+		}()
+
+		s := client.SnapshotService(snapshotter)
+		mounts, err := s.View(ctx, target, chainID)
+		if err != nil {
+			if errdefs.IsAlreadyExists(err) {
+				mounts, err = s.Mounts(ctx, target)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := mount.All(mounts, target); err != nil {
+			if err := s.Remove(ctx, target); err != nil && !errdefs.IsNotFound(err) {
+				fmt.Fprintln(cliContext.App.ErrWriter, "error cleaning up snapshot after mount error:", err)
+			}
+			return err
+		}
+		fmt.Fprintln(cliContext.App.Writer, target)
+		return nil
+	},
+}
+
+// unmountCommand unmounts an image mounted with mountCommand.
+var unmountCommand = cli.Command{
+	Name:        "unmount",
+	Usage:       "unmount an image mounted with \"soci image mount\"",
+	ArgsUsage:   "[flags] <target>",
+	Description: "Unmount the image rootfs from the target path and remove its snapshot.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  snapshotterFlag,
+			Usage: "snapshotter which mounted the image",
+			Value: remoteSnapshotterName,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		target := cliContext.Args().First()
+		if target == "" {
+			return fmt.Errorf("please provide a target path to unmount from")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		if err := mount.UnmountAll(target, 0); err != nil {
+			return err
+		}
+		if err := client.LeasesService().Delete(ctx, leases.Lease{ID: target}); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("error deleting lease: %w", err)
+		}
+		if err := client.SnapshotService(cliContext.String(snapshotterFlag)).Remove(ctx, target); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("error removing snapshot: %w", err)
+		}
+		fmt.Fprintln(cliContext.App.Writer, target)
+		return nil
+	},
+}
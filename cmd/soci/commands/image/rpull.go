@@ -34,23 +34,45 @@ package image
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	orasremote "oras.land/oras-go/v2/registry/remote"
 )
 
 const (
-	remoteSnapshotterName = "soci"
-	skipContentVerifyOpt  = "skip-content-verify"
+	remoteSnapshotterName  = "soci"
+	skipContentVerifyOpt   = "skip-content-verify"
+	workloadClassFlag      = "workload-class"
+	fetchZtocsOnlyFlag     = "fetch-all-ztocs-only"
+	hydrationThresholdFlag = "hydration-threshold"
+	hydrationTimeoutFlag   = "hydration-timeout"
+	hydrationPathFlag      = "hydration-path"
+	mountOptionFlag        = "mount-option"
 )
 
 // rpullCommand is a subcommand to pull an image from a registry levaraging soci snapshotter
@@ -62,6 +84,11 @@ var rpullCommand = cli.Command{
 
 After pulling an image, it should be ready to use the same reference in a run
 command. 
+
+With --fetch-all-ztocs-only, only the SOCI index and the ztocs of the image are
+fetched into the local SOCI content store, so that they're already on the node when
+the image is pulled later. Nothing is pulled into containerd and no layers are mounted.
+The SOCI artifacts are fetched with the credentials from the docker config.
 `,
 	Flags: append(append(append(
 		commands.RegistryFlags,
@@ -80,6 +107,30 @@ command.
 			Name:  internal.PlatformFlagKey,
 			Usage: "The platform to pull.",
 		},
+		cli.StringFlag{
+			Name:  workloadClassFlag,
+			Usage: "The workload class of the image, which determines its share of concurrent fetches from remote registries.",
+		},
+		cli.IntFlag{
+			Name:  hydrationThresholdFlag,
+			Usage: "Percentage of the prioritized spans of each layer which must be cached before the layer is mounted.",
+		},
+		cli.DurationFlag{
+			Name:  hydrationTimeoutFlag,
+			Usage: "How long mounting a layer waits for the hydration threshold at most. Defaults to the snapshotter's config.",
+		},
+		cli.StringSliceFlag{
+			Name:  hydrationPathFlag,
+			Usage: "Absolute path whose spans are prioritized by the hydration threshold; may be repeated. All spans are prioritized by default.",
+		},
+		cli.StringSliceFlag{
+			Name:  mountOptionFlag,
+			Usage: "Option (ro, noexec, nodev or nosuid) to mount the layers with, in addition to the snapshotter's config; may be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  fetchZtocsOnlyFlag,
+			Usage: "Only fetch the SOCI index and the ztocs of the image into the local SOCI content store, without pulling or mounting the image.",
+		},
 	),
 	Action: func(context *cli.Context) error {
 		var (
@@ -91,6 +142,13 @@ command.
 		}
 
 		config.indexDigest = context.String("soci-index-digest")
+		config.platform = context.String(internal.PlatformFlagKey)
+
+		if context.Bool(fetchZtocsOnlyFlag) {
+			ctx, cancel := commands.AppContext(context)
+			defer cancel()
+			return fetchZtocs(ctx, ref, config)
+		}
 
 		client, ctx, cancel, err := commands.NewClient(context)
 		if err != nil {
@@ -119,7 +177,11 @@ command.
 			config.snapshotter = sn
 		}
 
-		config.platform = context.String(internal.PlatformFlagKey)
+		config.workloadClass = context.String(workloadClassFlag)
+		config.hydrationThreshold = context.Int(hydrationThresholdFlag)
+		config.hydrationTimeout = context.Duration(hydrationTimeoutFlag)
+		config.hydrationPaths = context.StringSlice(hydrationPathFlag)
+		config.mountOptions = context.StringSlice(mountOptionFlag)
 
 		return pull(ctx, client, ref, config)
 	},
@@ -131,6 +193,39 @@ type rPullConfig struct {
 	snapshotter string
 	indexDigest string
 	platform    string
+
+	workloadClass string
+
+	hydrationThreshold int
+	hydrationTimeout   time.Duration
+	hydrationPaths     []string
+
+	mountOptions []string
+}
+
+// snapshotLabels returns the labels passed to the snapshotter for the layers of the image.
+func (cfg *rPullConfig) snapshotLabels() (map[string]string, error) {
+	labels := make(map[string]string)
+	if cfg.workloadClass != "" {
+		labels[source.WorkloadClassLabel] = cfg.workloadClass
+	}
+	if cfg.hydrationThreshold != 0 {
+		labels[source.HydrationThresholdLabel] = strconv.Itoa(cfg.hydrationThreshold)
+	}
+	if cfg.hydrationTimeout > 0 {
+		labels[source.HydrationTimeoutLabel] = strconv.FormatInt(int64(math.Ceil(cfg.hydrationTimeout.Seconds())), 10)
+	}
+	if len(cfg.hydrationPaths) > 0 {
+		paths, err := json.Marshal(cfg.hydrationPaths)
+		if err != nil {
+			return nil, err
+		}
+		labels[source.HydrationPathsLabel] = string(paths)
+	}
+	if len(cfg.mountOptions) > 0 {
+		labels[source.MountOptionsLabel] = strings.Join(cfg.mountOptions, ",")
+	}
+	return labels, nil
 }
 
 func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
@@ -144,6 +239,14 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
 	labels := commands.LabelArgs(config.Labels)
+	snapshotLabels, err := config.snapshotLabels()
+	if err != nil {
+		return err
+	}
+	var snapshotterOpts []snapshots.Opt
+	if len(snapshotLabels) > 0 {
+		snapshotterOpts = append(snapshotterOpts, snapshots.WithLabels(snapshotLabels))
+	}
 	if _, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
 		containerd.WithPullLabels(labels),
 		containerd.WithResolver(config.Resolver),
@@ -151,7 +254,7 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		containerd.WithSchema1Conversion,
 		containerd.WithPullUnpack,
 		containerd.WithPlatform(config.platform),
-		containerd.WithPullSnapshotter(config.snapshotter),
+		containerd.WithPullSnapshotter(config.snapshotter, snapshotterOpts...),
 		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(
 			config.indexDigest, ctdsnapshotters.AppendInfoHandlerWrapper(ref))),
 	}...); err != nil {
@@ -160,3 +263,89 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 
 	return nil
 }
+
+// fetchZtocs stores the SOCI index of ref and its ztocs in the local SOCI content store,
+// which the snapshotter reads them from instead of the registry when ref is pulled.
+func fetchZtocs(ctx context.Context, ref string, cfg *rPullConfig) error {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("cannot parse image ref %s: %w", ref, err)
+	}
+	repo, err := fs.NewRemoteStore(refspec)
+	if err != nil {
+		return err
+	}
+
+	var indexDesc ocispec.Descriptor
+	if cfg.indexDigest != "" {
+		dgst, err := digest.Parse(cfg.indexDigest)
+		if err != nil {
+			return fmt.Errorf("cannot parse index digest %s: %w", cfg.indexDigest, err)
+		}
+		indexDesc = ocispec.Descriptor{Digest: dgst}
+	} else {
+		manifestDesc, err := resolveManifest(ctx, repo, refspec, cfg.platform)
+		if err != nil {
+			return err
+		}
+		indexDesc, err = fs.NewOCIArtifactClient(repo).SelectReferrer(ctx, manifestDesc, fs.SelectFirstPolicy)
+		if err != nil {
+			return fmt.Errorf("cannot find SOCI index for %s: %w", manifestDesc.Digest, err)
+		}
+	}
+
+	store, err := oci.New(config.SociContentStorePath)
+	if err != nil {
+		return fmt.Errorf("cannot create local store: %w", err)
+	}
+	index, err := fs.FetchSociArtifacts(ctx, refspec, indexDesc, store, repo)
+	if errors.Is(err, errdef.ErrAlreadyExists) {
+		// The snapshotter stored some of the artifacts first, so they are all local now.
+		index, err = fs.FetchSociArtifacts(ctx, refspec, indexDesc, store, repo)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("fetched SOCI index %s with %d ztocs\n", indexDesc.Digest, len(index.Blobs))
+	return nil
+}
+
+// resolveManifest resolves the image manifest of refspec for platform, or the default
+// platform if it's empty.
+func resolveManifest(ctx context.Context, repo *orasremote.Repository, refspec reference.Spec, platform string) (ocispec.Descriptor, error) {
+	matcher := platforms.Default()
+	if platform != "" {
+		p, err := platforms.Parse(platform)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("could not parse platform %s: %w", platform, err)
+		}
+		matcher = platforms.Only(p)
+	}
+
+	object := refspec.Object
+	if dgst := refspec.Digest(); dgst != "" {
+		object = dgst.String()
+	}
+	desc, err := repo.Resolve(ctx, object)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot resolve %s: %w", refspec, err)
+	}
+	b, mediaType, err := soci.FetchManifest(ctx, repo.Manifests(), desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if !images.IsIndexType(mediaType) {
+		desc.MediaType = mediaType
+		return desc, nil
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse image index %s: %w", desc.Digest, err)
+	}
+	for _, m := range index.Manifests {
+		if m.Platform != nil && matcher.Match(*m.Platform) {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no manifest for the requested platform in %s", refspec)
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	copyImageFlag    = "image"
+	copyPlatformFlag = "platform"
+)
+
+var copyCommand = cli.Command{
+	Name:      "copy",
+	Usage:     "copy the soci indices of an image between registries",
+	ArgsUsage: "[flags] <src_ref> <dst_ref>",
+	Description: `copy the soci indices of the image src_ref, and the ztocs they refer to, from the
+   src_ref repository to the dst_ref repository. The indices refer to the image manifests
+   by digest, so the image must be copied unchanged, e.g. with --image.
+
+   Blobs are mounted from the source repository when both repositories are in the same
+   registry, so that they aren't uploaded again.`,
+	Flags: append(
+		commands.RegistryFlags,
+		internal.MountFromFlag,
+		cli.BoolFlag{
+			Name:  copyImageFlag,
+			Usage: "also copy the image and tag it as dst_ref",
+		},
+		cli.StringSliceFlag{
+			Name:  copyPlatformFlag + ", p",
+			Usage: "copy the indices of the given platforms only. Defaults to all platforms of the image",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		dstRef := cliContext.Args().Get(1)
+		if srcRef == "" || dstRef == "" {
+			return errors.New("source and destination references need to be specified")
+		}
+		var matchers []platforms.Matcher
+		for _, p := range cliContext.StringSlice(copyPlatformFlag) {
+			platform, err := platforms.Parse(p)
+			if err != nil {
+				return err
+			}
+			matchers = append(matchers, platforms.Only(platform))
+		}
+
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+
+		src, err := internal.NewRepository(cliContext, srcRef)
+		if err != nil {
+			return err
+		}
+		dstRepo, err := internal.NewRepository(cliContext, dstRef)
+		if err != nil {
+			return err
+		}
+		dst := &internal.MountingRepository{Repository: dstRepo, From: cliContext.StringSlice(internal.MountFromFlagName)}
+		if src.Reference.Registry == dstRepo.Reference.Registry {
+			dst.From = append([]string{src.Reference.Repository}, dst.From...)
+		}
+
+		if src.Reference.Reference == "" {
+			return fmt.Errorf("source reference %q needs a tag or a digest", srcRef)
+		}
+		root, err := src.Resolve(ctx, src.Reference.Reference)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", srcRef, err)
+		}
+		if cliContext.Bool(copyImageFlag) {
+			tag := dstRepo.Reference.Reference
+			if tag == "" {
+				tag = root.Digest.String()
+			}
+			fmt.Printf("copying image %s\n", root.Digest)
+			if _, err := oraslib.Copy(ctx, src, root.Digest.String(), dst, tag, oraslib.DefaultCopyOptions); err != nil {
+				return fmt.Errorf("failed to copy image: %w", err)
+			}
+		}
+
+		manifests, err := imageManifests(ctx, src, root, matchers)
+		if err != nil {
+			return err
+		}
+		opts := oraslib.DefaultCopyGraphOptions
+		opts.OnCopySkipped = func(_ context.Context, desc ocispec.Descriptor) error {
+			fmt.Printf("skipped %s %s: already exists\n", desc.MediaType, desc.Digest)
+			return nil
+		}
+		if !cliContext.Bool(copyImageFlag) {
+			// the indices refer to the image manifests as their subject, which are only
+			// copied with --image.
+			opts.FindSuccessors = successorsWithoutSubject
+		}
+		client := fs.NewOCIArtifactClient(src)
+		var copied int
+		for _, m := range manifests {
+			indices, err := client.AllReferrers(ctx, ocispec.Descriptor{Digest: m.Digest})
+			if err != nil && !errors.Is(err, fs.ErrNoReferrers) {
+				return fmt.Errorf("failed to list soci indices of manifest %s: %w", m.Digest, err)
+			}
+			for _, indexDesc := range indices {
+				fmt.Printf("copying soci index %s of manifest %s\n", indexDesc.Digest, m.Digest)
+				if err := oraslib.CopyGraph(ctx, src, dst, indexDesc, opts); err != nil {
+					return fmt.Errorf("failed to copy soci index %s: %w", indexDesc.Digest, err)
+				}
+				copied++
+			}
+		}
+		if copied == 0 {
+			return fmt.Errorf("no soci indices found for %s", srcRef)
+		}
+		return nil
+	},
+}
+
+// successorsWithoutSubject returns the successors of desc, except the subject of desc
+// if it's a manifest with a subject, e.g. the image manifest of a soci index.
+func successorsWithoutSubject(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	successors, err := content.Successors(ctx, fetcher, desc)
+	if err != nil || len(successors) == 0 {
+		return successors, err
+	}
+	b, err := content.FetchAll(ctx, fetcher, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Subject *ocispec.Descriptor `json:"subject,omitempty"`
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil || manifest.Subject == nil {
+		return successors, nil
+	}
+	var filtered []ocispec.Descriptor
+	for _, s := range successors {
+		if s.Digest != manifest.Subject.Digest {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered, nil
+}
+
+// imageManifests returns the image manifests of root matching one of matchers,
+// or all of them if there are no matchers.
+func imageManifests(ctx context.Context, repo *remote.Repository, root ocispec.Descriptor, matchers []platforms.Matcher) ([]ocispec.Descriptor, error) {
+	b, mediaType, err := soci.FetchManifest(ctx, repo.Manifests(), root)
+	if err != nil {
+		return nil, err
+	}
+	if !images.IsIndexType(mediaType) {
+		root.MediaType = mediaType
+		return []ocispec.Descriptor{root}, nil
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse image index %s: %w", root.Digest, err)
+	}
+	if len(matchers) == 0 {
+		return index.Manifests, nil
+	}
+	var manifests []ocispec.Descriptor
+	for _, m := range index.Manifests {
+		for _, matcher := range matchers {
+			if m.Platform != nil && matcher.Match(*m.Platform) {
+				manifests = append(manifests, m)
+				break
+			}
+		}
+	}
+	return manifests, nil
+}
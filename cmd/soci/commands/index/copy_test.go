@@ -0,0 +1,83 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestCopySkipsSubject(t *testing.T) {
+	ctx := context.Background()
+	src := memory.New()
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := src.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("failed to push %s: %v", desc.Digest, err)
+		}
+		return desc
+	}
+	marshal := func(v interface{}) []byte {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("failed to marshal: %v", err)
+		}
+		return b
+	}
+
+	config := push(ocispec.MediaTypeImageConfig, []byte("{}"))
+	layer := push(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	image := push(ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	}))
+	ztoc := push("application/octet-stream", []byte("ztoc"))
+	index := push(ocispec.MediaTypeImageManifest, marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{ztoc},
+		Subject:   &image,
+	}))
+
+	dst := memory.New()
+	opts := oraslib.DefaultCopyGraphOptions
+	opts.FindSuccessors = successorsWithoutSubject
+	if err := oraslib.CopyGraph(ctx, src, dst, index, opts); err != nil {
+		t.Fatalf("failed to copy index: %v", err)
+	}
+	for _, desc := range []ocispec.Descriptor{index, ztoc, config} {
+		if ok, err := dst.Exists(ctx, desc); err != nil || !ok {
+			t.Fatalf("expected %s to be copied", desc.Digest)
+		}
+	}
+	for _, desc := range []ocispec.Descriptor{image, layer} {
+		if ok, _ := dst.Exists(ctx, desc); ok {
+			t.Fatalf("expected %s of the subject not to be copied", desc.Digest)
+		}
+	}
+}
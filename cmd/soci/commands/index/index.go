@@ -25,5 +25,7 @@ var Command = cli.Command{
 		listCommand,
 		infoCommand,
 		rmCommand,
+		copyCommand,
+		provenanceCommand,
 	},
 }
@@ -24,6 +24,7 @@ import (
 	"text/tabwriter"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/images"
@@ -32,6 +33,16 @@ import (
 	"github.com/urfave/cli"
 )
 
+// indexEntry is an index in the JSON output of the list command.
+type indexEntry struct {
+	Digest    string     `json:"digest"`
+	Size      int64      `json:"size"`
+	ImageRefs []string   `json:"image_refs"`
+	Platform  string     `json:"platform"`
+	MediaType string     `json:"media_type"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
 type filter func(ae *soci.ArtifactEntry) bool
 
 func indexFilter(ae *soci.ArtifactEntry) bool {
@@ -78,11 +89,16 @@ var listCommand = cli.Command{
 			Name:  "platform, p",
 			Usage: "filter indices to a specific platform",
 		},
+		internal.OutputFlag,
 	},
 	Action: func(cliContext *cli.Context) error {
 		var artifacts []*soci.ArtifactEntry
 		ref := cliContext.String("ref")
 		quiet := cliContext.Bool("quiet")
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
 		var plats []specs.Platform
 		for _, p := range cliContext.StringSlice("platform") {
 			pp, err := platforms.Parse(p)
@@ -154,6 +170,17 @@ var listCommand = cli.Command{
 			return nil
 		}
 
+		if jsonOutput {
+			return writeIndexesJSON(os.Stdout, artifacts, func(ae *soci.ArtifactEntry) []string {
+				var refs []string
+				imgs, _ := is.List(ctx, fmt.Sprintf("target.digest==%s", ae.ImageDigest))
+				for _, img := range imgs {
+					refs = append(refs, img.Name)
+				}
+				return refs
+			})
+		}
+
 		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
 		writer.Write([]byte("DIGEST\tSIZE\tIMAGE REF\tPLATFORM\tMEDIA TYPE\tCREATED\t\n"))
 
@@ -172,6 +199,27 @@ var listCommand = cli.Command{
 	},
 }
 
+// writeIndexesJSON writes the indices of artifacts to w as JSON, with the refs
+// of their images returned by imageRefs.
+func writeIndexesJSON(w io.Writer, artifacts []*soci.ArtifactEntry, imageRefs func(ae *soci.ArtifactEntry) []string) error {
+	entries := make([]indexEntry, 0, len(artifacts))
+	for _, ae := range artifacts {
+		e := indexEntry{
+			Digest:    ae.Digest,
+			Size:      ae.Size,
+			ImageRefs: append([]string{}, imageRefs(ae)...),
+			Platform:  ae.Platform,
+			MediaType: ae.MediaType,
+		}
+		if !ae.CreatedAt.IsZero() {
+			createdAt := ae.CreatedAt
+			e.CreatedAt = &createdAt
+		}
+		entries = append(entries, e)
+	}
+	return internal.WriteJSON(w, entries)
+}
+
 func writeArtifactEntry(w io.Writer, ae *soci.ArtifactEntry, imageRef string) {
 	w.Write([]byte(fmt.Sprintf(
 		"%s\t%d\t%s\t%s\t%s\t%s\t\n",
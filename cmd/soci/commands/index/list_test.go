@@ -0,0 +1,87 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+)
+
+func TestWriteIndexesJSON(t *testing.T) {
+	artifacts := []*soci.ArtifactEntry{
+		{
+			Digest:      "sha256:1111",
+			Size:        100,
+			ImageDigest: "sha256:aaaa",
+			Platform:    "linux/amd64",
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+			CreatedAt:   time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Digest:      "sha256:2222",
+			Size:        200,
+			ImageDigest: "sha256:bbbb",
+			Platform:    "linux/arm64",
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+		},
+	}
+	refs := map[string][]string{
+		"sha256:aaaa": {"docker.io/library/redis:latest", "docker.io/library/redis:7"},
+	}
+	var b bytes.Buffer
+	err := writeIndexesJSON(&b, artifacts, func(ae *soci.ArtifactEntry) []string {
+		return refs[ae.ImageDigest]
+	})
+	if err != nil {
+		t.Fatalf("failed to write indices: %v", err)
+	}
+	want := `[
+  {
+    "digest": "sha256:1111",
+    "size": 100,
+    "image_refs": [
+      "docker.io/library/redis:latest",
+      "docker.io/library/redis:7"
+    ],
+    "platform": "linux/amd64",
+    "media_type": "application/vnd.oci.image.manifest.v1+json",
+    "created_at": "2023-03-01T12:00:00Z"
+  },
+  {
+    "digest": "sha256:2222",
+    "size": 200,
+    "image_refs": [],
+    "platform": "linux/arm64",
+    "media_type": "application/vnd.oci.image.manifest.v1+json"
+  }
+]
+`
+	if b.String() != want {
+		t.Fatalf("expected %s, got %s", want, b.String())
+	}
+
+	b.Reset()
+	if err := writeIndexesJSON(&b, nil, nil); err != nil {
+		t.Fatalf("failed to write indices: %v", err)
+	}
+	if b.String() != "[]\n" {
+		t.Fatalf("expected an empty array without indices, got %s", b.String())
+	}
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+// InfoCommand reports the version and capabilities of the running snapshotter.
+var InfoCommand = cli.Command{
+	Name:  "info",
+	Usage: "display the version and capabilities of the snapshotter",
+	Description: `display the version of the running snapshotter, the ztoc versions and layer
+   compression algorithms it can lazily load, and the features configured in it, as JSON.`,
+	Flags: []cli.Flag{
+		internal.APIAddressFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		resp, err := internal.GetAPI(ctx, cliContext.String(internal.APIAddressFlagKey), fs.InfoPath)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshotter info: %w", err)
+		}
+		defer resp.Body.Close()
+		var info fs.Info
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			return fmt.Errorf("failed to decode snapshotter info: %w", err)
+		}
+		j, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	},
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+const (
+	APIAddressFlagKey     = "api-address"
+	DefaultSociAPIAddress = "/run/soci-snapshotter-grpc/soci-api.sock"
+)
+
+// APIAddressFlag is the flag of commands which talk to the snapshotter's API.
+var APIAddressFlag = cli.StringFlag{
+	Name:  APIAddressFlagKey,
+	Usage: "address of the snapshotter's API (api_address in the snapshotter's config)",
+	Value: DefaultSociAPIAddress,
+}
+
+// PostAPI sends a POST request with body to path of the snapshotter's API on the
+// unix socket at address. The caller must close the body of the returned response.
+func PostAPI(ctx context.Context, address, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://soci"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return callAPI(address, req)
+}
+
+// GetAPI sends a GET request to path of the snapshotter's API on the unix socket
+// at address. The caller must close the body of the returned response.
+func GetAPI(ctx context.Context, address, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://soci"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return callAPI(address, req)
+}
+
+func callAPI(address string, req *http.Request) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", address)
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call the snapshotter's API: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("snapshotter's API returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// GetLayers returns the digests of the layers of img for the given platforms without duplicates.
+func GetLayers(ctx context.Context, cs content.Store, img images.Image, ps []ocispec.Platform) ([]digest.Digest, error) {
+	var layers []digest.Digest
+	seen := make(map[digest.Digest]struct{})
+	for _, p := range ps {
+		manifest, err := images.Manifest(ctx, cs, img.Target, platforms.OnlyStrict(p))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range manifest.Layers {
+			if _, ok := seen[l.Digest]; ok {
+				continue
+			}
+			seen[l.Digest] = struct{}{}
+			layers = append(layers, l.Digest)
+		}
+	}
+	return layers, nil
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const (
+	buildToolIdentifier = "AWS SOCI CLI v0.1"
+	spanSizeFlag        = "span-size"
+	minLayerSizeFlag    = "min-layer-size"
+	digestAlgorithmFlag = "digest-algorithm"
+	reproducibleFlag    = "reproducible"
+	chunkSizeFlag       = "chunk-size"
+	resumeFlag          = "resume"
+)
+
+// BuildFlags are the flags of the options of SOCI index builds.
+var BuildFlags = []cli.Flag{
+	cli.Int64Flag{
+		Name:  spanSizeFlag,
+		Usage: "Span size that soci index uses to segment layer data. Default is 4 MiB",
+		Value: 1 << 22,
+	},
+	cli.Int64Flag{
+		Name:  minLayerSizeFlag,
+		Usage: "Minimum layer size to build zTOC for. Smaller layers won't have zTOC and not lazy pulled. Default is 10 MiB.",
+		Value: 10 << 20,
+	},
+	cli.StringFlag{
+		Name:  digestAlgorithmFlag,
+		Usage: "Digest algorithm for the zTOCs and SOCI index. Supported algorithms: sha256, sha512",
+		Value: string(digest.SHA256),
+	},
+	cli.BoolFlag{
+		Name:  reproducibleFlag,
+		Usage: "Leave out the build tool identifier, so that the SOCI index only depends on the image and the flags",
+	},
+	cli.Int64Flag{
+		Name:  chunkSizeFlag,
+		Usage: "Record the digests of files in chunks of this size in the zTOCs, so that identical files in different layers are fetched once. Disabled by default",
+	},
+	cli.BoolFlag{
+		Name:  resumeFlag,
+		Usage: "Resume an interrupted build with the same flags, reusing the zTOCs it already built",
+	},
+}
+
+// BuildOptions returns the options of SOCI index builds set by BuildFlags and the
+// manifest type flag.
+func BuildOptions(cliContext *cli.Context) ([]soci.BuildOption, error) {
+	digestAlgorithm := digest.Algorithm(cliContext.String(digestAlgorithmFlag))
+	if digestAlgorithm != digest.SHA256 && digestAlgorithm != digest.SHA512 {
+		return nil, fmt.Errorf("unsupported digest algorithm: %v. supported algorithms: [%s, %s]", digestAlgorithm, digest.SHA256, digest.SHA512)
+	}
+
+	builderOpts := []soci.BuildOption{
+		soci.WithMinLayerSize(cliContext.Int64(minLayerSizeFlag)),
+		soci.WithSpanSize(cliContext.Int64(spanSizeFlag)),
+		soci.WithBuildToolIdentifier(buildToolIdentifier),
+		soci.WithDigestAlgorithm(digestAlgorithm),
+		soci.WithBuildJournal(soci.BuildJournalsDir()),
+	}
+
+	if cliContext.Bool(reproducibleFlag) {
+		builderOpts = append(builderOpts, soci.WithReproducible)
+	}
+	if chunkSize := cliContext.Int64(chunkSizeFlag); chunkSize > 0 {
+		builderOpts = append(builderOpts, soci.WithChunkDigests(chunkSize))
+	}
+	if cliContext.Bool(resumeFlag) {
+		builderOpts = append(builderOpts, soci.WithResume)
+	}
+
+	manifestType := cliContext.String(ManifestTypeFlagName)
+
+	if manifestType != ImageManifestType && manifestType != ArtifactManifestType {
+		return nil, fmt.Errorf("undefined manifest type: %v. supported manifest types: [%s, %s]", manifestType, ImageManifestType, ArtifactManifestType)
+	}
+
+	if manifestType == ArtifactManifestType {
+		builderOpts = append(builderOpts, soci.WithOCIArtifactRegistrySupport)
+	}
+	return builderOpts, nil
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// MountFromFlagName is the flag of the repositories to mount blobs from.
+const MountFromFlagName = "mount-from"
+
+// MountFromFlag lets commands which push blobs mount them from other repositories.
+var MountFromFlag = cli.StringSliceFlag{
+	Name: MountFromFlagName,
+	Usage: "repository of the same registry (e.g. the repository of a base image) to mount existing blobs from " +
+		"instead of uploading them. Can be specified multiple times",
+}
+
+// MountingRepository is a repository which mounts blobs that don't exist yet from other
+// repositories of the same registry, so that copying them to the repository is skipped.
+type MountingRepository struct {
+	*remote.Repository
+	// From are the repositories (e.g. "library/base") to mount blobs from.
+	From []string
+}
+
+// Exists returns true for blobs which exist in the repository or are mounted into it.
+func (r *MountingRepository) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	exists, err := r.Repository.Exists(ctx, desc)
+	if err != nil || exists || isManifest(desc.MediaType) {
+		return exists, err
+	}
+	for _, from := range r.From {
+		if from == r.Reference.Repository {
+			continue
+		}
+		mounted, err := r.mount(ctx, desc, from)
+		if err != nil {
+			// Fall back to the next repository, or to copying the blob.
+			fmt.Printf("failed to mount %s from %s: %v\n", desc.Digest, from, err)
+			continue
+		}
+		if mounted {
+			fmt.Printf("mounted %s from %s\n", desc.Digest, from)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mount asks the registry to mount the blob from the repository from. Registries which
+// can't mount it (e.g. because it doesn't exist there) start an upload instead, in which
+// case false is returned and the upload is left to expire.
+func (r *MountingRepository) mount(ctx context.Context, desc ocispec.Descriptor, from string) (bool, error) {
+	scheme := "https"
+	if r.PlainHTTP {
+		scheme = "http"
+	}
+	q := url.Values{}
+	q.Set("mount", desc.Digest.String())
+	q.Set("from", from)
+	u := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/?%s", scheme, r.Reference.Host(), r.Reference.Repository, q.Encode())
+
+	ctx = auth.AppendScopes(ctx,
+		auth.ScopeRepository(r.Reference.Repository, auth.ActionPull, auth.ActionPush),
+		auth.ScopeRepository(from, auth.ActionPull))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func isManifest(mediaType string) bool {
+	return soci.IsImageManifestType(mediaType) || soci.IsImageIndexType(mediaType) ||
+		soci.NormalizeMediaType(mediaType) == ocispec.MediaTypeArtifactManifest
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	OutputFlagKey = "output"
+	OutputTable   = "table"
+	OutputJSON    = "json"
+)
+
+// OutputFlag is the flag of commands which display tables, which display JSON
+// instead with --output json, so that they can be used by scripts.
+var OutputFlag = cli.StringFlag{
+	Name:  OutputFlagKey + ", o",
+	Usage: fmt.Sprintf("output format (%s or %s)", OutputTable, OutputJSON),
+	Value: OutputTable,
+}
+
+// JSONOutput returns whether a command displays JSON rather than a table, or an
+// error if its output format isn't supported.
+func JSONOutput(cliContext *cli.Context) (bool, error) {
+	switch o := cliContext.String(OutputFlagKey); o {
+	case OutputTable:
+		return false, nil
+	case OutputJSON:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unsupported output format %q, must be %q or %q", o, OutputTable, OutputJSON)
+	}
+}
+
+// PrintJSON displays v as indented JSON.
+func PrintJSON(v interface{}) error {
+	return WriteJSON(os.Stdout, v)
+}
+
+// WriteJSON writes v to w as indented JSON.
+func WriteJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
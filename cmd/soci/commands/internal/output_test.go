@@ -0,0 +1,76 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestJSONOutput(t *testing.T) {
+	tests := []struct {
+		args    []string
+		json    bool
+		wantErr bool
+	}{
+		{args: nil},
+		{args: []string{"--output", "table"}},
+		{args: []string{"--output", "json"}, json: true},
+		{args: []string{"--output", "JSON"}, wantErr: true},
+		{args: []string{"--output", "yaml"}, wantErr: true},
+		{args: []string{"--output", ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		OutputFlag.Apply(set)
+		if err := set.Parse(tt.args); err != nil {
+			t.Fatalf("failed to parse %v: %v", tt.args, err)
+		}
+		got, err := JSONOutput(cli.NewContext(nil, set, nil))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("output format of %v was accepted", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to get output format of %v: %v", tt.args, err)
+		} else if got != tt.json {
+			t.Errorf("expected JSON output %v for %v, got %v", tt.json, tt.args, got)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSON(&b, map[string][]string{"refs": {"a", "b"}}); err != nil {
+		t.Fatalf("failed to write JSON: %v", err)
+	}
+	want := `{
+  "refs": [
+    "a",
+    "b"
+  ]
+}
+`
+	if b.String() != want {
+		t.Fatalf("expected %s, got %s", want, b.String())
+	}
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/util/httputil"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// NewRepository returns a client of the remote repository of ref, authenticated with
+// the credentials of the --user flag and using plain HTTP if --plain-http is set.
+func NewRepository(cliContext *cli.Context, ref string) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(ref)
+	if err != nil {
+		return nil, err
+	}
+	username := cliContext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	authClient := *auth.DefaultClient
+	authClient.Client = &http.Client{Transport: httputil.NewMetadataEncodingTransport(http.DefaultTransport)}
+	authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
+		return auth.Credential{
+			Username: username,
+			Password: secret,
+		}, nil
+	}
+	repo.PlainHTTP = cliContext.Bool("plain-http")
+	if cliContext.GlobalBool("debug") {
+		repo.Client = &debugClient{client: &authClient}
+	} else {
+		repo.Client = &authClient
+	}
+	return repo, nil
+}
+
+type debugClient struct {
+	client remote.Client
+}
+
+func (c *debugClient) Do(req *http.Request) (*http.Response, error) {
+	fmt.Printf("http req %s %s\n", req.Method, req.URL)
+	res, err := c.client.Do(req)
+	if err != nil {
+		fmt.Printf("http err %v\n", err)
+	} else {
+		fmt.Printf("http res %s\n", res.Status)
+	}
+	return res, err
+}
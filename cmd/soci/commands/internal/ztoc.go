@@ -0,0 +1,51 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// GetZtocDigest returns the digest of a ztoc built for the layer,
+// or an empty digest if there is none.
+func GetZtocDigest(db *soci.ArtifactsDb, layerDigest string) (digest.Digest, error) {
+	var ztocDigest digest.Digest
+	err := db.Walk(func(ae *soci.ArtifactEntry) error {
+		if ztocDigest == "" && ae.Type == soci.ArtifactEntryTypeLayer && ae.OriginalDigest == layerDigest {
+			ztocDigest = digest.Digest(ae.Digest)
+		}
+		return nil
+	})
+	return ztocDigest, err
+}
+
+// GetZtoc reads the ztoc with digest d from the local store.
+func GetZtoc(ctx context.Context, blobStore *oci.Store, d digest.Digest) (*ztoc.Ztoc, error) {
+	reader, err := blobStore.Fetch(ctx, ocispec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ztoc.Unmarshal(reader)
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+const prefetchPathFlag = "path"
+
+// PrefetchCommand hydrates the lazily loaded layers of an image ahead of time.
+var PrefetchCommand = cli.Command{
+	Name:      "prefetch",
+	Usage:     "prefetch the contents of a lazily pulled image",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `fetch and cache the contents of the lazily loaded layers of an image ahead of time,
+   so that containers started from the image don't wait for on-demand fetches.
+   The image must be pulled with "soci image rpull" first. By default, all spans of the
+   layers are fetched. With --path, only the given files and directories are fetched.`,
+	Flags: append(
+		internal.PlatformFlags,
+		internal.APIAddressFlag,
+		cli.StringSliceFlag{
+			Name:  prefetchPathFlag,
+			Usage: "absolute path of a file or directory in the image to prefetch. Can be specified multiple times",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return errors.New("image needs to be specified")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+
+		layers, err := internal.GetLayers(ctx, cs, img, ps)
+		if err != nil {
+			return err
+		}
+
+		resp, err := requestPrefetch(ctx, cliContext.String(internal.APIAddressFlagKey), fs.PrefetchRequest{
+			Layers: layers,
+			Paths:  cliContext.StringSlice(prefetchPathFlag),
+		})
+		if err != nil {
+			return err
+		}
+
+		var failed int
+		w := tabwriter.NewWriter(os.Stdout, 4, 8, 4, ' ', 0)
+		fmt.Fprintln(w, "LAYER\tSTATUS\tFETCHED\tSIZE")
+		for _, l := range resp.Layers {
+			status := "prefetched"
+			switch {
+			case !l.Mounted:
+				status = "not lazily loaded"
+			case l.Error != "":
+				status = "failed: " + l.Error
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", l.Digest, status, l.FetchedSize, l.Size)
+		}
+		w.Flush()
+		if failed > 0 {
+			return fmt.Errorf("failed to prefetch %d layers", failed)
+		}
+		return nil
+	},
+}
+
+func requestPrefetch(ctx context.Context, address string, req fs.PrefetchRequest) (*fs.PrefetchResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := internal.PostAPI(ctx, address, fs.PrefetchPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to request prefetch: %w", err)
+	}
+	defer httpResp.Body.Close()
+	var resp fs.PrefetchResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode prefetch response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// lockTimeout is how long to wait for the snapshotter to release the artifacts DB.
+const lockTimeout = 10 * time.Second
+
+var pushCommand = cli.Command{
+	Name:      "push",
+	Usage:     "push the access profile of an image to its registry",
+	ArgsUsage: "[flags] <image_ref>",
+	Description: `push the spans of the image's lazily loaded layers which its containers read on this
+   node, as recorded by the snapshotter with [access_history] enabled, as a referrer of the
+   image manifest. Snapshotters of other nodes with [access_history] fetch_profiles enabled
+   prefetch these spans when they mount the image for the first time.`,
+	Flags: append(append(
+		commands.RegistryFlags,
+		internal.PlatformFlags...),
+		cli.BoolFlag{
+			Name:  "quiet, q",
+			Usage: "quiet mode",
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return errors.New("image needs to be specified")
+		}
+		quiet := cliContext.Bool("quiet")
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		ps, err := internal.GetPlatforms(ctx, cliContext, img, cs)
+		if err != nil {
+			return err
+		}
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			return err
+		}
+		dst, err := internal.NewRepository(cliContext, refspec.Locator)
+		if err != nil {
+			return err
+		}
+
+		var pushed int
+		for _, platform := range ps {
+			manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform))
+			if err != nil {
+				return err
+			}
+			profile, err := soci.LoadAccessProfile(soci.ArtifactsDbPath(), lockTimeout, manifestDesc.Digest.String())
+			if err != nil {
+				return fmt.Errorf("failed to load access profile: %w", err)
+			}
+			if len(profile.Layers) == 0 {
+				if !quiet {
+					fmt.Printf("no access history of image manifest %s (%s): skipping\n", manifestDesc.Digest, platforms.Format(platform))
+				}
+				continue
+			}
+
+			manifest, blob, err := soci.AccessProfileArtifact(profile, *manifestDesc, time.Now())
+			if err != nil {
+				return err
+			}
+			manifestBytes, err := json.Marshal(manifest)
+			if err != nil {
+				return err
+			}
+			profileDesc := ocispec.Descriptor{
+				MediaType: manifest.MediaType,
+				Digest:    digest.FromBytes(manifestBytes),
+				Size:      int64(len(manifestBytes)),
+			}
+			// the manifest is pushed last, so that it only refers to blobs which exist.
+			for _, c := range []struct {
+				desc ocispec.Descriptor
+				b    []byte
+			}{
+				{manifest.Config, []byte("{}")},
+				{manifest.Layers[0], blob},
+				{profileDesc, manifestBytes},
+			} {
+				if err := dst.Push(ctx, c.desc, bytes.NewReader(c.b)); err != nil {
+					return fmt.Errorf("failed to push %s: %w", c.desc.Digest, err)
+				}
+			}
+			pushed++
+			if quiet {
+				fmt.Println(profileDesc.Digest.String())
+			} else {
+				fmt.Printf("pushed access profile %s of image manifest %s (%s) with %d layers\n",
+					profileDesc.Digest, manifestDesc.Digest, platforms.Format(platform), len(profile.Layers))
+			}
+		}
+		if pushed == 0 {
+			return errors.New("no access history of the image on this node")
+		}
+		return nil
+	},
+}
@@ -20,22 +20,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"sort"
-	"strings"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/fs"
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 	oraslib "oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/oci"
-	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
 // PushCommand is a command to push an image artifacts from local content store to the remote repository
@@ -55,6 +52,7 @@ if they are available in the snapshotter's local content store.
 		commands.SnapshotterFlags...),
 		internal.PlatformFlags...),
 		internal.ExistingIndexFlag,
+		internal.MountFromFlag,
 		cli.Uint64Flag{
 			Name:  "max-concurrent-uploads",
 			Usage: "Max concurrent uploads. Default is 10",
@@ -64,6 +62,11 @@ if they are available in the snapshotter's local content store.
 			Name:  "quiet, q",
 			Usage: "quiet mode",
 		},
+		cli.BoolFlag{
+			Name: "verify",
+			Usage: "after pushing, verify that the soci index is discoverable from each platform's image manifest " +
+				"and that all of its blobs exist in the remote repository",
+		},
 	),
 	Action: func(cliContext *cli.Context) error {
 		ref := cliContext.Args().First()
@@ -95,6 +98,9 @@ if they are available in the snapshotter's local content store.
 			return err
 		}
 
+		verify := cliContext.Bool("verify")
+		var failedVerifications []string
+
 		for _, platform := range ps {
 			indexDescriptors, imgManifestDesc, err := soci.GetIndexDescriptorCollection(ctx, cs, artifactsDb, img, []ocispec.Platform{platform})
 			if err != nil {
@@ -109,13 +115,6 @@ if they are available in the snapshotter's local content store.
 				return indexDescriptors[i].CreatedAt.Before(indexDescriptors[j].CreatedAt)
 			})
 
-			username := cliContext.String("user")
-			var secret string
-			if i := strings.IndexByte(username, ':'); i > 0 {
-				secret = username[i+1:]
-				username = username[0:i]
-			}
-
 			src, err := oci.New(config.SociContentStorePath)
 			if err != nil {
 				return fmt.Errorf("cannot create OCI local store: %w", err)
@@ -127,27 +126,10 @@ if they are available in the snapshotter's local content store.
 				return err
 			}
 
-			dst, err := remote.NewRepository(refspec.Locator)
+			dst, err := internal.NewRepository(cliContext, refspec.Locator)
 			if err != nil {
 				return err
 			}
-			authClient := auth.DefaultClient
-			authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
-				return auth.Credential{
-					Username: username,
-					Password: secret,
-				}, nil
-			}
-
-			dst.Client = authClient
-			dst.PlainHTTP = cliContext.Bool("plain-http")
-
-			debug := cliContext.GlobalBool("debug")
-			if debug {
-				dst.Client = &debugClient{client: authClient}
-			} else {
-				dst.Client = authClient
-			}
 			existingIndexOption := cliContext.String(internal.ExistingIndexFlagName)
 			if !internal.SupportedArg(existingIndexOption, internal.SupportedExistingIndexOptions) {
 				return fmt.Errorf("unexpected value for flag %s: %s, expected types %v",
@@ -207,27 +189,26 @@ if they are available in the snapshotter's local content store.
 				fmt.Printf("pushing soci index with digest: %v\n", indexDesc.Digest)
 			}
 
-			err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc.Descriptor, options)
+			target := &internal.MountingRepository{Repository: dst, From: cliContext.StringSlice(internal.MountFromFlagName)}
+			err = oraslib.CopyGraph(context.Background(), src, target, indexDesc.Descriptor, options)
 			if err != nil {
 				return fmt.Errorf("error pushing graph to remote: %w", err)
 			}
 
+			if verify {
+				v, err := verifyPush(ctx, platforms.Format(platform), src, dst, *imgManifestDesc, indexDesc.Descriptor)
+				if err != nil {
+					return err
+				}
+				v.print(!quiet)
+				if !v.ok() {
+					failedVerifications = append(failedVerifications, v.platform)
+				}
+			}
+		}
+		if len(failedVerifications) > 0 {
+			return fmt.Errorf("verification of pushed soci artifacts failed for platforms: %v", failedVerifications)
 		}
 		return nil
 	},
 }
-
-type debugClient struct {
-	client remote.Client
-}
-
-func (c *debugClient) Do(req *http.Request) (*http.Response, error) {
-	fmt.Printf("http req %s %s\n", req.Method, req.URL)
-	res, err := c.client.Do(req)
-	if err != nil {
-		fmt.Printf("http err %v\n", err)
-	} else {
-		fmt.Printf("http res %s\n", res.Status)
-	}
-	return res, err
-}
@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// pushVerification is the result of verifying the artifacts pushed for a single platform.
+type pushVerification struct {
+	platform string
+	// discoverable is whether the soci index is returned by the referrers API
+	// (or the referrers tag schema) for the image manifest.
+	discoverable bool
+	referrersErr error
+	// blobs are the results of checking that the index manifest and its ztocs exist remotely.
+	blobs []blobVerification
+}
+
+type blobVerification struct {
+	desc ocispec.Descriptor
+	err  error
+}
+
+func (v pushVerification) ok() bool {
+	if !v.discoverable {
+		return false
+	}
+	for _, b := range v.blobs {
+		if b.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// print prints a per-blob report of the verification. Successful checks are
+// only printed if verbose is set.
+func (v pushVerification) print(verbose bool) {
+	switch {
+	case v.referrersErr != nil:
+		fmt.Printf("[FAIL] %s: could not list referrers of image manifest: %v\n", v.platform, v.referrersErr)
+	case !v.discoverable:
+		fmt.Printf("[FAIL] %s: soci index is not discoverable from image manifest\n", v.platform)
+	case verbose:
+		fmt.Printf("[OK] %s: soci index is discoverable from image manifest\n", v.platform)
+	}
+	for _, b := range v.blobs {
+		if b.err != nil {
+			fmt.Printf("[FAIL] %s: %s %s: %v\n", v.platform, b.desc.MediaType, b.desc.Digest, b.err)
+		} else if verbose {
+			fmt.Printf("[OK] %s: %s %s\n", v.platform, b.desc.MediaType, b.desc.Digest)
+		}
+	}
+}
+
+// verifyPush checks that the soci index described by indexDesc is discoverable
+// from imgManifestDesc in dst and that the index manifest and all of its ztocs
+// exist in dst.
+func verifyPush(ctx context.Context, platform string, src *oci.Store, dst *remote.Repository, imgManifestDesc, indexDesc ocispec.Descriptor) (pushVerification, error) {
+	v := pushVerification{platform: platform}
+
+	referrers, err := fs.NewOCIArtifactClient(dst).AllReferrers(ctx, ocispec.Descriptor{Digest: imgManifestDesc.Digest})
+	if err != nil && !errors.Is(err, fs.ErrNoReferrers) {
+		v.referrersErr = err
+	}
+	for _, r := range referrers {
+		if r.Digest == indexDesc.Digest {
+			v.discoverable = true
+			break
+		}
+	}
+
+	b, err := content.FetchAll(ctx, src, indexDesc)
+	if err != nil {
+		return v, fmt.Errorf("cannot read soci index %s from local store: %w", indexDesc.Digest, err)
+	}
+	var index soci.Index
+	if err := soci.UnmarshalIndex(b, &index); err != nil {
+		return v, fmt.Errorf("cannot parse soci index %s: %w", indexDesc.Digest, err)
+	}
+
+	v.blobs = append(v.blobs, blobVerification{
+		desc: indexDesc,
+		err:  checkExists(dst.Manifests().Exists(ctx, indexDesc)),
+	})
+	for _, blob := range index.Blobs {
+		v.blobs = append(v.blobs, blobVerification{
+			desc: blob,
+			err:  checkExists(dst.Blobs().Exists(ctx, blob)),
+		})
+	}
+	return v, nil
+}
+
+func checkExists(exists bool, err error) error {
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("not found in remote repository")
+	}
+	return nil
+}
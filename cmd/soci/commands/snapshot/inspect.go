@@ -0,0 +1,100 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "show how the layers of an active snapshot are loaded",
+	ArgsUsage: "<snapshot-id>",
+	Description: `show the image and SOCI index an active snapshot was created from, and for each
+   of its layers (starting with the top-most one) whether it's lazily loaded, unpacked
+   although it has a ztoc (fallback) or unpacked because it has no ztoc (local), how much
+   of it is fetched and the directory it's mounted at.`,
+	Flags: []cli.Flag{
+		snapshotterFlag,
+		internal.APIAddressFlag,
+		internal.OutputFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		key := cliContext.Args().First()
+		if key == "" {
+			return errors.New("please provide a snapshot id")
+		}
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		mounts, err := getMounts(ctx, cliContext)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		sn := client.SnapshotService(cliContext.String(snapshotterFlagName))
+		status, err := getSnapshotStatus(ctx, sn, key, mounts, db)
+		if err != nil {
+			return err
+		}
+
+		if jsonOutput {
+			return internal.PrintJSON(status.toJSON())
+		}
+
+		fmt.Printf("Key:        %s\n", status.key)
+		fmt.Printf("Image:      %s\n", orDash(status.image))
+		fmt.Printf("Index:      %s\n", orDash(status.index.String()))
+		fmt.Printf("Mount:      %s\n", orDash(status.upperDir))
+		fmt.Printf("Hydration:  %s\n", status.hydration())
+		fmt.Println()
+
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER\tMODE\tZTOC\tSIZE\tFETCHED\tHYDRATION\tMOUNT\t\n"))
+		for _, l := range status.layers {
+			size, fetched := "-", "-"
+			hydration := "-"
+			if l.mount != nil {
+				size = fmt.Sprint(l.mount.Size)
+				fetched = fmt.Sprint(l.mount.FetchedSize)
+				hydration = percentage(l.mount.FetchedSize, l.mount.Size)
+			}
+			writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+				orDash(l.digest), l.mode(), orDash(l.ztoc.String()), size, fetched, hydration, l.dir)))
+		}
+		return writer.Flush()
+	},
+}
@@ -0,0 +1,334 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/mount"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const (
+	// layerModeLazy is the mode of layers which are lazily loaded.
+	layerModeLazy = "lazy"
+	// layerModeFallback is the mode of layers which have a ztoc, but were unpacked
+	// because they couldn't be lazily loaded.
+	layerModeFallback = "fallback"
+	// layerModeLocal is the mode of layers without a ztoc, which are always unpacked.
+	layerModeLocal = "local"
+)
+
+// layerStatus is the status of a layer of a snapshot.
+type layerStatus struct {
+	snapshot string
+	digest   string
+	dir      string
+	ztoc     digest.Digest
+	// mount is the FUSE mount of the layer, or nil if the layer isn't lazily loaded.
+	mount *fs.MountInfo
+}
+
+func (l layerStatus) mode() string {
+	switch {
+	case l.mount != nil:
+		return layerModeLazy
+	case l.ztoc != "":
+		return layerModeFallback
+	default:
+		return layerModeLocal
+	}
+}
+
+// snapshotStatus is the status of an active snapshot and its layers.
+type snapshotStatus struct {
+	key      string
+	image    string
+	index    digest.Digest
+	upperDir string
+	// layers are the layers of the snapshot, starting with the top-most one.
+	layers []layerStatus
+}
+
+// fallbacks returns the number of layers of the snapshot which were unpacked
+// although they have a ztoc.
+func (s snapshotStatus) fallbacks() int {
+	var n int
+	for _, l := range s.layers {
+		if l.mode() == layerModeFallback {
+			n++
+		}
+	}
+	return n
+}
+
+// hydration returns the percentage of the lazily loaded layers of the snapshot
+// which are fetched.
+func (s snapshotStatus) hydration() string {
+	var size, fetched int64
+	for _, l := range s.layers {
+		if l.mount != nil {
+			size += l.mount.Size
+			fetched += l.mount.FetchedSize
+		}
+	}
+	return percentage(fetched, size)
+}
+
+// layerJSON is a layer of a snapshot in the JSON output of the commands.
+type layerJSON struct {
+	Digest   string `json:"digest,omitempty"`
+	Snapshot string `json:"snapshot"`
+	Mode     string `json:"mode"`
+	Ztoc     string `json:"ztoc,omitempty"`
+	Dir      string `json:"dir"`
+	// Size and FetchedSize are only set for lazily loaded layers.
+	Size        int64 `json:"size,omitempty"`
+	FetchedSize int64 `json:"fetched_size,omitempty"`
+}
+
+// snapshotJSON is a snapshot in the JSON output of the commands.
+type snapshotJSON struct {
+	Key      string      `json:"key"`
+	Image    string      `json:"image,omitempty"`
+	Index    string      `json:"index,omitempty"`
+	UpperDir string      `json:"upper_dir,omitempty"`
+	Layers   []layerJSON `json:"layers"`
+}
+
+// toJSON returns the JSON output of the snapshot.
+func (s snapshotStatus) toJSON() snapshotJSON {
+	j := snapshotJSON{Key: s.key, Image: s.image, Index: s.index.String(), UpperDir: s.upperDir, Layers: []layerJSON{}}
+	for _, l := range s.layers {
+		lj := layerJSON{Digest: l.digest, Snapshot: l.snapshot, Mode: l.mode(), Ztoc: l.ztoc.String(), Dir: l.dir}
+		if l.mount != nil {
+			lj.Size, lj.FetchedSize = l.mount.Size, l.mount.FetchedSize
+		}
+		j.Layers = append(j.Layers, lj)
+	}
+	return j
+}
+
+func percentage(part, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// getMounts returns the layers mounted by the snapshotter, by mountpoint.
+func getMounts(ctx context.Context, cliContext *cli.Context) (map[string]fs.MountInfo, error) {
+	resp, err := internal.GetAPI(ctx, cliContext.String(internal.APIAddressFlagKey), fs.MountsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the snapshotter's mounts: %w", err)
+	}
+	defer resp.Body.Close()
+	var mounts []fs.MountInfo
+	if err := json.NewDecoder(resp.Body).Decode(&mounts); err != nil {
+		return nil, fmt.Errorf("failed to decode the snapshotter's mounts: %w", err)
+	}
+	byMountpoint := make(map[string]fs.MountInfo, len(mounts))
+	for _, m := range mounts {
+		byMountpoint[m.Mountpoint] = m
+	}
+	return byMountpoint, nil
+}
+
+// getSnapshotStatus returns the status of the active snapshot key.
+func getSnapshotStatus(ctx context.Context, sn snapshots.Snapshotter, key string, mounts map[string]fs.MountInfo, db *soci.ArtifactsDb) (snapshotStatus, error) {
+	status := snapshotStatus{key: key}
+	mnts, err := sn.Mounts(ctx, key)
+	if err != nil {
+		return status, err
+	}
+	info, err := sn.Stat(ctx, key)
+	if err != nil {
+		return status, err
+	}
+	var chain []snapshots.Info
+	for parent := info.Parent; parent != ""; {
+		pInfo, err := sn.Stat(ctx, parent)
+		if err != nil {
+			return status, err
+		}
+		chain = append(chain, pInfo)
+		parent = pInfo.Parent
+	}
+	lowerDirs, err := getLowerDirs(mnts, len(chain))
+	if err != nil {
+		return status, err
+	}
+	status.upperDir = getUpperDir(mnts)
+
+	for i, layerInfo := range chain {
+		l := layerStatus{
+			snapshot: layerInfo.Name,
+			digest:   layerInfo.Labels[ctdsnapshotters.TargetLayerDigestLabel],
+			dir:      lowerDirs[i],
+		}
+		if m, ok := mounts[l.dir]; ok {
+			l.mount = &m
+			l.ztoc = m.Ztoc
+			if status.image == "" {
+				status.image = m.Image
+			}
+			if status.index == "" {
+				status.index = m.Index
+			}
+		} else if l.digest != "" {
+			l.ztoc, err = internal.GetZtocDigest(db, l.digest)
+			if err != nil {
+				return status, err
+			}
+		}
+		if status.image == "" {
+			status.image = layerInfo.Labels[ctdsnapshotters.TargetRefLabel]
+		}
+		if status.index == "" {
+			status.index = digest.Digest(layerInfo.Labels[source.TargetSociIndexDigestLabel])
+		}
+		status.layers = append(status.layers, l)
+	}
+	return status, nil
+}
+
+// getUpperDir returns the directory the changes to a snapshot are written to,
+// or an empty string if the snapshot is read-only.
+func getUpperDir(mounts []mount.Mount) string {
+	if len(mounts) != 1 {
+		return ""
+	}
+	m := mounts[0]
+	switch m.Type {
+	case "bind":
+		for _, o := range m.Options {
+			if o == "ro" {
+				return ""
+			}
+		}
+		return m.Source
+	case "overlay":
+		for _, o := range m.Options {
+			if strings.HasPrefix(o, "upperdir=") {
+				return strings.TrimPrefix(o, "upperdir=")
+			}
+		}
+	}
+	return ""
+}
+
+var listCommand = cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "list active snapshots and how their layers are loaded",
+	Description: `list the active snapshots of the snapshotter (e.g. the root filesystems of containers)
+   with the image and SOCI index they were created from, the number of layers which were
+   unpacked although they have a ztoc (fallback), the percentage of the lazily loaded
+   layers which are fetched (hydration), and the directory changes are written to.`,
+	Flags: []cli.Flag{
+		snapshotterFlag,
+		internal.APIAddressFlag,
+		internal.OutputFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		mounts, err := getMounts(ctx, cliContext)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+
+		sn := client.SnapshotService(cliContext.String(snapshotterFlagName))
+		var keys []string
+		if err := sn.Walk(ctx, func(_ context.Context, info snapshots.Info) error {
+			if info.Kind == snapshots.KindActive {
+				keys = append(keys, info.Name)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.Strings(keys)
+
+		var statuses []snapshotStatus
+		for _, key := range keys {
+			status, err := getSnapshotStatus(ctx, sn, key, mounts, db)
+			if err != nil {
+				// the snapshot may have been removed since it was listed.
+				fmt.Fprintf(os.Stderr, "skipping snapshot %s: %v\n", key, err)
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+
+		if jsonOutput {
+			out := make([]snapshotJSON, 0, len(statuses))
+			for _, status := range statuses {
+				out = append(out, status.toJSON())
+			}
+			return internal.PrintJSON(out)
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("KEY\tIMAGE\tINDEX\tLAYERS\tLAZY\tFALLBACK\tHYDRATION\tMOUNT\t\n"))
+		for _, status := range statuses {
+			var lazy int
+			for _, l := range status.layers {
+				if l.mount != nil {
+					lazy++
+				}
+			}
+			writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t\n",
+				status.key, orDash(status.image), orDash(status.index.String()), len(status.layers),
+				lazy, status.fallbacks(), status.hydration(), orDash(status.upperDir))))
+		}
+		return writer.Flush()
+	},
+}
@@ -0,0 +1,439 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/scan"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/mount"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// whiteoutPrefix is the prefix of tar entries that overlayfs represents
+// as whiteouts rather than as regular files.
+const whiteoutPrefix = ".wh."
+
+// divergence describes a single file of a mounted snapshot whose content
+// or metadata doesn't match what the layer's ztoc describes.
+type divergence struct {
+	layer  string
+	path   string
+	reason string
+}
+
+// divergenceJSON is a divergence in the JSON output of the verify command.
+type divergenceJSON struct {
+	Layer  string `json:"layer,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// verifyResult is the JSON output of the verify command.
+type verifyResult struct {
+	Snapshot    string           `json:"snapshot"`
+	Layers      int              `json:"layers"`
+	Files       int              `json:"files"`
+	Divergences []divergenceJSON `json:"divergences"`
+}
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify the files of a mounted snapshot against its ztocs",
+	ArgsUsage: "<snapshot-id>",
+	Description: `walk every lazily loaded layer of a mounted snapshot, recompute the digest
+   of each file and compare it against the layer's ztoc. File contents are also
+   compared against the data extracted from the compressed layer, which is read from
+   the content store or, if the layer was never pulled, from the registry. If --ref is
+   provided, the snapshot chain is additionally checked against the diff_ids from the
+   image config.`,
+	Flags: []cli.Flag{
+		snapshotterFlag,
+		cli.StringFlag{
+			Name:  "ref",
+			Usage: "image ref whose config diff_ids the snapshot chain is checked against",
+		},
+		internal.OutputFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		key := cliContext.Args().First()
+		if key == "" {
+			return errors.New("please provide a snapshot id")
+		}
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		sn := client.SnapshotService(cliContext.String(snapshotterFlagName))
+		mounts, err := sn.Mounts(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var chain []snapshots.Info
+		info, err := sn.Stat(ctx, key)
+		if err != nil {
+			return err
+		}
+		for parent := info.Parent; parent != ""; {
+			pInfo, err := sn.Stat(ctx, parent)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, pInfo)
+			parent = pInfo.Parent
+		}
+
+		lowerDirs, err := getLowerDirs(mounts, len(chain))
+		if err != nil {
+			return err
+		}
+
+		var divergences []divergence
+		if ref := cliContext.String("ref"); ref != "" {
+			img, err := client.GetImage(ctx, ref)
+			if err != nil {
+				return err
+			}
+			diffIDs, err := img.RootFS(ctx)
+			if err != nil {
+				return err
+			}
+			divergences = append(divergences, verifyChainIDs(chain, identity.ChainIDs(diffIDs))...)
+		}
+
+		db, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(ctx))
+		var numFiles int
+		for i, layerInfo := range chain {
+			d, n, err := verifyChainLayer(ctx, client.ContentStore(), hosts, db, blobStore, layerInfo, lowerDirs[i])
+			if err != nil {
+				return err
+			}
+			divergences = append(divergences, d...)
+			numFiles += n
+		}
+
+		return writeVerifyResult(os.Stdout, key, len(chain), numFiles, divergences, jsonOutput)
+	},
+}
+
+// writeVerifyResult writes the result of verifying the snapshot key to w, as a table
+// or as JSON. It returns an error if any file diverges, after writing the result.
+func writeVerifyResult(w io.Writer, key string, layers, files int, divergences []divergence, jsonOutput bool) error {
+	if jsonOutput {
+		result := verifyResult{Snapshot: key, Layers: layers, Files: files, Divergences: []divergenceJSON{}}
+		for _, d := range divergences {
+			result.Divergences = append(result.Divergences, divergenceJSON{Layer: d.layer, Path: d.path, Reason: d.reason})
+		}
+		if err := internal.WriteJSON(w, result); err != nil {
+			return err
+		}
+	} else if len(divergences) == 0 {
+		fmt.Fprintf(w, "snapshot %s verified: %d layers, %d files\n", key, layers, files)
+	} else {
+		writer := tabwriter.NewWriter(w, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER\tPATH\tREASON\t\n"))
+		for _, d := range divergences {
+			writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t\n", d.layer, d.path, d.reason)))
+		}
+		writer.Flush()
+	}
+	if len(divergences) > 0 {
+		return fmt.Errorf("snapshot %s has %d divergent files", key, len(divergences))
+	}
+	return nil
+}
+
+// getLowerDirs returns the directories of the layers of a snapshot
+// from its mounts. The directories are ordered from the top-most layer
+// to the bottom-most layer, which matches the order of the parent chain.
+func getLowerDirs(mounts []mount.Mount, numParents int) ([]string, error) {
+	if numParents == 0 {
+		return nil, nil
+	}
+	if len(mounts) != 1 {
+		return nil, fmt.Errorf("unexpected number of mounts: %d", len(mounts))
+	}
+	m := mounts[0]
+	switch m.Type {
+	case "bind":
+		if numParents != 1 {
+			return nil, fmt.Errorf("unexpected bind mount for snapshot with %d parents", numParents)
+		}
+		return []string{m.Source}, nil
+	case "overlay":
+		for _, o := range m.Options {
+			if strings.HasPrefix(o, "lowerdir=") {
+				dirs := strings.Split(strings.TrimPrefix(o, "lowerdir="), ":")
+				if len(dirs) != numParents {
+					return nil, fmt.Errorf("snapshot has %d parents but %d lower directories", numParents, len(dirs))
+				}
+				return dirs, nil
+			}
+		}
+		return nil, errors.New("overlay mount has no lowerdir")
+	default:
+		return nil, fmt.Errorf("unsupported mount type: %s", m.Type)
+	}
+}
+
+// verifyChainIDs checks that the snapshot chain (top-most layer first)
+// was built from the given chain IDs (bottom-most layer first).
+func verifyChainIDs(chain []snapshots.Info, chainIDs []digest.Digest) []divergence {
+	if len(chain) != len(chainIDs) {
+		return []divergence{{
+			reason: fmt.Sprintf("snapshot has %d layers but image config has %d diff_ids", len(chain), len(chainIDs)),
+		}}
+	}
+	var divergences []divergence
+	for i, info := range chain {
+		expected := chainIDs[len(chainIDs)-1-i]
+		if info.Name != expected.String() {
+			divergences = append(divergences, divergence{
+				layer:  info.Labels[ctdsnapshotters.TargetLayerDigestLabel],
+				reason: fmt.Sprintf("snapshot %s does not match chain id %s", info.Name, expected),
+			})
+		}
+	}
+	return divergences
+}
+
+// layerBlob is a compressed layer, read either from the content store or from the registry.
+type layerBlob interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// verifyChainLayer verifies the layer of the snapshot info mounted in dir. It returns the
+// divergent files and the number of files of the layer.
+func verifyChainLayer(ctx context.Context, cs content.Store, hosts source.RegistryHosts, db *soci.ArtifactsDb, blobStore *oci.Store, info snapshots.Info, dir string) ([]divergence, int, error) {
+	layerDigest, ok := info.Labels[ctdsnapshotters.TargetLayerDigestLabel]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "skipping snapshot %s: no layer digest label\n", info.Name)
+		return nil, 0, nil
+	}
+	ztocDigest, err := internal.GetZtocDigest(db, layerDigest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ztocDigest == "" {
+		fmt.Fprintf(os.Stderr, "skipping layer %s: no ztoc, layer was not lazily loaded\n", layerDigest)
+		return nil, 0, nil
+	}
+	toc, err := internal.GetZtoc(ctx, blobStore, ztocDigest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blob, err := openLayerBlob(ctx, cs, hosts, info, digest.Digest(layerDigest))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open layer %s: %w", layerDigest, err)
+	}
+	defer blob.Close()
+
+	d, err := verifyLayer(ctx, dir, toc, blob)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to verify layer %s: %w", layerDigest, err)
+	}
+	for j := range d {
+		d[j].layer = layerDigest
+	}
+	return d, len(toc.FileMetadata), nil
+}
+
+// openLayerBlob opens the compressed layer of a snapshot from the content store. Lazily
+// loaded layers usually aren't there, so they are read from the registry of the image
+// the snapshot was prepared for instead.
+func openLayerBlob(ctx context.Context, cs content.Store, hosts source.RegistryHosts, info snapshots.Info, layerDigest digest.Digest) (layerBlob, error) {
+	if ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: layerDigest}); err == nil {
+		return ra, nil
+	}
+	ref, ok := info.Labels[ctdsnapshotters.TargetRefLabel]
+	if !ok {
+		return nil, fmt.Errorf("layer is not in the content store and snapshot %s has no image ref label", info.Name)
+	}
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(info.Labels[source.TargetSizeLabel], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("layer is not in the content store and snapshot %s has no valid size label: %w", info.Name, err)
+	}
+	return scan.NewRemoteBlob(ctx, hosts, refspec, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      size,
+	})
+}
+
+// verifyLayer compares every entry of the ztoc with the file mounted in dir. The contents
+// of regular files are also compared with the data extracted from the compressed layer.
+func verifyLayer(ctx context.Context, dir string, toc *ztoc.Ztoc, blob io.ReaderAt) ([]divergence, error) {
+	expected, err := fileDigests(ctx, toc, blob)
+	if err != nil {
+		return nil, err
+	}
+	var divergences []divergence
+	for _, fm := range toc.FileMetadata {
+		if strings.HasPrefix(path.Base(fm.Name), whiteoutPrefix) {
+			continue
+		}
+		if reason := verifyFile(filepath.Join(dir, fm.Name), fm, expected[path.Clean("/"+fm.Name)]); reason != "" {
+			divergences = append(divergences, divergence{path: fm.Name, reason: reason})
+		}
+	}
+	return divergences, nil
+}
+
+// fileDigests returns the digests of the regular files extracted from the compressed layer,
+// keyed by their absolute paths. Each span of the layer is only read once.
+func fileDigests(ctx context.Context, toc *ztoc.Ztoc, blob io.ReaderAt) (map[string]digest.Digest, error) {
+	var mu sync.Mutex
+	digests := make(map[string]digest.Digest)
+	err := scan.Files(ctx, []scan.Layer{{Ztoc: toc, Blob: blob}}, func(_ context.Context, f scan.File, r io.Reader) error {
+		if f.Link != "" {
+			return nil
+		}
+		dgst, err := digest.FromReader(r)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		digests[f.Path] = dgst
+		mu.Unlock()
+		return nil
+	}, scan.WithAllFiles())
+	return digests, err
+}
+
+// verifyFile returns the reason a file diverges from its metadata,
+// or an empty string if it doesn't.
+func verifyFile(p string, fm ztoc.FileMetadata, expected digest.Digest) string {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return fmt.Sprintf("cannot stat file: %v", err)
+	}
+
+	mode := st.Mode()
+	switch fm.Type {
+	case "dir":
+		if !mode.IsDir() {
+			return fmt.Sprintf("expected directory, got %s", mode.Type())
+		}
+	case "symlink":
+		if mode&os.ModeSymlink == 0 {
+			return fmt.Sprintf("expected symlink, got %s", mode.Type())
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return fmt.Sprintf("cannot read symlink: %v", err)
+		}
+		if target != fm.Linkname {
+			return fmt.Sprintf("symlink target %q, expected %q", target, fm.Linkname)
+		}
+		return ""
+	case "char", "block":
+		if mode&os.ModeDevice == 0 {
+			return fmt.Sprintf("expected device, got %s", mode.Type())
+		}
+	case "fifo":
+		if mode&os.ModeNamedPipe == 0 {
+			return fmt.Sprintf("expected fifo, got %s", mode.Type())
+		}
+	case "hardlink":
+		// Hardlinks are resolved to their target, which is verified separately.
+		return ""
+	case "reg":
+		if !mode.IsRegular() {
+			return fmt.Sprintf("expected regular file, got %s", mode.Type())
+		}
+		if st.Size() != int64(fm.UncompressedSize) {
+			return fmt.Sprintf("size %d, expected %d", st.Size(), fm.UncompressedSize)
+		}
+		return verifyFileContent(p, expected)
+	}
+
+	if mode.Perm() != os.FileMode(fm.Mode).Perm() {
+		return fmt.Sprintf("mode %s, expected %s", mode.Perm(), os.FileMode(fm.Mode).Perm())
+	}
+	return ""
+}
+
+// verifyFileContent reads the whole file through the mount, which makes the
+// snapshotter fetch and verify every span the file belongs to, and compares
+// the resulting digest with the file extracted from the compressed layer.
+func verifyFileContent(p string, expected digest.Digest) string {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Sprintf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	actual, err := digest.FromReader(f)
+	if err != nil {
+		return fmt.Sprintf("cannot read file: %v", err)
+	}
+	if expected == "" {
+		return "file is missing from the compressed layer"
+	}
+	if actual != expected {
+		return fmt.Sprintf("digest %s, expected %s", actual, expected)
+	}
+	return ""
+}
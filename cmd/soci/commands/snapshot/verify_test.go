@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+func TestVerifyLayer(t *testing.T) {
+	toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{
+		testutil.Dir("etc/", testutil.WithDirMode(0755)),
+		testutil.File("etc/passwd", "root:x:0:0", testutil.WithFileMode(0644)),
+		testutil.File("etc/hosts", "127.0.0.1 localhost", testutil.WithFileMode(0644)),
+		testutil.Symlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+	}, gzip.DefaultCompression, 1<<10)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(dir string) error
+		diverged []string
+	}{
+		{
+			name:   "matching layer",
+			modify: func(string) error { return nil },
+		},
+		{
+			name: "modified file",
+			modify: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("root:x:1:1"), 0644)
+			},
+			diverged: []string{"etc/passwd"},
+		},
+		{
+			name: "missing file and wrong symlink",
+			modify: func(dir string) error {
+				if err := os.Remove(filepath.Join(dir, "etc/hosts")); err != nil {
+					return err
+				}
+				if err := os.Remove(filepath.Join(dir, "etc/localtime")); err != nil {
+					return err
+				}
+				return os.Symlink("/etc/UTC", filepath.Join(dir, "etc/localtime"))
+			},
+			diverged: []string{"etc/hosts", "etc/localtime"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "etc"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "etc/passwd"), []byte("root:x:0:0"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "etc/hosts"), []byte("127.0.0.1 localhost"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("/usr/share/zoneinfo/UTC", filepath.Join(dir, "etc/localtime")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.modify(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			divergences, err := verifyLayer(context.Background(), dir, toc, sr)
+			if err != nil {
+				t.Fatalf("failed to verify layer: %v", err)
+			}
+			if len(divergences) != len(tt.diverged) {
+				t.Fatalf("expected divergent files %v, got %v", tt.diverged, divergences)
+			}
+			for i, d := range divergences {
+				if d.path != tt.diverged[i] {
+					t.Fatalf("expected divergent files %v, got %v", tt.diverged, divergences)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteVerifyResultJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeVerifyResult(&b, "snap", 2, 10, nil, true); err != nil {
+		t.Fatalf("verified snapshot returned an error: %v", err)
+	}
+	want := `{
+  "snapshot": "snap",
+  "layers": 2,
+  "files": 10,
+  "divergences": []
+}
+`
+	if b.String() != want {
+		t.Fatalf("expected %s, got %s", want, b.String())
+	}
+
+	b.Reset()
+	divergences := []divergence{
+		{reason: "snapshot has 1 layers but image config has 2 diff_ids"},
+		{layer: "sha256:1111", path: "etc/passwd", reason: "size 10, expected 11"},
+	}
+	if err := writeVerifyResult(&b, "snap", 2, 10, divergences, true); err == nil {
+		t.Fatalf("snapshot with divergent files was verified")
+	}
+	want = `{
+  "snapshot": "snap",
+  "layers": 2,
+  "files": 10,
+  "divergences": [
+    {
+      "reason": "snapshot has 1 layers but image config has 2 diff_ids"
+    },
+    {
+      "layer": "sha256:1111",
+      "path": "etc/passwd",
+      "reason": "size 10, expected 11"
+    }
+  ]
+}
+`
+	if b.String() != want {
+		t.Fatalf("expected %s, got %s", want, b.String())
+	}
+}
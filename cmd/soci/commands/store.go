@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/awslabs/soci-snapshotter/fs/imagemount"
+	"github.com/containerd/containerd/platforms"
+	"github.com/urfave/cli"
+)
+
+const (
+	storeRootFlag     = "root"
+	storePlatformFlag = "platform"
+)
+
+// StoreCommand serves lazily loaded layers as an additional layer store of
+// containers/storage, for CRI-O and podman.
+var StoreCommand = cli.Command{
+	Name:      "store",
+	Usage:     "serve lazily loaded layers to CRI-O and podman as an additional layer store",
+	ArgsUsage: "<mountpoint>",
+	Description: `mount an additional layer store of containers/storage at mountpoint, which lazily
+   loads the layers of images with SOCI indices when they're looked up. Configure it in
+   storage.conf with additionallayerstores = ["<mountpoint>:ref"].
+   Registry credentials are read from the docker config.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  storeRootFlag,
+			Usage: "directory to keep the caches of the layers in",
+			Value: "/var/lib/soci-store",
+		},
+		cli.StringFlag{
+			Name:  storePlatformFlag,
+			Usage: "platform to select from multi-platform images. Defaults to the host platform",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		mountpoint := cliContext.Args().First()
+		if mountpoint == "" {
+			return fmt.Errorf("please provide a mountpoint")
+		}
+		opts := []imagemount.Option{imagemount.WithRoot(cliContext.String(storeRootFlag))}
+		if p := cliContext.String(storePlatformFlag); p != "" {
+			platform, err := platforms.Parse(p)
+			if err != nil {
+				return fmt.Errorf("could not parse platform %s: %w", p, err)
+			}
+			opts = append(opts, imagemount.WithPlatform(platform))
+		}
+		if err := os.MkdirAll(cliContext.String(storeRootFlag), 0700); err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		store, err := imagemount.ServeLayerStore(ctx, mountpoint, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("serving layers at %s\n", mountpoint)
+		<-ctx.Done()
+		return store.Close()
+	},
+}
@@ -0,0 +1,57 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+// UsageCommand reports the disk space used by the running snapshotter.
+var UsageCommand = cli.Command{
+	Name:  "usage",
+	Usage: "display the disk space used by the snapshotter",
+	Description: `display the disk space used by the layer caches, the metadata DBs and the
+   snapshots of the running snapshotter, and its disk budget, as JSON.`,
+	Flags: []cli.Flag{
+		internal.APIAddressFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+		resp, err := internal.GetAPI(ctx, cliContext.String(internal.APIAddressFlagKey), fs.UsagePath)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshotter disk usage: %w", err)
+		}
+		defer resp.Body.Close()
+		var usage fs.Usage
+		if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+			return fmt.Errorf("failed to decode snapshotter disk usage: %w", err)
+		}
+		j, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+		return nil
+	},
+}
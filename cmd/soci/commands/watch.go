@@ -0,0 +1,394 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	watchRepoFlag           = "repo"
+	watchIntervalFlag       = "interval"
+	watchWebhookAddressFlag = "webhook-address"
+	watchOnceFlag           = "once"
+	watchSkipExistingFlag   = "skip-existing"
+	watchStateDirName       = "watch"
+)
+
+// WatchCommand watches a repository for new tags and builds and pushes SOCI indices
+// for them.
+var WatchCommand = cli.Command{
+	Name:  "watch",
+	Usage: "build and push SOCI indices for new tags of a repository",
+	Description: `poll a repository for new tags, and build and push a SOCI index for each of them.
+   Images are fetched into containerd to build their indices, and removed again unless
+   they were already there. Tags whose images already have a SOCI index in the
+   repository are skipped.
+
+   With --webhook-address, a POST request to the address triggers a poll right away,
+   e.g. from a registry webhook or an EventBridge API destination, so the interval can
+   be longer. The tags which were indexed are recorded in the snapshotter's root
+   directory, so that a restarted watch only indexes new tags.`,
+	Flags: append(append(append(
+		commands.RegistryFlags,
+		internal.PlatformFlags...),
+		internal.ManifestTypeFlag,
+		cli.StringFlag{
+			Name:  watchRepoFlag,
+			Usage: "repository to watch, e.g. registry.example.com/app",
+		},
+		cli.DurationFlag{
+			Name:  watchIntervalFlag,
+			Usage: "how often the repository is polled for new tags",
+			Value: time.Minute,
+		},
+		cli.StringFlag{
+			Name:  watchWebhookAddressFlag,
+			Usage: "address to listen on for notifications of new tags, which trigger a poll. Disabled by default",
+		},
+		cli.BoolFlag{
+			Name:  watchOnceFlag,
+			Usage: "poll the repository once and exit",
+		},
+		cli.BoolFlag{
+			Name:  watchSkipExistingFlag,
+			Usage: "only index tags which are pushed after the first poll",
+		}),
+		internal.BuildFlags...),
+	Action: func(cliContext *cli.Context) error {
+		repoName := cliContext.String(watchRepoFlag)
+		if repoName == "" {
+			return errors.New("please provide a repository to watch with --repo")
+		}
+		interval := cliContext.Duration(watchIntervalFlag)
+		if interval <= 0 {
+			return fmt.Errorf("--%s must be positive", watchIntervalFlag)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		repo, err := internal.NewRepository(cliContext, repoName)
+		if err != nil {
+			return err
+		}
+		builderOpts, err := internal.BuildOptions(cliContext)
+		if err != nil {
+			return err
+		}
+		// Creating the snapshotter's root path first if it does not exist, since this ensures, that
+		// it has the limited permission set as drwx--x--x.
+		if err := os.MkdirAll(config.SociSnapshotterRootPath, 0711); err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local store: %w", err)
+		}
+		artifactsDb, err := soci.NewDB(soci.ArtifactsDbPath())
+		if err != nil {
+			return err
+		}
+
+		w := &tagWatcher{
+			cliContext:   cliContext,
+			client:       client,
+			repo:         repo,
+			repoName:     repoName,
+			blobStore:    blobStore,
+			artifactsDb:  artifactsDb,
+			builderOpts:  builderOpts,
+			statePath:    watchStatePath(repoName),
+			skipExisting: cliContext.Bool(watchSkipExistingFlag),
+		}
+		if err := w.loadState(); err != nil {
+			return err
+		}
+		if cliContext.Bool(watchOnceFlag) {
+			return w.poll(ctx)
+		}
+
+		trigger := make(chan struct{}, 1)
+		if addr := cliContext.String(watchWebhookAddressFlag); addr != "" {
+			server := &http.Server{Addr: addr, Handler: webhookHandler(trigger)}
+			go func() {
+				if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					fmt.Fprintf(os.Stderr, "webhook server failed: %v\n", err)
+				}
+			}()
+			defer server.Close()
+			fmt.Printf("listening for notifications on %s\n", addr)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// a failed poll is retried with the next one.
+			if err := w.poll(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to poll %s: %v\n", repoName, err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			case <-trigger:
+			}
+		}
+	},
+}
+
+// webhookHandler triggers a poll for each POST request. The body is ignored, since
+// the formats of notifications differ between registries and a poll finds all new tags.
+func webhookHandler(trigger chan<- struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+			// a poll is already pending.
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// watchStatePath returns the path of the state of the watch of repoName.
+func watchStatePath(repoName string) string {
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(repoName)
+	return filepath.Join(config.SociSnapshotterRootPath, watchStateDirName, name+".json")
+}
+
+// tagWatcher indexes the new tags of a repository.
+type tagWatcher struct {
+	cliContext   *cli.Context
+	client       *containerd.Client
+	repo         *remote.Repository
+	repoName     string
+	blobStore    *oci.Store
+	artifactsDb  *soci.ArtifactsDb
+	builderOpts  []soci.BuildOption
+	statePath    string
+	skipExisting bool
+
+	// indexed are the digests of the images of the tags which were indexed or skipped.
+	indexed map[string]digest.Digest
+}
+
+func (w *tagWatcher) loadState() error {
+	w.indexed = make(map[string]digest.Digest)
+	b, err := os.ReadFile(w.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot read watch state: %w", err)
+	}
+	if err := json.Unmarshal(b, &w.indexed); err != nil {
+		return fmt.Errorf("cannot parse watch state %s: %w", w.statePath, err)
+	}
+	// the first poll already happened.
+	w.skipExisting = false
+	return nil
+}
+
+// saveState replaces the state atomically, so that an interrupted write leaves the
+// previous state.
+func (w *tagWatcher) saveState() error {
+	b, err := json.Marshal(w.indexed)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(w.statePath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-state-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), w.statePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// poll indexes the tags of the repository which weren't indexed with their current
+// image yet. Tags which fail are retried by the next poll.
+func (w *tagWatcher) poll(ctx context.Context) error {
+	var tags []string
+	if err := w.repo.Tags(ctx, "", func(page []string) error {
+		tags = append(tags, page...)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("cannot list tags: %w", err)
+	}
+	sort.Strings(tags)
+
+	var failed []string
+	for _, tag := range tags {
+		desc, err := w.repo.Resolve(ctx, tag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot resolve %s:%s: %v\n", w.repoName, tag, err)
+			failed = append(failed, tag)
+			continue
+		}
+		if w.indexed[tag] == desc.Digest {
+			continue
+		}
+		if !w.skipExisting {
+			if err := w.indexTag(ctx, tag); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot index %s:%s: %v\n", w.repoName, tag, err)
+				failed = append(failed, tag)
+				continue
+			}
+		}
+		w.indexed[tag] = desc.Digest
+		if err := w.saveState(); err != nil {
+			return fmt.Errorf("cannot write watch state: %w", err)
+		}
+	}
+	w.skipExisting = false
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to index tags: %v", failed)
+	}
+	return nil
+}
+
+// indexTag fetches the image of tag into containerd and builds and pushes a SOCI index
+// for each of its platforms which doesn't have one in the repository yet.
+func (w *tagWatcher) indexTag(ctx context.Context, tag string) (retErr error) {
+	ref := w.repoName + ":" + tag
+	ctx, done, err := w.client.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer done(ctx)
+
+	matcher := platforms.All
+	if !w.cliContext.Bool(internal.AllPlatformsFlagKey) {
+		// the platforms of the flags don't depend on the image.
+		ps, err := internal.GetPlatforms(ctx, w.cliContext, images.Image{}, nil)
+		if err != nil {
+			return err
+		}
+		matcher = platforms.Any(ps...)
+	}
+	resolver, err := commands.GetResolver(ctx, w.cliContext)
+	if err != nil {
+		return err
+	}
+	is := w.client.ImageService()
+	_, err = is.Get(ctx, ref)
+	existed := err == nil
+	fmt.Printf("fetching %s\n", ref)
+	img, err := w.client.Fetch(ctx, ref, containerd.WithResolver(resolver), containerd.WithPlatformMatcher(matcher))
+	if err != nil {
+		return err
+	}
+	if !existed {
+		defer func() {
+			if err := is.Delete(ctx, ref); err != nil && !errdefs.IsNotFound(err) && retErr == nil {
+				retErr = err
+			}
+		}()
+	}
+
+	cs := w.client.ContentStore()
+	ps, err := internal.GetPlatforms(ctx, w.cliContext, img, cs)
+	if err != nil {
+		return err
+	}
+	for _, platform := range ps {
+		manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform))
+		if err != nil {
+			return err
+		}
+		referrers, err := fs.NewOCIArtifactClient(w.repo).AllReferrers(ctx, ocispec.Descriptor{Digest: manifestDesc.Digest})
+		if err != nil && !errors.Is(err, fs.ErrNoReferrers) {
+			return fmt.Errorf("failed to fetch list of referrers: %w", err)
+		}
+		if len(referrers) > 0 {
+			fmt.Printf("soci index found for %s (%s): skipping\n", ref, platforms.Format(platform))
+			continue
+		}
+
+		builder, err := soci.NewIndexBuilder(cs, w.blobStore, w.artifactsDb, append(w.builderOpts, soci.WithPlatform(platform))...)
+		if err != nil {
+			return err
+		}
+		indexWithMetadata, err := builder.Build(ctx, img)
+		if err != nil {
+			return err
+		}
+		if err := soci.WriteSociIndex(ctx, indexWithMetadata, w.blobStore, w.artifactsDb); err != nil {
+			return err
+		}
+
+		indexDescriptors, _, err := soci.GetIndexDescriptorCollection(ctx, cs, w.artifactsDb, img, []ocispec.Platform{platform})
+		if err != nil {
+			return err
+		}
+		if len(indexDescriptors) == 0 {
+			return fmt.Errorf("soci index of %s (%s) not found after it was written", ref, platforms.Format(platform))
+		}
+		sort.Slice(indexDescriptors, func(i, j int) bool {
+			return indexDescriptors[i].CreatedAt.Before(indexDescriptors[j].CreatedAt)
+		})
+		indexDesc := indexDescriptors[len(indexDescriptors)-1]
+		if err := oraslib.CopyGraph(ctx, w.blobStore, w.repo, indexDesc.Descriptor, oraslib.DefaultCopyGraphOptions); err != nil {
+			return fmt.Errorf("error pushing graph to remote: %w", err)
+		}
+		fmt.Printf("pushed soci index %s for %s (%s)\n", indexDesc.Digest, ref, platforms.Format(platform))
+	}
+	return nil
+}
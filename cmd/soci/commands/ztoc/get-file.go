@@ -26,6 +26,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/content"
 	"github.com/opencontainers/go-digest"
@@ -37,23 +38,35 @@ import (
 var getFileCommand = cli.Command{
 	Name:      "get-file",
 	Usage:     "retrieve a file from a local image layer using a specified ztoc",
-	ArgsUsage: "<digest> <file>",
+	ArgsUsage: "<digest> [file]",
+	Description: `retrieve a file, or a byte range of a file, from a local image layer.
+   If no file is provided, --offset and --length select a byte range of the
+   uncompressed layer archive instead.`,
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "output, o",
 			Usage: "the file to write the extracted content. Defaults to stdout",
 		},
+		cli.Int64Flag{
+			Name:  "offset",
+			Usage: "the uncompressed offset to start extracting from, relative to the start of the file or archive",
+		},
+		cli.Int64Flag{
+			Name:  "length",
+			Usage: "the number of uncompressed bytes to extract. Defaults to the rest of the file or archive",
+		},
 	},
 	Action: func(cliContext *cli.Context) error {
-		if len(cliContext.Args()) != 2 {
-			return errors.New("please provide both a ztoc digest and a filename to extract")
+		if len(cliContext.Args()) < 1 || len(cliContext.Args()) > 2 {
+			return errors.New("please provide a ztoc digest and optionally a filename to extract")
 		}
 
 		ztocDigest, err := digest.Parse(cliContext.Args()[0])
 		if err != nil {
 			return err
 		}
-		file := cliContext.Args()[1]
+		file := cliContext.Args().Get(1)
+		offset := compression.Offset(cliContext.Int64("offset"))
 
 		client, ctx, cancel, err := commands.NewClient(cliContext)
 		if err != nil {
@@ -71,20 +84,26 @@ var getFileCommand = cli.Command{
 			return err
 		}
 		defer layerReader.Close()
-
-		fileMetadata, err := ztoc.GetMetadataEntry(toc, file)
-		if err != nil {
-			return err
-		}
-		extractConfig := ztoc.FileExtractConfig{
-			UncompressedSize:      fileMetadata.UncompressedSize,
-			UncompressedOffset:    fileMetadata.UncompressedOffset,
-			Checkpoints:           toc.Checkpoints,
-			CompressedArchiveSize: toc.CompressedArchiveSize,
-			MaxSpanID:             toc.MaxSpanID,
+		sr := io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize))
+
+		var data []byte
+		if file == "" {
+			length := toc.UncompressedArchiveSize - offset
+			if cliContext.IsSet("length") {
+				length = compression.Offset(cliContext.Int64("length"))
+			}
+			data, err = ztoc.ExtractRange(sr, toc, offset, length)
+		} else {
+			fileMetadata, metadataErr := ztoc.GetMetadataEntry(toc, file)
+			if metadataErr != nil {
+				return metadataErr
+			}
+			length := fileMetadata.UncompressedSize - offset
+			if cliContext.IsSet("length") {
+				length = compression.Offset(cliContext.Int64("length"))
+			}
+			data, err = ztoc.ExtractFileRange(sr, toc, file, offset, length)
 		}
-
-		data, err := ztoc.ExtractFile(io.NewSectionReader(layerReader, 0, int64(toc.CompressedArchiveSize)), &extractConfig)
 		if err != nil {
 			return err
 		}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"text/tabwriter"
 
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/images"
@@ -29,6 +30,13 @@ import (
 	"github.com/urfave/cli"
 )
 
+// ztocEntry is a ztoc in the JSON output of the list command.
+type ztocEntry struct {
+	Digest      string `json:"digest"`
+	Size        int64  `json:"size"`
+	LayerDigest string `json:"layer_digest"`
+}
+
 var listCommand = cli.Command{
 	Name:        "list",
 	Description: "list ztocs",
@@ -46,8 +54,13 @@ var listCommand = cli.Command{
 			Name:  "verbose, v",
 			Usage: "display extra debugging messages",
 		},
+		internal.OutputFlag,
 	},
 	Action: func(cliContext *cli.Context) error {
+		jsonOutput, err := internal.JSONOutput(cliContext)
+		if err != nil {
+			return err
+		}
 		db, err := soci.NewDB(soci.ArtifactsDbPath())
 		if err != nil {
 			return err
@@ -86,7 +99,7 @@ var listCommand = cli.Command{
 				if err != nil && verbose {
 					// print a warning message if a manifest can't be resolved
 					// continue looking for manifests of other platforms
-					fmt.Printf("no image manifest for platform %s/%s. err: %v\n", p.Architecture, p.OS, err)
+					fmt.Fprintf(os.Stderr, "no image manifest for platform %s/%s. err: %v\n", p.Architecture, p.OS, err)
 				} else {
 					layers = append(layers, manifest.Layers...)
 				}
@@ -120,6 +133,14 @@ var listCommand = cli.Command{
 			}
 		}
 
+		if jsonOutput {
+			entries := make([]ztocEntry, 0, len(artifacts))
+			for _, artifact := range artifacts {
+				entries = append(entries, ztocEntry{Digest: artifact.Digest, Size: artifact.Size, LayerDigest: artifact.OriginalDigest})
+			}
+			return internal.PrintJSON(entries)
+		}
+
 		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
 		writer.Write([]byte("DIGEST\tSIZE\tLAYER DIGEST\t\n"))
 		for _, artifact := range artifacts {
@@ -37,9 +37,15 @@ import (
 	"os"
 
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/cache"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/db"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/debug"
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/image"
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/index"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/profile"
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/snapshot"
 	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/ztoc"
+	"github.com/awslabs/soci-snapshotter/util/fips"
 	"github.com/awslabs/soci-snapshotter/version"
 	"github.com/containerd/containerd/cmd/ctr/commands/run"
 	"github.com/containerd/containerd/defaults"
@@ -78,14 +84,30 @@ func main() {
 		},
 	}
 
-	app.Version = fmt.Sprintf("%s %s", version.Version, version.Revision)
+	// completes commands and flags with --generate-bash-completion, which the scripts
+	// printed by "soci completion" call.
+	app.EnableBashCompletion = true
+	app.Version = fmt.Sprintf("%s %s (crypto: %s)", version.Version, version.Revision, fips.Mode())
 
 	app.Commands = []cli.Command{
 		image.Command,
 		index.Command,
 		ztoc.Command,
+		snapshot.Command,
+		debug.Command,
 		commands.CreateCommand,
+		commands.ConvertCommand,
 		commands.PushCommand,
+		commands.WatchCommand,
+		commands.PrefetchCommand,
+		cache.Command,
+		profile.Command,
+		db.Command,
+		commands.GatewayCommand,
+		commands.StoreCommand,
+		commands.InfoCommand,
+		commands.UsageCommand,
+		commands.CompletionCommand,
 		run.Command,
 	}
 
@@ -0,0 +1,451 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package zstdchunked converts tar layers into the zstd:chunked format used
+// by containers/storage (podman, CRI-O) for lazy pulling.
+//
+// A zstd:chunked layer is a regular zstd compressed tar, so it can be pulled
+// by any client supporting zstd layers. Every chunk of file contents is
+// compressed in its own zstd frame, so it can be fetched and decompressed on
+// its own. The layer ends with skippable frames containing a TOC of the files
+// and their chunks, the tar-split data used to rebuild the tar from the files,
+// and a footer locating both. The TOC and tar-split data are also located by
+// the layer annotations.
+//
+// The chunk boundaries are placed using the TOC of a ztoc, so the tar doesn't
+// have to be parsed again.
+package zstdchunked
+
+import (
+	"bytes"
+	_ "crypto/sha256" // required by digest.Canonical
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Layer annotations locating the TOC and the tar-split data of a zstd:chunked layer.
+const (
+	ManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+	ManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+	TarSplitChecksumAnnotation = "io.github.containers.zstd-chunked.tarsplit-checksum"
+	TarSplitPositionAnnotation = "io.github.containers.zstd-chunked.tarsplit-position"
+)
+
+const (
+	// manifestTypeCRFS is the type of a TOC compatible with the CRFS TOC.
+	manifestTypeCRFS = 1
+
+	// footerSize is the size of the footer payload.
+	footerSize = 64
+
+	// skippableFrameHeaderSize is the size of the magic and the size of a skippable frame.
+	skippableFrameHeaderSize = 8
+
+	// DefaultChunkSize is the default maximum size of a chunk of file contents.
+	DefaultChunkSize = 4 << 20
+)
+
+var (
+	// skippableFrameMagic is the magic of a zstd skippable frame.
+	// https://datatracker.ietf.org/doc/html/rfc8878#section-3.1.2
+	skippableFrameMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+
+	// footerMagic identifies the footer of a zstd:chunked layer.
+	footerMagic = []byte{0x47, 0x6e, 0x55, 0x6c, 0x49, 0x6e, 0x55, 0x78}
+
+	crcTable = crc64.MakeTable(crc64.ISO)
+)
+
+// tocEntry is an entry in the TOC of a zstd:chunked layer.
+type tocEntry struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Linkname  string            `json:"linkName,omitempty"`
+	Mode      int64             `json:"mode,omitempty"`
+	Size      int64             `json:"size,omitempty"`
+	UID       int               `json:"uid,omitempty"`
+	GID       int               `json:"gid,omitempty"`
+	ModTime   *time.Time        `json:"modtime,omitempty"`
+	Devmajor  int64             `json:"devMajor,omitempty"`
+	Devminor  int64             `json:"devMinor,omitempty"`
+	Xattrs    map[string]string `json:"xattrs,omitempty"`
+	Digest    string            `json:"digest,omitempty"`
+	Offset    int64             `json:"offset,omitempty"`
+	EndOffset int64             `json:"endOffset,omitempty"`
+
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+}
+
+type toc struct {
+	Version        int           `json:"version"`
+	Entries        []tocEntry    `json:"entries"`
+	TarSplitDigest digest.Digest `json:"tarSplitDigest,omitempty"`
+}
+
+// tar-split entry types.
+const (
+	tarSplitFileType    = 1
+	tarSplitSegmentType = 2
+)
+
+// tarSplitEntry is an entry of the tar-split data (github.com/vbatts/tar-split).
+type tarSplitEntry struct {
+	Type     int    `json:"type"`
+	Name     string `json:"name,omitempty"`
+	NameRaw  []byte `json:"name_raw,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Payload  []byte `json:"payload"`
+	Position int    `json:"position"`
+}
+
+type options struct {
+	chunkSize int64
+	level     zstd.EncoderLevel
+}
+
+// Option is an option of Convert.
+type Option func(*options)
+
+// WithChunkSize sets the maximum size of a chunk of file contents.
+// Files larger than size are split into multiple chunks.
+func WithChunkSize(size int64) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// WithCompressionLevel sets the zstd compression level.
+func WithCompressionLevel(level int) Option {
+	return func(o *options) {
+		o.level = zstd.EncoderLevelFromZstd(level)
+	}
+}
+
+// Convert reads the uncompressed tar in r, writes it to w as zstd:chunked and returns
+// the annotations for the converted layer. toc is the TOC of the tar, as in its ztoc.
+//
+// The converted layer decompresses to the same tar, so the diff ID of the layer doesn't change.
+func Convert(w io.Writer, r io.Reader, t ztoc.TOC, opts ...Option) (map[string]string, error) {
+	o := options{
+		chunkSize: DefaultChunkSize,
+		level:     zstd.SpeedDefault,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", o.chunkSize)
+	}
+
+	files := append([]ztoc.FileMetadata{}, t.FileMetadata...)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].UncompressedOffset < files[j].UncompressedOffset })
+
+	cw := &countingWriter{w: w}
+	zw, err := zstd.NewWriter(cw, zstd.WithEncoderLevel(o.level))
+	if err != nil {
+		return nil, err
+	}
+	c := &converter{
+		cw:   cw,
+		zw:   zw,
+		r:    r,
+		opts: o,
+	}
+	for _, f := range files {
+		if err := c.addFile(f); err != nil {
+			return nil, fmt.Errorf("failed to convert %q: %w", f.Name, err)
+		}
+	}
+	// Everything after the contents of the last file (e.g. the end of archive marker).
+	trailer, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addSegment(trailer); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return c.writeManifest()
+}
+
+type converter struct {
+	cw   *countingWriter
+	zw   *zstd.Encoder
+	r    io.Reader
+	opts options
+
+	// pos is the offset in the uncompressed tar.
+	pos int64
+
+	entries         []tocEntry
+	tarSplit        bytes.Buffer
+	tarSplitEntries int
+}
+
+// addFile converts the headers and the contents of f.
+func (c *converter) addFile(f ztoc.FileMetadata) error {
+	start := int64(f.UncompressedOffset)
+	if start < c.pos {
+		return fmt.Errorf("file contents at offset %d overlap previous file ending at %d", start, c.pos)
+	}
+	// The tar headers of f, and the padding of the previous file.
+	header := make([]byte, start-c.pos)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if err := c.addSegment(header); err != nil {
+		return err
+	}
+
+	size := int64(f.UncompressedSize)
+	e := tocEntry{
+		Type:     f.Type,
+		Name:     f.Name,
+		Linkname: f.Linkname,
+		Mode:     f.Mode,
+		Size:     size,
+		UID:      f.UID,
+		GID:      f.GID,
+		Devmajor: f.Devmajor,
+		Devminor: f.Devminor,
+		Xattrs:   xattrs(f.Xattrs),
+	}
+	if !f.ModTime.IsZero() {
+		modTime := f.ModTime
+		e.ModTime = &modTime
+	}
+	if f.Type != "reg" || size == 0 {
+		c.entries = append(c.entries, e)
+		return c.addTarSplitFile(f.Name, size, nil)
+	}
+
+	// Every chunk of the contents is in its own frame, so it can be decompressed on its own.
+	fileDigester := digest.Canonical.Digester()
+	crc := crc64.New(crcTable)
+	var chunks []tocEntry
+	for off := int64(0); off < size; off += c.opts.chunkSize {
+		chunkSize := size - off
+		if chunkSize > c.opts.chunkSize {
+			chunkSize = c.opts.chunkSize
+		}
+		if err := c.restartFrame(); err != nil {
+			return err
+		}
+		startOffset := c.cw.n
+		chunkDigester := digest.Canonical.Digester()
+		if _, err := io.CopyN(io.MultiWriter(c.zw, fileDigester.Hash(), chunkDigester.Hash(), crc), c.r, chunkSize); err != nil {
+			return err
+		}
+		if err := c.restartFrame(); err != nil {
+			return err
+		}
+		chunks = append(chunks, tocEntry{
+			Type:        "chunk",
+			Name:        f.Name,
+			Offset:      startOffset,
+			EndOffset:   c.cw.n,
+			ChunkSize:   chunkSize,
+			ChunkOffset: off,
+			ChunkDigest: chunkDigester.Digest().String(),
+		})
+	}
+	c.pos += size
+
+	// The first chunk is described by the file entry itself.
+	e.Digest = fileDigester.Digest().String()
+	e.Offset = chunks[0].Offset
+	e.EndOffset = chunks[0].EndOffset
+	e.ChunkSize = chunks[0].ChunkSize
+	e.ChunkDigest = chunks[0].ChunkDigest
+	c.entries = append(c.entries, e)
+	c.entries = append(c.entries, chunks[1:]...)
+	return c.addTarSplitFile(f.Name, size, crc.Sum(nil))
+}
+
+// addSegment writes raw tar data which isn't file contents.
+func (c *converter) addSegment(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if _, err := c.zw.Write(b); err != nil {
+		return err
+	}
+	c.pos += int64(len(b))
+	return c.addTarSplitEntry(tarSplitEntry{Type: tarSplitSegmentType, Payload: b})
+}
+
+func (c *converter) addTarSplitFile(name string, size int64, crc []byte) error {
+	e := tarSplitEntry{Type: tarSplitFileType, Size: size, Payload: crc}
+	if utf8.ValidString(name) {
+		e.Name = name
+	} else {
+		e.NameRaw = []byte(name)
+	}
+	return c.addTarSplitEntry(e)
+}
+
+func (c *converter) addTarSplitEntry(e tarSplitEntry) error {
+	e.Position = c.tarSplitEntries
+	c.tarSplitEntries++
+	return json.NewEncoder(&c.tarSplit).Encode(e)
+}
+
+// restartFrame ends the current zstd frame, so the next data starts in a new frame.
+func (c *converter) restartFrame() error {
+	if err := c.zw.Close(); err != nil {
+		return err
+	}
+	c.zw.Reset(c.cw)
+	return nil
+}
+
+// writeManifest writes the TOC, the tar-split data, and the footer, and returns
+// the layer annotations locating them.
+func (c *converter) writeManifest() (map[string]string, error) {
+	compressedTarSplit, err := compress(c.tarSplit.Bytes(), c.opts.level)
+	if err != nil {
+		return nil, err
+	}
+	tarSplitDigest := digest.FromBytes(compressedTarSplit)
+
+	manifest, err := json.Marshal(toc{
+		Version:        1,
+		Entries:        c.entries,
+		TarSplitDigest: tarSplitDigest,
+	})
+	if err != nil {
+		return nil, err
+	}
+	compressedManifest, err := compress(manifest, c.opts.level)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestOffset := c.cw.n + skippableFrameHeaderSize
+	if err := writeSkippableFrame(c.cw, compressedManifest); err != nil {
+		return nil, err
+	}
+	tarSplitOffset := c.cw.n + skippableFrameHeaderSize
+	if err := writeSkippableFrame(c.cw, compressedTarSplit); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer[8*0:], uint64(manifestOffset))
+	binary.LittleEndian.PutUint64(footer[8*1:], uint64(len(compressedManifest)))
+	binary.LittleEndian.PutUint64(footer[8*2:], uint64(len(manifest)))
+	binary.LittleEndian.PutUint64(footer[8*3:], manifestTypeCRFS)
+	binary.LittleEndian.PutUint64(footer[8*4:], uint64(tarSplitOffset))
+	binary.LittleEndian.PutUint64(footer[8*5:], uint64(len(compressedTarSplit)))
+	binary.LittleEndian.PutUint64(footer[8*6:], uint64(c.tarSplit.Len()))
+	copy(footer[8*7:], footerMagic)
+	if err := writeSkippableFrame(c.cw, footer); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		ManifestChecksumAnnotation: digest.FromBytes(compressedManifest).String(),
+		ManifestPositionAnnotation: fmt.Sprintf("%d:%d:%d:%d", manifestOffset, len(compressedManifest), len(manifest), manifestTypeCRFS),
+		TarSplitChecksumAnnotation: tarSplitDigest.String(),
+		TarSplitPositionAnnotation: fmt.Sprintf("%d:%d:%d", tarSplitOffset, len(compressedTarSplit), c.tarSplit.Len()),
+	}, nil
+}
+
+// xattrs returns the extended attributes in the PAX records of a tar header,
+// with base64 encoded values.
+func xattrs(paxRecords map[string]string) map[string]string {
+	const xattrPrefix = "SCHILY.xattr."
+	var x map[string]string
+	for k, v := range paxRecords {
+		if !strings.HasPrefix(k, xattrPrefix) {
+			continue
+		}
+		if x == nil {
+			x = make(map[string]string)
+		}
+		x[strings.TrimPrefix(k, xattrPrefix)] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	return x
+}
+
+func compress(b []byte, level zstd.EncoderLevel) ([]byte, error) {
+	zw, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+	return zw.EncodeAll(b, nil), nil
+}
+
+func writeSkippableFrame(w io.Writer, b []byte) error {
+	header := make([]byte, skippableFrameHeaderSize)
+	copy(header, skippableFrameMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(b)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadFooter returns the offsets and sizes of the compressed TOC and tar-split data
+// from the footer at the end of a zstd:chunked layer.
+func ReadFooter(r io.ReaderAt, size int64) (tocOffset, tocSize, tarSplitOffset, tarSplitSize int64, err error) {
+	if size < footerSize+skippableFrameHeaderSize {
+		return 0, 0, 0, 0, errors.New("blob is too small to be zstd:chunked")
+	}
+	footer := make([]byte, footerSize)
+	if _, err := r.ReadAt(footer, size-footerSize); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if !bytes.Equal(footer[8*7:], footerMagic) {
+		return 0, 0, 0, 0, errors.New("blob isn't zstd:chunked: footer magic not found")
+	}
+	return int64(binary.LittleEndian.Uint64(footer[8*0:])),
+		int64(binary.LittleEndian.Uint64(footer[8*1:])),
+		int64(binary.LittleEndian.Uint64(footer[8*4:])),
+		int64(binary.LittleEndian.Uint64(footer[8*5:])),
+		nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zstdchunked
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestConvert(t *testing.T) {
+	const chunkSize = 1000
+	contents := map[string][]byte{
+		"small":   testutil.RandomByteData(100),
+		"chunked": testutil.RandomByteData(2500),
+	}
+	entries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", string(contents["small"])),
+		testutil.File("dir/empty", ""),
+		testutil.Symlink("dir/link", "small"),
+		testutil.File("dir/chunked", string(contents["chunked"])),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, entries, gzip.DefaultCompression, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	gr, err := gzip.NewReader(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarData, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	annotations, err := Convert(&out, bytes.NewReader(tarData), toc.TOC, WithChunkSize(chunkSize))
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	blob := out.Bytes()
+
+	// The layer decompresses to the original tar.
+	zr, err := zstd.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to decompress converted layer: %v", err)
+	}
+	if !bytes.Equal(decompressed, tarData) {
+		t.Fatal("converted layer doesn't decompress to the original tar")
+	}
+
+	// The footer locates the TOC, which matches the annotations.
+	tocOffset, tocSize, _, _, err := ReadFooter(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil {
+		t.Fatalf("failed to read footer: %v", err)
+	}
+	compressedTOC := blob[tocOffset : tocOffset+tocSize]
+	if d := digest.FromBytes(compressedTOC).String(); d != annotations[ManifestChecksumAnnotation] {
+		t.Fatalf("expected TOC digest %s, got %s", annotations[ManifestChecksumAnnotation], d)
+	}
+	tocData, err := zr.DecodeAll(compressedTOC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Entries []tocEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(tocData, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every chunk decompresses on its own.
+	files := make(map[string][]byte)
+	for _, e := range parsed.Entries {
+		if e.Offset == 0 && e.EndOffset == 0 {
+			continue
+		}
+		chunk, err := zr.DecodeAll(blob[e.Offset:e.EndOffset], nil)
+		if err != nil {
+			t.Fatalf("failed to decompress chunk of %s at %d: %v", e.Name, e.ChunkOffset, err)
+		}
+		if int64(len(chunk)) != e.ChunkSize {
+			t.Fatalf("expected chunk of %s at %d to have size %d, got %d", e.Name, e.ChunkOffset, e.ChunkSize, len(chunk))
+		}
+		if digest.FromBytes(chunk).String() != e.ChunkDigest {
+			t.Fatalf("digest of chunk of %s at %d doesn't match", e.Name, e.ChunkOffset)
+		}
+		files[e.Name] = append(files[e.Name], chunk...)
+	}
+	if len(files) != len(contents) {
+		t.Fatalf("expected contents of %d files, got %d", len(contents), len(files))
+	}
+	for name, expected := range contents {
+		if !bytes.Equal(files["dir/"+name], expected) {
+			t.Fatalf("contents of %s don't match", name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// accessHistoryLockTimeout is how long the access history waits for the artifacts DB,
+// which the CLI holds while it runs.
+const accessHistoryLockTimeout = 5 * time.Second
+
+// accessHistory records the spans read from the layers of images in the artifacts DB,
+// so that they're prefetched when the layers are mounted for the same images again.
+type accessHistory struct {
+	dbPath   string
+	maxSpans int
+
+	// fetchProfiles fetches the access profiles of images without access history from
+	// their registries, with credential.
+	fetchProfiles bool
+	credential    Credential
+	// profiles are the image manifest digests whose access profiles were fetched, which
+	// are only fetched once per run: *sync.Once by image manifest digest.
+	profiles sync.Map
+}
+
+// newAccessHistory returns the access history configured by cfg, or nil if it's disabled.
+func newAccessHistory(cfg config.AccessHistoryConfig, dbPath string, credential Credential) *accessHistory {
+	if !cfg.Enable {
+		return nil
+	}
+	return &accessHistory{dbPath: dbPath, maxSpans: cfg.MaxSpans, fetchProfiles: cfg.FetchProfiles, credential: credential}
+}
+
+// prefetch fetches the spans of l which were read when it was mounted for the image
+// imgDigest before, most read first. If the layer has no access history, the access
+// profile of the image is fetched from the registry of imageRef, if enabled. The spans
+// are fetched in the background until the fetches of l are canceled, e.g. when it's unmounted.
+func (h *accessHistory) prefetch(ctx context.Context, l layer.Layer, imageRef, imgDigest string) {
+	if h == nil {
+		return
+	}
+	ztocDigest := l.Info().ZtocDigest.String()
+	go func() {
+		spans, err := soci.AccessedSpans(h.dbPath, accessHistoryLockTimeout, imgDigest, ztocDigest, h.maxSpans)
+		if err == nil && len(spans) == 0 && h.fetchProfiles {
+			h.fetchProfile(ctx, imageRef, imgDigest)
+			spans, err = soci.AccessedSpans(h.dbPath, accessHistoryLockTimeout, imgDigest, ztocDigest, h.maxSpans)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to load access history of layer")
+			return
+		}
+		if len(spans) == 0 {
+			return
+		}
+		start := time.Now()
+		if err := l.PrefetchSpans(ctx, spans); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to prefetch spans from access history")
+			return
+		}
+		log.G(ctx).WithField("spans", len(spans)).WithField("elapsed", time.Since(start).String()).
+			Debug("prefetched spans from access history")
+	}()
+}
+
+// fetchProfile adds the access profile of the image imgDigest, fetched from the registry
+// of imageRef, to the access history. The profile of an image is fetched once, by the
+// first of its layers; the others wait for it.
+func (h *accessHistory) fetchProfile(ctx context.Context, imageRef, imgDigest string) {
+	v, _ := h.profiles.LoadOrStore(imgDigest, &sync.Once{})
+	v.(*sync.Once).Do(func() {
+		refspec, err := reference.Parse(imageRef)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to parse image reference to fetch access profile")
+			return
+		}
+		repo, err := newRemoteStore(ctx, refspec, h.credential)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to fetch access profile")
+			return
+		}
+		profile, err := soci.FetchAccessProfile(ctx, repo, ocispec.Descriptor{Digest: digest.Digest(imgDigest)})
+		if errors.Is(err, soci.ErrNoAccessProfile) {
+			log.G(ctx).Debug("image has no access profile")
+			return
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to fetch access profile")
+			return
+		}
+		if err := soci.ImportAccessProfile(h.dbPath, accessHistoryLockTimeout, imgDigest, profile); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to import access profile")
+			return
+		}
+		log.G(ctx).WithField("layers", len(profile.Layers)).Info("imported access profile of image")
+	})
+}
+
+// record adds spans, which were read from the layer with the ztoc ztocDigest when it was
+// mounted for the image imgDigest, to the access history of the image.
+func (h *accessHistory) record(ctx context.Context, imgDigest string, ztocDigest digest.Digest, spans []compression.SpanID) {
+	if h == nil || imgDigest == "" {
+		return
+	}
+	if err := soci.RecordAccessedSpans(h.dbPath, accessHistoryLockTimeout, imgDigest, ztocDigest.String(), spans); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to record access history of layer")
+	}
+}
@@ -22,9 +22,13 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net/http"
 
+	"github.com/awslabs/soci-snapshotter/fs/progress"
+	fsremote "github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/httputil"
 	"github.com/awslabs/soci-snapshotter/util/ioutils"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
@@ -66,16 +70,37 @@ func newArtifactFetcher(refspec reference.Spec, localStore, remoteStore content.
 	}, nil
 }
 
-func newRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
+// Credential returns the username and secret to authenticate to a registry host with
+// when pulling refspec. A secret without a username is an identity token.
+type Credential func(host string, refspec reference.Spec) (string, string, error)
+
+// dockerConfigCredential returns the credentials of host from the docker config.
+func dockerConfigCredential(host string, _ reference.Spec) (string, string, error) {
+	return dockerconfig.DockerCreds(host)
+}
+
+// NewRemoteStore returns a remote repository for the image reference that
+// authenticates with the credentials from the docker config.
+func NewRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
+	return newRemoteStore(context.Background(), refspec, dockerConfigCredential)
+}
+
+// newRemoteStore returns a remote repository for the image reference that
+// authenticates with the credentials returned by cred. Its requests are recorded
+// in the audit log on behalf of the image and the snapshot of ctx.
+func newRemoteStore(ctx context.Context, refspec reference.Spec, cred Credential) (*remote.Repository, error) {
 	repo, err := remote.NewRepository(refspec.Locator)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
 	}
 
-	authClient := auth.DefaultClient
+	authClient := *auth.DefaultClient
+	authClient.Client = &http.Client{
+		Transport: fsremote.WithAuditLog(ctx, httputil.NewMetadataEncodingTransport(http.DefaultTransport), refspec.String(), ""),
+	}
 	authClient.Cache = auth.DefaultCache
 	authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
-		username, secret, err := dockerconfig.DockerCreds(host)
+		username, secret, err := cred(host, refspec)
 		if err != nil {
 			return auth.EmptyCredential, err
 		}
@@ -91,18 +116,26 @@ func newRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
 		}, nil
 	}
 
-	repo.Client = authClient
+	repo.Client = &authClient
 	return repo, nil
 }
 
-// Constructs a new resolver for Docker registries
-func newResolver() remotes.Resolver {
+// Constructs a new resolver for Docker registries which authenticates
+// with the credentials returned by cred. Its requests are recorded in the
+// audit log on behalf of the image and the snapshot of ctx.
+func newResolver(ctx context.Context, refspec reference.Spec, cred Credential) remotes.Resolver {
 	options := docker.ResolverOptions{
 		Tracker: docker.NewInMemoryTracker(),
 	}
 	hostOptions := ctrdockerconfig.HostOptions{}
-	hostOptions.Credentials = dockerconfig.DockerCreds
+	hostOptions.Credentials = func(host string) (string, string, error) {
+		return cred(host, refspec)
+	}
 	hostOptions.DefaultTLS = &tls.Config{}
+	hostOptions.UpdateClient = func(client *http.Client) error {
+		client.Transport = fsremote.WithAuditLog(ctx, httputil.NewMetadataEncodingTransport(client.Transport), refspec.String(), "")
+		return nil
+	}
 	options.Hosts = ctrdockerconfig.ConfigureHosts(context.Background(), hostOptions)
 	return docker.NewResolver(options)
 }
@@ -165,12 +198,21 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 }
 
 func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore, remoteStore content.Storage) (*soci.Index, error) {
+	return fetchSociArtifacts(ctx, refspec, indexDesc, localStore, remoteStore, dockerConfigCredential)
+}
 
-	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore, newResolver())
+// fetchSociArtifacts is FetchSociArtifacts for remote stores which authenticate with cred.
+func fetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore, remoteStore content.Storage, cred Credential) (*soci.Index, error) {
+	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore, newResolver(ctx, refspec, cred))
 	if err != nil {
 		return nil, fmt.Errorf("could not create an artifact fetcher: %w", err)
 	}
 
+	// The index and ztocs may use any digest algorithm supported by go-digest (e.g. sha512).
+	// Their contents are verified against their digests when they are fetched and stored.
+	if err := indexDesc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid SOCI index digest: %w", err)
+	}
 	log.G(ctx).WithField("digest", indexDesc.Digest).Infof("fetching SOCI index from remote registry")
 
 	indexReader, local, err := fetcher.Fetch(ctx, indexDesc)
@@ -188,7 +230,11 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 		return nil, fmt.Errorf("cannot deserialize byte data to index: %w", err)
 	}
 
+	tracker, ref := progress.FromContext(ctx)
+	tracker.SetPhase(ref, progress.PhaseFetchingZtocs)
+	tracker.AddZtocs(ref, len(index.Blobs))
 	if !local {
+		tracker.AddBytes(ref, cw.Size())
 		b, err := soci.MarshalIndex(&index)
 		if err != nil {
 			return nil, err
@@ -206,6 +252,9 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, blob := range index.Blobs {
 		blob := blob
+		if err := blob.Digest.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid ztoc digest in SOCI index: %w", err)
+		}
 		eg.Go(func() error {
 			rc, local, err := fetcher.Fetch(ctx, blob)
 			if err != nil {
@@ -213,9 +262,14 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 			}
 			defer rc.Close()
 			if local {
+				tracker.ZtocFetched(ref, 0)
 				return nil
 			}
-			return fetcher.Store(ctx, blob, rc)
+			if err := fetcher.Store(ctx, blob, rc); err != nil {
+				return err
+			}
+			tracker.ZtocFetched(ref, blob.Size)
+			return nil
 		})
 	}
 
@@ -19,6 +19,7 @@ package backgroundfetcher
 import (
 	"context"
 	"fmt"
+	"runtime"
 	"time"
 
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
@@ -56,6 +57,18 @@ func WithEmitMetricPeriod(period time.Duration) Option {
 	}
 }
 
+// WithThrottle runs background fetches on `workers` dedicated OS threads, which are throttled by t.
+func WithThrottle(t Throttle, workers int) Option {
+	return func(bf *BackgroundFetcher) error {
+		if workers <= 0 {
+			return fmt.Errorf("number of throttled workers must be positive, got %d", workers)
+		}
+		bf.throttle = t
+		bf.throttledWorkers = workers
+		return nil
+	}
+}
+
 // An interface for a type to "pause" the background fetcher.
 // Useful for mocking in unit tests.
 type pauser interface {
@@ -80,6 +93,10 @@ type BackgroundFetcher struct {
 
 	bfPauser pauser
 
+	throttle         Throttle
+	throttledWorkers int
+	cgroupDir        string
+
 	// All span managers are added to the channel and picked up in Run().
 	// If a span manager is still able to fetch, it is reinserted into the chanel.
 	workQueue chan Resolver
@@ -106,6 +123,14 @@ func NewBackgroundFetcher(opts ...Option) (*BackgroundFetcher, error) {
 		bf.bfPauser = defaultPauser{}
 	}
 
+	if bf.throttle.enabled() {
+		dir, err := bf.throttle.setup()
+		if err != nil {
+			return nil, fmt.Errorf("cannot set up background fetch throttling: %w", err)
+		}
+		bf.cgroupDir = dir
+	}
+
 	return bf, nil
 }
 
@@ -120,6 +145,11 @@ func (bf *BackgroundFetcher) Close() error {
 	return nil
 }
 
+// QueueLen returns the number of layers in the work queue.
+func (bf *BackgroundFetcher) QueueLen() int {
+	return len(bf.workQueue)
+}
+
 // Sends a signal to pause the background fetcher for silencePeriod on the next iteration.
 func (bf *BackgroundFetcher) Pause() {
 	bf.pauseChan <- struct{}{}
@@ -147,6 +177,21 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 	ticker := time.NewTicker(bf.emitMetricPeriod)
 	go bf.emitWorkQueueMetric(ctx, ticker)
 
+	dispatch := func(lr Resolver) { go bf.resolve(ctx, lr) }
+	if bf.throttle.enabled() {
+		jobs := make(chan Resolver)
+		defer close(jobs)
+		for i := 0; i < bf.throttledWorkers; i++ {
+			go bf.throttledWorker(ctx, jobs)
+		}
+		dispatch = func(lr Resolver) {
+			select {
+			case jobs <- lr:
+			case <-ctx.Done():
+			}
+		}
+	}
+
 	for {
 		// Pause the background fetcher if necessary.
 		bf.pause(ctx)
@@ -166,14 +211,7 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 			if lr.Closed() {
 				continue
 			}
-			go func() {
-				more, err := lr.Resolve(ctx)
-				if more {
-					bf.workQueue <- lr
-				} else if err != nil {
-					log.G(ctx).WithError(err).Warn("error trying to resolve layer, removing it from the queue")
-				}
-			}()
+			dispatch(lr)
 		default:
 		}
 
@@ -183,6 +221,38 @@ func (bf *BackgroundFetcher) Run(ctx context.Context) error {
 	}
 }
 
+func (bf *BackgroundFetcher) resolve(ctx context.Context, lr Resolver) {
+	more, err := lr.Resolve(ctx)
+	if more {
+		bf.workQueue <- lr
+	} else if err != nil {
+		log.G(ctx).WithError(err).Warn("error trying to resolve layer, removing it from the queue")
+	}
+}
+
+// throttledWorker resolves layers on a dedicated OS thread which is throttled by bf.throttle.
+func (bf *BackgroundFetcher) throttledWorker(ctx context.Context, jobs <-chan Resolver) {
+	// The thread is never unlocked, so it exits with the goroutine
+	// instead of running other goroutines with the throttle applied.
+	runtime.LockOSThread()
+	if err := bf.throttle.applyToCurrentThread(bf.cgroupDir); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to throttle background fetch worker")
+	}
+	for lr := range jobs {
+		more, err := lr.Resolve(ctx)
+		if more {
+			// Don't block the worker on a full queue; Run may be waiting for a free worker.
+			select {
+			case bf.workQueue <- lr:
+			default:
+				go func(lr Resolver) { bf.workQueue <- lr }(lr)
+			}
+		} else if err != nil {
+			log.G(ctx).WithError(err).Warn("error trying to resolve layer, removing it from the queue")
+		}
+	}
+}
+
 func (bf *BackgroundFetcher) emitWorkQueueMetric(ctx context.Context, ticker *time.Ticker) {
 	for {
 		select {
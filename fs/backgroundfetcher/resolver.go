@@ -81,6 +81,10 @@ func NewSequentialResolver(layerDigest digest.Digest, spanManager *sm.SpanManage
 }
 
 func (lr *sequentialLayerResolver) Resolve(ctx context.Context) (bool, error) {
+	if lr.Closed() {
+		// the layer was closed or its fetches were canceled while the resolver was queued.
+		return false, nil
+	}
 	log.G(ctx).WithFields(logrus.Fields{
 		"layer":  lr.layerDigest,
 		"spanId": lr.nextSpanFetchID,
@@ -92,15 +96,39 @@ func (lr *sequentialLayerResolver) Resolve(ctx context.Context) (bool, error) {
 	err := lr.FetchSingleSpan(lr.nextSpanFetchID)
 	if err == nil {
 		commonmetrics.IncOperationCount(commonmetrics.BackgroundSpanFetchCount, lr.layerDigest)
+		lr.ReportReadStats(lr.layerDigest)
+		// spans fetched on demand before the background fetcher reached them
+		// weren't digested in order, so catch up on them now.
+		if err := lr.DigestSpansUntil(lr.nextSpanFetchID); err != nil {
+			log.G(ctx).WithError(err).WithField("layer", lr.layerDigest).Debug("failed to digest span")
+		}
 		lr.nextSpanFetchID++
 		return true, nil
 	}
 	if errors.Is(err, sm.ErrExceedMaxSpan) {
 		commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.BackgroundFetch, lr.layerDigest, lr.base.start)
+		lr.reportVerification(ctx)
 		return false, nil
 	}
+	if errors.Is(err, sm.ErrDiskPressure) {
+		// the span can't be cached right now; keep the layer and retry the span later.
+		return true, nil
+	}
 
 	commonmetrics.IncOperationCount(commonmetrics.BackgroundSpanFetchFailureCount, lr.layerDigest)
 	return false, fmt.Errorf("error trying to fetch span with spanId = %d from layerDigest = %s: %w",
 		lr.nextSpanFetchID, lr.layerDigest.String(), err)
 }
+
+// reportVerification reports the result of verifying the fully fetched layer against its digest.
+func (lr *sequentialLayerResolver) reportVerification(ctx context.Context) {
+	verified, err := lr.LayerVerified()
+	switch {
+	case err != nil:
+		commonmetrics.IncOperationCount(commonmetrics.BackgroundLayerVerificationFailureCount, lr.layerDigest)
+		log.G(ctx).WithError(err).WithField("layer", lr.layerDigest).Warn("fully fetched layer failed verification")
+	case verified:
+		commonmetrics.IncOperationCount(commonmetrics.BackgroundLayerVerifiedCount, lr.layerDigest)
+		log.G(ctx).WithField("layer", lr.layerDigest).Debug("verified fully fetched layer")
+	}
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backgroundfetcher
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// IOPriorityClassIdle only gives IO bandwidth to background fetches when no other process needs it.
+	IOPriorityClassIdle = "idle"
+	// IOPriorityClassBestEffort is the default IO scheduling class. Background fetches are
+	// scheduled according to their IOPriorityLevel.
+	IOPriorityClassBestEffort = "best-effort"
+
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// from linux/ioprio.h
+	ioprioClassShift   = 13
+	ioprioClassBE      = 2
+	ioprioClassIdle    = 3
+	ioprioWhoProcess   = 1
+	maxIOPriorityLevel = 7
+)
+
+// Throttle configures the threads that background fetches run on, so that
+// background fetches don't interfere with latency sensitive workloads on the node.
+// Each setting is applied to the OS threads of the background fetch workers only.
+type Throttle struct {
+	// IOPriorityClass is the IO scheduling class of background fetches, like ionice(1).
+	// Empty keeps the IO priority of the snapshotter.
+	IOPriorityClass string
+	// IOPriorityLevel is the priority (0-7, lower is higher) of background fetches
+	// within the best-effort IO scheduling class.
+	IOPriorityLevel int
+	// Nice is the nice value of background fetches. 0 keeps the nice value of the snapshotter.
+	Nice int
+	// Cgroup is the name of a cgroup v2 threaded cgroup which is created under the
+	// snapshotter's cgroup to run background fetches in. Empty disables the cgroup.
+	Cgroup string
+	// CPUWeight is the cpu.weight (1-10000) of Cgroup.
+	// The io controller doesn't support threaded cgroups, so IO is only throttled by IOPriorityClass.
+	CPUWeight uint64
+}
+
+func (t Throttle) enabled() bool {
+	return t != Throttle{}
+}
+
+// ioprio returns the value for ioprio_set(2).
+func (t Throttle) ioprio() (int, error) {
+	switch t.IOPriorityClass {
+	case IOPriorityClassIdle:
+		return ioprioClassIdle << ioprioClassShift, nil
+	case IOPriorityClassBestEffort:
+		if t.IOPriorityLevel < 0 || t.IOPriorityLevel > maxIOPriorityLevel {
+			return 0, fmt.Errorf("IO priority level must be between 0 and %d, got %d", maxIOPriorityLevel, t.IOPriorityLevel)
+		}
+		return ioprioClassBE<<ioprioClassShift | t.IOPriorityLevel, nil
+	default:
+		return 0, fmt.Errorf("unknown IO priority class %q, expected %q or %q", t.IOPriorityClass, IOPriorityClassIdle, IOPriorityClassBestEffort)
+	}
+}
+
+// setup validates the throttle and creates its cgroup. It returns the directory of the
+// cgroup, or an empty string if no cgroup is configured.
+func (t Throttle) setup() (string, error) {
+	if t.IOPriorityClass != "" {
+		if _, err := t.ioprio(); err != nil {
+			return "", err
+		}
+	}
+	if t.Nice < -20 || t.Nice > 19 {
+		return "", fmt.Errorf("nice value must be between -20 and 19, got %d", t.Nice)
+	}
+	if t.Cgroup == "" {
+		if t.CPUWeight != 0 {
+			return "", errors.New("cpu weight requires a cgroup")
+		}
+		return "", nil
+	}
+	if strings.ContainsRune(t.Cgroup, '/') {
+		return "", fmt.Errorf("cgroup name %q must not contain '/'", t.Cgroup)
+	}
+
+	parent, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cgroupRoot, parent, t.Cgroup)
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("failed to create cgroup %s: %w", dir, err)
+	}
+	// Only threaded cgroups can contain a subset of the threads of a process.
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.type"), []byte("threaded"), 0); err != nil {
+		return "", fmt.Errorf("failed to make cgroup %s threaded: %w", dir, err)
+	}
+	if t.CPUWeight != 0 {
+		if err := os.WriteFile(filepath.Join(cgroupRoot, parent, "cgroup.subtree_control"), []byte("+cpu"), 0); err != nil {
+			return "", fmt.Errorf("failed to enable cpu controller for cgroup %s: %w", dir, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cpu.weight"), []byte(strconv.FormatUint(t.CPUWeight, 10)), 0); err != nil {
+			return "", fmt.Errorf("failed to set cpu.weight of cgroup %s: %w", dir, err)
+		}
+	}
+	return dir, nil
+}
+
+// applyToCurrentThread applies the throttle to the calling OS thread.
+// The caller must have locked its goroutine to the thread and must never unlock it,
+// so that the thread exits with the goroutine instead of running other goroutines.
+func (t Throttle) applyToCurrentThread(cgroupDir string) error {
+	tid := unix.Gettid()
+	if t.IOPriorityClass != "" {
+		prio, err := t.ioprio()
+		if err != nil {
+			return err
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("failed to set IO priority: %w", errno)
+		}
+	}
+	if t.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, t.Nice); err != nil {
+			return fmt.Errorf("failed to set nice value: %w", err)
+		}
+	}
+	if cgroupDir != "" {
+		if err := os.WriteFile(filepath.Join(cgroupDir, "cgroup.threads"), []byte(strconv.Itoa(tid)), 0); err != nil {
+			return fmt.Errorf("failed to move thread to cgroup %s: %w", cgroupDir, err)
+		}
+	}
+	return nil
+}
+
+// ownCgroup returns the cgroup v2 path of the current process.
+func ownCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		// cgroup v2 entries have the form "0::<path>"
+		if line := s.Text(); strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not available")
+}
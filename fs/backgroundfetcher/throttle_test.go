@@ -0,0 +1,86 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backgroundfetcher
+
+import "testing"
+
+func TestThrottleSetup(t *testing.T) {
+	testCases := []struct {
+		name        string
+		throttle    Throttle
+		expectError bool
+		ioprio      int
+	}{
+		{
+			name:     "idle",
+			throttle: Throttle{IOPriorityClass: IOPriorityClassIdle},
+			ioprio:   3 << 13,
+		},
+		{
+			name:     "best-effort",
+			throttle: Throttle{IOPriorityClass: IOPriorityClassBestEffort, IOPriorityLevel: 7},
+			ioprio:   2<<13 | 7,
+		},
+		{
+			name:        "best-effort level out of range",
+			throttle:    Throttle{IOPriorityClass: IOPriorityClassBestEffort, IOPriorityLevel: 8},
+			expectError: true,
+		},
+		{
+			name:        "unknown class",
+			throttle:    Throttle{IOPriorityClass: "realtime"},
+			expectError: true,
+		},
+		{
+			name:        "nice out of range",
+			throttle:    Throttle{Nice: 20},
+			expectError: true,
+		},
+		{
+			name:        "cpu weight without cgroup",
+			throttle:    Throttle{CPUWeight: 10},
+			expectError: true,
+		},
+		{
+			name:        "nested cgroup",
+			throttle:    Throttle{Cgroup: "a/b"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.throttle.setup()
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ioprio, err := tc.throttle.ioprio()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ioprio != tc.ioprio {
+				t.Fatalf("unexpected ioprio; expected %d, got %d", tc.ioprio, ioprio)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// A cache bundle is a tar archive of the cached spans of lazily loaded layers.
+// It starts with a CacheBundleHeader in CacheBundleHeaderName, followed by one entry
+// per span at "spans/<layer digest algorithm>/<layer digest>/<ztoc digest algorithm>/<ztoc digest>/<span id>".
+// The entries contain the compressed contents of the spans, which are verified against
+// the span digests of the ztoc when they're imported.
+// Spans are keyed by ztoc digest as well as layer digest, since the ztoc determines
+// the span size that the layer is split into.
+const (
+	// CacheExportPath is the path of the endpoint of the snapshotter's API that exports
+	// the cached spans of layers as a cache bundle.
+	CacheExportPath = "/api/v1/cache/export"
+	// CacheImportPath is the path of the endpoint of the snapshotter's API that imports
+	// a cache bundle.
+	CacheImportPath = "/api/v1/cache/import"
+
+	// CacheBundleHeaderName is the name of the first entry of a cache bundle.
+	CacheBundleHeaderName = "soci-cache-bundle.json"
+	// CacheBundleVersion is the version of the cache bundle format.
+	CacheBundleVersion = 1
+
+	cacheBundleSpansDir = "spans"
+	// maxBundleSpanSize limits the size of a single span entry of a cache bundle.
+	maxBundleSpanSize = 1 << 30
+)
+
+// CacheBundleHeader is the first entry of a cache bundle.
+type CacheBundleHeader struct {
+	Version int `json:"version"`
+}
+
+// CacheExportRequest is the body of a request to the cache export endpoint.
+type CacheExportRequest struct {
+	// Layers are the digests of the layers to export. Layers which aren't lazily
+	// loaded by the snapshotter are skipped.
+	Layers []digest.Digest `json:"layers"`
+}
+
+// CacheImportResponse is the body of a response of the cache import endpoint.
+type CacheImportResponse struct {
+	// Spans is the number of spans in the bundle. The spans are imported into the
+	// cache of layers when they're lazily loaded.
+	Spans int `json:"spans"`
+	// Imported is the number of spans imported into layers which are already lazily loaded.
+	Imported int `json:"imported"`
+	// Rejected is the number of spans which failed verification against the ztoc.
+	Rejected int `json:"rejected"`
+}
+
+func cacheBundleSpanName(layerDigest, ztocDigest digest.Digest, spanID compression.SpanID) string {
+	return path.Join(cacheBundleSpansDir,
+		layerDigest.Algorithm().String(), layerDigest.Encoded(),
+		ztocDigest.Algorithm().String(), ztocDigest.Encoded(),
+		strconv.FormatInt(int64(spanID), 10))
+}
+
+func parseCacheBundleSpanName(name string) (layerDigest, ztocDigest digest.Digest, spanID compression.SpanID, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 || parts[0] != cacheBundleSpansDir {
+		return "", "", 0, fmt.Errorf("unexpected entry %q in cache bundle", name)
+	}
+	layerDigest = digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+	if err := layerDigest.Validate(); err != nil {
+		return "", "", 0, fmt.Errorf("invalid layer digest in cache bundle entry %q: %w", name, err)
+	}
+	ztocDigest = digest.NewDigestFromEncoded(digest.Algorithm(parts[3]), parts[4])
+	if err := ztocDigest.Validate(); err != nil {
+		return "", "", 0, fmt.Errorf("invalid ztoc digest in cache bundle entry %q: %w", name, err)
+	}
+	id, err := strconv.ParseInt(parts[5], 10, 32)
+	if err != nil || id < 0 {
+		return "", "", 0, fmt.Errorf("invalid span id in cache bundle entry %q", name)
+	}
+	return layerDigest, ztocDigest, compression.SpanID(id), nil
+}
+
+// mountedLayers returns the lazily loaded layers by digest.
+func (fs *filesystem) mountedLayers() map[digest.Digest]layer.Layer {
+	mounted := make(map[digest.Digest]layer.Layer)
+	fs.layerMu.Lock()
+	for _, l := range fs.layer {
+		mounted[l.Info().Digest] = l
+	}
+	fs.layerMu.Unlock()
+	return mounted
+}
+
+// exportCache writes the cached spans of the mounted layers in req to w as a cache bundle.
+func (fs *filesystem) exportCache(ctx context.Context, req CacheExportRequest, w io.Writer) error {
+	mounted := fs.mountedLayers()
+	tw := tar.NewWriter(w)
+	header, err := json.Marshal(CacheBundleHeader{Version: CacheBundleVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, CacheBundleHeaderName, header); err != nil {
+		return err
+	}
+	for _, dgst := range req.Layers {
+		l, ok := mounted[dgst]
+		if !ok {
+			continue
+		}
+		ztocDigest := l.Info().ZtocDigest
+		if err := l.ExportSpans(ctx, func(spanID compression.SpanID, compressed []byte) error {
+			return writeTarEntry(tw, cacheBundleSpanName(dgst, ztocDigest, spanID), compressed)
+		}); err != nil {
+			return fmt.Errorf("failed to export spans of layer %s: %w", dgst, err)
+		}
+	}
+	return tw.Close()
+}
+
+// importCache imports the spans of the cache bundle r. The spans are imported into the layers
+// that are already lazily loaded, and seeded for the layers that are lazily loaded in the future.
+func (fs *filesystem) importCache(ctx context.Context, r io.Reader) (CacheImportResponse, error) {
+	var resp CacheImportResponse
+	mounted := fs.mountedLayers()
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return resp, fmt.Errorf("failed to read cache bundle: %w", err)
+	}
+	var header CacheBundleHeader
+	if hdr.Name != CacheBundleHeaderName {
+		return resp, fmt.Errorf("not a cache bundle: unexpected first entry %q", hdr.Name)
+	}
+	if err := json.NewDecoder(tr).Decode(&header); err != nil {
+		return resp, fmt.Errorf("failed to read cache bundle header: %w", err)
+	}
+	if header.Version != CacheBundleVersion {
+		return resp, fmt.Errorf("unsupported cache bundle version %d", header.Version)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return resp, nil
+		}
+		if err != nil {
+			return resp, fmt.Errorf("failed to read cache bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		layerDigest, ztocDigest, spanID, err := parseCacheBundleSpanName(hdr.Name)
+		if err != nil {
+			return resp, err
+		}
+		if hdr.Size > maxBundleSpanSize {
+			return resp, fmt.Errorf("cache bundle entry %q is too large (%d bytes)", hdr.Name, hdr.Size)
+		}
+		compressed, err := io.ReadAll(tr)
+		if err != nil {
+			return resp, fmt.Errorf("failed to read cache bundle entry %q: %w", hdr.Name, err)
+		}
+		resp.Spans++
+
+		if l, ok := mounted[layerDigest]; ok && l.Info().ZtocDigest == ztocDigest {
+			// the span is in the cache of the layer from now on, so it isn't seeded.
+			if err := l.ImportSpan(spanID, compressed); err != nil {
+				log.G(ctx).WithError(err).WithField("layer", layerDigest).WithField("span", spanID).Warn("failed to import span")
+				resp.Rejected++
+				continue
+			}
+			resp.Imported++
+			continue
+		}
+		if err := fs.resolver.SeedSpan(layerDigest, ztocDigest, spanID, compressed); err != nil {
+			return resp, fmt.Errorf("failed to seed span %d of layer %s: %w", spanID, layerDigest, err)
+		}
+	}
+}
+
+func writeTarEntry(tw *tar.Writer, name string, b []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(b)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+func (fs *filesystem) cacheExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req CacheExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, l := range req.Layers {
+			if err := l.Validate(); err != nil {
+				http.Error(w, "invalid layer digest: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx := log.WithLogger(r.Context(), log.G(fs.ctx))
+		w.Header().Set("Content-Type", "application/x-tar")
+		if err := fs.exportCache(ctx, req, w); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to export cache")
+			// The bundle is streamed, so abort the response to let the client
+			// see a truncated bundle instead of an incomplete one.
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+func (fs *filesystem) cacheImportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := log.WithLogger(r.Context(), log.G(fs.ctx))
+		resp, err := fs.importCache(ctx, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write cache import response")
+		}
+	})
+}
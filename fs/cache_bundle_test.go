@@ -0,0 +1,125 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type exportLayer struct {
+	breakableLayer
+	digest     digest.Digest
+	ztocDigest digest.Digest
+	spans      map[compression.SpanID][]byte
+}
+
+func (l *exportLayer) Info() layer.Info {
+	return layer.Info{Digest: l.digest, ZtocDigest: l.ztocDigest}
+}
+
+func (l *exportLayer) ExportSpans(_ context.Context, fn func(compression.SpanID, []byte) error) error {
+	for id := compression.SpanID(0); int(id) < len(l.spans); id++ {
+		if err := fn(id, l.spans[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCacheBundleSpanName(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	ztocDigest := digest.SHA512.FromString("ztoc")
+	name := cacheBundleSpanName(layerDigest, ztocDigest, 42)
+	l, z, id, err := parseCacheBundleSpanName(name)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", name, err)
+	}
+	if l != layerDigest || z != ztocDigest || id != 42 {
+		t.Fatalf("unexpected parse result of %q: %v %v %v", name, l, z, id)
+	}
+
+	for _, name := range []string{
+		"spans/sha256/abc/sha256/def/1",
+		"other/" + layerDigest.Algorithm().String() + "/" + layerDigest.Encoded() + "/" + ztocDigest.Algorithm().String() + "/" + ztocDigest.Encoded() + "/1",
+		cacheBundleSpanName(layerDigest, ztocDigest, 1) + "/extra",
+		"spans/" + layerDigest.Algorithm().String() + "/" + layerDigest.Encoded() + "/" + ztocDigest.Algorithm().String() + "/" + ztocDigest.Encoded() + "/-1",
+	} {
+		if _, _, _, err := parseCacheBundleSpanName(name); err == nil {
+			t.Fatalf("expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestExportCache(t *testing.T) {
+	mounted := &exportLayer{
+		digest:     digest.FromString("mounted"),
+		ztocDigest: digest.FromString("ztoc"),
+		spans: map[compression.SpanID][]byte{
+			0: []byte("span 0"),
+			1: []byte("span 1"),
+		},
+	}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{"mounted": mounted},
+	}
+
+	var buf bytes.Buffer
+	if err := fs.exportCache(context.Background(), CacheExportRequest{
+		Layers: []digest.Digest{mounted.digest, digest.FromString("not mounted")},
+	}, &buf); err != nil {
+		t.Fatalf("failed to export cache: %v", err)
+	}
+
+	entries := make(map[string]string)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read bundle: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read bundle entry: %v", err)
+		}
+		names = append(names, hdr.Name)
+		entries[hdr.Name] = string(b)
+	}
+	expected := []string{
+		CacheBundleHeaderName,
+		cacheBundleSpanName(mounted.digest, mounted.ztocDigest, 0),
+		cacheBundleSpanName(mounted.digest, mounted.ztocDigest, 1),
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected bundle entries; expected %v, got %v", expected, names)
+	}
+	if entries[expected[2]] != "span 1" {
+		t.Fatalf("unexpected contents of span 1: %q", entries[expected[2]])
+	}
+}
@@ -58,6 +58,22 @@ type Config struct {
 	MountTimeoutSec                int64  `toml:"mount_timeout_sec"`
 	FuseMetricsEmitWaitDurationSec int64  `toml:"fuse_metrics_emit_wait_duration_sec"`
 
+	// FallbackRetryIntervalSec is how long (in seconds) a failure to fetch the SOCI artifacts
+	// of an image is remembered. Until then, the layers of the image fall back to being
+	// unpacked without retrying; afterwards, new snapshots of the image are lazily loaded
+	// again. Defaults to 300 seconds. A negative value remembers failures until the
+	// snapshotter restarts.
+	FallbackRetryIntervalSec int64 `toml:"fallback_retry_interval_sec"`
+
+	// LazyLoadWithoutRpull lazily loads images pulled without `soci image rpull`, e.g. by
+	// the CRI plugin, whose snapshots only have the standard containerd labels. The SOCI
+	// index is discovered with the Referrers API and the layer sizes are read from the image manifest.
+	LazyLoadWithoutRpull bool `toml:"lazy_load_without_rpull"`
+
+	// RequireFIPS refuses to start the snapshotter unless it uses FIPS 140 validated crypto,
+	// i.e. it was built with BoringCrypto and the fips build tag.
+	RequireFIPS bool `toml:"require_fips"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
@@ -67,6 +83,20 @@ type Config struct {
 	FuseConfig `toml:"fuse"`
 
 	BackgroundFetchConfig `toml:"background_fetch"`
+
+	FetchSchedulerConfig `toml:"fetch_scheduler"`
+
+	FaultInjectionConfig `toml:"fault_injection"`
+
+	DiskBudgetConfig `toml:"disk_budget"`
+
+	HydrationGateConfig `toml:"hydration_gate"`
+
+	MemoryBudgetConfig `toml:"memory_budget"`
+
+	CacheEncryptionConfig `toml:"cache_encryption"`
+
+	AccessHistoryConfig `toml:"access_history"`
 }
 
 type BlobConfig struct {
@@ -81,6 +111,54 @@ type BlobConfig struct {
 	// MaxSpanVerificationRetries defines the number of additional times fetch
 	// will be invoked in case of span verification failure.
 	MaxSpanVerificationRetries int `toml:"max_span_verification_retries"`
+
+	// MaxParallelSpans is the maximum number of spans fetched and uncompressed
+	// in parallel to serve a single read. Defaults to the number of CPUs.
+	MaxParallelSpans int `toml:"max_parallel_spans"`
+
+	// MaxConcurrentDecompressions is the maximum number of spans uncompressed concurrently
+	// across all layers. Defaults to half the number of CPUs. A negative value disables the limit.
+	MaxConcurrentDecompressions int `toml:"max_concurrent_decompressions"`
+
+	// AuditLogPath is the path of an append-only log which records every request to
+	// remote registries made on behalf of each image as a JSON line. Empty disables the audit log.
+	AuditLogPath string `toml:"audit_log_path"`
+
+	// PreCheck checks that each layer exists in the registry and can be fetched with
+	// range requests before it's mounted, so that layers which can't be lazily loaded
+	// fail to mount, and are pulled instead, rather than failing when they're read.
+	PreCheck bool `toml:"pre_check"`
+
+	// ChunkCache keeps the contents of files whose ztocs record their chunk digests (see
+	// `soci create --chunk-size`) in a cache shared by all layers, keyed by the digests,
+	// so that identical files in different layers and images are fetched and stored once.
+	// The chunk cache isn't evicted by the disk budget.
+	ChunkCache bool `toml:"chunk_cache"`
+
+	// SubSpanReads fetches and uncompresses small reads of spans which aren't cached only
+	// from the span's checkpoint up to the end of the read, instead of the whole span, to
+	// cut the read amplification of random-access workloads. A prefix of a span can't be
+	// verified against the span digest, so this should only be enabled for trusted registries.
+	SubSpanReads bool `toml:"sub_span_reads"`
+
+	// CacheVerification is when spans read from the span caches of layers are
+	// verified against the digest they had when they were cached, to detect bit rot
+	// or modifications of the cache directory: "always", "sampled" or "never"
+	// (the default). Spans which fail verification are fetched again.
+	CacheVerification string `toml:"cache_verification"`
+
+	// CacheVerificationSampleRate is the fraction of reads of cached spans which are
+	// verified with "sampled" cache verification. Defaults to 0.01.
+	CacheVerificationSampleRate float64 `toml:"cache_verification_sample_rate"`
+
+	// ConnectTimeoutMsec, FirstByteTimeoutMsec and BodyIdleTimeoutMsec bound the phases
+	// of each fetch from remote registries: getting a connection, waiting for the
+	// response once the request is sent, and waiting for more of the body, so that dead
+	// connections are given up on quickly while large fetches which make progress can
+	// take as long as fetching_timeout_sec. Zero disables the timeout.
+	ConnectTimeoutMsec   int64 `toml:"connect_timeout_msec"`
+	FirstByteTimeoutMsec int64 `toml:"first_byte_timeout_msec"`
+	BodyIdleTimeoutMsec  int64 `toml:"body_idle_timeout_msec"`
 }
 
 type DirectoryCacheConfig struct {
@@ -103,6 +181,51 @@ type FuseConfig struct {
 	// LogFuseOperations enables logging of operations on FUSE FS. This is to be used
 	// for debugging purposes only.
 	LogFuseOperations bool `toml:"log_fuse_operations"`
+
+	// ErrorLogLimit is the number of errors logged per layer and FUSE operation
+	// in each ErrorLogSummaryPeriodSec. Further errors are only counted and reported
+	// in a summary at the end of the period. A negative value disables the limit.
+	ErrorLogLimit int `toml:"error_log_limit"`
+
+	// ErrorLogSummaryPeriodSec is the period (in seconds) of ErrorLogLimit.
+	ErrorLogSummaryPeriodSec int64 `toml:"error_log_summary_period_sec"`
+
+	// FixedTimestamps reports FixedTimestampSec as the access, modification and change
+	// time of all files instead of the modification times recorded in the layers,
+	// e.g. for reproducible builds.
+	FixedTimestamps bool `toml:"fixed_timestamps"`
+
+	// FixedTimestampSec is the Unix time reported for all files if FixedTimestamps is set.
+	FixedTimestampSec int64 `toml:"fixed_timestamp_sec"`
+
+	// ReadaheadBytes is how far ahead of sequential reads the contents of a file are
+	// fetched. 0 uses the default (8 MiB) and a negative value disables readahead.
+	ReadaheadBytes int64 `toml:"readahead_bytes"`
+
+	// MountOptions are the options ("ro", "noexec", "nodev" and "nosuid") the FUSE
+	// mounts of layers are hardened with. Snapshots can add options with the
+	// containerd.io/snapshot/soci.mount-options label, but can't drop these.
+	MountOptions []string `toml:"mount_options"`
+
+	// ReadDeadlineMsec is how long (in milliseconds) a read of a file waits at most for
+	// its contents to be fetched, so that a stuck registry doesn't leave processes in
+	// uninterruptible sleep. 0 disables the deadline.
+	ReadDeadlineMsec int64 `toml:"read_deadline_msec"`
+
+	// ReadDeadlineAction is what happens to reads which hit the deadline: "eio" (the
+	// default) fails them, and "retry" fetches the contents again, doubling the deadline
+	// every time, and fails them after ReadDeadlineRetries retries.
+	ReadDeadlineAction string `toml:"read_deadline_action"`
+
+	// ReadDeadlineRetries is the number of retries of the "retry" action. 0 uses the
+	// default (3).
+	ReadDeadlineRetries int `toml:"read_deadline_retries"`
+
+	// ErrorErrnos maps the classes of the errors of failed reads of files ("timeout",
+	// "interrupted", "fetch", "verification", "decompression" and "other") to the errnos
+	// the reads fail with ("eio", "eagain", "eintr" or "enodata"). Unmapped classes fail
+	// with EIO.
+	ErrorErrnos map[string]string `toml:"error_errnos"`
 }
 
 type BackgroundFetchConfig struct {
@@ -124,4 +247,160 @@ type BackgroundFetchConfig struct {
 	// EmitMetricPeriodSec is the amount of interval (in second) at which the background
 	// fetcher emits metrics
 	EmitMetricPeriodSec int64 `toml:"emit_metric_period_sec"`
+
+	// IOPriorityClass is the IO scheduling class ("idle" or "best-effort") of
+	// background fetches, like ionice(1). Empty keeps the snapshotter's IO priority.
+	IOPriorityClass string `toml:"io_priority_class"`
+
+	// IOPriorityLevel is the priority (0-7, lower is higher) of background
+	// fetches within the "best-effort" IO scheduling class.
+	IOPriorityLevel int `toml:"io_priority_level"`
+
+	// Nice is the nice value of background fetches. 0 keeps the snapshotter's nice value.
+	Nice int `toml:"nice"`
+
+	// Cgroup is the name of a cgroup v2 threaded cgroup, created under the
+	// snapshotter's cgroup, which background fetches run in.
+	Cgroup string `toml:"cgroup"`
+
+	// CgroupCPUWeight is the cpu.weight (1-10000) of Cgroup.
+	CgroupCPUWeight uint64 `toml:"cgroup_cpu_weight"`
+
+	// ThrottledWorkers is the number of threads background fetches run on
+	// when any of the throttling options above is set.
+	ThrottledWorkers int `toml:"throttled_workers"`
+
+	// PromoteBlobs writes layers into containerd's content store once they're fully
+	// fetched and verified, so that pulling them without the snapshotter doesn't download them again.
+	// A copy of each layer is kept on disk until it's promoted.
+	PromoteBlobs bool `toml:"promote_blobs"`
+
+	// ContainerdAddress is the address of containerd's socket layers are promoted to.
+	// Defaults to /run/containerd/containerd.sock.
+	ContainerdAddress string `toml:"containerd_address"`
+
+	// CheckTOC cross-checks the names, sizes and offsets of the entries of the ztocs
+	// of layers against the tar headers of the layers as they're fetched.
+	CheckTOC bool `toml:"check_toc"`
+}
+
+// FetchSchedulerConfig is config for sharing fetches from remote registries fairly
+// between images, so that a single image can't use all fetch slots.
+type FetchSchedulerConfig struct {
+	// MaxConcurrentFetches is the maximum number of concurrent fetches from remote
+	// registries across all images. 0 disables the limit.
+	MaxConcurrentFetches int `toml:"max_concurrent_fetches"`
+
+	// DefaultClass is the workload class of images which aren't labeled with one.
+	DefaultClass string `toml:"default_class"`
+
+	// ClassWeights are the shares of the fetch slots of the images in each workload class.
+	// Classes without a weight have a weight of 1.
+	ClassWeights map[string]int `toml:"class_weights"`
+}
+
+// FaultInjectionConfig injects faults into the requests to remote registries, to test
+// how the snapshotter copes with unreliable registries (e.g. in integration or chaos tests).
+// It must not be used in production.
+type FaultInjectionConfig struct {
+	// Seed seeds the choice of faults, so that the same sequence of requests gets the same faults.
+	Seed int64 `toml:"seed"`
+
+	// LatencyMsec is the latency (in ms) added to each request.
+	LatencyMsec int64 `toml:"latency_msec"`
+
+	// TooManyRequestsRate is the fraction (0-1) of requests which are answered with
+	// 429 Too Many Requests instead of being sent to the registry.
+	TooManyRequestsRate float64 `toml:"too_many_requests_rate"`
+
+	// TruncateRate is the fraction (0-1) of successful responses whose bodies end early.
+	TruncateRate float64 `toml:"truncate_rate"`
+
+	// CorruptRate is the fraction (0-1) of successful responses with a corrupted byte in their body.
+	CorruptRate float64 `toml:"corrupt_rate"`
+}
+
+// Enabled returns whether any faults are injected.
+func (c FaultInjectionConfig) Enabled() bool {
+	return c.LatencyMsec > 0 || c.TooManyRequestsRate > 0 || c.TruncateRate > 0 || c.CorruptRate > 0
+}
+
+// DiskBudgetConfig limits the disk space used by the snapshotter, so that its caches are
+// evicted before the node runs out of disk space.
+type DiskBudgetConfig struct {
+	// MaxBytes is the disk space the layer caches may use. When they use more, the caches
+	// of the least recently used layers which aren't mounted are evicted. The metadata DB
+	// and the snapshots can't be evicted, so they don't count against it. 0 disables the budget.
+	MaxBytes int64 `toml:"max_bytes"`
+
+	// CheckIntervalSec is how often (in seconds) the disk usage is checked against the budget.
+	// Defaults to 60.
+	CheckIntervalSec int64 `toml:"check_interval_sec"`
+}
+
+// HydrationGateConfig delays returning from Mount until enough of the prioritized spans
+// of the layer are cached, for workloads which suffer badly from first-read latency spikes.
+// Images can override it with the hydration snapshot labels.
+type HydrationGateConfig struct {
+	// ThresholdPercent is the percentage of the prioritized spans of a layer which must be
+	// cached before Mount returns. 0 disables the gate.
+	ThresholdPercent int `toml:"threshold_percent"`
+
+	// TimeoutSec is how long (in seconds) Mount waits for the threshold at most. When it
+	// times out, the layer is mounted anyway. Defaults to 30.
+	TimeoutSec int64 `toml:"timeout_sec"`
+}
+
+// MemoryBudgetConfig limits the memory used by the in-memory caches of the snapshotter
+// (the data caches of layers and the ztocs), so that they're dropped before the kernel
+// OOM-kills the snapshotter.
+type MemoryBudgetConfig struct {
+	// MaxBytes is the memory the in-memory caches may use. When they use more, the data
+	// caches are dropped and the least recently used layers which aren't mounted are
+	// evicted. 0 disables the budget.
+	MaxBytes int64 `toml:"max_bytes"`
+
+	// WatermarkPercent is the percentage of the memory limit of the snapshotter's cgroup
+	// (or of the node's memory, if the cgroup has no limit) above which the caches are
+	// dropped regardless of MaxBytes, to avoid being OOM-killed. 0 disables the watermark.
+	WatermarkPercent int `toml:"watermark_percent"`
+
+	// CheckIntervalSec is how often (in seconds) the memory usage is checked.
+	// Defaults to 10.
+	CheckIntervalSec int64 `toml:"check_interval_sec"`
+}
+
+// AccessHistoryConfig prefetches the spans of layers which were read when the layers were
+// mounted for the same image before on the node, e.g. the files containers read at startup.
+type AccessHistoryConfig struct {
+	// Enable records the spans read from the layers of images in the artifacts DB when the
+	// layers are unmounted, and prefetches them when the layers are mounted for the same
+	// image again, before the rest of the layers is fetched in the background.
+	Enable bool `toml:"enable"`
+
+	// MaxSpans is the number of most read spans of a layer which are prefetched.
+	// 0 prefetches all of them.
+	MaxSpans int `toml:"max_spans"`
+
+	// FetchProfiles fetches the access profile of an image from the registry, a referrer of
+	// the image manifest pushed with `soci profile push`, when a layer of the image is
+	// mounted without access history on the node. The profile is added to the access history.
+	FetchProfiles bool `toml:"fetch_profiles"`
+}
+
+// CacheEncryptionConfig encrypts the caches of layers at rest, for nodes where image
+// contents must not be stored in plaintext. When it's enabled, the metadata DB is kept
+// in memory instead of on disk.
+type CacheEncryptionConfig struct {
+	// Enable encrypts the files of the layer caches with AES-256-GCM.
+	Enable bool `toml:"enable"`
+
+	// KeyFile is the path of the file of the 32 byte key, which is raw or hex or
+	// base64 encoded.
+	KeyFile string `toml:"key_file"`
+
+	// KeyCommand is a command which prints the key in the same formats as KeyFile,
+	// e.g. a script which decrypts the data key of the node with a KMS. It's used
+	// instead of KeyFile.
+	KeyCommand []string `toml:"key_command"`
 }
@@ -0,0 +1,154 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// cacheTypes are the supported values of the cache types. Empty is the default
+// (directory) cache.
+var cacheTypes = []string{"", "directory", "memory", "packfile"}
+
+var cacheVerifications = []string{"", "always", "sampled", "never"}
+
+var fuseMountOptions = []string{"ro", "noexec", "nodev", "nosuid"}
+
+var readDeadlineActions = []string{"", "eio", "retry"}
+
+var fuseErrorClasses = []string{"timeout", "interrupted", "fetch", "verification", "decompression", "other"}
+
+var fuseErrnos = []string{"eio", "eagain", "eintr", "enodata"}
+
+// Validate checks that the values of c are in range. All invalid values are reported.
+func (c *Config) Validate() error {
+	var errs *multierror.Error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = multierror.Append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(oneOf(c.HTTPCacheType, cacheTypes), "http_cache_type must be one of %q, got %q", cacheTypes[1:], c.HTTPCacheType)
+	check(oneOf(c.FSCacheType, cacheTypes), "filesystem_cache_type must be one of %q, got %q", cacheTypes[1:], c.FSCacheType)
+	check(c.ResolveResultEntry >= 0, "resolve_result_entry must not be negative")
+	check(c.MaxConcurrency >= 0, "max_concurrency must not be negative")
+	check(c.MountTimeoutSec >= 0, "mount_timeout_sec must not be negative")
+	check(c.FuseMetricsEmitWaitDurationSec >= 0, "fuse_metrics_emit_wait_duration_sec must not be negative")
+
+	b := c.BlobConfig
+	check(b.ValidInterval >= 0, "blob.valid_interval must not be negative")
+	check(b.FetchTimeoutSec >= 0, "blob.fetching_timeout_sec must not be negative")
+	check(b.MaxRetries >= 0, "blob.max_retries must not be negative")
+	check(b.MinWaitMsec >= 0, "blob.min_wait_msec must not be negative")
+	check(b.MaxWaitMsec >= 0, "blob.max_wait_msec must not be negative")
+	check(b.MinWaitMsec == 0 || b.MaxWaitMsec == 0 || b.MinWaitMsec <= b.MaxWaitMsec,
+		"blob.min_wait_msec (%d) must not be greater than blob.max_wait_msec (%d)", b.MinWaitMsec, b.MaxWaitMsec)
+	check(b.MaxSpanVerificationRetries >= 0, "blob.max_span_verification_retries must not be negative")
+	check(b.MaxParallelSpans >= 0, "blob.max_parallel_spans must not be negative")
+	check(oneOf(b.CacheVerification, cacheVerifications),
+		"blob.cache_verification must be one of %q, got %q", cacheVerifications[1:], b.CacheVerification)
+	check(b.CacheVerificationSampleRate >= 0 && b.CacheVerificationSampleRate <= 1,
+		"blob.cache_verification_sample_rate must be between 0 and 1")
+	check(b.ConnectTimeoutMsec >= 0, "blob.connect_timeout_msec must not be negative")
+	check(b.FirstByteTimeoutMsec >= 0, "blob.first_byte_timeout_msec must not be negative")
+	check(b.BodyIdleTimeoutMsec >= 0, "blob.body_idle_timeout_msec must not be negative")
+
+	d := c.DirectoryCacheConfig
+	check(d.MaxLRUCacheEntry >= 0, "directory_cache.max_lru_cache_entry must not be negative")
+	check(d.MaxCacheFds >= 0, "directory_cache.max_cache_fds must not be negative")
+
+	f := c.FuseConfig
+	check(f.AttrTimeout >= 0, "fuse.attr_timeout must not be negative")
+	check(f.EntryTimeout >= 0, "fuse.entry_timeout must not be negative")
+	check(f.NegativeTimeout >= 0, "fuse.negative_timeout must not be negative")
+	check(f.ErrorLogSummaryPeriodSec >= 0, "fuse.error_log_summary_period_sec must not be negative")
+	check(f.ReadDeadlineMsec >= 0, "fuse.read_deadline_msec must not be negative")
+	check(oneOf(f.ReadDeadlineAction, readDeadlineActions),
+		"fuse.read_deadline_action must be one of %q, got %q", readDeadlineActions[1:], f.ReadDeadlineAction)
+	check(f.ReadDeadlineRetries >= 0, "fuse.read_deadline_retries must not be negative")
+	for _, o := range f.MountOptions {
+		check(oneOf(o, fuseMountOptions), "fuse.mount_options must be some of %q, got %q", fuseMountOptions, o)
+	}
+	errorClasses := make([]string, 0, len(f.ErrorErrnos))
+	for class := range f.ErrorErrnos {
+		errorClasses = append(errorClasses, class)
+	}
+	sort.Strings(errorClasses)
+	for _, class := range errorClasses {
+		check(oneOf(class, fuseErrorClasses), "fuse.error_errnos classes must be some of %q, got %q", fuseErrorClasses, class)
+		check(oneOf(f.ErrorErrnos[class], fuseErrnos),
+			"fuse.error_errnos.%q must be one of %q, got %q", class, fuseErrnos, f.ErrorErrnos[class])
+	}
+
+	bf := c.BackgroundFetchConfig
+	check(bf.SilencePeriodMsec >= 0, "background_fetch.silence_period_msec must not be negative")
+	check(bf.FetchPeriodMsec >= 0, "background_fetch.fetch_period_msec must not be negative")
+	check(bf.MaxQueueSize >= 0, "background_fetch.max_queue_size must not be negative")
+	check(bf.EmitMetricPeriodSec >= 0, "background_fetch.emit_metric_period_sec must not be negative")
+	check(oneOf(bf.IOPriorityClass, []string{"", "idle", "best-effort"}),
+		"background_fetch.io_priority_class must be \"idle\" or \"best-effort\", got %q", bf.IOPriorityClass)
+	check(bf.IOPriorityLevel >= 0 && bf.IOPriorityLevel <= 7, "background_fetch.io_priority_level must be between 0 and 7")
+	check(bf.Nice >= -20 && bf.Nice <= 19, "background_fetch.nice must be between -20 and 19")
+	check(!strings.ContainsRune(bf.Cgroup, '/'), "background_fetch.cgroup must not contain '/'")
+	check(bf.CgroupCPUWeight <= 10000, "background_fetch.cgroup_cpu_weight must be between 1 and 10000")
+	check(bf.CgroupCPUWeight == 0 || bf.Cgroup != "", "background_fetch.cgroup_cpu_weight requires background_fetch.cgroup")
+	check(bf.ThrottledWorkers >= 0, "background_fetch.throttled_workers must not be negative")
+
+	fs := c.FetchSchedulerConfig
+	check(fs.MaxConcurrentFetches >= 0, "fetch_scheduler.max_concurrent_fetches must not be negative")
+	classes := make([]string, 0, len(fs.ClassWeights))
+	for class := range fs.ClassWeights {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		check(fs.ClassWeights[class] > 0, "fetch_scheduler.class_weights.%q must be positive", class)
+	}
+
+	fi := c.FaultInjectionConfig
+	check(fi.LatencyMsec >= 0, "fault_injection.latency_msec must not be negative")
+	check(fi.TooManyRequestsRate >= 0 && fi.TooManyRequestsRate <= 1, "fault_injection.too_many_requests_rate must be between 0 and 1")
+	check(fi.TruncateRate >= 0 && fi.TruncateRate <= 1, "fault_injection.truncate_rate must be between 0 and 1")
+	check(fi.CorruptRate >= 0 && fi.CorruptRate <= 1, "fault_injection.corrupt_rate must be between 0 and 1")
+
+	db := c.DiskBudgetConfig
+	check(db.MaxBytes >= 0, "disk_budget.max_bytes must not be negative")
+	check(db.CheckIntervalSec >= 0, "disk_budget.check_interval_sec must not be negative")
+
+	check(c.AccessHistoryConfig.MaxSpans >= 0, "access_history.max_spans must not be negative")
+
+	ce := c.CacheEncryptionConfig
+	check(!ce.Enable || (ce.KeyFile == "") != (len(ce.KeyCommand) == 0),
+		"cache_encryption requires exactly one of cache_encryption.key_file and cache_encryption.key_command")
+	check(!ce.Enable || !c.BackgroundFetchConfig.PromoteBlobs,
+		"cache_encryption can't be used with background_fetch.promote_blobs, since promoted layers are stored unencrypted")
+
+	return errs.ErrorOrNil()
+}
+
+func oneOf(v string, values []string) bool {
+	for _, value := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "valid",
+			cfg: Config{
+				FSCacheType: "packfile",
+				BlobConfig:  BlobConfig{MinWaitMsec: 10, MaxWaitMsec: 100},
+				BackgroundFetchConfig: BackgroundFetchConfig{
+					IOPriorityClass: "best-effort",
+					IOPriorityLevel: 7,
+					Cgroup:          "soci-bg",
+					CgroupCPUWeight: 100,
+				},
+				FetchSchedulerConfig: FetchSchedulerConfig{
+					MaxConcurrentFetches: 32,
+					ClassWeights:         map[string]int{"critical": 4},
+				},
+				FuseConfig: FuseConfig{
+					MountOptions:       []string{"nodev", "nosuid"},
+					ReadDeadlineMsec:   5000,
+					ReadDeadlineAction: "retry",
+					ErrorErrnos:        map[string]string{"timeout": "eagain", "fetch": "enodata"},
+				},
+			},
+		},
+		{
+			name: "invalid",
+			cfg: Config{
+				FSCacheType:    "disk",
+				MaxConcurrency: -1,
+				BlobConfig:     BlobConfig{MinWaitMsec: 100, MaxWaitMsec: 10, CacheVerification: "sometimes", BodyIdleTimeoutMsec: -1},
+				BackgroundFetchConfig: BackgroundFetchConfig{
+					IOPriorityLevel: 8,
+					CgroupCPUWeight: 100,
+				},
+				FetchSchedulerConfig: FetchSchedulerConfig{
+					MaxConcurrentFetches: -1,
+					ClassWeights:         map[string]int{"batch": 0},
+				},
+				FaultInjectionConfig: FaultInjectionConfig{TruncateRate: 1.5},
+				DiskBudgetConfig:     DiskBudgetConfig{MaxBytes: -1},
+				FuseConfig: FuseConfig{
+					MountOptions:       []string{"noexec", "nouser"},
+					ReadDeadlineAction: "hang",
+					ErrorErrnos:        map[string]string{"panic": "eio", "fetch": "ebusy"},
+				},
+				CacheEncryptionConfig: CacheEncryptionConfig{
+					Enable:     true,
+					KeyFile:    "/etc/soci-snapshotter-grpc/cache.key",
+					KeyCommand: []string{"get-key"},
+				},
+				AccessHistoryConfig: AccessHistoryConfig{Enable: true, MaxSpans: -1},
+			},
+			expected: []string{
+				"filesystem_cache_type",
+				"max_concurrency",
+				"blob.min_wait_msec",
+				"blob.cache_verification",
+				"blob.body_idle_timeout_msec",
+				"background_fetch.io_priority_level",
+				"background_fetch.cgroup_cpu_weight requires",
+				"fetch_scheduler.max_concurrent_fetches",
+				`fetch_scheduler.class_weights."batch"`,
+				"fault_injection.truncate_rate",
+				"disk_budget.max_bytes",
+				"fuse.read_deadline_action",
+				`fuse.mount_options must be some of ["ro" "noexec" "nodev" "nosuid"], got "nouser"`,
+				`fuse.error_errnos classes must be some of`,
+				`fuse.error_errnos."fetch" must be one of`,
+				"access_history.max_spans",
+				"cache_encryption requires",
+			},
+		},
+		{
+			name: "cache encryption with promoted blobs",
+			cfg: Config{
+				BackgroundFetchConfig: BackgroundFetchConfig{PromoteBlobs: true},
+				CacheEncryptionConfig: CacheEncryptionConfig{Enable: true, KeyFile: "/etc/soci-snapshotter-grpc/cache.key"},
+			},
+			expected: []string{"background_fetch.promote_blobs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if len(tt.expected) == 0 {
+				if err != nil {
+					t.Fatalf("expected config to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected config to be invalid")
+			}
+			for _, e := range tt.expected {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected error about %q, got %v", e, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	// promotedBlobLeaseExpiration is how long promoted layers are kept in the content store
+	// if they're not referenced by an image by then (e.g. the image was removed).
+	promotedBlobLeaseExpiration = 24 * time.Hour
+)
+
+// containerdPromoter writes layers into containerd's content store.
+type containerdPromoter struct {
+	address string
+
+	// containerd usually starts after the snapshotter, so connect on the first promotion.
+	mu     sync.Mutex
+	client *containerd.Client
+}
+
+// NewContainerdPromoter returns a layer.BlobPromoter that writes layers into the content
+// store of the containerd at address. Promoted layers are leased for a day, after which
+// they're garbage collected unless an image in the namespace references them.
+func NewContainerdPromoter(address string) layer.BlobPromoter {
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+	return &containerdPromoter{address: address}
+}
+
+func (p *containerdPromoter) getClient() (*containerd.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		return p.client, nil
+	}
+	client, err := containerd.New(p.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd at %s: %w", p.address, err)
+	}
+	p.client = client
+	return client, nil
+}
+
+func (p *containerdPromoter) Promote(ctx context.Context, desc ocispec.Descriptor, r io.Reader, labels map[string]string) error {
+	if _, ok := namespaces.Namespace(ctx); !ok {
+		return errors.New("layer isn't mounted in a containerd namespace")
+	}
+	client, err := p.getClient()
+	if err != nil {
+		return err
+	}
+	// the lease keeps the layer from being garbage collected before an image references it.
+	// It's left to expire, instead of being deleted once the layer is written.
+	l, err := client.LeasesService().Create(ctx, leases.WithRandomID(), leases.WithExpiration(promotedBlobLeaseExpiration))
+	if err != nil {
+		return fmt.Errorf("failed to create lease: %w", err)
+	}
+	ctx = leases.WithLease(ctx, l.ID)
+	ref := "soci-promote-" + desc.Digest.String()
+	if err := content.WriteBlob(ctx, client.ContentStore(), ref, r, desc, content.WithLabels(labels)); err != nil {
+		return fmt.Errorf("failed to write layer into content store: %w", err)
+	}
+	return nil
+}
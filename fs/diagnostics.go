@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	iofs "io/fs"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/util/diagnostics"
+)
+
+type backgroundFetchDiagnostics struct {
+	Enabled   bool `json:"enabled"`
+	QueueSize int  `json:"queueSize"`
+}
+
+type cacheDiagnostics struct {
+	Directory string `json:"directory"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// filesystems is the number of filesystems created by the process.
+var filesystems int32
+
+// registerDiagnostics registers the state of the filesystem to be included in
+// diagnostic bundles until ctx is done. Other filesystems in the same process, e.g.
+// mounted by imagemount, are registered with their number, e.g. "mounts-2".
+func (fs *filesystem) registerDiagnostics(ctx context.Context, root string) {
+	var suffix string
+	if n := atomic.AddInt32(&filesystems, 1); n > 1 {
+		suffix = fmt.Sprintf("-%d", n)
+	}
+	providers := map[string]diagnostics.Provider{
+		"mounts": func() (interface{}, error) {
+			return fs.mounts(), nil
+		},
+		"spans": func() (interface{}, error) {
+			return fs.spanStates(""), nil
+		},
+		"background_fetch": func() (interface{}, error) {
+			if fs.bgFetcher == nil {
+				return backgroundFetchDiagnostics{}, nil
+			}
+			return backgroundFetchDiagnostics{
+				Enabled:   true,
+				QueueSize: fs.bgFetcher.QueueLen(),
+			}, nil
+		},
+		"cache": func() (interface{}, error) {
+			var caches []cacheDiagnostics
+			for _, name := range []string{"spancache", "httpcache"} {
+				c, err := dirUsage(filepath.Join(root, name))
+				if err != nil {
+					return nil, err
+				}
+				caches = append(caches, c)
+			}
+			return caches, nil
+		},
+	}
+	for name, p := range providers {
+		diagnostics.Register(name+suffix, p)
+	}
+	go func() {
+		<-ctx.Done()
+		for name := range providers {
+			diagnostics.Unregister(name + suffix)
+		}
+	}()
+}
+
+// dirUsage returns the number and total size of the regular files in dir.
+func dirUsage(dir string) (cacheDiagnostics, error) {
+	c := cacheDiagnostics{Directory: dir}
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			// files are removed from the cache concurrently.
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		c.Files++
+		c.Bytes += info.Size()
+		return nil
+	})
+	return c, err
+}
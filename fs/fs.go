@@ -44,9 +44,12 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -56,16 +59,21 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	layermetrics "github.com/awslabs/soci-snapshotter/fs/metrics/layer"
+	"github.com/awslabs/soci-snapshotter/fs/progress"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/fips"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
 	metrics "github.com/docker/go-metrics"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -97,11 +105,18 @@ const (
 	// The default amount of interval at which the background fetcher emits metrics
 	defaultBgMetricEmitPeriod = 10 * time.Second
 
+	// The default number of threads background fetches run on when they are throttled.
+	defaultBgThrottledWorkers = 4
+
 	// Amount of time Mount will time out if a layer can't be resolved.
 	defaultMountTimeout = 30 * time.Second
 
 	// Amount of time the snapshotter will wait before emitting the metrics for FUSE operation.
 	defaultFuseMetricsEmitWaitDuration = 60 * time.Second
+
+	// Amount of time a failure to fetch the SOCI artifacts of an image is remembered
+	// before lazily loading the image is retried.
+	defaultFallbackRetryInterval = 5 * time.Minute
 )
 
 var (
@@ -115,6 +130,14 @@ type options struct {
 	resolveHandlers   map[string]remote.Handler
 	metadataStore     metadata.Store
 	overlayOpaqueType layer.OverlayOpaqueType
+	apiMux            *http.ServeMux
+	blobPromoter      layer.BlobPromoter
+	snapshotsDir      string
+	metadataFiles     []string
+	credential        Credential
+	contentStorePath  string
+	artifactsDBPath   string
+	pullProgress      *progress.Tracker
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -138,18 +161,136 @@ func WithMetadataStore(metadataStore metadata.Store) Option {
 	}
 }
 
+// WithAPIMux registers the filesystem's API (e.g. prefetching layers) on mux.
+func WithAPIMux(mux *http.ServeMux) Option {
+	return func(opts *options) {
+		opts.apiMux = mux
+	}
+}
+
+// WithBlobPromoter promotes layers with p once they're fully fetched and verified
+// by the background fetcher, instead of the containerd content store configured
+// by BackgroundFetchConfig.PromoteBlobs.
+func WithBlobPromoter(p layer.BlobPromoter) Option {
+	return func(opts *options) {
+		opts.blobPromoter = p
+	}
+}
+
+// WithDiskUsagePaths includes the snapshots in snapshotsDir and the metadata DB files
+// in the disk usage reported by the filesystem and limited by DiskBudgetConfig.
+func WithDiskUsagePaths(snapshotsDir string, metadataFiles ...string) Option {
+	return func(opts *options) {
+		opts.snapshotsDir = snapshotsDir
+		opts.metadataFiles = metadataFiles
+	}
+}
+
+// WithCredential authenticates to registries with the credentials returned by cred when
+// fetching SOCI artifacts and unpacking layers, instead of the credentials from the docker config.
+func WithCredential(cred Credential) Option {
+	return func(opts *options) {
+		opts.credential = cred
+	}
+}
+
+// WithPullProgress records the progress of lazily pulling images in t, e.g. to report
+// it to kubelet through the CRI keychain.
+func WithPullProgress(t *progress.Tracker) Option {
+	return func(opts *options) {
+		opts.pullProgress = t
+	}
+}
+
+// WithContentStorePath stores the SOCI artifacts in the OCI layout at path instead of
+// config.SociContentStorePath.
+func WithContentStorePath(path string) Option {
+	return func(opts *options) {
+		opts.contentStorePath = path
+	}
+}
+
+// WithArtifactsDBPath records the access history of layers in the artifacts DB at path
+// instead of soci.ArtifactsDbPath().
+func WithArtifactsDBPath(path string) Option {
+	return func(opts *options) {
+		opts.artifactsDBPath = path
+	}
+}
+
 func WithOverlayOpaqueType(overlayOpaqueType layer.OverlayOpaqueType) Option {
 	return func(opts *options) {
 		opts.overlayOpaqueType = overlayOpaqueType
 	}
 }
 
+// processConfig is the part of the config which applies to all filesystems of the process.
+type processConfig struct {
+	maxConcurrentDecompressions int
+	maxConcurrentFetches        int
+	faultInjection              config.FaultInjectionConfig
+	auditLogPath                string
+}
+
+var (
+	processConfigMu sync.Mutex
+	// appliedProcessConfig is the process config of the first filesystem, if any.
+	appliedProcessConfig *processConfig
+)
+
+// applyProcessConfig applies the settings of cfg which apply to the whole process, e.g.
+// the concurrency limits, once. Filesystems created later in the same process, e.g. by
+// imagemount, share the settings of the first one instead of overwriting them.
+func applyProcessConfig(ctx context.Context, cfg config.Config) error {
+	pc := processConfig{
+		maxConcurrentDecompressions: cfg.BlobConfig.MaxConcurrentDecompressions,
+		maxConcurrentFetches:        cfg.FetchSchedulerConfig.MaxConcurrentFetches,
+		faultInjection:              cfg.FaultInjectionConfig,
+		auditLogPath:                cfg.BlobConfig.AuditLogPath,
+	}
+	processConfigMu.Lock()
+	defer processConfigMu.Unlock()
+	if appliedProcessConfig != nil {
+		if *appliedProcessConfig != pc {
+			log.G(ctx).Warn("concurrency limits, fault injection and audit log are shared by all filesystems of the process; ignoring the config of this filesystem")
+		}
+		return nil
+	}
+
+	if pc.auditLogPath != "" {
+		auditLog, err := remote.NewAuditLog(pc.auditLogPath)
+		if err != nil {
+			return err
+		}
+		remote.SetAuditLog(auditLog)
+	}
+	spanmanager.SetMaxConcurrentDecompressions(pc.maxConcurrentDecompressions)
+	remote.SetMaxConcurrentFetches(pc.maxConcurrentFetches)
+	remote.SetFaultInjection(pc.faultInjection)
+	if pc.faultInjection.Enabled() {
+		log.G(ctx).WithField("config", pc.faultInjection).Warn("injecting faults into requests to remote registries")
+	}
+	appliedProcessConfig = &pc
+	return nil
+}
+
 func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
 		o(&fsOpts)
 	}
 
+	if cfg.RequireFIPS {
+		if err := fips.Require(); err != nil {
+			return nil, err
+		}
+	}
+	commonmetrics.SetFIPSMode(fips.Enabled())
+
+	if err := applyProcessConfig(ctx, cfg); err != nil {
+		return nil, err
+	}
+
 	attrTimeout := time.Duration(cfg.FuseConfig.AttrTimeout) * time.Second
 	if attrTimeout == 0 {
 		attrTimeout = defaultFuseTimeout
@@ -167,6 +308,11 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 
 	metadataStore := fsOpts.metadataStore
 
+	credential := fsOpts.credential
+	if credential == nil {
+		credential = dockerConfigCredential
+	}
+
 	getSources := fsOpts.getSources
 	if getSources == nil {
 		getSources = source.FromDefaultLabels(func(refspec reference.Spec) (hosts []docker.RegistryHost, _ error) {
@@ -194,7 +340,11 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		bgEmitMetricPeriod = defaultBgMetricEmitPeriod
 	}
 
-	store, err := oci.New(config.SociContentStorePath)
+	contentStorePath := fsOpts.contentStorePath
+	if contentStorePath == "" {
+		contentStorePath = config.SociContentStorePath
+	}
+	store, err := oci.New(contentStorePath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create local store: %w", err)
 	}
@@ -208,10 +358,25 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 			"emitMetricPeriod": bgEmitMetricPeriod,
 		}).Info("constructing background fetcher")
 
-		bgFetcher, err = bf.NewBackgroundFetcher(bf.WithFetchPeriod(bgFetchPeriod),
+		bgOpts := []bf.Option{bf.WithFetchPeriod(bgFetchPeriod),
 			bf.WithSilencePeriod(bgSilencePeriod),
 			bf.WithMaxQueueSize(bgMaxQueueSize),
-			bf.WithEmitMetricPeriod(bgEmitMetricPeriod))
+			bf.WithEmitMetricPeriod(bgEmitMetricPeriod)}
+		bgThrottle := bf.Throttle{
+			IOPriorityClass: cfg.BackgroundFetchConfig.IOPriorityClass,
+			IOPriorityLevel: cfg.BackgroundFetchConfig.IOPriorityLevel,
+			Nice:            cfg.BackgroundFetchConfig.Nice,
+			Cgroup:          cfg.BackgroundFetchConfig.Cgroup,
+			CPUWeight:       cfg.BackgroundFetchConfig.CgroupCPUWeight,
+		}
+		if bgThrottle != (bf.Throttle{}) {
+			bgThrottledWorkers := cfg.BackgroundFetchConfig.ThrottledWorkers
+			if bgThrottledWorkers == 0 {
+				bgThrottledWorkers = defaultBgThrottledWorkers
+			}
+			bgOpts = append(bgOpts, bf.WithThrottle(bgThrottle, bgThrottledWorkers))
+		}
+		bgFetcher, err = bf.NewBackgroundFetcher(bgOpts...)
 
 		if err != nil {
 			return nil, fmt.Errorf("cannot create background fetcher: %w", err)
@@ -221,7 +386,16 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		log.G(context.Background()).Info("background fetch is disabled")
 	}
 
-	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher)
+	promoter := fsOpts.blobPromoter
+	if promoter == nil && cfg.BackgroundFetchConfig.PromoteBlobs {
+		promoter = NewContainerdPromoter(cfg.BackgroundFetchConfig.ContainerdAddress)
+	}
+	if promoter != nil && bgFetcher == nil {
+		log.G(context.Background()).Warn("layers won't be promoted since background fetch is disabled")
+		promoter = nil
+	}
+
+	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher, promoter)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup resolver: %w", err)
 	}
@@ -245,7 +419,27 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		fuseMetricsEmitWaitDuration = defaultFuseMetricsEmitWaitDuration
 	}
 
-	return &filesystem{
+	fallbackRetryInterval := time.Duration(cfg.FallbackRetryIntervalSec) * time.Second
+	if fallbackRetryInterval == 0 {
+		fallbackRetryInterval = defaultFallbackRetryInterval
+	}
+
+	artifactsDBPath := fsOpts.artifactsDBPath
+	if artifactsDBPath == "" {
+		artifactsDBPath = soci.ArtifactsDbPath()
+	}
+
+	hydrationPolicy, err := newHydrationPolicy(cfg.HydrationGateConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	mountOptions, err := parseMountOptions(cfg.FuseConfig.MountOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &filesystem{
 		// it's generally considered bad practice to store a context in a struct,
 		// however `filesystem` has it's own lifecycle as well as a per-request lifecycle.
 		// Some operations (e.g. remote calls) exist within a per-request lifecycle and use
@@ -258,6 +452,9 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		getSources:                  getSources,
 		debug:                       cfg.Debug,
 		layer:                       make(map[string]layer.Layer),
+		mountSources:                make(map[string]mountSource),
+		credential:                  credential,
+		pullProgress:                fsOpts.pullProgress,
 		allowNoVerification:         cfg.AllowNoVerification,
 		disableVerification:         true,
 		metricsController:           c,
@@ -268,28 +465,81 @@ func NewFilesystem(ctx context.Context, root string, cfg config.Config, opts ...
 		bgFetcher:                   bgFetcher,
 		mountTimeout:                mountTimeout,
 		fuseMetricsEmitWaitDuration: fuseMetricsEmitWaitDuration,
-	}, nil
+		fallbackRetryInterval:       fallbackRetryInterval,
+		hydrationPolicy:             hydrationPolicy,
+		accessHistory:               newAccessHistory(cfg.AccessHistoryConfig, artifactsDBPath, credential),
+		mountOptions:                mountOptions,
+		fetchScheduler:              cfg.FetchSchedulerConfig,
+		lazyLoadWithoutRpull:        cfg.LazyLoadWithoutRpull,
+		info:                        newInfo(cfg),
+		usage: &usageTracker{
+			cacheDirs:         []string{filepath.Join(root, "spancache"), filepath.Join(root, "httpcache")},
+			metadataFiles:     fsOpts.metadataFiles,
+			snapshotsDir:      fsOpts.snapshotsDir,
+			budget:            cfg.DiskBudgetConfig.MaxBytes,
+			leastRecentlyUsed: r.LeastRecentlyUsed,
+			evict:             r.Evict,
+		},
+		memory: newMemoryTracker(cfg.MemoryBudgetConfig.MaxBytes, cfg.MemoryBudgetConfig.WatermarkPercent,
+			r.ZtocMemoryUsage, r.LeastRecentlyUsed, r.Evict),
+	}
+	if cfg.DiskBudgetConfig.MaxBytes > 0 || ns != nil {
+		interval := time.Duration(cfg.DiskBudgetConfig.CheckIntervalSec) * time.Second
+		if interval == 0 {
+			interval = defaultDiskBudgetCheckInterval
+		}
+		go fs.usage.run(ctx, interval)
+	}
+	if cfg.MemoryBudgetConfig.MaxBytes > 0 || cfg.MemoryBudgetConfig.WatermarkPercent > 0 || ns != nil {
+		interval := time.Duration(cfg.MemoryBudgetConfig.CheckIntervalSec) * time.Second
+		if interval == 0 {
+			interval = defaultMemoryBudgetCheckInterval
+		}
+		go fs.memory.run(ctx, interval)
+	}
+	fs.registerDiagnostics(ctx, root)
+	if fsOpts.apiMux != nil {
+		fsOpts.apiMux.Handle(PrefetchPath, fs.prefetchHandler())
+		fsOpts.apiMux.Handle(CacheExportPath, fs.cacheExportHandler())
+		fsOpts.apiMux.Handle(CacheImportPath, fs.cacheImportHandler())
+		fsOpts.apiMux.Handle(InfoPath, fs.infoHandler())
+		fsOpts.apiMux.Handle(UsagePath, fs.usageHandler())
+		fsOpts.apiMux.Handle(MountsPath, fs.mountsHandler())
+		fsOpts.apiMux.Handle(SpansPath, fs.spansHandler())
+	}
+	return fs, nil
 }
 
 type sociContext struct {
 	cachedErr            error
+	failedAt             time.Time // when cachedErr was cached
 	cachedErrMu          sync.RWMutex
+	retry                bool // whether the context replaces one that failed
 	bgFetchPauseOnce     sync.Once
 	fetchOnce            sync.Once
 	sociIndex            *soci.Index
+	sociIndexDigest      digest.Digest
 	imageLayerToSociDesc map[string]ocispec.Descriptor
 	fuseOperationCounter *layer.FuseOperationCounter
 }
 
-func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store orascontent.Storage, fuseOpEmitWaitDuration time.Duration) error {
+func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef, indexDigest, imageManifestDigest string, store orascontent.Storage, cred Credential, fuseOpEmitWaitDuration time.Duration) error {
 	var retErr error
 	c.fetchOnce.Do(func() {
 		defer func() {
 			if retErr != nil {
 				c.cachedErrMu.Lock()
 				c.cachedErr = retErr
+				c.failedAt = time.Now()
 				c.cachedErrMu.Unlock()
 			}
+			if c.retry {
+				op := commonmetrics.FallbackRetrySuccessCount
+				if retErr != nil {
+					op = commonmetrics.FallbackRetryFailureCount
+				}
+				commonmetrics.AddImageOperationCount(op, digest.Digest(imageManifestDigest), 1)
+			}
 		}()
 
 		refspec, err := reference.Parse(imageRef)
@@ -298,12 +548,15 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 			return
 		}
 
-		remoteStore, err := newRemoteStore(refspec)
+		remoteStore, err := newRemoteStore(ctx, refspec, cred)
 		if err != nil {
 			retErr = err
 			return
 		}
 
+		tracker, _ := progress.FromContext(ctx)
+		tracker.SetPhase(imageRef, progress.PhaseResolvingIndex)
+
 		client := NewOCIArtifactClient(remoteStore)
 		indexDesc := ocispec.Descriptor{
 			Digest: digest.Digest(indexDigest),
@@ -326,12 +579,13 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 
 		log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
 
-		index, err := FetchSociArtifacts(ctx, refspec, indexDesc, store, remoteStore)
+		index, err := fetchSociArtifacts(ctx, refspec, indexDesc, store, remoteStore, cred)
 		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
 			retErr = fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
 			return
 		}
 		c.sociIndex = index
+		c.sociIndexDigest = indexDesc.Digest
 		c.populateImageLayerToSociMapping(index)
 
 		// Create the FUSE operation counter.
@@ -345,6 +599,13 @@ func (c *sociContext) Init(fsCtx context.Context, ctx context.Context, imageRef,
 	return retErr
 }
 
+// failedBefore returns whether the context failed to initialize before t.
+func (c *sociContext) failedBefore(t time.Time) bool {
+	c.cachedErrMu.RLock()
+	defer c.cachedErrMu.RUnlock()
+	return c.cachedErr != nil && c.failedAt.Before(t)
+}
+
 func (c *sociContext) populateImageLayerToSociMapping(sociIndex *soci.Index) {
 	c.imageLayerToSociDesc = make(map[string]ocispec.Descriptor, len(sociIndex.Blobs))
 	for _, desc := range sociIndex.Blobs {
@@ -358,6 +619,7 @@ type filesystem struct {
 	resolver                    *layer.Resolver
 	debug                       bool
 	layer                       map[string]layer.Layer
+	mountSources                map[string]mountSource // the images layers are mounted for, by mountpoint
 	layerMu                     sync.Mutex
 	allowNoVerification         bool
 	disableVerification         bool
@@ -371,6 +633,120 @@ type filesystem struct {
 	bgFetcher                   *bf.BackgroundFetcher
 	mountTimeout                time.Duration
 	fuseMetricsEmitWaitDuration time.Duration
+	fallbackRetryInterval       time.Duration // negative if failed SOCI contexts are never retried
+	sociContextsMu              sync.Mutex    // serializes replacing failed SOCI contexts
+	hydrationPolicy             hydrationPolicy
+	mountOptions                uintptr // mount flags the FUSE mounts of layers are hardened with
+	fetchScheduler              config.FetchSchedulerConfig
+	lazyLoadWithoutRpull        bool
+	imageLayerSizes             sync.Map // image manifest digest -> *imageLayerSizes
+	info                        Info
+	usage                       *usageTracker
+	memory                      *memoryTracker
+	credential                  Credential
+	pullProgress                *progress.Tracker
+	accessHistory               *accessHistory // nil if disabled
+}
+
+// layerSizesTTL is how long the layer sizes of an image manifest are kept, which
+// covers preparing the snapshots of all the layers of an image.
+const layerSizesTTL = 10 * time.Minute
+
+// imageLayerSizes are the sizes of the layers of an image manifest.
+type imageLayerSizes struct {
+	created time.Time
+	once    sync.Once
+	sizes   map[digest.Digest]int64
+	err     error
+}
+
+// sources returns the sources of the layer of a snapshot. If the image was pulled
+// without rpull and fs.lazyLoadWithoutRpull is set, the missing labels are completed
+// from the image manifest first.
+func (fs *filesystem) sources(ctx context.Context, labels map[string]string) ([]source.Source, error) {
+	if _, ok := labels[source.TargetSizeLabel]; ok || !fs.lazyLoadWithoutRpull {
+		return fs.getSources(labels)
+	}
+	imageRef, ok := labels[ctdsnapshotters.TargetRefLabel]
+	if !ok {
+		return nil, fmt.Errorf("unable to get image ref from labels")
+	}
+	imgDigest, ok := labels[ctdsnapshotters.TargetManifestDigestLabel]
+	if !ok {
+		return nil, fmt.Errorf("unable to get image digest from labels")
+	}
+	now := time.Now()
+	v, loaded := fs.imageLayerSizes.LoadOrStore(imgDigest, &imageLayerSizes{created: now})
+	if !loaded {
+		fs.pruneLayerSizes(now)
+	}
+	s := v.(*imageLayerSizes)
+	s.once.Do(func() {
+		s.sizes, s.err = fetchLayerSizes(ctx, imageRef, imgDigest, fs.credential)
+		if s.err != nil {
+			// don't keep the error, so that the next mount tries again.
+			fs.imageLayerSizes.Delete(imgDigest)
+		}
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	completed, err := source.WithLayerSizes(labels, s.sizes)
+	if err != nil {
+		return nil, err
+	}
+	return fs.getSources(completed)
+}
+
+// pruneLayerSizes forgets the layer sizes of the image manifests which were
+// fetched more than layerSizesTTL before now.
+func (fs *filesystem) pruneLayerSizes(now time.Time) {
+	fs.imageLayerSizes.Range(func(k, v interface{}) bool {
+		if now.Sub(v.(*imageLayerSizes).created) > layerSizesTTL {
+			fs.imageLayerSizes.Delete(k)
+		}
+		return true
+	})
+}
+
+// fetchLayerSizes fetches the image manifest with imgDigest and returns the sizes of its layers.
+func fetchLayerSizes(ctx context.Context, imageRef, imgDigest string, cred Credential) (map[digest.Digest]int64, error) {
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
+	}
+	remoteStore, err := newRemoteStore(ctx, refspec, cred)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create remote store: %w", err)
+	}
+	_, rc, err := remoteStore.FetchReference(ctx, imgDigest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch image manifest %s: %w", imgDigest, err)
+	}
+	defer rc.Close()
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(rc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode image manifest %s: %w", imgDigest, err)
+	}
+	sizes := make(map[digest.Digest]int64, len(manifest.Layers))
+	for _, l := range manifest.Layers {
+		sizes[l.Digest] = l.Size
+	}
+	return sizes, nil
+}
+
+// fetchQueue returns the fetch queue of the image of a snapshot, whose weight is
+// determined by the workload class label of the snapshot.
+func (fs *filesystem) fetchQueue(imageRef string, labels map[string]string) remote.FetchQueue {
+	class, ok := labels[source.WorkloadClassLabel]
+	if !ok {
+		class = fs.fetchScheduler.DefaultClass
+	}
+	weight, ok := fs.fetchScheduler.ClassWeights[class]
+	if !ok {
+		weight = 1
+	}
+	return remote.FetchQueue{Name: imageRef, Weight: weight}
 }
 
 func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
@@ -379,24 +755,32 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 		return fmt.Errorf("unable to get image ref from labels")
 	}
 	// Get source information of this layer.
-	src, err := fs.getSources(labels)
+	src, err := fs.sources(ctx, labels)
 	if err != nil {
 		return err
 	} else if len(src) == 0 {
 		return fmt.Errorf("blob info not found for any labels in %s", fmt.Sprint(labels))
 	}
-	// download the target layer
 	s := src[0]
 	archive := NewLayerArchive()
+	if l, ok := fs.cachedLayer(s.Target.Digest); ok {
+		err := unpackCachedLayer(ctx, l, archive, mountpoint, mounts)
+		l.Done()
+		if err == nil {
+			return nil
+		}
+		log.G(ctx).WithError(err).Warn("failed to unpack layer from cache, fetching it")
+	}
+	// download the target layer
 	refspec, err := reference.Parse(imageRef)
 	if err != nil {
 		return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
 	}
-	remoteStore, err := newRemoteStore(refspec)
+	remoteStore, err := newRemoteStore(ctx, refspec, fs.credential)
 	if err != nil {
 		return fmt.Errorf("cannot create remote store: %w", err)
 	}
-	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, newResolver())
+	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, newResolver(ctx, refspec, fs.credential))
 	if err != nil {
 		return fmt.Errorf("cannot create fetcher: %w", err)
 	}
@@ -410,23 +794,95 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	return nil
 }
 
+// LayerPresent returns true if the layer of a snapshot is present on the node, either
+// in the local content store, e.g. since it was unpacked before, or in the cache of a
+// mounted layer whose spans are all cached. MountLocal unpacks such layers from the
+// content store or the cache without fetching them. The contents of mounted layers
+// aren't shared with the snapshot, they're decompressed from the cache into it.
+func (fs *filesystem) LayerPresent(ctx context.Context, labels map[string]string) bool {
+	src, err := fs.sources(ctx, labels)
+	if err != nil || len(src) == 0 {
+		return false
+	}
+	desc := src[0].Target
+	if l, ok := fs.cachedLayer(desc.Digest); ok {
+		l.Done()
+		return true
+	}
+	exists, err := fs.orasStore.Exists(ctx, desc)
+	return err == nil && exists
+}
+
+// cachedLayer returns a new reference to a mounted layer with dgst whose spans are all
+// cached, so that the layer stays open if it's unmounted while it's read. The caller
+// must call Done on the layer.
+func (fs *filesystem) cachedLayer(dgst digest.Digest) (layer.Layer, bool) {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	for _, l := range fs.layer {
+		if l.Info().Digest == dgst && l.Cached() {
+			if ref, ok := l.Acquire(); ok {
+				return ref, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// unpackCachedLayer unpacks a layer from its cache, i.e. it decompresses the cached spans
+// of l and applies the uncompressed contents to mountpoint.
+// A failed unpack can be retried on the same mountpoint, since applying the layer again
+// replaces the files which were applied.
+func unpackCachedLayer(ctx context.Context, l layer.Layer, a Archive, mountpoint string, mounts []mount.Mount) error {
+	r, err := l.Uncompressed(ctx)
+	if err != nil {
+		return err
+	}
+	if err := applyLayer(ctx, a, mountpoint, r, mounts); err != nil {
+		return err
+	}
+	log.G(ctx).WithField("layer", l.Info().Digest).Info("unpacked layer from cache")
+	return nil
+}
+
 func (fs *filesystem) getSociContext(ctx context.Context, imageRef, indexDigest, imageManifestDigest string) (*sociContext, error) {
 	cAny, _ := fs.sociContexts.LoadOrStore(imageManifestDigest, &sociContext{})
 	c, ok := cAny.(*sociContext)
 	if !ok {
 		return nil, fmt.Errorf("could not load index: fs soci context is invalid type for %s", indexDigest)
 	}
-	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.orasStore, fs.fuseMetricsEmitWaitDuration)
+	if fs.fallbackRetryInterval >= 0 && c.failedBefore(time.Now().Add(-fs.fallbackRetryInterval)) {
+		c = fs.retrySociContext(imageManifestDigest, c)
+	}
+	err := c.Init(fs.ctx, ctx, imageRef, indexDigest, imageManifestDigest, fs.orasStore, fs.credential, fs.fuseMetricsEmitWaitDuration)
 	return c, err
 }
 
+// retrySociContext replaces the failed SOCI context of an image with a new one, so that
+// the image is lazily loaded again instead of falling back to unpacking its layers.
+// Concurrent callers get the same new context.
+func (fs *filesystem) retrySociContext(imageManifestDigest string, failed *sociContext) *sociContext {
+	fs.sociContextsMu.Lock()
+	defer fs.sociContextsMu.Unlock()
+	if cur, ok := fs.sociContexts.Load(imageManifestDigest); ok && cur != failed {
+		if c, ok := cur.(*sociContext); ok {
+			return c
+		}
+	}
+	log.L.WithField("image", imageManifestDigest).Info("retrying to fetch SOCI artifacts that failed before")
+	c := &sociContext{retry: true}
+	fs.sociContexts.Store(imageManifestDigest, c)
+	return c
+}
+
 func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
 	// Setting the start time to measure the Mount operation duration.
 	start := time.Now()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
+	// Without the index digest, the index is discovered with the Referrers API.
 	sociIndexDigest, ok := labels[source.TargetSociIndexDigestLabel]
-	if !ok {
+	if !ok && !fs.lazyLoadWithoutRpull {
 		return fmt.Errorf("unable to get soci index digest from labels")
 	}
 	imageRef, ok := labels[ctdsnapshotters.TargetRefLabel]
@@ -437,24 +893,37 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	if !ok {
 		return fmt.Errorf("unable to get image digest from labels")
 	}
+	mountFlags, err := fs.mountFlags(labels)
+	if err != nil {
+		return err
+	}
 
+	ctx = progress.WithImage(ctx, fs.pullProgress, imageRef)
 	c, err := fs.getSociContext(ctx, imageRef, sociIndexDigest, imgDigest)
 	if err != nil {
 		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
 	}
+	fs.pullProgress.SetPhase(imageRef, progress.PhaseMountingLayers)
 
 	// Get source information of this layer.
-	src, err := fs.getSources(labels)
+	src, err := fs.sources(ctx, labels)
 	if err != nil {
 		return err
 	} else if len(src) == 0 {
 		return fmt.Errorf("source must be passed")
 	}
 
+	// Blobs resolved for this snapshot share the fetch slots of its image.
+	fetchQueue := fs.fetchQueue(imageRef, labels)
+	ctx = remote.WithFetchQueue(ctx, fetchQueue)
+
 	// Resolve the target layer
 	var (
 		resultChan = make(chan layer.Layer)
 		errChan    = make(chan error)
+		// resolvedFrom is the source the layer is resolved from. It's set before
+		// the layer is sent to resultChan.
+		resolvedFrom reference.Spec
 	)
 	go func() {
 		var rErr error
@@ -468,9 +937,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 				rErr = fmt.Errorf("skipping mounting layer %s as FUSE mount: %w", s.Target.Digest.String(), snapshot.ErrNoZtoc)
 				break
 			}
+			if err := verifyDiffID(ctx, labels, sociDesc); err != nil {
+				rErr = fmt.Errorf("cannot mount layer %s: %w", s.Target.Digest, err)
+				break
+			}
 
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc, c.fuseOperationCounter)
 			if err == nil {
+				resolvedFrom = s.Name
 				resultChan <- l
 				return
 			}
@@ -486,6 +960,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		go func() {
 			// Avoids to get canceled by client.
 			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
+			ctx = remote.WithFetchQueue(ctx, fetchQueue)
 			sociDesc, ok := c.imageLayerToSociDesc[desc.Digest.String()]
 			if !ok {
 				log.G(ctx).WithError(snapshot.ErrNoZtoc).WithField("layerDigest", desc.Digest.String()).Debug("skipping layer pre-resolve")
@@ -516,11 +991,23 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			"layerDigest": labels[ctdsnapshotters.TargetLayerDigestLabel],
 		}).Info("timeout waiting for layer to resolve")
 		retErr = fmt.Errorf("timeout waiting for layer %s to resolve", labels[ctdsnapshotters.TargetLayerDigestLabel])
+		// release the layer if it's resolved after all, so that it can be evicted.
+		go func() {
+			select {
+			case l := <-resultChan:
+				l.Done()
+			case <-errChan:
+			}
+		}()
 		return
 	}
 	defer func() {
 		if retErr != nil {
+			dgst := l.Info().Digest
 			l.Done() // don't use this layer.
+			// Resolve the layer from scratch next time, since its state may be the
+			// cause of the failure, unless another mountpoint uses it.
+			fs.resolver.Discard(resolvedFrom, dgst)
 		}
 	}()
 
@@ -539,14 +1026,26 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}
 
 	// Measuring duration of Mount operation for resolved layer.
-	digest := l.Info().Digest // get layer sha
+	info := l.Info()
+	digest := info.Digest // get layer sha
+	fs.pullProgress.AddBytes(imageRef, info.FetchedSize)
 	defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.Mount, digest, start)
 
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.mountSources[mountpoint] = mountSource{imageRef: imageRef, imageDigest: imgDigest, indexDigest: c.sociIndexDigest}
 	fs.layerMu.Unlock()
 	fs.metricsController.Add(mountpoint, l)
+	defer func() {
+		if retErr != nil {
+			fs.layerMu.Lock()
+			delete(fs.layer, mountpoint)
+			delete(fs.mountSources, mountpoint)
+			fs.layerMu.Unlock()
+			fs.metricsController.Remove(mountpoint)
+		}
+	}()
 
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
@@ -560,9 +1059,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		AllowOther: true,   // allow users other than root&mounter to access fs
 		FsName:     "soci", // name this filesystem as "soci"
 		Debug:      fs.debug,
+		// Serve POSIX ACL xattrs (system.posix_acl_*) which the kernel doesn't pass to
+		// FUSE filesystems without ACL support.
+		EnableAcl: true,
 	}
 	if _, err := exec.LookPath(fusermountBin); err == nil {
-		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
+		if mountFlags&syscall.MS_NOSUID == 0 {
+			mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
+		}
 	} else {
 		log.G(ctx).WithError(err).Infof("%s not installed; trying direct mount", fusermountBin)
 		mountOpts.DirectMount = true
@@ -584,7 +1088,62 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	})
 
-	return server.WaitMount()
+	if err := server.WaitMount(); err != nil {
+		// the mount may be established without being served; tear it down so that
+		// the mountpoint can be used by the fallback.
+		if uErr := server.Unmount(); uErr != nil {
+			log.G(ctx).WithError(uErr).Warn("failed to unmount after failed mount")
+		}
+		retErr = err
+		return
+	}
+	if mountFlags != 0 {
+		if err := hardenMount(mountpoint, mountFlags); err != nil {
+			if uErr := server.Unmount(); uErr != nil {
+				log.G(ctx).WithError(uErr).Warn("failed to unmount after failed mount")
+			}
+			retErr = err
+			return
+		}
+	}
+	// the spans read by previous mounts are prefetched even if the mount doesn't wait for them.
+	fs.accessHistory.prefetch(log.WithLogger(fs.ctx, log.G(ctx)), l, imageRef, imgDigest)
+	fs.waitHydration(ctx, l, labels)
+	return nil
+}
+
+// verifyDiffID checks the diffID of the layer recorded by the ztoc descriptor sociDesc of
+// a schema v2 index against the image config.
+func verifyDiffID(ctx context.Context, labels map[string]string, sociDesc ocispec.Descriptor) error {
+	diffID, ok, err := soci.ImageLayerDiffID(sociDesc)
+	if err != nil || !ok {
+		return err
+	}
+	return source.VerifyDiffID(ctx, labels, diffID)
+}
+
+// Usage returns the usage of the layer mounted at mountpoint, whose size is the size of
+// the uncompressed layer, since its contents aren't on disk until they're read.
+func (fs *filesystem) Usage(mountpoint string) (snapshots.Usage, bool) {
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return snapshots.Usage{}, false
+	}
+	return snapshots.Usage{Size: l.Info().UncompressedSize}, true
+}
+
+// LayerSize returns the size of the layer of a snapshot, which is read from the image
+// manifest if the image was pulled without rpull.
+func (fs *filesystem) LayerSize(ctx context.Context, labels map[string]string) (int64, error) {
+	src, err := fs.sources(ctx, labels)
+	if err != nil {
+		return 0, err
+	} else if len(src) == 0 {
+		return 0, fmt.Errorf("source must be passed")
+	}
+	return src[0].Target.Size, nil
 }
 
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -616,7 +1175,7 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	log.G(ctx).WithError(err).Warn("failed to connect to blob")
 
 	// Check failed. Try to refresh the connection with fresh source information
-	src, err := fs.getSources(labels)
+	src, err := fs.sources(ctx, labels)
 	if err != nil {
 		return err
 	}
@@ -649,10 +1208,23 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 		fs.layerMu.Unlock()
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
+	src := fs.mountSources[mountpoint]
 	delete(fs.layer, mountpoint) // unregisters the corresponding layer
+	delete(fs.mountSources, mountpoint)
+	info := l.Info()
+	if !fs.isLayerMountedLocked(info.Digest) {
+		// Nothing uses the layer anymore, e.g. the container exited before the layer was
+		// fully fetched. The layer stays cached, but fetching the rest of it is wasted work.
+		l.CancelFetches()
+	}
+	var accessed []compression.SpanID
+	if fs.accessHistory != nil {
+		accessed = l.AccessedSpans()
+	}
 	l.Done()
 	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
+	fs.accessHistory.record(ctx, src.imageDigest, info.ZtocDigest, accessed)
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
@@ -661,6 +1233,17 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
+// isLayerMountedLocked returns true if the layer with dgst is mounted on any mountpoint.
+// fs.layerMu must be held.
+func (fs *filesystem) isLayerMountedLocked(dgst digest.Digest) bool {
+	for _, l := range fs.layer {
+		if l.Info().Digest == dgst {
+			return true
+		}
+	}
+	return false
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
@@ -41,11 +41,16 @@ package fs
 import (
 	"context"
 	"fmt"
+	"io"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -74,16 +79,122 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestPruneLayerSizes(t *testing.T) {
+	fs := &filesystem{}
+	now := time.Now()
+	fs.imageLayerSizes.Store("old", &imageLayerSizes{created: now.Add(-2 * layerSizesTTL)})
+	fs.imageLayerSizes.Store("new", &imageLayerSizes{created: now.Add(-layerSizesTTL / 2)})
+	fs.pruneLayerSizes(now)
+	if _, ok := fs.imageLayerSizes.Load("old"); ok {
+		t.Errorf("expired layer sizes weren't pruned")
+	}
+	if _, ok := fs.imageLayerSizes.Load("new"); !ok {
+		t.Errorf("unexpired layer sizes were pruned")
+	}
+}
+
+func TestSociContextRetry(t *testing.T) {
+	const image = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name     string
+		interval time.Duration
+		failedAt time.Time
+		retried  bool
+	}{
+		{
+			name:     "failure expired",
+			interval: time.Minute,
+			failedAt: time.Now().Add(-2 * time.Minute),
+			retried:  true,
+		},
+		{
+			name:     "failure not expired",
+			interval: time.Minute,
+			failedAt: time.Now(),
+		},
+		{
+			name:     "failures never expire",
+			interval: -1,
+			failedAt: time.Now().Add(-time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &filesystem{ctx: context.Background(), fallbackRetryInterval: tt.interval}
+			failed := &sociContext{cachedErr: fmt.Errorf("transient error"), failedAt: tt.failedAt}
+			failed.fetchOnce.Do(func() {})
+			fs.sociContexts.Store(image, failed)
+
+			// the retry fails too since the image ref is invalid.
+			c, err := fs.getSociContext(context.Background(), "", "", image)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if retried := c != failed; retried != tt.retried {
+				t.Fatalf("unexpected retry; expected %v, got %v", tt.retried, retried)
+			}
+			cur, _ := fs.sociContexts.Load(image)
+			if cur != c {
+				t.Fatalf("the context of the image wasn't replaced")
+			}
+		})
+	}
+}
+
+func TestApplyProcessConfigOnce(t *testing.T) {
+	processConfigMu.Lock()
+	applied := appliedProcessConfig
+	appliedProcessConfig = nil
+	processConfigMu.Unlock()
+	t.Cleanup(func() {
+		processConfigMu.Lock()
+		appliedProcessConfig = applied
+		processConfigMu.Unlock()
+		remote.SetMaxConcurrentFetches(0)
+	})
+
+	var first, second config.Config
+	first.FetchSchedulerConfig.MaxConcurrentFetches = 4
+	second.FetchSchedulerConfig.MaxConcurrentFetches = 8
+	for _, cfg := range []config.Config{first, second} {
+		if err := applyProcessConfig(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := appliedProcessConfig.maxConcurrentFetches; n != 4 {
+		t.Fatalf("the process config of a later filesystem was applied; expected 4 concurrent fetches, got %d", n)
+	}
+}
+
 type breakableLayer struct {
 	success bool
 }
 
 func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
+func (l *breakableLayer) SpanStates() spanmanager.SpanStates                  { return spanmanager.SpanStates{} }
 func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       { return nil, nil }
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) Prefetch(context.Context, []string) error            { return nil }
+func (l *breakableLayer) Hydrate(context.Context, []string, float64) (float64, error) {
+	return 1, nil
+}
+func (l *breakableLayer) ExportSpans(context.Context, func(compression.SpanID, []byte) error) error {
+	return nil
+}
+func (l *breakableLayer) ImportSpan(compression.SpanID, []byte) error { return nil }
+func (l *breakableLayer) PrefetchSpans(context.Context, []compression.SpanID) error {
+	return nil
+}
+func (l *breakableLayer) AccessedSpans() []compression.SpanID { return nil }
+func (l *breakableLayer) Cached() bool                        { return false }
+func (l *breakableLayer) Uncompressed(context.Context) (io.Reader, error) {
+	return nil, fmt.Errorf("fail")
+}
+func (l *breakableLayer) CancelFetches()               {}
+func (l *breakableLayer) Acquire() (layer.Layer, bool) { return l, true }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Amount of time Mount waits at most for the prioritized spans of a layer to be cached.
+const defaultHydrationTimeout = 30 * time.Second
+
+// hydrationPolicy is how much of a layer must be cached before Mount returns.
+type hydrationPolicy struct {
+	// threshold is the fraction (between 0 and 1) of the prioritized spans which
+	// must be cached. 0 disables the gate.
+	threshold float64
+	timeout   time.Duration
+	// paths are the files whose spans are prioritized, or all files if empty.
+	paths []string
+}
+
+func newHydrationPolicy(cfg config.HydrationGateConfig) (hydrationPolicy, error) {
+	if cfg.ThresholdPercent < 0 || cfg.ThresholdPercent > 100 {
+		return hydrationPolicy{}, fmt.Errorf("hydration threshold must be between 0 and 100, got %d", cfg.ThresholdPercent)
+	}
+	timeout := time.Duration(cfg.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHydrationTimeout
+	}
+	return hydrationPolicy{threshold: float64(cfg.ThresholdPercent) / 100, timeout: timeout}, nil
+}
+
+// withLabels returns the policy of a snapshot, whose hydration labels override p.
+func (p hydrationPolicy) withLabels(labels map[string]string) (hydrationPolicy, error) {
+	if v, ok := labels[source.HydrationThresholdLabel]; ok {
+		percent, err := strconv.Atoi(v)
+		if err != nil || percent < 0 || percent > 100 {
+			return p, fmt.Errorf("invalid hydration threshold %q: must be a percentage between 0 and 100", v)
+		}
+		p.threshold = float64(percent) / 100
+	}
+	if v, ok := labels[source.HydrationTimeoutLabel]; ok {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec <= 0 {
+			return p, fmt.Errorf("invalid hydration timeout %q: must be a positive number of seconds", v)
+		}
+		p.timeout = time.Duration(sec) * time.Second
+	}
+	if v, ok := labels[source.HydrationPathsLabel]; ok && v != "" {
+		var paths []string
+		if err := json.Unmarshal([]byte(v), &paths); err != nil {
+			return p, fmt.Errorf("invalid hydration paths label: %w", err)
+		}
+		p.paths = paths
+	}
+	return p, nil
+}
+
+// waitHydration waits until the prioritized spans of l are cached as required by the
+// hydration labels of the snapshot, or until the policy times out. The layer is usable
+// either way, so failing to hydrate it is only logged.
+func (fs *filesystem) waitHydration(ctx context.Context, l layer.Layer, labels map[string]string) {
+	policy, err := fs.hydrationPolicy.withLabels(labels)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("ignoring hydration labels")
+		policy = fs.hydrationPolicy
+	}
+	if policy.threshold <= 0 {
+		return
+	}
+	digest := l.Info().Digest
+	start := time.Now()
+	defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.MountHydrationWait, digest, start)
+
+	ctx, cancel := context.WithTimeout(ctx, policy.timeout)
+	defer cancel()
+	cached, err := l.Hydrate(ctx, policy.paths, policy.threshold)
+	fields := logrus.Fields{
+		"layerDigest": digest,
+		"threshold":   policy.threshold,
+		"cached":      cached,
+		"elapsed":     time.Since(start).String(),
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		commonmetrics.IncOperationCount(commonmetrics.MountHydrationTimeoutCount, digest)
+		log.G(ctx).WithFields(fields).Warnf("timed out after %s waiting for layer to hydrate", policy.timeout)
+	case err != nil:
+		log.G(ctx).WithFields(fields).WithError(err).Warn("failed to hydrate layer")
+	default:
+		log.G(ctx).WithFields(fields).Debug("layer hydrated")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+)
+
+type hydrateLayer struct {
+	breakableLayer
+	paths     []string
+	threshold float64
+	deadline  bool
+}
+
+func (l *hydrateLayer) Hydrate(ctx context.Context, paths []string, threshold float64) (float64, error) {
+	l.paths = paths
+	l.threshold = threshold
+	_, l.deadline = ctx.Deadline()
+	return threshold, nil
+}
+
+func TestHydrationPolicy(t *testing.T) {
+	defaults, err := newHydrationPolicy(config.HydrationGateConfig{ThresholdPercent: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHydrationPolicy(config.HydrationGateConfig{ThresholdPercent: 101}); err == nil {
+		t.Fatal("expected a threshold over 100% to be rejected")
+	}
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected hydrationPolicy
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			expected: hydrationPolicy{threshold: 0.5, timeout: defaultHydrationTimeout},
+		},
+		{
+			name: "labels override defaults",
+			labels: map[string]string{
+				source.HydrationThresholdLabel: "80",
+				source.HydrationTimeoutLabel:   "5",
+				source.HydrationPathsLabel:     `["/usr/bin/app","/etc/app, with comma"]`,
+			},
+			expected: hydrationPolicy{threshold: 0.8, timeout: 5 * time.Second, paths: []string{"/usr/bin/app", "/etc/app, with comma"}},
+		},
+		{
+			name:     "zero threshold disables the gate",
+			labels:   map[string]string{source.HydrationThresholdLabel: "0"},
+			expected: hydrationPolicy{threshold: 0, timeout: defaultHydrationTimeout},
+		},
+		{
+			name:    "invalid threshold",
+			labels:  map[string]string{source.HydrationThresholdLabel: "150"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid timeout",
+			labels:  map[string]string{source.HydrationTimeoutLabel: "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid paths",
+			labels:  map[string]string{source.HydrationPathsLabel: "/usr/bin/app"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := defaults.withLabels(tt.labels)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, tt.expected) {
+				t.Fatalf("unexpected policy: got %+v, expected %+v", p, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWaitHydration(t *testing.T) {
+	fs := &filesystem{hydrationPolicy: hydrationPolicy{timeout: defaultHydrationTimeout}}
+
+	l := &hydrateLayer{}
+	fs.waitHydration(context.Background(), l, nil)
+	if l.threshold != 0 {
+		t.Fatalf("expected layer not to be hydrated without a threshold")
+	}
+
+	fs.waitHydration(context.Background(), l, map[string]string{
+		source.HydrationThresholdLabel: "90",
+		source.HydrationPathsLabel:     `["/bin"]`,
+	})
+	if l.threshold != 0.9 || !reflect.DeepEqual(l.paths, []string{"/bin"}) || !l.deadline {
+		t.Fatalf("unexpected hydration: threshold %v, paths %v, deadline %v", l.threshold, l.paths, l.deadline)
+	}
+}
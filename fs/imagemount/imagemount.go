@@ -0,0 +1,407 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package imagemount mounts lazily loaded images at arbitrary paths without running
+// the snapshotter, e.g. in build systems and CI sandboxes which don't run containerd.
+//
+//	img, err := imagemount.Mount(ctx, "registry.example.com/app:latest", indexDigest, "/mnt/app",
+//		imagemount.WithKeychain(dockerconfig.NewDockerConfigKeychain(ctx)))
+//	if err != nil {
+//		return err
+//	}
+//	defer img.Unmount(ctx)
+//
+// Like the snapshotter, it needs to run as root to mount FUSE and overlay filesystems.
+package imagemount
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Option configures how an image is mounted.
+type Option func(*options)
+
+type options struct {
+	root     string
+	config   config.Config
+	resolver resolver.Config
+	keychain []resolver.Credential
+	platform platforms.MatchComparer
+}
+
+// WithRoot keeps the caches and the layers of the image in root. By default they're
+// kept in a temporary directory which is removed when the image is unmounted.
+func WithRoot(root string) Option {
+	return func(opts *options) {
+		opts.root = root
+	}
+}
+
+// WithConfig configures the filesystem the image is lazily loaded with. The concurrency
+// limits, the fault injection and the audit log apply to the whole process, so they're
+// only applied by the first image mounted in the process.
+func WithConfig(cfg config.Config) Option {
+	return func(opts *options) {
+		opts.config = cfg
+	}
+}
+
+// WithResolverConfig configures the registry hosts (e.g. mirrors) the image is pulled from.
+func WithResolverConfig(cfg resolver.Config) Option {
+	return func(opts *options) {
+		opts.resolver = cfg
+	}
+}
+
+// WithKeychain authenticates to registries with the credentials returned by keychain,
+// which are tried in order. By default, the credentials from the docker config are used.
+func WithKeychain(keychain ...resolver.Credential) Option {
+	return func(opts *options) {
+		opts.keychain = append(opts.keychain, keychain...)
+	}
+}
+
+// WithPlatform mounts the image for platform if the image is multi-platform.
+// By default, the image is mounted for the platform of the host.
+func WithPlatform(platform ocispec.Platform) Option {
+	return func(opts *options) {
+		opts.platform = platforms.Only(platform)
+	}
+}
+
+// Image is an image mounted with Mount.
+type Image struct {
+	// Target is the path the image is mounted at.
+	Target string
+
+	filesystem
+	// lazyLayers are the mountpoints of the lazily loaded layers.
+	lazyLayers []string
+	mounted    bool
+}
+
+// Mount mounts the image ref read-only at target, lazily loading its layers with the SOCI
+// index with indexDigest. If indexDigest is empty, the index is discovered with the
+// Referrers API. Layers without a ztoc are unpacked.
+func Mount(ctx context.Context, ref string, indexDigest digest.Digest, target string, opts ...Option) (_ *Image, retErr error) {
+	o := newOptions(ctx, opts)
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+	}
+	hosts := resolver.RegistryHostsFromConfig(o.resolver, o.keychain...)
+	_, manifestDesc, manifest, err := fetchManifest(ctx, refspec, hosts, o.platform)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{Target: target}
+	defer func() {
+		if retErr != nil {
+			if err := img.Unmount(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to clean up image after mount error")
+			}
+		}
+	}()
+	if err := img.open(ctx, o, hosts); err != nil {
+		return nil, err
+	}
+
+	// the layers are mounted bottom-most first, so that layers without a ztoc
+	// can be applied onto the layers below them.
+	var layerDirs []string
+	for i, l := range manifest.Layers {
+		dir := filepath.Join(img.root, "layers", strconv.Itoa(i))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		labels := source.LayerLabels(ref, indexDigest, manifestDesc.Digest, manifest, i)
+		err := img.fs.Mount(ctx, dir, labels)
+		if err == nil {
+			img.lazyLayers = append(img.lazyLayers, dir)
+		} else {
+			if errors.Is(err, snapshot.ErrNoZtoc) {
+				log.G(ctx).WithField("layerDigest", l.Digest).Debug("unpacking layer without ztoc")
+			} else {
+				log.G(ctx).WithError(err).WithField("layerDigest", l.Digest).Warn("failed to lazily load layer; unpacking it")
+			}
+			if err := img.fs.MountLocal(ctx, dir, labels, parentMounts(layerDirs)); err != nil {
+				return nil, fmt.Errorf("failed to unpack layer %s: %w", l.Digest, err)
+			}
+		}
+		layerDirs = append(layerDirs, dir)
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	if err := mount.All(rootMounts(layerDirs), target); err != nil {
+		return nil, fmt.Errorf("failed to mount image at %s: %w", target, err)
+	}
+	img.mounted = true
+	return img, nil
+}
+
+// Unmount unmounts the image and its layers, and removes the root directory
+// if it was created by Mount.
+func (img *Image) Unmount(ctx context.Context) error {
+	var errs []error
+	if img.mounted {
+		if err := mount.UnmountAll(img.Target, 0); err != nil {
+			errs = append(errs, err)
+		}
+		img.mounted = false
+	}
+	for _, dir := range img.lazyLayers {
+		if err := img.fs.Unmount(ctx, dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	img.lazyLayers = nil
+	errs = append(errs, img.close()...)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to unmount image at %s: %v", img.Target, errs)
+	}
+	return nil
+}
+
+// newOptions applies opts onto the defaults.
+func newOptions(ctx context.Context, opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.platform == nil {
+		o.platform = platforms.Default()
+	}
+	if len(o.keychain) == 0 {
+		o.keychain = []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)}
+	}
+	// metrics are registered globally, so they'd be registered twice
+	// if several images were mounted.
+	o.config.NoPrometheus = true
+	return o
+}
+
+// filesystem is the filesystem layers are lazily loaded with, and its caches.
+type filesystem struct {
+	root       string
+	removeRoot bool
+	cancel     context.CancelFunc
+	fs         snapshot.FileSystem
+	db         *metadata.DB
+}
+
+// open creates the filesystem with its caches in the root of o, or in a temporary
+// directory if it's not set. The filesystem lives until it's closed.
+func (f *filesystem) open(ctx context.Context, o options, hosts source.RegistryHosts) (err error) {
+	f.root = o.root
+	if f.root == "" {
+		f.root, err = os.MkdirTemp("", "soci-mount-")
+		if err != nil {
+			return err
+		}
+		f.removeRoot = true
+	}
+	f.db, err = metadata.OpenDB(filepath.Join(f.root, "metadata.db"), nil)
+	if err != nil {
+		return err
+	}
+	fsCtx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+	f.cancel = cancel
+	f.fs, err = socifs.NewFilesystem(fsCtx, filepath.Join(f.root, "soci"), o.config,
+		socifs.WithGetSources(source.FromDefaultLabels(hosts)),
+		socifs.WithMetadataStore(f.db.NewReader),
+		socifs.WithContentStorePath(filepath.Join(f.root, "content")),
+		socifs.WithCredential(multiCredential(o.keychain)),
+	)
+	return err
+}
+
+// close stops the filesystem, and removes its root directory if it was created by open.
+// The layers mounted with the filesystem must be unmounted first.
+func (f *filesystem) close() []error {
+	var errs []error
+	if f.cancel != nil {
+		f.cancel()
+	}
+	if f.db != nil {
+		if err := f.db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		f.db = nil
+	}
+	if f.removeRoot {
+		if err := os.RemoveAll(f.root); err != nil {
+			errs = append(errs, err)
+		}
+		f.removeRoot = false
+	}
+	return errs
+}
+
+// parentMounts returns the mounts MountLocal applies a layer onto, given the
+// directories of the layers below it, bottom-most first.
+func parentMounts(layerDirs []string) []mount.Mount {
+	m := mount.Mount{Type: "overlay", Source: "overlay"}
+	if len(layerDirs) > 0 {
+		m.Options = []string{"lowerdir=" + strings.Join(reversed(layerDirs), ":")}
+	}
+	return []mount.Mount{m}
+}
+
+// rootMounts returns the read-only mounts of the root filesystem of an image
+// with the layers in layerDirs, bottom-most first.
+func rootMounts(layerDirs []string) []mount.Mount {
+	if len(layerDirs) == 1 {
+		return []mount.Mount{{Type: "bind", Source: layerDirs[0], Options: []string{"ro", "rbind"}}}
+	}
+	return []mount.Mount{{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: []string{"lowerdir=" + strings.Join(reversed(layerDirs), ":")},
+	}}
+}
+
+func reversed(s []string) []string {
+	r := make([]string, len(s))
+	for i, v := range s {
+		r[len(s)-1-i] = v
+	}
+	return r
+}
+
+// multiCredential returns the first credentials returned by keychain.
+func multiCredential(keychain []resolver.Credential) socifs.Credential {
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		for _, cred := range keychain {
+			if username, secret, err := cred(host, refspec); err != nil {
+				return "", "", err
+			} else if username != "" || secret != "" {
+				return username, secret, nil
+			}
+		}
+		return "", "", nil
+	}
+}
+
+// fetchManifest resolves refspec and returns a fetcher of its repository and the descriptor
+// and content of its image manifest, choosing the manifest for platform if the image is
+// multi-platform.
+func fetchManifest(ctx context.Context, refspec reference.Spec, hosts source.RegistryHosts, platform platforms.MatchComparer) (remotes.Fetcher, ocispec.Descriptor, ocispec.Manifest, error) {
+	r := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return hosts(refspec)
+		},
+	})
+	name, desc, err := r.Resolve(ctx, refspec.String())
+	if err != nil {
+		return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("cannot resolve image %s: %w", refspec, err)
+	}
+	fetcher, err := r.Fetcher(ctx, name)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+
+	b, mediaType, err := fetchManifestContent(ctx, fetcher, desc)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("cannot fetch image %s: %w", refspec, err)
+	}
+	if images.IsIndexType(mediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("cannot parse image index: %w", err)
+		}
+		var found bool
+		for _, m := range index.Manifests {
+			if m.Platform != nil && platform.Match(*m.Platform) && (!found || platform.Less(*m.Platform, *desc.Platform)) {
+				desc, found = m, true
+			}
+		}
+		if !found {
+			return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("image %s has no manifest for the platform", refspec)
+		}
+		if b, mediaType, err = fetchManifestContent(ctx, fetcher, desc); err != nil {
+			return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("cannot fetch image manifest: %w", err)
+		}
+	}
+	if !images.IsManifestType(mediaType) {
+		return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("unexpected media type %s of image %s", mediaType, refspec)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("cannot parse image manifest: %w", err)
+	}
+	desc.MediaType = mediaType
+	return fetcher, desc, manifest, nil
+}
+
+// fetchManifestContent fetches the image manifest or index desc, verifies it against its
+// digest, and returns it and its normalized media type. Manifests with generic media
+// types are fetched from the manifests endpoint of the registry, and their media type is
+// detected from their content.
+func fetchManifestContent(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, string, error) {
+	mediaType := desc.MediaType
+	if !soci.IsImageIndexType(mediaType) && !soci.IsImageManifestType(mediaType) {
+		// the fetcher only uses the manifests endpoint for the known media types.
+		desc.MediaType = ocispec.MediaTypeImageManifest
+	} else {
+		desc.MediaType = soci.NormalizeMediaType(mediaType)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, desc.Size+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(b)) != desc.Size || desc.Digest.Algorithm().FromBytes(b) != desc.Digest {
+		return nil, "", fmt.Errorf("content of %s doesn't match its descriptor", desc.Digest)
+	}
+	mediaType, err = soci.ManifestMediaType(mediaType, b)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, mediaType, nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagemount
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestLayerMounts(t *testing.T) {
+	layers := []string{"/root/layers/0", "/root/layers/1", "/root/layers/2"}
+
+	tests := []struct {
+		name           string
+		layerDirs      []string
+		expectedParent []mount.Mount
+		expectedRoot   []mount.Mount
+	}{
+		{
+			name:           "single layer",
+			layerDirs:      layers[:1],
+			expectedParent: []mount.Mount{{Type: "overlay", Source: "overlay", Options: []string{"lowerdir=/root/layers/0"}}},
+			expectedRoot:   []mount.Mount{{Type: "bind", Source: "/root/layers/0", Options: []string{"ro", "rbind"}}},
+		},
+		{
+			name:           "multiple layers",
+			layerDirs:      layers,
+			expectedParent: []mount.Mount{{Type: "overlay", Source: "overlay", Options: []string{"lowerdir=/root/layers/2:/root/layers/1:/root/layers/0"}}},
+			expectedRoot:   []mount.Mount{{Type: "overlay", Source: "overlay", Options: []string{"lowerdir=/root/layers/2:/root/layers/1:/root/layers/0"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m := parentMounts(tt.layerDirs); !reflect.DeepEqual(m, tt.expectedParent) {
+				t.Errorf("unexpected parent mounts; expected %v, got %v", tt.expectedParent, m)
+			}
+			if m := rootMounts(tt.layerDirs); !reflect.DeepEqual(m, tt.expectedRoot) {
+				t.Errorf("unexpected root mounts; expected %v, got %v", tt.expectedRoot, m)
+			}
+		})
+	}
+
+	if m := parentMounts(nil); len(m) != 1 || len(m[0].Options) != 0 {
+		t.Errorf("expected a mount without lower directories for the bottom-most layer, got %v", m)
+	}
+}
+
+func TestMultiCredential(t *testing.T) {
+	anonymous := func(string, reference.Spec) (string, string, error) { return "", "", nil }
+	user := func(string, reference.Spec) (string, string, error) { return "user", "pass", nil }
+	failing := func(string, reference.Spec) (string, string, error) { return "", "", errors.New("failed") }
+
+	tests := []struct {
+		name         string
+		keychain     []resolver.Credential
+		expectedUser string
+		expectErr    bool
+	}{
+		{
+			name: "no credentials",
+		},
+		{
+			name:         "first credentials found",
+			keychain:     []resolver.Credential{anonymous, user, failing},
+			expectedUser: "user",
+		},
+		{
+			name:      "error",
+			keychain:  []resolver.Credential{anonymous, failing, user},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, _, err := multiCredential(tt.keychain)("registry.example.com", reference.Spec{})
+			if tt.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if username != tt.expectedUser {
+				t.Errorf("expected user %q, got %q", tt.expectedUser, username)
+			}
+		})
+	}
+}
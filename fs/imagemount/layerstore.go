@@ -0,0 +1,403 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagemount
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/snapshots"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Compression types of layers in the info files of additional layer stores,
+// as defined by containers/storage.
+const (
+	layerUncompressed = 0
+	layerGzip         = 2
+	layerZstd         = 4
+)
+
+// layerInfo is the info file of a layer in an additional layer store, which
+// containers/storage reads the digests and the sizes of the layer from.
+type layerInfo struct {
+	CompressedDigest   digest.Digest `json:"compressed-diff-digest,omitempty"`
+	CompressedSize     int64         `json:"compressed-size,omitempty"`
+	UncompressedDigest digest.Digest `json:"diff-digest,omitempty"`
+	UncompressedSize   int64         `json:"diff-size,omitempty"`
+	CompressionType    int           `json:"compression,omitempty"`
+}
+
+// layerUsage is implemented by file systems which know the uncompressed sizes of the
+// layers they mount.
+type layerUsage interface {
+	Usage(mountpoint string) (snapshots.Usage, bool)
+}
+
+// LayerStore serves lazily loaded layers as an additional layer store of
+// containers/storage, so that CRI-O and podman can lazily load images with SOCI indices
+// without containerd. containers/storage is configured to look layers up by image ref with
+//
+//	[storage.options]
+//	additionallayerstores = ["<mountpoint>:ref"]
+//
+// and finds the layer with digest of the image ref at <mountpoint>/<base64 ref>/<digest>,
+// which has
+//   - diff, the contents of the layer,
+//   - info, the digests and the sizes of the layer,
+//   - blob, the compressed layer, which is fetched when it's first opened,
+//   - use, which containers/storage stats while it uses the layer.
+//
+// Layers are lazily loaded when they're first looked up, with the SOCI indices discovered
+// with the Referrers API, and stay mounted until the store is closed. Layers without a ztoc
+// aren't found, so that containers/storage pulls them as usual.
+type LayerStore struct {
+	// Mountpoint is the path the store is mounted at.
+	Mountpoint string
+
+	filesystem
+	ctx      context.Context
+	hosts    source.RegistryHosts
+	platform platforms.MatchComparer
+	server   *fuse.Server
+
+	mu     sync.Mutex
+	images map[string]*storeImage
+	layers map[digest.Digest]*storeLayer
+	inodes map[string]uint64
+}
+
+// storeImage is an image whose layers were looked up in a layer store.
+type storeImage struct {
+	once     sync.Once
+	err      error
+	fetcher  remotes.Fetcher
+	desc     ocispec.Descriptor
+	manifest ocispec.Manifest
+	diffIDs  []digest.Digest
+}
+
+// storeLayer is a lazily loaded layer of a layer store.
+type storeLayer struct {
+	once sync.Once
+	err  error
+	desc ocispec.Descriptor
+	// fetcher fetches the blob of the layer.
+	fetcher remotes.Fetcher
+	// dir is the mountpoint of the lazily loaded layer.
+	dir  string
+	info []byte
+
+	blobOnce sync.Once
+	blobErr  error
+	blob     *os.File
+}
+
+// ServeLayerStore mounts a layer store at mountpoint.
+func ServeLayerStore(ctx context.Context, mountpoint string, opts ...Option) (_ *LayerStore, retErr error) {
+	o := newOptions(ctx, opts)
+	s := &LayerStore{
+		Mountpoint: mountpoint,
+		ctx:        log.WithLogger(context.Background(), log.G(ctx)),
+		hosts:      resolver.RegistryHostsFromConfig(o.resolver, o.keychain...),
+		platform:   o.platform,
+		images:     make(map[string]*storeImage),
+		layers:     make(map[digest.Digest]*storeLayer),
+		inodes:     make(map[string]uint64),
+	}
+	defer func() {
+		if retErr != nil {
+			if err := s.Close(); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to clean up layer store after mount error")
+			}
+		}
+	}()
+	if err := s.open(ctx, o, s.hosts); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		return nil, err
+	}
+	mountOpts := fuse.MountOptions{
+		AllowOther: true,
+		FsName:     "soci-store",
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		mountOpts.DirectMount = true
+	}
+	server, err := fusefs.Mount(mountpoint, &storeRoot{s: s}, &fusefs.Options{
+		MountOptions:    mountOpts,
+		NullPermissions: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount layer store at %s: %w", mountpoint, err)
+	}
+	s.server = server
+	return s, nil
+}
+
+// Close unmounts the store and its layers, and removes the root directory if it was
+// created by ServeLayerStore.
+func (s *LayerStore) Close() error {
+	var errs []error
+	if s.server != nil {
+		if err := s.server.Unmount(); err != nil {
+			errs = append(errs, err)
+		}
+		s.server = nil
+	}
+	s.mu.Lock()
+	layers := s.layers
+	s.layers = make(map[digest.Digest]*storeLayer)
+	s.mu.Unlock()
+	for _, l := range layers {
+		if l.blob != nil {
+			l.blob.Close()
+		}
+		if l.dir != "" && l.err == nil {
+			if err := s.fs.Unmount(s.ctx, l.dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	errs = append(errs, s.close()...)
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close layer store at %s: %v", s.Mountpoint, errs)
+	}
+	return nil
+}
+
+// image returns the image ref, fetching its manifest and config the first time.
+func (s *LayerStore) image(ref string) (*storeImage, error) {
+	s.mu.Lock()
+	img, ok := s.images[ref]
+	if !ok {
+		img = &storeImage{}
+		s.images[ref] = img
+	}
+	s.mu.Unlock()
+
+	img.once.Do(func() {
+		img.err = img.fetch(s.ctx, ref, s.hosts, s.platform)
+		if img.err != nil {
+			// failures are retried by the next lookup.
+			s.mu.Lock()
+			delete(s.images, ref)
+			s.mu.Unlock()
+		}
+	})
+	return img, img.err
+}
+
+func (img *storeImage) fetch(ctx context.Context, ref string, hosts source.RegistryHosts, platform platforms.MatchComparer) (err error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+	}
+	img.fetcher, img.desc, img.manifest, err = fetchManifest(ctx, refspec, hosts, platform)
+	if err != nil {
+		return err
+	}
+	rc, err := img.fetcher.Fetch(ctx, img.manifest.Config)
+	if err != nil {
+		return fmt.Errorf("cannot fetch image config: %w", err)
+	}
+	defer rc.Close()
+	var config ocispec.Image
+	if err := json.NewDecoder(io.LimitReader(rc, img.manifest.Config.Size)).Decode(&config); err != nil {
+		return fmt.Errorf("cannot parse image config: %w", err)
+	}
+	img.diffIDs = config.RootFS.DiffIDs
+	return nil
+}
+
+// layer returns the layer dgst of the image ref, lazily loading it the first time.
+func (s *LayerStore) layer(ref string, dgst digest.Digest) (*storeLayer, error) {
+	img, err := s.image(ref)
+	if err != nil {
+		return nil, err
+	}
+	i := layerIndex(img.manifest, dgst)
+	if i < 0 {
+		return nil, fmt.Errorf("image %s has no layer %s", ref, dgst)
+	}
+
+	s.mu.Lock()
+	l, ok := s.layers[dgst]
+	if !ok {
+		l = &storeLayer{desc: img.manifest.Layers[i], fetcher: img.fetcher}
+		s.layers[dgst] = l
+	}
+	s.mu.Unlock()
+
+	l.once.Do(func() {
+		l.err = s.mountLayer(l, ref, img, i)
+		if l.err != nil {
+			s.mu.Lock()
+			delete(s.layers, dgst)
+			s.mu.Unlock()
+		}
+	})
+	return l, l.err
+}
+
+func (s *LayerStore) mountLayer(l *storeLayer, ref string, img *storeImage, i int) error {
+	l.dir = filepath.Join(s.root, "layers", l.desc.Digest.Encoded())
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+	labels := source.LayerLabels(ref, "", img.desc.Digest, img.manifest, i)
+	if err := s.fs.Mount(s.ctx, l.dir, labels); err != nil {
+		return err
+	}
+	info := layerInfo{
+		CompressedDigest: l.desc.Digest,
+		CompressedSize:   l.desc.Size,
+		CompressionType:  compressionType(l.desc.MediaType),
+	}
+	if i < len(img.diffIDs) {
+		info.UncompressedDigest = img.diffIDs[i]
+	}
+	if u, ok := s.fs.(layerUsage); ok {
+		if usage, ok := u.Usage(l.dir); ok {
+			info.UncompressedSize = usage.Size
+		}
+	}
+	var err error
+	l.info, err = json.Marshal(info)
+	return err
+}
+
+// openBlob returns the compressed layer l, fetching it into the root of the store
+// the first time.
+func (s *LayerStore) openBlob(l *storeLayer) (*os.File, error) {
+	l.blobOnce.Do(func() {
+		l.blob, l.blobErr = s.fetchBlob(l.fetcher, l.desc)
+	})
+	return l.blob, l.blobErr
+}
+
+func (s *LayerStore) fetchBlob(fetcher remotes.Fetcher, desc ocispec.Descriptor) (_ *os.File, retErr error) {
+	dir := filepath.Join(s.root, "blobs")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, desc.Digest.Encoded())
+	if f, err := os.Open(path); err == nil {
+		return f, nil
+	}
+	rc, err := fetcher.Fetch(s.ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch layer %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp(dir, ".tmp-blob-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch layer %s: %w", desc.Digest, err)
+	}
+	if n != desc.Size || !verifier.Verified() {
+		return nil, fmt.Errorf("content of layer %s doesn't match its descriptor", desc.Digest)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ino returns the inode number of the file at path in the store.
+func (s *LayerStore) ino(path string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ino, ok := s.inodes[path]
+	if !ok {
+		// inode 1 is the root.
+		ino = uint64(len(s.inodes)) + 2
+		s.inodes[path] = ino
+	}
+	return ino
+}
+
+// parseStoreRef returns the image ref of the name of a directory of a layer store.
+func parseStoreRef(name string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid image ref %q: %w", name, err)
+	}
+	ref := string(b)
+	if _, err := reference.Parse(ref); err != nil {
+		return "", fmt.Errorf("invalid image ref %q: %w", ref, err)
+	}
+	return ref, nil
+}
+
+// layerIndex returns the index of the layer dgst of manifest, or -1.
+func layerIndex(manifest ocispec.Manifest, dgst digest.Digest) int {
+	for i, l := range manifest.Layers {
+		if l.Digest == dgst {
+			return i
+		}
+	}
+	return -1
+}
+
+func compressionType(mediaType string) int {
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		return layerGzip
+	case strings.HasSuffix(mediaType, "zstd"):
+		return layerZstd
+	}
+	return layerUncompressed
+}
+
+// isNotFound returns whether err means that a layer isn't in the store, rather than
+// that it failed to be loaded.
+func isNotFound(err error) bool {
+	return errors.Is(err, snapshot.ErrNoZtoc)
+}
@@ -0,0 +1,272 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagemount
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/opencontainers/go-digest"
+)
+
+// The files of the directory of a layer in a layer store.
+const (
+	layerDiffName = "diff"
+	layerInfoName = "info"
+	layerBlobName = "blob"
+	layerUseName  = "use"
+)
+
+func dirAttr(ino uint64, out *fuse.Attr) fusefs.StableAttr {
+	out.Ino = ino
+	out.Mode = syscall.S_IFDIR | 0555
+	out.Nlink = 2
+	return fusefs.StableAttr{Mode: syscall.S_IFDIR, Ino: ino}
+}
+
+func fileAttr(ino uint64, size int64, out *fuse.Attr) fusefs.StableAttr {
+	out.Ino = ino
+	out.Mode = syscall.S_IFREG | 0444
+	out.Nlink = 1
+	out.Size = uint64(size)
+	return fusefs.StableAttr{Mode: syscall.S_IFREG, Ino: ino}
+}
+
+func linkAttr(ino uint64, target string, out *fuse.Attr) fusefs.StableAttr {
+	out.Ino = ino
+	out.Mode = syscall.S_IFLNK | 0777
+	out.Nlink = 1
+	out.Size = uint64(len(target))
+	return fusefs.StableAttr{Mode: syscall.S_IFLNK, Ino: ino}
+}
+
+// storeRoot is the root directory of a layer store, which has a directory for every
+// image ref, named with the base64 encoded ref. The directories aren't listed.
+type storeRoot struct {
+	fusefs.Inode
+	s *LayerStore
+}
+
+var _ = (fusefs.NodeLookuper)((*storeRoot)(nil))
+
+func (n *storeRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	ref, err := parseStoreRef(name)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("unknown entry in layer store")
+		return nil, syscall.ENOENT
+	}
+	return n.NewInode(ctx, &refDir{s: n.s, ref: ref, path: name}, dirAttr(n.s.ino(name), &out.Attr)), 0
+}
+
+var _ = (fusefs.NodeReaddirer)((*storeRoot)(nil))
+
+func (n *storeRoot) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	return fusefs.NewListDirStream(nil), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*storeRoot)(nil))
+
+func (n *storeRoot) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dirAttr(1, &out.Attr)
+	return 0
+}
+
+// refDir is the directory of an image ref in a layer store, which has a directory for
+// every layer which can be lazily loaded, named with the digest of the layer. The
+// directories aren't listed.
+type refDir struct {
+	fusefs.Inode
+	s    *LayerStore
+	ref  string
+	path string
+}
+
+var _ = (fusefs.NodeLookuper)((*refDir)(nil))
+
+func (n *refDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	dgst, err := digest.Parse(name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	l, err := n.s.layer(n.ref, dgst)
+	if err != nil {
+		entry := log.G(ctx).WithError(err).WithField("ref", n.ref).WithField("layerDigest", dgst)
+		if isNotFound(err) {
+			entry.Debug("layer can't be lazily loaded")
+		} else {
+			entry.Warn("failed to lazily load layer")
+		}
+		return nil, syscall.ENOENT
+	}
+	p := path.Join(n.path, name)
+	return n.NewInode(ctx, &layerDir{s: n.s, l: l, path: p}, dirAttr(n.s.ino(p), &out.Attr)), 0
+}
+
+var _ = (fusefs.NodeReaddirer)((*refDir)(nil))
+
+func (n *refDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	return fusefs.NewListDirStream(nil), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*refDir)(nil))
+
+func (n *refDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dirAttr(n.s.ino(n.path), &out.Attr)
+	return 0
+}
+
+// layerDir is the directory of a lazily loaded layer in a layer store.
+type layerDir struct {
+	fusefs.Inode
+	s    *LayerStore
+	l    *storeLayer
+	path string
+}
+
+var _ = (fusefs.NodeLookuper)((*layerDir)(nil))
+
+func (n *layerDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	ino := n.s.ino(path.Join(n.path, name))
+	switch name {
+	case layerDiffName:
+		return n.NewInode(ctx, &diffLink{target: n.l.dir, ino: ino}, linkAttr(ino, n.l.dir, &out.Attr)), 0
+	case layerInfoName:
+		return n.NewInode(ctx, &contentFile{content: n.l.info, ino: ino}, fileAttr(ino, int64(len(n.l.info)), &out.Attr)), 0
+	case layerUseName:
+		return n.NewInode(ctx, &contentFile{ino: ino}, fileAttr(ino, 0, &out.Attr)), 0
+	case layerBlobName:
+		return n.NewInode(ctx, &blobFile{s: n.s, l: n.l, ino: ino}, fileAttr(ino, n.l.desc.Size, &out.Attr)), 0
+	}
+	return nil, syscall.ENOENT
+}
+
+var _ = (fusefs.NodeReaddirer)((*layerDir)(nil))
+
+func (n *layerDir) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	var entries []fuse.DirEntry
+	for _, name := range []string{layerBlobName, layerDiffName, layerInfoName, layerUseName} {
+		mode := uint32(syscall.S_IFREG)
+		if name == layerDiffName {
+			mode = syscall.S_IFLNK
+		}
+		entries = append(entries, fuse.DirEntry{Mode: mode, Name: name, Ino: n.s.ino(path.Join(n.path, name))})
+	}
+	return fusefs.NewListDirStream(entries), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*layerDir)(nil))
+
+func (n *layerDir) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dirAttr(n.s.ino(n.path), &out.Attr)
+	return 0
+}
+
+// diffLink links to the mountpoint of a lazily loaded layer, which is used as a lower
+// directory of the overlay filesystems of containers.
+type diffLink struct {
+	fusefs.Inode
+	target string
+	ino    uint64
+}
+
+var _ = (fusefs.NodeReadlinker)((*diffLink)(nil))
+
+func (n *diffLink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(n.target), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*diffLink)(nil))
+
+func (n *diffLink) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	linkAttr(n.ino, n.target, &out.Attr)
+	return 0
+}
+
+// contentFile is a read-only file with content.
+type contentFile struct {
+	fusefs.Inode
+	content []byte
+	ino     uint64
+}
+
+var _ = (fusefs.NodeOpener)((*contentFile)(nil))
+
+func (n *contentFile) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	return nil, 0, 0
+}
+
+var _ = (fusefs.NodeReader)((*contentFile)(nil))
+
+func (n *contentFile) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	k, err := bytes.NewReader(n.content).ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:k]), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*contentFile)(nil))
+
+func (n *contentFile) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fileAttr(n.ino, int64(len(n.content)), &out.Attr)
+	return 0
+}
+
+// blobFile is the compressed layer, which is fetched when it's first opened.
+type blobFile struct {
+	fusefs.Inode
+	s   *LayerStore
+	l   *storeLayer
+	ino uint64
+}
+
+var _ = (fusefs.NodeOpener)((*blobFile)(nil))
+
+func (n *blobFile) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if _, err := n.s.openBlob(n.l); err != nil {
+		log.G(ctx).WithError(err).WithField("layerDigest", n.l.desc.Digest).Warn("failed to fetch layer")
+		return nil, 0, syscall.EIO
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+var _ = (fusefs.NodeReader)((*blobFile)(nil))
+
+func (n *blobFile) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	blob, err := n.s.openBlob(n.l)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	k, err := blob.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:k]), 0
+}
+
+var _ = (fusefs.NodeGetattrer)((*blobFile)(nil))
+
+func (n *blobFile) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	fileAttr(n.ino, n.l.desc.Size, &out.Attr)
+	return 0
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package imagemount
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseStoreRef(t *testing.T) {
+	tests := []struct {
+		name        string
+		dir         string
+		expectedRef string
+		expectErr   bool
+	}{
+		{
+			name:        "valid ref",
+			dir:         base64.StdEncoding.EncodeToString([]byte("registry.example.com/app:latest")),
+			expectedRef: "registry.example.com/app:latest",
+		},
+		{
+			name:      "not base64",
+			dir:       "registry.example.com",
+			expectErr: true,
+		},
+		{
+			name:      "invalid ref",
+			dir:       base64.StdEncoding.EncodeToString([]byte("https://registry.example.com/app")),
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := parseStoreRef(tt.dir)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got ref %q", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref != tt.expectedRef {
+				t.Fatalf("unexpected ref: expected %q, got %q", tt.expectedRef, ref)
+			}
+		})
+	}
+}
+
+func TestLayerInfo(t *testing.T) {
+	b, err := json.Marshal(layerInfo{
+		CompressedDigest:   digest.FromString("compressed"),
+		CompressedSize:     10,
+		UncompressedDigest: digest.FromString("uncompressed"),
+		UncompressedSize:   20,
+		CompressionType:    compressionType(ocispec.MediaTypeImageLayerGzip),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys of the layers of containers/storage
+	var info map[string]interface{}
+	if err := json.Unmarshal(b, &info); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"compressed-diff-digest": digest.FromString("compressed").String(),
+		"compressed-size":        float64(10),
+		"diff-digest":            digest.FromString("uncompressed").String(),
+		"diff-size":              float64(20),
+		"compression":            float64(layerGzip),
+	}
+	if fmt.Sprint(info) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected info: expected %v, got %v", expected, info)
+	}
+
+	for mediaType, expected := range map[string]int{
+		ocispec.MediaTypeImageLayerGzip:        layerGzip,
+		images.MediaTypeDockerSchema2LayerGzip: layerGzip,
+		ocispec.MediaTypeImageLayerZstd:        layerZstd,
+		ocispec.MediaTypeImageLayer:            layerUncompressed,
+	} {
+		if c := compressionType(mediaType); c != expected {
+			t.Errorf("unexpected compression type of %s: expected %d, got %d", mediaType, expected, c)
+		}
+	}
+}
+
+type testFetcher map[digest.Digest][]byte
+
+func (f testFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := f[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", desc.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestLayerStoreBlob(t *testing.T) {
+	blob := []byte("layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	corrupt := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("other"), Size: int64(len(blob))}
+	s := &LayerStore{ctx: context.Background()}
+	s.root = t.TempDir()
+
+	f, err := s.openBlob(&storeLayer{desc: desc, fetcher: testFetcher{desc.Digest: blob}})
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	defer f.Close()
+	b := make([]byte, len(blob))
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	if !bytes.Equal(b, blob) {
+		t.Fatalf("unexpected blob %q", b)
+	}
+
+	// the fetched blob is reused by other layers with the digest
+	other, err := s.openBlob(&storeLayer{desc: desc, fetcher: testFetcher{}})
+	if err != nil {
+		t.Fatalf("failed to open fetched blob: %v", err)
+	}
+	other.Close()
+
+	if _, err := s.openBlob(&storeLayer{desc: corrupt, fetcher: testFetcher{corrupt.Digest: blob}}); err == nil {
+		t.Fatal("expected blobs which don't match their digest to be rejected")
+	}
+}
+
+func TestLayerStoreInodes(t *testing.T) {
+	s := &LayerStore{inodes: make(map[string]uint64)}
+	a, b := s.ino("a"), s.ino("a/b")
+	if a == b || a == 1 || b == 1 {
+		t.Fatalf("expected unique inodes other than the root's, got %d and %d", a, b)
+	}
+	if s.ino("a") != a {
+		t.Fatal("expected the inode of a path to be stable")
+	}
+}
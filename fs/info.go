@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/util/fips"
+	"github.com/awslabs/soci-snapshotter/version"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+)
+
+// InfoPath is the path of the endpoint of the snapshotter's API that reports
+// the version and capabilities of the snapshotter.
+const InfoPath = "/api/v1/info"
+
+const (
+	// VerificationSpans is the verification mode where the contents of spans are
+	// verified against the span digests of their ztocs as they're fetched.
+	VerificationSpans = "spans"
+	// VerificationSpansAndLayers is the verification mode where layers are also
+	// verified against their digests once they're fully fetched in the background.
+	VerificationSpansAndLayers = "spans+layers"
+)
+
+// Info is the version and capabilities of the snapshotter, which tools can use
+// to adapt their behavior to the snapshotter on a node.
+type Info struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+	// Crypto is the crypto mode of the snapshotter (see fips.Mode).
+	Crypto string `json:"crypto"`
+	// Zlib is the zlib implementation and version spans are uncompressed with.
+	Zlib string `json:"zlib"`
+	// ZtocVersions are the versions of ztocs the snapshotter can lazily load layers with.
+	ZtocVersions []ztoc.Version `json:"ztocVersions"`
+	// CompressionAlgorithms are the compression algorithms of layers the snapshotter can lazily load.
+	CompressionAlgorithms []string `json:"compressionAlgorithms"`
+	Features              Features `json:"features"`
+}
+
+// Features are the features configured in the snapshotter.
+type Features struct {
+	BackgroundFetch      bool   `json:"backgroundFetch"`
+	Verification         string `json:"verification"`
+	PromoteBlobs         bool   `json:"promoteBlobs"`
+	LazyLoadWithoutRpull bool   `json:"lazyLoadWithoutRpull"`
+	FetchScheduler       bool   `json:"fetchScheduler"`
+	AuditLog             bool   `json:"auditLog"`
+}
+
+// newInfo returns the Info of a snapshotter configured with cfg.
+func newInfo(cfg config.Config) Info {
+	verification := VerificationSpans
+	if !cfg.BackgroundFetchConfig.Disable {
+		verification = VerificationSpansAndLayers
+	}
+	return Info{
+		Version:               version.Version,
+		Revision:              version.Revision,
+		Crypto:                fips.Mode(),
+		Zlib:                  compression.ZlibImplementation + " " + compression.ZlibVersion(),
+		ZtocVersions:          []ztoc.Version{ztoc.Version09},
+		CompressionAlgorithms: []string{compression.Gzip},
+		Features: Features{
+			BackgroundFetch:      !cfg.BackgroundFetchConfig.Disable,
+			Verification:         verification,
+			PromoteBlobs:         !cfg.BackgroundFetchConfig.Disable && cfg.BackgroundFetchConfig.PromoteBlobs,
+			LazyLoadWithoutRpull: cfg.LazyLoadWithoutRpull,
+			FetchScheduler:       cfg.FetchSchedulerConfig.MaxConcurrentFetches > 0,
+			AuditLog:             cfg.BlobConfig.AuditLogPath != "",
+		},
+	}
+}
+
+func (fs *filesystem) infoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(fs.info); err != nil {
+			log.G(fs.ctx).WithError(err).Warn("failed to write info response")
+		}
+	})
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+func TestInfoFeatures(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		expected Features
+	}{
+		{
+			name: "default",
+			expected: Features{
+				BackgroundFetch: true,
+				Verification:    VerificationSpansAndLayers,
+			},
+		},
+		{
+			name: "background fetch disabled",
+			cfg: config.Config{
+				BackgroundFetchConfig: config.BackgroundFetchConfig{Disable: true, PromoteBlobs: true},
+			},
+			expected: Features{
+				Verification: VerificationSpans,
+			},
+		},
+		{
+			name: "all features",
+			cfg: config.Config{
+				LazyLoadWithoutRpull:  true,
+				BlobConfig:            config.BlobConfig{AuditLogPath: "/var/log/audit.log"},
+				BackgroundFetchConfig: config.BackgroundFetchConfig{PromoteBlobs: true},
+				FetchSchedulerConfig:  config.FetchSchedulerConfig{MaxConcurrentFetches: 8},
+			},
+			expected: Features{
+				BackgroundFetch:      true,
+				Verification:         VerificationSpansAndLayers,
+				PromoteBlobs:         true,
+				LazyLoadWithoutRpull: true,
+				FetchScheduler:       true,
+				AuditLog:             true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := newInfo(tt.cfg)
+			if !reflect.DeepEqual(info.Features, tt.expected) {
+				t.Fatalf("unexpected features; expected %+v, got %+v", tt.expected, info.Features)
+			}
+		})
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
+	fs := &filesystem{info: newInfo(config.Config{})}
+	h := fs.infoHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, InfoPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var info Info
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, fs.info) {
+		t.Fatalf("unexpected info; expected %+v, got %+v", fs.info, info)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, InfoPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for POST", rec.Code)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+// newCacheCipher returns the cipher which encrypts the caches of layers at rest, or
+// nil if cache encryption isn't enabled.
+func newCacheCipher(cfg config.CacheEncryptionConfig) (*cache.Cipher, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+	c, err := cache.LoadCipher(cfg.KeyFile, cfg.KeyCommand)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache key: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/reader"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+)
+
+// Classes of the errors of reads of files, which fuse.error_errnos maps to errnos.
+const (
+	// errClassTimeout is a read which hit the read deadline, or whose fetch timed out.
+	errClassTimeout = "timeout"
+	// errClassInterrupted is a read which was interrupted, e.g. since its fetch was
+	// canceled or a system call returned EINTR or EAGAIN.
+	errClassInterrupted = "interrupted"
+	// errClassFetch is a read whose contents couldn't be fetched.
+	errClassFetch = "fetch"
+	// errClassVerification is a read whose contents don't match their digests.
+	errClassVerification = "verification"
+	// errClassDecompression is a read whose contents couldn't be uncompressed.
+	errClassDecompression = "decompression"
+	// errClassOther is any other failed read.
+	errClassOther = "other"
+)
+
+// errnos are the errnos failed reads can be mapped to. EIO is the default. EINTR and
+// EAGAIN ask the reading process to retry the read, which most runtimes (e.g. Go's and
+// glibc's stdio) do for EINTR without surfacing it, but only some do for EAGAIN on files.
+// ENODATA tells it that the contents aren't available, without implying a broken device.
+var errnos = map[string]syscall.Errno{
+	"eio":     syscall.EIO,
+	"eagain":  syscall.EAGAIN,
+	"eintr":   syscall.EINTR,
+	"enodata": syscall.ENODATA,
+}
+
+// errnoMapping maps the classes of the errors of reads to the errnos they fail with.
+type errnoMapping map[string]syscall.Errno
+
+// newErrnoMapping returns the errno mapping of cfg, or nil if all errors are EIO.
+func newErrnoMapping(cfg config.FuseConfig) errnoMapping {
+	if len(cfg.ErrorErrnos) == 0 {
+		return nil
+	}
+	m := make(errnoMapping, len(cfg.ErrorErrnos))
+	for class, name := range cfg.ErrorErrnos {
+		if errno, ok := errnos[name]; ok {
+			m[class] = errno
+		}
+	}
+	return m
+}
+
+// errno returns the errno of a read which failed with err.
+func (m errnoMapping) errno(err error) syscall.Errno {
+	if errno, ok := m[readErrorClass(err)]; ok {
+		return errno
+	}
+	return syscall.EIO
+}
+
+// readErrorClass returns the class of the error of a read. Timeouts and interruptions
+// take precedence, since they're transient whatever they interrupted.
+func readErrorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errReadDeadline), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errClassTimeout
+	case errors.Is(err, context.Canceled), errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN):
+		return errClassInterrupted
+	case errors.Is(err, spanmanager.ErrIncorrectSpanDigest), errors.Is(err, spanmanager.ErrCorruptedSpan),
+		errors.Is(err, reader.ErrIncorrectChunkDigest):
+		return errClassVerification
+	case errors.Is(err, spanmanager.ErrUncompressSpan):
+		return errClassDecompression
+	case errors.Is(err, spanmanager.ErrFetchSpan):
+		return errClassFetch
+	default:
+		return errClassOther
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/reader"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+)
+
+func TestReadErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class string
+	}{
+		{errReadDeadline, errClassTimeout},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), errClassTimeout},
+		{context.Canceled, errClassInterrupted},
+		{fmt.Errorf("read: %w", syscall.EINTR), errClassInterrupted},
+		{fmt.Errorf("span 3: %w", spanmanager.ErrIncorrectSpanDigest), errClassVerification},
+		{fmt.Errorf("read: %w", reader.ErrIncorrectChunkDigest), errClassVerification},
+		{fmt.Errorf("span 3: %w", spanmanager.ErrUncompressSpan), errClassDecompression},
+		{fmt.Errorf("read: %w", spanmanager.ErrFetchSpan), errClassFetch},
+		{errors.New("unknown"), errClassOther},
+	} {
+		if class := readErrorClass(tc.err); class != tc.class {
+			t.Errorf("expected %q to be %q, got %q", tc.err, tc.class, class)
+		}
+	}
+}
+
+func TestErrnoMapping(t *testing.T) {
+	if m := newErrnoMapping(config.FuseConfig{}); m.errno(errReadDeadline) != syscall.EIO {
+		t.Fatalf("expected EIO by default")
+	}
+	m := newErrnoMapping(config.FuseConfig{ErrorErrnos: map[string]string{
+		errClassTimeout: "eagain",
+		errClassFetch:   "enodata",
+	}})
+	for _, tc := range []struct {
+		err   error
+		errno syscall.Errno
+	}{
+		{errReadDeadline, syscall.EAGAIN},
+		{fmt.Errorf("read: %w", spanmanager.ErrFetchSpan), syscall.ENODATA},
+		{spanmanager.ErrUncompressSpan, syscall.EIO},
+	} {
+		if errno := m.errno(tc.err); errno != tc.errno {
+			t.Errorf("expected %q to fail with %v, got %v", tc.err, tc.errno, errno)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultErrorLogLimit         = 10
+	defaultErrorLogSummaryPeriod = time.Minute
+)
+
+// errorLogLimiter limits how many errors of each FUSE operation are logged for a layer.
+// A broken layer (e.g. a bad ztoc) can fail every read, so without a limit it can
+// produce thousands of identical log lines per second.
+//
+// Up to `limit` errors of each operation are logged per period. The errors over the
+// limit are counted and reported in a single summary line per operation at the end
+// of the period.
+type errorLogLimiter struct {
+	layer  digest.Digest
+	limit  int
+	period time.Duration
+
+	mu         sync.Mutex
+	logged     map[string]int
+	suppressed map[string]int
+	timer      *time.Timer
+}
+
+func newErrorLogLimiter(layer digest.Digest, cfg config.FuseConfig) *errorLogLimiter {
+	limit := cfg.ErrorLogLimit
+	if limit == 0 {
+		limit = defaultErrorLogLimit
+	}
+	period := time.Duration(cfg.ErrorLogSummaryPeriodSec) * time.Second
+	if period == 0 {
+		period = defaultErrorLogSummaryPeriod
+	}
+	return &errorLogLimiter{
+		layer:      layer,
+		limit:      limit,
+		period:     period,
+		logged:     make(map[string]int),
+		suppressed: make(map[string]int),
+	}
+}
+
+// allow returns true if an error of operation op should be logged.
+// A nil errorLogLimiter allows all errors.
+func (l *errorLogLimiter) allow(op string) bool {
+	if l == nil || l.limit < 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.period, l.summarize)
+	}
+	if l.logged[op] < l.limit {
+		l.logged[op]++
+		return true
+	}
+	l.suppressed[op]++
+	return false
+}
+
+// summarize logs the number of suppressed errors of each operation and
+// starts a new period.
+func (l *errorLogLimiter) summarize() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for op, count := range l.suppressed {
+		log.G(context.Background()).WithFields(logrus.Fields{
+			"layer":      l.layer,
+			"operation":  op,
+			"suppressed": count,
+			"period":     l.period,
+		}).Warn("suppressed repeated FUSE errors")
+	}
+	l.logged = make(map[string]int)
+	l.suppressed = make(map[string]int)
+	l.timer = nil
+}
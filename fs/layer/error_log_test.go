@@ -0,0 +1,63 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestErrorLogLimiter(t *testing.T) {
+	l := newErrorLogLimiter(digest.FromString("layer"), config.FuseConfig{
+		ErrorLogLimit:            2,
+		ErrorLogSummaryPeriodSec: 3600,
+	})
+	expected := []bool{true, true, false, false}
+	for i, e := range expected {
+		if actual := l.allow(fuseOpFileRead); actual != e {
+			t.Fatalf("error %d: expected allow=%t, got %t", i, e, actual)
+		}
+	}
+	if !l.allow(fuseOpLookup) {
+		t.Fatal("errors of a different operation should not be limited")
+	}
+	if l.suppressed[fuseOpFileRead] != 2 {
+		t.Fatalf("expected 2 suppressed errors, got %d", l.suppressed[fuseOpFileRead])
+	}
+
+	l.timer.Stop()
+	l.summarize()
+	if !l.allow(fuseOpFileRead) {
+		t.Fatal("errors should be logged again in a new period")
+	}
+	l.timer.Stop()
+}
+
+func TestErrorLogLimiterDisabled(t *testing.T) {
+	l := newErrorLogLimiter(digest.FromString("layer"), config.FuseConfig{ErrorLogLimit: -1})
+	for i := 0; i < 100; i++ {
+		if !l.allow(fuseOpFileRead) {
+			t.Fatal("errors should not be limited when the limit is disabled")
+		}
+	}
+	var nilLimiter *errorLogLimiter
+	if !nilLimiter.allow(fuseOpFileRead) {
+		t.Fatal("nil limiter should allow all errors")
+	}
+}
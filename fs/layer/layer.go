@@ -46,6 +46,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
@@ -59,9 +60,11 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
 	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -76,6 +79,20 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+	// packfileCacheType stores the cache of each layer in a single file instead of
+	// a file per entry, to reduce the number of inodes used by the cache.
+	packfileCacheType = "packfile"
+
+	// defaultCacheVerificationSampleRate is the fraction of reads of cached spans
+	// which are verified with "sampled" cache verification.
+	defaultCacheVerificationSampleRate = 0.01
+
+	// spanCacheDir and httpCacheDir are the directories of the span caches and
+	// the http caches of layers under the root directory.
+	spanCacheDir = "spancache"
+	httpCacheDir = "httpcache"
+	// chunkCacheDir is the directory of the chunk cache shared by layers.
+	chunkCacheDir = "chunkcache"
 )
 
 // Layer represents a layer.
@@ -83,6 +100,9 @@ type Layer interface {
 	// Info returns the information of this layer.
 	Info() Info
 
+	// SpanStates returns the number of the spans of this layer in each state.
+	SpanStates() spanmanager.SpanStates
+
 	// RootNode returns the root node of this layer.
 	RootNode(baseInode uint32) (fusefs.InodeEmbedder, error)
 
@@ -103,6 +123,49 @@ type Layer interface {
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
+	// Prefetch fetches and caches the contents of the files at paths (absolute paths
+	// within the layer; directories are prefetched recursively), or all contents of
+	// the layer if paths is empty. Paths which don't exist in the layer are ignored.
+	Prefetch(ctx context.Context, paths []string) error
+
+	// Hydrate fetches and caches the spans of the files at paths, or of the whole layer
+	// if paths is empty, until at least the fraction threshold of them is cached.
+	// It returns the fraction of these spans which is cached.
+	Hydrate(ctx context.Context, paths []string, threshold float64) (float64, error)
+
+	// PrefetchSpans fetches and caches the spans with the IDs in spans, in order. IDs which
+	// aren't spans of the layer are ignored.
+	PrefetchSpans(ctx context.Context, spans []compression.SpanID) error
+
+	// AccessedSpans returns the IDs of the spans of this layer which contents were read from, in order.
+	AccessedSpans() []compression.SpanID
+
+	// Cached returns true if all spans of this layer are cached, so that its contents can
+	// be read without fetching them.
+	Cached() bool
+
+	// Uncompressed returns a reader of the uncompressed contents of this layer, i.e. its tar
+	// archive, e.g. to unpack it. Spans which aren't cached are fetched. Reading it doesn't
+	// count as reads of the containers which use the layer.
+	Uncompressed(ctx context.Context) (io.Reader, error)
+
+	// ExportSpans calls fn with the compressed contents of every cached span of this layer.
+	ExportSpans(ctx context.Context, fn func(spanID compression.SpanID, compressed []byte) error) error
+
+	// ImportSpan adds the compressed contents of a span, as returned by ExportSpans,
+	// to the cache of this layer after verifying them against the ztoc.
+	ImportSpan(spanID compression.SpanID, compressed []byte) error
+
+	// CancelFetches cancels the background fetch, prefetches and readahead of this layer,
+	// e.g. when no mounted snapshot uses it anymore. Reads on demand aren't affected.
+	// The background fetch is restarted when the layer is mounted again.
+	CancelFetches()
+
+	// Acquire returns another reference to this layer, which keeps it open until its Done
+	// is called, e.g. to keep reading the layer after it's unmounted. It returns false if
+	// the layer was discarded from the cache of the resolver.
+	Acquire() (Layer, bool)
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -111,9 +174,15 @@ type Layer interface {
 // Info is the current status of a layer.
 type Info struct {
 	Digest      digest.Digest
-	Size        int64     // layer size in bytes
-	FetchedSize int64     // layer fetched size in bytes
-	ReadTime    time.Time // last time the layer was read
+	ZtocDigest  digest.Digest // digest of the ztoc the layer is lazily loaded with
+	Size        int64         // layer size in bytes
+	FetchedSize int64         // layer fetched size in bytes
+	// UncompressedSize is the size of the uncompressed contents of the layer in bytes.
+	UncompressedSize int64
+	ReadTime         time.Time // last time the layer was read
+	// TOCCheck is the report of the cross-check of the ztoc against the layer. It's
+	// nil unless the TOC check is enabled.
+	TOCCheck *spanmanager.TOCCheckReport
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -130,11 +199,55 @@ type Resolver struct {
 	artifactStore     content.Storage
 	overlayOpaqueType OverlayOpaqueType
 	bgFetcher         *backgroundfetcher.BackgroundFetcher
+	promoter          BlobPromoter
+	cacheDirs         *cacheDirs
+	// chunkCache caches the chunks of files by digest for all layers. It's nil
+	// unless BlobConfig.ChunkCache is set.
+	chunkCache cache.BlobCache
+	// cipher encrypts the caches of layers at rest. It's nil unless
+	// CacheEncryptionConfig.Enable is set.
+	cipher *cache.Cipher
+	// ztocBytes is the estimated memory held by the ztocs of the cached layers.
+	ztocBytes *int64
+}
+
+// cacheDirs records the directories of the caches of layers and blobs on disk by name,
+// so that the space freed by evicting a layer can be measured.
+type cacheDirs struct {
+	mu   sync.Mutex
+	dirs map[string]string
+}
+
+func (c *cacheDirs) set(name, kind, dir string) {
+	if dir == "" {
+		return
+	}
+	c.mu.Lock()
+	c.dirs[name+"/"+kind] = dir
+	c.mu.Unlock()
+}
+
+func (c *cacheDirs) remove(name, kind string) {
+	c.mu.Lock()
+	delete(c.dirs, name+"/"+kind)
+	c.mu.Unlock()
+}
+
+func (c *cacheDirs) get(name string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dirs []string
+	for _, kind := range []string{spanCacheDir, httpCacheDir} {
+		if d, ok := c.dirs[name+"/"+kind]; ok {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
 }
 
 // NewResolver returns a new layer resolver.
 func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remote.Handler,
-	metadataStore metadata.Store, artifactStore content.Storage, overlayOpaqueType OverlayOpaqueType, bgFetcher *backgroundfetcher.BackgroundFetcher) (*Resolver, error) {
+	metadataStore metadata.Store, artifactStore content.Storage, overlayOpaqueType OverlayOpaqueType, bgFetcher *backgroundfetcher.BackgroundFetcher, promoter BlobPromoter) (*Resolver, error) {
 	resolveResultEntry := cfg.ResolveResultEntry
 	if resolveResultEntry == 0 {
 		resolveResultEntry = defaultResolveResultEntry
@@ -143,8 +256,12 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 	// layerCache caches resolved layers for future use. This is useful in a use-case where
 	// the filesystem resolves and caches all layers in an image (not only queried one) in parallel,
 	// before they are actually queried.
+	dirs := &cacheDirs{dirs: make(map[string]string)}
+	ztocBytes := new(int64)
 	layerCache := lrucache.New(resolveResultEntry)
 	layerCache.OnEvicted = func(key string, value interface{}) {
+		dirs.remove(key, spanCacheDir)
+		atomic.AddInt64(ztocBytes, -value.(*layer).ztocBytes)
 		if err := value.(*layer).close(); err != nil {
 			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up layer")
 			return
@@ -155,6 +272,7 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 	// blobCache caches resolved blobs for future use.
 	blobCache := lrucache.New(resolveResultEntry)
 	blobCache.OnEvicted = func(key string, value interface{}) {
+		dirs.remove(key, httpCacheDir)
 		if err := value.(remote.Blob).Close(); err != nil {
 			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up blob")
 			return
@@ -165,6 +283,35 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
+	if promoter != nil {
+		// copies of layers left by a previous run can't be completed, since their spans
+		// were verified by that run.
+		if err := os.RemoveAll(filepath.Join(root, promoteDir)); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Join(root, promoteDir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	cipher, err := newCacheCipher(cfg.CacheEncryptionConfig)
+	if err != nil {
+		return nil, err
+	}
+	var chunkCache cache.BlobCache
+	if cfg.BlobConfig.ChunkCache {
+		// chunks are verified against their digests before they're cached, so the
+		// cache is kept across restarts. Chunks which can't be decrypted, e.g. after
+		// the key changed, are fetched again.
+		chunkCache, err = cache.NewDirectoryCache(filepath.Join(root, chunkCacheDir), cache.DirectoryCacheConfig{
+			SyncAdd: cfg.DirectoryCacheConfig.SyncAdd,
+			BufPool: cacheBufPool,
+			Direct:  true,
+			Cipher:  cipher,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create chunk cache: %w", err)
+		}
+	}
 
 	return &Resolver{
 		rootDir:           root,
@@ -177,12 +324,72 @@ func NewResolver(root string, cfg config.Config, resolveHandlers map[string]remo
 		artifactStore:     artifactStore,
 		overlayOpaqueType: overlayOpaqueType,
 		bgFetcher:         bgFetcher,
+		promoter:          promoter,
+		cacheDirs:         dirs,
+		chunkCache:        chunkCache,
+		cipher:            cipher,
+		ztocBytes:         ztocBytes,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
+// logTOCCheck logs the result of the TOC check of a layer. A ztoc which doesn't match
+// its layer serves wrong contents, so mismatches are logged as warnings.
+func logTOCCheck(ctx context.Context, dgst digest.Digest, report spanmanager.TOCCheckReport) {
+	entry := log.G(ctx).WithFields(logrus.Fields{
+		"layerDigest":    dgst,
+		"checkedEntries": report.CheckedEntries,
+		"mismatches":     report.MismatchCount,
+	})
+	switch {
+	case report.Error != "":
+		entry.Warnf("failed to check ztoc against layer: %s", report.Error)
+	case report.MismatchCount > 0:
+		first := report.Mismatches[0]
+		entry.Warnf("ztoc doesn't match layer: %s of entry %d (%q) is %q in the ztoc but %q in the layer",
+			first.Field, first.Index, first.Name, first.Expected, first.Actual)
+	default:
+		entry.Debug("ztoc matches layer")
+	}
+}
+
+// cacheVerification returns when spans read from the span caches of layers are
+// verified, and the fraction of the reads which are verified if they're sampled.
+func cacheVerification(cfg config.BlobConfig) (spanmanager.CacheVerification, float64) {
+	switch cfg.CacheVerification {
+	case "always":
+		return spanmanager.VerifyAlways, 1
+	case "sampled":
+		if cfg.CacheVerificationSampleRate == 0 {
+			return spanmanager.VerifySampled, defaultCacheVerificationSampleRate
+		}
+		return spanmanager.VerifySampled, cfg.CacheVerificationSampleRate
+	default:
+		return spanmanager.VerifyNever, 0
+	}
+}
+
+// cacheBufPool is shared by the on-memory caches of all layers,
+// so that buffers evicted from one layer's cache are reused by the others.
+var cacheBufPool = &sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// newCache returns the cache of the layer dgst and its directory, which is empty for
+// on-memory caches. Caches on disk are created in a unique directory, sharded by the
+// digest of the layer, and are encrypted with cipher unless it's nil.
+func newCache(root string, dgst digest.Digest, cacheType string, cfg config.Config, cipher *cache.Cipher) (cache.BlobCache, string, error) {
 	if cacheType == memoryCacheType {
-		return cache.NewMemoryCache(), nil
+		return cache.NewMemoryCache(), "", nil
+	}
+	cachePath, err := newCacheDir(root, dgst)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize directory cache: %w", err)
+	}
+	if cacheType == packfileCacheType {
+		c, err := cache.NewPackfileCache(cachePath, cache.PackfileCacheConfig{BufPool: cacheBufPool, Cipher: cipher})
+		return c, cachePath, err
 	}
 
 	dcc := cfg.DirectoryCacheConfig
@@ -195,11 +402,7 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 		maxFdEntry = defaultMaxCacheFds
 	}
 
-	bufPool := &sync.Pool{
-		New: func() interface{} {
-			return new(bytes.Buffer)
-		},
-	}
+	bufPool := cacheBufPool
 	dCache, fCache := lrucache.New(maxDataEntry), lrucache.New(maxFdEntry)
 	dCache.OnEvicted = func(key string, value interface{}) {
 		value.(*bytes.Buffer).Reset()
@@ -208,15 +411,7 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value interface{}) {
 		value.(*os.File).Close()
 	}
-	// create a cache on an unique directory
-	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
-	}
-	cachePath, err := os.MkdirTemp(root, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
-	}
-	return cache.NewDirectoryCache(
+	c, err := cache.NewDirectoryCache(
 		cachePath,
 		cache.DirectoryCacheConfig{
 			SyncAdd:   dcc.SyncAdd,
@@ -224,8 +419,23 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 			FdCache:   fCache,
 			BufPool:   bufPool,
 			Direct:    dcc.Direct,
+			Cipher:    cipher,
 		},
 	)
+	return c, cachePath, err
+}
+
+// newCacheDir creates a unique directory for the cache of the layer dgst.
+func newCacheDir(root string, dgst digest.Digest) (string, error) {
+	encoded := dgst.Encoded()
+	shard := root
+	if len(encoded) > 2 {
+		shard = filepath.Join(root, encoded[:2])
+	}
+	if err := os.MkdirAll(shard, 0700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(shard, encoded+"-")
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
@@ -268,7 +478,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	spanCache, err := newCache(filepath.Join(r.rootDir, "spancache"), r.config.FSCacheType, r.config)
+	spanCache, spanCachePath, err := newCache(filepath.Join(r.rootDir, spanCacheDir), desc.Digest, r.config.FSCacheType, r.config, r.cipher)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create span manager cache: %w", err)
 	}
@@ -300,6 +510,13 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		// for now just error out, so container runtime takes care of this
 		return nil, fmt.Errorf("download and unpack this layer in container runtime for now")
 	}
+	// schema v2 indices record the uncompressed size of the layer, which must match the ztoc.
+	if size, ok, err := soci.ImageLayerUncompressedSize(sociDesc); err != nil {
+		return nil, err
+	} else if ok && size != int64(ztoc.UncompressedArchiveSize) {
+		return nil, fmt.Errorf("uncompressed size of layer %s is %d in the index but %d in the ztoc",
+			desc.Digest, size, ztoc.UncompressedArchiveSize)
+	}
 
 	// log ztoc info
 	log.G(context.Background()).WithFields(logrus.Fields{
@@ -316,6 +533,11 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
 		return blobR.ReadAt(p, offset)
 	}), 0, blobR.Size())
+	// spans fetched in the background (e.g. by the background fetcher or prefetches)
+	// wait for reads of files to be served first.
+	bgSr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
+		return blobR.ReadAt(p, offset, remote.WithBackgroundFetch())
+	}), 0, blobR.Size())
 	// define telemetry hooks to measure latency metrics for the metadata store
 	telemetry := metadata.Telemetry{
 		InitMetadataStoreLatency: func(start time.Time) {
@@ -326,23 +548,78 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if retErr != nil {
+			// remove the layer's filesystem from the metadata DB.
+			meta.Close()
+		}
+	}()
 	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
 
 	spanManager := spanmanager.New(ztoc, sr, spanCache, r.config.BlobConfig.MaxSpanVerificationRetries, cache.Direct())
+	spanManager.SetMaxParallelSpans(r.config.BlobConfig.MaxParallelSpans)
+	spanManager.SetBackgroundReader(bgSr)
+	spanManager.SetSubSpanReads(r.config.BlobConfig.SubSpanReads)
+	spanManager.SetCacheVerification(cacheVerification(r.config.BlobConfig))
+	r.importSeededSpans(ctx, desc.Digest, sociDesc.Digest, spanManager)
 	var bgLayerResolver backgroundfetcher.Resolver
+	var promotion *blobPromotion
 	if r.bgFetcher != nil {
+		// the background fetcher fetches the whole layer, so verify it along the way.
+		// Once it's verified, the layer can be promoted too.
+		var digestOpts []spanmanager.LayerDigestOption
+		if r.promoter != nil {
+			promotion, err = r.newBlobPromotion(ctx, refspec, desc)
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("layer won't be promoted after background fetch")
+			} else {
+				digestOpts = promotion.digestOptions()
+			}
+		}
+		if err := spanManager.SetLayerDigest(desc.Digest, digestOpts...); err != nil {
+			log.G(ctx).WithError(err).Debug("layer won't be verified after background fetch")
+			if promotion != nil {
+				promotion.close()
+				promotion = nil
+			}
+		}
+		if r.config.BackgroundFetchConfig.CheckTOC {
+			spanManager.SetTOCCheck(func(report spanmanager.TOCCheckReport) {
+				logTOCCheck(ctx, desc.Digest, report)
+			})
+		}
 		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager)
 		r.bgFetcher.Add(bgLayerResolver)
-	}
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
+		defer func() {
+			if retErr != nil {
+				// the background fetcher drops closed resolvers.
+				bgLayerResolver.Close()
+			}
+		}()
+	}
+	var readerOpts []reader.Option
+	if r.chunkCache != nil {
+		readerOpts = append(readerOpts, reader.WithChunkCache(r.chunkCache, ztoc.TOC))
+	}
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, readerOpts...)
 	if err != nil {
+		if promotion != nil {
+			promotion.close()
+		}
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
 
 	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, bgLayerResolver, opCounter)
+	l := newLayer(r, desc, sociDesc.Digest, blobR, vr, spanManager, bgLayerResolver, promotion, opCounter)
+	l.name = name
+	l.ztocBytes = ztocMemory(ztoc)
+	l.uncompressedSize = int64(ztoc.UncompressedArchiveSize)
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
+	if added {
+		r.cacheDirs.set(name, spanCacheDir, spanCachePath)
+		atomic.AddInt64(r.ztocBytes, l.ztocBytes)
+	}
 	r.layerCacheMu.Unlock()
 	if !added {
 		l.close() // layer already exists in the cache. discrad this.
@@ -352,6 +629,88 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	return &layerRef{cachedL.(*layer), done2}, nil
 }
 
+// LeastRecentlyUsed returns the name of the least recently used layer which isn't
+// mounted and the directories of its caches. It returns false if all layers are in use.
+func (r *Resolver) LeastRecentlyUsed() (string, []string, bool) {
+	r.layerCacheMu.Lock()
+	unused := r.layerCache.Unused()
+	r.layerCacheMu.Unlock()
+	if len(unused) == 0 {
+		return "", nil, false
+	}
+	return unused[0], r.cacheDirs.get(unused[0]), true
+}
+
+// remove removes the layer name and its blob from the caches, removing their caches from
+// disk, unless the layer is in use. It returns false if it's not removed.
+func (r *Resolver) remove(name string) bool {
+	r.layerCacheMu.Lock()
+	unused := false
+	for _, n := range r.layerCache.Unused() {
+		if n == name {
+			unused = true
+			break
+		}
+	}
+	if !unused {
+		r.layerCacheMu.Unlock()
+		return false
+	}
+	// the layer releases its blob when it's closed, so the blob is unused once
+	// the layer is removed.
+	r.layerCache.Remove(name)
+	r.layerCacheMu.Unlock()
+
+	r.blobCacheMu.Lock()
+	r.blobCache.Remove(name)
+	r.blobCacheMu.Unlock()
+	return true
+}
+
+// Evict evicts the layer name, removing its caches from disk, unless it's mounted
+// again since LeastRecentlyUsed returned it. It returns false if it's not evicted.
+func (r *Resolver) Evict(name string) bool {
+	if !r.remove(name) {
+		return false
+	}
+	logrus.WithField("key", name).Infof("evicted layer to stay within the budget")
+	return true
+}
+
+// Discard removes the layer resolved from refspec, e.g. after mounting it failed, so that
+// it's resolved from scratch the next time. The layer is kept if it's still in use.
+func (r *Resolver) Discard(refspec reference.Spec, dgst digest.Digest) bool {
+	name := refspec.String() + "/" + dgst.String()
+	if !r.remove(name) {
+		return false
+	}
+	logrus.WithField("key", name).Debugf("discarded layer")
+	return true
+}
+
+// ZtocMemoryUsage returns the estimated memory held by the ztocs of the cached layers.
+func (r *Resolver) ZtocMemoryUsage() int64 {
+	return atomic.LoadInt64(r.ztocBytes)
+}
+
+// ztocMemory estimates the memory held by a ztoc. It's dominated by the checkpoints,
+// the metadata of the files and the digests of the spans and chunks.
+func ztocMemory(z *ztoc.Ztoc) int64 {
+	const (
+		fileMetadataSize = 256 // FileMetadata without its strings and digests
+		digestSize       = 71  // "sha256:" and 64 hex digits
+	)
+	n := int64(len(z.Checkpoints)) + int64(len(z.SpanDigests))*digestSize
+	for _, fm := range z.FileMetadata {
+		n += fileMetadataSize + int64(len(fm.Name)+len(fm.Linkname)+len(fm.Uname)+len(fm.Gname))
+		n += int64(len(fm.ChunkDigests)) * digestSize
+		for k, v := range fm.Xattrs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
 // resolveBlob resolves a blob based on the passed layer blob information.
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
@@ -371,7 +730,7 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
+	httpCache, httpCachePath, err := newCache(filepath.Join(r.rootDir, httpCacheDir), desc.Digest, r.config.HTTPCacheType, r.config, r.cipher)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http cache: %w", err)
 	}
@@ -388,6 +747,9 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 	}
 	r.blobCacheMu.Lock()
 	cachedB, done, added := r.blobCache.Add(name, b)
+	if added {
+		r.cacheDirs.set(name, httpCacheDir, httpCachePath)
+	}
 	r.blobCacheMu.Unlock()
 	if !added {
 		b.Close() // blob already exists in the cache. discard this.
@@ -398,32 +760,58 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 func newLayer(
 	resolver *Resolver,
 	desc ocispec.Descriptor,
+	ztocDigest digest.Digest,
 	blob *blobRef,
 	vr *reader.VerifiableReader,
+	spanManager *spanmanager.SpanManager,
 	bgResolver backgroundfetcher.Resolver,
+	promotion *blobPromotion,
 	opCounter *FuseOperationCounter,
 ) *layer {
+	fetchCtx, cancelFetch := context.WithCancel(context.Background())
 	return &layer{
 		resolver:             resolver,
 		desc:                 desc,
+		ztocDigest:           ztocDigest,
 		blob:                 blob,
 		verifiableReader:     vr,
+		spanManager:          spanManager,
 		bgResolver:           bgResolver,
+		promotion:            promotion,
 		fuseOperationCounter: opCounter,
+		errLogLimiter:        newErrorLogLimiter(desc.Digest, resolver.config.FuseConfig),
+		fetchCtx:             fetchCtx,
+		cancelFetch:          cancelFetch,
 	}
 }
 
 type layer struct {
 	resolver         *Resolver
 	desc             ocispec.Descriptor
+	ztocDigest       digest.Digest
 	blob             *blobRef
 	verifiableReader *reader.VerifiableReader
+	spanManager      *spanmanager.SpanManager
 
 	bgResolver backgroundfetcher.Resolver
+	promotion  *blobPromotion
+
+	// fetchCtx is canceled by CancelFetches. fetchMu guards it and bgResolver.
+	fetchCtx    context.Context
+	cancelFetch context.CancelFunc
+	fetchMu     sync.Mutex
 
 	r reader.Reader
 
 	fuseOperationCounter *FuseOperationCounter
+	errLogLimiter        *errorLogLimiter
+
+	// ztocBytes is the estimated memory held by the layer's ztoc.
+	ztocBytes int64
+	// uncompressedSize is the size of the uncompressed contents of the layer.
+	uncompressedSize int64
+	// name is the key of the layer in the cache of the resolver.
+	name string
 
 	closed   bool
 	closedMu sync.Mutex
@@ -434,14 +822,27 @@ func (l *layer) Info() Info {
 	if l.r != nil {
 		readTime = l.r.LastOnDemandReadTime()
 	}
+	var tocCheck *spanmanager.TOCCheckReport
+	if l.spanManager != nil {
+		if report, ok := l.spanManager.TOCCheckReport(); ok {
+			tocCheck = &report
+		}
+	}
 	return Info{
-		Digest:      l.desc.Digest,
-		Size:        l.blob.Size(),
-		FetchedSize: l.blob.FetchedSize(),
-		ReadTime:    readTime,
+		Digest:           l.desc.Digest,
+		ZtocDigest:       l.ztocDigest,
+		Size:             l.blob.Size(),
+		FetchedSize:      l.blob.FetchedSize(),
+		ReadTime:         readTime,
+		UncompressedSize: l.uncompressedSize,
+		TOCCheck:         tocCheck,
 	}
 }
 
+func (l *layer) SpanStates() spanmanager.SpanStates {
+	return l.spanManager.SpanStates()
+}
+
 func (l *layer) Check() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -474,6 +875,22 @@ func (l *layer) SkipVerify() {
 	l.r = l.verifiableReader.SkipVerify()
 }
 
+func (l *layerRef) Acquire() (Layer, bool) {
+	r := l.resolver
+	r.layerCacheMu.Lock()
+	c, done, ok := r.layerCache.Get(l.name)
+	r.layerCacheMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if c.(*layer) != l.layer {
+		// the layer was discarded and resolved again.
+		done()
+		return nil, false
+	}
+	return &layerRef{l.layer, done}, true
+}
+
 func (l *layerRef) Done() {
 	l.done()
 }
@@ -485,7 +902,7 @@ func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.fuseOperationCounter)
+	return newNode(l.fetchContext(), l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.resolver.config.LogFuseOperations, l.fuseOperationCounter, l.errLogLimiter, l.resolver.config.FuseConfig)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -499,8 +916,9 @@ func (l *layer) close() error {
 		return nil
 	}
 	l.closed = true
-	if l.bgResolver != nil {
-		l.bgResolver.Close()
+	l.CancelFetches()
+	if l.promotion != nil {
+		l.promotion.close()
 	}
 	defer l.blob.done() // Close reader first, then close the blob
 	l.verifiableReader.Close()
@@ -510,6 +928,32 @@ func (l *layer) close() error {
 	return nil
 }
 
+func (l *layer) CancelFetches() {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	l.cancelFetch()
+	if l.bgResolver != nil {
+		l.bgResolver.Close()
+	}
+}
+
+// fetchContext returns the context of the fetches of the layer. If they were canceled,
+// they are restarted, including the background fetch.
+func (l *layer) fetchContext() context.Context {
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+	if l.fetchCtx.Err() == nil {
+		return l.fetchCtx
+	}
+	l.fetchCtx, l.cancelFetch = context.WithCancel(context.Background())
+	if l.bgResolver != nil {
+		// spans which were already fetched are skipped quickly.
+		l.bgResolver = backgroundfetcher.NewSequentialResolver(l.desc.Digest, l.spanManager)
+		l.resolver.bgFetcher.Add(l.bgResolver)
+	}
+	return l.fetchCtx
+}
+
 func (l *layer) isClosed() bool {
 	l.closedMu.Lock()
 	closed := l.closed
@@ -45,6 +45,8 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/metadata"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func TestLayer(t *testing.T) {
@@ -79,6 +81,48 @@ func TestWaiter(t *testing.T) {
 	}
 }
 
+func TestEntryTimes(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	fixed := time.Unix(0, 0)
+	tests := []struct {
+		name      string
+		fixedTime *time.Time
+		expected  time.Time
+	}{
+		{
+			name:     "modification time of the entry",
+			expected: mtime,
+		},
+		{
+			name:      "fixed time",
+			fixedTime: &fixed,
+			expected:  fixed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ffs := &fs{fixedTime: tt.fixedTime}
+			attr := metadata.Attr{ModTime: mtime, Mode: 0644}
+			for name, toAttr := range map[string]func(uint64, metadata.Attr, *fuse.Attr) fusefs.StableAttr{
+				"entry":    ffs.entryToAttr,
+				"whiteout": ffs.entryToWhAttr,
+			} {
+				var out fuse.Attr
+				toAttr(1, attr, &out)
+				for kind, actual := range map[string]time.Time{
+					"atime": out.AccessTime(),
+					"mtime": out.ModTime(),
+					"ctime": out.ChangeTime(),
+				} {
+					if !actual.Equal(tt.expected) {
+						t.Errorf("%s %s: expected %v, got %v", name, kind, tt.expected, actual)
+					}
+				}
+			}
+		})
+	}
+}
+
 func newWaiter() *waiter {
 	return &waiter{
 		completionCond: sync.NewCond(&sync.Mutex{}),
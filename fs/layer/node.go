@@ -53,6 +53,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
@@ -190,7 +191,7 @@ func incFuseOpFailureMetric(operationName string, layer digest.Digest) {
 	commonmetrics.IncOperationCount(metric, layer)
 }
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, opCounter *FuseOperationCounter) (fusefs.InodeEmbedder, error) {
+func newNode(ctx context.Context, layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, logFSOperations bool, opCounter *FuseOperationCounter, errLogLimiter *errorLogLimiter, fuseCfg config.FuseConfig) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -208,6 +209,12 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		opaqueXattrs:     opq,
 		logFSOperations:  logFSOperations,
 		operationCounter: opCounter,
+		errLogLimiter:    errLogLimiter,
+		fixedTime:        fixedTime(fuseCfg),
+		readaheadBytes:   fuseCfg.ReadaheadBytes,
+		readDeadline:     newReadDeadline(fuseCfg),
+		errnos:           newErrnoMapping(fuseCfg),
+		fetchCtx:         ctx,
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -227,6 +234,35 @@ type fs struct {
 	opaqueXattrs     []string
 	logFSOperations  bool
 	operationCounter *FuseOperationCounter
+	errLogLimiter    *errorLogLimiter
+	// fixedTime overrides the timestamps of all files if it isn't nil.
+	fixedTime *time.Time
+	// readaheadBytes is how far ahead of sequential reads files are fetched.
+	readaheadBytes int64
+	// readDeadline bounds how long reads of files wait for their contents, if it isn't nil.
+	readDeadline *readDeadline
+	// errnos maps the classes of the errors of failed reads to their errnos.
+	errnos errnoMapping
+	// fetchCtx is canceled when the fetches of the layer are canceled, which stops readahead.
+	fetchCtx context.Context
+}
+
+// fixedTime returns the timestamp which overrides the timestamps of all files, if it's configured.
+func fixedTime(cfg config.FuseConfig) *time.Time {
+	if !cfg.FixedTimestamps {
+		return nil
+	}
+	t := time.Unix(cfg.FixedTimestampSec, 0)
+	return &t
+}
+
+func (fs *fs) isOpaqueXattr(name string) bool {
+	for _, x := range fs.opaqueXattrs {
+		if name == x {
+			return true
+		}
+	}
+	return false
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -331,7 +367,7 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 		return true
 	}); err != nil || lastErr != nil {
 		incFuseOpFailureMetric(fuseOpReaddir, n.fs.layerDigest)
-		n.fs.s.report(fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
+		n.fs.s.report(fuseOpReaddir, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
 		return nil, syscall.EIO
 	}
 
@@ -341,7 +377,7 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 			ino, err := n.fs.inodeOfID(id)
 			if err != nil {
 				incFuseOpFailureMetric(fuseOpReaddir, n.fs.layerDigest)
-				n.fs.s.report(fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
+				n.fs.s.report(fuseOpReaddir, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
 				return nil, syscall.EIO
 			}
 			ents = append(ents, fuse.DirEntry{
@@ -389,21 +425,21 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 			ino, err := n.fs.inodeOfID(tn.id)
 			if err != nil {
 				incFuseOpFailureMetric(fuseOpLookup, n.fs.layerDigest)
-				n.fs.s.report(fmt.Errorf("%s: %v", fuseOpLookup, err))
+				n.fs.s.report(fuseOpLookup, fmt.Errorf("%s: %v", fuseOpLookup, err))
 				return nil, syscall.EIO
 			}
-			entryToAttr(ino, tn.attr, &out.Attr)
+			n.fs.entryToAttr(ino, tn.attr, &out.Attr)
 		case *whiteout:
 			ino, err := n.fs.inodeOfID(tn.id)
 			if err != nil {
 				incFuseOpFailureMetric(fuseOpLookup, n.fs.layerDigest)
-				n.fs.s.report(fmt.Errorf("%s: %v", fuseOpLookup, err))
+				n.fs.s.report(fuseOpLookup, fmt.Errorf("%s: %v", fuseOpLookup, err))
 				return nil, syscall.EIO
 			}
-			entryToAttr(ino, tn.attr, &out.Attr)
+			n.fs.entryToAttr(ino, tn.attr, &out.Attr)
 		default:
 			incFuseOpFailureMetric(fuseOpLookup, n.fs.layerDigest)
-			n.fs.s.report(fmt.Errorf("%s: uknown node type detected", fuseOpLookup))
+			n.fs.s.report(fuseOpLookup, fmt.Errorf("%s: uknown node type detected", fuseOpLookup))
 			return nil, syscall.EIO
 		}
 		return cn, 0
@@ -429,14 +465,14 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 			ino, err := n.fs.inodeOfID(whID)
 			if err != nil {
 				incFuseOpFailureMetric(fuseOpLookup, n.fs.layerDigest)
-				n.fs.s.report(fmt.Errorf("%s: %v", fuseOpLookup, err))
+				n.fs.s.report(fuseOpLookup, fmt.Errorf("%s: %v", fuseOpLookup, err))
 				return nil, syscall.EIO
 			}
 			return n.NewInode(ctx, &whiteout{
 				id:   whID,
 				fs:   n.fs,
 				attr: wh,
-			}, entryToWhAttr(ino, wh, &out.Attr)), 0
+			}, n.fs.entryToWhAttr(ino, wh, &out.Attr)), 0
 		}
 		n.readdir() // This code path is very expensive. Cache child entries here so that the next call don't reach here.
 		return nil, syscall.ENOENT
@@ -445,14 +481,14 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 	ino, err := n.fs.inodeOfID(id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpLookup, n.fs.layerDigest)
-		n.fs.s.report(fmt.Errorf("%s: %v", fuseOpLookup, err))
+		n.fs.s.report(fuseOpLookup, fmt.Errorf("%s: %v", fuseOpLookup, err))
 		return nil, syscall.EIO
 	}
 	return n.NewInode(ctx, &node{
 		id:   id,
 		fs:   n.fs,
 		attr: ce,
-	}, entryToAttr(ino, ce, &out.Attr)), 0
+	}, n.fs.entryToAttr(ino, ce, &out.Attr)), 0
 }
 
 var _ = (fusefs.NodeOpener)((*node)(nil))
@@ -465,13 +501,27 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 	ra, err := n.fs.r.OpenFile(n.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpOpen, n.fs.layerDigest)
-		n.fs.s.report(fmt.Errorf("%s: %v", fuseOpOpen, err))
+		n.fs.s.report(fuseOpOpen, fmt.Errorf("%s: %v", fuseOpOpen, err))
 		return nil, 0, syscall.EIO
 	}
-	return &file{
+	f := &file{
 		n:  n,
 		ra: ra,
-	}, fuse.FOPEN_KEEP_CACHE, 0
+	}
+	if flags&syscall.O_DIRECT != 0 {
+		// Applications opening files with O_DIRECT (e.g. databases) manage their own
+		// caching and read in their own patterns, so the page cache and readahead are
+		// skipped, and the uncompressed spans they read aren't cached either.
+		if u, ok := ra.(uncachedReader); ok {
+			f.ra = readerAtFunc(u.ReadAtUncached)
+		}
+		return f, fuse.FOPEN_DIRECT_IO, 0
+	}
+	if p, ok := ra.(prefetcher); ok {
+		f.prefetcher = p
+		f.readahead = newReadahead(n.fs.readaheadBytes)
+	}
+	return f, fuse.FOPEN_KEEP_CACHE, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
@@ -484,10 +534,10 @@ func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrO
 	ino, err := n.fs.inodeOfID(n.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpGetattr, n.fs.layerDigest)
-		n.fs.s.report(fmt.Errorf("%s: %v", fuseOpGetattr, err))
+		n.fs.s.report(fuseOpGetattr, fmt.Errorf("%s: %v", fuseOpGetattr, err))
 		return syscall.EIO
 	}
-	entryToAttr(ino, n.attr, &out.Attr)
+	n.fs.entryToAttr(ino, n.attr, &out.Attr)
 	return 0
 }
 
@@ -509,7 +559,7 @@ func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 			return uint32(copy(dest, opaqueXattrValue)), 0
 		}
 	}
-	if v, ok := ent.Xattrs[attr]; ok {
+	if v, ok := xattrsFromPAXRecords(ent.Xattrs)[attr]; ok {
 		if len(dest) < len(v) {
 			return uint32(len(v)), syscall.ERANGE
 		}
@@ -534,7 +584,10 @@ func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			attrs = append(attrs, []byte(opaqueXattr+"\x00")...)
 		}
 	}
-	for k := range ent.Xattrs {
+	for _, k := range xattrNames(xattrsFromPAXRecords(ent.Xattrs)) {
+		if opq && n.fs.isOpaqueXattr(k) {
+			continue // already listed
+		}
 		attrs = append(attrs, []byte(k+"\x00")...)
 	}
 	if len(dest) < len(attrs) {
@@ -562,6 +615,11 @@ func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 type file struct {
 	n  *node
 	ra io.ReaderAt
+
+	// readahead fetches the contents ahead of sequential reads with prefetcher.
+	// It is nil if the file isn't read ahead.
+	readahead  *readahead
+	prefetcher prefetcher
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
@@ -573,11 +631,15 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 	}
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.SynchronousRead, f.n.fs.layerDigest, time.Now()) // measure time for synchronous file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.SynchronousReadCount, f.n.fs.layerDigest)                   // increment the counter for synchronous file reads
-	n, err := f.ra.ReadAt(dest, off)
+	n, err := f.n.fs.readDeadline.readAt(f.ra, dest, off, f.n.fs.layerDigest)
 	if err != nil && err != io.EOF {
 		incFuseOpFailureMetric(fuseOpFileRead, f.n.fs.layerDigest)
-		f.n.fs.s.report(fmt.Errorf("%s: %v", fuseOpFileRead, err))
-		return nil, syscall.EIO
+		f.n.fs.s.report(fuseOpFileRead, fmt.Errorf("%s: %v", fuseOpFileRead, err))
+		return nil, f.n.fs.errnos.errno(err)
+	}
+	if start, length, ok := f.readahead.observe(off, int64(n)); ok && f.n.fs.fetchCtx.Err() == nil {
+		// read ahead within the lifecycle of the layer, not of this request.
+		f.readahead.fetch(f.n.fs.fetchCtx, f.prefetcher, start, length)
 	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
@@ -592,10 +654,10 @@ func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
 	ino, err := f.n.fs.inodeOfID(f.n.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpFileGetattr, f.n.fs.layerDigest)
-		f.n.fs.s.report(fmt.Errorf("%s: %v", fuseOpFileGetattr, err))
+		f.n.fs.s.report(fuseOpFileGetattr, fmt.Errorf("%s: %v", fuseOpFileGetattr, err))
 		return syscall.EIO
 	}
-	entryToAttr(ino, f.n.attr, &out.Attr)
+	f.n.fs.entryToAttr(ino, f.n.attr, &out.Attr)
 	return 0
 }
 
@@ -616,10 +678,10 @@ func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.A
 	ino, err := w.fs.inodeOfID(w.id)
 	if err != nil {
 		incFuseOpFailureMetric(fuseOpWhiteoutGetattr, w.fs.layerDigest)
-		w.fs.s.report(fmt.Errorf("%s: %v", fuseOpWhiteoutGetattr, err))
+		w.fs.s.report(fuseOpWhiteoutGetattr, fmt.Errorf("%s: %v", fuseOpWhiteoutGetattr, err))
 		return syscall.EIO
 	}
-	entryToWhAttr(ino, w.attr, &out.Attr)
+	w.fs.entryToWhAttr(ino, w.attr, &out.Attr)
 	return 0
 }
 
@@ -696,8 +758,10 @@ func (s *state) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 	return 0
 }
 
-func (s *state) report(err error) {
-	s.statFile.report(err)
+// report records err, which happened in FUSE operation op, in the stat file.
+// The error is logged unless errors of op are being rate limited for this layer.
+func (s *state) report(op string, err error) {
+	s.statFile.report(err, s.fs.errLogLimiter.allow(op))
 }
 
 type statJSON struct {
@@ -769,11 +833,13 @@ func (sf *statFile) logContents() {
 	}).WithError(errors.New(sf.statJSON.Error)).Error("statFile error")
 }
 
-func (sf *statFile) report(err error) {
+func (sf *statFile) report(err error, logErr bool) {
 	sf.mu.Lock()
 	defer sf.mu.Unlock()
 	sf.statJSON.Error = err.Error()
-	sf.logContents()
+	if logErr {
+		sf.logContents()
+	}
 }
 
 func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
@@ -800,7 +866,7 @@ func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 }
 
 // entryToAttr converts metadata.Attr to go-fuse's Attr.
-func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
+func (fs *fs) entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = ino
 	out.Size = uint64(e.Size)
 	if e.Mode&os.ModeSymlink != 0 {
@@ -811,8 +877,7 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 	if out.Size%uint64(out.Blksize) > 0 {
 		out.Blocks++
 	}
-	mtime := e.ModTime
-	out.SetTimes(nil, &mtime, nil)
+	fs.setTimes(e.ModTime, out)
 	out.Mode = fileModeToSystemMode(e.Mode)
 	out.Owner = fuse.Owner{Uid: uint32(e.UID), Gid: uint32(e.GID)}
 	out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
@@ -832,13 +897,12 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 }
 
 // entryToWhAttr converts metadata.Attr to go-fuse's Attr of whiteouts.
-func entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
+func (fs *fs) entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = ino
 	out.Size = 0
 	out.Blksize = blockSize
 	out.Blocks = 0
-	mtime := e.ModTime
-	out.SetTimes(nil, &mtime, nil)
+	fs.setTimes(e.ModTime, out)
 	out.Mode = syscall.S_IFCHR
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
 	out.Rdev = uint32(unix.Mkdev(0, 0))
@@ -854,6 +918,17 @@ func entryToWhAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAtt
 	}
 }
 
+// setTimes sets all timestamps of out to the modification time of the entry, or to the
+// fixed timestamp if it's configured. Layers are immutable and tar archives only record
+// the modification time, so the timestamps are stable for the lifetime of the mount and
+// applications watching files don't see spurious changes.
+func (fs *fs) setTimes(mtime time.Time, out *fuse.Attr) {
+	if fs.fixedTime != nil {
+		mtime = *fs.fixedTime
+	}
+	out.SetTimes(&mtime, &mtime, &mtime)
+}
+
 // stateToAttr converts state directory to go-fuse's Attr.
 func (fs *fs) stateToAttr(out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = fs.inodeOfState()
@@ -0,0 +1,241 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func (l *layer) Prefetch(ctx context.Context, paths []string) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	ctx, cancel := l.withFetchContext(ctx)
+	defer cancel()
+	if len(paths) == 0 {
+		return l.spanManager.FetchAllSpans(ctx)
+	}
+
+	meta := l.verifiableReader.Metadata()
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, found := lookupPath(meta, p)
+		if !found {
+			// the file may be in another layer of the image
+			continue
+		}
+		if err := l.prefetchNode(ctx, meta, id); err != nil {
+			return fmt.Errorf("failed to prefetch %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// prefetchNode fetches the contents of the node with id, recursively if it's a directory.
+func (l *layer) prefetchNode(ctx context.Context, meta metadata.Reader, id uint32) error {
+	return walkNode(ctx, meta, id, func(start, end compression.Offset) error {
+		return l.spanManager.FetchSpans(ctx, start, end)
+	})
+}
+
+// Hydrate fetches and caches the spans of the files at paths, or all spans of the
+// layer if paths is empty, until at least the fraction threshold (between 0 and 1)
+// of them is cached. Spans are fetched in the order of paths. It returns the fraction
+// of the spans which is cached, which is 1 if none of paths exist in the layer.
+func (l *layer) Hydrate(ctx context.Context, paths []string, threshold float64) (float64, error) {
+	if l.isClosed() {
+		return 0, fmt.Errorf("layer is already closed")
+	}
+	ctx, cancel := l.withFetchContext(ctx)
+	defer cancel()
+
+	spans, err := l.prioritizedSpans(ctx, paths)
+	if err != nil {
+		return 0, err
+	}
+	if len(spans) == 0 {
+		return 1, nil
+	}
+	cachedFraction := func() float64 {
+		var cached int
+		for _, id := range spans {
+			if l.spanManager.IsCached(id) {
+				cached++
+			}
+		}
+		return float64(cached) / float64(len(spans))
+	}
+	fraction := cachedFraction()
+	for _, id := range spans {
+		if fraction >= threshold {
+			break
+		}
+		if l.spanManager.IsCached(id) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return cachedFraction(), err
+		}
+		if err := l.spanManager.FetchSingleSpan(id); err != nil {
+			return cachedFraction(), fmt.Errorf("failed to fetch span %d: %w", id, err)
+		}
+		if l.spanManager.IsCached(id) {
+			fraction += 1 / float64(len(spans))
+		}
+	}
+	return cachedFraction(), nil
+}
+
+func (l *layer) PrefetchSpans(ctx context.Context, spans []compression.SpanID) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	ctx, cancel := l.withFetchContext(ctx)
+	defer cancel()
+	for _, id := range spans {
+		if id < 0 || id > l.spanManager.MaxSpanID() || l.spanManager.IsCached(id) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := l.spanManager.FetchSingleSpan(id); err != nil {
+			return fmt.Errorf("failed to fetch span %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (l *layer) AccessedSpans() []compression.SpanID {
+	return l.spanManager.TouchedSpans()
+}
+
+// prioritizedSpans returns the IDs of the spans of the files at paths without
+// duplicates, in the order of paths, or of all spans of the layer if paths is empty.
+func (l *layer) prioritizedSpans(ctx context.Context, paths []string) ([]compression.SpanID, error) {
+	var spans []compression.SpanID
+	if len(paths) == 0 {
+		for id := compression.SpanID(0); id <= l.spanManager.MaxSpanID(); id++ {
+			spans = append(spans, id)
+		}
+		return spans, nil
+	}
+	seen := make(map[compression.SpanID]struct{})
+	meta := l.verifiableReader.Metadata()
+	for _, p := range paths {
+		id, found := lookupPath(meta, p)
+		if !found {
+			// the file may be in another layer of the image
+			continue
+		}
+		if err := walkNode(ctx, meta, id, func(start, end compression.Offset) error {
+			first, last, ok := l.spanManager.SpanRange(start, end)
+			if !ok {
+				return nil
+			}
+			for i := first; i <= last; i++ {
+				if _, ok := seen[i]; !ok {
+					seen[i] = struct{}{}
+					spans = append(spans, i)
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to find spans of %q: %w", p, err)
+		}
+	}
+	return spans, nil
+}
+
+// walkNode calls fn with the range of the uncompressed contents of the node with id,
+// or of every regular file under it if it's a directory.
+func walkNode(ctx context.Context, meta metadata.Reader, id uint32, fn func(start, end compression.Offset) error) error {
+	attr, err := meta.GetAttr(id)
+	if err != nil {
+		return err
+	}
+	if attr.Mode.IsDir() {
+		var children []uint32
+		if err := meta.ForeachChild(id, func(_ string, id uint32, _ os.FileMode) bool {
+			children = append(children, id)
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := walkNode(ctx, meta, child, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !attr.Mode.IsRegular() || attr.Size == 0 {
+		return nil
+	}
+	f, err := meta.OpenFile(id)
+	if err != nil {
+		return err
+	}
+	start := f.GetUncompressedOffset()
+	return fn(start, start+f.GetUncompressedFileSize())
+}
+
+// withFetchContext returns a context which is canceled when either ctx or the
+// fetches of the layer are canceled.
+func (l *layer) withFetchContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	l.fetchMu.Lock()
+	fetchCtx := l.fetchCtx
+	l.fetchMu.Unlock()
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-fetchCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// lookupPath returns the id of the node at the absolute path p.
+// Like Lookup of FUSE nodes, any error of the metadata reader means that p doesn't exist.
+func lookupPath(meta metadata.Reader, p string) (uint32, bool) {
+	id := meta.RootID()
+	for _, name := range strings.Split(strings.TrimPrefix(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, _, err := meta.GetChild(id, name)
+		if err != nil {
+			return 0, false
+		}
+		id = child
+	}
+	return id, true
+}
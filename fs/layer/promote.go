@@ -0,0 +1,153 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	promoteDir = "promote"
+
+	// distributionSourceLabelPrefix is the prefix of the label containerd uses to record
+	// the repositories a blob can be fetched from.
+	distributionSourceLabelPrefix = "containerd.io/distribution.source."
+)
+
+// BlobPromoter stores layers once they're fully fetched and verified by the background
+// fetcher (e.g. in containerd's content store), so that pulling the layer later doesn't
+// need to download it again.
+type BlobPromoter interface {
+	// Promote stores the compressed layer desc read from r. ctx carries the namespace
+	// of the snapshot the layer was mounted for.
+	Promote(ctx context.Context, desc ocispec.Descriptor, r io.Reader, labels map[string]string) error
+}
+
+// blobPromotion keeps a copy of a layer as the background fetcher verifies it,
+// and promotes it once the whole layer is verified.
+type blobPromotion struct {
+	promoter  BlobPromoter
+	namespace string
+	desc      ocispec.Descriptor
+	labels    map[string]string
+
+	mu        sync.Mutex
+	f         *os.File
+	closed    bool
+	promoting bool
+}
+
+// newBlobPromotion starts a promotion of the layer desc of refspec, keeping the copy
+// of the layer in a temporary file under r's root directory.
+func (r *Resolver) newBlobPromotion(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (*blobPromotion, error) {
+	f, err := os.CreateTemp(filepath.Join(r.rootDir, promoteDir), desc.Digest.Encoded()+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file for layer: %w", err)
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	return &blobPromotion{
+		promoter:  r.promoter,
+		namespace: ns,
+		desc:      desc,
+		labels:    distributionSourceLabels(refspec),
+		f:         f,
+	}, nil
+}
+
+// digestOptions returns the span manager options that write the layer to the promotion.
+func (p *blobPromotion) digestOptions() []spanmanager.LayerDigestOption {
+	return []spanmanager.LayerDigestOption{
+		spanmanager.WithLayerSink(p.f),
+		spanmanager.WithVerifiedHook(func(err error) {
+			if err != nil {
+				p.close()
+				return
+			}
+			go p.promote()
+		}),
+	}
+}
+
+func (p *blobPromotion) promote() {
+	ctx := namespaces.WithNamespace(context.Background(), p.namespace)
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("layer", p.desc.Digest))
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	// the layer can be closed while it's promoted, so remove the copy once it's done.
+	p.promoting = true
+	p.mu.Unlock()
+	defer p.remove()
+
+	if _, err := p.f.Seek(0, io.SeekStart); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to promote layer")
+		return
+	}
+	if err := p.promoter.Promote(ctx, p.desc, p.f, p.labels); err != nil {
+		commonmetrics.IncOperationCount(commonmetrics.BlobPromotionFailureCount, p.desc.Digest)
+		log.G(ctx).WithError(err).Warn("failed to promote layer")
+		return
+	}
+	commonmetrics.IncOperationCount(commonmetrics.BlobPromotionCount, p.desc.Digest)
+	log.G(ctx).Debug("promoted layer")
+}
+
+// close stops the promotion and removes the copy of the layer, unless the layer
+// is being promoted. It's safe to call it more than once.
+func (p *blobPromotion) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if !p.promoting {
+		p.remove()
+	}
+}
+
+func (p *blobPromotion) remove() {
+	p.f.Close()
+	os.Remove(p.f.Name())
+}
+
+// distributionSourceLabels returns the labels containerd uses to record that
+// the blob can be fetched from refspec's repository.
+func distributionSourceLabels(refspec reference.Spec) map[string]string {
+	host := refspec.Hostname()
+	repo := strings.TrimPrefix(refspec.Locator, host+"/")
+	if host == "" || repo == "" {
+		return nil
+	}
+	return map[string]string{distributionSourceLabelPrefix + host: repo}
+}
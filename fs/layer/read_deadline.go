@@ -0,0 +1,159 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/util/bufferpool"
+	"github.com/opencontainers/go-digest"
+)
+
+// Actions of reads which hit the read deadline.
+const (
+	readDeadlineEIO   = "eio"
+	readDeadlineRetry = "retry"
+)
+
+// defaultReadDeadlineRetries is the number of retries of reads which hit the read deadline
+// with the retry action.
+const defaultReadDeadlineRetries = 3
+
+// maxReadDeadlineAttempts bounds the attempts of reads which are in flight at the same
+// time, so that a stuck registry doesn't pile up goroutines and buffers. Once they're
+// all stuck, reads wait for the attempts they've started, or fail at the deadline.
+const maxReadDeadlineAttempts = 256
+
+// errReadDeadline is returned by reads which hit the read deadline.
+var errReadDeadline = errors.New("read deadline exceeded")
+
+// readDeadline bounds how long reads of files wait for their contents to be fetched.
+// FUSE reads can't be interrupted while the snapshotter serves them, so a stuck
+// registry would otherwise leave the reading processes in uninterruptible sleep.
+type readDeadline struct {
+	timeout time.Duration
+	action  string
+	retries int
+	// attempts holds a slot per attempt in flight.
+	attempts chan struct{}
+}
+
+// newReadDeadline returns the read deadline of cfg, or nil if it's disabled.
+func newReadDeadline(cfg config.FuseConfig) *readDeadline {
+	if cfg.ReadDeadlineMsec <= 0 {
+		return nil
+	}
+	d := &readDeadline{
+		timeout:  time.Duration(cfg.ReadDeadlineMsec) * time.Millisecond,
+		action:   cfg.ReadDeadlineAction,
+		retries:  cfg.ReadDeadlineRetries,
+		attempts: make(chan struct{}, maxReadDeadlineAttempts),
+	}
+	if d.action == "" {
+		d.action = readDeadlineEIO
+	}
+	if d.retries == 0 {
+		d.retries = defaultReadDeadlineRetries
+	}
+	return d
+}
+
+type readResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// deadlineRead collects the results of the attempts of a read. The attempts read into
+// pooled buffers, which they put back themselves if they complete after the read returned.
+type deadlineRead struct {
+	mu       sync.Mutex
+	returned bool
+	results  chan readResult
+}
+
+func (r *deadlineRead) attempt(ra io.ReaderAt, size int, off int64, done func()) {
+	defer done()
+	buf := bufferpool.Get(size)
+	n, err := ra.ReadAt(buf, off)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.returned {
+		bufferpool.Put(buf)
+		return
+	}
+	r.results <- readResult{buf: buf, n: n, err: err}
+}
+
+// finish marks the read as returned and puts back the buffers of the attempts which
+// completed without being used.
+func (r *deadlineRead) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.returned = true
+	for {
+		select {
+		case res := <-r.results:
+			bufferpool.Put(res.buf)
+		default:
+			return
+		}
+	}
+}
+
+// readAt reads p at off from ra, the contents of a file of the layer dgst, within the
+// deadline. Reads which hit the deadline keep running in the background, so that they
+// still fetch and cache the contents, and a retried read is served by whichever attempt
+// completes first. A retry only starts another attempt if fewer than
+// maxReadDeadlineAttempts are in flight; otherwise it keeps waiting for its attempts.
+func (d *readDeadline) readAt(ra io.ReaderAt, p []byte, off int64, dgst digest.Digest) (int, error) {
+	if d == nil {
+		return ra.ReadAt(p, off)
+	}
+	attempts := 1
+	if d.action == readDeadlineRetry {
+		attempts += d.retries
+	}
+	// the attempts which hit the deadline must not write to p once it's returned.
+	r := &deadlineRead{results: make(chan readResult, attempts)}
+	defer r.finish()
+	timeout := d.timeout
+	for i := 0; i < attempts; i++ {
+		select {
+		case d.attempts <- struct{}{}:
+			go r.attempt(ra, len(p), off, func() { <-d.attempts })
+		default:
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case res := <-r.results:
+			timer.Stop()
+			n := copy(p, res.buf[:res.n])
+			bufferpool.Put(res.buf)
+			return n, res.err
+		case <-timer.C:
+		}
+		commonmetrics.IncOperationCount(commonmetrics.ReadDeadlineHitCount, dgst)
+		timeout *= 2
+	}
+	return 0, errReadDeadline
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+// stuckReaderAt blocks the first stuck reads until release is closed.
+type stuckReaderAt struct {
+	data    []byte
+	stuck   int32
+	reads   int32
+	release chan struct{}
+}
+
+func (r *stuckReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.AddInt32(&r.reads, 1) <= r.stuck {
+		<-r.release
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestReadDeadline(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name          string
+		cfg           config.FuseConfig
+		stuck         int32
+		expected      []byte
+		expectedReads int32
+		expectedErr   error
+	}{
+		{
+			name:          "disabled",
+			expected:      data[2:6],
+			expectedReads: 1,
+		},
+		{
+			name:          "within the deadline",
+			cfg:           config.FuseConfig{ReadDeadlineMsec: 1000},
+			expected:      data[2:6],
+			expectedReads: 1,
+		},
+		{
+			name:          "eio",
+			cfg:           config.FuseConfig{ReadDeadlineMsec: 10},
+			stuck:         1,
+			expectedReads: 1,
+			expectedErr:   errReadDeadline,
+		},
+		{
+			name:          "retry",
+			cfg:           config.FuseConfig{ReadDeadlineMsec: 10, ReadDeadlineAction: "retry"},
+			stuck:         2,
+			expected:      data[2:6],
+			expectedReads: 3,
+		},
+		{
+			name:          "retries exhausted",
+			cfg:           config.FuseConfig{ReadDeadlineMsec: 10, ReadDeadlineAction: "retry", ReadDeadlineRetries: 1},
+			stuck:         2,
+			expectedReads: 2,
+			expectedErr:   errReadDeadline,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := &stuckReaderAt{data: data, stuck: tt.stuck, release: make(chan struct{})}
+			defer close(ra.release)
+			p := bytes.Repeat([]byte{'x'}, 4)
+			n, err := newReadDeadline(tt.cfg).readAt(ra, p, 2, "sha256:layer")
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("unexpected error: expected %v, got %v", tt.expectedErr, err)
+			}
+			if err == nil && !bytes.Equal(p[:n], tt.expected) {
+				t.Fatalf("unexpected data: expected %q, got %q", tt.expected, p[:n])
+			}
+			if reads := atomic.LoadInt32(&ra.reads); reads != tt.expectedReads {
+				t.Fatalf("expected %d reads, got %d", tt.expectedReads, reads)
+			}
+		})
+	}
+}
+
+func TestReadDeadlineMaxAttempts(t *testing.T) {
+	ra := &stuckReaderAt{data: []byte("0123456789"), stuck: 1, release: make(chan struct{})}
+	d := newReadDeadline(config.FuseConfig{ReadDeadlineMsec: 10, ReadDeadlineAction: "retry", ReadDeadlineRetries: 2})
+	d.attempts = make(chan struct{}, 1)
+
+	// the retries wait for the stuck attempt instead of starting more.
+	p := make([]byte, 4)
+	if _, err := d.readAt(ra, p, 2, "sha256:layer"); !errors.Is(err, errReadDeadline) {
+		t.Fatalf("expected the read to hit the deadline, got %v", err)
+	}
+	if reads := atomic.LoadInt32(&ra.reads); reads != 1 {
+		t.Fatalf("expected a single attempt in flight, got %d reads", reads)
+	}
+	if _, err := d.readAt(ra, p, 2, "sha256:layer"); !errors.Is(err, errReadDeadline) {
+		t.Fatalf("expected the read to hit the deadline without a free attempt, got %v", err)
+	}
+	if reads := atomic.LoadInt32(&ra.reads); reads != 1 {
+		t.Fatalf("expected no attempt without a free slot, got %d reads", reads)
+	}
+
+	// once the stuck attempt completes, its slot is free again.
+	close(ra.release)
+	for start := time.Now(); len(d.attempts) > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("expected the stuck attempt to free its slot")
+		}
+	}
+	if n, err := d.readAt(ra, p, 2, "sha256:layer"); err != nil || !bytes.Equal(p[:n], []byte("2345")) {
+		t.Fatalf("expected the read to succeed, got %q (%v)", p[:n], err)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+)
+
+// defaultReadaheadBytes is how far ahead of sequential reads the contents of a file are fetched.
+const defaultReadaheadBytes = 8 << 20 // 8 MiB
+
+// sequentialReadsThreshold is the number of consecutive sequential reads after which
+// a file is considered to be read sequentially.
+const sequentialReadsThreshold = 2
+
+// prefetcher is implemented by the files of readers which can fetch the contents
+// of a file ahead of reads.
+type prefetcher interface {
+	Prefetch(ctx context.Context, offset, length int64) error
+}
+
+// uncachedReader is implemented by the files of readers which can read the contents
+// of a file without caching them.
+type uncachedReader interface {
+	ReadAtUncached(p []byte, offset int64) (int, error)
+}
+
+// readahead detects sequential reads of a file handle and decides which range to fetch
+// ahead of them. The kernel doesn't pass posix_fadvise to FUSE filesystems, but
+// POSIX_FADV_SEQUENTIAL and POSIX_FADV_WILLNEED result in larger sequential reads
+// by the kernel's readahead, which are detected here.
+type readahead struct {
+	mu         sync.Mutex
+	window     int64
+	next       int64 // the offset following the last read
+	sequential int   // the number of consecutive sequential reads
+	fetched    int64 // the end of the range fetched ahead
+
+	// fetching is true while a goroutine fetches the ranges ahead of the reads.
+	fetching bool
+	// pendingStart and pendingEnd are the range to fetch once the current fetch completes.
+	pendingStart, pendingEnd int64
+}
+
+func newReadahead(window int64) *readahead {
+	if window == 0 {
+		window = defaultReadaheadBytes
+	}
+	if window < 0 {
+		return nil
+	}
+	// The first read is never sequential.
+	return &readahead{window: window, next: -1}
+}
+
+// observe records a read of n bytes at off, and returns the range to fetch ahead of it.
+// ok is false if nothing should be fetched, because the reads aren't sequential or
+// the range ahead is already being fetched.
+func (r *readahead) observe(off, n int64) (start, length int64, ok bool) {
+	if r == nil || n <= 0 {
+		return 0, 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off == r.next {
+		r.sequential++
+	} else {
+		r.sequential = 0
+		r.fetched = 0
+	}
+	r.next = off + n
+	if r.sequential < sequentialReadsThreshold {
+		return 0, 0, false
+	}
+	// Fetch the next window once the reads have consumed half of the current one,
+	// so that fetches stay ahead of the reads.
+	if r.fetched-r.next > r.window/2 {
+		return 0, 0, false
+	}
+	start = r.next
+	if r.fetched > start {
+		start = r.fetched
+	}
+	end := r.next + r.window
+	r.fetched = end
+	return start, end - start, true
+}
+
+// fetch fetches [start, start+length) with p in the background. A file handle reads
+// ahead with at most one goroutine: ranges requested while a fetch is in flight are
+// fetched once it completes, and contiguous ranges are fetched together.
+func (r *readahead) fetch(ctx context.Context, p prefetcher, start, length int64) {
+	r.mu.Lock()
+	if r.fetching {
+		if r.pendingEnd != 0 && start == r.pendingEnd {
+			r.pendingEnd = start + length
+		} else {
+			r.pendingStart, r.pendingEnd = start, start+length
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.fetching = true
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			if err := p.Prefetch(ctx, start, length); err != nil && !errors.Is(err, context.Canceled) {
+				log.G(ctx).WithError(err).Debug("failed to read ahead")
+			}
+			r.mu.Lock()
+			if r.pendingEnd == 0 || ctx.Err() != nil {
+				r.fetching = false
+				r.pendingStart, r.pendingEnd = 0, 0
+				r.mu.Unlock()
+				return
+			}
+			start, length = r.pendingStart, r.pendingEnd-r.pendingStart
+			r.pendingStart, r.pendingEnd = 0, 0
+			r.mu.Unlock()
+		}
+	}()
+}
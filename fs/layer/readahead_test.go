@@ -0,0 +1,152 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestReadahead(t *testing.T) {
+	type read struct {
+		off, n        int64
+		start, length int64
+		ok            bool
+	}
+	tests := []struct {
+		name   string
+		window int64
+		reads  []read
+	}{
+		{
+			name:   "sequential reads are read ahead",
+			window: 100,
+			reads: []read{
+				{off: 0, n: 10},
+				{off: 10, n: 10},
+				{off: 20, n: 10, start: 30, length: 100, ok: true},
+				{off: 30, n: 10},
+				{off: 40, n: 10},
+				{off: 50, n: 10},
+				{off: 60, n: 10},
+				{off: 70, n: 10, start: 130, length: 50, ok: true},
+				{off: 80, n: 10},
+			},
+		},
+		{
+			name:   "random reads aren't read ahead",
+			window: 100,
+			reads: []read{
+				{off: 0, n: 10},
+				{off: 50, n: 10},
+				{off: 10, n: 10},
+				{off: 20, n: 10},
+				{off: 90, n: 10},
+			},
+		},
+		{
+			name:   "seeking restarts detection",
+			window: 100,
+			reads: []read{
+				{off: 0, n: 10},
+				{off: 10, n: 10},
+				{off: 20, n: 10, start: 30, length: 100, ok: true},
+				{off: 500, n: 10},
+				{off: 510, n: 10},
+				{off: 520, n: 10, start: 530, length: 100, ok: true},
+			},
+		},
+		{
+			name:   "disabled",
+			window: -1,
+			reads: []read{
+				{off: 0, n: 10},
+				{off: 10, n: 10},
+				{off: 20, n: 10},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := newReadahead(tt.window)
+			for i, r := range tt.reads {
+				start, length, ok := ra.observe(r.off, r.n)
+				if ok != r.ok || start != r.start || length != r.length {
+					t.Fatalf("read %d at %d: got (%d, %d, %v), want (%d, %d, %v)",
+						i, r.off, start, length, ok, r.start, r.length, r.ok)
+				}
+			}
+		})
+	}
+}
+
+type blockingPrefetcher struct {
+	mu      sync.Mutex
+	ranges  [][2]int64
+	running int
+	max     int
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (p *blockingPrefetcher) Prefetch(ctx context.Context, offset, length int64) error {
+	p.mu.Lock()
+	p.ranges = append(p.ranges, [2]int64{offset, length})
+	p.running++
+	if p.running > p.max {
+		p.max = p.running
+	}
+	p.mu.Unlock()
+	<-p.release
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	p.done <- struct{}{}
+	return nil
+}
+
+func TestReadaheadFetch(t *testing.T) {
+	p := &blockingPrefetcher{release: make(chan struct{}), done: make(chan struct{})}
+	ra := newReadahead(100)
+	ctx := context.Background()
+
+	ra.fetch(ctx, p, 0, 100)
+	// While the first range is fetched, contiguous ranges are coalesced.
+	ra.fetch(ctx, p, 100, 100)
+	ra.fetch(ctx, p, 200, 100)
+
+	for i := 0; i < 2; i++ {
+		p.release <- struct{}{}
+		<-p.done
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	want := [][2]int64{{0, 100}, {100, 200}}
+	if len(p.ranges) != len(want) {
+		t.Fatalf("unexpected fetched ranges: got %v, want %v", p.ranges, want)
+	}
+	for i := range want {
+		if p.ranges[i] != want[i] {
+			t.Fatalf("unexpected fetched ranges: got %v, want %v", p.ranges, want)
+		}
+	}
+	if p.max != 1 {
+		t.Fatalf("expected at most 1 concurrent fetch, got %d", p.max)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RemoveStaleFiles removes the files left under root, the root directory of a Resolver,
+// by a previous run which didn't shut down cleanly: the caches of layers, which are
+// created anew whenever a layer is resolved, the copies of promoted layers, and the
+// incomplete files of the chunk cache and of seeded spans. It must be called before the
+// Resolver is created. It returns the removed paths.
+func RemoveStaleFiles(root string) ([]string, error) {
+	var removed []string
+	for _, dir := range []string{spanCacheDir, httpCacheDir} {
+		// caches are sharded by the digest of the layer.
+		shards, err := readDirIfExists(filepath.Join(root, dir))
+		if err != nil {
+			return removed, err
+		}
+		for _, shard := range shards {
+			shardPath := filepath.Join(root, dir, shard.Name())
+			if !shard.IsDir() {
+				continue
+			}
+			caches, err := readDirIfExists(shardPath)
+			if err != nil {
+				return removed, err
+			}
+			for _, c := range caches {
+				p := filepath.Join(shardPath, c.Name())
+				if err := os.RemoveAll(p); err != nil {
+					return removed, err
+				}
+				removed = append(removed, p)
+			}
+			os.Remove(shardPath)
+		}
+	}
+	// the chunk cache is kept across restarts, but it writes incomplete chunks to its
+	// "wip" directory.
+	for _, dir := range []string{promoteDir, filepath.Join(chunkCacheDir, "wip")} {
+		entries, err := readDirIfExists(filepath.Join(root, dir))
+		if err != nil {
+			return removed, err
+		}
+		for _, e := range entries {
+			p := filepath.Join(root, dir, e.Name())
+			if err := os.RemoveAll(p); err != nil {
+				return removed, err
+			}
+			removed = append(removed, p)
+		}
+	}
+	err := filepath.WalkDir(filepath.Join(root, spanSeedDir), func(p string, d iofs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && strings.HasPrefix(d.Name(), "wip-") {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			removed = append(removed, p)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func readDirIfExists(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Spans imported for layers which aren't resolved yet are kept in the span seed directory,
+// keyed by layer digest and ztoc digest. The ztoc determines the span size and span boundaries,
+// so seeded spans are only used by layers which are lazily loaded with the same ztoc.
+const spanSeedDir = "spanseed"
+
+func (r *Resolver) spanSeedPath(layerDigest, ztocDigest digest.Digest) string {
+	return filepath.Join(r.rootDir, spanSeedDir,
+		layerDigest.Algorithm().String(), layerDigest.Encoded(),
+		ztocDigest.Algorithm().String(), ztocDigest.Encoded())
+}
+
+// spanSeedID is the ID a seeded span is encrypted with, so that seeded spans can't be
+// moved between spans or layers.
+func spanSeedID(layerDigest, ztocDigest digest.Digest, spanID compression.SpanID) string {
+	return fmt.Sprintf("%s/%s/%d", layerDigest, ztocDigest, spanID)
+}
+
+// SeedSpan stores the compressed contents of a span, as exported by Layer.ExportSpans,
+// so that the span is imported into the cache of the layer when the layer is resolved.
+func (r *Resolver) SeedSpan(layerDigest, ztocDigest digest.Digest, spanID compression.SpanID, compressed []byte) error {
+	if err := layerDigest.Validate(); err != nil {
+		return fmt.Errorf("invalid layer digest: %w", err)
+	}
+	if err := ztocDigest.Validate(); err != nil {
+		return fmt.Errorf("invalid ztoc digest: %w", err)
+	}
+	if r.cipher != nil {
+		var err error
+		compressed, err = r.cipher.Encrypt(compressed, spanSeedID(layerDigest, ztocDigest, spanID))
+		if err != nil {
+			return err
+		}
+	}
+	dir := r.spanSeedPath(layerDigest, ztocDigest)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "wip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(compressed); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, strconv.FormatInt(int64(spanID), 10)))
+}
+
+// importSeededSpans imports the seeded spans of a layer into its span manager and removes
+// them, since they are in the cache of the layer from then on. Spans which fail verification
+// are discarded; they'll be fetched from the registry on demand.
+func (r *Resolver) importSeededSpans(ctx context.Context, layerDigest, ztocDigest digest.Digest, m *spanmanager.SpanManager) {
+	dir := r.spanSeedPath(layerDigest, ztocDigest)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.G(ctx).WithError(err).Warn("failed to read seeded spans")
+		}
+		return
+	}
+	var imported int
+	for _, e := range entries {
+		id, err := strconv.ParseInt(e.Name(), 10, 32)
+		if err != nil || id < 0 {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		b, err := os.ReadFile(p)
+		if err == nil && r.cipher != nil {
+			b, err = r.cipher.Decrypt(b, spanSeedID(layerDigest, ztocDigest, compression.SpanID(id)))
+		}
+		if err == nil {
+			err = m.ImportSpan(compression.SpanID(id), b)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("span", id).Warn("discarding seeded span")
+			continue
+		}
+		imported++
+	}
+	log.G(ctx).WithField("spans", imported).Debug("imported seeded spans")
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to remove seeded spans")
+	}
+	// remove the directories of the layer too, unless they have seeds for other ztocs.
+	if os.Remove(filepath.Dir(dir)) == nil {
+		os.Remove(filepath.Dir(filepath.Dir(dir)))
+	}
+}
+
+func (l *layer) ExportSpans(ctx context.Context, fn func(spanID compression.SpanID, compressed []byte) error) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.ExportSpans(func(spanID compression.SpanID, compressed []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(spanID, compressed)
+	})
+}
+
+func (l *layer) ImportSpan(spanID compression.SpanID, compressed []byte) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	return l.spanManager.ImportSpan(spanID, compressed)
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func (l *layer) Cached() bool {
+	if l.isClosed() {
+		return false
+	}
+	for id := compression.SpanID(0); id <= l.spanManager.MaxSpanID(); id++ {
+		if !l.spanManager.IsCached(id) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *layer) Uncompressed(ctx context.Context) (io.Reader, error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	// the contents are written to disk by whoever reads them, so the uncompressed spans
+	// aren't cached as well.
+	return l.spanManager.GetContents(ctx, 0, compression.Offset(l.uncompressedSize),
+		spanmanager.SkipCache(), spanmanager.SkipReadStats())
+}
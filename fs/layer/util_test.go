@@ -54,6 +54,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
@@ -265,7 +266,7 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 			},
 			want: []check{
 				hasOpaque("foo/"),
-				hasNodeXattrs("foo/", "SCHILY.xattr.foo", "bar"),
+				hasNodeXattrs("foo/", "foo", "bar"),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
@@ -363,7 +364,7 @@ func hasSize(name string, size int) check {
 }
 
 func getRootNode(t *testing.T, r reader.Reader, opaque OverlayOpaqueType) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, false, nil)
+	rootNode, err := newNode(context.Background(), testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, false, nil, nil, config.FuseConfig{})
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -600,7 +601,7 @@ func hasStateFile(t *testing.T, id string) check {
 		wantErr := fmt.Errorf("test-%d", rand.Int63())
 
 		// report the data
-		root.fs.s.report(wantErr)
+		root.fs.s.report(fuseOpFileRead, wantErr)
 
 		// obtain file size (check later)
 		var ao fuse.AttrOut
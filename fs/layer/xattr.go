@@ -0,0 +1,193 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// paxSchilyXattr is the prefix of the PAX records which hold extended attributes.
+	paxSchilyXattr = "SCHILY.xattr."
+	// paxSchilyACLAccess and paxSchilyACLDefault are the PAX records which hold
+	// POSIX ACLs in their text form (e.g. written by GNU tar and star with --acls).
+	paxSchilyACLAccess  = "SCHILY.acl.access"
+	paxSchilyACLDefault = "SCHILY.acl.default"
+
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// Tags, permissions and version of the binary POSIX ACL xattr format (linux/posix_acl_xattr.h).
+const (
+	aclVersion     = 0x0002
+	aclUndefinedID = 0xffffffff
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclRead    = 0x04
+	aclWrite   = 0x02
+	aclExecute = 0x01
+)
+
+// xattrsFromPAXRecords returns the extended attributes of a node from the PAX records
+// of its tar header, in the same way overlayfs snapshotters apply them when unpacking
+// the layer. ACLs in text form are converted to the binary POSIX ACL xattrs. ACLs
+// which were stored as xattrs take precedence.
+func xattrsFromPAXRecords(records map[string][]byte) map[string][]byte {
+	xattrs := make(map[string][]byte)
+	for k, v := range records {
+		if name := strings.TrimPrefix(k, paxSchilyXattr); name != k && name != "" {
+			xattrs[name] = v
+		}
+	}
+	for record, name := range map[string]string{
+		paxSchilyACLAccess:  xattrACLAccess,
+		paxSchilyACLDefault: xattrACLDefault,
+	} {
+		text, ok := records[record]
+		if _, exists := xattrs[name]; !ok || exists {
+			continue
+		}
+		// ACLs which can't be converted are left out rather than served partially,
+		// which could grant more access than the layer intended.
+		if acl, err := aclFromText(string(text)); err == nil {
+			xattrs[name] = acl
+		}
+	}
+	return xattrs
+}
+
+// xattrNames returns the sorted names of xattrs.
+func xattrNames(xattrs map[string][]byte) []string {
+	names := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// aclFromText converts an ACL in the long or short text form of acl(5)
+// (e.g. "user::rw-,user:1000:r--,group::r--,mask::r--,other::---") to the binary
+// POSIX ACL xattr format. Named entries must have a numeric ID, either as the
+// qualifier or as the fourth field which star appends to names.
+func aclFromText(text string) ([]byte, error) {
+	var entries []aclEntry
+	for _, e := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.IndexByte(e, '#'); i >= 0 {
+			e = e[:i]
+		}
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		fields := strings.Split(e, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", e)
+		}
+		perm, err := aclPerm(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry %q: %w", e, err)
+		}
+		entry := aclEntry{perm: perm, id: aclUndefinedID}
+		qualified := fields[1] != ""
+		switch fields[0] {
+		case "user", "u":
+			entry.tag = aclUserObj
+			if qualified {
+				entry.tag = aclUser
+			}
+		case "group", "g":
+			entry.tag = aclGroupObj
+			if qualified {
+				entry.tag = aclGroup
+			}
+		case "mask", "m":
+			entry.tag = aclMask
+		case "other", "o":
+			entry.tag = aclOther
+		default:
+			return nil, fmt.Errorf("invalid ACL entry %q: unknown tag", e)
+		}
+		if qualified {
+			id := fields[1]
+			if len(fields) == 4 {
+				id = fields[3]
+			}
+			n, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACL entry %q: no numeric ID", e)
+			}
+			entry.id = uint32(n)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty ACL")
+	}
+	// The kernel requires the entries to be ordered by tag and ID.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	buf := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	for i, e := range entries {
+		b := buf[4+8*i:]
+		binary.LittleEndian.PutUint16(b, e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+	}
+	return buf, nil
+}
+
+// aclPerm parses the permissions of an ACL entry, e.g. "r-x" or "rx".
+func aclPerm(s string) (uint16, error) {
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= aclRead
+		case 'w':
+			perm |= aclWrite
+		case 'x':
+			perm |= aclExecute
+		case '-':
+		default:
+			return 0, fmt.Errorf("invalid permission %q", s)
+		}
+	}
+	return perm, nil
+}
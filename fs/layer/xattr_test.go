@@ -0,0 +1,128 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func aclBytes(entries ...aclEntry) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(aclVersion))
+	for _, e := range entries {
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+func TestXattrsFromPAXRecords(t *testing.T) {
+	accessACL := aclBytes(
+		aclEntry{aclUserObj, aclRead | aclWrite, aclUndefinedID},
+		aclEntry{aclUser, aclRead, 1000},
+		aclEntry{aclGroupObj, aclRead, aclUndefinedID},
+		aclEntry{aclMask, aclRead, aclUndefinedID},
+		aclEntry{aclOther, 0, aclUndefinedID},
+	)
+	tests := []struct {
+		name     string
+		records  map[string][]byte
+		expected map[string][]byte
+	}{
+		{
+			name: "xattrs",
+			records: map[string][]byte{
+				"SCHILY.xattr.user.foo":                  []byte("bar"),
+				"SCHILY.xattr.system.posix_acl_access":   accessACL,
+				"SCHILY.xattr.security.capability":       []byte{1, 2},
+				"mtime":                                  []byte("1600000000"),
+				"SCHILY.xattr.":                          []byte("empty name"),
+				"LIBARCHIVE.xattr.user.not-a-schily-one": []byte("x"),
+			},
+			expected: map[string][]byte{
+				"user.foo":                []byte("bar"),
+				"system.posix_acl_access": accessACL,
+				"security.capability":     {1, 2},
+			},
+		},
+		{
+			name: "text ACLs",
+			records: map[string][]byte{
+				"SCHILY.acl.access":  []byte("user::rw-,group::r--,mask::r--,other::---,user:1000:r--"),
+				"SCHILY.acl.default": []byte("user::rwx\ngroup::r-x # comment\nother::r-x\n"),
+			},
+			expected: map[string][]byte{
+				"system.posix_acl_access": accessACL,
+				"system.posix_acl_default": aclBytes(
+					aclEntry{aclUserObj, aclRead | aclWrite | aclExecute, aclUndefinedID},
+					aclEntry{aclGroupObj, aclRead | aclExecute, aclUndefinedID},
+					aclEntry{aclOther, aclRead | aclExecute, aclUndefinedID},
+				),
+			},
+		},
+		{
+			name: "star ACL with names and IDs",
+			records: map[string][]byte{
+				"SCHILY.acl.access": []byte("user::rw-,user:alice:r--:1000,group::r--,mask::r--,other::---"),
+			},
+			expected: map[string][]byte{
+				"system.posix_acl_access": accessACL,
+			},
+		},
+		{
+			name: "xattr ACL takes precedence",
+			records: map[string][]byte{
+				"SCHILY.xattr.system.posix_acl_access": accessACL,
+				"SCHILY.acl.access":                    []byte("user::rwx,group::rwx,other::rwx"),
+			},
+			expected: map[string][]byte{
+				"system.posix_acl_access": accessACL,
+			},
+		},
+		{
+			name: "ACL with names only is left out",
+			records: map[string][]byte{
+				"SCHILY.acl.access": []byte("user::rw-,user:alice:r--,group::r--,mask::r--,other::---"),
+			},
+			expected: map[string][]byte{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := xattrsFromPAXRecords(tt.records)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestACLFromTextInvalid(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"user::rwz",
+		"owner::rw-",
+		"user:1000",
+		"user:1000:r--:1:2",
+	} {
+		if _, err := aclFromText(text); err == nil {
+			t.Errorf("expected %q to be invalid", text)
+		}
+	}
+}
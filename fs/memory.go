@@ -0,0 +1,333 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/containerd/containerd/log"
+)
+
+// defaultMemoryBudgetCheckInterval is how often the memory usage is checked against the budget.
+const defaultMemoryBudgetCheckInterval = 10 * time.Second
+
+const (
+	memoryTypeCache   = "cache"
+	memoryTypeZtoc    = "ztoc"
+	memoryTypeProcess = "process"
+
+	memoryActionShed  = "shed"
+	memoryActionEvict = "evict"
+)
+
+var (
+	procSelfCgroup = "/proc/self/cgroup"
+	procMeminfo    = "/proc/meminfo"
+	cgroupRoot     = "/sys/fs/cgroup"
+)
+
+// memoryUsage is the memory used by the snapshotter.
+type memoryUsage struct {
+	// cacheBytes is the memory used by the in-memory data caches of layers.
+	cacheBytes int64
+	// ztocBytes is the estimated memory used by the ztocs of the cached layers.
+	ztocBytes int64
+	// processBytes is the working set of the snapshotter's cgroup, or of the node if
+	// it's not in a memory cgroup. 0 if it can't be measured.
+	processBytes int64
+	// limitBytes is the memory the snapshotter can use before it's OOM-killed.
+	limitBytes int64
+}
+
+// memoryTracker measures the memory used by the snapshotter, and drops its in-memory
+// caches and evicts layers when it exceeds the budget or the watermark.
+type memoryTracker struct {
+	budget           int64
+	watermarkPercent int
+	cacheUsage       func() int64
+	ztocUsage        func() int64
+	// processUsage returns the working set and the memory limit of the snapshotter.
+	processUsage func() (int64, int64, error)
+	// shed drops the in-memory data caches.
+	shed func()
+	// leastRecentlyUsed and evict are the same as usageTracker's.
+	leastRecentlyUsed func() (string, []string, bool)
+	evict             func(string) bool
+	// freeOSMemory returns the memory freed by the dropped caches to the OS.
+	freeOSMemory func()
+
+	enforceMu sync.Mutex // serializes enforcing the budget
+}
+
+func (t *memoryTracker) usage(ctx context.Context) memoryUsage {
+	u := memoryUsage{cacheBytes: t.cacheUsage(), ztocBytes: t.ztocUsage()}
+	if t.processUsage != nil {
+		var err error
+		if u.processBytes, u.limitBytes, err = t.processUsage(); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to measure process memory")
+		}
+	}
+	return u
+}
+
+func (t *memoryTracker) overBudget(u memoryUsage) bool {
+	return t.budget > 0 && u.cacheBytes+u.ztocBytes > t.budget
+}
+
+func (t *memoryTracker) overWatermark(u memoryUsage) bool {
+	return t.watermarkPercent > 0 && u.limitBytes > 0 &&
+		u.processBytes > u.limitBytes/100*int64(t.watermarkPercent)
+}
+
+// enforce drops the in-memory caches when the caches exceed the budget or the
+// snapshotter's memory exceeds the watermark. If that isn't enough, it evicts the
+// least recently used layers which aren't mounted, which releases their ztocs, until
+// it's within both or there's nothing left to evict.
+func (t *memoryTracker) enforce(ctx context.Context) (memoryUsage, int) {
+	t.enforceMu.Lock()
+	defer t.enforceMu.Unlock()
+	u := t.usage(ctx)
+	if !t.overBudget(u) && !t.overWatermark(u) {
+		return u, 0
+	}
+	log.G(ctx).WithField("cache", u.cacheBytes).WithField("ztoc", u.ztocBytes).
+		WithField("process", u.processBytes).WithField("limit", u.limitBytes).
+		Info("dropping in-memory caches because of memory pressure")
+	t.shed()
+	commonmetrics.IncMemoryPressureEvents(memoryActionShed)
+	if t.overWatermark(u) {
+		t.freeOSMemory()
+	}
+	u = t.usage(ctx)
+	evicted := 0
+	for t.overBudget(u) || t.overWatermark(u) {
+		name, _, ok := t.leastRecentlyUsed()
+		if !ok {
+			log.G(ctx).WithField("cache", u.cacheBytes).WithField("ztoc", u.ztocBytes).
+				WithField("process", u.processBytes).WithField("limit", u.limitBytes).
+				Warn("memory exceeds the budget but all layers are in use")
+			break
+		}
+		if !t.evict(name) {
+			continue
+		}
+		evicted++
+		commonmetrics.IncMemoryPressureEvents(memoryActionEvict)
+		if t.overWatermark(u) {
+			t.freeOSMemory()
+		}
+		u = t.usage(ctx)
+	}
+	return u, evicted
+}
+
+// run periodically reports the memory usage and enforces the budget until ctx is done.
+func (t *memoryTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		u, _ := t.enforce(ctx)
+		commonmetrics.SetMemoryUsage(memoryTypeCache, u.cacheBytes)
+		commonmetrics.SetMemoryUsage(memoryTypeZtoc, u.ztocBytes)
+		commonmetrics.SetMemoryUsage(memoryTypeProcess, u.processBytes)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processMemory returns the working set and the memory limit of the snapshotter's
+// memory cgroup. The working set doesn't include the inactive page cache, since the
+// kernel reclaims it before OOM-killing. If the snapshotter isn't in a memory cgroup
+// or the cgroup has no limit, the node's memory is used.
+func processMemory() (int64, int64, error) {
+	total, available, err := nodeMemory()
+	if err != nil {
+		return 0, 0, err
+	}
+	usage, limit, ok, err := cgroupMemory()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		return total - available, total, nil
+	}
+	if limit <= 0 || limit > total {
+		limit = total
+	}
+	return usage, limit, nil
+}
+
+// cgroupMemory returns the working set and the memory limit of the snapshotter's
+// cgroup. The limit is 0 if there's none. It returns false if the snapshotter isn't
+// in a memory cgroup.
+func cgroupMemory() (int64, int64, bool, error) {
+	f, err := os.Open(procSelfCgroup)
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// lines look like "<id>:<controllers>:<path>", where cgroup v2 has id 0 and
+		// no controllers.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			dir := cgroupDir(cgroupRoot, fields[2], "memory.max")
+			if dir == "" {
+				continue
+			}
+			return readCgroupMemory(dir, "memory.current", "memory.max", "inactive_file")
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c != "memory" {
+				continue
+			}
+			dir := cgroupDir(filepath.Join(cgroupRoot, "memory"), fields[2], "memory.limit_in_bytes")
+			if dir == "" {
+				continue
+			}
+			return readCgroupMemory(dir, "memory.usage_in_bytes", "memory.limit_in_bytes", "total_inactive_file")
+		}
+	}
+	return 0, 0, false, scanner.Err()
+}
+
+// cgroupDir returns the directory of the cgroup path under root which has file. If the
+// cgroup namespace of the snapshotter differs from the mount's, the path isn't under
+// root and root itself is the snapshotter's cgroup. It returns "" if there's no such
+// directory.
+func cgroupDir(root, path, file string) string {
+	for _, dir := range []string{filepath.Join(root, path), root} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+func readCgroupMemory(dir, usageFile, limitFile, inactiveKey string) (int64, int64, bool, error) {
+	usage, err := readCgroupValue(filepath.Join(dir, usageFile))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	limit, err := readCgroupValue(filepath.Join(dir, limitFile))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	stat, err := readKeyValues(filepath.Join(dir, "memory.stat"), " ")
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if inactive := stat[inactiveKey]; inactive < usage {
+		usage -= inactive
+	}
+	return usage, limit, true, nil
+}
+
+// readCgroupValue reads a value of a cgroup file, which is 0 if it's "max".
+func readCgroupValue(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	return v, nil
+}
+
+// nodeMemory returns the total and available memory of the node.
+func nodeMemory() (int64, int64, error) {
+	info, err := readKeyValues(procMeminfo, ":")
+	if err != nil {
+		return 0, 0, err
+	}
+	total, ok := info["MemTotal"]
+	if !ok {
+		return 0, 0, fmt.Errorf("no MemTotal in %s", procMeminfo)
+	}
+	// values are in kB.
+	return total * 1024, info["MemAvailable"] * 1024, nil
+}
+
+// readKeyValues reads a file of lines of a key, sep and a number, e.g. memory.stat
+// or /proc/meminfo. Trailing units of the numbers are ignored.
+func readKeyValues(path, sep string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), sep)
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSpace(key)] = v
+	}
+	return values, scanner.Err()
+}
+
+// newMemoryTracker returns the memory tracker of the filesystem.
+func newMemoryTracker(budget int64, watermarkPercent int, ztocUsage func() int64,
+	leastRecentlyUsed func() (string, []string, bool), evict func(string) bool) *memoryTracker {
+	return &memoryTracker{
+		budget:            budget,
+		watermarkPercent:  watermarkPercent,
+		cacheUsage:        cache.MemoryUsage,
+		ztocUsage:         ztocUsage,
+		processUsage:      processMemory,
+		shed:              cache.ShedMemory,
+		leastRecentlyUsed: leastRecentlyUsed,
+		evict:             evict,
+		freeOSMemory:      debug.FreeOSMemory,
+	}
+}
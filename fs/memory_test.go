@@ -0,0 +1,225 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnforceMemoryBudget(t *testing.T) {
+	const (
+		ztocSize  = 1024
+		cacheSize = 4096
+		limit     = 100 * 1024
+	)
+	tests := []struct {
+		name             string
+		layers           int
+		mounted          int
+		budget           int64
+		watermarkPercent int
+		// process is the memory of the process besides the caches and the ztocs.
+		process         int64
+		expectedShed    bool
+		expectedEvicted int
+	}{
+		{
+			name:   "no budget",
+			layers: 4,
+		},
+		{
+			name:   "within budget",
+			layers: 4,
+			budget: cacheSize + 4*ztocSize,
+		},
+		{
+			name:         "shedding the caches is enough",
+			layers:       4,
+			budget:       4 * ztocSize,
+			expectedShed: true,
+		},
+		{
+			name:            "over budget without the caches",
+			layers:          4,
+			budget:          2 * ztocSize,
+			expectedShed:    true,
+			expectedEvicted: 2,
+		},
+		{
+			name:            "mounted layers aren't evicted",
+			layers:          4,
+			mounted:         3,
+			budget:          2 * ztocSize,
+			expectedShed:    true,
+			expectedEvicted: 1,
+		},
+		{
+			name:             "below the watermark",
+			layers:           4,
+			watermarkPercent: 90,
+			process:          limit / 2,
+		},
+		{
+			name:             "above the watermark",
+			layers:           4,
+			watermarkPercent: 50,
+			process:          limit/2 - 2*ztocSize,
+			expectedShed:     true,
+			expectedEvicted:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers := tt.layers
+			var cache int64 = cacheSize
+			shed, freed := false, 0
+			tracker := &memoryTracker{
+				budget:           tt.budget,
+				watermarkPercent: tt.watermarkPercent,
+				cacheUsage:       func() int64 { return cache },
+				ztocUsage:        func() int64 { return int64(layers) * ztocSize },
+				processUsage: func() (int64, int64, error) {
+					return tt.process + cache + int64(layers)*ztocSize, limit, nil
+				},
+				shed: func() {
+					shed = true
+					cache = 0
+				},
+				leastRecentlyUsed: func() (string, []string, bool) {
+					if layers <= tt.mounted {
+						return "", nil, false
+					}
+					return "layer", nil, true
+				},
+				evict: func(string) bool {
+					layers--
+					return true
+				},
+				freeOSMemory: func() { freed++ },
+			}
+			u, evicted := tracker.enforce(context.Background())
+			if shed != tt.expectedShed {
+				t.Fatalf("unexpected shedding; expected %v, got %v", tt.expectedShed, shed)
+			}
+			if evicted != tt.expectedEvicted {
+				t.Fatalf("unexpected number of evicted layers; expected %d, got %d", tt.expectedEvicted, evicted)
+			}
+			if u.ztocBytes != int64(layers)*ztocSize || u.cacheBytes != cache {
+				t.Fatalf("unexpected usage %+v", u)
+			}
+			if tt.watermarkPercent == 0 && freed > 0 {
+				t.Fatalf("memory is returned to the OS without a watermark")
+			}
+		})
+	}
+}
+
+func TestCgroupMemory(t *testing.T) {
+	tests := []struct {
+		name          string
+		cgroup        string
+		files         map[string]string
+		expectedOK    bool
+		expectedUsage int64
+		expectedLimit int64
+	}{
+		{
+			name:   "cgroup v2",
+			cgroup: "0::/system.slice/soci.service\n",
+			files: map[string]string{
+				"system.slice/soci.service/memory.current": "1000\n",
+				"system.slice/soci.service/memory.max":     "4000\n",
+				"system.slice/soci.service/memory.stat":    "anon 600\ninactive_file 300\n",
+			},
+			expectedOK:    true,
+			expectedUsage: 700,
+			expectedLimit: 4000,
+		},
+		{
+			name:   "cgroup v2 without a limit",
+			cgroup: "0::/system.slice/soci.service\n",
+			files: map[string]string{
+				"system.slice/soci.service/memory.current": "1000\n",
+				"system.slice/soci.service/memory.max":     "max\n",
+				"system.slice/soci.service/memory.stat":    "inactive_file 0\n",
+			},
+			expectedOK:    true,
+			expectedUsage: 1000,
+		},
+		{
+			name:   "cgroup v2 in a cgroup namespace",
+			cgroup: "0::/\n",
+			files: map[string]string{
+				"memory.current": "1000\n",
+				"memory.max":     "4000\n",
+				"memory.stat":    "inactive_file 100\n",
+			},
+			expectedOK:    true,
+			expectedUsage: 900,
+			expectedLimit: 4000,
+		},
+		{
+			name:   "cgroup v1",
+			cgroup: "5:cpu,cpuacct:/soci\n4:memory:/soci\n",
+			files: map[string]string{
+				"memory/soci/memory.usage_in_bytes": "2000\n",
+				"memory/soci/memory.limit_in_bytes": "8000\n",
+				"memory/soci/memory.stat":           "cache 500\ntotal_inactive_file 500\n",
+			},
+			expectedOK:    true,
+			expectedUsage: 1500,
+			expectedLimit: 8000,
+		},
+		{
+			name:   "root cgroup v2",
+			cgroup: "0::/\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			defer func(cgroup, r string) { procSelfCgroup, cgroupRoot = cgroup, r }(procSelfCgroup, cgroupRoot)
+			procSelfCgroup = filepath.Join(root, "cgroup")
+			cgroupRoot = filepath.Join(root, "sys")
+			writeMemoryFile(t, procSelfCgroup, tt.cgroup)
+			for name, content := range tt.files {
+				writeMemoryFile(t, filepath.Join(cgroupRoot, name), content)
+			}
+			usage, limit, ok, err := cgroupMemory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.expectedOK || usage != tt.expectedUsage || limit != tt.expectedLimit {
+				t.Fatalf("unexpected cgroup memory; expected %d/%d (%v), got %d/%d (%v)",
+					tt.expectedUsage, tt.expectedLimit, tt.expectedOK, usage, limit, ok)
+			}
+		})
+	}
+}
+
+func writeMemoryFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -56,6 +56,67 @@ const (
 	// ImageOperationCountKey is the key for any metric related to operation count metric at the image level (as opposed to layer).
 	ImageOperationCountKey = "image_operation_count_key"
 
+	// LayerReadStatsKey is the key for the read amplification counters of a layer.
+	LayerReadStatsKey = "layer_read_stats"
+
+	// LayerReadAmplificationKey is the key for the read amplification ratios of a layer.
+	LayerReadAmplificationKey = "layer_read_amplification"
+
+	// ReadSourceBytesKey is the key for the bytes served to the reads of a layer by the source
+	// that satisfied them.
+	ReadSourceBytesKey = "read_source_bytes"
+
+	// ReadSourceRatioKey is the key for the share of the bytes served to the reads of a layer
+	// by each source.
+	ReadSourceRatioKey = "read_source_ratio"
+
+	// RemoteSourceBytesKey is the key for the compressed bytes of a layer fetched from each remote source.
+	RemoteSourceBytesKey = "remote_source_bytes"
+
+	// DBFileSizeKey is the key for the size of the snapshotter's bolt DB files.
+	DBFileSizeKey = "db_file_size_bytes"
+
+	// DBCompactionCountKey is the key for the number of times the snapshotter's bolt DBs are compacted.
+	DBCompactionCountKey = "db_compaction_count"
+
+	// DBTransactionLatencyKey is the key for the duration of the transactions of the bolt DBs.
+	DBTransactionLatencyKey = "db_transaction_duration_milliseconds"
+
+	// DBPageAllocationsKey is the key for the number of pages allocated by the bolt DBs.
+	DBPageAllocationsKey = "db_page_allocations"
+
+	// DBPageAllocBytesKey is the key for the bytes of the pages allocated by the bolt DBs.
+	DBPageAllocBytesKey = "db_page_alloc_bytes"
+
+	// DBOpenCountKey is the key for the number of open bolt DBs.
+	DBOpenCountKey = "db_open_count"
+
+	// DecompressionQueueDepthKey is the key for the number of spans waiting to be uncompressed.
+	DecompressionQueueDepthKey = "decompression_queue_depth"
+
+	// FIPSModeKey is the key for whether the snapshotter uses FIPS 140 validated crypto.
+	FIPSModeKey = "fips_mode"
+
+	// DiskUsageKey is the key for the disk space used by the snapshotter.
+	DiskUsageKey = "disk_usage_bytes"
+
+	// DiskBudgetEvictionsKey is the key for the number of layers whose caches were evicted
+	// to stay within the disk budget.
+	DiskBudgetEvictionsKey = "disk_budget_evictions"
+
+	// MemoryUsageKey is the key for the memory used by the snapshotter.
+	MemoryUsageKey = "memory_usage_bytes"
+
+	// MemoryPressureEventsKey is the key for the number of times the caches were shed
+	// or layers evicted because of memory pressure.
+	MemoryPressureEventsKey = "memory_pressure_events"
+
+	// SnapshotterOperationLatencyKey is the key for the latency of the snapshotter's gRPC operations.
+	SnapshotterOperationLatencyKey = "snapshotter_operation_latency_milliseconds"
+
+	// SnapshotterOperationErrorsKey is the key for the number of failed gRPC operations of the snapshotter.
+	SnapshotterOperationErrorsKey = "snapshotter_operation_errors"
+
 	// Keep namespace as soci and subsystem as fs.
 	namespace = "soci"
 	subsystem = "fs"
@@ -64,12 +125,13 @@ const (
 // Lists all metric labels.
 const (
 	// prometheus metrics
-	Mount             = "mount"
-	RemoteRegistryGet = "remote_registry_get"
-	NodeReaddir       = "node_readdir"
-	InitMetadataStore = "init_metadata_store"
-	SynchronousRead   = "synchronous_read"
-	BackgroundFetch   = "background_fetch"
+	Mount              = "mount"
+	RemoteRegistryGet  = "remote_registry_get"
+	NodeReaddir        = "node_readdir"
+	InitMetadataStore  = "init_metadata_store"
+	SynchronousRead    = "synchronous_read"
+	BackgroundFetch    = "background_fetch"
+	MountHydrationWait = "mount_hydration_wait"
 
 	SynchronousReadCount              = "synchronous_read_count"
 	SynchronousReadRegistryFetchCount = "synchronous_read_remote_registry_fetch_count" // TODO revisit (wrong place)
@@ -93,20 +155,95 @@ const (
 	// Note that a layer not having a ztoc is NOT classified as an error, even though `fs.Mount` returns an error in that case.
 	FuseMountFailureCount = "fuse_mount_failure_count"
 
+	// Number of times fetching the SOCI artifacts of an image, which failed before, succeeded
+	// or failed again once the failure expired
+	FallbackRetrySuccessCount = "fallback_retry_success_count"
+	FallbackRetryFailureCount = "fallback_retry_failure_count"
+
+	// Number of times Mount timed out waiting for the prioritized spans of a layer to be cached
+	MountHydrationTimeoutCount = "mount_hydration_timeout_count"
+
+	// Number of times reads of files hit the read deadline waiting for their contents to be fetched
+	ReadDeadlineHitCount = "read_deadline_hit_count"
+
 	// Number of errors of span fetch by background fetcher
 	BackgroundSpanFetchFailureCount = "background_span_fetch_failure_count"
 
 	// Number of spans fetched by background fetcher
 	BackgroundSpanFetchCount = "background_span_fetch_count"
 
+	// Number of layers whose digest is verified once they're fully fetched by background fetcher
+	BackgroundLayerVerifiedCount = "background_layer_verified_count"
+
+	// Number of layers whose digest doesn't match once they're fully fetched by background fetcher
+	BackgroundLayerVerificationFailureCount = "background_layer_verification_failure_count"
+
+	// Number of file chunks served from the chunk cache shared by layers
+	FileChunkCacheHitCount = "file_chunk_cache_hit_count"
+
+	// Number of layers written into containerd's content store once they're verified
+	BlobPromotionCount = "blob_promotion_count"
+
+	// Number of layers that failed to be written into containerd's content store
+	BlobPromotionFailureCount = "blob_promotion_failure_count"
+
+	// Number of fetches answered with the whole layer because the registry ignored the range requested
+	RangeIgnoredCount = "range_ignored_count"
+
 	// Number of items in the work queue of background fetcher
 	BackgroundFetchWorkQueueSize = "background_fetch_work_queue_size"
+
+	// Number of times span caching was paused because the cache volume was full or failing
+	DiskPressure = "disk_pressure"
+
+	// Number of cached spans discarded because their contents don't match their digest
+	SpanCacheVerificationFailureCount = "span_cache_verification_failure_count"
+
+	// Time spent waiting for a decompression slot before a span is uncompressed
+	DecompressionWait = "decompression_wait"
+
+	// Time spent waiting for a fetch slot before fetching from a remote registry
+	FetchSchedulerWait = "fetch_scheduler_wait"
+
+	// layer read stats
+	ReadStatsBytesFetched = "bytes_fetched"
+	ReadStatsBytesServed  = "bytes_served"
+	ReadStatsSpansFetched = "spans_fetched"
+	ReadStatsSpansTouched = "spans_touched"
+
+	// layer read amplification ratios
+	ReadAmplificationBytes = "bytes" // bytes fetched from the registry / bytes served to the application
+	ReadAmplificationSpans = "spans" // spans fetched from the registry / spans touched by the application
+
+	// sources that satisfy the reads of a layer
+	ReadSourceChunkCache = "chunk_cache" // the chunk cache shared by layers
+	ReadSourceSpanCache  = "span_cache"  // spans cached on disk
+	ReadSourceMemory     = "memory"      // spans cached in memory
+	ReadSourceRemote     = "remote"      // spans fetched to serve the read
+
+	// remote sources the spans of a layer are fetched from
+	RemoteSourceRegistry  = "registry"   // the registry of the image
+	RemoteSourceMirror    = "mirror"     // a mirror of the registry, e.g. a pull-through cache or a P2P agent
+	RemoteSourceURL       = "url"        // a URL listed by a foreign layer
+	RemoteSourceHandler   = "handler"    // a custom remote snapshot handler
+	RemoteSourceBlobCache = "blob_cache" // the whole layer, cached because the registry ignored ranges
+
+	// bolt DBs
+	MetadataDB  = "metadata"
+	ArtifactsDB = "artifacts"
+
+	// transactions of bolt DBs
+	DBTxView   = "view"
+	DBTxUpdate = "update"
+	DBTxBatch  = "batch" // including the time waiting for the batch to be committed
 )
 
 var (
 	// Buckets for OperationLatency metrics.
 	latencyBucketsMilliseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384} // in milliseconds
 	latencyBucketsMicroseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}                          // in microseconds
+	// Buckets for the duration of DB transactions, from reads of a few pages to syncs of large writes.
+	dbTransactionBucketsMilliseconds = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024} // in milliseconds
 
 	// operationLatencyMilliseconds collects operation latency numbers in milliseconds grouped by
 	// operation, type and layer digest.
@@ -165,6 +302,221 @@ var (
 			Help:      "The count of soci snapshotter operations. Broken down by operation type and image digest.",
 		},
 		[]string{"operation_type", "image"})
+
+	// layerReadStats reflects the bytes and spans fetched from the registry and
+	// served to the application per layer sha.
+	layerReadStats = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      LayerReadStatsKey,
+			Help:      "The bytes and spans fetched from the registry and served to the application. Broken down by stat and layer sha.",
+		},
+		[]string{"stat", "layer"},
+	)
+
+	// layerReadAmplification reflects the ratio of data fetched from the registry to
+	// data served to the application per layer sha.
+	layerReadAmplification = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      LayerReadAmplificationKey,
+			Help:      "The ratio of data fetched from the registry to data served to the application. Broken down by type (bytes or spans) and layer sha.",
+		},
+		[]string{"type", "layer"},
+	)
+
+	// readSourceBytes reflects the bytes served to the reads of a layer by the source that
+	// satisfied them.
+	readSourceBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      ReadSourceBytesKey,
+			Help:      "The uncompressed bytes served to the application by the source that satisfied the reads. Broken down by source and layer sha.",
+		},
+		[]string{"source", "layer"},
+	)
+
+	// readSourceRatio reflects the share of the bytes served to the reads of a layer by each source.
+	readSourceRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      ReadSourceRatioKey,
+			Help:      "The share of the uncompressed bytes served to the application by each source. Broken down by source and layer sha.",
+		},
+		[]string{"source", "layer"},
+	)
+
+	// remoteSourceBytes collects the compressed bytes of a layer fetched from each remote source.
+	remoteSourceBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      RemoteSourceBytesKey,
+			Help:      "The compressed bytes fetched from each remote source (registry, mirror, url, handler or blob_cache). Broken down by source and layer sha.",
+		},
+		[]string{"source", "layer"},
+	)
+
+	// dbFileSize reflects the size of the bolt DB files, which only shrink when they're compacted.
+	dbFileSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBFileSizeKey,
+			Help:      "The size in bytes of the snapshotter's bolt DB files. Broken down by DB.",
+		},
+		[]string{"db"},
+	)
+
+	// dbCompactionCount collects the number of compactions of the bolt DBs.
+	dbCompactionCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBCompactionCountKey,
+			Help:      "The count of compactions of the snapshotter's bolt DBs. Broken down by DB and result.",
+		},
+		[]string{"db", "result"},
+	)
+
+	// dbTransactionLatency collects the duration of the transactions of the bolt DBs. Reads
+	// of the DBs take microseconds while writes which sync the DB file take milliseconds.
+	dbTransactionLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBTransactionLatencyKey,
+			Help:      "Duration in milliseconds of the transactions of the snapshotter's bolt DBs. Broken down by DB and transaction type.",
+			Buckets:   dbTransactionBucketsMilliseconds,
+		},
+		[]string{"db", "type"},
+	)
+
+	// dbPageAllocations collects the number of pages allocated by the bolt DBs.
+	dbPageAllocations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBPageAllocationsKey,
+			Help:      "The count of pages allocated by the snapshotter's bolt DBs. Broken down by DB.",
+		},
+		[]string{"db"},
+	)
+
+	// dbPageAllocBytes collects the bytes of the pages allocated by the bolt DBs.
+	dbPageAllocBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBPageAllocBytesKey,
+			Help:      "The bytes of the pages allocated by the snapshotter's bolt DBs. Broken down by DB.",
+		},
+		[]string{"db"},
+	)
+
+	// dbOpenCount reflects the number of open bolt DBs.
+	dbOpenCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DBOpenCountKey,
+			Help:      "The number of open bolt DBs of the snapshotter. Broken down by DB.",
+		},
+		[]string{"db"},
+	)
+
+	// decompressionQueueDepth reflects the number of spans waiting for a decompression slot.
+	decompressionQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DecompressionQueueDepthKey,
+			Help:      "The number of spans waiting to be uncompressed because the concurrent decompression limit is reached.",
+		},
+	)
+
+	// diskUsage reflects the disk space used by the snapshotter.
+	diskUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DiskUsageKey,
+			Help:      "The disk space in bytes used by the snapshotter. Broken down by type (cache, metadata or snapshots).",
+		},
+		[]string{"type"},
+	)
+
+	// diskBudgetEvictions collects the number of layers whose caches were evicted to stay
+	// within the disk budget.
+	diskBudgetEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      DiskBudgetEvictionsKey,
+			Help:      "The count of layers whose caches were evicted to stay within the disk budget.",
+		},
+	)
+
+	// memoryUsage reflects the memory used by the snapshotter.
+	memoryUsage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MemoryUsageKey,
+			Help:      "The memory in bytes used by the snapshotter. Broken down by type (cache, ztoc or process).",
+		},
+		[]string{"type"},
+	)
+
+	// memoryPressureEvents collects the number of times the caches were shed ("shed") or
+	// layers evicted ("evict") to stay within the memory budget.
+	memoryPressureEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MemoryPressureEventsKey,
+			Help:      "The count of times the in-memory caches were shed or layers evicted to stay within the memory budget. Broken down by action (shed or evict).",
+		},
+		[]string{"action"},
+	)
+
+	// snapshotterOperationLatency collects the latency of the snapshotter's gRPC operations,
+	// e.g. Prepare or Mounts.
+	snapshotterOperationLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      SnapshotterOperationLatencyKey,
+			Help:      "Latency in milliseconds of the snapshotter's gRPC operations. Broken down by operation.",
+			Buckets:   latencyBucketsMilliseconds,
+		},
+		[]string{"operation"},
+	)
+
+	// snapshotterOperationErrors collects the number of failed gRPC operations of the snapshotter.
+	snapshotterOperationErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      SnapshotterOperationErrorsKey,
+			Help:      "The count of failed gRPC operations of the snapshotter. Broken down by operation and error (e.g. not_found).",
+		},
+		[]string{"operation", "error"},
+	)
+
+	// fipsMode is 1 if the snapshotter uses FIPS 140 validated crypto and 0 otherwise.
+	fipsMode = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FIPSModeKey,
+			Help:      "Whether the snapshotter uses FIPS 140 validated crypto (1) or not (0).",
+		},
+	)
 )
 
 var register sync.Once
@@ -191,6 +543,25 @@ func Register() {
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
 		prometheus.MustRegister(imageOperationCount)
+		prometheus.MustRegister(layerReadStats)
+		prometheus.MustRegister(layerReadAmplification)
+		prometheus.MustRegister(readSourceBytes)
+		prometheus.MustRegister(readSourceRatio)
+		prometheus.MustRegister(remoteSourceBytes)
+		prometheus.MustRegister(dbFileSize)
+		prometheus.MustRegister(dbCompactionCount)
+		prometheus.MustRegister(dbTransactionLatency)
+		prometheus.MustRegister(dbPageAllocations)
+		prometheus.MustRegister(dbPageAllocBytes)
+		prometheus.MustRegister(dbOpenCount)
+		prometheus.MustRegister(decompressionQueueDepth)
+		prometheus.MustRegister(fipsMode)
+		prometheus.MustRegister(diskUsage)
+		prometheus.MustRegister(diskBudgetEvictions)
+		prometheus.MustRegister(memoryUsage)
+		prometheus.MustRegister(memoryPressureEvents)
+		prometheus.MustRegister(snapshotterOperationLatency)
+		prometheus.MustRegister(snapshotterOperationErrors)
 	})
 }
 
@@ -226,3 +597,114 @@ func AddBytesCount(operation string, layer digest.Digest, bytes int64) {
 func AddImageOperationCount(operation string, image digest.Digest, count int32) {
 	imageOperationCount.WithLabelValues(operation, image.String()).Add(float64(count))
 }
+
+// SetLayerReadStats sets the read stats of a layer along with its read amplification ratios.
+// The ratios are only set once the layer has served data.
+func SetLayerReadStats(layer digest.Digest, bytesFetched, bytesServed, spansFetched, spansTouched int64) {
+	l := layer.String()
+	layerReadStats.WithLabelValues(ReadStatsBytesFetched, l).Set(float64(bytesFetched))
+	layerReadStats.WithLabelValues(ReadStatsBytesServed, l).Set(float64(bytesServed))
+	layerReadStats.WithLabelValues(ReadStatsSpansFetched, l).Set(float64(spansFetched))
+	layerReadStats.WithLabelValues(ReadStatsSpansTouched, l).Set(float64(spansTouched))
+	if bytesServed > 0 {
+		layerReadAmplification.WithLabelValues(ReadAmplificationBytes, l).Set(float64(bytesFetched) / float64(bytesServed))
+	}
+	if spansTouched > 0 {
+		layerReadAmplification.WithLabelValues(ReadAmplificationSpans, l).Set(float64(spansFetched) / float64(spansTouched))
+	}
+}
+
+// SetLayerReadSources sets the bytes served to the reads of a layer by each source along
+// with their shares. The shares are only set once the layer has served data.
+func SetLayerReadSources(layer digest.Digest, bytesBySource map[string]int64) {
+	l := layer.String()
+	var total int64
+	for source, n := range bytesBySource {
+		readSourceBytes.WithLabelValues(source, l).Set(float64(n))
+		total += n
+	}
+	if total == 0 {
+		return
+	}
+	for source, n := range bytesBySource {
+		readSourceRatio.WithLabelValues(source, l).Set(float64(n) / float64(total))
+	}
+}
+
+// AddRemoteSourceBytes adds n to the compressed bytes of a layer fetched from source.
+func AddRemoteSourceBytes(source string, layer digest.Digest, n int64) {
+	remoteSourceBytes.WithLabelValues(source, layer.String()).Add(float64(n))
+}
+
+// SetDBFileSize sets the size of the file of a bolt DB.
+func SetDBFileSize(db string, size int64) {
+	dbFileSize.WithLabelValues(db).Set(float64(size))
+}
+
+// IncDBCompactionCount counts a compaction of a bolt DB, which failed if err isn't nil.
+func IncDBCompactionCount(db string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	dbCompactionCount.WithLabelValues(db, result).Inc()
+}
+
+// MeasureDBTransaction observes the duration of a transaction of txType of a bolt DB.
+func MeasureDBTransaction(db, txType string, start time.Time) {
+	dbTransactionLatency.WithLabelValues(db, txType).Observe(sinceInMilliseconds(start))
+}
+
+// AddDBPageAllocations adds the pages a bolt DB allocated, and their size in bytes.
+func AddDBPageAllocations(db string, pages, bytes int64) {
+	dbPageAllocations.WithLabelValues(db).Add(float64(pages))
+	dbPageAllocBytes.WithLabelValues(db).Add(float64(bytes))
+}
+
+// AddOpenDBCount adds delta to the number of open bolt DBs.
+func AddOpenDBCount(db string, delta int) {
+	dbOpenCount.WithLabelValues(db).Add(float64(delta))
+}
+
+// AddDecompressionQueueDepth adds delta to the number of spans waiting to be uncompressed.
+func AddDecompressionQueueDepth(delta int) {
+	decompressionQueueDepth.Add(float64(delta))
+}
+
+// SetDiskUsage sets the disk space used by the snapshotter for usageType.
+func SetDiskUsage(usageType string, bytes int64) {
+	diskUsage.WithLabelValues(usageType).Set(float64(bytes))
+}
+
+// IncDiskBudgetEvictions counts a layer whose caches were evicted to stay within the disk budget.
+func IncDiskBudgetEvictions() {
+	diskBudgetEvictions.Inc()
+}
+
+// SetMemoryUsage sets the memory used by the snapshotter for usageType.
+func SetMemoryUsage(usageType string, bytes int64) {
+	memoryUsage.WithLabelValues(usageType).Set(float64(bytes))
+}
+
+// IncMemoryPressureEvents counts an action taken to stay within the memory budget.
+func IncMemoryPressureEvents(action string) {
+	memoryPressureEvents.WithLabelValues(action).Inc()
+}
+
+// MeasureSnapshotterOperation records the latency of a gRPC operation of the snapshotter
+// and, if errorKind isn't empty, its failure.
+func MeasureSnapshotterOperation(operation string, start time.Time, errorKind string) {
+	snapshotterOperationLatency.WithLabelValues(operation).Observe(sinceInMilliseconds(start))
+	if errorKind != "" {
+		snapshotterOperationErrors.WithLabelValues(operation, errorKind).Inc()
+	}
+}
+
+// SetFIPSMode sets whether the snapshotter uses FIPS 140 validated crypto.
+func SetFIPSMode(enabled bool) {
+	v := 0.0
+	if enabled {
+		v = 1
+	}
+	fipsMode.Set(v)
+}
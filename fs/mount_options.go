@@ -0,0 +1,97 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"golang.org/x/sys/unix"
+)
+
+// mountOptionFlags are the flags of the options the FUSE mounts of layers can be
+// hardened with.
+var mountOptionFlags = map[string]uintptr{
+	"ro":     unix.MS_RDONLY,
+	"noexec": unix.MS_NOEXEC,
+	"nodev":  unix.MS_NODEV,
+	"nosuid": unix.MS_NOSUID,
+}
+
+// statfsMountFlags maps the flags of statfs to the mount flags which keep them when
+// a mount is remounted.
+var statfsMountFlags = map[int64]uintptr{
+	unix.ST_RDONLY:      unix.MS_RDONLY,
+	unix.ST_NOSUID:      unix.MS_NOSUID,
+	unix.ST_NODEV:       unix.MS_NODEV,
+	unix.ST_NOEXEC:      unix.MS_NOEXEC,
+	unix.ST_NOATIME:     unix.MS_NOATIME,
+	unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+	unix.ST_RELATIME:    unix.MS_RELATIME,
+	unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+}
+
+// parseMountOptions returns the mount flags of options.
+func parseMountOptions(options []string) (uintptr, error) {
+	var flags uintptr
+	for _, o := range options {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		flag, ok := mountOptionFlags[o]
+		if !ok {
+			return 0, fmt.Errorf("unsupported mount option %q: must be one of ro, noexec, nodev and nosuid", o)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// mountFlags returns the flags the FUSE mount of the layer of a snapshot is hardened
+// with, which are the flags of the config and the flags of the mount options label of
+// the snapshot. Labels can't drop the flags of the config.
+func (fs *filesystem) mountFlags(labels map[string]string) (uintptr, error) {
+	v, ok := labels[source.MountOptionsLabel]
+	if !ok {
+		return fs.mountOptions, nil
+	}
+	flags, err := parseMountOptions(strings.Split(v, ","))
+	if err != nil {
+		return 0, fmt.Errorf("invalid mount options label: %w", err)
+	}
+	return fs.mountOptions | flags, nil
+}
+
+// hardenMount remounts the mount at mountpoint with flags, in addition to the flags
+// it was mounted with.
+func hardenMount(mountpoint string, flags uintptr) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return fmt.Errorf("failed to stat mount %s: %w", mountpoint, err)
+	}
+	for stFlag, flag := range statfsMountFlags {
+		if int64(st.Flags)&stFlag != 0 {
+			flags |= flag
+		}
+	}
+	if err := unix.Mount("", mountpoint, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s with mount options: %w", mountpoint, err)
+	}
+	return nil
+}
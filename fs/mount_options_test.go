@@ -0,0 +1,79 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"golang.org/x/sys/unix"
+)
+
+func TestMountFlags(t *testing.T) {
+	configFlags, err := parseMountOptions([]string{"nodev", "nosuid"})
+	if err != nil {
+		t.Fatalf("failed to parse mount options: %v", err)
+	}
+	if configFlags != unix.MS_NODEV|unix.MS_NOSUID {
+		t.Fatalf("unexpected flags %#x", configFlags)
+	}
+	fs := &filesystem{mountOptions: configFlags}
+
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		expected  uintptr
+		expectErr bool
+	}{
+		{
+			name:     "no label",
+			expected: unix.MS_NODEV | unix.MS_NOSUID,
+		},
+		{
+			name:     "label adds options",
+			labels:   map[string]string{source.MountOptionsLabel: "ro, noexec"},
+			expected: unix.MS_RDONLY | unix.MS_NOEXEC | unix.MS_NODEV | unix.MS_NOSUID,
+		},
+		{
+			name:     "empty label",
+			labels:   map[string]string{source.MountOptionsLabel: ""},
+			expected: unix.MS_NODEV | unix.MS_NOSUID,
+		},
+		{
+			name:      "unsupported option",
+			labels:    map[string]string{source.MountOptionsLabel: "noexec,suid"},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := fs.mountFlags(tt.labels)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if flags != tt.expected {
+				t.Fatalf("unexpected flags: expected %#x, got %#x", tt.expected, flags)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// MountsPath is the path of the endpoint of the snapshotter's API that lists
+// the layers mounted by the snapshotter.
+const MountsPath = "/api/v1/mounts"
+
+// mountSource is the image a layer is mounted for.
+type mountSource struct {
+	imageRef    string
+	imageDigest string
+	indexDigest digest.Digest
+}
+
+// MountInfo is a layer mounted by the snapshotter.
+type MountInfo struct {
+	Mountpoint string `json:"mountpoint"`
+	// Image is the ref of the image the layer was mounted for.
+	Image string `json:"image,omitempty"`
+	// Index is the digest of the SOCI index the layer is lazily loaded with.
+	Index digest.Digest `json:"index,omitempty"`
+	Layer digest.Digest `json:"layer"`
+	// Ztoc is the digest of the ztoc the layer is lazily loaded with.
+	Ztoc        digest.Digest `json:"ztoc,omitempty"`
+	Size        int64         `json:"size"`
+	FetchedSize int64         `json:"fetchedSize"`
+	ReadTime    time.Time     `json:"readTime"`
+	// UncompressedSize is the size of the uncompressed layer.
+	UncompressedSize int64 `json:"uncompressedSize"`
+	// TOCCheck is the report of the cross-check of the ztoc against the layer, if it's enabled.
+	TOCCheck *spanmanager.TOCCheckReport `json:"tocCheck,omitempty"`
+}
+
+// mounts returns the layers mounted by the filesystem, sorted by mountpoint.
+func (fs *filesystem) mounts() []MountInfo {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	mounts := make([]MountInfo, 0, len(fs.layer))
+	for mountpoint, l := range fs.layer {
+		info := l.Info()
+		src := fs.mountSources[mountpoint]
+		mounts = append(mounts, MountInfo{
+			Mountpoint:       mountpoint,
+			Image:            src.imageRef,
+			Index:            src.indexDigest,
+			Layer:            info.Digest,
+			Ztoc:             info.ZtocDigest,
+			Size:             info.Size,
+			FetchedSize:      info.FetchedSize,
+			ReadTime:         info.ReadTime,
+			UncompressedSize: info.UncompressedSize,
+			TOCCheck:         info.TOCCheck,
+		})
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Mountpoint < mounts[j].Mountpoint })
+	return mounts
+}
+
+func (fs *filesystem) mountsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(fs.mounts()); err != nil {
+			log.G(fs.ctx).WithError(err).Warn("failed to write mounts response")
+		}
+	})
+}
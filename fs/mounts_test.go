@@ -0,0 +1,79 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestMountsHandler(t *testing.T) {
+	index := digest.FromString("index")
+	a := &prefetchLayer{digest: digest.FromString("a")}
+	b := &prefetchLayer{digest: digest.FromString("b")}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"/snapshots/2/fs": b,
+			"/snapshots/1/fs": a,
+		},
+		mountSources: map[string]mountSource{
+			"/snapshots/1/fs": {imageRef: "docker.io/library/rabbitmq:latest", indexDigest: index},
+		},
+	}
+	h := fs.mountsHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MountsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var mounts []MountInfo
+	if err := json.NewDecoder(rec.Body).Decode(&mounts); err != nil {
+		t.Fatal(err)
+	}
+	expected := []MountInfo{
+		{
+			Mountpoint:  "/snapshots/1/fs",
+			Image:       "docker.io/library/rabbitmq:latest",
+			Index:       index,
+			Layer:       a.digest,
+			Size:        100,
+			FetchedSize: 50,
+		},
+		{
+			Mountpoint:  "/snapshots/2/fs",
+			Layer:       b.digest,
+			Size:        100,
+			FetchedSize: 50,
+		},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("unexpected mounts; expected %+v, got %+v", expected, mounts)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, MountsPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for POST", rec.Code)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// PrefetchPath is the path of the prefetch endpoint of the snapshotter's API.
+const PrefetchPath = "/api/v1/prefetch"
+
+// PrefetchRequest is the body of a request to the prefetch endpoint.
+type PrefetchRequest struct {
+	// Layers are the digests of the layers to prefetch.
+	Layers []digest.Digest `json:"layers"`
+	// Paths are the files and directories (absolute paths in the image) to prefetch.
+	// If empty, all spans of the layers are prefetched.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// PrefetchResponse is the body of a response of the prefetch endpoint.
+type PrefetchResponse struct {
+	Layers []PrefetchLayerResult `json:"layers"`
+}
+
+// PrefetchLayerResult is the result of prefetching a single layer.
+type PrefetchLayerResult struct {
+	Digest digest.Digest `json:"digest"`
+	// Mounted is whether the layer is lazily loaded by the snapshotter.
+	// Layers which aren't mounted are either fully local or not pulled yet, so they aren't prefetched.
+	Mounted bool `json:"mounted"`
+	// FetchedSize is the number of bytes of the layer which are fetched after prefetching.
+	FetchedSize int64 `json:"fetchedSize"`
+	// Size is the size of the layer in bytes.
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+// prefetch fetches and caches the contents of the mounted layers in req.
+// Layers are prefetched concurrently.
+func (fs *filesystem) prefetch(ctx context.Context, req PrefetchRequest) PrefetchResponse {
+	mounted := fs.mountedLayers()
+
+	results := make([]PrefetchLayerResult, len(req.Layers))
+	var wg sync.WaitGroup
+	for i, dgst := range req.Layers {
+		results[i].Digest = dgst
+		l, ok := mounted[dgst]
+		if !ok {
+			continue
+		}
+		results[i].Mounted = true
+		wg.Add(1)
+		go func(l layer.Layer, res *PrefetchLayerResult) {
+			defer wg.Done()
+			if err := l.Prefetch(ctx, req.Paths); err != nil {
+				log.G(ctx).WithError(err).WithField("layer", res.Digest).Warn("failed to prefetch layer")
+				res.Error = err.Error()
+			}
+			info := l.Info()
+			res.FetchedSize = info.FetchedSize
+			res.Size = info.Size
+		}(l, &results[i])
+	}
+	wg.Wait()
+	return PrefetchResponse{Layers: results}
+}
+
+func (fs *filesystem) prefetchHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req PrefetchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, l := range req.Layers {
+			if err := l.Validate(); err != nil {
+				http.Error(w, "invalid layer digest: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ctx := log.WithLogger(r.Context(), log.G(fs.ctx))
+		resp := fs.prefetch(ctx, req)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write prefetch response")
+		}
+	})
+}
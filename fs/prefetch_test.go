@@ -0,0 +1,73 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type prefetchLayer struct {
+	breakableLayer
+	digest digest.Digest
+	err    error
+	paths  []string
+}
+
+func (l *prefetchLayer) Info() layer.Info {
+	return layer.Info{Digest: l.digest, Size: 100, FetchedSize: 50}
+}
+
+func (l *prefetchLayer) Prefetch(_ context.Context, paths []string) error {
+	l.paths = paths
+	return l.err
+}
+
+func TestPrefetch(t *testing.T) {
+	ok := &prefetchLayer{digest: digest.FromString("ok")}
+	failing := &prefetchLayer{digest: digest.FromString("failing"), err: errors.New("fetch failed")}
+	notMounted := digest.FromString("not-mounted")
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"mnt-ok":      ok,
+			"mnt-failing": failing,
+		},
+	}
+
+	paths := []string{"/usr/bin"}
+	resp := fs.prefetch(context.Background(), PrefetchRequest{
+		Layers: []digest.Digest{ok.digest, failing.digest, notMounted},
+		Paths:  paths,
+	})
+
+	expected := []PrefetchLayerResult{
+		{Digest: ok.digest, Mounted: true, FetchedSize: 50, Size: 100},
+		{Digest: failing.digest, Mounted: true, FetchedSize: 50, Size: 100, Error: "fetch failed"},
+		{Digest: notMounted},
+	}
+	if !reflect.DeepEqual(resp.Layers, expected) {
+		t.Fatalf("unexpected results; expected %+v, got %+v", expected, resp.Layers)
+	}
+	if !reflect.DeepEqual(ok.paths, paths) {
+		t.Fatalf("unexpected paths; expected %v, got %v", paths, ok.paths)
+	}
+}
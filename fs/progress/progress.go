@@ -0,0 +1,158 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package progress tracks the phases of lazily pulling images, so that they can be
+// reported to clients which only see a pull as a whole, e.g. kubelet through CRI.
+package progress
+
+import (
+	"context"
+	"sync"
+)
+
+// Phase is a phase of lazily pulling an image.
+type Phase string
+
+const (
+	// PhaseResolvingIndex is resolving the SOCI index of the image,
+	// e.g. with the Referrers API.
+	PhaseResolvingIndex Phase = "resolvingIndex"
+	// PhaseFetchingZtocs is fetching the SOCI index and the ztocs of the image.
+	PhaseFetchingZtocs Phase = "fetchingZtocs"
+	// PhaseMountingLayers is resolving and mounting the layers of the image.
+	PhaseMountingLayers Phase = "mountingLayers"
+)
+
+// maxImages bounds the number of images whose progress is remembered.
+const maxImages = 1024
+
+// Image is the progress of lazily pulling an image.
+type Image struct {
+	Phase Phase `json:"phase,omitempty"`
+	// ZtocsTotal is the number of ztocs in the SOCI index of the image.
+	ZtocsTotal int `json:"ztocsTotal,omitempty"`
+	// ZtocsFetched is the number of ztocs fetched or found locally.
+	ZtocsFetched int `json:"ztocsFetched,omitempty"`
+	// BytesFetched is the number of bytes fetched from the registry for the SOCI
+	// artifacts and the mounted layers of the image.
+	BytesFetched int64 `json:"bytesFetched,omitempty"`
+}
+
+// Tracker records the progress of lazily pulling images by image ref.
+// A nil Tracker records nothing.
+type Tracker struct {
+	mu     sync.Mutex
+	images map[string]*Image
+	order  []string
+}
+
+// New returns an empty Tracker.
+func New() *Tracker {
+	return &Tracker{images: make(map[string]*Image)}
+}
+
+// Reset forgets the progress of a previous pull of ref, e.g. when it's pulled again.
+func (t *Tracker) Reset(ref string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if img, ok := t.images[ref]; ok {
+		*img = Image{}
+	}
+}
+
+// Get returns the progress of pulling ref.
+func (t *Tracker) Get(ref string) (Image, bool) {
+	if t == nil {
+		return Image{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	img, ok := t.images[ref]
+	if !ok {
+		return Image{}, false
+	}
+	return *img, true
+}
+
+// SetPhase records that pulling ref has reached phase p.
+func (t *Tracker) SetPhase(ref string, p Phase) {
+	t.update(ref, func(img *Image) {
+		img.Phase = p
+	})
+}
+
+// AddZtocs records that the SOCI index of ref has n ztocs.
+func (t *Tracker) AddZtocs(ref string, n int) {
+	t.update(ref, func(img *Image) {
+		img.ZtocsTotal += n
+	})
+}
+
+// ZtocFetched records that a ztoc of ref was fetched with n bytes from the registry.
+func (t *Tracker) ZtocFetched(ref string, n int64) {
+	t.update(ref, func(img *Image) {
+		img.ZtocsFetched++
+		img.BytesFetched += n
+	})
+}
+
+// AddBytes records that n bytes were fetched from the registry while pulling ref.
+func (t *Tracker) AddBytes(ref string, n int64) {
+	t.update(ref, func(img *Image) {
+		img.BytesFetched += n
+	})
+}
+
+func (t *Tracker) update(ref string, f func(*Image)) {
+	if t == nil || ref == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	img, ok := t.images[ref]
+	if !ok {
+		img = &Image{}
+		t.images[ref] = img
+		t.order = append(t.order, ref)
+		for len(t.order) > maxImages {
+			delete(t.images, t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+	f(img)
+}
+
+type imageKey struct{}
+
+type imageProgress struct {
+	t   *Tracker
+	ref string
+}
+
+// WithImage returns a context which records the progress of pulling ref in t.
+func WithImage(ctx context.Context, t *Tracker, ref string) context.Context {
+	return context.WithValue(ctx, imageKey{}, imageProgress{t: t, ref: ref})
+}
+
+// FromContext returns the Tracker and image ref of ctx set by WithImage.
+// The Tracker is nil if ctx doesn't record progress.
+func FromContext(ctx context.Context) (*Tracker, string) {
+	p, _ := ctx.Value(imageKey{}).(imageProgress)
+	return p.t, p.ref
+}
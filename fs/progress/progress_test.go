@@ -0,0 +1,61 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package progress
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestTracker(t *testing.T) {
+	const ref = "docker.io/library/foo:latest"
+	tracker := New()
+	ctx := WithImage(context.Background(), tracker, ref)
+
+	ct, cref := FromContext(ctx)
+	ct.SetPhase(cref, PhaseFetchingZtocs)
+	ct.AddZtocs(cref, 2)
+	ct.ZtocFetched(cref, 100)
+	ct.ZtocFetched(cref, 0)
+	ct.SetPhase(cref, PhaseMountingLayers)
+	ct.AddBytes(cref, 50)
+
+	expected := Image{Phase: PhaseMountingLayers, ZtocsTotal: 2, ZtocsFetched: 2, BytesFetched: 150}
+	if got, ok := tracker.Get(ref); !ok || got != expected {
+		t.Fatalf("expected progress %+v, got %+v", expected, got)
+	}
+
+	tracker.Reset(ref)
+	if got, _ := tracker.Get(ref); got != (Image{}) {
+		t.Fatalf("expected progress to be reset, got %+v", got)
+	}
+
+	for i := 0; i < maxImages; i++ {
+		tracker.SetPhase(fmt.Sprintf("docker.io/library/foo:%d", i), PhaseResolvingIndex)
+	}
+	if _, ok := tracker.Get(ref); ok {
+		t.Fatal("expected the oldest image to be forgotten")
+	}
+
+	// contexts without a tracker record nothing.
+	nt, nref := FromContext(context.Background())
+	nt.SetPhase(nref, PhaseResolvingIndex)
+	if _, ok := nt.Get(nref); ok {
+		t.Fatal("expected no progress without a tracker")
+	}
+}
@@ -39,6 +39,8 @@
 package reader
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -49,11 +51,17 @@ import (
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/fips"
+	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/log"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
 )
 
+// ErrIncorrectChunkDigest is returned when a chunk of a file doesn't match its digest.
+var ErrIncorrectChunkDigest = errors.New("chunk doesn't match its digest")
+
 type Reader interface {
 	OpenFile(id uint32) (io.ReaderAt, error)
 	Metadata() metadata.Reader
@@ -121,13 +129,41 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// Option configures a Reader.
+type Option func(*reader)
+
+// WithChunkCache serves the contents of the files which have chunk digests in toc
+// from chunkCache, which is shared by layers, so that identical files in different
+// layers are only fetched once. Chunks read from the layer are added to chunkCache.
+func WithChunkCache(chunkCache cache.BlobCache, toc ztoc.TOC) Option {
+	return func(gr *reader) {
+		if toc.ChunkSize <= 0 {
+			return
+		}
+		gr.chunkCache = chunkCache
+		gr.chunkSize = toc.ChunkSize
+		gr.chunks = make(map[compression.Offset][]digest.Digest)
+		for _, fm := range toc.FileMetadata {
+			if len(fm.ChunkDigests) > 0 {
+				gr.chunks[fm.UncompressedOffset] = fm.ChunkDigests
+			}
+		}
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, opts ...Option) (*VerifiableReader, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	vr := &reader{
 		spanManager: spanManager,
 		r:           r,
 		layerSha:    layerSha,
 		verifier:    digestVerifier,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	for _, o := range opts {
+		o(vr)
 	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
@@ -137,6 +173,11 @@ type reader struct {
 	r           metadata.Reader
 	layerSha    digest.Digest
 
+	// ctx is canceled when the reader is closed so that in-flight reads
+	// stop resolving spans.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	lastReadTime   time.Time
 	lastReadTimeMu sync.Mutex
 
@@ -145,6 +186,12 @@ type reader struct {
 
 	verify   bool
 	verifier func(uint32, string) (digest.Verifier, error)
+
+	// chunkCache caches the chunks of files by their digests, shared by layers.
+	// chunks are the chunk digests of files by their offset in the layer.
+	chunkCache cache.BlobCache
+	chunkSize  compression.Offset
+	chunks     map[compression.Offset][]digest.Digest
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -187,6 +234,9 @@ func (gr *reader) Close() (retErr error) {
 		return nil
 	}
 	gr.closed = true
+	gr.cancel()
+	// the stats are reported periodically from reads, so report the last reads too.
+	gr.spanManager.FlushReadStats(gr.layerSha)
 	if err := gr.r.Close(); err != nil {
 		retErr = multierror.Append(retErr, err)
 	}
@@ -208,6 +258,16 @@ type file struct {
 
 // ReadAt reads the file when the file is requested by the container
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	return sf.readAt(p, offset)
+}
+
+// ReadAtUncached reads the file like ReadAt, without caching the uncompressed contents
+// of the spans it reads, e.g. for files opened with O_DIRECT.
+func (sf *file) ReadAtUncached(p []byte, offset int64) (int, error) {
+	return sf.readAt(p, offset, spanmanager.SkipCache())
+}
+
+func (sf *file) readAt(p []byte, offset int64, opts ...spanmanager.ContentsOption) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -219,9 +279,19 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	if expectedSize > compression.Offset(len(p)) {
 		expectedSize = compression.Offset(len(p))
 	}
+	if chunks := sf.gr.chunks[sf.fr.GetUncompressedOffset()]; chunks != nil {
+		n, err := sf.readChunks(p[:expectedSize], compression.Offset(offset), chunks, opts...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the file: %w", err)
+		}
+		sf.gr.setLastReadTime(time.Now())
+		commonmetrics.AddBytesCount(commonmetrics.SynchronousBytesServed, sf.gr.layerSha, int64(n))
+		sf.gr.spanManager.ReportReadStats(sf.gr.layerSha)
+		return n, nil
+	}
 	fileOffsetStart := sf.fr.GetUncompressedOffset() + compression.Offset(offset)
 	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
+	r, err := sf.gr.spanManager.GetContents(sf.gr.ctx, fileOffsetStart, fileOffsetEnd, opts...)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read the file: %w", err)
 	}
@@ -232,13 +302,100 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 
 	n, err := io.ReadFull(r, p[0:expectedSize])
 	if err != nil {
-		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
+		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d: %w", n, expectedSize, err)
 	}
 	commonmetrics.AddBytesCount(commonmetrics.SynchronousBytesServed, sf.gr.layerSha, int64(n)) // measure the number of bytes served synchronously
+	sf.gr.spanManager.ReportReadStats(sf.gr.layerSha)
+
+	return n, nil
+}
 
+// readChunks reads p at offset of the file from the chunk cache, fetching the chunks
+// which aren't cached from the layer.
+func (sf *file) readChunks(p []byte, offset compression.Offset, chunks []digest.Digest, opts ...spanmanager.ContentsOption) (int, error) {
+	fileSize := sf.fr.GetUncompressedFileSize()
+	var n int
+	for n < len(p) {
+		off := offset + compression.Offset(n)
+		i := int(off / sf.gr.chunkSize)
+		if i >= len(chunks) {
+			return n, fmt.Errorf("no chunk digest recorded for offset %d", off)
+		}
+		chunkStart := compression.Offset(i) * sf.gr.chunkSize
+		chunkEnd := chunkStart + sf.gr.chunkSize
+		if chunkEnd > fileSize {
+			chunkEnd = fileSize
+		}
+		length := chunkEnd - off
+		if rest := compression.Offset(len(p) - n); rest < length {
+			length = rest
+		}
+		m, err := sf.readChunk(p[n:n+int(length)], off-chunkStart, chunks[i], chunkStart, chunkEnd, opts...)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
 	return n, nil
 }
 
+// readChunk reads p at offset of the chunk dgst in [chunkStart, chunkEnd) of the file.
+func (sf *file) readChunk(p []byte, offset compression.Offset, dgst digest.Digest, chunkStart, chunkEnd compression.Offset, opts ...spanmanager.ContentsOption) (int, error) {
+	key := dgst.Encoded()
+	if r, err := sf.gr.chunkCache.Get(key); err == nil {
+		defer r.Close()
+		if n, err := r.ReadAt(p, int64(offset)); n == len(p) {
+			commonmetrics.IncOperationCount(commonmetrics.FileChunkCacheHitCount, sf.gr.layerSha)
+			sf.gr.spanManager.RecordChunkCacheRead(n)
+			return n, nil
+		} else if err != nil && err != io.EOF {
+			log.L.WithError(err).WithField("chunk", dgst).Debug("failed to read chunk from the cache")
+		}
+	}
+
+	fileOffset := sf.fr.GetUncompressedOffset()
+	r, err := sf.gr.spanManager.GetContents(sf.gr.ctx, fileOffset+chunkStart, fileOffset+chunkEnd, opts...)
+	if err != nil {
+		return 0, err
+	}
+	chunk := make([]byte, chunkEnd-chunkStart)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return 0, err
+	}
+	if dgst.Algorithm().FromBytes(chunk) != dgst {
+		return 0, fmt.Errorf("chunk %s of the file: %w", dgst, ErrIncorrectChunkDigest)
+	}
+	// failing to cache the chunk doesn't fail the read.
+	if w, err := sf.gr.chunkCache.Add(key); err == nil {
+		defer w.Close()
+		if _, err := w.Write(chunk); err != nil {
+			w.Abort()
+		} else if err := w.Commit(); err != nil {
+			log.L.WithError(err).WithField("chunk", dgst).Debug("failed to cache chunk")
+		}
+	}
+	return copy(p, chunk[offset:]), nil
+}
+
+// Prefetch fetches and caches the contents of the file in [offset, offset+length)
+// ahead of reads, e.g. when the file is read sequentially.
+func (sf *file) Prefetch(ctx context.Context, offset, length int64) error {
+	uncompFileSize := sf.fr.GetUncompressedFileSize()
+	start := compression.Offset(offset)
+	if start >= uncompFileSize || length <= 0 {
+		return nil
+	}
+	end := start + compression.Offset(length)
+	if end > uncompFileSize {
+		end = uncompFileSize
+	}
+	fileOffset := sf.fr.GetUncompressedOffset()
+	if err := sf.gr.spanManager.FetchSpans(ctx, fileOffset+start, fileOffset+end); err != nil {
+		return fmt.Errorf("failed to prefetch the file: %w", err)
+	}
+	return nil
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
@@ -270,5 +427,8 @@ func digestVerifier(id uint32, digestStr string) (digest.Verifier, error) {
 	if err != nil {
 		return nil, fmt.Errorf("no digset is recorded: %w", err)
 	}
+	if err := fips.CheckDigestAlgorithm(digest.Algorithm()); err != nil {
+		return nil, err
+	}
 	return digest.Verifier(), nil
 }
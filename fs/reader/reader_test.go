@@ -66,6 +66,7 @@ var spanSizeCond = [3]int64{64, 128, 256}
 func TestFsReader(t *testing.T) {
 	testFileReadAt(t, metadata.NewTempDbStore)
 	testFailReader(t, metadata.NewTempDbStore)
+	testChunkCache(t, metadata.NewTempDbStore)
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -180,6 +181,78 @@ func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize in
 	return f, vr.Close
 }
 
+func testChunkCache(t *testing.T, factory metadata.Store) {
+	const chunkSize = 4
+	testFileName := "test"
+	tarEntry := []testutil.TarEntry{
+		testutil.File(testFileName, sampleData1),
+	}
+	ztoc, sr, err := ztoc.BuildZtocReader(t, tarEntry, gzip.DefaultCompression, sampleSpanSize)
+	if err != nil {
+		t.Fatalf("failed to build sample ztoc: %v", err)
+	}
+	var chunks []digest.Digest
+	for off := 0; off < len(sampleData1); off += chunkSize {
+		end := off + chunkSize
+		if end > len(sampleData1) {
+			end = len(sampleData1)
+		}
+		chunks = append(chunks, digest.FromString(sampleData1[off:end]))
+	}
+	ztoc.ChunkSize = chunkSize
+	for i := range ztoc.FileMetadata {
+		if ztoc.FileMetadata[i].Name == testFileName {
+			ztoc.FileMetadata[i].ChunkDigests = chunks
+		}
+	}
+	mr, err := factory(sr, ztoc)
+	if err != nil {
+		t.Fatalf("failed to prepare metadata reader")
+	}
+	defer mr.Close()
+	tid, _, err := mr.GetChild(mr.RootID(), testFileName)
+	if err != nil {
+		t.Fatalf("failed to get %q: %v", testFileName, err)
+	}
+
+	chunkCache := cache.NewMemoryCache()
+	read := func(sr *io.SectionReader) (string, error) {
+		spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache(), 0)
+		vr, err := NewReader(mr, digest.FromString(""), spanManager, WithChunkCache(chunkCache, ztoc.TOC))
+		if err != nil {
+			return "", err
+		}
+		fr, err := vr.GetReader().OpenFile(tid)
+		if err != nil {
+			return "", err
+		}
+		p := make([]byte, len(sampleData1))
+		n, err := fr.ReadAt(p, 0)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return string(p[:n]), nil
+	}
+
+	got, err := read(sr)
+	if err != nil || got != sampleData1 {
+		t.Fatalf("unexpected contents %q: %v", got, err)
+	}
+	for _, dgst := range chunks {
+		if _, err := chunkCache.Get(dgst.Encoded()); err != nil {
+			t.Fatalf("chunk %s isn't cached: %v", dgst, err)
+		}
+	}
+
+	// Another layer with the same file is served from the chunk cache
+	// without reading the layer.
+	broken := io.NewSectionReader(bytes.NewReader(make([]byte, sr.Size())), 0, sr.Size())
+	got, err = read(broken)
+	if err != nil || got != sampleData1 {
+		t.Fatalf("unexpected contents from the chunk cache %q: %v", got, err)
+	}
+}
+
 func testFailReader(t *testing.T, factory metadata.Store) {
 	testFileName := "test"
 	tarEntry := []testutil.TarEntry{
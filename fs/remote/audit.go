@@ -0,0 +1,236 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// AuditRecord is a line of the audit log, which records a request to a remote registry
+// made on behalf of an image.
+type AuditRecord struct {
+	Time  time.Time `json:"time"`
+	Image string    `json:"image"`
+	// Layer is the digest of the layer the request was made for, if any. Requests for
+	// the SOCI index and ztocs of the image have no layer.
+	Layer digest.Digest `json:"layer,omitempty"`
+	// Snapshot is the key of the snapshot the request was made for, i.e. the snapshot
+	// which resolved the layer or the SOCI artifacts of the image first.
+	Snapshot string `json:"snapshot,omitempty"`
+	// URL is the URL of the request without its query, which may contain credentials
+	// (e.g. of signed URLs).
+	URL    string `json:"url"`
+	Method string `json:"method"`
+	Range  string `json:"range,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// Bytes is the number of bytes of the response body.
+	Bytes int64 `json:"bytes"`
+	// LatencyMs is the time until the response body was read, in milliseconds.
+	LatencyMs int64 `json:"latencyMs"`
+	// Principal is the identity the request was authorized as: the username of basic
+	// auth, the subject of a JWT bearer token, or "anonymous".
+	Principal string `json:"principal"`
+	Error     string `json:"error,omitempty"`
+}
+
+// AuditLog appends an AuditRecord as a JSON line for every request to remote registries.
+type AuditLog struct {
+	f   *os.File
+	enc *json.Encoder
+	mu  sync.Mutex
+}
+
+// NewAuditLog opens the audit log at path for appending.
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &AuditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+func (a *AuditLog) record(r AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(r)
+}
+
+// defaultAuditLog is the *AuditLog requests to remote registries are recorded in, if any.
+var defaultAuditLog atomic.Value
+
+func init() {
+	SetAuditLog(nil)
+}
+
+// SetAuditLog records the requests of fetchers created afterwards in a.
+// A nil a disables the audit log.
+func SetAuditLog(a *AuditLog) {
+	defaultAuditLog.Store(a)
+}
+
+func getAuditLog() *AuditLog {
+	return defaultAuditLog.Load().(*AuditLog)
+}
+
+type snapshotKey struct{}
+
+// WithSnapshot returns a context whose requests to remote registries are audited as
+// made on behalf of the snapshot with key.
+func WithSnapshot(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, snapshotKey{}, key)
+}
+
+// auditTransport records the requests of inner, which are made on behalf of the layer of image.
+type auditTransport struct {
+	inner    http.RoundTripper
+	log      *AuditLog
+	image    string
+	layer    digest.Digest
+	snapshot string
+}
+
+// WithAuditLog returns tr, recording its requests in the audit log if it's enabled as made
+// on behalf of the layer of image (if any) and of the snapshot of ctx set by WithSnapshot.
+// The requests are recorded after authorization, so tr must be wrapped by the authorizing transport.
+func WithAuditLog(ctx context.Context, tr http.RoundTripper, image string, layer digest.Digest) http.RoundTripper {
+	a := getAuditLog()
+	if a == nil {
+		return tr
+	}
+	snapshot, _ := ctx.Value(snapshotKey{}).(string)
+	return &auditTransport{inner: tr, log: a, image: image, layer: layer, snapshot: snapshot}
+}
+
+func (tr *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+	r := AuditRecord{
+		Time:      time.Now().UTC(),
+		Image:     tr.image,
+		Layer:     tr.layer,
+		Snapshot:  tr.snapshot,
+		URL:       u.String(),
+		Method:    req.Method,
+		Range:     req.Header.Get("Range"),
+		Principal: principal(req),
+	}
+	resp, err := tr.inner.RoundTrip(req)
+	if err != nil {
+		r.Error = err.Error()
+		tr.write(r)
+		return nil, err
+	}
+	r.Status = resp.StatusCode
+	resp.Body = &auditBody{ReadCloser: resp.Body, done: func(n int64, err error) {
+		r.Bytes = n
+		if err != nil {
+			r.Error = err.Error()
+		}
+		tr.write(r)
+	}}
+	return resp, nil
+}
+
+func (tr *auditTransport) write(r AuditRecord) {
+	r.LatencyMs = time.Since(r.Time).Milliseconds()
+	if err := tr.log.record(r); err != nil {
+		log.L.WithError(err).WithField("url", r.URL).Error("failed to write audit log")
+	}
+}
+
+// auditBody counts the bytes read from a response body and calls done once, when
+// the body is read to the end or closed.
+type auditBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64, err error)
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.n, nil) })
+	} else if err != nil {
+		b.once.Do(func() { b.done(b.n, err) })
+	}
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	b.once.Do(func() { b.done(b.n, nil) })
+	return b.ReadCloser.Close()
+}
+
+// principal returns the identity req is authorized as.
+func principal(req *http.Request) string {
+	if user, _, ok := req.BasicAuth(); ok {
+		return user
+	}
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok {
+		return "anonymous"
+	}
+	if strings.EqualFold(scheme, "Bearer") {
+		if sub := jwtSubject(token); sub != "" {
+			return sub
+		}
+	}
+	return strings.ToLower(scheme)
+}
+
+// jwtSubject returns the subject of token if it's a JWT. The token isn't verified,
+// since it's only used to record which identity the registry issued it for.
+func jwtSubject(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
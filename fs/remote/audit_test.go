@@ -0,0 +1,161 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestPrincipal(t *testing.T) {
+	jwt := func(payload string) string {
+		return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		expected      string
+	}{
+		{
+			name:     "anonymous",
+			expected: "anonymous",
+		},
+		{
+			name:          "basic",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("robot:secret")),
+			expected:      "robot",
+		},
+		{
+			name:          "jwt bearer",
+			authorization: jwt(`{"sub":"robot","exp":1}`),
+			expected:      "robot",
+		},
+		{
+			name:          "jwt bearer without subject",
+			authorization: jwt(`{"exp":1}`),
+			expected:      "bearer",
+		},
+		{
+			name:          "opaque bearer",
+			authorization: "Bearer opaque",
+			expected:      "bearer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "https://registry.example.com/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if p := principal(req); p != tt.expected {
+				t.Fatalf("unexpected principal: expected %q, got %q", tt.expected, p)
+			}
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	SetAuditLog(a)
+	defer SetAuditLog(nil)
+
+	body := "0123456789"
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	})
+	layer := digest.FromString("layer")
+	tr := WithAuditLog(WithSnapshot(context.Background(), "sha256:snapshot"), inner, "registry.example.com/app:v1", layer)
+
+	for _, u := range []string{
+		"https://registry.example.com/v2/app/blobs/" + layer.String(),
+		"https://bucket.example.com/blob?X-Amz-Signature=secret",
+	} {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=0-9")
+		req.SetBasicAuth("robot", "secret")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []AuditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.Image != "registry.example.com/app:v1" || r.Layer != layer || r.Snapshot != "sha256:snapshot" {
+			t.Errorf("unexpected image, layer or snapshot: %+v", r)
+		}
+		if r.Range != "bytes=0-9" || r.Status != http.StatusPartialContent || r.Bytes != int64(len(body)) {
+			t.Errorf("unexpected request: %+v", r)
+		}
+		if r.Principal != "robot" {
+			t.Errorf("unexpected principal %q", r.Principal)
+		}
+		if strings.Contains(r.URL, "secret") {
+			t.Errorf("URL %q contains credentials", r.URL)
+		}
+	}
+}
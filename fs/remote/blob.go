@@ -45,15 +45,25 @@ import (
 	"regexp"
 
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/cache"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/util/bufferpool"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var contentRangeRegexp = regexp.MustCompile(`bytes ([0-9]+)-([0-9]+)/([0-9]+|\\*)`)
 
+// wholeBlobKey is the cache key of the whole blob, which is cached if the
+// registry ignores range requests.
+const wholeBlobKey = "whole-blob"
+
 type Blob interface {
 	Check() error
 	Size() int64
@@ -78,6 +88,25 @@ type blob struct {
 
 	resolver *Resolver
 
+	// fetchQueue is the queue of the blob's fetches in the fetch scheduler.
+	fetchQueue FetchQueue
+	// dedicatedSlot is 1 while a read of a file holds the blob's dedicated fetch slot,
+	// which doesn't count against the fetch scheduler's limit, so that every blob can
+	// always serve a read of a file.
+	dedicatedSlot int32
+
+	digest digest.Digest
+	// cache caches the whole blob if the registry sends it instead of the
+	// requested ranges, so that it's only downloaded once. It may be nil.
+	cache           cache.BlobCache
+	wholeBlobCached bool
+	rangesIgnored   bool
+	wholeBlobMu     sync.Mutex
+	// wholeBlobFetch is held while the whole blob is read into the cache,
+	// so that concurrent reads wait for it instead of downloading it again.
+	wholeBlobFetch chan struct{}
+	rangeIgnored   sync.Once
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -99,6 +128,9 @@ func (b *blob) Close() error {
 	defer b.closedMu.Unlock()
 	if !b.closed {
 		b.closed = true
+		if b.cache != nil {
+			return b.cache.Close()
+		}
 	}
 	return nil
 }
@@ -124,6 +156,19 @@ func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec
 		return fmt.Errorf("invalid size of new blob %d; want %d", newSize, b.size)
 	}
 
+	// make sure the new fetcher serves the same blob as the old one
+	b.fetcherMu.Lock()
+	old := b.fetcher
+	b.fetcherMu.Unlock()
+	if hf, ok := f.(*httpFetcher); ok {
+		if oldHF, ok := old.(*httpFetcher); ok {
+			hf.inheritETag(oldHF)
+		}
+		if err := hf.check(); err != nil {
+			return fmt.Errorf("failed to validate refreshed blob: %w", err)
+		}
+	}
+
 	// update the blob's fetcher with new one
 	b.fetcherMu.Lock()
 	b.fetcher = f
@@ -225,6 +270,33 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	if opts.ctx != nil {
 		fetchCtx = opts.ctx
 	}
+	if opts.background {
+		fetchCtx = source.WithBackgroundFetch(fetchCtx)
+	}
+
+	// Once the registry is known to ignore ranges, reads wait for the whole blob
+	// being read into the cache instead of downloading it too.
+	holdsWholeBlob := false
+	if b.ignoresRanges() {
+		release, err := b.acquireWholeBlob(fetchCtx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for the whole blob: %w", err)
+		}
+		defer release()
+		holdsWholeBlob = true
+	}
+	if ok, err := b.readCachedWholeBlob(reg, w); ok {
+		if err == nil {
+			commonmetrics.AddRemoteSourceBytes(commonmetrics.RemoteSourceBlobCache, b.digest, b.clamp(reg).size())
+		}
+		return err
+	}
+
+	release, err := b.acquireFetchSlot(fetchCtx, opts.background)
+	if err != nil {
+		return fmt.Errorf("failed to wait for a fetch slot: %w", err)
+	}
+	defer release()
 
 	var req []region
 	req = append(req, reg)
@@ -241,14 +313,19 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	b.lastCheckMu.Unlock()
 
 	for {
-		_, p, err := mr.Next()
+		preg, p, err := mr.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return fmt.Errorf("failed to read multipart resp: %w", err)
 		}
 
-		if _, err := io.CopyN(w, p, reg.size()); err != nil {
+		if preg.b == 0 && preg.size() == b.size && preg.size() != reg.size() {
+			// The registry ignored the range and sent the whole blob.
+			if err := b.readWholeBlob(p, reg, w, holdsWholeBlob); err != nil {
+				return err
+			}
+		} else if _, err := bufferpool.CopyN(w, p, reg.size()); err != nil {
 			return err
 		}
 
@@ -261,10 +338,173 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 	if !fetched {
 		return fmt.Errorf("failed to fetch region %v", reg)
 	}
+	commonmetrics.AddRemoteSourceBytes(fr.source(), b.digest, b.clamp(reg).size())
 
 	return nil
 }
 
+// acquireFetchSlot blocks until the fetch gets a fetch slot, and returns the function
+// which releases it. A read of a file takes the blob's dedicated slot if it's free, and
+// otherwise waits for a slot of the fetch scheduler ahead of background fetches.
+func (b *blob) acquireFetchSlot(ctx context.Context, background bool) (release func(), _ error) {
+	if !background && atomic.CompareAndSwapInt32(&b.dedicatedSlot, 0, 1) {
+		return func() { atomic.StoreInt32(&b.dedicatedSlot, 0) }, nil
+	}
+	return getScheduler().acquire(ctx, b.fetchQueue, background)
+}
+
+// readWholeBlob copies `reg` of the whole blob, which the registry sent instead of `reg`,
+// from `r` to `w`. The rest of the blob is read into the cache, so that the blob
+// isn't downloaded again for every read. `held` tells whether the caller already
+// holds wholeBlobFetch; otherwise the blob is only cached if no other read is caching it.
+func (b *blob) readWholeBlob(r io.Reader, reg region, w io.Writer, held bool) error {
+	b.rangeIgnored.Do(func() {
+		log.L.WithField("digest", b.digest).Warn("registry ignored range request and sent the whole layer")
+	})
+	commonmetrics.IncOperationCount(commonmetrics.RangeIgnoredCount, b.digest)
+
+	var cw cache.Writer
+	if c := b.wholeBlobCache(); c != nil && (held || b.tryAcquireWholeBlob()) {
+		if !held {
+			defer b.releaseWholeBlob()
+		}
+		var err error
+		if cw, err = c.Add(wholeBlobKey, cache.Direct()); err != nil {
+			log.L.WithField("digest", b.digest).WithError(err).Debug("failed to cache whole layer")
+			cw = nil
+		}
+	}
+	if cw == nil {
+		if _, err := io.CopyN(io.Discard, r, reg.b); err != nil {
+			return err
+		}
+		_, err := bufferpool.CopyN(w, r, b.clamp(reg).size())
+		return err
+	}
+	defer cw.Close()
+
+	tr := io.TeeReader(r, cw)
+	if _, err := io.CopyN(io.Discard, tr, reg.b); err != nil {
+		cw.Abort()
+		return err
+	}
+	if _, err := bufferpool.CopyN(w, tr, b.clamp(reg).size()); err != nil {
+		cw.Abort()
+		return err
+	}
+	// reg has been read, so failing to cache the rest of the blob doesn't fail the read.
+	n, err := io.Copy(cw, r)
+	if err == nil && b.clamp(reg).e+1+n != b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = cw.Commit()
+	} else {
+		cw.Abort()
+	}
+	if err != nil {
+		log.L.WithField("digest", b.digest).WithError(err).Debug("failed to cache whole layer")
+		return nil
+	}
+
+	b.wholeBlobMu.Lock()
+	b.wholeBlobCached = true
+	b.wholeBlobMu.Unlock()
+	b.fetchedRegionSetMu.Lock()
+	b.fetchedRegionSet.add(region{0, b.size - 1})
+	b.fetchedRegionSetMu.Unlock()
+	return nil
+}
+
+// wholeBlobCache returns the cache for the whole blob, or nil if it mustn't be cached.
+// The on-memory cache isn't used because whole layers are too large to be kept in memory.
+func (b *blob) wholeBlobCache() cache.BlobCache {
+	if _, ok := b.cache.(*cache.MemoryCache); ok {
+		return nil
+	}
+	return b.cache
+}
+
+// ignoresRanges returns true if the registry sent the whole blob for a range request
+// and the whole blob can be cached.
+func (b *blob) ignoresRanges() bool {
+	b.wholeBlobMu.Lock()
+	defer b.wholeBlobMu.Unlock()
+	return b.rangesIgnored && b.wholeBlobCache() != nil
+}
+
+func (b *blob) wholeBlobFetchLocked() chan struct{} {
+	if b.wholeBlobFetch == nil {
+		b.wholeBlobFetch = make(chan struct{}, 1)
+	}
+	return b.wholeBlobFetch
+}
+
+// acquireWholeBlob waits until no other read is caching the whole blob.
+func (b *blob) acquireWholeBlob(ctx context.Context) (func(), error) {
+	b.wholeBlobMu.Lock()
+	ch := b.wholeBlobFetchLocked()
+	b.wholeBlobMu.Unlock()
+	select {
+	case ch <- struct{}{}:
+		return b.releaseWholeBlob, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// tryAcquireWholeBlob marks the registry as ignoring ranges and returns true
+// if no other read is caching the whole blob.
+func (b *blob) tryAcquireWholeBlob() bool {
+	b.wholeBlobMu.Lock()
+	b.rangesIgnored = true
+	ch := b.wholeBlobFetchLocked()
+	b.wholeBlobMu.Unlock()
+	select {
+	case ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *blob) releaseWholeBlob() {
+	b.wholeBlobMu.Lock()
+	ch := b.wholeBlobFetchLocked()
+	b.wholeBlobMu.Unlock()
+	<-ch
+}
+
+// readCachedWholeBlob copies `reg` to `w` from the whole blob if it's cached.
+// It returns false if the blob isn't cached.
+func (b *blob) readCachedWholeBlob(reg region, w io.Writer) (bool, error) {
+	b.wholeBlobMu.Lock()
+	cached := b.wholeBlobCached
+	b.wholeBlobMu.Unlock()
+	if !cached {
+		return false, nil
+	}
+	r, err := b.cache.Get(wholeBlobKey, cache.Direct())
+	if err != nil {
+		b.wholeBlobMu.Lock()
+		b.wholeBlobCached = false
+		b.wholeBlobMu.Unlock()
+		return false, nil
+	}
+	defer r.Close()
+	reg = b.clamp(reg)
+	_, err = bufferpool.CopyN(w, io.NewSectionReader(r, reg.b, reg.size()), reg.size())
+	return true, err
+}
+
+// clamp returns `reg` without the part past the end of the blob.
+func (b *blob) clamp(reg region) region {
+	if reg.e >= b.size {
+		reg.e = b.size - 1
+	}
+	return reg
+}
+
 // fetchRange fetches content from remote blob.
 func (b *blob) fetchRange(reg region, w io.Writer, opts *options) error {
 	return b.fetchRegion(reg, w, false, opts)
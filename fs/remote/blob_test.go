@@ -53,6 +53,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
 )
 
 const (
@@ -294,8 +296,8 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 		// Check for contents
 		for j := range contentBytes {
 			for i := 0; i < int(tst.regions[j].size()); i++ {
-				if contentBytes[j][i] != []byte(tst.content)[i] {
-					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, []byte(tst.content)[i], contentBytes[j])
+				if contentBytes[j][i] != []byte(tst.content)[tst.regions[j].b+int64(i)] {
+					t.Errorf("%v test failed: the output sequence is wrong, wanted %v, got %v", tst.name, []byte(tst.content)[tst.regions[j].b+int64(i)], contentBytes[j])
 					break
 				}
 			}
@@ -303,6 +305,87 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 	}
 }
 
+func TestRangeIgnored(t *testing.T) {
+	content := "test123456"
+	newBlob := func(t *testing.T, c cache.BlobCache) (*blob, *callsCountRoundTripper) {
+		tr := &callsCountRoundTripper{
+			content: content,
+		}
+		return &blob{
+			fetcher: &httpFetcher{
+				url: "test",
+				tr:  tr,
+			},
+			size:         int64(len(content)),
+			fetchTimeout: time.Duration(defaultFetchTimeoutSec) * time.Second,
+			cache:        c,
+		}, tr
+	}
+	newDirectoryCache := func(t *testing.T) cache.BlobCache {
+		c, err := cache.NewDirectoryCache(t.TempDir(), cache.DirectoryCacheConfig{SyncAdd: true})
+		if err != nil {
+			t.Fatalf("failed to create cache: %v", err)
+		}
+		return c
+	}
+	read := func(t *testing.T, b *blob, reg region) {
+		p := make([]byte, reg.size())
+		n, err := b.ReadAt(p, reg.b)
+		if err != nil {
+			t.Errorf("failed to read %v: %v", reg, err)
+			return
+		}
+		if expected := content[reg.b : b.clamp(reg).e+1]; string(p[:n]) != expected {
+			t.Errorf("unexpected contents of %v; expected %q, got %q", reg, expected, p[:n])
+		}
+	}
+	regions := []region{{4, 7}, {0, 3}, {8, 12}}
+
+	t.Run("sequential reads", func(t *testing.T) {
+		b, tr := newBlob(t, newDirectoryCache(t))
+		for _, reg := range regions {
+			read(t, b, reg)
+		}
+		if tr.count != 1 {
+			t.Fatalf("the whole blob should be downloaded once, but was downloaded %d times", tr.count)
+		}
+		if b.FetchedSize() != b.size {
+			t.Fatalf("unexpected fetched size; expected %d, got %d", b.size, b.FetchedSize())
+		}
+	})
+
+	t.Run("concurrent reads", func(t *testing.T) {
+		b, tr := newBlob(t, newDirectoryCache(t))
+		var wg sync.WaitGroup
+		for _, reg := range regions {
+			reg := reg
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				read(t, b, reg)
+			}()
+		}
+		wg.Wait()
+		downloads := atomic.LoadInt64(&tr.count)
+		for _, reg := range regions {
+			read(t, b, reg)
+		}
+		if tr.count != downloads {
+			t.Fatalf("the whole blob should be cached after the first reads, but was downloaded %d more times", tr.count-downloads)
+		}
+	})
+
+	t.Run("memory cache", func(t *testing.T) {
+		b, tr := newBlob(t, cache.NewMemoryCache())
+		for _, reg := range regions {
+			read(t, b, reg)
+		}
+		if tr.count != int64(len(regions)) {
+			t.Fatalf("the whole blob shouldn't be cached in memory, but was downloaded %d times", tr.count)
+		}
+	})
+}
+
 func makeTestBlob(t *testing.T, size int64, fn RoundTripFunc) *blob {
 	var (
 		lastCheck     time.Time
@@ -0,0 +1,191 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// defaultFaultInjector is the *faultInjector which injects faults into requests to remote
+// registries, if any.
+var defaultFaultInjector atomic.Value
+
+func init() {
+	SetFaultInjection(config.FaultInjectionConfig{})
+}
+
+// SetFaultInjection injects the faults of cfg into the requests of fetchers created afterwards.
+// This is for testing only.
+func SetFaultInjection(cfg config.FaultInjectionConfig) {
+	var f *faultInjector
+	if cfg.Enabled() {
+		f = &faultInjector{cfg: cfg, rand: rand.New(rand.NewSource(cfg.Seed))}
+	}
+	defaultFaultInjector.Store(f)
+}
+
+func getFaultInjector() *faultInjector {
+	return defaultFaultInjector.Load().(*faultInjector)
+}
+
+// faultInjector chooses the faults of each request from a seeded random source, so the
+// same sequence of requests gets the same faults.
+type faultInjector struct {
+	cfg  config.FaultInjectionConfig
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// faults are the faults injected into a single request.
+type faults struct {
+	tooManyRequests bool
+	truncate        bool
+	corrupt         bool
+	// position is where the body is truncated or corrupted, as a fraction of its length.
+	position float64
+}
+
+func (f *faultInjector) next() faults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// All values are drawn for every request so that each request uses the same
+	// number of values of the random source, regardless of the faults chosen.
+	return faults{
+		tooManyRequests: f.rand.Float64() < f.cfg.TooManyRequestsRate,
+		truncate:        f.rand.Float64() < f.cfg.TruncateRate,
+		corrupt:         f.rand.Float64() < f.cfg.CorruptRate,
+		position:        f.rand.Float64(),
+	}
+}
+
+// withFaultInjection returns tr, injecting faults into its requests if fault injection is enabled.
+func withFaultInjection(tr http.RoundTripper) http.RoundTripper {
+	f := getFaultInjector()
+	if f == nil {
+		return tr
+	}
+	if _, ok := tr.(*faultTransport); ok {
+		return tr
+	}
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+	return &faultTransport{inner: tr, injector: f}
+}
+
+// injectFaults injects faults into the requests of tr if fault injection is enabled. If tr
+// retries requests, the faults are injected below the retries so that they're exercised too.
+func injectFaults(tr http.RoundTripper) http.RoundTripper {
+	if rt, ok := tr.(*rhttp.RoundTripper); ok && rt.Client != nil && rt.Client.HTTPClient != nil {
+		rt.Client.HTTPClient.Transport = withFaultInjection(rt.Client.HTTPClient.Transport)
+		return tr
+	}
+	return withFaultInjection(tr)
+}
+
+// faultTransport injects faults into the requests of inner.
+type faultTransport struct {
+	inner    http.RoundTripper
+	injector *faultInjector
+}
+
+func (tr *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return tr.roundTrip(req, tr.injector.next())
+}
+
+func (tr *faultTransport) roundTrip(req *http.Request, faults faults) (*http.Response, error) {
+	if latency := time.Duration(tr.injector.cfg.LatencyMsec) * time.Millisecond; latency > 0 {
+		t := time.NewTimer(latency)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	if faults.tooManyRequests {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     "429 Too Many Requests",
+			StatusCode: http.StatusTooManyRequests,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+	resp, err := tr.inner.RoundTrip(req)
+	if err != nil || resp.StatusCode/100 != 2 || resp.ContentLength <= 0 {
+		return resp, err
+	}
+	pos := int64(faults.position * float64(resp.ContentLength))
+	if faults.corrupt {
+		resp.Body = &corruptBody{ReadCloser: resp.Body, pos: pos}
+	}
+	if faults.truncate {
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: pos}
+	}
+	return resp, nil
+}
+
+// truncatedBody ends with io.ErrUnexpectedEOF after the remaining bytes, like a body
+// whose connection is closed early.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// corruptBody flips the bits of the byte at pos.
+type corruptBody struct {
+	io.ReadCloser
+	off int64
+	pos int64
+}
+
+func (b *corruptBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if i := b.pos - b.off; i >= 0 && i < int64(n) {
+		p[i] ^= 0xff
+	}
+	b.off += int64(n)
+	return n, err
+}
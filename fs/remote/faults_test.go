@@ -0,0 +1,145 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+func TestFaultInjectorDeterministic(t *testing.T) {
+	cfg := config.FaultInjectionConfig{Seed: 42, TooManyRequestsRate: 0.3, TruncateRate: 0.3, CorruptRate: 0.3}
+	sequence := func() []faults {
+		SetFaultInjection(cfg)
+		defer SetFaultInjection(config.FaultInjectionConfig{})
+		f := getFaultInjector()
+		var s []faults
+		for i := 0; i < 100; i++ {
+			s = append(s, f.next())
+		}
+		return s
+	}
+	first, second := sequence(), sequence()
+	if !reflect.DeepEqual(first, second) {
+		t.Fatal("the same seed produced different faults")
+	}
+	var tooManyRequests int
+	for _, f := range first {
+		if f.tooManyRequests {
+			tooManyRequests++
+		}
+	}
+	if tooManyRequests == 0 || tooManyRequests == len(first) {
+		t.Fatalf("unexpected number of 429s: %d of %d", tooManyRequests, len(first))
+	}
+}
+
+func TestFaultTransport(t *testing.T) {
+	body := []byte("0123456789")
+	var sent int
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{
+			StatusCode:    http.StatusPartialContent,
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+	tests := []struct {
+		name          string
+		faults        faults
+		expectedSent  int
+		expectedCode  int
+		expectedBody  []byte
+		expectedError error
+	}{
+		{
+			name:         "no faults",
+			expectedSent: 1,
+			expectedCode: http.StatusPartialContent,
+			expectedBody: body,
+		},
+		{
+			name:         "too many requests",
+			faults:       faults{tooManyRequests: true},
+			expectedCode: http.StatusTooManyRequests,
+			expectedBody: []byte{},
+		},
+		{
+			name:          "truncated",
+			faults:        faults{truncate: true, position: 0.5},
+			expectedSent:  1,
+			expectedCode:  http.StatusPartialContent,
+			expectedBody:  body[:5],
+			expectedError: io.ErrUnexpectedEOF,
+		},
+		{
+			name:         "corrupted",
+			faults:       faults{corrupt: true, position: 0.35},
+			expectedSent: 1,
+			expectedCode: http.StatusPartialContent,
+			expectedBody: append(append(append([]byte{}, body[:3]...), body[3]^0xff), body[4:]...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent = 0
+			tr := &faultTransport{inner: inner, injector: &faultInjector{}}
+			resp, err := tr.roundTrip(&http.Request{}, tt.faults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.expectedCode {
+				t.Fatalf("unexpected status %d", resp.StatusCode)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if !errors.Is(err, tt.expectedError) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !bytes.Equal(got, tt.expectedBody) {
+				t.Fatalf("unexpected body %q", got)
+			}
+			if sent != tt.expectedSent {
+				t.Fatalf("unexpected number of requests sent: %d", sent)
+			}
+		})
+	}
+}
+
+func TestFaultTransportLatencyCanceled(t *testing.T) {
+	tr := &faultTransport{
+		inner:    roundTripperFunc(func(*http.Request) (*http.Response, error) { t.Fatal("request was sent"); return nil, nil }),
+		injector: &faultInjector{cfg: config.FaultInjectionConfig{LatencyMsec: 60000}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://registry.example.com/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.roundTrip(req, faults{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRedirectTTL is how long redirect targets without a known expiry are reused for.
+	defaultRedirectTTL = 10 * time.Minute
+
+	// redirectExpiryMargin is how long before a signed URL expires it's refreshed, so that
+	// span reads don't hit an expired URL while they're in flight.
+	redirectExpiryMargin = 30 * time.Second
+
+	// amzDateFormat is the format of the X-Amz-Date query parameter of S3 SigV4 presigned URLs.
+	amzDateFormat = "20060102T150405Z"
+)
+
+// redirectCache caches the targets blob URLs redirect to (e.g. S3 or CloudFront signed URLs
+// for ECR), so that fetchers of the same blob read spans from the target directly
+// instead of doing a redirect round trip each.
+type redirectCache struct {
+	mu      sync.Mutex
+	targets map[string]redirectTarget
+	now     func() time.Time
+}
+
+type redirectTarget struct {
+	url     string
+	expires time.Time
+	// signed is true if url is a signed URL which expires at expires.
+	signed bool
+}
+
+func newRedirectCache() *redirectCache {
+	return &redirectCache{
+		targets: make(map[string]redirectTarget),
+		now:     time.Now,
+	}
+}
+
+// get returns the cached target of key, if it doesn't expire soon.
+// Keys are returned by redirectKey.
+func (c *redirectCache) get(key string) (redirectTarget, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.targets[key]
+	if !ok {
+		return redirectTarget{}, false
+	}
+	if c.expiresSoon(t) {
+		delete(c.targets, key)
+		return redirectTarget{}, false
+	}
+	return t, true
+}
+
+// target returns targetURL with its expiry, without caching it.
+func (c *redirectCache) target(targetURL string) redirectTarget {
+	t := redirectTarget{url: targetURL, expires: c.now().Add(defaultRedirectTTL)}
+	if expires, ok := signedURLExpiry(targetURL); ok {
+		t.expires = expires
+		t.signed = true
+	}
+	return t
+}
+
+// add caches targetURL as the target of key and returns it with its expiry.
+func (c *redirectCache) add(key, targetURL string) redirectTarget {
+	t := c.target(targetURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.targets {
+		if c.expiresSoon(v) {
+			delete(c.targets, k)
+		}
+	}
+	c.targets[key] = t
+	return t
+}
+
+// signedExpiry returns when the target expires if it's a signed URL, or zero otherwise.
+func (t redirectTarget) signedExpiry() time.Time {
+	if !t.signed {
+		return time.Time{}
+	}
+	return t.expires
+}
+
+func (c *redirectCache) expiresSoon(t redirectTarget) bool {
+	return !c.now().Before(t.expires.Add(-redirectExpiryMargin))
+}
+
+// signedURLExpiry returns when the signed URL rawURL expires, if it's an S3
+// presigned URL (SigV4 or SigV2) or a CloudFront signed URL with a canned policy.
+func signedURLExpiry(rawURL string) (time.Time, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	q := u.Query()
+	if date, expires := q.Get("X-Amz-Date"), q.Get("X-Amz-Expires"); date != "" && expires != "" {
+		signed, err := time.Parse(amzDateFormat, date)
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || sec < 0 {
+			return time.Time{}, false
+		}
+		return signed.Add(time.Duration(sec) * time.Second), true
+	}
+	if expires := q.Get("Expires"); expires != "" {
+		sec, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || sec < 0 {
+			return time.Time{}, false
+		}
+		return time.Unix(sec, 0), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSignedURLExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		expected time.Time
+		ok       bool
+	}{
+		{
+			name:     "s3 sigv4",
+			url:      "https://bucket.s3.amazonaws.com/blob?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Date=20230102T030405Z&X-Amz-Expires=3600&X-Amz-Signature=abc",
+			expected: time.Date(2023, 1, 2, 4, 4, 5, 0, time.UTC),
+			ok:       true,
+		},
+		{
+			name:     "cloudfront canned policy",
+			url:      "https://d111111abcdef8.cloudfront.net/blob?Expires=1672628645&Signature=abc&Key-Pair-Id=K",
+			expected: time.Unix(1672628645, 0),
+			ok:       true,
+		},
+		{
+			name: "invalid sigv4 date",
+			url:  "https://bucket.s3.amazonaws.com/blob?X-Amz-Date=yesterday&X-Amz-Expires=3600",
+		},
+		{
+			name: "unsigned",
+			url:  "https://registry.example.com/v2/repo/blobs/sha256:abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expires, ok := signedURLExpiry(tt.url)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%t, got %t", tt.ok, ok)
+			}
+			if !expires.Equal(tt.expected) {
+				t.Fatalf("expected expiry %v, got %v", tt.expected, expires)
+			}
+		})
+	}
+}
+
+func TestRedirectCacheExpiry(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newRedirectCache()
+	c.now = func() time.Time { return now }
+
+	signedURL := fmt.Sprintf("https://bucket.s3.amazonaws.com/blob?X-Amz-Date=%s&X-Amz-Expires=120", now.Format(amzDateFormat))
+	if target := c.add("signed", signedURL); !target.signed || !target.signedExpiry().Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("unexpected target %+v", target)
+	}
+	if target := c.add("unsigned", "https://registry.example.com/blob"); target.signed || !target.signedExpiry().IsZero() {
+		t.Fatalf("unexpected target %+v", target)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("signed"); !ok {
+		t.Fatal("expected signed URL to be cached before it expires")
+	}
+	now = now.Add(time.Minute - redirectExpiryMargin)
+	if _, ok := c.get("signed"); ok {
+		t.Fatal("expected signed URL not to be reused right before it expires")
+	}
+	if _, ok := c.get("unsigned"); !ok {
+		t.Fatal("expected unsigned URL to be cached")
+	}
+	now = now.Add(defaultRedirectTTL)
+	if _, ok := c.get("unsigned"); ok {
+		t.Fatal("expected unsigned URL to be dropped after the default TTL")
+	}
+}
+
+func TestRedirectReused(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	blobDigest := digest.FromString("dummy")
+	expires := time.Now().Add(time.Hour).UTC().Format(amzDateFormat)
+	signedURL := "https://bucket.s3.amazonaws.com/blob?X-Amz-Date=" + expires + "&X-Amz-Expires=3600"
+	tr := &countingRoundTripper{inner: &sampleRoundTripper{
+		redirectURL: map[string]string{regexp.QuoteMeta("dummyexample.com"): signedURL},
+		okURLs:      []string{regexp.QuoteMeta("bucket.s3.amazonaws.com")},
+	}}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	fc := &fetcherConfig{
+		hosts:     hosts,
+		refspec:   refspec,
+		desc:      ocispec.Descriptor{Digest: blobDigest},
+		redirects: newRedirectCache(),
+	}
+	for i := 0; i < 2; i++ {
+		f, err := newHTTPFetcher(context.Background(), fc)
+		if err != nil {
+			t.Fatalf("failed to create fetcher: %v", err)
+		}
+		if f.url != signedURL {
+			t.Fatalf("expected fetcher to read from %q, got %q", signedURL, f.url)
+		}
+		if f.urlExpiresSoon() {
+			t.Fatal("expected signed URL not to expire soon")
+		}
+	}
+	if tr.count("dummyexample.com") != 1 {
+		t.Fatalf("expected the blob to be redirected once, got %d requests to the registry", tr.count("dummyexample.com"))
+	}
+}
+
+type countingRoundTripper struct {
+	inner http.RoundTripper
+	urls  []string
+}
+
+func (tr *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.urls = append(tr.urls, req.URL.String())
+	return tr.inner.RoundTrip(req)
+}
+
+func (tr *countingRoundTripper) count(host string) (n int) {
+	for _, u := range tr.urls {
+		if strings.Contains(u, host) {
+			n++
+		}
+	}
+	return
+}
+
+func TestRedirectNotReusedAcrossCredentials(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	blobDigest := digest.FromString("dummy")
+	expires := time.Now().Add(time.Hour).UTC().Format(amzDateFormat)
+	signedURL := "https://bucket.s3.amazonaws.com/blob?X-Amz-Date=" + expires + "&X-Amz-Expires=3600"
+	tr := &countingRoundTripper{inner: &sampleRoundTripper{
+		redirectURL: map[string]string{regexp.QuoteMeta("dummyexample.com"): signedURL},
+		okURLs:      []string{regexp.QuoteMeta("bucket.s3.amazonaws.com")},
+	}}
+	hostsWithToken := func(token string) source.RegistryHosts {
+		return func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       &http.Client{Transport: tr},
+				Authorizer:   tokenAuthorizer(token),
+				Host:         refspec.Hostname(),
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			}}, nil
+		}
+	}
+	redirects := newRedirectCache()
+	for _, token := range []string{"a", "b", "a"} {
+		fc := &fetcherConfig{
+			hosts:     hostsWithToken(token),
+			refspec:   refspec,
+			desc:      ocispec.Descriptor{Digest: blobDigest},
+			redirects: redirects,
+		}
+		if _, err := newHTTPFetcher(context.Background(), fc); err != nil {
+			t.Fatalf("failed to create fetcher: %v", err)
+		}
+	}
+	// the target authorized with token "a" isn't reused with token "b".
+	if tr.count("dummyexample.com") != 2 {
+		t.Fatalf("expected the blob to be redirected once per credentials, got %d requests to the registry", tr.count("dummyexample.com"))
+	}
+}
+
+// tokenAuthorizer authorizes every request with a bearer token.
+type tokenAuthorizer string
+
+func (a tokenAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(a))
+	return nil
+}
+
+func (a tokenAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	return nil
+}
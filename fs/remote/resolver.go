@@ -41,6 +41,7 @@ package remote
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -102,18 +103,22 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	return &Resolver{
 		blobConfig: cfg,
 		handlers:   handlers,
+		redirects:  newRedirectCache(),
 	}
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
 	handlers   map[string]Handler
+	redirects  *redirectCache
 }
 
 type fetcher interface {
 	fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error)
 	check() error
 	genID(reg region) string
+	// source returns the kind of source the blob is fetched from, e.g. commonmetrics.RemoteSourceMirror.
+	source() string
 }
 
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (Blob, error) {
@@ -122,12 +127,16 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		return nil, err
 	}
 	blobConfig := &r.blobConfig
-	return makeBlob(f,
+	b := makeBlob(f,
 		size,
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		time.Duration(blobConfig.FetchTimeoutSec)*time.Second)
+	b.fetchQueue = fetchQueueFromContext(ctx)
+	b.digest = desc.Digest
+	b.cache = blobCache
+	return b, nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
@@ -139,6 +148,7 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 		maxRetries: blobConfig.MaxRetries,
 		minWait:    time.Duration(blobConfig.MinWaitMsec) * time.Millisecond,
 		maxWait:    time.Duration(blobConfig.MaxWaitMsec) * time.Millisecond,
+		redirects:  r.redirects,
 	}
 	var handlersErr error
 	for name, p := range r.handlers {
@@ -163,9 +173,15 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 	if err != nil {
 		return nil, 0, err
 	}
+	if blobConfig.PreCheck {
+		if err := hf.preCheck(ctx, desc.Size); err != nil {
+			return nil, 0, fmt.Errorf("pre-check of layer %s failed: %w", desc.Digest, err)
+		}
+	}
 	if blobConfig.ForceSingleRangeMode {
 		hf.singleRangeMode()
 	}
+	hf.timeouts = newFetchTimeouts(*blobConfig)
 	return hf, desc.Size, err
 }
 
@@ -176,6 +192,7 @@ type fetcherConfig struct {
 	maxRetries int
 	minWait    time.Duration
 	maxWait    time.Duration
+	redirects  *redirectCache
 }
 
 // jitter returns a number in the range duration to duration+(duration/divisor)-1, inclusive
@@ -223,7 +240,20 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error
 
 	// Try to create fetcher until succeeded
 	rErr := fmt.Errorf("failed to resolve")
-	for _, host := range reghosts {
+
+	// Foreign layers (e.g. Windows base layers) list the URLs they're distributed from,
+	// which are tried before the registry like containerd does.
+	for _, u := range desc.URLs {
+		f, err := newURLFetcher(ctx, u, reghosts, pullScope, fc.refspec.String(), digest, fc.redirects)
+		if err != nil {
+			rErr = fmt.Errorf("failed to fetch from layer URL (url %q, ref:%q, digest:%q): %v: %w",
+				u, fc.refspec, digest, err, rErr)
+			continue // Try another
+		}
+		return f, nil
+	}
+
+	for i, host := range reghosts {
 		if host.Host == "" || strings.Contains(host.Host, "/") {
 			rErr = fmt.Errorf("invalid destination (host %q, ref:%q, digest:%q): %w",
 				host.Host, fc.refspec, digest, rErr)
@@ -241,6 +271,7 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error
 			rt.Client.Backoff = backoffStrategy
 			rt.Client.CheckRetry = retryStrategy
 		}
+		tr = WithAuditLog(ctx, injectFaults(tr), fc.refspec.String(), digest)
 
 		timeout := host.Client.Timeout
 		if host.Authorizer != nil {
@@ -257,26 +288,82 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error
 			path.Join(host.Host, host.Path),
 			strings.TrimPrefix(fc.refspec.Locator, fc.refspec.Hostname()+"/"),
 			digest)
-		url, err := redirect(ctx, blobURL, tr, timeout)
+		target, err := resolveRedirect(ctx, fc.redirects, blobURL, pullScope, digest, tr, timeout)
 		if err != nil {
 			rErr = fmt.Errorf("failed to redirect (host %q, ref:%q, digest:%q): %v: %w",
 				host.Host, fc.refspec, digest, err, rErr)
 			continue // Try another
 		}
 
+		// The registry of the image is the last host; the hosts before it are its mirrors.
+		kind := commonmetrics.RemoteSourceRegistry
+		if i < len(reghosts)-1 {
+			kind = commonmetrics.RemoteSourceMirror
+		}
+
 		// Hit one destination
 		return &httpFetcher{
-			url:     url,
-			tr:      tr,
-			blobURL: blobURL,
-			digest:  digest,
-			timeout: timeout,
+			url:        target.url,
+			urlExpires: target.signedExpiry(),
+			tr:         tr,
+			blobURL:    blobURL,
+			scope:      pullScope,
+			digest:     digest,
+			timeout:    timeout,
+			redirects:  fc.redirects,
+			kind:       kind,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("cannot resolve layer: %w", rErr)
 }
 
+// newURLFetcher returns a fetcher of the foreign layer at rawURL. The transport of the
+// registry hosts is reused to get the same retries, but registry credentials are only
+// sent if rawURL is on one of the registry hosts. Requests are audited as made on behalf of image.
+func newURLFetcher(ctx context.Context, rawURL string, reghosts []docker.RegistryHost, pullScope, image string, digest digest.Digest, redirects *redirectCache) (*httpFetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if len(reghosts) == 0 {
+		return nil, fmt.Errorf("no registry host is configured")
+	}
+	host := reghosts[0]
+	for _, h := range reghosts {
+		if h.Host == u.Host {
+			host = h
+			break
+		}
+	}
+	tr := WithAuditLog(ctx, injectFaults(host.Client.Transport), image, digest)
+	if host.Authorizer != nil && host.Host == u.Host {
+		tr = &transport{
+			inner: tr,
+			auth:  host.Authorizer,
+			scope: pullScope,
+		}
+	}
+	target, err := resolveRedirect(ctx, redirects, rawURL, pullScope, digest, tr, host.Client.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFetcher{
+		url:        target.url,
+		urlExpires: target.signedExpiry(),
+		tr:         tr,
+		blobURL:    rawURL,
+		scope:      pullScope,
+		digest:     digest,
+		timeout:    host.Client.Timeout,
+		redirects:  redirects,
+		kind:       commonmetrics.RemoteSourceURL,
+	}, nil
+}
+
 type transport struct {
 	inner http.RoundTripper
 	auth  docker.Authorizer
@@ -319,7 +406,53 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
-func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout time.Duration) (url string, err error) {
+// resolveRedirect returns the target blobURL redirects to, reusing the cached target
+// if redirects has one that doesn't expire soon and was authorized for the same scope
+// and credentials.
+func resolveRedirect(ctx context.Context, redirects *redirectCache, blobURL, scope string, dgst digest.Digest, tr http.RoundTripper, timeout time.Duration) (redirectTarget, error) {
+	if redirects == nil {
+		url, err := redirect(ctx, blobURL, dgst, tr, timeout)
+		return redirectTarget{url: url}, err
+	}
+	if key, err := redirectKey(ctx, tr, blobURL, scope); err == nil {
+		if t, ok := redirects.get(key); ok {
+			return t, nil
+		}
+	}
+	url, err := redirect(ctx, blobURL, dgst, tr, timeout)
+	if err != nil {
+		return redirectTarget{}, err
+	}
+	key, err := redirectKey(ctx, tr, blobURL, scope)
+	if err != nil {
+		return redirects.target(url), nil
+	}
+	return redirects.add(key, url), nil
+}
+
+// redirectKey returns the key of the target of blobURL in the redirect cache.
+// A target is only reused by fetchers with the same scope which authorize blobURL with
+// the same credentials, since the target is readable without authorization. The
+// credentials are checked with the authorizer of tr, which doesn't reach the registry
+// if it has a token for the scope already.
+func redirectKey(ctx context.Context, tr http.RoundTripper, blobURL, scope string) (string, error) {
+	var principal string
+	if t, ok := tr.(*transport); ok {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+		if err != nil {
+			return "", err
+		}
+		if err := t.auth.Authorize(docker.WithScope(ctx, t.scope), req); err != nil {
+			return "", err
+		}
+		if a := req.Header.Get("Authorization"); a != "" {
+			principal = digest.FromString(a).String()
+		}
+	}
+	return strings.Join([]string{blobURL, scope, principal}, "\n"), nil
+}
+
+func redirect(ctx context.Context, blobURL string, dgst digest.Digest, tr http.RoundTripper, timeout time.Duration) (url string, err error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -343,6 +476,10 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 		res.Body.Close()
 	}()
 
+	if err := checkContentDigest(res, dgst); err != nil {
+		return "", err
+	}
+
 	if res.StatusCode/100 == 2 {
 		url = blobURL
 	} else if redir := res.Header.Get("Location"); redir != "" && res.StatusCode/100 == 3 {
@@ -357,13 +494,22 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 
 type httpFetcher struct {
 	url           string
+	urlExpires    time.Time // zero if the url doesn't expire
 	urlMu         sync.Mutex
 	tr            http.RoundTripper
 	blobURL       string
+	scope         string // the repository scope the blob is authorized for
 	digest        digest.Digest
 	singleRange   bool
 	singleRangeMu sync.Mutex
 	timeout       time.Duration
+	timeouts      fetchTimeouts // bound the phases of fetches
+	redirects     *redirectCache
+	kind          string // the kind of source, e.g. commonmetrics.RemoteSourceMirror
+	// etag is the first strong ETag the blob was served with, by etagHost.
+	etag     string
+	etagHost string
+	etagMu   sync.Mutex
 }
 
 type multipartReadCloser interface {
@@ -371,7 +517,7 @@ type multipartReadCloser interface {
 	Close() error
 }
 
-func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (_ multipartReadCloser, retErr error) {
 	if len(rs) == 0 {
 		return nil, fmt.Errorf("no request queried")
 	}
@@ -395,12 +541,21 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		requests = []region{superRegion(requests)}
 	}
 
+	// Refresh signed URLs before they expire, instead of waiting for them to be rejected.
+	if f.urlExpiresSoon() {
+		if err := f.refreshURL(ctx); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to refresh URL before it expires")
+		}
+	}
+
 	// Request to the registry
 	f.urlMu.Lock()
 	url := f.url
 	f.urlMu.Unlock()
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	reqCtx, watchdog := f.timeouts.watch(ctx)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
 	if err != nil {
+		watchdog.stop()
 		return nil, err
 	}
 	var ranges string
@@ -409,6 +564,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 	}
 	req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
 	req.Header.Add("Accept-Encoding", "identity")
+	f.setIfMatch(req)
 	req.Close = false
 
 	// Recording the roundtrip latency for remote registry GET operation.
@@ -416,6 +572,16 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 	res, err := tr.RoundTrip(req) // NOT DefaultClient; don't want redirects
 	commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.RemoteRegistryGet, f.digest, start)
 	if err != nil {
+		watchdog.stop()
+		return nil, watchdog.wrap(err)
+	}
+	res.Body = watchdog.body(res.Body)
+	defer func() {
+		if retErr != nil {
+			res.Body.Close()
+		}
+	}()
+	if err := f.validate(req, res); err != nil {
 		return nil, err
 	}
 	if res.StatusCode == http.StatusOK {
@@ -445,6 +611,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		log.G(ctx).Infof("Received status code: %v. Refreshing URL and retrying...", res.Status)
 
 		// re-redirect and retry this once.
+		res.Body.Close()
 		if err := f.refreshURL(ctx); err != nil {
 			return nil, fmt.Errorf("failed to refresh URL on %v: %w", res.Status, err)
 		}
@@ -453,6 +620,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		log.G(ctx).Infof("Received status code: %v. Setting single range mode and retrying...", res.Status)
 
 		// gcr.io (https://storage.googleapis.com) returns 400 on multi-range request (2020 #81)
+		res.Body.Close()
 		f.singleRangeMode()            // fallbacks to singe range request mode
 		return f.fetch(ctx, rs, false) // retries with the single range mode
 	}
@@ -476,6 +644,7 @@ func (f *httpFetcher) check() error {
 	}
 	req.Close = false
 	req.Header.Set("Range", "bytes=0-1")
+	f.setIfMatch(req)
 	res, err := f.tr.RoundTrip(req)
 	if err != nil {
 		return fmt.Errorf("check failed: failed to request to registry: %w", err)
@@ -484,6 +653,9 @@ func (f *httpFetcher) check() error {
 		io.Copy(io.Discard, res.Body)
 		res.Body.Close()
 	}()
+	if err := f.validate(req, res); err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	}
 	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
 		return nil
 	} else if res.StatusCode == http.StatusForbidden {
@@ -503,22 +675,136 @@ func (f *httpFetcher) check() error {
 	return fmt.Errorf("unexpected status code %v", res.StatusCode)
 }
 
+var (
+	// ErrBlobNotFound is returned by the pre-check of a blob which doesn't exist in the registry.
+	ErrBlobNotFound = errors.New("blob not found")
+	// ErrRangeNotSupported is returned by the pre-check of a blob which can't be fetched with range requests.
+	ErrRangeNotSupported = errors.New("range requests not supported")
+)
+
+// preCheck checks that the blob exists and has the expected size with a HEAD request,
+// and that it can be fetched with range requests, so that a blob which can't be lazily
+// loaded is found before it's mounted rather than when it's read.
+//
+// Range support is taken from the Accept-Ranges header of the HEAD response if the
+// registry serves the blob itself. Otherwise, e.g. if the blob is redirected to a
+// signed URL, which is only valid for GET requests, a range of the blob is fetched.
+func (f *httpFetcher) preCheck(ctx context.Context, size int64) error {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", f.blobURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	req.Close = false
+	res, err := f.tr.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("failed to request to registry: %w", err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err := checkContentDigest(res, f.digest); err != nil {
+		return err
+	}
+	f.urlMu.Lock()
+	url := f.url
+	f.urlMu.Unlock()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s: %w", f.digest, ErrBlobNotFound)
+	case res.StatusCode/100 == 2:
+		if size > 0 && res.ContentLength >= 0 && res.ContentLength != size {
+			return fmt.Errorf("unexpected size of %s: expected %d, got %d", f.digest, size, res.ContentLength)
+		}
+		switch res.Header.Get("Accept-Ranges") {
+		case "bytes":
+			return nil
+		case "none":
+			return fmt.Errorf("%s: %w", f.digest, ErrRangeNotSupported)
+		}
+	case res.StatusCode/100 == 3:
+		// The Accept-Ranges of a redirect says nothing about its target, so the range
+		// request is made to the target of this redirect.
+		loc, err := res.Location()
+		if err != nil {
+			return fmt.Errorf("redirect of %s without location: %w", f.digest, err)
+		}
+		url = loc.String()
+	default:
+		return fmt.Errorf("unexpected status code %v", res.StatusCode)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	req.Close = false
+	req.Header.Set("Range", "bytes=0-1")
+	res, err = f.tr.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("failed to request to registry: %w", err)
+	}
+	if res.StatusCode == http.StatusOK {
+		// The body is the whole blob, so the connection is closed instead of draining it.
+		res.Body.Close()
+		return fmt.Errorf("%s: %w", f.digest, ErrRangeNotSupported)
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w", f.digest, ErrBlobNotFound)
+	}
+	return fmt.Errorf("unexpected status code %v", res.StatusCode)
+}
+
 func (f *httpFetcher) refreshURL(ctx context.Context) error {
-	newURL, err := redirect(ctx, f.blobURL, f.tr, f.timeout)
+	newURL, err := redirect(ctx, f.blobURL, f.digest, f.tr, f.timeout)
 	if err != nil {
 		return err
 	}
+	var expires time.Time
+	if f.redirects != nil {
+		if key, err := redirectKey(ctx, f.tr, f.blobURL, f.scope); err == nil {
+			expires = f.redirects.add(key, newURL).signedExpiry()
+		} else {
+			expires = f.redirects.target(newURL).signedExpiry()
+		}
+	}
 	f.urlMu.Lock()
 	f.url = newURL
+	f.urlExpires = expires
 	f.urlMu.Unlock()
 	return nil
 }
 
+// urlExpiresSoon returns true if the url is a signed URL which is about to expire.
+func (f *httpFetcher) urlExpiresSoon() bool {
+	f.urlMu.Lock()
+	expires := f.urlExpires
+	f.urlMu.Unlock()
+	return !expires.IsZero() && !time.Now().Before(expires.Add(-redirectExpiryMargin))
+}
+
 func (f *httpFetcher) genID(reg region) string {
 	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.blobURL, reg.b, reg.e)))
 	return fmt.Sprintf("%x", sum)
 }
 
+func (f *httpFetcher) source() string {
+	if f.kind == "" {
+		return commonmetrics.RemoteSourceRegistry
+	}
+	return f.kind
+}
+
 func (f *httpFetcher) singleRangeMode() {
 	f.singleRangeMu.Lock()
 	f.singleRange = true
@@ -603,8 +889,9 @@ func parseRange(header string) (region, int64, error) {
 type Option func(*options)
 
 type options struct {
-	ctx       context.Context
-	cacheOpts []cache.Option
+	ctx        context.Context
+	cacheOpts  []cache.Option
+	background bool
 }
 
 func WithContext(ctx context.Context) Option {
@@ -619,6 +906,15 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// WithBackgroundFetch marks a read as hydrating the blob in the background. Reads of
+// files are served before background reads by the fetch scheduler, and may be sent
+// over other connections by the clients of the registry hosts.
+func WithBackgroundFetch() Option {
+	return func(opts *options) {
+		opts.background = true
+	}
+}
+
 // NOTE: ported from https://github.com/containerd/containerd/blob/v1.5.2/remotes/docker/scope.go#L29-L42
 // TODO: import this from containerd package once we drop support to continerd v1.4.x
 //
@@ -662,6 +958,10 @@ func (r *remoteFetcher) genID(reg region) string {
 	return r.r.GenID(reg.b, reg.size())
 }
 
+func (r *remoteFetcher) source() string {
+	return commonmetrics.RemoteSourceHandler
+}
+
 type Handler interface {
 	Handle(ctx context.Context, desc ocispec.Descriptor) (fetcher Fetcher, size int64, err error)
 }
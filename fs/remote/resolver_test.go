@@ -41,14 +41,18 @@ package remote
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	rhttp "github.com/hashicorp/go-retryablehttp"
@@ -70,23 +74,27 @@ func TestMirror(t *testing.T) {
 	)
 
 	tests := []struct {
-		name     string
-		tr       http.RoundTripper
-		mirrors  []string
-		wantHost string
-		error    bool
+		name       string
+		tr         http.RoundTripper
+		mirrors    []string
+		urls       []string
+		wantHost   string
+		wantSource string
+		error      bool
 	}{
 		{
-			name:     "no-mirror",
-			tr:       &sampleRoundTripper{okURLs: []string{refHost}},
-			mirrors:  nil,
-			wantHost: refHost,
+			name:       "no-mirror",
+			tr:         &sampleRoundTripper{okURLs: []string{refHost}},
+			mirrors:    nil,
+			wantHost:   refHost,
+			wantSource: commonmetrics.RemoteSourceRegistry,
 		},
 		{
-			name:     "valid-mirror",
-			tr:       &sampleRoundTripper{okURLs: []string{"mirrorexample.com"}},
-			mirrors:  []string{"mirrorexample.com"},
-			wantHost: "mirrorexample.com",
+			name:       "valid-mirror",
+			tr:         &sampleRoundTripper{okURLs: []string{"mirrorexample.com"}},
+			mirrors:    []string{"mirrorexample.com"},
+			wantHost:   "mirrorexample.com",
+			wantSource: commonmetrics.RemoteSourceMirror,
 		},
 		{
 			name: "invalid-mirror",
@@ -104,7 +112,8 @@ func TestMirror(t *testing.T) {
 				"mirrorexample3.com",
 				"mirrorexample4.com",
 			},
-			wantHost: "mirrorexample4.com",
+			wantHost:   "mirrorexample4.com",
+			wantSource: commonmetrics.RemoteSourceMirror,
 		},
 		{
 			name: "invalid-all-mirror",
@@ -121,15 +130,17 @@ func TestMirror(t *testing.T) {
 				"mirrorexample2.com",
 				"mirrorexample3.com",
 			},
-			wantHost: refHost,
+			wantHost:   refHost,
+			wantSource: commonmetrics.RemoteSourceRegistry,
 		},
 		{
 			name: "invalid-hostname-of-mirror",
 			tr: &sampleRoundTripper{
 				okURLs: []string{`.*`},
 			},
-			mirrors:  []string{"mirrorexample.com/somepath/"},
-			wantHost: refHost,
+			mirrors:    []string{"mirrorexample.com/somepath/"},
+			wantHost:   refHost,
+			wantSource: commonmetrics.RemoteSourceRegistry,
 		},
 		{
 			name: "redirected-mirror",
@@ -139,8 +150,44 @@ func TestMirror(t *testing.T) {
 				},
 				okURLs: []string{`.*`},
 			},
-			mirrors:  []string{"mirrorexample.com"},
-			wantHost: "backendexample.com",
+			mirrors:    []string{"mirrorexample.com"},
+			wantHost:   "backendexample.com",
+			wantSource: commonmetrics.RemoteSourceMirror,
+		},
+		{
+			name:       "foreign-layer-url",
+			tr:         &sampleRoundTripper{okURLs: []string{"foreignexample.com", refHost}},
+			urls:       []string{"https://foreignexample.com/layers/" + blobDigest.Encoded()},
+			wantHost:   "foreignexample.com",
+			wantSource: commonmetrics.RemoteSourceURL,
+		},
+		{
+			name: "invalid-foreign-layer-url",
+			tr: &sampleRoundTripper{
+				withCode: map[string]int{
+					"foreignexample1.com": http.StatusNotFound,
+				},
+				okURLs: []string{"foreignexample2.com", refHost},
+			},
+			urls: []string{
+				"https://foreignexample1.com/layers/" + blobDigest.Encoded(),
+				"ftp://foreignexample3.com/layers/" + blobDigest.Encoded(),
+				"https://foreignexample2.com/layers/" + blobDigest.Encoded(),
+			},
+			wantHost:   "foreignexample2.com",
+			wantSource: commonmetrics.RemoteSourceURL,
+		},
+		{
+			name: "invalid-all-foreign-layer-url",
+			tr: &sampleRoundTripper{
+				withCode: map[string]int{
+					"foreignexample.com": http.StatusNotFound,
+				},
+				okURLs: []string{refHost},
+			},
+			urls:       []string{"https://foreignexample.com/layers/" + blobDigest.Encoded()},
+			wantHost:   refHost,
+			wantSource: commonmetrics.RemoteSourceRegistry,
 		},
 		{
 			name:     "fail-all",
@@ -169,7 +216,7 @@ func TestMirror(t *testing.T) {
 			fetcher, err := newHTTPFetcher(context.Background(), &fetcherConfig{
 				hosts:   hosts,
 				refspec: refspec,
-				desc:    ocispec.Descriptor{Digest: blobDigest},
+				desc:    ocispec.Descriptor{Digest: blobDigest, URLs: tt.urls},
 			})
 			if err != nil {
 				if tt.error {
@@ -185,6 +232,9 @@ func TestMirror(t *testing.T) {
 				t.Errorf("invalid hostname %q(%q); want %q",
 					nurl.Hostname(), nurl.String(), tt.wantHost)
 			}
+			if fetcher.source() != tt.wantSource {
+				t.Errorf("invalid source %q; want %q", fetcher.source(), tt.wantSource)
+			}
 		})
 	}
 }
@@ -255,6 +305,158 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestPreCheck(t *testing.T) {
+	type response struct {
+		status       int
+		acceptRanges string
+		location     string
+		size         int64
+	}
+	testCases := []struct {
+		name         string
+		head         response
+		get          *response
+		expectedErr  error
+		expectFailed bool
+	}{
+		{
+			name: "Accept-Ranges of the registry",
+			head: response{status: http.StatusOK, acceptRanges: "bytes", size: 4},
+		},
+		{
+			name: "range request without Accept-Ranges",
+			head: response{status: http.StatusOK, size: 4},
+			get:  &response{status: http.StatusPartialContent},
+		},
+		{
+			name: "range request to redirected blob",
+			head: response{status: http.StatusTemporaryRedirect, location: "https://signed.example.com/blob", size: -1},
+			get:  &response{status: http.StatusPartialContent},
+		},
+		{
+			name:        "range request to redirected blob answered with the whole blob",
+			head:        response{status: http.StatusTemporaryRedirect, acceptRanges: "bytes", location: "https://signed.example.com/blob", size: -1},
+			get:         &response{status: http.StatusOK},
+			expectedErr: ErrRangeNotSupported,
+		},
+		{
+			name:         "redirect without location",
+			head:         response{status: http.StatusTemporaryRedirect, size: -1},
+			expectFailed: true,
+		},
+		{
+			name:        "range request answered with the whole blob",
+			head:        response{status: http.StatusOK, size: 4},
+			get:         &response{status: http.StatusOK},
+			expectedErr: ErrRangeNotSupported,
+		},
+		{
+			name:        "Accept-Ranges none",
+			head:        response{status: http.StatusOK, acceptRanges: "none", size: 4},
+			expectedErr: ErrRangeNotSupported,
+		},
+		{
+			name:        "blob not found",
+			head:        response{status: http.StatusNotFound, size: -1},
+			expectedErr: ErrBlobNotFound,
+		},
+		{
+			name:         "size mismatch",
+			head:         response{status: http.StatusOK, acceptRanges: "bytes", size: 5},
+			expectFailed: true,
+		},
+		{
+			name:         "unexpected status code",
+			head:         response{status: http.StatusInternalServerError, size: -1},
+			expectFailed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gets int
+			var body *trackingBody
+			tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				r := tc.head
+				if req.Method == "GET" {
+					gets++
+					if tc.get == nil {
+						t.Fatalf("unexpected range request")
+					}
+					if req.URL.String() != "https://signed.example.com/blob" {
+						t.Fatalf("range request to unexpected URL %s", req.URL)
+					}
+					r = *tc.get
+				} else if req.URL.String() != "https://registry.example.com/v2/test/blobs/sha256:abc" {
+					t.Fatalf("HEAD request to unexpected URL %s", req.URL)
+				}
+				header := make(http.Header)
+				if r.acceptRanges != "" {
+					header.Set("Accept-Ranges", r.acceptRanges)
+				}
+				if r.location != "" {
+					header.Set("Location", r.location)
+				}
+				res := &http.Response{
+					StatusCode:    r.status,
+					Header:        header,
+					ContentLength: r.size,
+					Body:          io.NopCloser(bytes.NewReader(nil)),
+					Request:       req,
+				}
+				if req.Method == "GET" {
+					body = &trackingBody{Reader: bytes.NewReader(make([]byte, 4))}
+					res.Body = body
+				}
+				return res, nil
+			})
+			f := &httpFetcher{
+				url:     "https://signed.example.com/blob",
+				blobURL: "https://registry.example.com/v2/test/blobs/sha256:abc",
+				tr:      tr,
+			}
+
+			err := f.preCheck(context.Background(), 4)
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+				}
+			} else if tc.expectFailed != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.get != nil && gets != 1 {
+				t.Fatalf("expected a range request, got %d", gets)
+			}
+			if body != nil {
+				if !body.closed {
+					t.Fatalf("the body of the range request isn't closed")
+				}
+				if tc.get.status == http.StatusOK && body.read > 0 {
+					t.Fatalf("the whole blob was read")
+				}
+			}
+		})
+	}
+}
+
+// trackingBody records how much of a response body is read and whether it's closed.
+type trackingBody struct {
+	*bytes.Reader
+	read   int
+	closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
 type breakRoundTripper struct {
 	success bool
 }
@@ -334,3 +536,73 @@ func (r *retryRoundTripper) RoundTrip(req *http.Request) (res *http.Response, er
 	}
 	return
 }
+
+func TestFetchTimeouts(t *testing.T) {
+	const chunks = 4
+	testCases := []struct {
+		name        string
+		stallBefore int // the chunk before which the response stalls, if any
+		expectedErr bool
+	}{
+		{
+			name:        "slow but progressing body",
+			stallBefore: -1,
+		},
+		{
+			name:        "no response",
+			stallBefore: 0,
+			expectedErr: true,
+		},
+		{
+			name:        "stalled body",
+			stallBefore: 2,
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < chunks; i++ {
+					if i == tc.stallBefore {
+						<-release
+						return
+					}
+					if i == 0 {
+						w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", chunks-1, chunks))
+						w.WriteHeader(http.StatusPartialContent)
+					}
+					w.Write([]byte{byte(i)})
+					w.(http.Flusher).Flush()
+					// the body takes longer than the body idle timeout, but makes progress.
+					time.Sleep(20 * time.Millisecond)
+				}
+			}))
+			defer srv.Close()
+			defer close(release)
+
+			f := &httpFetcher{
+				url:      srv.URL,
+				tr:       srv.Client().Transport,
+				timeouts: fetchTimeouts{connect: time.Second, firstByte: 50 * time.Millisecond, bodyIdle: 50 * time.Millisecond},
+			}
+			mr, err := f.fetch(context.Background(), []region{{0, chunks - 1}}, true)
+			if err == nil {
+				defer mr.Close()
+				var p io.Reader
+				if _, p, err = mr.Next(); err == nil {
+					_, err = io.ReadAll(p)
+				}
+			}
+			if !tc.expectedErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrFetchTimeout) {
+				t.Fatalf("expected fetch timeout, got %v", err)
+			}
+		})
+	}
+}
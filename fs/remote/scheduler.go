@@ -0,0 +1,229 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/opencontainers/go-digest"
+)
+
+// FetchQueue identifies the fetches which share a fair share of the fetch slots,
+// e.g. the fetches of the layers of an image.
+type FetchQueue struct {
+	// Name identifies the queue.
+	Name string
+	// Weight is the share of the fetch slots the queue gets relative to the other
+	// queues with waiting fetches. Weights <= 0 are treated as 1.
+	Weight int
+}
+
+type fetchQueueKey struct{}
+
+// WithFetchQueue returns a context with the fetch queue of the blobs resolved with it.
+func WithFetchQueue(ctx context.Context, q FetchQueue) context.Context {
+	return context.WithValue(ctx, fetchQueueKey{}, q)
+}
+
+// fetchQueueFromContext returns the fetch queue of ctx, or the default queue.
+func fetchQueueFromContext(ctx context.Context) FetchQueue {
+	q, _ := ctx.Value(fetchQueueKey{}).(FetchQueue)
+	return q
+}
+
+// defaultScheduler is shared by all blobs, so that the limit applies to all fetches
+// from remote registries. It holds a *fetchScheduler which is nil if fetches aren't limited.
+var defaultScheduler atomic.Value
+
+func init() {
+	SetMaxConcurrentFetches(0)
+}
+
+// SetMaxConcurrentFetches sets the maximum number of concurrent fetches from remote registries.
+// When the limit is reached, fetch slots are handed out across fetch queues in proportion to
+// their weights. n <= 0 disables the limit. Fetches which already hold a slot aren't affected.
+func SetMaxConcurrentFetches(n int) {
+	var s *fetchScheduler
+	if n > 0 {
+		s = newFetchScheduler(n)
+	}
+	defaultScheduler.Store(s)
+}
+
+func getScheduler() *fetchScheduler {
+	return defaultScheduler.Load().(*fetchScheduler)
+}
+
+// fetchScheduler is a weighted fair scheduler of fetch slots. A freed slot goes to the
+// queue with waiting fetches which holds the fewest slots relative to its weight.
+// Fetches which serve reads of files are served before background fetches, so that
+// hydrating layers doesn't delay reads.
+type fetchScheduler struct {
+	mu     sync.Mutex
+	free   int
+	queues map[string]*schedulerQueue
+	// waiting is the number of waiting fetches across all queues.
+	waiting int
+	// foregroundWaiting is the number of waiting fetches which serve reads of files.
+	foregroundWaiting int
+	// seq orders the queues which hold the same share of slots by when they were last served.
+	seq uint64
+}
+
+type schedulerQueue struct {
+	weight   int
+	inflight int
+	// waiters are the waiting fetches which serve reads of files, and bgWaiters are
+	// the waiting background fetches.
+	waiters    []chan struct{}
+	bgWaiters  []chan struct{}
+	lastServed uint64
+}
+
+// waitersOf returns the waiters of q of background fetches or of reads of files.
+func (q *schedulerQueue) waitersOf(background bool) *[]chan struct{} {
+	if background {
+		return &q.bgWaiters
+	}
+	return &q.waiters
+}
+
+func newFetchScheduler(n int) *fetchScheduler {
+	return &fetchScheduler{
+		free:   n,
+		queues: make(map[string]*schedulerQueue),
+	}
+}
+
+// acquire blocks until the fetch queue q gets a fetch slot or ctx is done, and returns
+// the function which releases the slot. background tells whether the fetch hydrates
+// a layer in the background rather than serving a read of a file.
+func (s *fetchScheduler) acquire(ctx context.Context, q FetchQueue, background bool) (release func(), _ error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	weight := q.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	release = func() { s.release(q.Name) }
+
+	s.mu.Lock()
+	sq, ok := s.queues[q.Name]
+	if !ok {
+		sq = &schedulerQueue{}
+		s.queues[q.Name] = sq
+	}
+	sq.weight = weight
+	if s.free > 0 && s.waiting == 0 {
+		s.free--
+		sq.inflight++
+		s.mu.Unlock()
+		return release, nil
+	}
+	ch := make(chan struct{})
+	waiters := sq.waitersOf(background)
+	*waiters = append(*waiters, ch)
+	s.waiting++
+	if !background {
+		s.foregroundWaiting++
+	}
+	s.mu.Unlock()
+
+	start := time.Now()
+	defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.FetchSchedulerWait, digest.Digest(""), start)
+	select {
+	case <-ch:
+		return release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		waiters := sq.waitersOf(background)
+		for i, w := range *waiters {
+			if w == ch {
+				*waiters = append((*waiters)[:i], (*waiters)[i+1:]...)
+				s.waiting--
+				if !background {
+					s.foregroundWaiting--
+				}
+				s.removeIdle(q.Name, sq)
+				s.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+		// The slot was handed out concurrently.
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+func (s *fetchScheduler) release(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sq := s.queues[name]
+	sq.inflight--
+	s.free++
+	s.removeIdle(name, sq)
+	s.dispatch()
+}
+
+// dispatch hands out free slots to the waiting fetches. It must be called with s.mu held.
+func (s *fetchScheduler) dispatch() {
+	for s.free > 0 && s.waiting > 0 {
+		background := s.foregroundWaiting == 0
+		var next *schedulerQueue
+		for _, sq := range s.queues {
+			if len(*sq.waitersOf(background)) == 0 {
+				continue
+			}
+			if next == nil || sq.before(next) {
+				next = sq
+			}
+		}
+		waiters := next.waitersOf(background)
+		ch := (*waiters)[0]
+		*waiters = (*waiters)[1:]
+		s.waiting--
+		if !background {
+			s.foregroundWaiting--
+		}
+		s.free--
+		next.inflight++
+		s.seq++
+		next.lastServed = s.seq
+		close(ch)
+	}
+}
+
+// before returns true if q holds a smaller share of slots relative to its weight than o.
+func (q *schedulerQueue) before(o *schedulerQueue) bool {
+	if l, r := q.inflight*o.weight, o.inflight*q.weight; l != r {
+		return l < r
+	}
+	return q.lastServed < o.lastServed
+}
+
+// removeIdle forgets queues without fetches. It must be called with s.mu held.
+func (s *fetchScheduler) removeIdle(name string, sq *schedulerQueue) {
+	if sq.inflight == 0 && len(sq.waiters) == 0 && len(sq.bgWaiters) == 0 {
+		delete(s.queues, name)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFetchSchedulerUnlimited(t *testing.T) {
+	var s *fetchScheduler
+	for i := 0; i < 100; i++ {
+		if _, err := s.acquire(context.Background(), FetchQueue{Name: "a"}, false); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestFetchSchedulerWeightedFairness(t *testing.T) {
+	s := newFetchScheduler(1)
+	// Hold the only slot, so that all other fetches have to wait.
+	release, err := s.acquire(context.Background(), FetchQueue{Name: "busy"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type grant struct {
+		queue   string
+		release func()
+	}
+	grants := make(chan grant)
+	enqueue := func(q FetchQueue, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				r, err := s.acquire(context.Background(), q, false)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				grants <- grant{q.Name, r}
+			}()
+		}
+		// Wait for the fetches to be queued.
+		for {
+			s.mu.Lock()
+			waiting := 0
+			if sq, ok := s.queues[q.Name]; ok {
+				waiting = len(sq.waiters)
+			}
+			s.mu.Unlock()
+			if waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// The monopolizing image queues many fetches before the other images.
+	enqueue(FetchQueue{Name: "monopolizing", Weight: 1}, 8)
+	enqueue(FetchQueue{Name: "light", Weight: 1}, 2)
+	enqueue(FetchQueue{Name: "critical", Weight: 2}, 4)
+
+	// Grow the pool to 4 slots, so that each queue holds slots at once.
+	s.mu.Lock()
+	s.free += 3
+	s.mu.Unlock()
+	release()
+
+	held := map[string]int{}
+	var releases []func()
+	for i := 0; i < 4; i++ {
+		g := <-grants
+		held[g.queue]++
+		releases = append(releases, g.release)
+	}
+	if held["critical"] != 2 || held["monopolizing"] != 1 || held["light"] != 1 {
+		t.Fatalf("expected slots to be shared by weight, got %v", held)
+	}
+	for _, r := range releases {
+		r()
+	}
+	for i := 0; i < 10; i++ {
+		(<-grants).release()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.free != 4 || s.waiting != 0 || len(s.queues) != 0 {
+		t.Fatalf("expected all slots to be released, free: %d, waiting: %d, queues: %d", s.free, s.waiting, len(s.queues))
+	}
+}
+
+func TestFetchSchedulerCancel(t *testing.T) {
+	s := newFetchScheduler(1)
+	release, err := s.acquire(context.Background(), FetchQueue{Name: "a"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, FetchQueue{Name: "b"}, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the fetch to time out, got %v", err)
+	}
+	release()
+	release, err = s.acquire(context.Background(), FetchQueue{Name: "b"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	release()
+	if s.free != 1 || s.waiting != 0 || len(s.queues) != 0 {
+		t.Fatalf("expected all slots to be released, free: %d, waiting: %d, queues: %d", s.free, s.waiting, len(s.queues))
+	}
+}
+
+func TestFetchSchedulerForegroundFirst(t *testing.T) {
+	s := newFetchScheduler(1)
+	release, err := s.acquire(context.Background(), FetchQueue{Name: "busy"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type grant struct {
+		background bool
+		release    func()
+	}
+	grants := make(chan grant)
+	enqueue := func(background bool, n int) {
+		for i := 0; i < n; i++ {
+			go func() {
+				r, err := s.acquire(context.Background(), FetchQueue{Name: "a"}, background)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				grants <- grant{background, r}
+			}()
+		}
+		// Wait for the fetches to be queued.
+		for {
+			s.mu.Lock()
+			waiting := 0
+			if sq, ok := s.queues["a"]; ok {
+				waiting = len(*sq.waitersOf(background))
+			}
+			s.mu.Unlock()
+			if waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Background fetches are queued before the reads of files.
+	enqueue(true, 3)
+	enqueue(false, 2)
+	release()
+
+	var order []bool
+	for i := 0; i < 5; i++ {
+		g := <-grants
+		order = append(order, g.background)
+		g.release()
+	}
+	for i, background := range order {
+		if background != (i >= 2) {
+			t.Fatalf("expected reads of files to be served before background fetches, got %v", order)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.free != 1 || s.waiting != 0 || s.foregroundWaiting != 0 || len(s.queues) != 0 {
+		t.Fatalf("expected all slots to be released, free: %d, waiting: %d, queues: %d", s.free, s.waiting, len(s.queues))
+	}
+}
+
+func TestBlobDedicatedFetchSlot(t *testing.T) {
+	SetMaxConcurrentFetches(1)
+	defer SetMaxConcurrentFetches(0)
+	// Hold the only slot of the scheduler.
+	release, err := getScheduler().acquire(context.Background(), FetchQueue{Name: "busy"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	b := &blob{}
+	wait := func(background bool) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		r, err := b.acquireFetchSlot(ctx, background)
+		if err == nil {
+			r()
+		}
+		return err
+	}
+	if err := wait(true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the background fetch to wait for the scheduler, got %v", err)
+	}
+	releaseDedicated, err := b.acquireFetchSlot(context.Background(), false)
+	if err != nil {
+		t.Fatalf("expected the read to get the dedicated slot, got %v", err)
+	}
+	if err := wait(false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the second read to wait for the scheduler, got %v", err)
+	}
+	releaseDedicated()
+	if err := wait(false); err != nil {
+		t.Fatalf("expected the read to get the released dedicated slot, got %v", err)
+	}
+}
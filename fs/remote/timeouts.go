@@ -0,0 +1,189 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+)
+
+// ErrFetchTimeout is returned by fetches which hit the connect, first byte or body idle timeout.
+var ErrFetchTimeout = errors.New("fetch timed out")
+
+// Phases of a fetch which are bounded by fetchTimeouts.
+const (
+	phaseConnect   = "connect"
+	phaseFirstByte = "first byte"
+	phaseBodyIdle  = "body idle"
+)
+
+// fetchTimeouts bound the phases of a fetch, unlike the fetch timeout which bounds the
+// whole fetch. Zero disables a timeout.
+type fetchTimeouts struct {
+	// connect bounds getting a connection, including dialing and the TLS handshake.
+	connect time.Duration
+	// firstByte bounds waiting for the response once the fetch has a connection.
+	firstByte time.Duration
+	// bodyIdle bounds waiting for more of the body of the response.
+	bodyIdle time.Duration
+}
+
+func newFetchTimeouts(cfg config.BlobConfig) fetchTimeouts {
+	return fetchTimeouts{
+		connect:   time.Duration(cfg.ConnectTimeoutMsec) * time.Millisecond,
+		firstByte: time.Duration(cfg.FirstByteTimeoutMsec) * time.Millisecond,
+		bodyIdle:  time.Duration(cfg.BodyIdleTimeoutMsec) * time.Millisecond,
+	}
+}
+
+// watch returns a context for a fetch which is canceled once the phase the fetch is in
+// takes longer than its timeout, and the watchdog which tracks the phases. The watchdog
+// is nil if all timeouts are disabled.
+func (t fetchTimeouts) watch(ctx context.Context) (context.Context, *fetchWatchdog) {
+	if t.connect <= 0 && t.firstByte <= 0 && t.bodyIdle <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &fetchWatchdog{timeouts: t, cancel: cancel}
+	// Retried requests and requests for tokens get connections too, so every
+	// connection restarts the connect and first byte timeouts.
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:              func(string) { w.arm(phaseConnect, t.connect) },
+		GotConn:              func(httptrace.GotConnInfo) { w.arm(phaseFirstByte, t.firstByte) },
+		GotFirstResponseByte: func() { w.arm("", 0) },
+	})
+	return ctx, w
+}
+
+// fetchWatchdog cancels the context of a fetch once a phase of the fetch times out.
+type fetchWatchdog struct {
+	timeouts fetchTimeouts
+	cancel   context.CancelFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+	// gen is incremented every time the timer is armed, so that a timer which fires
+	// while it's being rearmed doesn't cancel the fetch.
+	gen     uint64
+	expired string // the phase which timed out
+	stopped bool
+}
+
+// arm starts the timer of phase, stopping the timer of the previous phase. A phase
+// without timeout only stops the timer.
+func (w *fetchWatchdog) arm(phase string, timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.expired != "" {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.gen++
+	if timeout <= 0 {
+		return
+	}
+	gen := w.gen
+	w.timer = time.AfterFunc(timeout, func() { w.expire(phase, gen) })
+}
+
+func (w *fetchWatchdog) expire(phase string, gen uint64) {
+	w.mu.Lock()
+	if w.stopped || gen != w.gen {
+		w.mu.Unlock()
+		return
+	}
+	w.expired = phase
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// stop stops the watchdog and releases its context.
+func (w *fetchWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// wrap returns err, annotated with the timeout which caused it if a phase timed out.
+func (w *fetchWatchdog) wrap(err error) error {
+	if w == nil || err == nil {
+		return err
+	}
+	w.mu.Lock()
+	phase := w.expired
+	w.mu.Unlock()
+	switch phase {
+	case phaseConnect:
+		return fmt.Errorf("%w: no connection within %v: %v", ErrFetchTimeout, w.timeouts.connect, err)
+	case phaseFirstByte:
+		return fmt.Errorf("%w: no response within %v: %v", ErrFetchTimeout, w.timeouts.firstByte, err)
+	case phaseBodyIdle:
+		return fmt.Errorf("%w: no progress of the body within %v: %v", ErrFetchTimeout, w.timeouts.bodyIdle, err)
+	}
+	return err
+}
+
+// body returns rc, which restarts the body idle timeout on every read which makes
+// progress, and stops the watchdog once it's closed.
+func (w *fetchWatchdog) body(rc io.ReadCloser) io.ReadCloser {
+	if w == nil {
+		return rc
+	}
+	w.arm(phaseBodyIdle, w.timeouts.bodyIdle)
+	return &watchedBody{rc: rc, w: w}
+}
+
+type watchedBody struct {
+	rc io.ReadCloser
+	w  *fetchWatchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	switch {
+	case err == io.EOF:
+		b.w.arm("", 0)
+	case err != nil:
+		err = b.w.wrap(err)
+	case n > 0:
+		b.w.arm(phaseBodyIdle, b.w.timeouts.bodyIdle)
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	err := b.rc.Close()
+	b.w.stop()
+	return err
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrBlobChanged is returned when a registry serves a different blob than the one
+// requested, or than the one it served before the fetcher was refreshed.
+var ErrBlobChanged = errors.New("blob changed")
+
+// checkContentDigest checks that the Docker-Content-Digest header of res, if any, is dgst.
+func checkContentDigest(res *http.Response, dgst digest.Digest) error {
+	if d := res.Header.Get("Docker-Content-Digest"); d != "" && dgst != "" && d != dgst.String() {
+		return fmt.Errorf("registry served %s instead of %s: %w", d, dgst, ErrBlobChanged)
+	}
+	return nil
+}
+
+// strongETag returns the ETag of res, unless it's a weak ETag, which can't be used with If-Match.
+func strongETag(res *http.Response) string {
+	etag := res.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
+// validate checks that res, the response to req, serves the blob of f: that its
+// Docker-Content-Digest is the digest of the blob, and that its ETag is the ETag the
+// same host has served before, if any. The first ETag f sees is sent as If-Match in
+// later requests to that host, so that it rejects them with 412 Precondition Failed
+// if the blob changes. Redirects may move the blob to hosts which serve it with other
+// ETags, e.g. another CDN, so only the Docker-Content-Digest is validated for them.
+func (f *httpFetcher) validate(req *http.Request, res *http.Response) error {
+	if err := checkContentDigest(res, f.digest); err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("ETag of %s doesn't match: %w", f.digest, ErrBlobChanged)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil
+	}
+	etag := strongETag(res)
+	if etag == "" {
+		return nil
+	}
+	f.etagMu.Lock()
+	defer f.etagMu.Unlock()
+	if f.etag == "" {
+		f.etag, f.etagHost = etag, req.URL.Host
+	} else if f.etagHost == req.URL.Host && f.etag != etag {
+		return fmt.Errorf("ETag of %s changed from %s to %s: %w", f.digest, f.etag, etag, ErrBlobChanged)
+	}
+	return nil
+}
+
+// setIfMatch makes req conditional on the ETag f has seen, if any, from the host of req.
+func (f *httpFetcher) setIfMatch(req *http.Request) {
+	f.etagMu.Lock()
+	etag, host := f.etag, f.etagHost
+	f.etagMu.Unlock()
+	if etag != "" && host == req.URL.Host {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// inheritETag makes f validate the blob against the ETag old has seen, e.g. after
+// refreshing credentials. The ETag only applies to the host which served it, so
+// blobs fetched from other hosts, e.g. another mirror, are only validated by their
+// Docker-Content-Digest.
+func (f *httpFetcher) inheritETag(old *httpFetcher) {
+	old.etagMu.Lock()
+	etag, host := old.etag, old.etagHost
+	old.etagMu.Unlock()
+	f.etagMu.Lock()
+	f.etag, f.etagHost = etag, host
+	f.etagMu.Unlock()
+}
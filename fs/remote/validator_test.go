@@ -0,0 +1,192 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestValidate(t *testing.T) {
+	dgst := digest.FromString("blob")
+	type response struct {
+		status        int
+		etag          string
+		contentDigest string
+		host          string // the host the request is redirected to, if any
+	}
+	testCases := []struct {
+		name          string
+		responses     []response
+		expectedMatch []string
+		expectedErr   error
+	}{
+		{
+			name: "the first ETag is sent as If-Match",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `"abc"`},
+				{status: http.StatusPartialContent, etag: `"abc"`},
+				{status: http.StatusPartialContent},
+			},
+			expectedMatch: []string{"", `"abc"`, `"abc"`},
+		},
+		{
+			name: "weak ETags aren't sent",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `W/"abc"`},
+				{status: http.StatusPartialContent, etag: `"def"`},
+			},
+			expectedMatch: []string{"", ""},
+		},
+		{
+			name: "ETag of error responses isn't recorded",
+			responses: []response{
+				{status: http.StatusServiceUnavailable, etag: `"abc"`},
+				{status: http.StatusPartialContent, etag: `"def"`},
+			},
+			expectedMatch: []string{"", ""},
+		},
+		{
+			name: "precondition failed",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `"abc"`},
+				{status: http.StatusPreconditionFailed},
+			},
+			expectedMatch: []string{"", `"abc"`},
+			expectedErr:   ErrBlobChanged,
+		},
+		{
+			name: "changed ETag",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `"abc"`},
+				{status: http.StatusPartialContent, etag: `"def"`},
+			},
+			expectedMatch: []string{"", `"abc"`},
+			expectedErr:   ErrBlobChanged,
+		},
+		{
+			name: "ETag of another redirect target isn't validated",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `"abc"`, host: "cdn1.example.com"},
+				{status: http.StatusPartialContent, etag: `"def"`, host: "cdn2.example.com"},
+				{status: http.StatusPartialContent, etag: `"abc"`, host: "cdn1.example.com"},
+			},
+			expectedMatch: []string{"", "", `"abc"`},
+		},
+		{
+			name: "changed ETag of the same redirect target",
+			responses: []response{
+				{status: http.StatusPartialContent, etag: `"abc"`, host: "cdn1.example.com"},
+				{status: http.StatusPartialContent, etag: `"def"`, host: "cdn1.example.com"},
+			},
+			expectedMatch: []string{"", `"abc"`},
+			expectedErr:   ErrBlobChanged,
+		},
+		{
+			name: "matching Docker-Content-Digest",
+			responses: []response{
+				{status: http.StatusPartialContent, contentDigest: dgst.String()},
+			},
+			expectedMatch: []string{""},
+		},
+		{
+			name: "substituted blob",
+			responses: []response{
+				{status: http.StatusPartialContent, contentDigest: digest.FromString("other").String()},
+			},
+			expectedMatch: []string{""},
+			expectedErr:   ErrBlobChanged,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var i int
+			f := &httpFetcher{
+				url:    "https://registry.example.com/v2/test/blobs/" + dgst.String(),
+				digest: dgst,
+			}
+			f.tr = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if m := req.Header.Get("If-Match"); m != tc.expectedMatch[i] {
+					t.Fatalf("unexpected If-Match of request %d; expected %q, got %q", i, tc.expectedMatch[i], m)
+				}
+				r := tc.responses[i]
+				i++
+				header := make(http.Header)
+				if r.etag != "" {
+					header.Set("ETag", r.etag)
+				}
+				if r.contentDigest != "" {
+					header.Set("Docker-Content-Digest", r.contentDigest)
+				}
+				return &http.Response{
+					StatusCode: r.status,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			})
+
+			var err error
+			for _, r := range tc.responses {
+				if r.host != "" {
+					f.url = "https://" + r.host + "/blobs/" + dgst.String()
+				}
+				if err = f.check(); errors.Is(err, ErrBlobChanged) {
+					break
+				}
+			}
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v, got %v", tc.expectedErr, err)
+				}
+			} else if errors.Is(err, ErrBlobChanged) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestInheritETag(t *testing.T) {
+	old := &httpFetcher{
+		etag:     `"abc"`,
+		etagHost: "registry.example.com",
+	}
+	f := &httpFetcher{}
+	f.inheritETag(old)
+
+	req, _ := http.NewRequest("GET", "https://registry.example.com/v2/test/blobs/sha256:abc", nil)
+	f.setIfMatch(req)
+	if m := req.Header.Get("If-Match"); m != old.etag {
+		t.Fatalf("ETag of the same host should be sent; expected %q, got %q", old.etag, m)
+	}
+
+	req, _ = http.NewRequest("GET", "https://mirror.example.com/v2/test/blobs/sha256:abc", nil)
+	f.setIfMatch(req)
+	if m := req.Header.Get("If-Match"); m != "" {
+		t.Fatalf("ETag of another host shouldn't be sent, got %q", m)
+	}
+	res := &http.Response{StatusCode: http.StatusPartialContent, Header: make(http.Header)}
+	res.Header.Set("ETag", `"def"`)
+	if err := f.validate(req, res); err != nil {
+		t.Fatalf("ETag of another host shouldn't be validated: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+)
+
+// targetChainIDLabel is the label of the name of the snapshot of a layer being unpacked,
+// which containerd sets to the chain ID of the layer computed from the diffIDs of the
+// image config.
+const targetChainIDLabel = "containerd.io/snapshot.ref"
+
+// ErrDiffIDMismatch is returned when the diffID of a layer recorded by a SOCI index
+// doesn't match the diffID of the layer in the image config.
+var ErrDiffIDMismatch = errors.New("diffID of the layer doesn't match the image config")
+
+type parentChainIDKey struct{}
+
+// WithParentChainID returns a context for preparing the snapshot of a layer whose parent
+// layer has chainID, which is empty for the bottom layer of an image.
+func WithParentChainID(ctx context.Context, chainID string) context.Context {
+	return context.WithValue(ctx, parentChainIDKey{}, chainID)
+}
+
+// VerifyDiffID checks that diffID is the diffID of the layer of the snapshot with labels
+// in the image config, by checking that the chain ID of diffID on top of the parent layer
+// set by WithParentChainID is the chain ID containerd computed from the image config.
+// Nothing is checked if either chain ID isn't known.
+func VerifyDiffID(ctx context.Context, labels map[string]string, diffID digest.Digest) error {
+	parent, ok := ctx.Value(parentChainIDKey{}).(string)
+	if !ok {
+		return nil
+	}
+	expected, ok := labels[targetChainIDLabel]
+	if !ok {
+		return nil
+	}
+	chain := []digest.Digest{diffID}
+	if parent != "" {
+		chain = []digest.Digest{digest.Digest(parent), diffID}
+	}
+	if actual := identity.ChainID(chain); actual.String() != expected {
+		return fmt.Errorf("%w: chain ID of diffID %s is %s, expected %s", ErrDiffIDMismatch, diffID, actual, expected)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import "context"
+
+type backgroundFetchKey struct{}
+
+// WithBackgroundFetch returns a context of the requests of a fetch which hydrates a
+// layer in the background (e.g. the background fetcher or prefetches), rather than
+// serving a read of a file. The clients of registry hosts may send them over other
+// connections than the reads, so that they don't queue ahead of the reads.
+func WithBackgroundFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundFetchKey{}, true)
+}
+
+// IsBackgroundFetch returns whether ctx is the context of a background fetch.
+func IsBackgroundFetch(ctx context.Context) bool {
+	b, _ := ctx.Value(backgroundFetchKey{}).(bool)
+	return b
+}
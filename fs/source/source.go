@@ -34,6 +34,7 @@ package source
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -87,6 +88,32 @@ const (
 
 	// TargetSociIndexDigestLabel is a label which contains the digest of the soci index.
 	TargetSociIndexDigestLabel = "containerd.io/snapshot/remote/soci.index.digest"
+
+	// TargetURLsLabel is a label which contains the URLs a foreign layer is distributed
+	// from, encoded as a JSON array since URLs may contain commas.
+	TargetURLsLabel = "containerd.io/snapshot/remote/soci.urls"
+
+	// WorkloadClassLabel is a label which contains the workload class of the image, which
+	// determines its share of the fetches from remote registries.
+	WorkloadClassLabel = "containerd.io/snapshot/soci.workload-class"
+
+	// HydrationThresholdLabel is a label which contains the percentage of the prioritized
+	// spans of a layer which must be cached before the layer's snapshot is mounted.
+	HydrationThresholdLabel = "containerd.io/snapshot/soci.hydration-threshold"
+
+	// HydrationTimeoutLabel is a label which contains how long (in seconds) mounting a
+	// layer waits for the hydration threshold at most.
+	HydrationTimeoutLabel = "containerd.io/snapshot/soci.hydration-timeout-sec"
+
+	// HydrationPathsLabel is a label which contains the paths whose spans are prioritized
+	// by the hydration threshold, encoded as a JSON array. All spans of the layer are
+	// prioritized if it's not set.
+	HydrationPathsLabel = "containerd.io/snapshot/soci.hydration-paths"
+
+	// MountOptionsLabel is a label which contains the comma-separated options ("ro",
+	// "noexec", "nodev" and "nosuid") the FUSE mount of the layer is hardened with, in
+	// addition to the mount options of the config.
+	MountOptionsLabel = "containerd.io/snapshot/soci.mount-options"
 )
 
 // FromDefaultLabels returns a function for converting snapshot labels to
@@ -149,6 +176,11 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 			Size:        targetSize,
 			Annotations: labels,
 		}
+		if urls, ok := labels[TargetURLsLabel]; ok && urls != "" {
+			if err := json.Unmarshal([]byte(urls), &targetDesc.URLs); err != nil {
+				return nil, fmt.Errorf("invalid URLs label: %w", err)
+			}
+		}
 
 		return []Source{
 			{
@@ -161,10 +193,72 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 	}
 }
 
+// WithLayerSizes returns a copy of labels with the size labels of the target layer and
+// its neighboring layers set from sizes, which maps layer digests to their sizes.
+// This completes the labels of snapshots of images which weren't pulled with
+// AppendDefaultLabelsHandlerWrapper, e.g. by the CRI plugin, which only sets the
+// standard containerd labels.
+func WithLayerSizes(labels map[string]string, sizes map[digest.Digest]int64) (map[string]string, error) {
+	target, err := digest.Parse(labels[ctdsnapshotters.TargetLayerDigestLabel])
+	if err != nil {
+		return nil, fmt.Errorf("invalid layer digest label: %w", err)
+	}
+	size, ok := sizes[target]
+	if !ok {
+		return nil, fmt.Errorf("layer %s isn't in the image manifest", target)
+	}
+	completed := make(map[string]string, len(labels)+2)
+	for k, v := range labels {
+		completed[k] = v
+	}
+	completed[TargetSizeLabel] = strconv.FormatInt(size, 10)
+	if l, ok := labels[ctdsnapshotters.TargetImageLayersLabel]; ok {
+		var layerSizes []string
+		for _, d := range strings.Split(l, ",") {
+			size, ok := sizes[digest.Digest(d)]
+			if !ok {
+				return nil, fmt.Errorf("layer %s isn't in the image manifest", d)
+			}
+			layerSizes = append(layerSizes, strconv.FormatInt(size, 10))
+		}
+		completed[targetImageLayersSizeLabel] = strings.Join(layerSizes, ",")
+	}
+	return completed, nil
+}
+
+// LayerLabels returns the labels of the snapshot of the layer at index i of manifest, like
+// the ones containerd passes to the snapshotter when the image ref is pulled with
+// AppendDefaultLabelsHandlerWrapper. This lets the filesystem mount layers without containerd.
+func LayerLabels(ref string, indexDigest digest.Digest, manifestDigest digest.Digest, manifest ocispec.Manifest, i int) map[string]string {
+	target := manifest.Layers[i]
+	var layerDigests, layerSizes []string
+	for _, l := range manifest.Layers[i:] {
+		layerDigests = append(layerDigests, l.Digest.String())
+		layerSizes = append(layerSizes, strconv.FormatInt(l.Size, 10))
+	}
+	labels := map[string]string{
+		ctdsnapshotters.TargetRefLabel:            ref,
+		ctdsnapshotters.TargetManifestDigestLabel: manifestDigest.String(),
+		ctdsnapshotters.TargetLayerDigestLabel:    target.Digest.String(),
+		ctdsnapshotters.TargetImageLayersLabel:    strings.Join(layerDigests, ","),
+		targetImageLayersSizeLabel:                strings.Join(layerSizes, ","),
+		TargetSizeLabel:                           strconv.FormatInt(target.Size, 10),
+		TargetSociIndexDigestLabel:                indexDigest.String(),
+	}
+	if len(target.URLs) > 0 {
+		if urls, err := json.Marshal(target.URLs); err == nil {
+			labels[TargetURLsLabel] = string(urls)
+		}
+	}
+	return labels
+}
+
 // AppendDefaultLabelsHandlerWrapper makes a handler which appends image's basic
 // information to each layer descriptor as annotations during unpack. These
 // annotations will be passed to this remote snapshotter as labels and used to
 // construct source information.
+// Only the layers of schema 2 and OCI manifests are annotated; images with docker
+// schema 1 manifests aren't supported.
 func AppendDefaultLabelsHandlerWrapper(indexDigest string, wrapper func(images.Handler) images.Handler) func(f images.Handler) images.Handler {
 	return func(f images.Handler) images.Handler {
 		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
@@ -183,6 +277,12 @@ func AppendDefaultLabelsHandlerWrapper(indexDigest string, wrapper func(images.H
 
 						c.Annotations[TargetSizeLabel] = fmt.Sprintf("%d", c.Size)
 						c.Annotations[TargetSociIndexDigestLabel] = indexDigest
+						if len(c.URLs) > 0 {
+							// Layers are fetched from the registry if their URLs are too long for a label.
+							if urls, err := json.Marshal(c.URLs); err == nil && labels.Validate(TargetURLsLabel, string(urls)) == nil {
+								c.Annotations[TargetURLsLabel] = string(urls)
+							}
+						}
 
 						var layerSizes string
 						for _, l := range children[i:] {
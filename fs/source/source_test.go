@@ -0,0 +1,199 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package source
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWithLayerSizes(t *testing.T) {
+	layer1 := digest.FromString("layer1")
+	layer2 := digest.FromString("layer2")
+	layer3 := digest.FromString("layer3")
+	sizes := map[digest.Digest]int64{layer1: 10, layer2: 20, layer3: 30}
+
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		expectedSize   string
+		expectedLayers string
+		expectErr      bool
+	}{
+		{
+			name: "target only",
+			labels: map[string]string{
+				ctdsnapshotters.TargetLayerDigestLabel: layer2.String(),
+			},
+			expectedSize: "20",
+		},
+		{
+			name: "with neighboring layers",
+			labels: map[string]string{
+				ctdsnapshotters.TargetLayerDigestLabel: layer2.String(),
+				ctdsnapshotters.TargetImageLayersLabel: layer2.String() + "," + layer3.String(),
+			},
+			expectedSize:   "20",
+			expectedLayers: "20,30",
+		},
+		{
+			name: "unknown target",
+			labels: map[string]string{
+				ctdsnapshotters.TargetLayerDigestLabel: digest.FromString("unknown").String(),
+			},
+			expectErr: true,
+		},
+		{
+			name: "unknown neighboring layer",
+			labels: map[string]string{
+				ctdsnapshotters.TargetLayerDigestLabel: layer1.String(),
+				ctdsnapshotters.TargetImageLayersLabel: layer1.String() + "," + digest.FromString("unknown").String(),
+			},
+			expectErr: true,
+		},
+		{
+			name:      "missing target",
+			labels:    map[string]string{},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels, err := WithLayerSizes(tt.labels, sizes)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if labels[TargetSizeLabel] != tt.expectedSize {
+				t.Errorf("expected size label %q, got %q", tt.expectedSize, labels[TargetSizeLabel])
+			}
+			if labels[targetImageLayersSizeLabel] != tt.expectedLayers {
+				t.Errorf("expected layer sizes label %q, got %q", tt.expectedLayers, labels[targetImageLayersSizeLabel])
+			}
+			if _, ok := tt.labels[TargetSizeLabel]; ok {
+				t.Error("expected the passed labels not to be modified")
+			}
+		})
+	}
+}
+
+func TestLayerLabels(t *testing.T) {
+	const ref = "docker.io/library/rabbitmq:latest"
+	index := digest.FromString("index")
+	manifestDigest := digest.FromString("manifest")
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			{Digest: digest.FromString("layer1"), Size: 10},
+			{Digest: digest.FromString("layer2"), Size: 20, URLs: []string{"https://example.com/layer2?a=1,2", "https://mirror.example.com/layer2"}},
+			{Digest: digest.FromString("layer3"), Size: 30},
+		},
+	}
+
+	labels := LayerLabels(ref, index, manifestDigest, manifest, 1)
+	if labels[ctdsnapshotters.TargetManifestDigestLabel] != manifestDigest.String() {
+		t.Errorf("unexpected manifest digest label %q", labels[ctdsnapshotters.TargetManifestDigestLabel])
+	}
+	if labels[TargetSociIndexDigestLabel] != index.String() {
+		t.Errorf("unexpected index digest label %q", labels[TargetSociIndexDigestLabel])
+	}
+
+	hosts := func(reference.Spec) ([]docker.RegistryHost, error) { return nil, nil }
+	sources, err := FromDefaultLabels(hosts)(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("expected 1 source, got %d", len(sources))
+	}
+	s := sources[0]
+	if s.Name.String() != ref {
+		t.Errorf("unexpected ref %q", s.Name)
+	}
+	if s.Target.Digest != manifest.Layers[1].Digest || s.Target.Size != 20 {
+		t.Errorf("unexpected target %+v", s.Target)
+	}
+	if !reflect.DeepEqual(s.Target.URLs, manifest.Layers[1].URLs) {
+		t.Errorf("unexpected target URLs %v", s.Target.URLs)
+	}
+	var neighbors []ocispec.Descriptor
+	for _, l := range s.Manifest.Layers[1:] {
+		neighbors = append(neighbors, ocispec.Descriptor{Digest: l.Digest, Size: l.Size})
+	}
+	if expected := []ocispec.Descriptor{manifest.Layers[2]}; !reflect.DeepEqual(neighbors, expected) {
+		t.Errorf("unexpected neighboring layers; expected %v, got %v", expected, neighbors)
+	}
+}
+
+func TestVerifyDiffID(t *testing.T) {
+	diffID := digest.FromString("layer")
+	parent := digest.FromString("parent")
+	chainID := digest.FromString(parent.String() + " " + diffID.String())
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		labels    map[string]string
+		expectErr bool
+	}{
+		{
+			name:   "bottom layer",
+			ctx:    WithParentChainID(context.Background(), ""),
+			labels: map[string]string{targetChainIDLabel: diffID.String()},
+		},
+		{
+			name:   "layer on top of parent",
+			ctx:    WithParentChainID(context.Background(), parent.String()),
+			labels: map[string]string{targetChainIDLabel: chainID.String()},
+		},
+		{
+			name:      "mismatch",
+			ctx:       WithParentChainID(context.Background(), ""),
+			labels:    map[string]string{targetChainIDLabel: chainID.String()},
+			expectErr: true,
+		},
+		{
+			name:   "unknown parent",
+			ctx:    context.Background(),
+			labels: map[string]string{targetChainIDLabel: chainID.String()},
+		},
+		{
+			name: "unknown chain ID",
+			ctx:  WithParentChainID(context.Background(), ""),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyDiffID(tt.ctx, tt.labels, diffID)
+			if tt.expectErr != errors.Is(err, ErrDiffIDMismatch) || !tt.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrCorruptedSpan is returned when the cached contents of a span don't match their
+// digest, e.g. because of bit rot or because the cache directory was modified.
+var ErrCorruptedSpan = errors.New("cached span is corrupted")
+
+// CacheVerification is when the cached contents of spans are verified on read.
+type CacheVerification int
+
+const (
+	// VerifyNever never verifies cached spans.
+	VerifyNever CacheVerification = iota
+	// VerifySampled verifies a random sample of the reads of cached spans.
+	VerifySampled
+	// VerifyAlways verifies every read of a cached span.
+	VerifyAlways
+)
+
+// SetCacheVerification sets when the cached contents of spans are verified on read.
+// With VerifySampled, reads are verified with probability sampleRate. Compressed spans
+// are verified against the span digests of the ztoc, and uncompressed spans against
+// the digest of their contents when they were cached. Spans which fail verification
+// are removed from the cache and fetched again. It must be called before the
+// SpanManager is used.
+func (m *SpanManager) SetCacheVerification(v CacheVerification, sampleRate float64) {
+	m.cacheVerification = v
+	m.cacheVerificationSampleRate = sampleRate
+}
+
+// shouldVerifyCache returns whether the next read of a cached span is verified.
+func (m *SpanManager) shouldVerifyCache() bool {
+	switch m.cacheVerification {
+	case VerifyAlways:
+		return true
+	case VerifySampled:
+		return rand.Float64() < m.cacheVerificationSampleRate
+	default:
+		return false
+	}
+}
+
+// setCachedDigest records the digest of the uncompressed contents of s, which are
+// being cached, unless cached spans are never verified.
+func (m *SpanManager) setCachedDigest(s *span, uncompressed []byte) {
+	if m.cacheVerification == VerifyNever {
+		return
+	}
+	s.cachedDigest = digest.FromBytes(uncompressed)
+}
+
+// readVerifiedSpan reads all the cached contents of s, which are compressed if s is
+// `fetched` and uncompressed otherwise, and verifies them. ErrCorruptedSpan is
+// returned if they don't match their digest.
+func (m *SpanManager) readVerifiedSpan(s *span) ([]byte, error) {
+	compressed := s.checkState(fetched)
+	size := s.endUncompOffset - s.startUncompOffset
+	if compressed {
+		size = s.endCompOffset - s.startCompOffset
+	}
+	r, err := m.getSpanFromCache(s.id, 0, size)
+	if err != nil {
+		// the span is cached, so its entry was removed from the cache.
+		return nil, fmt.Errorf("span %d: %v: %w", s.id, err, ErrCorruptedSpan)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("span %d: %v: %w", s.id, err, ErrCorruptedSpan)
+	}
+	if compressed {
+		if err := m.verifySpanContents(buf, s.id); err != nil {
+			return nil, fmt.Errorf("%v: %w", err, ErrCorruptedSpan)
+		}
+	} else if s.cachedDigest != "" {
+		if actual := s.cachedDigest.Algorithm().FromBytes(buf); actual != s.cachedDigest {
+			return nil, fmt.Errorf("span %d: expected %v but got %v: %w", s.id, s.cachedDigest, actual, ErrCorruptedSpan)
+		}
+	}
+	return buf, nil
+}
+
+// discardCorruptedSpan makes s fetched again, since its cached contents are
+// corrupted. The caller must hold the lock of s.
+func (m *SpanManager) discardCorruptedSpan(s *span, err error) error {
+	log.L.WithError(err).Warn("discarding corrupted span from the cache")
+	commonmetrics.IncOperationCount(commonmetrics.SpanCacheVerificationFailureCount, digest.Digest(""))
+	s.cachedDigest = ""
+	return s.setState(unrequested)
+}
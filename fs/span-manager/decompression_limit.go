@@ -0,0 +1,77 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/opencontainers/go-digest"
+)
+
+// decompressionSlots limits the number of spans uncompressed concurrently. It is shared
+// by all span managers, so that many parallel reads across layers don't use all CPUs.
+// It holds a chan struct{} with a slot per concurrent decompression, or a nil chan
+// if decompression isn't limited.
+var decompressionSlots atomic.Value
+
+func init() {
+	SetMaxConcurrentDecompressions(0)
+}
+
+// defaultMaxConcurrentDecompressions returns half the number of CPUs, and at least 1.
+func defaultMaxConcurrentDecompressions() int {
+	if n := runtime.NumCPU() / 2; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// SetMaxConcurrentDecompressions sets the maximum number of spans uncompressed concurrently
+// across all span managers. n == 0 sets the default, which is half the number of CPUs, and
+// n < 0 disables the limit. Decompressions which already hold a slot aren't affected.
+func SetMaxConcurrentDecompressions(n int) {
+	if n == 0 {
+		n = defaultMaxConcurrentDecompressions()
+	}
+	var slots chan struct{}
+	if n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	decompressionSlots.Store(slots)
+}
+
+// acquireDecompressionSlot blocks until a span can be uncompressed, and returns
+// the function which releases the slot.
+func acquireDecompressionSlot() (release func()) {
+	slots := decompressionSlots.Load().(chan struct{})
+	if slots == nil {
+		return func() {}
+	}
+	select {
+	case slots <- struct{}{}:
+	default:
+		start := time.Now()
+		commonmetrics.AddDecompressionQueueDepth(1)
+		slots <- struct{}{}
+		commonmetrics.AddDecompressionQueueDepth(-1)
+		commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.DecompressionWait, digest.Digest(""), start)
+	}
+	return func() { <-slots }
+}
@@ -0,0 +1,65 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrDiskPressure is returned when a span can't be cached because the cache
+// volume is full or failing.
+var ErrDiskPressure = errors.New("span cache is under disk pressure")
+
+// diskPressureBackoff is how long span caching is paused after the cache
+// volume reports an error. Spans requested in the meantime are served from
+// memory and cached when they're requested again after the backoff.
+var diskPressureBackoff = 30 * time.Second
+
+// diskPressureUntil is the time (in unix nanoseconds) until which span caching
+// is paused. It is shared by all span managers since their caches live on the
+// same volume.
+var diskPressureUntil int64
+
+// underDiskPressure returns true if span caching is paused.
+func underDiskPressure() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&diskPressureUntil)
+}
+
+// checkDiskPressure pauses span caching if err is caused by the cache volume
+// being full or failing, and wraps err with ErrDiskPressure in that case.
+func checkDiskPressure(err error) error {
+	if !isDiskPressureErr(err) {
+		return err
+	}
+	atomic.StoreInt64(&diskPressureUntil, time.Now().Add(diskPressureBackoff).UnixNano())
+	commonmetrics.IncOperationCount(commonmetrics.DiskPressure, digest.Digest(""))
+	return fmt.Errorf("%w: %v", ErrDiskPressure, err)
+}
+
+func isDiskPressureErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EDQUOT) ||
+		errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.EROFS)
+}
@@ -0,0 +1,255 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/bufferpool"
+	"github.com/awslabs/soci-snapshotter/util/fips"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrLayerDigestMismatch is returned when the digest of the fully fetched layer
+// doesn't match the layer digest.
+var ErrLayerDigestMismatch = errors.New("layer digest does not match")
+
+// layerDigester computes the digest of the compressed layer progressively, as the
+// compressed contents of its spans become available in order.
+type layerDigester struct {
+	mu       sync.Mutex
+	expected digest.Digest
+	digester digest.Digester
+	// offset is the number of compressed bytes digested so far.
+	offset compression.Offset
+	// nextSpan is the next span to be digested.
+	nextSpan compression.SpanID
+	done     bool
+	err      error
+
+	// sink receives the compressed contents of the layer as they're digested.
+	sink    io.Writer
+	sinkErr error
+	// onVerified is called once all spans are digested.
+	onVerified func(error)
+}
+
+// LayerDigestOption configures the progressive verification of the layer.
+type LayerDigestOption func(*layerDigester)
+
+// WithLayerSink writes the compressed contents of the layer to w as they're digested,
+// so that the verified layer can be stored once all spans are fetched.
+func WithLayerSink(w io.Writer) LayerDigestOption {
+	return func(d *layerDigester) {
+		d.sink = w
+	}
+}
+
+// WithVerifiedHook calls f once all spans are digested. The error is non-nil if
+// the layer failed verification or couldn't be written to the sink.
+func WithVerifiedHook(f func(error)) LayerDigestOption {
+	return func(d *layerDigester) {
+		d.onVerified = f
+	}
+}
+
+// SetLayerDigest enables progressive verification of the layer against dgst. The
+// compressed contents of spans are digested as they're fetched in order, so that once
+// all spans are fetched, the layer is verified without reading it again.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetLayerDigest(dgst digest.Digest, opts ...LayerDigestOption) error {
+	if !dgst.Algorithm().Available() {
+		return fmt.Errorf("unsupported digest algorithm %q", dgst.Algorithm())
+	}
+	if err := fips.CheckDigestAlgorithm(dgst.Algorithm()); err != nil {
+		return err
+	}
+	d := &layerDigester{
+		expected: dgst,
+		digester: dgst.Algorithm().Digester(),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	m.layerDigester = d
+	return nil
+}
+
+// LayerVerified returns whether all spans are fetched and the layer digest is verified.
+// A non-nil error is returned if the layer failed verification.
+func (m *SpanManager) LayerVerified() (bool, error) {
+	d := m.layerDigester
+	if d == nil {
+		return false, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.done && d.err == nil, d.err
+}
+
+// DigestSpansUntil digests the compressed contents of the spans up to and including spanID
+// which haven't been digested yet. Spans which were fetched out of order, and thus skipped
+// when they were fetched, are read from the cache; nothing is fetched again.
+// The spans must be cached already. The error is only about digesting the spans; the
+// result of verifying the layer is reported by LayerVerified and the verified hook.
+func (m *SpanManager) DigestSpansUntil(spanID compression.SpanID) error {
+	d := m.layerDigester
+	if d == nil {
+		return nil
+	}
+	if spanID > m.ztoc.MaxSpanID {
+		spanID = m.ztoc.MaxSpanID
+	}
+	for {
+		d.mu.Lock()
+		next, done := d.nextSpan, d.done
+		d.mu.Unlock()
+		if done || next > spanID {
+			return nil
+		}
+		buf, ok, err := m.exportSpan(m.spans[next])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			buf, ok = m.getPendingSpan(next)
+		}
+		if !ok {
+			return fmt.Errorf("span %d is not cached: %w", next, ErrSpanNotAvailable)
+		}
+		m.digestSpan(next, buf)
+	}
+}
+
+// digestSpan adds the compressed contents of a span to the layer digest if it's
+// the next span to be digested. Spans ahead of the next span are kept in the cache
+// so that they can be digested in order without fetching them again.
+func (m *SpanManager) digestSpan(spanID compression.SpanID, compressed []byte) {
+	d := m.layerDigester
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	ahead := !d.done && d.err == nil && spanID > d.nextSpan
+	done := d.digest(m, spanID, compressed)
+	err := d.err
+	if err == nil {
+		err = d.sinkErr
+	}
+	d.mu.Unlock()
+	if ahead {
+		m.addPendingSpan(spanID, compressed)
+	}
+	if done && d.onVerified != nil {
+		d.onVerified(err)
+	}
+}
+
+// addPendingSpan caches the compressed contents of a span which was fetched before
+// it could be digested. The span's own cache entry may hold its uncompressed
+// contents, so the compressed contents are kept under a separate key.
+// If they can't be cached, DigestSpansUntil fails for the span.
+func (m *SpanManager) addPendingSpan(spanID compression.SpanID, compressed []byte) {
+	if underDiskPressure() {
+		return
+	}
+	opts := append([]cache.Option{cache.Direct()}, m.cacheOpt...)
+	w, err := m.cache.Add(pendingSpanKey(spanID), opts...)
+	if err != nil {
+		return
+	}
+	defer w.Close()
+	if _, err := w.Write(compressed); err != nil {
+		w.Abort()
+		return
+	}
+	w.Commit()
+}
+
+// getPendingSpan returns the compressed contents of a span cached by addPendingSpan.
+func (m *SpanManager) getPendingSpan(spanID compression.SpanID) ([]byte, bool) {
+	r, err := m.cache.Get(pendingSpanKey(spanID), cache.Direct())
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	s := m.spans[spanID]
+	buf, err := io.ReadAll(io.NewSectionReader(r, 0, int64(s.endCompOffset-s.startCompOffset)))
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+func pendingSpanKey(spanID compression.SpanID) string {
+	return fmt.Sprintf("%d.digest", spanID)
+}
+
+// digest adds the compressed contents of span spanID if it's the next span.
+// It returns true if the layer was completed by this span. d.mu must be held.
+func (d *layerDigester) digest(m *SpanManager, spanID compression.SpanID, compressed []byte) bool {
+	if d.done || d.err != nil || spanID != d.nextSpan {
+		return false
+	}
+	s := m.spans[spanID]
+
+	// The gzip header precedes the first span.
+	if spanID == 0 && s.startCompOffset > 0 {
+		header := bufferpool.Get(int(s.startCompOffset))
+		defer bufferpool.Put(header)
+		if _, err := m.r.ReadAt(header, 0); err != nil && err != io.EOF {
+			// retry with the next fetch of span 0.
+			return false
+		}
+		d.write(header)
+		d.offset = s.startCompOffset
+	}
+
+	// Consecutive spans overlap by a byte if the checkpoint isn't at a byte boundary.
+	skip := d.offset - s.startCompOffset
+	if skip < 0 || skip > compression.Offset(len(compressed)) {
+		d.err = fmt.Errorf("span %d doesn't continue the layer at offset %d", spanID, d.offset)
+		d.done = true
+		return true
+	}
+	d.write(compressed[skip:])
+	d.offset = s.endCompOffset
+	d.nextSpan++
+
+	if spanID != m.ztoc.MaxSpanID {
+		return false
+	}
+	d.done = true
+	if actual := d.digester.Digest(); actual != d.expected {
+		d.err = fmt.Errorf("expected %v but got %v: %w", d.expected, actual, ErrLayerDigestMismatch)
+	}
+	return true
+}
+
+func (d *layerDigester) write(p []byte) {
+	d.digester.Hash().Write(p)
+	if d.sink != nil && d.sinkErr == nil {
+		if _, err := d.sink.Write(p); err != nil {
+			d.sinkErr = fmt.Errorf("failed to write layer: %w", err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"sync/atomic"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// ReadStats quantifies the read amplification of a layer, i.e. how much more
+// data is fetched from the registry than is read by the application.
+type ReadStats struct {
+	// BytesFetched is the number of compressed bytes fetched from the registry,
+	// including retries after span verification failures.
+	BytesFetched int64
+	// BytesServed is the number of uncompressed bytes served to the application.
+	BytesServed int64
+	// SpansFetched is the number of spans fetched from the registry.
+	SpansFetched int64
+	// SpansTouched is the number of distinct spans that contents were served from.
+	SpansTouched int64
+	// BytesBySource is the number of uncompressed bytes served, broken down by the
+	// source that satisfied the read, e.g. commonmetrics.ReadSourceSpanCache.
+	BytesBySource map[string]int64
+	// SubSpanReads is the number of reads of spans served by fetching only a prefix
+	// of the span, and SubSpanFallbacks the number of them which fell back to fetching
+	// the whole span because the prefix was too short.
+	SubSpanReads     int64
+	SubSpanFallbacks int64
+}
+
+// BytesAmplification returns the ratio of bytes fetched to bytes served,
+// or 0 if nothing has been served yet.
+func (s ReadStats) BytesAmplification() float64 {
+	if s.BytesServed == 0 {
+		return 0
+	}
+	return float64(s.BytesFetched) / float64(s.BytesServed)
+}
+
+// SpansAmplification returns the ratio of spans fetched to spans touched,
+// or 0 if no span has been touched yet.
+func (s ReadStats) SpansAmplification() float64 {
+	if s.SpansTouched == 0 {
+		return 0
+	}
+	return float64(s.SpansFetched) / float64(s.SpansTouched)
+}
+
+// SourceRatio returns the share of the bytes served that were satisfied by source,
+// or 0 if nothing has been served yet.
+func (s ReadStats) SourceRatio(source string) float64 {
+	var total int64
+	for _, n := range s.BytesBySource {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(s.BytesBySource[source]) / float64(total)
+}
+
+// readSource is the source that satisfied a read.
+type readSource int
+
+const (
+	fromChunkCache readSource = iota
+	fromSpanCache
+	fromMemory
+	fromRemote
+	numReadSources
+)
+
+var readSourceNames = [numReadSources]string{
+	fromChunkCache: commonmetrics.ReadSourceChunkCache,
+	fromSpanCache:  commonmetrics.ReadSourceSpanCache,
+	fromMemory:     commonmetrics.ReadSourceMemory,
+	fromRemote:     commonmetrics.ReadSourceRemote,
+}
+
+// readStatsReportPeriod is the minimum interval between exports of the read stats of
+// a layer from the read path.
+const readStatsReportPeriod = 10 * time.Second
+
+type readStats struct {
+	bytesFetched int64
+	bytesServed  int64
+	spansFetched int64
+	spansTouched int64
+	bySource     [numReadSources]int64
+	subSpanReads int64
+	subSpanFalls int64
+	// lastReport is the time the stats were last exported, in nanoseconds since the epoch.
+	lastReport int64
+}
+
+// ReadStats returns the read amplification stats of the layer.
+func (m *SpanManager) ReadStats() ReadStats {
+	s := ReadStats{
+		BytesFetched:  atomic.LoadInt64(&m.stats.bytesFetched),
+		BytesServed:   atomic.LoadInt64(&m.stats.bytesServed),
+		SpansFetched:  atomic.LoadInt64(&m.stats.spansFetched),
+		SpansTouched:  atomic.LoadInt64(&m.stats.spansTouched),
+		BytesBySource: make(map[string]int64, numReadSources),
+
+		SubSpanReads:     atomic.LoadInt64(&m.stats.subSpanReads),
+		SubSpanFallbacks: atomic.LoadInt64(&m.stats.subSpanFalls),
+	}
+	for src, name := range readSourceNames {
+		s.BytesBySource[name] = atomic.LoadInt64(&m.stats.bySource[src])
+	}
+	return s
+}
+
+// ReportReadStats exports the read amplification stats of the layer as metrics, at most
+// once per readStatsReportPeriod so that it can be called on every read.
+func (m *SpanManager) ReportReadStats(layer digest.Digest) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&m.stats.lastReport)
+	if now-last < int64(readStatsReportPeriod) || !atomic.CompareAndSwapInt64(&m.stats.lastReport, last, now) {
+		return
+	}
+	m.FlushReadStats(layer)
+}
+
+// FlushReadStats exports the read amplification stats of the layer as metrics immediately,
+// e.g. when the layer is released.
+func (m *SpanManager) FlushReadStats(layer digest.Digest) {
+	s := m.ReadStats()
+	commonmetrics.SetLayerReadStats(layer, s.BytesFetched, s.BytesServed, s.SpansFetched, s.SpansTouched)
+	commonmetrics.SetLayerReadSources(layer, s.BytesBySource)
+}
+
+// RecordChunkCacheRead records that n bytes were served from the chunk cache shared by
+// layers instead of the spans of the layer.
+func (m *SpanManager) RecordChunkCacheRead(n int) {
+	atomic.AddInt64(&m.stats.bytesServed, int64(n))
+	atomic.AddInt64(&m.stats.bySource[fromChunkCache], int64(n))
+}
+
+// sourceTally counts the bytes of a read satisfied by each source, which are recorded
+// once the read is served.
+type sourceTally [numReadSources]int64
+
+func (t *sourceTally) add(src readSource, n compression.Offset) {
+	if t != nil {
+		atomic.AddInt64(&t[src], int64(n))
+	}
+}
+
+func (m *SpanManager) recordFetch(n int) {
+	atomic.AddInt64(&m.stats.bytesFetched, int64(n))
+}
+
+func (m *SpanManager) recordSpanFetched() {
+	atomic.AddInt64(&m.stats.spansFetched, 1)
+}
+
+func (m *SpanManager) recordSubSpanRead() {
+	atomic.AddInt64(&m.stats.subSpanReads, 1)
+}
+
+func (m *SpanManager) recordSubSpanFallback() {
+	atomic.AddInt64(&m.stats.subSpanFalls, 1)
+}
+
+// recordServe records that the contents in [start, end) of spans [spanStart, spanEnd] were served,
+// satisfied by the sources counted in tally.
+func (m *SpanManager) recordServe(spanStart, spanEnd compression.SpanID, start, end compression.Offset, tally *sourceTally) {
+	atomic.AddInt64(&m.stats.bytesServed, int64(end-start))
+	for src := range tally {
+		atomic.AddInt64(&m.stats.bySource[src], atomic.LoadInt64(&tally[src]))
+	}
+	for i := spanStart; i <= spanEnd; i++ {
+		if atomic.CompareAndSwapUint32(&m.spans[i].touched, 0, 1) {
+			atomic.AddInt64(&m.stats.spansTouched, 1)
+		}
+	}
+}
+
+// TouchedSpans returns the IDs of the spans that contents were served from, in order.
+func (m *SpanManager) TouchedSpans() []compression.SpanID {
+	var spans []compression.SpanID
+	for i := range m.spans {
+		if atomic.LoadUint32(&m.spans[i].touched) == 1 {
+			spans = append(spans, compression.SpanID(i))
+		}
+	}
+	return spans
+}
@@ -23,6 +23,7 @@ import (
 	"sync/atomic"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
 )
 
 type spanState int
@@ -64,6 +65,12 @@ var stateTransitionMap = map[spanState][]spanState{
 	fetched: {
 		// when span data request comes and span is fetched by bg-fetcher; compressed span is available in cache
 		uncompressed,
+		// when the cached span fails verification; it's fetched again
+		unrequested,
+	},
+	uncompressed: {
+		// when the cached span fails verification; it's fetched again
+		unrequested,
 	},
 }
 
@@ -75,6 +82,22 @@ type span struct {
 	endUncompOffset   compression.Offset
 	state             atomic.Value
 	mu                sync.Mutex
+	// touched is set to 1 once contents of the span are served.
+	touched uint32
+	// waiters is the number of requests waiting for mu to fetch or read the span.
+	waiters int32
+	// failed is set to 1 if the last fetch of the span failed, until it's fetched.
+	failed uint32
+	// cachedDigest is the digest of the uncompressed contents of the span in the
+	// cache, if they're verified on read. It's guarded by mu.
+	cachedDigest digest.Digest
+}
+
+// lock locks mu, counting the caller as waiting for the span until it's locked.
+func (s *span) lock() {
+	atomic.AddInt32(&s.waiters, 1)
+	s.mu.Lock()
+	atomic.AddInt32(&s.waiters, -1)
 }
 
 func (s *span) checkState(expected spanState) bool {
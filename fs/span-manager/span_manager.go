@@ -23,12 +23,13 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sync"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/bufferpool"
+	"github.com/awslabs/soci-snapshotter/util/fips"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
-	"github.com/opencontainers/go-digest"
-	"golang.org/x/sync/errgroup"
 )
 
 // Specific error types raised by SpanManager.
@@ -36,6 +37,11 @@ var (
 	ErrSpanNotAvailable    = errors.New("span not available in cache")
 	ErrIncorrectSpanDigest = errors.New("span digests do not match")
 	ErrExceedMaxSpan       = errors.New("span id larger than max span id")
+	// ErrFetchSpan is returned when the contents of a span can't be fetched. The error
+	// of the fetch is wrapped as well.
+	ErrFetchSpan = errors.New("failed to fetch span")
+	// ErrUncompressSpan is returned when the contents of a span can't be uncompressed.
+	ErrUncompressSpan = errors.New("failed to uncompress span")
 )
 
 // SpanManager fetches and caches spans of a given layer.
@@ -44,9 +50,24 @@ type SpanManager struct {
 	cacheOpt                          []cache.Option
 	zinfo                             compression.Zinfo
 	r                                 *io.SectionReader // reader for contents of the spans managed by SpanManager
+	bgR                               *io.SectionReader // reader for contents of the spans fetched in the background
 	spans                             []*span
 	ztoc                              *ztoc.Ztoc
 	maxSpanVerificationFailureRetries int
+	maxParallelSpans                  int
+	stats                             readStats
+	cachedSource                      readSource // the source of reads served from cache
+	subSpanReads                      bool
+	layerDigester                     *layerDigester
+	tocChecker                        *tocChecker
+	lastFetchErr                      fetchError // the error of the last failed fetch of a span
+	cacheVerification                 CacheVerification
+	cacheVerificationSampleRate       float64
+	// workers are the goroutines of span pipelines, which Close waits for.
+	workers sync.WaitGroup
+	// closed is closed by Close, which stops span pipelines from starting more spans.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 type spanInfo struct {
@@ -75,9 +96,13 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 		cacheOpt:                          cacheOpt,
 		zinfo:                             index,
 		r:                                 r,
+		bgR:                               r,
 		spans:                             spans,
 		ztoc:                              ztoc,
 		maxSpanVerificationFailureRetries: retries,
+		maxParallelSpans:                  runtime.NumCPU(),
+		cachedSource:                      cacheSource(cache),
+		closed:                            make(chan struct{}),
 	}
 	if m.maxSpanVerificationFailureRetries < 0 {
 		m.maxSpanVerificationFailureRetries = defaultSpanVerificationFailureRetries
@@ -90,6 +115,30 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 	return m
 }
 
+// cacheSource returns the source of reads served from c.
+func cacheSource(c cache.BlobCache) readSource {
+	if _, ok := c.(*cache.MemoryCache); ok {
+		return fromMemory
+	}
+	return fromSpanCache
+}
+
+// SetMaxParallelSpans sets the maximum number of spans which are fetched and uncompressed
+// in parallel to serve a single read. n <= 0 keeps the default, which is the number of CPUs.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetMaxParallelSpans(n int) {
+	if n > 0 {
+		m.maxParallelSpans = n
+	}
+}
+
+// SetBackgroundReader sets the reader of the spans fetched in the background by
+// FetchSingleSpan, e.g. one which fetches them with a lower priority than reads.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetBackgroundReader(r *io.SectionReader) {
+	m.bgR = r
+}
+
 func (m *SpanManager) buildAllSpans() {
 	var i compression.SpanID
 	for i = 0; i <= m.ztoc.MaxSpanID; i++ {
@@ -108,8 +157,17 @@ func (m *SpanManager) buildAllSpans() {
 
 // FetchSingleSpan invokes the reader to fetch the span in the background and cache
 // the span without uncompressing. It is invoked by the BackgroundFetcher.
+// If the TOC check is enabled, the spans which are hydrated are checked afterwards.
 // span state change: unrequested -> requested -> fetched.
 func (m *SpanManager) FetchSingleSpan(spanID compression.SpanID) error {
+	if err := m.fetchSingleSpan(spanID); err != nil {
+		return err
+	}
+	m.checkTOC()
+	return nil
+}
+
+func (m *SpanManager) fetchSingleSpan(spanID compression.SpanID) error {
 	if spanID > m.ztoc.MaxSpanID {
 		return ErrExceedMaxSpan
 	}
@@ -120,17 +178,78 @@ func (m *SpanManager) FetchSingleSpan(spanID compression.SpanID) error {
 		return nil
 	}
 
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
 	// check again after acquiring Lock
 	if !s.checkState(unrequested) {
 		return nil
 	}
 
-	_, err := m.fetchAndCacheSpan(spanID, false)
+	// a span fetched in the background is only useful once it's cached,
+	// so don't fetch it while it can't be cached.
+	if underDiskPressure() {
+		return ErrDiskPressure
+	}
+
+	_, err := m.fetchAndCacheSpan(spanID, false, true)
 	return err
 }
 
+// FetchSpans fetches and caches the spans containing the uncompressed contents
+// in [startUncompOffset, endUncompOffset). Spans which are already cached are skipped.
+// Fetching stops before the next span once ctx is canceled.
+func (m *SpanManager) FetchSpans(ctx context.Context, startUncompOffset, endUncompOffset compression.Offset) error {
+	spans, ok := compression.Spans(m.zinfo, startUncompOffset, endUncompOffset-startUncompOffset)
+	if !ok {
+		return nil
+	}
+	for i := spans.First; i <= spans.Last; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := m.FetchSingleSpan(i); err != nil {
+			return fmt.Errorf("failed to fetch span %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// FetchAllSpans fetches and caches all spans of the layer.
+// Fetching stops before the next span once ctx is canceled.
+func (m *SpanManager) FetchAllSpans(ctx context.Context) error {
+	var i compression.SpanID
+	for i = 0; i <= m.ztoc.MaxSpanID; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := m.FetchSingleSpan(i); err != nil {
+			return fmt.Errorf("failed to fetch span %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SpanRange returns the IDs of the first and the last span containing the uncompressed
+// contents in [startUncompOffset, endUncompOffset). ok is false if the range is empty.
+func (m *SpanManager) SpanRange(startUncompOffset, endUncompOffset compression.Offset) (first, last compression.SpanID, ok bool) {
+	spans, ok := compression.Spans(m.zinfo, startUncompOffset, endUncompOffset-startUncompOffset)
+	return spans.First, spans.Last, ok
+}
+
+// MaxSpanID returns the ID of the last span of the layer.
+func (m *SpanManager) MaxSpanID() compression.SpanID {
+	return m.ztoc.MaxSpanID
+}
+
+// IsCached returns whether the span is cached, either compressed or uncompressed.
+func (m *SpanManager) IsCached(spanID compression.SpanID) bool {
+	if spanID > m.ztoc.MaxSpanID {
+		return false
+	}
+	s := m.spans[spanID]
+	return s.checkState(fetched) || s.checkState(uncompressed)
+}
+
 // resolveSpan ensures the span exists in cache and is uncompressed by calling
 // `getSpanContent`. Only for testing.
 func (m *SpanManager) resolveSpan(spanID compression.SpanID) error {
@@ -139,42 +258,84 @@ func (m *SpanManager) resolveSpan(spanID compression.SpanID) error {
 	}
 
 	// this func itself doesn't use the returned span data
-	_, err := m.getSpanContent(spanID, 0, m.spans[spanID].endUncompOffset)
+	s := m.spans[spanID]
+	_, err := m.getSpanContent(spanID, 0, s.endUncompOffset-s.startUncompOffset, false, nil)
 	return err
 }
 
+// ContentsOption configures how GetContents reads the contents of spans.
+type ContentsOption func(*contentsOptions)
+
+type contentsOptions struct {
+	skipCache     bool
+	skipReadStats bool
+}
+
+// SkipCache doesn't cache the uncompressed contents of the spans which are read,
+// e.g. for files opened with O_DIRECT, which are cached by the application.
+// The compressed spans are still cached, so that they aren't fetched again.
+func SkipCache() ContentsOption {
+	return func(o *contentsOptions) {
+		o.skipCache = true
+	}
+}
+
+// SkipReadStats doesn't record the contents which are read as served, e.g. when the
+// whole layer is read to unpack it, rather than by the containers which use the layer.
+func SkipReadStats() ContentsOption {
+	return func(o *contentsOptions) {
+		o.skipReadStats = true
+	}
+}
+
 // GetContents returns a reader for the requested contents. The contents may be
-// across multiple spans.
-func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression.Offset) (io.Reader, error) {
+// across multiple spans. Spans are fetched and uncompressed in parallel, and the
+// reader returns their contents in order as soon as they're available.
+// An error resolving the first span is returned directly; errors resolving the
+// following spans are returned by the reader. No more spans are resolved once
+// ctx is done. The contents are recorded as served once they have all been read.
+func (m *SpanManager) GetContents(ctx context.Context, startUncompOffset, endUncompOffset compression.Offset, opts ...ContentsOption) (io.Reader, error) {
+	var o contentsOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	si := m.getSpanInfo(startUncompOffset, endUncompOffset)
-	numSpans := si.spanEnd - si.spanStart + 1
-	spanReaders := make([]io.Reader, numSpans)
+	tally := &sourceTally{}
 
-	eg, _ := errgroup.WithContext(context.Background())
-	var i compression.SpanID
-	for i = 0; i < numSpans; i++ {
-		j := i
-		eg.Go(func() error {
-			spanID := j + si.spanStart
-			r, err := m.getSpanContent(spanID, si.startOffInSpan[j], si.endOffInSpan[j])
-			if err != nil {
-				return err
-			}
-			spanReaders[j] = r
-			return nil
-		})
+	var r io.Reader
+	if si.spanStart == si.spanEnd {
+		sr, err := m.getSpanContent(si.spanStart, si.startOffInSpan[0], si.endOffInSpan[0], o.skipCache, tally)
+		if err != nil {
+			return nil, err
+		}
+		r = sr
+	} else {
+		p := m.newSpanPipeline(ctx, si, m.maxParallelSpans, o.skipCache, tally)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		r = p
 	}
-	if err := eg.Wait(); err != nil {
-		return nil, err
+	if endUncompOffset <= startUncompOffset || o.skipReadStats {
+		return r, nil
 	}
-
-	return io.MultiReader(spanReaders...), nil
+	return &servedReader{
+		r:         r,
+		remaining: endUncompOffset - startUncompOffset,
+		onServed: func() {
+			m.recordServe(si.spanStart, si.spanEnd, startUncompOffset, endUncompOffset, tally)
+		},
+	}, nil
 }
 
-// getSpanInfo returns spanInfo from the offsets of the requested file
+// getSpanInfo returns spanInfo from the offsets of the requested file. offsetEnd is
+// exclusive, so a read which ends at the end of a span doesn't touch the next span.
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *spanInfo {
 	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
-	spanEnd := m.zinfo.UncompressedOffsetToSpanID(offsetEnd)
+	spanEnd := spanStart
+	if offsetEnd > offsetStart {
+		spanEnd = m.zinfo.UncompressedOffsetToSpanID(offsetEnd - 1)
+	}
 	numSpans := spanEnd - spanStart + 1
 	start := make([]compression.Offset, numSpans)
 	end := make([]compression.Offset, numSpans)
@@ -214,38 +375,90 @@ func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *sp
 //  2. For `fetched` span, read and uncompress the compressed span from cache, cache and
 //     return the reader from the uncompressed span.
 //  3. For `unrequested` span, fetch-uncompress-cache the span data, return the reader
-//     from the uncompressed span
+//     from the uncompressed span. With sub-span reads, a small read only fetches and
+//     uncompresses a prefix of the span, which isn't cached.
 //  4. No span state lock will be acquired in `requested` state.
-func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, offsetEnd compression.Offset) (io.Reader, error) {
+//
+// If skipCache is true, the uncompressed span isn't cached: an `unrequested` span is
+// fetched and cached compressed, and uncompressed like a `fetched` span.
+//
+// The source that satisfied the read is counted in tally, which may be nil.
+func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, offsetEnd compression.Offset, skipCache bool, tally *sourceTally) (io.Reader, error) {
 	s := m.spans[spanID]
 	size := offsetEnd - offsetStart
+	// cached spans are only verified while holding the lock, since corrupted spans
+	// are discarded.
+	verify := m.shouldVerifyCache()
 
 	// return from cache directly if cached and uncompressed
-	if s.checkState(uncompressed) {
+	if !verify && s.checkState(uncompressed) {
+		tally.add(m.cachedSource, size)
 		return m.getSpanFromCache(s.id, offsetStart, size)
 	}
 
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
 	// check again after acquiring lock
 	if s.checkState(uncompressed) {
-		return m.getSpanFromCache(s.id, offsetStart, size)
+		if !verify {
+			tally.add(m.cachedSource, size)
+			return m.getSpanFromCache(s.id, offsetStart, size)
+		}
+		buf, err := m.readVerifiedSpan(s)
+		if err == nil {
+			tally.add(m.cachedSource, size)
+			return bytes.NewReader(buf[offsetStart : offsetStart+size]), nil
+		}
+		if !errors.Is(err, ErrCorruptedSpan) {
+			return nil, err
+		}
+		if err := m.discardCorruptedSpan(s, err); err != nil {
+			return nil, err
+		}
 	}
 
-	// if cached but not uncompressed, uncompress and cache the span content
-	if s.checkState(fetched) {
-		// get compressed span from the cache
-		compressedSize := s.endCompOffset - s.startCompOffset
-		r, err := m.getSpanFromCache(s.id, 0, compressedSize)
-		if err != nil {
+	// the compressed span is verified before it's uncompressed.
+	var verifiedBuf []byte
+	if verify && s.checkState(fetched) {
+		buf, err := m.readVerifiedSpan(s)
+		switch {
+		case err == nil:
+			verifiedBuf = buf
+		case errors.Is(err, ErrCorruptedSpan):
+			if err := m.discardCorruptedSpan(s, err); err != nil {
+				return nil, err
+			}
+		default:
 			return nil, err
 		}
+	}
 
-		// read compressed span
-		compressedBuf, err := io.ReadAll(r)
-		if err != nil {
+	source := m.cachedSource
+	if skipCache && s.checkState(unrequested) {
+		if _, err := m.fetchAndCacheSpan(s.id, false, false); err != nil && !errors.Is(err, ErrDiskPressure) {
 			return nil, err
 		}
+		source = fromRemote
+	}
+
+	// if cached but not uncompressed, uncompress and cache the span content
+	if s.checkState(fetched) {
+		compressedBuf := verifiedBuf
+		if compressedBuf == nil {
+			// get compressed span from the cache
+			compressedSize := s.endCompOffset - s.startCompOffset
+			r, err := m.getSpanFromCache(s.id, 0, compressedSize)
+			if err != nil {
+				return nil, err
+			}
+
+			// read compressed span
+			compressedBuf = bufferpool.Get(int(compressedSize))
+			defer bufferpool.Put(compressedBuf)
+			if _, err := io.ReadFull(r, compressedBuf); err != nil {
+				return nil, err
+			}
+		}
 
 		// uncompress span
 		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
@@ -253,32 +466,53 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 			return nil, err
 		}
 
-		// cache uncompressed span
-		if err := m.addSpanToCache(s.id, uncompSpanBuf, m.cacheOpt...); err != nil {
-			return nil, err
+		tally.add(source, size)
+		if skipCache {
+			return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
 		}
-		if err := s.setState(uncompressed); err != nil {
-			return nil, err
+		// cache uncompressed span. If the cache is under disk pressure, serve
+		// the span from memory; the span stays `fetched` so it's uncompressed
+		// and cached again on the next request.
+		if err := m.addSpanToCache(s.id, uncompSpanBuf, m.cacheOpt...); err != nil {
+			if !errors.Is(err, ErrDiskPressure) {
+				return nil, err
+			}
+		} else {
+			m.setCachedDigest(s, uncompSpanBuf)
+			if err := s.setState(uncompressed); err != nil {
+				return nil, err
+			}
 		}
 		return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
 	}
 
+	// a small read may only need a prefix of the span, which isn't cached.
+	if data, ok, err := m.readSubSpan(s, offsetStart, offsetEnd); err != nil {
+		return nil, err
+	} else if ok {
+		tally.add(fromRemote, size)
+		return bytes.NewReader(data), nil
+	}
+
 	// fetch-uncompress-cache span: span state can only be `unrequested` since
 	// no goroutine will release span state lock in `requested` state
-	uncompBuf, err := m.fetchAndCacheSpan(s.id, true)
+	uncompBuf, err := m.fetchAndCacheSpan(s.id, true, false)
 	if err != nil {
 		return nil, err
 	}
+	tally.add(fromRemote, size)
 	buf := bytes.NewBuffer(uncompBuf[offsetStart : offsetStart+size])
 	return io.Reader(buf), nil
 }
 
 // fetchAndCacheSpan fetches a span, uncompresses the span if `uncompress == true`,
-// caches and returns the span content. The span state is set to `fetched/uncompressed`,
-// depending on if `uncompress` is enabled.
+// and caches the span content. The span state is set to `fetched/uncompressed`,
+// depending on if `uncompress` is enabled. The uncompressed span content is returned
+// if `uncompress` is enabled; otherwise the returned buffer is nil. Spans fetched
+// in the `background` are read with the background reader.
 // The caller needs to check the span state (e.g. `unrequested`) and acquires the
 // span's state lock before calling.
-func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bool) (buf []byte, err error) {
+func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress, background bool) (buf []byte, err error) {
 	s := m.spans[spanID]
 
 	// change to `requested`; if fetch/cache fails, change back to `unrequested`
@@ -290,13 +524,17 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 		if err != nil && s.checkState(requested) {
 			s.setState(unrequested)
 		}
+		m.recordFetchResult(s, err)
 	}()
 
 	// fetch compressed span
-	compressedBuf, err := m.fetchSpanWithRetries(spanID)
+	compressedBuf, err := m.fetchSpanWithRetries(spanID, background)
 	if err != nil {
 		return nil, err
 	}
+	// the cache keeps its own copy of the data, so the buffer can be reused once it's added.
+	defer bufferpool.Put(compressedBuf)
+	m.digestSpan(spanID, compressedBuf)
 
 	buf = compressedBuf
 	var state = fetched
@@ -311,13 +549,27 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 		state = uncompressed
 	}
 
-	// cache span data
+	// cache span data. If the cache is under disk pressure, uncompressed span
+	// data is still returned to be served from memory, and the span goes back
+	// to `unrequested` so it's fetched and cached again on the next request.
 	if err := m.addSpanToCache(spanID, buf, m.cacheOpt...); err != nil {
+		if uncompress && errors.Is(err, ErrDiskPressure) {
+			if err := s.setState(unrequested); err != nil {
+				return nil, err
+			}
+			return buf, nil
+		}
 		return nil, err
 	}
+	if uncompress {
+		m.setCachedDigest(s, buf)
+	}
 	if err := s.setState(state); err != nil {
 		return nil, err
 	}
+	if !uncompress {
+		return nil, nil
+	}
 	return buf, nil
 }
 
@@ -325,35 +577,62 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 // It will retry the fetch and verification m.maxSpanVerificationFailureRetries times.
 // It does not retry when there is an error fetching the data, because retries already happen lower in the stack in httpFetcher.
 // If there is an error fetching data from remote, it is not an transient error.
-func (m *SpanManager) fetchSpanWithRetries(spanID compression.SpanID) ([]byte, error) {
+// The returned buffer is from bufferpool and should be put back once it isn't referenced anymore.
+func (m *SpanManager) fetchSpanWithRetries(spanID compression.SpanID, background bool) (_ []byte, err error) {
 	s := m.spans[spanID]
 	offset := s.startCompOffset
 	compressedSize := s.endCompOffset - s.startCompOffset
-	compressedBuf := make([]byte, compressedSize)
+	compressedBuf := bufferpool.Get(int(compressedSize))
+	defer func() {
+		if err != nil {
+			bufferpool.Put(compressedBuf)
+		}
+	}()
 
-	var (
-		err error
-		n   int
-	)
+	r := m.r
+	if background {
+		r = m.bgR
+	}
+	var n int
 	for i := 0; i < m.maxSpanVerificationFailureRetries+1; i++ {
-		n, err = m.r.ReadAt(compressedBuf, int64(offset))
+		n, err = r.ReadAt(compressedBuf, int64(offset))
+		m.recordFetch(n)
 		// if the n = len(p) bytes returned by ReadAt are at the end of the input source,
 		// ReadAt may return either err == EOF or err == nil: https://pkg.go.dev/io#ReaderAt
 		if err != nil && err != io.EOF {
-			return []byte{}, err
+			return []byte{}, &spanFetchError{id: spanID, err: err}
 		}
 
 		if n != len(compressedBuf) {
-			return []byte{}, fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(compressedBuf))
+			return []byte{}, &spanFetchError{id: spanID, err: fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(compressedBuf))}
 		}
 
 		if err = m.verifySpanContents(compressedBuf, spanID); err == nil {
+			m.recordSpanFetched()
 			return compressedBuf, nil
 		}
 	}
 	return []byte{}, err
 }
 
+// spanFetchError is the error of a fetch of a span, which is both ErrFetchSpan and err.
+type spanFetchError struct {
+	id  compression.SpanID
+	err error
+}
+
+func (e *spanFetchError) Error() string {
+	return fmt.Sprintf("%v %d: %v", ErrFetchSpan, e.id, e.err)
+}
+
+func (e *spanFetchError) Unwrap() error {
+	return e.err
+}
+
+func (e *spanFetchError) Is(target error) bool {
+	return target == ErrFetchSpan
+}
+
 // uncompressSpan uses zinfo to extract uncompressed span data from compressed
 // span data.
 func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
@@ -364,29 +643,37 @@ func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, err
 		return []byte{}, nil
 	}
 
+	release := acquireDecompressionSlot()
 	bytes, err := m.zinfo.ExtractDataFromBuffer(compressedBuf, uncompSize, s.startUncompOffset, s.id)
+	release()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("span %d: %v: %w", s.id, err, ErrUncompressSpan)
 	}
 	return bytes, nil
 }
 
 // addSpanToCache adds contents of the span to the cache.
 // A non-nil error is returned if the data is not written to the cache.
+// The error wraps ErrDiskPressure if the cache volume is full or failing.
 func (m *SpanManager) addSpanToCache(spanID compression.SpanID, contents []byte, opts ...cache.Option) error {
+	if underDiskPressure() {
+		return ErrDiskPressure
+	}
 	w, err := m.cache.Add(fmt.Sprintf("%d", spanID), opts...)
 	if err != nil {
-		return err
+		return checkDiskPressure(err)
 	}
 	defer w.Close()
 
 	_, err = w.Write(contents)
 	if err != nil {
 		w.Abort()
-		return err
+		return checkDiskPressure(err)
 	}
 
-	w.Commit()
+	if err := w.Commit(); err != nil {
+		return checkDiskPressure(err)
+	}
 	return nil
 }
 
@@ -407,16 +694,27 @@ func (m *SpanManager) getSpanFromCache(spanID compression.SpanID, offset, size c
 // verifySpanContents caculates span digest from its compressed bytes, and compare
 // with the digest stored in ztoc.
 func (m *SpanManager) verifySpanContents(compressedData []byte, spanID compression.SpanID) error {
-	actual := digest.FromBytes(compressedData)
 	expected := m.ztoc.SpanDigests[spanID]
+	if !expected.Algorithm().Available() {
+		return fmt.Errorf("unsupported digest algorithm %q for span %d: %w", expected.Algorithm(), spanID, ErrIncorrectSpanDigest)
+	}
+	if err := fips.CheckDigestAlgorithm(expected.Algorithm()); err != nil {
+		return fmt.Errorf("span %d: %v: %w", spanID, err, ErrIncorrectSpanDigest)
+	}
+	actual := expected.Algorithm().FromBytes(compressedData)
 	if actual != expected {
 		return fmt.Errorf("expected %v but got %v: %w", expected, actual, ErrIncorrectSpanDigest)
 	}
 	return nil
 }
 
-// Close closes both the underlying zinfo data and blob cache.
+// Close closes both the underlying zinfo data and blob cache. It stops span pipelines
+// from starting more spans and waits for the spans they're resolving.
 func (m *SpanManager) Close() {
-	m.zinfo.Close()
-	m.cache.Close()
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.workers.Wait()
+		m.zinfo.Close()
+		m.cache.Close()
+	})
 }
@@ -19,16 +19,23 @@ package spanmanager
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"reflect"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
 )
 
 func init() {
@@ -162,7 +169,7 @@ func TestSpanManagerCache(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Test resolveSpanFromCache
-			spanR, err := m.getSpanContent(compression.SpanID(spanID), tc.offset, tc.offset+tc.size)
+			spanR, err := m.getSpanContent(compression.SpanID(spanID), tc.offset, tc.offset+tc.size, false, nil)
 			if err != nil {
 				t.Fatalf("error resolving span from cache")
 			}
@@ -237,7 +244,7 @@ func TestStateTransition(t *testing.T) {
 					t.Fatalf("failed transitioning to Fetched state")
 				}
 			} else {
-				_, err := m.getSpanContent(tc.spanID, 0, s.endUncompOffset-s.startUncompOffset)
+				_, err := m.getSpanContent(tc.spanID, 0, s.endUncompOffset-s.startUncompOffset, false, nil)
 				if err != nil {
 					t.Fatalf("failed getting the span for on-demand fetch: %v", err)
 				}
@@ -284,25 +291,25 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Fetched state with valid new state",
 			currentState: fetched,
-			newState:     []spanState{uncompressed},
+			newState:     []spanState{uncompressed, unrequested},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Fetched state with invalid new state",
 			currentState: fetched,
-			newState:     []spanState{unrequested, requested, fetched},
+			newState:     []spanState{requested, fetched},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 		{
 			name:         "span in Uncompressed state with valid new state",
 			currentState: uncompressed,
-			newState:     []spanState{},
+			newState:     []spanState{unrequested},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Uncompressed state with invalid new state",
 			currentState: uncompressed,
-			newState:     []spanState{unrequested, requested, fetched, uncompressed},
+			newState:     []spanState{requested, fetched, uncompressed},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 	}
@@ -361,7 +368,7 @@ func TestSpanManagerRetries(t *testing.T) {
 			for i := 0; i < int(ztoc.MaxSpanID); i++ {
 				rdr.errCount = 0
 
-				_, err := sm.fetchAndCacheSpan(compression.SpanID(i), true)
+				_, err := sm.fetchAndCacheSpan(compression.SpanID(i), true, false)
 				if !errors.Is(err, tc.expectedErr) {
 					t.Fatalf("unexpected err; expected %v, got %v", tc.expectedErr, err)
 				}
@@ -407,7 +414,7 @@ func getFileContentFromSpans(m *SpanManager, toc *ztoc.Ztoc, fileName string) ([
 	}
 	offsetStart := metadata.UncompressedOffset
 	offsetEnd := offsetStart + metadata.UncompressedSize
-	r, err := m.GetContents(offsetStart, offsetEnd)
+	r, err := m.GetContents(context.Background(), offsetStart, offsetEnd)
 	if err != nil {
 		return nil, err
 	}
@@ -423,3 +430,820 @@ type readerFn func([]byte, int64) (int, error)
 func (f readerFn) ReadAt(b []byte, n int64) (int, error) {
 	return f(b, n)
 }
+
+func TestSpanManagerDiskPressure(t *testing.T) {
+	defer func() { diskPressureUntil = 0 }()
+
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(spanSize) * 3)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-manager-disk-pressure-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	fc := &failingCache{BlobCache: cache.NewMemoryCache(), err: syscall.ENOSPC}
+	m := New(toc, r, fc, 0)
+
+	// reads are served from memory while the cache is full.
+	data, err := getFileContentFromSpans(m, toc, "span-manager-disk-pressure-test")
+	if err != nil {
+		t.Fatalf("failed to read file under disk pressure: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("file content doesn't match under disk pressure")
+	}
+	if !underDiskPressure() {
+		t.Fatal("expected span caching to be paused")
+	}
+	for _, s := range m.spans {
+		if !s.checkState(unrequested) {
+			t.Fatalf("span %d was marked as cached under disk pressure", s.id)
+		}
+	}
+	if err := m.FetchSingleSpan(0); !errors.Is(err, ErrDiskPressure) {
+		t.Fatalf("expected background fetch to fail with ErrDiskPressure, got %v", err)
+	}
+
+	// spans are cached again once the backoff expires.
+	fc.err = nil
+	diskPressureUntil = 0
+	if err := m.resolveSpan(0); err != nil {
+		t.Fatalf("failed to resolve span after disk pressure: %v", err)
+	}
+	if !m.spans[0].checkState(uncompressed) {
+		t.Fatal("expected span to be cached after disk pressure")
+	}
+}
+
+// failingCache is a cache.BlobCache which fails to add data with err.
+type failingCache struct {
+	cache.BlobCache
+	err error
+}
+
+func (c *failingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.BlobCache.Add(key, opts...)
+}
+
+func TestSpanManagerReadStats(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("read-stats-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+
+	// read the same contents of span 0 twice; the span is only fetched once.
+	for i := 0; i < 2; i++ {
+		r, err := m.GetContents(context.Background(), 0, 100)
+		if err != nil {
+			t.Fatalf("failed to get contents: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			t.Fatalf("failed to read contents: %v", err)
+		}
+	}
+	// contents which are never read aren't served.
+	if _, err := m.GetContents(context.Background(), 0, 100); err != nil {
+		t.Fatalf("failed to get contents: %v", err)
+	}
+	// fetch span 1 in the background without serving its contents.
+	if err := m.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span 1: %v", err)
+	}
+	// contents read with SkipReadStats aren't served either.
+	start := m.spans[1].startUncompOffset
+	r1, err := m.GetContents(context.Background(), start, start+100, SkipReadStats())
+	if err != nil {
+		t.Fatalf("failed to get contents: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, r1); err != nil {
+		t.Fatalf("failed to read contents: %v", err)
+	}
+
+	span0 := m.spans[0].endCompOffset - m.spans[0].startCompOffset
+	span1 := m.spans[1].endCompOffset - m.spans[1].startCompOffset
+	expected := ReadStats{
+		BytesFetched: int64(span0 + span1),
+		BytesServed:  200,
+		SpansFetched: 2,
+		SpansTouched: 1,
+		// the first read is fetched and the second one is served from the memory cache.
+		BytesBySource: map[string]int64{
+			commonmetrics.ReadSourceChunkCache: 0,
+			commonmetrics.ReadSourceSpanCache:  0,
+			commonmetrics.ReadSourceMemory:     100,
+			commonmetrics.ReadSourceRemote:     100,
+		},
+	}
+	stats := m.ReadStats()
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("unexpected read stats; expected %+v, got %+v", expected, stats)
+	}
+	if stats.SourceRatio(commonmetrics.ReadSourceMemory) != 0.5 {
+		t.Fatalf("unexpected memory ratio; expected 0.5, got %v", stats.SourceRatio(commonmetrics.ReadSourceMemory))
+	}
+	if stats.SpansAmplification() != 2 {
+		t.Fatalf("unexpected spans amplification; expected 2, got %v", stats.SpansAmplification())
+	}
+	if expected := float64(span0+span1) / 200; stats.BytesAmplification() != expected {
+		t.Fatalf("unexpected bytes amplification; expected %v, got %v", expected, stats.BytesAmplification())
+	}
+	if touched := m.TouchedSpans(); !reflect.DeepEqual(touched, []compression.SpanID{0}) {
+		t.Fatalf("unexpected touched spans; expected [0], got %v", touched)
+	}
+}
+
+func TestSpanManagerSubSpanReads(t *testing.T) {
+	var spanSize compression.Offset = 262144 // 256 KiB
+	content := testutil.RandomByteData(int64(2 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("sub-span-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	defer m.Close()
+	m.SetSubSpanReads(true)
+
+	// the whole spans are read from a span manager without sub-span reads.
+	whole := New(toc, r, cache.NewMemoryCache(), 0)
+	defer whole.Close()
+
+	read := func(m *SpanManager, start, end compression.Offset) []byte {
+		r, err := m.GetContents(context.Background(), start, end)
+		if err != nil {
+			t.Fatalf("failed to get contents: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read contents: %v", err)
+		}
+		return data
+	}
+	span0 := m.spans[0]
+	expected := read(whole, 0, span0.endUncompOffset)
+
+	// a small read at the beginning of the span only fetches a prefix of it.
+	if data := read(m, 100, 1124); !bytes.Equal(data, expected[100:1124]) {
+		t.Fatal("unexpected contents of sub-span read")
+	}
+	stats := m.ReadStats()
+	if stats.SubSpanReads != 1 || stats.SpansFetched != 0 {
+		t.Fatalf("expected a sub-span read without fetching the span, got %+v", stats)
+	}
+	if compSize := int64(span0.endCompOffset - span0.startCompOffset); stats.BytesFetched >= compSize/2 {
+		t.Fatalf("expected less than half of the span to be fetched, got %d of %d bytes", stats.BytesFetched, compSize)
+	}
+	if m.IsCached(0) {
+		t.Fatal("expected a sub-span read not to cache the span")
+	}
+
+	// a read at the end of the span fetches and caches the whole span.
+	end := span0.endUncompOffset
+	if data := read(m, end-1024, end); !bytes.Equal(data, expected[end-1024:end]) {
+		t.Fatal("unexpected contents of read at the end of the span")
+	}
+	if stats := m.ReadStats(); stats.SubSpanReads != 1 || stats.SpansFetched != 1 || !m.IsCached(0) {
+		t.Fatalf("expected the whole span to be fetched and cached, got %+v", stats)
+	}
+}
+
+func TestSpanManagerExportImport(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("export-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	src := New(toc, r, cache.NewMemoryCache(), 0)
+	defer src.Close()
+
+	// span 0 is read (uncompressed), spans 1 and 2 are fetched in the background (compressed).
+	if _, err := src.GetContents(context.Background(), 0, 100); err != nil {
+		t.Fatalf("failed to get contents: %v", err)
+	}
+	for _, id := range []compression.SpanID{1, 2} {
+		if err := src.FetchSingleSpan(id); err != nil {
+			t.Fatalf("failed to fetch span %d: %v", id, err)
+		}
+	}
+
+	// only the spans cached compressed are exported, without fetching anything.
+	fetched := src.ReadStats().BytesFetched
+	exported := make(map[compression.SpanID][]byte)
+	if err := src.ExportSpans(func(id compression.SpanID, b []byte) error {
+		exported[id] = b
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to export spans: %v", err)
+	}
+	if len(exported) != 2 || exported[1] == nil || exported[2] == nil {
+		t.Fatalf("expected spans 1 and 2 to be exported, got %d spans", len(exported))
+	}
+	if src.ReadStats().BytesFetched != fetched {
+		t.Fatalf("expected export not to fetch spans")
+	}
+
+	// the destination can't fetch anything, so all reads must be served from imported spans.
+	failingReader := io.NewSectionReader(readerFn(func(b []byte, n int64) (int, error) {
+		return 0, errors.New("unexpected fetch")
+	}), 0, r.Size())
+	dst := New(toc, failingReader, cache.NewMemoryCache(), 0)
+	defer dst.Close()
+	if err := dst.ImportSpan(3, exported[1]); !errors.Is(err, ErrIncorrectSpanDigest) {
+		t.Fatalf("expected importing mismatching contents to fail with %v, got %v", ErrIncorrectSpanDigest, err)
+	}
+	for id, b := range exported {
+		if err := dst.ImportSpan(id, b); err != nil {
+			t.Fatalf("failed to import span %d: %v", id, err)
+		}
+	}
+	if !dst.spans[3].checkState(unrequested) {
+		t.Fatalf("expected span 3 to stay unrequested")
+	}
+	start := src.spans[1].startUncompOffset
+	end := src.spans[2].endUncompOffset
+	expected, err := src.GetContents(context.Background(), start, end)
+	if err != nil {
+		t.Fatalf("failed to get contents from source: %v", err)
+	}
+	actual, err := dst.GetContents(context.Background(), start, end)
+	if err != nil {
+		t.Fatalf("failed to get contents from imported spans: %v", err)
+	}
+	expectedBytes, _ := io.ReadAll(expected)
+	actualBytes, _ := io.ReadAll(actual)
+	if !bytes.Equal(expectedBytes, actualBytes) {
+		t.Fatalf("imported spans don't match the source")
+	}
+}
+
+func TestSpanManagerCacheVerification(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(2 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("cache-verification-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		v           CacheVerification
+		expectFixed bool
+	}{
+		{name: "never", v: VerifyNever, expectFixed: false},
+		{name: "always", v: VerifyAlways, expectFixed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mc := cache.NewMemoryCache().(*cache.MemoryCache)
+			m := New(toc, r, mc, 0)
+			defer m.Close()
+			m.SetCacheVerification(tc.v, 0)
+
+			// span 0 is cached uncompressed, span 1 compressed.
+			expected, err := io.ReadAll(mustGetContents(t, m, 0, m.spans[1].endUncompOffset))
+			if err != nil {
+				t.Fatalf("failed to read contents: %v", err)
+			}
+			if err := m.FetchSingleSpan(1); err != nil {
+				t.Fatalf("failed to fetch span 1: %v", err)
+			}
+			for _, key := range []string{"0", "1"} {
+				mc.Membuf[key].Bytes()[10] ^= 0xff
+			}
+			fetched := m.ReadStats().BytesFetched
+
+			actual, err := io.ReadAll(mustGetContents(t, m, 0, m.spans[0].endUncompOffset))
+			if err != nil {
+				t.Fatalf("failed to read contents: %v", err)
+			}
+			if fixed := bytes.Equal(actual, expected[:len(actual)]); fixed != tc.expectFixed {
+				t.Fatalf("expected corrupted span 0 to be fixed: %v, got %v", tc.expectFixed, fixed)
+			}
+			if !tc.expectFixed {
+				return
+			}
+			actual, err = io.ReadAll(mustGetContents(t, m, m.spans[1].startUncompOffset, m.spans[1].endUncompOffset))
+			if err != nil {
+				t.Fatalf("failed to read contents: %v", err)
+			}
+			if !bytes.Equal(actual, expected[m.spans[1].startUncompOffset:]) {
+				t.Fatalf("expected corrupted span 1 to be fixed")
+			}
+			if m.ReadStats().BytesFetched == fetched {
+				t.Fatalf("expected corrupted spans to be fetched again")
+			}
+			if !m.spans[0].checkState(uncompressed) || !m.spans[1].checkState(uncompressed) {
+				t.Fatalf("expected corrupted spans to be cached again")
+			}
+		})
+	}
+}
+
+func mustGetContents(t *testing.T, m *SpanManager, start, end compression.Offset) io.Reader {
+	t.Helper()
+	r, err := m.GetContents(context.Background(), start, end)
+	if err != nil {
+		t.Fatalf("failed to get contents: %v", err)
+	}
+	return r
+}
+
+func TestSpanManagerParallelRead(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(8 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("parallel-read-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	for _, parallelism := range []int{1, 2, 16} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			m := New(toc, r, cache.NewMemoryCache(), 0)
+			defer m.Close()
+			m.SetMaxParallelSpans(parallelism)
+			expected, err := getFileContentFromSpans(m, toc, "parallel-read-test")
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if !bytes.Equal(expected, content) {
+				t.Fatalf("contents read in parallel don't match")
+			}
+		})
+	}
+
+	t.Run("error in a later span", func(t *testing.T) {
+		m := New(toc, r, cache.NewMemoryCache(), 0)
+		defer m.Close()
+		failAt := m.spans[2].startCompOffset
+		m.r = io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			if off >= int64(failAt) {
+				return 0, errors.New("fetch failed")
+			}
+			return r.ReadAt(b, off)
+		}), 0, r.Size())
+		contents, err := m.GetContents(context.Background(), 0, m.spans[m.ztoc.MaxSpanID].endUncompOffset)
+		if err != nil {
+			t.Fatalf("expected the first span to be resolved, got %v", err)
+		}
+		if _, err := io.ReadAll(contents); !errors.Is(err, ErrFetchSpan) {
+			t.Fatalf("expected reading a failing span to fail with ErrFetchSpan, got %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		m := New(toc, r, cache.NewMemoryCache(), 0)
+		m.SetMaxParallelSpans(1)
+		// the fetch of the second span blocks until Close has started.
+		release := make(chan struct{})
+		blockAt := m.spans[1].startCompOffset
+		m.r = io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			if off >= int64(blockAt) {
+				<-release
+			}
+			return r.ReadAt(b, off)
+		}), 0, r.Size())
+		contents, err := m.GetContents(context.Background(), 0, m.spans[m.ztoc.MaxSpanID].endUncompOffset)
+		if err != nil {
+			t.Fatalf("expected the first span to be resolved, got %v", err)
+		}
+		closed := make(chan struct{})
+		go func() {
+			m.Close()
+			close(closed)
+		}()
+		<-m.closed
+		close(release)
+		<-closed
+		if _, err := io.ReadAll(contents); !errors.Is(err, errSpanManagerClosed) {
+			t.Fatalf("expected the spans after Close not to be resolved, got %v", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		m := New(toc, r, cache.NewMemoryCache(), 0)
+		defer m.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := m.GetContents(ctx, 0, m.spans[m.ztoc.MaxSpanID].endUncompOffset); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected reading to be canceled, got %v", err)
+		}
+		if stats := m.ReadStats(); stats.BytesServed != 0 {
+			t.Fatalf("expected nothing to be served after cancellation, got %d bytes", stats.BytesServed)
+		}
+	})
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	defer SetMaxConcurrentDecompressions(0)
+
+	SetMaxConcurrentDecompressions(1)
+	release := acquireDecompressionSlot()
+	acquired := make(chan struct{})
+	go func() {
+		acquireDecompressionSlot()()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("expected the second decompression to wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the second decompression to get the released slot")
+	}
+
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("decompression-limit-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	for _, limit := range []int{1, -1} {
+		t.Run(fmt.Sprintf("limit=%d", limit), func(t *testing.T) {
+			SetMaxConcurrentDecompressions(limit)
+			m := New(toc, r, cache.NewMemoryCache(), 0)
+			defer m.Close()
+			m.SetMaxParallelSpans(4)
+			actual, err := getFileContentFromSpans(m, toc, "decompression-limit-test")
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if !bytes.Equal(actual, content) {
+				t.Fatalf("contents don't match")
+			}
+		})
+	}
+}
+
+// BenchmarkSpanManagerFetch measures fetching and caching spans in the background
+// and serving them afterwards, as the read path does under load.
+func BenchmarkSpanManagerFetch(b *testing.B) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(8 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("fetch-bench", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(b, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		b.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	defer m.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range m.spans {
+			s.state.Store(unrequested)
+		}
+		if err := m.FetchAllSpans(context.Background()); err != nil {
+			b.Fatalf("failed to fetch spans: %v", err)
+		}
+		if _, err := getFileContentFromSpans(m, toc, "fetch-bench"); err != nil {
+			b.Fatalf("failed to read file: %v", err)
+		}
+	}
+}
+
+func TestSpanManagerLayerDigest(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("layer-digest-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	layerDigest, err := digest.FromReader(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatalf("failed to digest layer: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		digest      digest.Digest
+		readFirst   bool
+		expectedErr error
+	}{
+		{
+			name:   "spans fetched in order",
+			digest: layerDigest,
+		},
+		{
+			name:      "a span read before the others",
+			digest:    layerDigest,
+			readFirst: true,
+		},
+		{
+			name:        "wrong digest",
+			digest:      digest.FromString("wrong"),
+			expectedErr: ErrLayerDigestMismatch,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New(toc, r, cache.NewMemoryCache(), 0)
+			defer m.Close()
+			var sink bytes.Buffer
+			var hookCalls int
+			var hookErr error
+			if err := m.SetLayerDigest(tc.digest, WithLayerSink(&sink), WithVerifiedHook(func(err error) {
+				hookCalls++
+				hookErr = err
+			})); err != nil {
+				t.Fatalf("failed to set layer digest: %v", err)
+			}
+			if tc.readFirst {
+				if _, err := m.GetContents(context.Background(), m.spans[2].startUncompOffset, m.spans[2].startUncompOffset+10); err != nil {
+					t.Fatalf("failed to read span 2: %v", err)
+				}
+			}
+			if err := m.FetchAllSpans(context.Background()); err != nil {
+				t.Fatalf("failed to fetch spans: %v", err)
+			}
+			if err := m.DigestSpansUntil(m.ztoc.MaxSpanID); err != nil {
+				t.Fatalf("failed to digest spans: %v", err)
+			}
+			verified, err := m.LayerVerified()
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if verified != (tc.expectedErr == nil) {
+				t.Fatalf("unexpected verification result: %t", verified)
+			}
+			// the verification result isn't reported as a failure to digest spans.
+			if err := m.DigestSpansUntil(m.ztoc.MaxSpanID); err != nil {
+				t.Fatalf("expected digesting the verified layer to succeed, got %v", err)
+			}
+			if hookCalls != 1 || !errors.Is(hookErr, tc.expectedErr) {
+				t.Fatalf("expected verified hook to be called once with %v, got %d calls with %v", tc.expectedErr, hookCalls, hookErr)
+			}
+			// spans read out of order are digested from the cache, not fetched again.
+			if stats := m.ReadStats(); stats.SpansFetched != int64(m.ztoc.MaxSpanID)+1 {
+				t.Fatalf("expected each span to be fetched once, got %d fetches", stats.SpansFetched)
+			}
+			if sink.Len() != int(r.Size()) {
+				t.Fatalf("expected %d bytes written to sink, got %d", r.Size(), sink.Len())
+			}
+			if actual := digest.FromBytes(sink.Bytes()); actual != layerDigest {
+				t.Fatalf("expected sink contents with digest %v, got %v", layerDigest, actual)
+			}
+		})
+	}
+}
+
+func TestSpanManagerFetchCanceled(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("fetch-canceled-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.FetchAllSpans(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected fetch to be canceled, got %v", err)
+	}
+	if err := m.FetchSpans(ctx, 0, m.spans[2].endUncompOffset); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected fetch to be canceled, got %v", err)
+	}
+	if stats := m.ReadStats(); stats.SpansFetched != 0 {
+		t.Fatalf("expected no spans to be fetched after cancellation, got %d", stats.SpansFetched)
+	}
+}
+
+func TestSpanManagerSpanRange(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-range-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	defer m.Close()
+
+	first, last, ok := m.SpanRange(m.spans[1].startUncompOffset, m.spans[2].endUncompOffset)
+	if !ok || first != 1 || last != 2 {
+		t.Fatalf("unexpected span range: got (%d, %d, %v), expected (1, 2, true)", first, last, ok)
+	}
+	if _, _, ok := m.SpanRange(10, 10); ok {
+		t.Fatalf("expected empty range to have no spans")
+	}
+
+	if m.IsCached(1) {
+		t.Fatalf("expected span 1 not to be cached before fetching it")
+	}
+	if err := m.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span 1: %v", err)
+	}
+	if !m.IsCached(1) {
+		t.Fatalf("expected span 1 to be cached after fetching it")
+	}
+	if m.IsCached(0) || m.IsCached(m.MaxSpanID()+1) {
+		t.Fatalf("expected spans which weren't fetched not to be cached")
+	}
+}
+
+func TestSpanManagerSpanStates(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := testutil.RandomByteData(int64(4 * spanSize))
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-states-test", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	rdr := &retryableReaderAt{inner: r}
+	m := New(toc, io.NewSectionReader(rdr, 0, r.Size()), cache.NewMemoryCache(), 0)
+	defer m.Close()
+	total := int(m.MaxSpanID()) + 1
+
+	if err := m.FetchSingleSpan(0); err != nil {
+		t.Fatalf("failed to fetch span 0: %v", err)
+	}
+	s1 := m.spans[1]
+	if _, err := m.getSpanContent(1, 0, s1.endUncompOffset-s1.startUncompOffset, false, nil); err != nil {
+		t.Fatalf("failed to read span 1: %v", err)
+	}
+	// the fetch of span 2 fails since the reader returns corrupted data.
+	rdr.maxErrors = 1
+	if err := m.FetchSingleSpan(2); !errors.Is(err, ErrIncorrectSpanDigest) {
+		t.Fatalf("expected ErrIncorrectSpanDigest, got %v", err)
+	}
+	// span 3 is queued while another request holds it.
+	m.spans[3].mu.Lock()
+	done := make(chan error)
+	go func() {
+		done <- m.FetchSingleSpan(3)
+	}()
+	for atomic.LoadInt32(&m.spans[3].waiters) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	states := m.SpanStates()
+	if states.LastError == "" || states.LastErrorTime == nil {
+		t.Fatalf("expected the error of the failed fetch, got %+v", states)
+	}
+	states.LastError, states.LastErrorTime = "", nil
+	expected := SpanStates{
+		Total:        total,
+		Unrequested:  total - 2,
+		Queued:       1,
+		Fetched:      1,
+		Uncompressed: 1,
+		Failed:       1,
+		FailedSpans:  []compression.SpanID{2},
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Fatalf("unexpected span states; expected %+v, got %+v", expected, states)
+	}
+
+	m.spans[3].mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("failed to fetch span 3: %v", err)
+	}
+	rdr.errCount, rdr.maxErrors = 0, 0
+	if err := m.FetchSingleSpan(2); err != nil {
+		t.Fatalf("failed to fetch span 2 again: %v", err)
+	}
+	states = m.SpanStates()
+	if states.Fetched != 3 || states.Queued != 0 || states.Failed != 0 || states.FailedSpans != nil {
+		t.Fatalf("unexpected span states after fetching spans 2 and 3: %+v", states)
+	}
+}
+
+func TestReportReadStatsPeriod(t *testing.T) {
+	m := &SpanManager{}
+	layer := digest.FromString("layer")
+
+	m.ReportReadStats(layer)
+	first := m.stats.lastReport
+	if first == 0 {
+		t.Fatalf("expected the first read stats to be reported")
+	}
+	m.ReportReadStats(layer)
+	if m.stats.lastReport != first {
+		t.Fatalf("expected read stats not to be reported again within %v", readStatsReportPeriod)
+	}
+}
+
+func TestSpanManagerTOCCheck(t *testing.T) {
+	var spanSize compression.Offset = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/a", string(testutil.RandomByteData(int64(2*spanSize)))),
+		testutil.File("dir/b", "b"),
+		testutil.Symlink("link", "dir/b"),
+		testutil.File("c", string(testutil.RandomByteData(int64(2*spanSize)))),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		drift              func(entries []ztoc.FileMetadata) []ztoc.FileMetadata
+		expectedMismatches []string
+	}{
+		{
+			name: "matching TOC",
+		},
+		{
+			name: "drifted TOC",
+			drift: func(entries []ztoc.FileMetadata) []ztoc.FileMetadata {
+				entries[1].UncompressedSize++
+				entries[2].Name = "dir/B"
+				entries[2].UncompressedOffset += 512
+				return entries[:len(entries)-1]
+			},
+			expectedMismatches: []string{"dir/a:size", "dir/B:name", "dir/B:offset", "c:entry"},
+		},
+		{
+			name: "missing entries",
+			drift: func(entries []ztoc.FileMetadata) []ztoc.FileMetadata {
+				return append(entries, ztoc.FileMetadata{Name: "missing"})
+			},
+			expectedMismatches: []string{"missing:entry"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			drifted := *toc
+			drifted.FileMetadata = append([]ztoc.FileMetadata(nil), toc.FileMetadata...)
+			if tc.drift != nil {
+				drifted.FileMetadata = tc.drift(drifted.FileMetadata)
+			}
+			m := New(&drifted, r, cache.NewMemoryCache(), 0)
+			defer m.Close()
+			var hookCalls int
+			m.SetTOCCheck(func(TOCCheckReport) { hookCalls++ })
+
+			// the check stops at the first span which isn't hydrated.
+			if err := m.FetchSingleSpan(0); err != nil {
+				t.Fatalf("failed to fetch span 0: %v", err)
+			}
+			if report, _ := m.TOCCheckReport(); report.Done || report.CheckedEntries != 2 {
+				t.Fatalf("expected the first 2 entries to be checked, got %+v", report)
+			}
+			if err := m.FetchAllSpans(context.Background()); err != nil {
+				t.Fatalf("failed to fetch spans: %v", err)
+			}
+			report, ok := m.TOCCheckReport()
+			if !ok || !report.Done || report.Error != "" || hookCalls != 1 {
+				t.Fatalf("expected the check to be done once, got %+v after %d calls", report, hookCalls)
+			}
+			if report.CheckedEntries != len(drifted.FileMetadata) {
+				t.Fatalf("expected %d entries to be checked, got %d", len(drifted.FileMetadata), report.CheckedEntries)
+			}
+			var mismatches []string
+			for _, mismatch := range report.Mismatches {
+				mismatches = append(mismatches, mismatch.Name+":"+mismatch.Field)
+			}
+			if report.MismatchCount != len(tc.expectedMismatches) || !reflect.DeepEqual(mismatches, tc.expectedMismatches) {
+				t.Fatalf("expected mismatches %v, got %v", tc.expectedMismatches, mismatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// errSpanManagerClosed is the error of spans which weren't resolved since the
+// SpanManager was closed.
+var errSpanManagerClosed = errors.New("span manager is closed")
+
+type spanResult struct {
+	r   io.Reader
+	err error
+}
+
+// spanPipeline reads the contents of consecutive spans in order, while the following
+// spans are fetched and uncompressed in the background. At most `parallelism` spans
+// are resolved at the same time.
+type spanPipeline struct {
+	ctx     context.Context
+	results []chan spanResult
+	next    int
+	cur     io.Reader
+	err     error
+}
+
+// newSpanPipeline starts resolving the spans described by si. Spans which have started
+// resolving are resolved to completion, but no more spans are started once ctx is done
+// or the SpanManager is closed. Close waits for the goroutines of the pipeline.
+func (m *SpanManager) newSpanPipeline(ctx context.Context, si *spanInfo, parallelism int, skipCache bool, tally *sourceTally) *spanPipeline {
+	numSpans := int(si.spanEnd - si.spanStart + 1)
+	p := &spanPipeline{
+		ctx:     ctx,
+		results: make([]chan spanResult, numSpans),
+	}
+	for i := range p.results {
+		p.results[i] = make(chan spanResult, 1)
+	}
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		sem := make(chan struct{}, parallelism)
+		for i := 0; i < numSpans; i++ {
+			var err error
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-m.closed:
+				err = errSpanManagerClosed
+			}
+			if err != nil {
+				for ; i < numSpans; i++ {
+					p.results[i] <- spanResult{err: err}
+				}
+				return
+			}
+			m.workers.Add(1)
+			go func(i int) {
+				defer m.workers.Done()
+				defer func() { <-sem }()
+				p.results[i] <- m.resolvePipelineSpan(ctx, si, i, skipCache, tally)
+			}(i)
+		}
+	}()
+	return p
+}
+
+// resolvePipelineSpan resolves the i-th span of si, unless ctx is done or the
+// SpanManager is closed by the time the span gets its turn.
+func (m *SpanManager) resolvePipelineSpan(ctx context.Context, si *spanInfo, i int, skipCache bool, tally *sourceTally) spanResult {
+	if err := ctx.Err(); err != nil {
+		return spanResult{err: err}
+	}
+	select {
+	case <-m.closed:
+		return spanResult{err: errSpanManagerClosed}
+	default:
+	}
+	spanID := si.spanStart + compression.SpanID(i)
+	r, err := m.getSpanContent(spanID, si.startOffInSpan[i], si.endOffInSpan[i], skipCache, tally)
+	return spanResult{r: r, err: err}
+}
+
+// advance waits for the next span and makes it the current reader.
+func (p *spanPipeline) advance() error {
+	var res spanResult
+	if err := p.ctx.Err(); err != nil {
+		res.err = err
+	} else {
+		select {
+		case res = <-p.results[p.next]:
+		case <-p.ctx.Done():
+			res.err = p.ctx.Err()
+		}
+	}
+	p.next++
+	if res.err != nil {
+		p.err = res.err
+		return res.err
+	}
+	p.cur = res.r
+	return nil
+}
+
+func (p *spanPipeline) Read(b []byte) (int, error) {
+	for {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.cur == nil {
+			if p.next == len(p.results) {
+				return 0, io.EOF
+			}
+			if err := p.advance(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// servedReader reads the requested contents of spans and records them as served
+// once they have all been read.
+type servedReader struct {
+	r         io.Reader
+	remaining compression.Offset
+	onServed  func()
+}
+
+func (r *servedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 && r.remaining > 0 {
+		r.remaining -= compression.Offset(n)
+		if r.remaining <= 0 {
+			r.onServed()
+		}
+	}
+	return n, err
+}
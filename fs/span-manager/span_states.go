@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// maxFailedSpans is the number of the IDs of failed spans reported by SpanStates.
+const maxFailedSpans = 100
+
+// SpanStates is the number of the spans of a layer in each state, e.g. to find out why
+// the background fetch of a layer doesn't make progress.
+type SpanStates struct {
+	// Total is the number of spans of the layer.
+	Total int `json:"total"`
+	// Unrequested spans aren't cached and aren't being fetched.
+	Unrequested int `json:"unrequested"`
+	// InFlight spans are being fetched.
+	InFlight int `json:"inFlight"`
+	// Queued spans are waited for by requests, e.g. while they're in flight for another
+	// request or being uncompressed. Queued spans are also counted by their state.
+	Queued int `json:"queued"`
+	// Fetched spans are cached compressed.
+	Fetched int `json:"fetched"`
+	// Uncompressed spans are cached uncompressed.
+	Uncompressed int `json:"uncompressed"`
+	// Failed spans weren't fetched by their last fetch. Failed spans are also counted by
+	// their state, which is unrequested unless they're fetched again.
+	Failed int `json:"failed"`
+	// FailedSpans are the IDs of the first failed spans.
+	FailedSpans []compression.SpanID `json:"failedSpans,omitempty"`
+	// LastError is the error of the last failed fetch of a span, and LastErrorTime is when
+	// it failed.
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// fetchError is the error of the last failed fetch of a span.
+type fetchError struct {
+	mu   sync.Mutex
+	err  error
+	time time.Time
+}
+
+// SpanStates returns the number of the spans of the layer in each state. The states of
+// the spans are read without locking them, so they may be changing meanwhile.
+func (m *SpanManager) SpanStates() SpanStates {
+	states := SpanStates{Total: len(m.spans)}
+	for _, s := range m.spans {
+		switch s.state.Load().(spanState) {
+		case unrequested:
+			states.Unrequested++
+		case requested:
+			states.InFlight++
+		case fetched:
+			states.Fetched++
+		case uncompressed:
+			states.Uncompressed++
+		}
+		if atomic.LoadInt32(&s.waiters) > 0 {
+			states.Queued++
+		}
+		if atomic.LoadUint32(&s.failed) == 1 {
+			states.Failed++
+			if len(states.FailedSpans) < maxFailedSpans {
+				states.FailedSpans = append(states.FailedSpans, s.id)
+			}
+		}
+	}
+	m.lastFetchErr.mu.Lock()
+	if m.lastFetchErr.err != nil {
+		states.LastError = m.lastFetchErr.err.Error()
+		t := m.lastFetchErr.time
+		states.LastErrorTime = &t
+	}
+	m.lastFetchErr.mu.Unlock()
+	return states
+}
+
+// recordFetchResult records whether the last fetch of the span s failed with err.
+func (m *SpanManager) recordFetchResult(s *span, err error) {
+	if err == nil {
+		atomic.StoreUint32(&s.failed, 0)
+		return
+	}
+	atomic.StoreUint32(&s.failed, 1)
+	m.lastFetchErr.mu.Lock()
+	m.lastFetchErr.err = err
+	m.lastFetchErr.time = time.Now()
+	m.lastFetchErr.mu.Unlock()
+}
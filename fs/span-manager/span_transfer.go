@@ -0,0 +1,106 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// ExportSpans calls fn with the compressed contents of every span that is cached
+// compressed. Compressed contents can be verified against the span digests of the
+// ztoc, so they can be imported into the cache of another SpanManager with ImportSpan.
+//
+// The cache only keeps the uncompressed contents of spans which have been read, so
+// these spans aren't exported; nothing is fetched from the layer.
+func (m *SpanManager) ExportSpans(fn func(spanID compression.SpanID, compressed []byte) error) error {
+	var i compression.SpanID
+	for i = 0; i <= m.ztoc.MaxSpanID; i++ {
+		buf, ok, err := m.exportSpan(m.spans[i])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(i, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportSpan returns the compressed contents of s if they are cached.
+func (m *SpanManager) exportSpan(s *span) ([]byte, bool, error) {
+	if !s.checkState(fetched) {
+		return nil, false, nil
+	}
+	// fetched spans share their cache entry with the uncompressed contents,
+	// so hold the lock to keep the span from being uncompressed while it's read.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkState(fetched) {
+		return nil, false, nil
+	}
+	buf, err := m.getCompressedSpanFromCache(s)
+	return buf, err == nil, err
+}
+
+// ImportSpan adds the compressed contents of a span, as returned by ExportSpans,
+// to the cache. The contents are verified against the span digest in the ztoc.
+// Spans which are already cached or being fetched are left as they are.
+// span state change: unrequested -> requested -> fetched.
+func (m *SpanManager) ImportSpan(spanID compression.SpanID, compressed []byte) (err error) {
+	if spanID < 0 || spanID > m.ztoc.MaxSpanID {
+		return ErrExceedMaxSpan
+	}
+	if err := m.verifySpanContents(compressed, spanID); err != nil {
+		return err
+	}
+
+	s := m.spans[spanID]
+	if !s.checkState(unrequested) {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkState(unrequested) {
+		return nil
+	}
+
+	if err := s.setState(requested); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.setState(unrequested)
+		}
+	}()
+	if err := m.addSpanToCache(spanID, compressed, m.cacheOpt...); err != nil {
+		return err
+	}
+	return s.setState(fetched)
+}
+
+func (m *SpanManager) getCompressedSpanFromCache(s *span) ([]byte, error) {
+	r, err := m.getSpanFromCache(s.id, 0, s.endCompOffset-s.startCompOffset)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
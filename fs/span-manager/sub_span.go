@@ -0,0 +1,80 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/util/bufferpool"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+const (
+	// subSpanMargin is how much more compressed data than estimated from the average
+	// compression ratio of the span is fetched for a sub-span read, since the ratio
+	// varies within the span.
+	subSpanMargin = 1.25
+	// subSpanSlack is fetched beyond the estimate, so that reads at the very
+	// beginning of a span don't fall short.
+	subSpanSlack = 16 << 10
+)
+
+// SetSubSpanReads sets whether reads of spans which aren't cached fetch and uncompress
+// the span only from its checkpoint up to the end of the read, instead of the whole span.
+// This cuts the read amplification of small random reads, but the fetched data can't be
+// verified against the span digest and isn't cached. It must be called before the
+// SpanManager is used.
+func (m *SpanManager) SetSubSpanReads(enabled bool) {
+	m.subSpanReads = enabled
+}
+
+// readSubSpan returns the uncompressed contents of span s in [offsetStart, offsetEnd),
+// which are offsets within the span, by fetching only a prefix of the compressed span.
+// ok is false if the whole span should be fetched instead, because sub-span reads are
+// disabled, the prefix wouldn't be much smaller than the span, or it turned out to be
+// too short to uncompress the contents.
+func (m *SpanManager) readSubSpan(s *span, offsetStart, offsetEnd compression.Offset) (_ []byte, ok bool, _ error) {
+	compSize := s.endCompOffset - s.startCompOffset
+	uncompSize := s.endUncompOffset - s.startUncompOffset
+	if !m.subSpanReads || compSize <= 0 || uncompSize <= 0 {
+		return nil, false, nil
+	}
+	prefixSize := compression.Offset(float64(compSize)*float64(offsetEnd)/float64(uncompSize)*subSpanMargin) + subSpanSlack
+	if prefixSize > compSize/2 {
+		return nil, false, nil
+	}
+
+	buf := bufferpool.Get(int(prefixSize))
+	defer bufferpool.Put(buf)
+	n, err := m.r.ReadAt(buf, int64(s.startCompOffset))
+	m.recordFetch(n)
+	if err != nil && err != io.EOF {
+		return nil, false, &spanFetchError{id: s.id, err: err}
+	}
+
+	release := acquireDecompressionSlot()
+	data, err := m.zinfo.ExtractDataFromBuffer(buf[:n], offsetEnd-offsetStart, s.startUncompOffset+offsetStart, s.id)
+	release()
+	if err != nil {
+		// the prefix was too short, or is corrupted: the whole span is fetched
+		// and verified instead.
+		m.recordSubSpanFallback()
+		return nil, false, nil
+	}
+	m.recordSubSpanRead()
+	return data, true, nil
+}
@@ -0,0 +1,267 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// maxTOCMismatches is the number of mismatches kept in the TOC check report of a layer.
+const maxTOCMismatches = 100
+
+// errNotHydrated is returned when the TOC check reaches a span which isn't cached yet.
+var errNotHydrated = errors.New("span is not hydrated")
+
+// TOCMismatch is a difference between an entry of the TOC of the ztoc and the tar
+// header of the entry in the layer.
+type TOCMismatch struct {
+	// Index is the index of the entry in the TOC.
+	Index int `json:"index"`
+	// Name is the name of the entry in the TOC, or in the layer if it's not in the TOC.
+	Name string `json:"name"`
+	// Field is the field which differs: "name", "size" or "offset", or "entry" if the
+	// entry is only in the TOC or only in the layer.
+	Field    string `json:"field"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// TOCCheckReport is the progress and the result of the TOC check of a layer.
+type TOCCheckReport struct {
+	// CheckedEntries is the number of entries of the TOC checked so far.
+	CheckedEntries int `json:"checkedEntries"`
+	TotalEntries   int `json:"totalEntries"`
+	// Done is true once the whole layer is checked, or the check failed.
+	Done bool `json:"done"`
+	// MismatchCount is the number of mismatches, of which the first maxTOCMismatches
+	// are in Mismatches.
+	MismatchCount int           `json:"mismatchCount"`
+	Mismatches    []TOCMismatch `json:"mismatches,omitempty"`
+	// Error is why the check stopped before the end of the layer, e.g. an invalid tar header.
+	Error string `json:"error,omitempty"`
+}
+
+// tocChecker cross-checks the entries of the TOC against the tar headers of the layer,
+// as the spans containing them are hydrated.
+type tocChecker struct {
+	entries []ztoc.FileMetadata
+
+	// running is set while a goroutine checks the hydrated spans; the fields below
+	// up to mu are only used by that goroutine.
+	running int32
+	// pos is the uncompressed offset of the next tar header.
+	pos compression.Offset
+	// buf holds the uncompressed contents of span bufSpan, which the last header was read from.
+	buf     []byte
+	bufSpan compression.SpanID
+
+	mu     sync.Mutex
+	report TOCCheckReport
+	onDone func(TOCCheckReport)
+}
+
+// SetTOCCheck enables the TOC check of the layer. When spans are fetched in the
+// background, the tar headers in the spans which are cached are parsed in order and
+// compared to the names, sizes and offsets of the entries of the TOC, so that
+// ztocs which don't match their layers, e.g. because of buggy builders, are detected.
+// Spans are only uncompressed to be checked if they contain tar headers; nothing is
+// fetched for the check. onDone, if not nil, is called with the report once the whole
+// layer is checked. It must be called before the SpanManager is used.
+func (m *SpanManager) SetTOCCheck(onDone func(TOCCheckReport)) {
+	m.tocChecker = &tocChecker{
+		entries: m.ztoc.FileMetadata,
+		bufSpan: -1,
+		report:  TOCCheckReport{TotalEntries: len(m.ztoc.FileMetadata)},
+		onDone:  onDone,
+	}
+}
+
+// TOCCheckReport returns the report of the TOC check of the layer, and false if the
+// TOC check isn't enabled.
+func (m *SpanManager) TOCCheckReport() (TOCCheckReport, bool) {
+	c := m.tocChecker
+	if c == nil {
+		return TOCCheckReport{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := c.report
+	report.Mismatches = append([]TOCMismatch(nil), c.report.Mismatches...)
+	return report, true
+}
+
+// checkTOC checks the tar headers from where the check stopped, until it reaches a
+// span which isn't hydrated yet. Only one goroutine checks a layer at a time; other
+// goroutines return immediately.
+func (m *SpanManager) checkTOC() {
+	c := m.tocChecker
+	if c == nil || !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&c.running, 0)
+	// the last span is uncompressed again when the check continues, rather than
+	// keeping it in memory while its layer waits for the next spans.
+	defer func() {
+		c.buf, c.bufSpan = nil, -1
+	}()
+
+	for {
+		c.mu.Lock()
+		done := c.report.Done
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		r := &hydratedReader{m: m, c: c, off: c.pos}
+		hdr, err := tar.NewReader(r).Next()
+		switch {
+		case errors.Is(err, errNotHydrated):
+			return
+		case err == io.EOF:
+			c.finish(nil)
+		case err != nil:
+			c.finish(fmt.Errorf("failed to read tar header at %d: %w", c.pos, err))
+		default:
+			c.check(hdr, r.off)
+			// the contents of the entry are padded to the block size.
+			c.pos = r.off + compression.Offset((hdr.Size+511)&^511)
+		}
+	}
+}
+
+// check compares the header of the next entry, whose contents start at offset, to the TOC.
+func (c *tocChecker) check(hdr *tar.Header, offset compression.Offset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := c.report.CheckedEntries
+	if idx >= c.report.TotalEntries {
+		c.addMismatch(TOCMismatch{Index: idx, Name: hdr.Name, Field: "entry", Actual: hdr.Name})
+		return
+	}
+	c.report.CheckedEntries++
+	e := c.entries[idx]
+	if e.Name != hdr.Name {
+		c.addMismatch(TOCMismatch{Index: idx, Name: e.Name, Field: "name", Expected: e.Name, Actual: hdr.Name})
+	}
+	if int64(e.UncompressedSize) != hdr.Size {
+		c.addMismatch(TOCMismatch{Index: idx, Name: e.Name, Field: "size",
+			Expected: strconv.FormatInt(int64(e.UncompressedSize), 10), Actual: strconv.FormatInt(hdr.Size, 10)})
+	}
+	if e.UncompressedOffset != offset {
+		c.addMismatch(TOCMismatch{Index: idx, Name: e.Name, Field: "offset",
+			Expected: strconv.FormatInt(int64(e.UncompressedOffset), 10), Actual: strconv.FormatInt(int64(offset), 10)})
+	}
+}
+
+// finish completes the check, which failed if err is non-nil. Otherwise, the entries
+// of the TOC which weren't checked aren't in the layer.
+func (c *tocChecker) finish(err error) {
+	c.mu.Lock()
+	if err != nil {
+		c.report.Error = err.Error()
+	} else {
+		for _, e := range c.entries[c.report.CheckedEntries:] {
+			c.addMismatch(TOCMismatch{Index: c.report.CheckedEntries, Name: e.Name, Field: "entry", Expected: e.Name})
+			c.report.CheckedEntries++
+		}
+	}
+	c.report.Done = true
+	report := c.report
+	c.mu.Unlock()
+	if c.onDone != nil {
+		c.onDone(report)
+	}
+}
+
+// addMismatch records a mismatch. c.mu must be held.
+func (c *tocChecker) addMismatch(mismatch TOCMismatch) {
+	c.report.MismatchCount++
+	if len(c.report.Mismatches) < maxTOCMismatches {
+		c.report.Mismatches = append(c.report.Mismatches, mismatch)
+	}
+}
+
+// hydratedReader reads the uncompressed layer from off, as long as the spans it
+// reads from are cached. errNotHydrated is returned once it reaches a span which isn't.
+type hydratedReader struct {
+	m   *SpanManager
+	c   *tocChecker
+	off compression.Offset
+}
+
+func (r *hydratedReader) Read(p []byte) (int, error) {
+	if r.off >= r.m.ztoc.UncompressedArchiveSize {
+		return 0, io.EOF
+	}
+	spanID := r.m.zinfo.UncompressedOffsetToSpanID(r.off)
+	s := r.m.spans[spanID]
+	if r.c.bufSpan != spanID {
+		buf, err := r.m.hydratedSpan(s)
+		if err != nil {
+			return 0, err
+		}
+		r.c.buf, r.c.bufSpan = buf, spanID
+	}
+	n := copy(p, r.c.buf[r.off-s.startUncompOffset:])
+	r.off += compression.Offset(n)
+	return n, nil
+}
+
+// hydratedSpan returns the uncompressed contents of s if it's cached, uncompressing
+// them if only the compressed contents are cached. errNotHydrated is returned
+// otherwise; s is never fetched.
+func (m *SpanManager) hydratedSpan(s *span) ([]byte, error) {
+	// fetched spans share their cache entry with the uncompressed contents,
+	// so hold the lock to keep the span from being uncompressed while it's read.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var compressed bool
+	switch {
+	case s.checkState(uncompressed):
+	case s.checkState(fetched):
+		compressed = true
+	default:
+		return nil, errNotHydrated
+	}
+	size := s.endUncompOffset - s.startUncompOffset
+	if compressed {
+		size = s.endCompOffset - s.startCompOffset
+	}
+	r, err := m.cache.Get(fmt.Sprintf("%d", s.id))
+	if err != nil {
+		// the span was evicted from the cache; it's checked once it's fetched again.
+		return nil, errNotHydrated
+	}
+	defer r.Close()
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if compressed {
+		return m.uncompressSpan(s, buf)
+	}
+	return buf, nil
+}
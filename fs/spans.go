@@ -0,0 +1,90 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// SpansPath is the path of the endpoint of the snapshotter's API that reports the states
+// of the spans of the mounted layers, e.g. to find out why background fetches are stuck
+// without enabling debug logs. The "layer" query parameter limits the report to the layer
+// with that digest.
+const SpansPath = "/api/v1/spans"
+
+// LayerSpans is the states of the spans of a mounted layer.
+type LayerSpans struct {
+	Mountpoint string                 `json:"mountpoint"`
+	Layer      digest.Digest          `json:"layer"`
+	Spans      spanmanager.SpanStates `json:"spans"`
+}
+
+// spanStates returns the states of the spans of the mounted layers, or only of the layer
+// dgst if it's not empty, sorted by mountpoint.
+func (fs *filesystem) spanStates(dgst digest.Digest) []LayerSpans {
+	// the states are counted without holding layerMu, since layers can have many spans.
+	fs.layerMu.Lock()
+	layers := make(map[string]layer.Layer, len(fs.layer))
+	for mountpoint, l := range fs.layer {
+		layers[mountpoint] = l
+	}
+	fs.layerMu.Unlock()
+
+	spans := make([]LayerSpans, 0, len(layers))
+	for mountpoint, l := range layers {
+		info := l.Info()
+		if dgst != "" && info.Digest != dgst {
+			continue
+		}
+		spans = append(spans, LayerSpans{
+			Mountpoint: mountpoint,
+			Layer:      info.Digest,
+			Spans:      l.SpanStates(),
+		})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Mountpoint < spans[j].Mountpoint })
+	return spans
+}
+
+func (fs *filesystem) spansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var dgst digest.Digest
+		if v := r.URL.Query().Get("layer"); v != "" {
+			var err error
+			if dgst, err = digest.Parse(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid layer digest: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(fs.spanStates(dgst)); err != nil {
+			log.G(fs.ctx).WithError(err).Warn("failed to write spans response")
+		}
+	})
+}
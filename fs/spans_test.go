@@ -0,0 +1,91 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+type spansLayer struct {
+	breakableLayer
+	digest digest.Digest
+	states spanmanager.SpanStates
+}
+
+func (l *spansLayer) Info() layer.Info                   { return layer.Info{Digest: l.digest} }
+func (l *spansLayer) SpanStates() spanmanager.SpanStates { return l.states }
+
+func TestSpansHandler(t *testing.T) {
+	a := &spansLayer{
+		digest: digest.FromString("a"),
+		states: spanmanager.SpanStates{Total: 4, Unrequested: 1, InFlight: 1, Fetched: 2, Failed: 1, FailedSpans: []compression.SpanID{3}},
+	}
+	b := &spansLayer{
+		digest: digest.FromString("b"),
+		states: spanmanager.SpanStates{Total: 2, Uncompressed: 2},
+	}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"/snapshots/2/fs": b,
+			"/snapshots/1/fs": a,
+		},
+	}
+	h := fs.spansHandler()
+
+	get := func(target string) []LayerSpans {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s", rec.Code, target)
+		}
+		var spans []LayerSpans
+		if err := json.NewDecoder(rec.Body).Decode(&spans); err != nil {
+			t.Fatal(err)
+		}
+		return spans
+	}
+	expected := []LayerSpans{
+		{Mountpoint: "/snapshots/1/fs", Layer: a.digest, Spans: a.states},
+		{Mountpoint: "/snapshots/2/fs", Layer: b.digest, Spans: b.states},
+	}
+	if spans := get(SpansPath); !reflect.DeepEqual(spans, expected) {
+		t.Fatalf("unexpected spans; expected %+v, got %+v", expected, spans)
+	}
+	if spans := get(SpansPath + "?layer=" + b.digest.String()); !reflect.DeepEqual(spans, expected[1:]) {
+		t.Fatalf("unexpected spans of layer b; expected %+v, got %+v", expected[1:], spans)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, SpansPath+"?layer=invalid", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for an invalid layer digest", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, SpansPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for POST", rec.Code)
+	}
+}
@@ -89,6 +89,12 @@ func (lu *layerUnpacker) Unpack(ctx context.Context, desc ocispec.Descriptor, mo
 			return fmt.Errorf("cannot fetch layer: %w", err)
 		}
 	}
+	return applyLayer(ctx, lu.archive, mountpoint, rc, mounts)
+}
+
+// applyLayer applies the layer read from r, compressed or not, to the directory mountpoint.
+// The parents of the layer are the lower directories of mounts.
+func applyLayer(ctx context.Context, a Archive, mountpoint string, r io.Reader, mounts []mount.Mount) error {
 	parents, err := getLayerParents(mounts[0].Options)
 	if err != nil {
 		return fmt.Errorf("cannot get layer parents: %w", err)
@@ -99,7 +105,7 @@ func (lu *layerUnpacker) Unpack(ctx context.Context, desc ocispec.Descriptor, mo
 	if len(parents) > 0 {
 		opts = append(opts, archive.WithParents(parents))
 	}
-	_, err = lu.archive.Apply(ctx, mountpoint, rc, opts...)
+	_, err = a.Apply(ctx, mountpoint, r, opts...)
 	if err != nil {
 		return fmt.Errorf("cannot apply layer: %w", err)
 	}
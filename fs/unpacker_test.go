@@ -21,10 +21,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -143,6 +146,62 @@ func TestUnpackHappyPath(t *testing.T) {
 	}
 }
 
+// cachedFakeLayer is a mounted layer whose spans may all be cached.
+type cachedFakeLayer struct {
+	breakableLayer
+	digest digest.Digest
+	cached bool
+	// refs is the number of references acquired and not released yet.
+	refs int
+}
+
+func (l *cachedFakeLayer) Info() layer.Info { return layer.Info{Digest: l.digest} }
+func (l *cachedFakeLayer) Cached() bool     { return l.cached }
+func (l *cachedFakeLayer) Acquire() (layer.Layer, bool) {
+	l.refs++
+	return l, true
+}
+func (l *cachedFakeLayer) Done() { l.refs-- }
+func (l *cachedFakeLayer) Uncompressed(context.Context) (io.Reader, error) {
+	return strings.NewReader("layer"), nil
+}
+
+func TestUnpackCachedLayer(t *testing.T) {
+	dgst := digest.FromString("layer")
+	partial := &cachedFakeLayer{digest: dgst}
+	cached := &cachedFakeLayer{digest: dgst, cached: true}
+	other := &cachedFakeLayer{digest: digest.FromString("other"), cached: true}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"/snapshots/1/fs": partial,
+			"/snapshots/2/fs": other,
+		},
+	}
+	if _, ok := fs.cachedLayer(dgst); ok {
+		t.Fatalf("layer isn't fully cached on any mountpoint, but it was found")
+	}
+
+	fs.layer["/snapshots/3/fs"] = cached
+	l, ok := fs.cachedLayer(dgst)
+	if !ok || l != cached {
+		t.Fatalf("expected the fully cached layer, got %v", l)
+	}
+	archive := newFakeArchive(5, false)
+	if cached.refs != 1 {
+		t.Fatalf("expected a reference to the cached layer, got %d", cached.refs)
+	}
+	if err := unpackCachedLayer(context.Background(), l, archive, "/some/path/filename", getFakeMounts()); err != nil {
+		t.Fatalf("failed to unpack cached layer: %v", err)
+	}
+	l.Done()
+	if archive.applyCount != 1 {
+		t.Fatalf("Apply() must be called only once, but was called %d times", archive.applyCount)
+	}
+	if cached.refs != 0 {
+		t.Fatalf("expected the reference to the cached layer to be released, got %d", cached.refs)
+	}
+}
+
 type fakeArtifactFetcher struct {
 	storeFails bool
 	fetchFails bool
@@ -0,0 +1,240 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	iofs "io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/containerd/containerd/log"
+)
+
+// UsagePath is the path of the endpoint of the snapshotter's API that reports
+// the disk space used by the snapshotter, e.g. for node agents to account for it.
+const UsagePath = "/api/v1/usage"
+
+// defaultDiskBudgetCheckInterval is how often the disk usage is checked against the budget.
+const defaultDiskBudgetCheckInterval = 60 * time.Second
+
+const (
+	usageTypeCache     = "cache"
+	usageTypeMetadata  = "metadata"
+	usageTypeSnapshots = "snapshots"
+)
+
+// Usage is the disk space allocated by the snapshotter.
+type Usage struct {
+	// CacheBytes is the space used by the caches of layers.
+	CacheBytes int64 `json:"cacheBytes"`
+	// MetadataBytes is the space used by the metadata DBs.
+	MetadataBytes int64 `json:"metadataBytes"`
+	// SnapshotsBytes is the space used by the snapshots, i.e. the upperdirs of containers
+	// and the layers which aren't lazily loaded. Lazily loaded layers aren't included.
+	SnapshotsBytes int64 `json:"snapshotsBytes"`
+	TotalBytes     int64 `json:"totalBytes"`
+	// BudgetBytes is the disk budget of CacheBytes (see config.DiskBudgetConfig). 0 if there's no budget.
+	BudgetBytes int64 `json:"budgetBytes"`
+	// EvictedLayers is the number of layers whose caches were evicted to stay within the budget.
+	EvictedLayers int64 `json:"evictedLayers"`
+}
+
+// usageTracker measures the disk space used by the snapshotter and evicts caches
+// of layers when it exceeds the budget.
+type usageTracker struct {
+	cacheDirs     []string
+	metadataFiles []string
+	snapshotsDir  string
+	budget        int64
+	// leastRecentlyUsed returns the least recently used layer which isn't mounted and
+	// the directories of its caches. It returns false if there's no such layer.
+	leastRecentlyUsed func() (string, []string, bool)
+	// evict evicts the caches of a layer returned by leastRecentlyUsed.
+	// It returns false if the layer is mounted again in the meantime.
+	evict func(string) bool
+
+	enforceMu sync.Mutex // serializes enforcing the budget
+
+	mu      sync.Mutex
+	evicted int64
+}
+
+// usage measures the disk space used by the snapshotter.
+func (t *usageTracker) usage() (Usage, error) {
+	var u Usage
+	for _, dir := range t.cacheDirs {
+		b, err := diskUsage(dir)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.CacheBytes += b
+	}
+	for _, f := range t.metadataFiles {
+		b, err := diskUsage(f)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.MetadataBytes += b
+	}
+	if t.snapshotsDir != "" {
+		b, err := diskUsage(t.snapshotsDir)
+		if err != nil {
+			return Usage{}, err
+		}
+		u.SnapshotsBytes = b
+	}
+	u.TotalBytes = u.CacheBytes + u.MetadataBytes + u.SnapshotsBytes
+	u.BudgetBytes = t.budget
+	t.mu.Lock()
+	u.EvictedLayers = t.evicted
+	t.mu.Unlock()
+	return u, nil
+}
+
+// enforceBudget evicts the caches of the least recently used layers which aren't
+// mounted until the caches are within the budget or there's nothing left to evict.
+// Only the caches count against the budget, since nothing else can be evicted.
+func (t *usageTracker) enforceBudget(ctx context.Context) (Usage, error) {
+	t.enforceMu.Lock()
+	defer t.enforceMu.Unlock()
+	u, err := t.usage()
+	if err != nil {
+		return Usage{}, err
+	}
+	for t.budget > 0 && u.CacheBytes > t.budget {
+		name, dirs, ok := t.leastRecentlyUsed()
+		if !ok {
+			log.G(ctx).WithField("usage", u.CacheBytes).WithField("budget", t.budget).
+				Warn("layer caches exceed the disk budget but all layers are in use")
+			break
+		}
+		var freed int64
+		for _, dir := range dirs {
+			b, err := diskUsage(dir)
+			if err != nil {
+				return Usage{}, err
+			}
+			freed += b
+		}
+		if !t.evict(name) {
+			continue
+		}
+		u.CacheBytes -= freed
+		u.TotalBytes -= freed
+		t.mu.Lock()
+		t.evicted++
+		u.EvictedLayers = t.evicted
+		t.mu.Unlock()
+		commonmetrics.IncDiskBudgetEvictions()
+	}
+	return u, nil
+}
+
+// run periodically reports the disk usage and enforces the budget until ctx is done.
+func (t *usageTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		u, err := t.enforceBudget(ctx)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to measure disk usage")
+		} else {
+			commonmetrics.SetDiskUsage(usageTypeCache, u.CacheBytes)
+			commonmetrics.SetDiskUsage(usageTypeMetadata, u.MetadataBytes)
+			commonmetrics.SetDiskUsage(usageTypeSnapshots, u.SnapshotsBytes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// diskUsage returns the disk space allocated to the files under path. Like `du -x`,
+// it doesn't descend into other filesystems, e.g. the FUSE mounts of lazily loaded layers.
+// Hard links are counted once.
+func diskUsage(path string) (int64, error) {
+	root, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	rootSt, ok := root.Sys().(*syscall.Stat_t)
+	if !ok {
+		return root.Size(), nil
+	}
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]struct{})
+	var total int64
+	err = filepath.WalkDir(path, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			// files are removed concurrently.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if uint64(st.Dev) != uint64(rootSt.Dev) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if st.Nlink > 1 {
+			key := inode{uint64(st.Dev), uint64(st.Ino)}
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+		total += int64(st.Blocks) * 512
+		return nil
+	})
+	return total, err
+}
+
+func (fs *filesystem) usageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		u, err := fs.usage.usage()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(u); err != nil {
+			log.G(fs.ctx).WithError(err).Warn("failed to write usage response")
+		}
+	})
+}
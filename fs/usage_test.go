@@ -0,0 +1,214 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeUsageFile(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	writeUsageFile(t, filepath.Join(dir, "a"), 8192)
+	writeUsageFile(t, filepath.Join(dir, "sub", "b"), 8192)
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "sub", "a")); err != nil {
+		t.Fatal(err)
+	}
+	withLinks, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "sub", "a")); err != nil {
+		t.Fatal(err)
+	}
+	withoutLinks, err := diskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withLinks != withoutLinks {
+		t.Fatalf("hard links are counted more than once: %d != %d", withLinks, withoutLinks)
+	}
+	if withoutLinks < 2*8192 {
+		t.Fatalf("unexpected usage %d", withoutLinks)
+	}
+
+	missing, err := diskUsage(filepath.Join(dir, "missing"))
+	if err != nil || missing != 0 {
+		t.Fatalf("unexpected usage of missing dir: %d, %v", missing, err)
+	}
+}
+
+func TestEnforceDiskBudget(t *testing.T) {
+	const layerSize = 64 * 1024
+	tests := []struct {
+		name            string
+		layers          int
+		mounted         int
+		budgetLayers    int
+		metadataSize    int
+		expectedEvicted int64
+	}{
+		{
+			name:         "no budget",
+			layers:       4,
+			budgetLayers: 0,
+		},
+		{
+			name:         "within budget",
+			layers:       4,
+			budgetLayers: 5,
+		},
+		{
+			name:            "over budget",
+			layers:          4,
+			budgetLayers:    2,
+			expectedEvicted: 2,
+		},
+		{
+			name:         "metadata doesn't count against the budget",
+			layers:       4,
+			budgetLayers: 4,
+			metadataSize: 4 * layerSize,
+		},
+		{
+			name:            "mounted layers aren't evicted",
+			layers:          4,
+			mounted:         3,
+			budgetLayers:    2,
+			expectedEvicted: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			cacheDir := filepath.Join(root, "spancache")
+			var layers []string
+			for i := 0; i < tt.layers; i++ {
+				l := filepath.Join(cacheDir, string(rune('a'+i)))
+				writeUsageFile(t, l, layerSize)
+				layers = append(layers, l)
+			}
+			perLayer, err := diskUsage(layers[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			total, err := diskUsage(cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the space used by the cache directory itself.
+			overhead := total - perLayer*int64(tt.layers)
+			var budget int64
+			if tt.budgetLayers > 0 {
+				budget = overhead + perLayer*int64(tt.budgetLayers)
+			}
+			var metadataSize int64
+			if tt.metadataSize > 0 {
+				metadataFile := filepath.Join(root, "metadata.db")
+				writeUsageFile(t, metadataFile, tt.metadataSize)
+				if metadataSize, err = diskUsage(metadataFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tracker := &usageTracker{
+				cacheDirs:     []string{cacheDir},
+				metadataFiles: []string{filepath.Join(root, "metadata.db")},
+				budget:        budget,
+				leastRecentlyUsed: func() (string, []string, bool) {
+					if len(layers) <= tt.mounted {
+						return "", nil, false
+					}
+					return layers[0], []string{layers[0]}, true
+				},
+				evict: func(name string) bool {
+					if err := os.Remove(name); err != nil {
+						t.Fatal(err)
+					}
+					layers = layers[1:]
+					return true
+				},
+			}
+			u, err := tracker.enforceBudget(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.EvictedLayers != tt.expectedEvicted {
+				t.Fatalf("unexpected number of evicted layers; expected %d, got %d", tt.expectedEvicted, u.EvictedLayers)
+			}
+			expected := overhead + perLayer*int64(tt.layers-int(tt.expectedEvicted))
+			if u.CacheBytes != expected || u.TotalBytes != expected+metadataSize {
+				t.Fatalf("unexpected usage; expected %d, got %+v", expected, u)
+			}
+			if measured, err := tracker.usage(); err != nil {
+				t.Fatal(err)
+			} else if measured.CacheBytes != u.CacheBytes {
+				t.Fatalf("the usage after eviction is %d, but %d was measured", u.CacheBytes, measured.CacheBytes)
+			}
+		})
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	root := t.TempDir()
+	writeUsageFile(t, filepath.Join(root, "cache", "a"), 4096)
+	writeUsageFile(t, filepath.Join(root, "metadata.db"), 4096)
+	writeUsageFile(t, filepath.Join(root, "snapshots", "1", "fs", "a"), 4096)
+	fs := &filesystem{usage: &usageTracker{
+		cacheDirs:     []string{filepath.Join(root, "cache")},
+		metadataFiles: []string{filepath.Join(root, "metadata.db")},
+		snapshotsDir:  filepath.Join(root, "snapshots"),
+		budget:        1 << 30,
+	}}
+	h := fs.usageHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, UsagePath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var u Usage
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.CacheBytes == 0 || u.MetadataBytes == 0 || u.SnapshotsBytes == 0 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if u.TotalBytes != u.CacheBytes+u.MetadataBytes+u.SnapshotsBytes || u.BudgetBytes != 1<<30 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, UsagePath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for POST", rec.Code)
+	}
+}
@@ -47,6 +47,25 @@ const (
 	enableTestEnv         = "ENABLE_INTEGRATION_TEST"
 	containerdLogLevelEnv = "CONTAINERD_LOG_LEVEL"
 	sociLogLevelEnv       = "SOCI_LOG_LEVEL"
+
+	// backendEnv selects the environment tests run in: "docker" (default) runs them in
+	// containers built from the project's Dockerfile, "host" against containerd and
+	// soci-snapshotter installed on the host, and "ssh" against a machine (e.g. a
+	// Firecracker microVM) reachable over ssh at sshTargetEnv.
+	backendEnv = "SOCI_E2E_BACKEND"
+	// sshTargetEnv is the target of ssh (e.g. root@172.16.0.2) of the "ssh" backend.
+	sshTargetEnv = "SOCI_E2E_SSH_TARGET"
+	// sshOptsEnv are additional space-separated options of ssh (e.g. "-i /path/to/key").
+	sshOptsEnv = "SOCI_E2E_SSH_OPTS"
+	// registryAddrEnv is the address of the machine running the tests, which is reachable
+	// from the machine of the "ssh" backend, for tests with a local registry.
+	registryAddrEnv = "SOCI_E2E_REGISTRY_ADDR"
+)
+
+const (
+	backendDocker = "docker"
+	backendHost   = "host"
+	backendSSH    = "ssh"
 )
 
 // this can be overwritten by setting up env variables specified by
@@ -54,6 +73,7 @@ const (
 var (
 	containerdLogLevel = "warn"
 	sociLogLevel       = "debug"
+	backend            = backendDocker
 )
 
 // TestMain is a main function for integration tests.
@@ -78,6 +98,18 @@ func TestMain(m *testing.M) {
 		}
 		sociLogLevel = logLevel
 	}
+	if b := os.Getenv(backendEnv); b != "" {
+		switch b {
+		case backendDocker, backendHost, backendSSH:
+			backend = b
+		default:
+			testutil.TestingL.Fatalf("unsupported %s: %s", backendEnv, b)
+		}
+	}
+	if backend != backendDocker {
+		// The snapshotter is already installed in the environment, so nothing is built.
+		os.Exit(m.Run())
+	}
 
 	if err := shell.Supported(); err != nil {
 		testutil.TestingL.Fatalf("shell pkg is not supported: %v", err)
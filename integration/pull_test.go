@@ -579,6 +579,9 @@ disable = true
 
 // TestMirror tests if mirror & refreshing functionalities of snapshotter work
 func TestMirror(t *testing.T) {
+	if backend != backendDocker {
+		t.Skipf("tests with local registries require the %s backend", backendDocker)
+	}
 	var (
 		reporter    = testutil.NewTestingReporter(t)
 		caCertDir   = "/usr/local/share/ca-certificates"
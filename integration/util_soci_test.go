@@ -40,7 +40,6 @@ import (
 	"github.com/awslabs/soci-snapshotter/soci"
 	shell "github.com/awslabs/soci-snapshotter/util/dockershell"
 	"github.com/containerd/containerd/platforms"
-	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -127,12 +126,24 @@ func validateSociIndex(sh *shell.Shell, sociIndex soci.Index, imgManifestDigest
 		return fmt.Errorf("unexpected index artifact type; expected = %v, got = %v", soci.SociIndexArtifactType, sociIndex.ArtifactType)
 	}
 
-	expectedAnnotations := map[string]string{
-		soci.IndexAnnotationBuildToolIdentifier: "AWS SOCI CLI v0.1",
+	if tool := sociIndex.Annotations[soci.IndexAnnotationBuildToolIdentifier]; tool != "AWS SOCI CLI v0.1" {
+		return fmt.Errorf("unexpected build tool identifier; expected = %v, got = %v", "AWS SOCI CLI v0.1", tool)
 	}
 
-	if diff := cmp.Diff(sociIndex.Annotations, expectedAnnotations); diff != "" {
-		return fmt.Errorf("unexpected index annotations; diff = %v", diff)
+	provenance, err := soci.ProvenanceFromIndex(&sociIndex)
+	if err != nil {
+		return err
+	}
+	if provenance.ImageManifest.String() != imgManifestDigest {
+		return fmt.Errorf("unexpected provenance image manifest; expected = %v, got = %v", imgManifestDigest, provenance.ImageManifest)
+	}
+	for _, l := range provenance.Layers {
+		if includedLayers == nil {
+			break
+		}
+		if _, ok := includedLayers[l.Digest.String()]; ok == (l.Ztoc == "") {
+			return fmt.Errorf("unexpected provenance of layer %v; ztoc = %v, skipped = %v", l.Digest, l.Ztoc, l.Skipped)
+		}
 	}
 
 	if imgManifestDigest != sociIndex.Subject.Digest.String() {
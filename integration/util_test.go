@@ -36,6 +36,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/csv"
@@ -120,6 +121,7 @@ level = "{{.LogLevel}}"
 `
 const snapshotterConfigTemplate = `
 disable_verification = {{.DisableVerification}}
+api_address = "/run/soci-snapshotter-grpc/soci-api.sock"
 
 {{.AdditionalConfig}}
 `
@@ -428,15 +430,21 @@ func withRegistryImageRef(ref string) registryOpt {
 	}
 }
 
+const (
+	caCertDir = "/usr/local/share/ca-certificates"
+	// hostsPath is where the backends without Docker map the hosts of local registries.
+	hostsPath = "/etc/hosts"
+)
+
 func newShellWithRegistry(t *testing.T, r registryConfig, opts ...registryOpt) (sh *shell.Shell, done func() error) {
 	rOpts := defaultRegistryOptions()
 	for _, o := range opts {
 		o(&rOpts)
 	}
-	var (
-		caCertDir   = "/usr/local/share/ca-certificates"
-		serviceName = "testing"
-	)
+	if backend != backendDocker {
+		return newShellWithInProcessRegistry(t, r, rOpts)
+	}
+	serviceName := "testing"
 
 	// Setup dummy creds for test
 	crt, key, err := generateRegistrySelfSignedCert(r.host)
@@ -526,7 +534,111 @@ networks:
 	}
 }
 
+// newShellWithInProcessRegistry is newShellWithRegistry for the backends without Docker.
+// The registry runs in the test process and r.host is mapped to it in hostsPath of the
+// environment: to the loopback address on the host, and to the address in registryAddrEnv
+// on machines reached over ssh.
+func newShellWithInProcessRegistry(t *testing.T, r registryConfig, rOpts registryOptions) (*shell.Shell, func() error) {
+	addr, listenAddr := "127.0.0.1", "127.0.0.1:443"
+	if backend == backendSSH {
+		addr, listenAddr = os.Getenv(registryAddrEnv), "0.0.0.0:443"
+		if addr == "" {
+			t.Skipf("%s must be set for tests with a local registry on the %s backend", registryAddrEnv, backendSSH)
+		}
+	}
+	crt, key, err := generateRegistrySelfSignedCert(r.host)
+	if err != nil {
+		t.Fatalf("failed to generate cert: %v", err)
+	}
+	cert, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatalf("failed to load cert: %v", err)
+	}
+	regOpts := []testutil.RegistryOption{
+		testutil.WithBasicAuth(r.user, r.pass),
+		testutil.WithTLSCertificate(cert),
+		testutil.WithListenAddress(listenAddr),
+	}
+	if rOpts.registryImageRef == oci10RegistryImage {
+		regOpts = append(regOpts, testutil.WithoutReferrersAPI())
+	}
+	reg := testutil.NewRegistry(regOpts...)
+
+	sh, done := newSnapshotterBaseShell(t)
+	certPath := filepath.Join(caCertDir, r.host+".crt")
+	if err := testutil.WriteFileContents(sh, certPath, crt, 0600); err != nil {
+		t.Fatalf("failed to write cert at %v: %v", caCertDir, err)
+	}
+	sh.
+		X("sh", "-c", fmt.Sprintf("echo '%s %s' >> %s", addr, r.host, hostsPath)).
+		X("update-ca-certificates").
+		Retry(100, "nerdctl", "login", "-u", r.user, "-p", r.pass, r.host)
+	return sh, func() error {
+		reg.Close()
+		// the cert is removed when the state of the environment is restored.
+		if err := done(); err != nil {
+			return err
+		}
+		return sh.Command("update-ca-certificates").Run()
+	}
+}
+
 func newSnapshotterBaseShell(t *testing.T) (*shell.Shell, func() error) {
+	de, done := newSnapshotterBaseExec(t)
+	sh := shell.New(de, testutil.NewTestingReporter(t))
+	if !isTestingBuiltinSnapshotter() {
+		if err := testutil.WriteFileContents(sh, defaultContainerdConfigPath, []byte(getContainerdConfigToml(t, false)), 0600); err != nil {
+			t.Fatalf("failed to write containerd config %v: %v", defaultContainerdConfigPath, err)
+		}
+	}
+	return sh, done
+}
+
+// newSnapshotterBaseExec returns the environment of the backend tests run in, which has
+// containerd and soci-snapshotter installed, and a function which cleans it up.
+// savedStatePaths are the files of the backends without Docker which tests change and
+// which are restored after each test, since the environment isn't disposable.
+var savedStatePaths = []string{
+	defaultContainerdConfigPath,
+	defaultSnapshotterConfigPath,
+	hostsPath,
+	caCertDir,
+}
+
+// savedStateUnits are the systemd units of the backends without Docker which are stopped
+// during each test, since the tests run their own containerd and soci-snapshotter.
+var savedStateUnits = []string{"containerd", "soci-snapshotter"}
+
+func newSnapshotterBaseExec(t *testing.T) (*dexec.Exec, func() error) {
+	var de *dexec.Exec
+	switch backend {
+	case backendHost:
+		de = dexec.NewHost()
+	case backendSSH:
+		target := os.Getenv(sshTargetEnv)
+		if target == "" {
+			t.Fatalf("%s must be set for the %s backend", sshTargetEnv, backendSSH)
+		}
+		var err error
+		de, err = dexec.NewSSH(target, strings.Fields(os.Getenv(sshOptsEnv))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if de != nil {
+		// The environment isn't disposable, so its configs and daemons are restored after the test.
+		restore, err := de.SaveState(savedStatePaths, savedStateUnits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return de, func() error {
+			// stop the daemons started by the test before starting the ones of the environment.
+			sh := shell.New(de, testutil.NewTestingReporter(t))
+			testutil.KillMatchingProcess(sh, "containerd")
+			testutil.KillMatchingProcess(sh, "soci-snapshotter-grpc")
+			return restore()
+		}
+	}
 	serviceName := "testing"
 	buildArgs, err := getBuildArgsFromEnv()
 	if err != nil {
@@ -540,13 +652,7 @@ func newSnapshotterBaseShell(t *testing.T) (*shell.Shell, func() error) {
 	if !ok {
 		t.Fatalf("failed to get shell of service %v", serviceName)
 	}
-	sh := shell.New(de, testutil.NewTestingReporter(t))
-	if !isTestingBuiltinSnapshotter() {
-		if err := testutil.WriteFileContents(sh, defaultContainerdConfigPath, []byte(getContainerdConfigToml(t, false)), 0600); err != nil {
-			t.Fatalf("failed to write containerd config %v: %v", defaultContainerdConfigPath, err)
-		}
-	}
-	return sh, c.Cleanup
+	return de, c.Cleanup
 }
 
 func generateRegistrySelfSignedCert(registryHost string) (crt, key []byte, _ error) {
@@ -0,0 +1,166 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+)
+
+// CompactPath is the path of the endpoint of the snapshotter's API which compacts the metadata DB.
+const CompactPath = "/api/v1/db/compact"
+
+// boltDB is the part of *bolt.DB used by readers.
+type boltDB interface {
+	View(fn func(*bolt.Tx) error) error
+	Batch(fn func(*bolt.Tx) error) error
+}
+
+// DB is a metadata DB shared by the readers of all layers, which can be
+// compacted while the readers use it.
+type DB struct {
+	opts *bolt.Options
+
+	// mu is held for writing while the DB is compacted, so that readers
+	// wait for the compacted DB to be reopened.
+	mu sync.RWMutex
+	db *bolt.DB
+	// mem is the memory file of the DB if it's kept in memory.
+	mem *os.File
+	// pages and pageBytes are the page allocations of the DB before it was last
+	// reopened, since bolt's stats start over when it's reopened.
+	pages     int64
+	pageBytes int64
+}
+
+// OpenDB opens the metadata DB at path.
+func OpenDB(path string, opts *bolt.Options) (*DB, error) {
+	db, err := bolt.Open(path, 0600, opts)
+	if err != nil {
+		return nil, err
+	}
+	commonmetrics.AddOpenDBCount(commonmetrics.MetadataDB, 1)
+	return &DB{opts: opts, db: db}, nil
+}
+
+// OpenMemoryDB opens a metadata DB which is kept in memory instead of on disk, e.g.
+// so that the metadata of layers isn't stored unencrypted. It can't be compacted.
+func OpenMemoryDB(opts *bolt.Options) (*DB, error) {
+	fd, err := unix.MemfdCreate("soci-metadata-db", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create memory file: %w", err)
+	}
+	mem := os.NewFile(uintptr(fd), "soci-metadata-db")
+	db, err := bolt.Open(fmt.Sprintf("/proc/self/fd/%d", fd), 0600, opts)
+	if err != nil {
+		mem.Close()
+		return nil, err
+	}
+	commonmetrics.AddOpenDBCount(commonmetrics.MetadataDB, 1)
+	return &DB{opts: opts, db: db, mem: mem}, nil
+}
+
+// NewReader parses ztoc and stores filesystem metadata to the DB.
+func (d *DB) NewReader(sr *io.SectionReader, ztoc *ztoc.Ztoc, opts ...Option) (Reader, error) {
+	return newReader(d, sr, ztoc, opts...)
+}
+
+func (d *DB) View(fn func(*bolt.Tx) error) error {
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.MetadataDB, commonmetrics.DBTxView, time.Now())
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.db.View(fn)
+}
+
+func (d *DB) Batch(fn func(*bolt.Tx) error) error {
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.MetadataDB, commonmetrics.DBTxBatch, time.Now())
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.db.Batch(fn)
+}
+
+// PageAllocations returns the number of pages the DB allocated since it was opened,
+// and their size in bytes.
+func (d *DB) PageAllocations() (pages, bytes int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	txStats := d.db.Stats().TxStats
+	return d.pages + txStats.GetPageCount(), d.pageBytes + txStats.GetPageAlloc()
+}
+
+// Path returns the path of the DB file.
+func (d *DB) Path() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.db.Path()
+}
+
+// FreeRatio returns the fraction of the DB file which compacting it would give back.
+func (d *DB) FreeRatio() (float64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return dbutil.FreeRatio(d.db)
+}
+
+// Compact compacts the DB file. Readers block until the compaction is done.
+func (d *DB) Compact() (dbutil.CompactStats, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mem != nil {
+		return dbutil.CompactStats{}, errors.New("DB in memory can't be compacted")
+	}
+	path := d.db.Path()
+	stats, err := dbutil.Compact(d.db)
+	txStats := d.db.Stats().TxStats
+	d.pages += txStats.GetPageCount()
+	d.pageBytes += txStats.GetPageAlloc()
+	// The DB is reopened even if the compaction failed, so that readers
+	// keep working on whichever file is at path.
+	if cerr := d.db.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("failed to close DB: %w", cerr)
+	}
+	db, oerr := bolt.Open(path, 0600, d.opts)
+	if oerr != nil {
+		return stats, fmt.Errorf("failed to reopen DB after compaction: %w", oerr)
+	}
+	d.db = db
+	return stats, err
+}
+
+// Close closes the DB.
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.db.Close()
+	commonmetrics.AddOpenDBCount(commonmetrics.MetadataDB, -1)
+	if d.mem != nil {
+		if merr := d.mem.Close(); merr != nil && err == nil {
+			err = merr
+		}
+	}
+	return err
+}
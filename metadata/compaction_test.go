@@ -0,0 +1,59 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPageAllocations(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "metadata.db"), nil)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+	put := func() {
+		err := db.Batch(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("layer"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("key"), bytes.Repeat([]byte("a"), 1<<16))
+		})
+		if err != nil {
+			t.Fatalf("failed to write DB: %v", err)
+		}
+	}
+
+	put()
+	pages, pageBytes := db.PageAllocations()
+	if pages == 0 || pageBytes == 0 {
+		t.Fatalf("expected the write to allocate pages, got %d pages of %d bytes", pages, pageBytes)
+	}
+	if _, err := db.Compact(); err != nil {
+		t.Fatalf("failed to compact DB: %v", err)
+	}
+	// the allocations before the DB was reopened are kept.
+	put()
+	if p, b := db.PageAllocations(); p <= pages || b <= pageBytes {
+		t.Fatalf("expected more than %d pages of %d bytes, got %d pages of %d bytes", pages, pageBytes, p, b)
+	}
+}
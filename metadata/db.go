@@ -36,6 +36,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
@@ -310,37 +311,34 @@ func readChild(md *bolt.Bucket, base string) (uint32, error) {
 
 func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 	if len(m.children) > 0 {
-		var firstChildName string
-		var firstChild childEntry
-		for name, child := range m.children {
-			firstChildName, firstChild = name, child
-			break
+		// The children are written in order of their names, so that the extra
+		// children are appended to their bucket.
+		names := make([]string, 0, len(m.children))
+		for name := range m.children {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		firstChildName, firstChild := names[0], m.children[names[0]]
 		if err := md.Put(bucketKeyChildID, encodeID(firstChild.id)); err != nil {
 			return fmt.Errorf("failed to put id of first child %q: %w", firstChildName, err)
 		}
 		if err := md.Put(bucketKeyChildName, []byte(firstChildName)); err != nil {
 			return fmt.Errorf("failed to put name first child %q: %w", firstChildName, err)
 		}
-		if len(m.children) > 1 {
-			var cbkt *bolt.Bucket
-			for k, c := range m.children {
-				if k == firstChildName {
-					continue
-				}
-				if cbkt == nil {
-					if cbkt := md.Bucket(bucketKeyChildrenExtra); cbkt != nil {
-						// Reset
-						if err := md.DeleteBucket(bucketKeyChildrenExtra); err != nil {
-							return err
-						}
-					}
-					var err error
-					cbkt, err = md.CreateBucket(bucketKeyChildrenExtra)
-					if err != nil {
-						return err
-					}
+		if len(names) > 1 {
+			if cbkt := md.Bucket(bucketKeyChildrenExtra); cbkt != nil {
+				// Reset
+				if err := md.DeleteBucket(bucketKeyChildrenExtra); err != nil {
+					return err
 				}
+			}
+			cbkt, err := md.CreateBucket(bucketKeyChildrenExtra)
+			if err != nil {
+				return err
+			}
+			cbkt.FillPercent = 1.0 // we only do sequential write to this bucket
+			for _, name := range names[1:] {
+				c := m.children[name]
 				if err := cbkt.Put([]byte(c.base), encodeID(c.id)); err != nil {
 					return fmt.Errorf("failed to add child ID %q: %w", c.id, err)
 				}
@@ -0,0 +1,511 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"golang.org/x/sys/unix"
+)
+
+// The flat index of a layer serializes the tree of its filesystem into a single
+// read-only buffer, which is mmapped from a file when the index is stored on disk.
+// All integers are little endian.
+//
+//	header   : magic, the number of nodes, children and xattrs, and the size of the strings.
+//	nodes    : a record of flatNodeSize bytes for every node. The node with ID i is the
+//	           i-th record, starting from the root node with ID 1.
+//	children : a record of flatChildSize bytes for every entry of a directory. The
+//	           entries of a directory are contiguous and sorted by name.
+//	xattrs   : a record of flatXattrSize bytes for every extended attribute. The
+//	           xattrs of a node are contiguous and sorted by key.
+//	strings  : the names, link names and xattrs, referenced by offset and length.
+const (
+	flatMagic      = "SOCIMDX1"
+	flatHeaderSize = 24
+	flatNodeSize   = 80
+	flatChildSize  = 12
+	flatXattrSize  = 16
+
+	flatRootID = 1
+)
+
+// Offsets of the fields of a node record.
+const (
+	flatNodeSize64        = 0
+	flatNodeModSec        = 8
+	flatNodeUncompOffset  = 16
+	flatNodeModNsec       = 24
+	flatNodeMode          = 28
+	flatNodeUID           = 32
+	flatNodeGID           = 36
+	flatNodeDevMajor      = 40
+	flatNodeDevMinor      = 44
+	flatNodeNumLink       = 48
+	flatNodeLinkNameOff   = 52
+	flatNodeLinkNameLen   = 56
+	flatNodeChildrenStart = 60
+	flatNodeChildrenCount = 64
+	flatNodeXattrsStart   = 68
+	flatNodeXattrsCount   = 72
+)
+
+var errFlatIndexClosed = errors.New("flat index is closed")
+
+// FlatStore builds the metadata of layers into flat indexes, instead of storing them
+// in a DB. A flat index is built once when a layer is mounted and is read-only, so
+// lookups don't need transactions and the index is much smaller than the buckets of
+// the layer in a DB.
+type FlatStore struct {
+	dir string
+}
+
+// NewFlatStore returns a store which mmaps the flat indexes of layers from files in
+// dir. The files are unlinked as soon as they are mapped, so the indexes of layers
+// don't outlive the process. Indexes are kept in memory if dir is empty.
+func NewFlatStore(dir string) (*FlatStore, error) {
+	if dir != "" {
+		// Remove the files left behind by a process which crashed while it was
+		// building an index.
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to clean up flat index directory %q: %w", dir, err)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create flat index directory %q: %w", dir, err)
+		}
+	}
+	return &FlatStore{dir: dir}, nil
+}
+
+// NewReader builds the flat index of the filesystem in ztoc and returns a reader of it.
+func (s *FlatStore) NewReader(sr *io.SectionReader, ztoc *ztoc.Ztoc, opts ...Option) (Reader, error) {
+	var rOpts Options
+	for _, o := range opts {
+		if err := o(&rOpts); err != nil {
+			return nil, fmt.Errorf("failed to apply option: %w", err)
+		}
+	}
+	start := time.Now()
+	data, err := buildFlatIndex(ztoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build flat index: %w", err)
+	}
+	idx := &flatIndex{data: data, refs: 1}
+	if s.dir != "" {
+		if err := idx.mmap(s.dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := idx.parse(); err != nil {
+		idx.release()
+		return nil, err
+	}
+	if rOpts.Telemetry != nil && rOpts.Telemetry.InitMetadataStoreLatency != nil {
+		rOpts.Telemetry.InitMetadataStoreLatency(start)
+	}
+	return &flatReader{idx: idx, sr: sr}, nil
+}
+
+// buildFlatIndex serializes the filesystem in ztoc into a flat index.
+func buildFlatIndex(ztoc *ztoc.Ztoc) ([]byte, error) {
+	curID := uint32(flatRootID)
+	attrs, md, err := buildNodes(ztoc, flatRootID, func() (uint32, error) {
+		if curID == math.MaxUint32 {
+			return 0, fmt.Errorf("sequence id too large")
+		}
+		curID++
+		return curID, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) != int(curID) {
+		return nil, fmt.Errorf("expected %d nodes, got %d", curID, len(attrs))
+	}
+
+	// Size the index first, so that it's written to a single buffer.
+	var numChildren, numXattrs, stringsSize int
+	for _, attr := range attrs {
+		numXattrs += len(attr.Xattrs)
+		stringsSize += len(attr.LinkName)
+		for k, v := range attr.Xattrs {
+			stringsSize += len(k) + len(v)
+		}
+	}
+	for _, m := range md {
+		numChildren += len(m.children)
+		for name := range m.children {
+			stringsSize += len(name)
+		}
+	}
+	childrenOff := flatHeaderSize + len(attrs)*flatNodeSize
+	xattrsOff := childrenOff + numChildren*flatChildSize
+	stringsOff := xattrsOff + numXattrs*flatXattrSize
+	if stringsOff+stringsSize > math.MaxUint32 {
+		return nil, fmt.Errorf("flat index of %d bytes is too large", stringsOff+stringsSize)
+	}
+	data := make([]byte, stringsOff+stringsSize)
+
+	le := binary.LittleEndian
+	copy(data, flatMagic)
+	le.PutUint32(data[8:], uint32(len(attrs)))
+	le.PutUint32(data[12:], uint32(numChildren))
+	le.PutUint32(data[16:], uint32(numXattrs))
+	le.PutUint32(data[20:], uint32(stringsSize))
+
+	var childIdx, xattrIdx, strOff int
+	putString := func(b []byte, s string) {
+		le.PutUint32(b, uint32(strOff))
+		le.PutUint32(b[4:], uint32(len(s)))
+		copy(data[stringsOff+strOff:], s)
+		strOff += len(s)
+	}
+	for id := uint32(flatRootID); id <= curID; id++ {
+		attr := attrs[id]
+		n := data[flatHeaderSize+int(id-flatRootID)*flatNodeSize:][:flatNodeSize]
+		le.PutUint64(n[flatNodeSize64:], uint64(attr.Size))
+		le.PutUint64(n[flatNodeModSec:], uint64(attr.ModTime.Unix()))
+		le.PutUint32(n[flatNodeModNsec:], uint32(attr.ModTime.Nanosecond()))
+		le.PutUint32(n[flatNodeMode:], uint32(attr.Mode))
+		le.PutUint32(n[flatNodeUID:], uint32(attr.UID))
+		le.PutUint32(n[flatNodeGID:], uint32(attr.GID))
+		le.PutUint32(n[flatNodeDevMajor:], uint32(attr.DevMajor))
+		le.PutUint32(n[flatNodeDevMinor:], uint32(attr.DevMinor))
+		le.PutUint32(n[flatNodeNumLink:], uint32(attr.NumLink))
+		putString(n[flatNodeLinkNameOff:], attr.LinkName)
+
+		keys := make([]string, 0, len(attr.Xattrs))
+		for k := range attr.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		le.PutUint32(n[flatNodeXattrsStart:], uint32(xattrIdx))
+		le.PutUint32(n[flatNodeXattrsCount:], uint32(len(keys)))
+		for _, k := range keys {
+			x := data[xattrsOff+xattrIdx*flatXattrSize:]
+			putString(x, k)
+			putString(x[8:], string(attr.Xattrs[k]))
+			xattrIdx++
+		}
+
+		m := md[id]
+		if m == nil {
+			continue
+		}
+		le.PutUint64(n[flatNodeUncompOffset:], uint64(m.UncompressedOffset))
+		names := make([]string, 0, len(m.children))
+		for name := range m.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		le.PutUint32(n[flatNodeChildrenStart:], uint32(childIdx))
+		le.PutUint32(n[flatNodeChildrenCount:], uint32(len(names)))
+		for _, name := range names {
+			c := data[childrenOff+childIdx*flatChildSize:]
+			putString(c, name)
+			le.PutUint32(c[8:], m.children[name].id)
+			childIdx++
+		}
+	}
+	return data, nil
+}
+
+// flatIndex is a flat index shared by a reader and its clones.
+type flatIndex struct {
+	// mu guards data against being unmapped while it's read.
+	mu     sync.RWMutex
+	data   []byte
+	mapped bool
+	refs   int
+
+	nodes                              int
+	childrenOff, xattrsOff, stringsOff int
+}
+
+// mmap writes the index to a file in dir and replaces the index in memory with a
+// read-only mapping of the file.
+func (idx *flatIndex) mmap(dir string) error {
+	f, err := os.CreateTemp(dir, "*.idx")
+	if err != nil {
+		return fmt.Errorf("failed to create flat index file: %w", err)
+	}
+	defer func() {
+		f.Close()
+		// The mapping keeps the file alive until it's unmapped.
+		os.Remove(f.Name())
+	}()
+	if _, err := f.Write(idx.data); err != nil {
+		return fmt.Errorf("failed to write flat index file: %w", err)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, len(idx.data), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to mmap flat index file: %w", err)
+	}
+	idx.data, idx.mapped = data, true
+	return nil
+}
+
+// parse validates the header of the index and computes the offsets of its tables.
+func (idx *flatIndex) parse() error {
+	data := idx.data
+	if len(data) < flatHeaderSize || string(data[:8]) != flatMagic {
+		return fmt.Errorf("invalid flat index header")
+	}
+	le := binary.LittleEndian
+	idx.nodes = int(le.Uint32(data[8:]))
+	idx.childrenOff = flatHeaderSize + idx.nodes*flatNodeSize
+	idx.xattrsOff = idx.childrenOff + int(le.Uint32(data[12:]))*flatChildSize
+	idx.stringsOff = idx.xattrsOff + int(le.Uint32(data[16:]))*flatXattrSize
+	if size := idx.stringsOff + int(le.Uint32(data[20:])); size != len(data) {
+		return fmt.Errorf("invalid flat index size %d; expected %d", len(data), size)
+	}
+	return nil
+}
+
+func (idx *flatIndex) acquire() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.data == nil {
+		return errFlatIndexClosed
+	}
+	idx.refs++
+	return nil
+}
+
+// release drops a reference to the index, and releases its data once it's not
+// referenced anymore.
+func (idx *flatIndex) release() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.refs--; idx.refs > 0 || idx.data == nil {
+		return nil
+	}
+	data := idx.data
+	idx.data = nil
+	if idx.mapped {
+		return unix.Munmap(data)
+	}
+	return nil
+}
+
+// view calls fn with the data of the index, which can't be unmapped until fn returns.
+func (idx *flatIndex) view(fn func(data []byte) error) error {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if idx.data == nil {
+		return errFlatIndexClosed
+	}
+	return fn(idx.data)
+}
+
+func (idx *flatIndex) node(data []byte, id uint32) ([]byte, error) {
+	if id < flatRootID || int(id-flatRootID) >= idx.nodes {
+		return nil, fmt.Errorf("node %d not found", id)
+	}
+	off := flatHeaderSize + int(id-flatRootID)*flatNodeSize
+	return data[off : off+flatNodeSize], nil
+}
+
+// string returns the string referenced by the offset and length in b. The string
+// is copied out of data, so that it stays valid after the index is unmapped.
+func (idx *flatIndex) string(data, b []byte) string {
+	off := idx.stringsOff + int(binary.LittleEndian.Uint32(b))
+	return string(data[off : off+int(binary.LittleEndian.Uint32(b[4:]))])
+}
+
+// children returns the records of the entries of the directory n.
+func (idx *flatIndex) children(data, n []byte) []byte {
+	start := idx.childrenOff + int(binary.LittleEndian.Uint32(n[flatNodeChildrenStart:]))*flatChildSize
+	return data[start : start+int(binary.LittleEndian.Uint32(n[flatNodeChildrenCount:]))*flatChildSize]
+}
+
+func (idx *flatIndex) attr(data, n []byte, attr *Attr) {
+	le := binary.LittleEndian
+	attr.Size = int64(le.Uint64(n[flatNodeSize64:]))
+	attr.ModTime = time.Unix(int64(le.Uint64(n[flatNodeModSec:])), int64(le.Uint32(n[flatNodeModNsec:])))
+	attr.LinkName = idx.string(data, n[flatNodeLinkNameOff:])
+	attr.Mode = os.FileMode(le.Uint32(n[flatNodeMode:]))
+	attr.UID = int(le.Uint32(n[flatNodeUID:]))
+	attr.GID = int(le.Uint32(n[flatNodeGID:]))
+	attr.DevMajor = int(le.Uint32(n[flatNodeDevMajor:]))
+	attr.DevMinor = int(le.Uint32(n[flatNodeDevMinor:]))
+	attr.NumLink = int(le.Uint32(n[flatNodeNumLink:]))
+	if count := int(le.Uint32(n[flatNodeXattrsCount:])); count > 0 {
+		attr.Xattrs = make(map[string][]byte, count)
+		start := idx.xattrsOff + int(le.Uint32(n[flatNodeXattrsStart:]))*flatXattrSize
+		for i := 0; i < count; i++ {
+			x := data[start+i*flatXattrSize:]
+			attr.Xattrs[idx.string(data, x)] = []byte(idx.string(data, x[8:]))
+		}
+	}
+}
+
+// flatReader is a reader of the metadata of a layer in a flat index.
+type flatReader struct {
+	idx *flatIndex
+	sr  *io.SectionReader
+
+	closeOnce sync.Once
+}
+
+// RootID returns ID of the root node.
+func (r *flatReader) RootID() uint32 {
+	return flatRootID
+}
+
+// Clone returns a new reader identical to the current reader
+// but uses the provided section reader for retrieving file paylaods.
+func (r *flatReader) Clone(sr *io.SectionReader) (Reader, error) {
+	if err := r.idx.acquire(); err != nil {
+		return nil, err
+	}
+	return &flatReader{idx: r.idx, sr: sr}, nil
+}
+
+// Close closes this reader. The index is released once all its readers are closed.
+func (r *flatReader) Close() (err error) {
+	r.closeOnce.Do(func() {
+		err = r.idx.release()
+	})
+	return
+}
+
+// GetAttr returns file attribute of specified node.
+func (r *flatReader) GetAttr(id uint32) (attr Attr, _ error) {
+	err := r.idx.view(func(data []byte) error {
+		n, err := r.idx.node(data, id)
+		if err != nil {
+			return err
+		}
+		r.idx.attr(data, n, &attr)
+		return nil
+	})
+	return attr, err
+}
+
+// GetChild returns a child node that has the specified base name.
+func (r *flatReader) GetChild(pid uint32, base string) (id uint32, attr Attr, _ error) {
+	err := r.idx.view(func(data []byte) error {
+		n, err := r.idx.node(data, pid)
+		if err != nil {
+			return fmt.Errorf("failed to get parent node: %w", err)
+		}
+		children := r.idx.children(data, n)
+		count := len(children) / flatChildSize
+		name := func(i int) []byte {
+			c := children[i*flatChildSize:]
+			off := r.idx.stringsOff + int(binary.LittleEndian.Uint32(c))
+			return data[off : off+int(binary.LittleEndian.Uint32(c[4:]))]
+		}
+		i := sort.Search(count, func(i int) bool { return string(name(i)) >= base })
+		if i == count || string(name(i)) != base {
+			return fmt.Errorf("child %q of %d not found", base, pid)
+		}
+		id = binary.LittleEndian.Uint32(children[i*flatChildSize+8:])
+		child, err := r.idx.node(data, id)
+		if err != nil {
+			return fmt.Errorf("failed to get child node: %w", err)
+		}
+		r.idx.attr(data, child, &attr)
+		return nil
+	})
+	if err != nil {
+		return 0, Attr{}, err
+	}
+	return id, attr, nil
+}
+
+// ForeachChild calls the specified callback function for each child node.
+// When the callback returns false, this stops the iteration.
+func (r *flatReader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
+	type childInfo struct {
+		name string
+		id   uint32
+		mode os.FileMode
+	}
+	var children []childInfo
+	// The callback is called once the index isn't viewed anymore, so that it can
+	// use the reader.
+	if err := r.idx.view(func(data []byte) error {
+		n, err := r.idx.node(data, id)
+		if err != nil {
+			return err
+		}
+		entries := r.idx.children(data, n)
+		children = make([]childInfo, 0, len(entries)/flatChildSize)
+		for i := 0; i < len(entries); i += flatChildSize {
+			cid := binary.LittleEndian.Uint32(entries[i+8:])
+			child, err := r.idx.node(data, cid)
+			if err != nil {
+				return fmt.Errorf("failed to get child node: %w", err)
+			}
+			children = append(children, childInfo{
+				name: r.idx.string(data, entries[i:]),
+				id:   cid,
+				mode: os.FileMode(binary.LittleEndian.Uint32(child[flatNodeMode:])),
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, c := range children {
+		if !f(c.name, c.id, c.mode) {
+			break
+		}
+	}
+	return nil
+}
+
+// OpenFile returns a section reader of the specified node.
+func (r *flatReader) OpenFile(id uint32) (File, error) {
+	var f file
+	if err := r.idx.view(func(data []byte) error {
+		n, err := r.idx.node(data, id)
+		if err != nil {
+			return err
+		}
+		if !os.FileMode(binary.LittleEndian.Uint32(n[flatNodeMode:])).IsRegular() {
+			return fmt.Errorf("%d is not a regular file", id)
+		}
+		f.uncompressedSize = compression.Offset(binary.LittleEndian.Uint64(n[flatNodeSize64:]))
+		f.uncompressedOffset = compression.Offset(binary.LittleEndian.Uint64(n[flatNodeUncompOffset:]))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// NumOfNodes returns the number of nodes in the index.
+func (r *flatReader) NumOfNodes() (i int, _ error) {
+	err := r.idx.view(func([]byte) error {
+		i = r.idx.nodes
+		return nil
+	})
+	return i, err
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+func TestFlatReader(t *testing.T) {
+	for name, dir := range map[string]string{"mmap": t.TempDir(), "memory": ""} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewFlatStore(dir)
+			if err != nil {
+				t.Fatalf("failed to create flat store: %v", err)
+			}
+			testReader(t, func(sr *io.SectionReader, ztoc *ztoc.Ztoc, opts ...Option) (testableReader, error) {
+				r, err := store.NewReader(sr, ztoc, opts...)
+				if err != nil {
+					return nil, err
+				}
+				return r.(*flatReader), nil
+			})
+			if dir == "" {
+				return
+			}
+			// the files of the indexes are unlinked once they are mapped.
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Fatalf("expected no files in %q, got %v (%v)", dir, entries, err)
+			}
+		})
+	}
+}
+
+func TestFlatReaderClone(t *testing.T) {
+	store, err := NewFlatStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create flat store: %v", err)
+	}
+	ztoc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{
+		testutil.File("foo", "foofoo"),
+	}, gzip.DefaultCompression, 64)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	r, err := store.NewReader(sr, ztoc)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	clone, err := r.Clone(sr)
+	if err != nil {
+		t.Fatalf("failed to clone reader: %v", err)
+	}
+
+	// the index is still mapped for the clone once the reader is closed.
+	if err := r.Close(); err != nil {
+		t.Fatalf("failed to close reader: %v", err)
+	}
+	if _, attr, err := clone.GetChild(clone.RootID(), "foo"); err != nil || attr.Size != 6 {
+		t.Fatalf("expected foo of 6 bytes in clone, got %d bytes (%v)", attr.Size, err)
+	}
+	if err := clone.Close(); err != nil {
+		t.Fatalf("failed to close clone: %v", err)
+	}
+	if _, err := clone.GetAttr(clone.RootID()); err != errFlatIndexClosed {
+		t.Fatalf("expected %v once all readers are closed, got %v", errFlatIndexClosed, err)
+	}
+}
+
+func BenchmarkNewFlatReader(b *testing.B) {
+	toc := benchmarkZtoc()
+	store, err := NewFlatStore(b.TempDir())
+	if err != nil {
+		b.Fatalf("failed to create flat store: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(nil), 0, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := store.NewReader(sr, toc)
+		if err != nil {
+			b.Fatalf("failed to create reader: %v", err)
+		}
+		b.StopTimer()
+		r.Close()
+		b.StartTimer()
+	}
+}
@@ -33,7 +33,6 @@
 package metadata
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -54,10 +53,14 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// insertBatchSize is the number of nodes whose metadata is written to the DB in a
+// single transaction when a reader is initialized.
+const insertBatchSize = 4096
+
 // reader stores filesystem metadata parsed from ztoc to metadata DB
 // and provides methods to read them.
 type reader struct {
-	db     *bolt.DB
+	db     boltDB
 	fsID   string
 	rootID uint32
 	sr     *io.SectionReader
@@ -79,6 +82,10 @@ func (r *reader) nextID() (uint32, error) {
 
 // NewReader parses ztoc and stores filesystem metadata to the provided DB.
 func NewReader(db *bolt.DB, sr *io.SectionReader, ztoc *ztoc.Ztoc, opts ...Option) (Reader, error) {
+	return newReader(db, sr, ztoc, opts...)
+}
+
+func newReader(db boltDB, sr *io.SectionReader, ztoc *ztoc.Ztoc, opts ...Option) (Reader, error) {
 	var rOpts Options
 	for _, o := range opts {
 		if err := o(&rOpts); err != nil {
@@ -180,81 +187,36 @@ func (r *reader) initRootNode(fsID string) error {
 }
 
 func (r *reader) initNodes(ztoc *ztoc.Ztoc) error {
-	md := make(map[uint32]*metadataEntry)
-	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
+	// The nodes are built in memory first, so that they can be written in order of
+	// their IDs, in batches, instead of updating the DB for every entry.
+	attrs, md, err := buildNodes(ztoc, r.rootID, r.nextID)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint32, 0, len(attrs))
+	for id := range attrs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if err := r.writeBatches(ids, func(tx *bolt.Tx, batch []uint32) error {
 		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
 			return err
 		}
 		nodes.FillPercent = 1.0 // we only do sequential write to this bucket
-		var attr Attr
-		for _, ent := range ztoc.FileMetadata {
-			var id uint32
+		for _, id := range batch {
 			var b *bolt.Bucket
-			ent.Name = cleanEntryName(ent.Name)
-			isLink := ent.Type == "hardlink"
-			if isLink {
-				id, err = getIDByName(md, ent.Linkname, r.rootID)
-				if err != nil {
-					return fmt.Errorf("%q is a hardlink but cannot get link destination %q: %w", ent.Name, ent.Linkname, err)
-				}
+			if id == r.rootID {
 				b, err = getNodeBucketByID(nodes, id)
-				if err != nil {
-					return fmt.Errorf("cannot get hardlink destination %q ==> %q (%d): %w", ent.Name, ent.Linkname, id, err)
-				}
-				numLink, _ := binary.Varint(b.Get(bucketKeyNumLink))
-				if err := putInt(b, bucketKeyNumLink, numLink+1); err != nil {
-					return fmt.Errorf("cannot put NumLink of %q ==> %q: %w", ent.Name, ent.Linkname, err)
-				}
 			} else {
-				// Write node bucket
-				var found bool
-				if ent.Type == "dir" {
-					// Check if this directory is already created, if so overwrite it.
-					id, err = getIDByName(md, ent.Name, r.rootID)
-					if err == nil {
-						b, err = getNodeBucketByID(nodes, id)
-						if err != nil {
-							return fmt.Errorf("failed to get directory bucket %d: %w", id, err)
-						}
-						found = true
-						attr.NumLink = readNumLink(b)
-					}
-				}
-				if !found {
-					// No existing node. Create a new one.
-					id, err = r.nextID()
-					if err != nil {
-						return err
-					}
-					b, err = nodes.CreateBucket(encodeID(id))
-					if err != nil {
-						return err
-					}
-					attr.NumLink = 1 // at least the parent dir references this directory.
-					if ent.Type == "dir" {
-						attr.NumLink++ // at least "." references this directory.
-					}
-				}
-				if err := writeAttr(b, attrFromZtocEntry(&ent, &attr)); err != nil {
-					return fmt.Errorf("failed to set attr to %d(%q): %w", id, ent.Name, err)
-				}
+				b, err = nodes.CreateBucket(encodeID(id))
 			}
-
-			pdirName := parentDir(ent.Name)
-			pid, pb, err := r.getOrCreateDir(nodes, md, pdirName, r.rootID)
 			if err != nil {
-				return fmt.Errorf("failed to create parent directory %q of %q: %w", pdirName, ent.Name, err)
-			}
-			if err := setChild(md, pb, pid, path.Base(ent.Name), id, ent.Type == "dir"); err != nil {
 				return err
 			}
-
-			if !isLink {
-				if md[id] == nil {
-					md[id] = &metadataEntry{}
-				}
-				md[id].UncompressedOffset = ent.UncompressedOffset
+			if err := writeAttr(b, attrs[id]); err != nil {
+				return fmt.Errorf("failed to set attr to %d: %w", id, err)
 			}
 		}
 		return nil
@@ -262,77 +224,144 @@ func (r *reader) initNodes(ztoc *ztoc.Ztoc) error {
 		return err
 	}
 
-	addendum := make([]struct {
-		id []byte
-		md *metadataEntry
-	}, len(md))
-	i := 0
-	for id, d := range md {
-		addendum[i].id, addendum[i].md = encodeID(id), d
-		i++
+	ids = ids[:0]
+	for id := range md {
+		ids = append(ids, id)
 	}
-	sort.Slice(addendum, func(i, j int) bool {
-		return bytes.Compare(addendum[i].id, addendum[j].id) < 0
-	})
-
-	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return r.writeBatches(ids, func(tx *bolt.Tx, batch []uint32) error {
 		meta, err := getMetadata(tx, r.fsID)
 		if err != nil {
 			return err
 		}
 		meta.FillPercent = 1.0 // we only do sequential write to this bucket
-
-		for _, m := range addendum {
-			md, err := meta.CreateBucket(m.id)
+		for _, id := range batch {
+			b, err := meta.CreateBucket(encodeID(id))
 			if err != nil {
 				return err
 			}
-			if err := writeMetadataEntry(md, m.md); err != nil {
+			if err := writeMetadataEntry(b, md[id]); err != nil {
 				return err
 			}
 		}
 		return nil
-	}); err != nil {
-		return err
-	}
+	})
+}
 
+// writeBatches writes the entries of ids with fn, with a transaction for every
+// insertBatchSize entries. The dirty pages of a transaction are kept in memory until
+// it's committed, and have to be copied every time the DB file grows, so writing
+// the metadata of large layers in a single transaction is much slower.
+func (r *reader) writeBatches(ids []uint32, fn func(tx *bolt.Tx, batch []uint32) error) error {
+	for len(ids) > 0 {
+		n := insertBatchSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		batch := ids[:n]
+		if err := r.db.Batch(func(tx *bolt.Tx) error {
+			return fn(tx, batch)
+		}); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
 	return nil
 }
 
-func (r *reader) getOrCreateDir(nodes *bolt.Bucket, md map[uint32]*metadataEntry, d string, rootID uint32) (id uint32, b *bolt.Bucket, err error) {
-	id, err = getIDByName(md, d, rootID)
-	if err != nil {
-		id, err = r.nextID()
+// buildNodes builds the attributes and the metadata of the nodes of the filesystem
+// in ztoc in memory. The attributes of the root node rootID are initialized, and
+// other nodes get their IDs from nextID.
+func buildNodes(ztoc *ztoc.Ztoc, rootID uint32, nextID func() (uint32, error)) (map[uint32]*Attr, map[uint32]*metadataEntry, error) {
+	md := make(map[uint32]*metadataEntry)
+	attrs := map[uint32]*Attr{
+		rootID: {
+			Mode:    os.ModeDir | 0755,
+			NumLink: 2, // The directory itself(.) and the parent link to this directory.
+		},
+	}
+	for _, ent := range ztoc.FileMetadata {
+		var id uint32
+		var err error
+		ent.Name = cleanEntryName(ent.Name)
+		isLink := ent.Type == "hardlink"
+		if isLink {
+			id, err = getIDByName(md, ent.Linkname, rootID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%q is a hardlink but cannot get link destination %q: %w", ent.Name, ent.Linkname, err)
+			}
+			attr, ok := attrs[id]
+			if !ok {
+				return nil, nil, fmt.Errorf("cannot get hardlink destination %q ==> %q (%d)", ent.Name, ent.Linkname, id)
+			}
+			attr.NumLink++
+		} else {
+			var attr *Attr
+			if ent.Type == "dir" {
+				// Check if this directory is already created, if so overwrite it.
+				if id, err = getIDByName(md, ent.Name, rootID); err == nil {
+					attr = attrs[id]
+				}
+			}
+			if attr == nil {
+				// No existing node. Create a new one.
+				id, err = nextID()
+				if err != nil {
+					return nil, nil, err
+				}
+				attr = &Attr{NumLink: 1} // at least the parent dir references this directory.
+				if ent.Type == "dir" {
+					attr.NumLink++ // at least "." references this directory.
+				}
+				attrs[id] = attr
+			}
+			attrFromZtocEntry(&ent, attr)
+		}
+
+		pdirName := parentDir(ent.Name)
+		pid, pattr, err := getOrCreateDir(attrs, md, pdirName, rootID, nextID)
 		if err != nil {
-			return 0, nil, err
+			return nil, nil, fmt.Errorf("failed to create parent directory %q of %q: %w", pdirName, ent.Name, err)
+		}
+		setChild(md, pattr, pid, path.Base(ent.Name), id, ent.Type == "dir")
+
+		if !isLink {
+			if md[id] == nil {
+				md[id] = &metadataEntry{}
+			}
+			md[id].UncompressedOffset = ent.UncompressedOffset
 		}
-		b, err = nodes.CreateBucket(encodeID(id))
+	}
+	return attrs, md, nil
+}
+
+func getOrCreateDir(attrs map[uint32]*Attr, md map[uint32]*metadataEntry, d string, rootID uint32, nextID func() (uint32, error)) (id uint32, attr *Attr, err error) {
+	id, err = getIDByName(md, d, rootID)
+	if err != nil {
+		id, err = nextID()
 		if err != nil {
 			return 0, nil, err
 		}
-		attr := &Attr{
+		attr = &Attr{
 			Mode:    os.ModeDir | 0755,
 			NumLink: 2, // The directory itself(.) and the parent link to this directory.
 		}
-		if err := writeAttr(b, attr); err != nil {
-			return 0, nil, err
-		}
+		attrs[id] = attr
 		if d != "" {
-			pid, pb, err := r.getOrCreateDir(nodes, md, parentDir(d), rootID)
+			pid, pattr, err := getOrCreateDir(attrs, md, parentDir(d), rootID, nextID)
 			if err != nil {
 				return 0, nil, err
 			}
-			if err := setChild(md, pb, pid, path.Base(d), id, true); err != nil {
-				return 0, nil, err
-			}
+			setChild(md, pattr, pid, path.Base(d), id, true)
 		}
 	} else {
-		b, err = getNodeBucketByID(nodes, id)
-		if err != nil {
-			return 0, nil, fmt.Errorf("failed to get dir bucket %d: %w", id, err)
+		var ok bool
+		attr, ok = attrs[id]
+		if !ok {
+			return 0, nil, fmt.Errorf("failed to get dir node %d", id)
 		}
 	}
-	return id, b, nil
+	return id, attr, nil
 }
 
 func (r *reader) waitInit() error {
@@ -595,7 +624,7 @@ func getIDByName(md map[uint32]*metadataEntry, name string, rootID uint32) (uint
 	return c.id, nil
 }
 
-func setChild(md map[uint32]*metadataEntry, pb *bolt.Bucket, pid uint32, base string, id uint32, isDir bool) error {
+func setChild(md map[uint32]*metadataEntry, pattr *Attr, pid uint32, base string, id uint32, isDir bool) {
 	if md[pid] == nil {
 		md[pid] = &metadataEntry{}
 	}
@@ -604,12 +633,8 @@ func setChild(md map[uint32]*metadataEntry, pb *bolt.Bucket, pid uint32, base st
 	}
 	md[pid].children[base] = childEntry{base, id}
 	if isDir {
-		numLink, _ := binary.Varint(pb.Get(bucketKeyNumLink))
-		if err := putInt(pb, bucketKeyNumLink, numLink+1); err != nil {
-			return fmt.Errorf("cannot add numlink for children: %w", err)
-		}
+		pattr.NumLink++
 	}
-	return nil
 }
 
 func parentDir(p string) string {
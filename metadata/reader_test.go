@@ -33,9 +33,13 @@
 package metadata
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	bolt "go.etcd.io/bbolt"
@@ -77,3 +81,44 @@ func (r *testableReadCloser) Close() error {
 	r.closeFn()
 	return r.testableReader.Close()
 }
+
+// benchmarkZtoc returns the ztoc of a layer with many files, for benchmarks of stores.
+func benchmarkZtoc() *ztoc.Ztoc {
+	const dirs, filesPerDir = 100, 1000
+	var toc ztoc.Ztoc
+	for d := 0; d < dirs; d++ {
+		dir := fmt.Sprintf("dir%d/", d)
+		toc.FileMetadata = append(toc.FileMetadata, ztoc.FileMetadata{Name: dir, Type: "dir", Mode: 0755})
+		for f := 0; f < filesPerDir; f++ {
+			toc.FileMetadata = append(toc.FileMetadata, ztoc.FileMetadata{
+				Name:             fmt.Sprintf("%sfile%d", dir, f),
+				Type:             "reg",
+				Mode:             0644,
+				UncompressedSize: 100,
+				ModTime:          time.Unix(1700000000, 0),
+			})
+		}
+	}
+	return &toc
+}
+
+func BenchmarkNewReader(b *testing.B) {
+	toc := benchmarkZtoc()
+	db, err := bolt.Open(filepath.Join(b.TempDir(), "metadata.db"), 0600, nil)
+	if err != nil {
+		b.Fatalf("failed to open DB: %v", err)
+	}
+	defer db.Close()
+	sr := io.NewSectionReader(bytes.NewReader(nil), 0, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := NewReader(db, sr, toc)
+		if err != nil {
+			b.Fatalf("failed to create reader: %v", err)
+		}
+		b.StopTimer()
+		r.Close()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package scan
+
+import (
+	"context"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// RemoteBlob is a layer blob which is read with range requests to the registry.
+type RemoteBlob struct {
+	ctx  context.Context
+	blob remote.Blob
+}
+
+// NewRemoteBlob returns a reader of the layer desc of the image refspec, using hosts
+// to access the registry. Nothing is cached, so each read fetches from the registry.
+func NewRemoteBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*RemoteBlob, error) {
+	blob, err := remote.NewResolver(config.BlobConfig{}, nil).Resolve(ctx, hosts, refspec, desc, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteBlob{ctx: ctx, blob: blob}, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *RemoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	return b.blob.ReadAt(p, off, remote.WithContext(b.ctx))
+}
+
+// Close closes the blob.
+func (b *RemoteBlob) Close() error {
+	return b.blob.Close()
+}
@@ -0,0 +1,251 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package scan streams the files of an image using the ztocs of its layers, so that
+// images can be scanned (e.g. for vulnerabilities) without pulling them. Only the
+// spans of the layers which contain regular files are read.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultParallelism = 4
+	defaultChunkSize   = 4 << 20
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Layer is a layer of an image along with its ztoc.
+type Layer struct {
+	Desc ocispec.Descriptor
+	Ztoc *ztoc.Ztoc
+	// Blob reads the compressed layer, e.g. from the registry with RemoteBlob.
+	Blob io.ReaderAt
+}
+
+// File is a regular file or a hardlink of a layer.
+type File struct {
+	// Layer is the digest of the layer which contains the file.
+	Layer digest.Digest
+	// Path is the absolute path of the file in the image.
+	Path string
+	// Link is the absolute path of the file a hardlink refers to, whose contents
+	// are read. It's empty for regular files.
+	Link     string
+	Metadata *ztoc.FileMetadata
+}
+
+// FileFunc is called with each regular file and a reader of its contents.
+// The reader is only valid until FileFunc returns.
+type FileFunc func(ctx context.Context, f File, r io.Reader) error
+
+type options struct {
+	parallelism int
+	chunkSize   int64
+	allFiles    bool
+}
+
+// Option is an option of Files.
+type Option func(*options)
+
+// WithParallelism sets the number of files read concurrently. Defaults to 4.
+func WithParallelism(n int) Option {
+	return func(o *options) {
+		o.parallelism = n
+	}
+}
+
+// WithChunkSize sets how many bytes of a file are decompressed at once,
+// which bounds the memory used by each reader. Defaults to 4MiB.
+func WithChunkSize(n int64) Option {
+	return func(o *options) {
+		o.chunkSize = n
+	}
+}
+
+// WithAllFiles also passes the files which are removed or replaced by upper
+// layers, which aren't part of the image's filesystem.
+func WithAllFiles() Option {
+	return func(o *options) {
+		o.allFiles = true
+	}
+}
+
+// Files calls fn with the regular files and hardlinks of the image made of layers
+// (lowest first). Files are visited concurrently, so fn must be safe to call from
+// multiple goroutines. The spans of a layer are fetched once for all of its files,
+// as long as the files sharing them are visited close to each other.
+// It stops at the first error returned by fn or when ctx is done.
+func Files(ctx context.Context, layers []Layer, fn FileFunc, opts ...Option) error {
+	o := options{
+		parallelism: defaultParallelism,
+		chunkSize:   defaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.parallelism <= 0 || o.chunkSize <= 0 {
+		return fmt.Errorf("parallelism and chunk size must be positive")
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(o.parallelism)
+	var upper visibility
+	// Visit the layers from the top so that files hidden by upper layers can be skipped.
+	for i := len(layers) - 1; i >= 0; i-- {
+		l := layers[i]
+		// Files are visited in the order of the layer, so the files sharing a span are
+		// read around the same time and the span only needs to stay cached briefly.
+		blob := newSpanReaderAt(l.Blob, 2*o.parallelism)
+		sr := io.NewSectionReader(blob, 0, int64(l.Ztoc.CompressedArchiveSize))
+		regs := make(map[string]*ztoc.FileMetadata)
+		for j := range l.Ztoc.FileMetadata {
+			md := &l.Ztoc.FileMetadata[j]
+			p := cleanPath(md.Name)
+			if md.Type == "reg" {
+				regs[p] = md
+			}
+			if (md.Type != "reg" && md.Type != "hardlink") || strings.HasPrefix(path.Base(p), whiteoutPrefix) {
+				continue
+			}
+			if !o.allFiles && upper.hidden(p) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return eg.Wait()
+			}
+			f := File{Layer: l.Desc.Digest, Path: p, Metadata: md}
+			content := md
+			if md.Type == "hardlink" {
+				// the target of a hardlink precedes it in the layer.
+				f.Link = cleanPath(md.Linkname)
+				target, ok := regs[f.Link]
+				if !ok {
+					if err := eg.Wait(); err != nil {
+						return err
+					}
+					return fmt.Errorf("%s of layer %s: target %s of hardlink not found", f.Path, f.Layer, f.Link)
+				}
+				content = target
+			}
+			toc := l.Ztoc
+			eg.Go(func() error {
+				r := &fileReader{sr: sr, toc: toc, off: content.UncompressedOffset, end: content.UncompressedOffset + content.UncompressedSize, chunkSize: o.chunkSize}
+				if err := fn(ctx, f, r); err != nil {
+					return fmt.Errorf("%s of layer %s: %w", f.Path, f.Layer, err)
+				}
+				return nil
+			})
+		}
+		upper.add(l.Ztoc)
+	}
+	return eg.Wait()
+}
+
+// visibility tracks the paths of upper layers, which hide the same paths of lower layers.
+type visibility struct {
+	// paths are hidden by upper layers.
+	paths map[string]struct{}
+	// trees are paths whose children are hidden by upper layers, e.g. because they
+	// are removed, opaque or replaced with non-directories.
+	trees map[string]struct{}
+}
+
+func (v *visibility) hidden(p string) bool {
+	if _, ok := v.paths[p]; ok {
+		return true
+	}
+	for d := path.Dir(p); ; d = path.Dir(d) {
+		if _, ok := v.trees[d]; ok {
+			return true
+		}
+		if d == "/" {
+			return false
+		}
+	}
+}
+
+func (v *visibility) add(toc *ztoc.Ztoc) {
+	if v.paths == nil {
+		v.paths = make(map[string]struct{})
+		v.trees = make(map[string]struct{})
+	}
+	for _, md := range toc.FileMetadata {
+		p := cleanPath(md.Name)
+		dir, base := path.Split(p)
+		dir = path.Clean(dir)
+		switch {
+		case base == whiteoutOpaque:
+			v.trees[dir] = struct{}{}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			v.paths[removed] = struct{}{}
+			v.trees[removed] = struct{}{}
+		default:
+			v.paths[p] = struct{}{}
+			if md.Type != "dir" {
+				v.trees[p] = struct{}{}
+			}
+		}
+	}
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fileReader reads a file of a layer, decompressing a chunk of it at a time.
+type fileReader struct {
+	sr        *io.SectionReader
+	toc       *ztoc.Ztoc
+	off, end  compression.Offset
+	chunkSize int64
+	buf       []byte
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.off >= r.end {
+			return 0, io.EOF
+		}
+		length := r.end - r.off
+		if length > compression.Offset(r.chunkSize) {
+			length = compression.Offset(r.chunkSize)
+		}
+		b, err := ztoc.ExtractRange(r.sr, r.toc, r.off, length)
+		if err != nil {
+			return 0, err
+		}
+		r.off += length
+		r.buf = b
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
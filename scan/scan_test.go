@@ -0,0 +1,183 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package scan
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestFiles(t *testing.T) {
+	large := strings.Repeat("0123456789", 10000)
+	lower := buildLayer(t, "lower",
+		testutil.Dir("etc/"),
+		testutil.File("etc/passwd", "root"),
+		testutil.File("etc/removed", "removed"),
+		testutil.Dir("opt/"),
+		testutil.File("opt/hidden", "hidden"),
+		testutil.Dir("var/"),
+		testutil.File("var/replaced", "replaced"),
+		testutil.File("large", large),
+	)
+	upper := buildLayer(t, "upper",
+		testutil.File("etc/passwd", "root:x:0:0"),
+		testutil.Link("etc/hardlink", "etc/passwd"),
+		testutil.File("etc/.wh.removed", ""),
+		testutil.Dir("opt/"),
+		testutil.File("opt/.wh..wh..opq", ""),
+		testutil.File("opt/new", "new"),
+		testutil.Symlink("var", "/tmp"),
+	)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected map[string]string
+	}{
+		{
+			name: "image filesystem",
+			opts: []Option{WithChunkSize(1000)},
+			expected: map[string]string{
+				"/etc/passwd":   "root:x:0:0",
+				"/etc/hardlink": "root:x:0:0",
+				"/opt/new":      "new",
+				"/large":        large,
+			},
+		},
+		{
+			name: "all files",
+			opts: []Option{WithAllFiles(), WithParallelism(1)},
+			expected: map[string]string{
+				"lower:/etc/passwd": "root",
+				"/etc/passwd":       "root:x:0:0",
+				"/etc/hardlink":     "root:x:0:0",
+				"/etc/removed":      "removed",
+				"/opt/hidden":       "hidden",
+				"/opt/new":          "new",
+				"/var/replaced":     "replaced",
+				"/large":            large,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			files := make(map[string]string)
+			err := Files(context.Background(), []Layer{lower, upper}, func(_ context.Context, f File, r io.Reader) error {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				key := f.Path
+				if f.Layer == lower.Desc.Digest && f.Path == "/etc/passwd" {
+					key = "lower:" + key
+				}
+				mu.Lock()
+				files[key] = string(b)
+				mu.Unlock()
+				return nil
+			}, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to read files: %v", err)
+			}
+			if !reflect.DeepEqual(files, tt.expected) {
+				t.Fatalf("unexpected files %v", keys(files))
+			}
+		})
+	}
+}
+
+func TestFilesError(t *testing.T) {
+	l := buildLayer(t, "layer", testutil.File("a", "a"), testutil.File("b", "b"))
+	errScan := errors.New("scan failed")
+	err := Files(context.Background(), []Layer{l}, func(context.Context, File, io.Reader) error {
+		return errScan
+	})
+	if !errors.Is(err, errScan) {
+		t.Fatalf("expected %v, got %v", errScan, err)
+	}
+}
+
+func TestFilesFetchSpansOnce(t *testing.T) {
+	var ents []testutil.TarEntry
+	for i := 0; i < 100; i++ {
+		ents = append(ents, testutil.File(fmt.Sprintf("file%d", i), strings.Repeat(fmt.Sprint(i), 50)))
+	}
+	l := buildLayer(t, "layer", ents...)
+	blob := &countingReaderAt{r: l.Blob, reads: make(map[int64]int)}
+	l.Blob = blob
+	err := Files(context.Background(), []Layer{l}, func(_ context.Context, _ File, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}, WithParallelism(1))
+	if err != nil {
+		t.Fatalf("failed to read files: %v", err)
+	}
+	if len(blob.reads) < 2 {
+		t.Fatalf("expected files in several spans, got %d", len(blob.reads))
+	}
+	for off, n := range blob.reads {
+		if n != 1 {
+			t.Fatalf("span at offset %d was fetched %d times", off, n)
+		}
+	}
+}
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	mu    sync.Mutex
+	reads map[int64]int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads[off]++
+	c.mu.Unlock()
+	return c.r.ReadAt(p, off)
+}
+
+func buildLayer(t *testing.T, name string, ents ...testutil.TarEntry) Layer {
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, 1<<10)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	return Layer{
+		Desc: ocispec.Descriptor{Digest: digest.FromString(name)},
+		Ztoc: toc,
+		Blob: sr,
+	}
+}
+
+func keys(m map[string]string) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
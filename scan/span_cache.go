@@ -0,0 +1,72 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package scan
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"golang.org/x/sync/singleflight"
+)
+
+// spanReaderAt keeps the last compressed spans read from a layer blob, so that
+// the files sharing a span don't fetch it again. The spans are always read whole
+// when extracting files, so reads are keyed by their offset and length.
+type spanReaderAt struct {
+	r io.ReaderAt
+
+	mu    sync.Mutex
+	spans *lru.Cache
+	group singleflight.Group
+}
+
+func newSpanReaderAt(r io.ReaderAt, maxSpans int) *spanReaderAt {
+	return &spanReaderAt{r: r, spans: lru.New(maxSpans)}
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *spanReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	key := strconv.FormatInt(off, 10) + "-" + strconv.Itoa(len(p))
+	s.mu.Lock()
+	v, ok := s.spans.Get(key)
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		v, err, _ = s.group.Do(key, func() (interface{}, error) {
+			b := make([]byte, len(p))
+			n, err := s.r.ReadAt(b, off)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			b = b[:n]
+			s.mu.Lock()
+			s.spans.Add(key, b)
+			s.mu.Unlock()
+			return b, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, v.([]byte))
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
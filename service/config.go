@@ -33,6 +33,8 @@
 package service
 
 import (
+	"fmt"
+
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 )
@@ -51,6 +53,30 @@ type Config struct {
 
 	// SnapshotterConfig is snapshotter-related config.
 	SnapshotterConfig `toml:"snapshotter"`
+
+	// DirectoriesConfig is config for the locations of the snapshotter's state.
+	DirectoriesConfig `toml:"directories"`
+}
+
+// Validate checks that the values of c are in range.
+func (c *Config) Validate() error {
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+	if err := resolver.Config(c.ResolverConfig).Validate(); err != nil {
+		return err
+	}
+	tc := c.ResolverConfig.TokenCache
+	if tc.Enable && tc.KeyFile == "" && len(tc.KeyCommand) == 0 && !c.CacheEncryptionConfig.Enable {
+		return fmt.Errorf("resolver.token_cache requires resolver.token_cache.key_file, resolver.token_cache.key_command or cache_encryption")
+	}
+	if c.KubeconfigKeychainConfig.IsolateNamespaces && !c.CRIKeychainConfig.EnableKeychain {
+		return fmt.Errorf("kubeconfig_keychain.isolate_namespaces requires cri_keychain.enable_keychain")
+	}
+	if c.SnapshotterConfig.MinLayerSize < 0 {
+		return fmt.Errorf("snapshotter.min_layer_size must not be negative")
+	}
+	return nil
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -61,6 +87,11 @@ type KubeconfigKeychainConfig struct {
 	// KubeconfigPath is the path to kubeconfig which can be used to sync
 	// secrets on the cluster into this snapshotter.
 	KubeconfigPath string `toml:"kubeconfig_path"`
+
+	// IsolateNamespaces only uses the secrets of the namespaces whose pods are pulling
+	// an image through the CRI keychain, or whose pulls of it succeeded, for the image,
+	// instead of the secrets of all namespaces. This requires the CRI keychain.
+	IsolateNamespaces bool `toml:"isolate_namespaces"`
 }
 
 // CRIKeychainConfig is config for CRI-based keychain.
@@ -77,7 +108,8 @@ type ResolverConfig resolver.Config
 
 // SnapshotterConfig is snapshotter-related config.
 type SnapshotterConfig struct {
-	// MinLayerSize skips remote mounting of smaller layers
+	// MinLayerSize skips remote mounting of smaller layers. If a snapshot has no size
+	// label, the size of its layer is read from the image manifest.
 	MinLayerSize int64 `toml:"min_layer_size"`
 
 	// AllowInvalidMountsOnRestart allows that there are snapshot mounts that cannot access to the
@@ -85,4 +117,38 @@ type SnapshotterConfig struct {
 	// NOTE: User needs to manually remove the snapshots from containerd's metadata store using
 	//       ctr (e.g. `ctr snapshot rm`).
 	AllowInvalidMountsOnRestart bool `toml:"allow_invalid_mounts_on_restart"`
+
+	// FallbackPull unpacks the layers of remote snapshots which can't be restored when
+	// the snapshotter restarts, e.g. because the SOCI index or the registry is gone,
+	// instead of leaving them invalid. Layers which can't be lazily loaded while pulling
+	// are always unpacked by the snapshotter, regardless of this option.
+	FallbackPull bool `toml:"fallback_pull"`
+
+	// VirtioFS mounts the root filesystems of containers on the host and passes them to
+	// the runtime as bind mounts, so that microVM runtimes share them with their guests
+	// over virtio-fs and layers are lazily loaded on the host.
+	VirtioFS bool `toml:"virtiofs"`
+}
+
+// DirectoriesConfig is config for the locations of the snapshotter's state.
+// Each directory can be placed on a different volume (e.g. the span cache on
+// instance storage and the metadata DB on a persistent volume). Empty values
+// keep the default location under the root directory.
+type DirectoriesConfig struct {
+	// MetadataDir is the directory of the metadata DB.
+	// Defaults to the root directory.
+	MetadataDir string `toml:"metadata_dir"`
+
+	// CacheDir is the directory of the span and HTTP caches.
+	// Defaults to "<root>/soci".
+	CacheDir string `toml:"cache_dir"`
+
+	// SnapshotsDir is the directory of the snapshots, including the FUSE mountpoints
+	// of remote snapshots. Defaults to "<root>/snapshotter".
+	SnapshotsDir string `toml:"snapshots_dir"`
+
+	// Migrate moves existing state from the default locations into the configured
+	// directories on startup. Without it, existing state at the default locations
+	// is left untouched and ignored.
+	Migrate bool `toml:"migrate"`
 }
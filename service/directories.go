@@ -0,0 +1,242 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
+	"github.com/moby/sys/mountinfo"
+)
+
+const (
+	metadataDBName       = "metadata.db"
+	metadataIndexDirName = "metadata-index"
+)
+
+// MetadataDBPath returns the path of the metadata DB for the given root directory.
+func (c DirectoriesConfig) MetadataDBPath(root string) string {
+	if c.MetadataDir != "" {
+		return filepath.Join(c.MetadataDir, metadataDBName)
+	}
+	return filepath.Join(root, metadataDBName)
+}
+
+// MetadataIndexDir returns the directory of the flat metadata indexes of layers for the
+// given root directory.
+func (c DirectoriesConfig) MetadataIndexDir(root string) string {
+	if c.MetadataDir != "" {
+		return filepath.Join(c.MetadataDir, metadataIndexDirName)
+	}
+	return filepath.Join(root, metadataIndexDirName)
+}
+
+func (c DirectoriesConfig) fsRoot(root string) string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	return fsRoot(root)
+}
+
+func (c DirectoriesConfig) snapshotterRoot(root string) string {
+	if c.SnapshotsDir != "" {
+		return c.SnapshotsDir
+	}
+	return snapshotterRoot(root)
+}
+
+// PrepareDirectories validates the directories configured in cfg and creates them if
+// they don't exist. If cfg.Migrate is set, state found at the default locations under
+// root is moved into the configured directories.
+//
+// PrepareDirectories also checks that the snapshotter is functional on the snapshots
+// directory, so it can be called instead of `Supported`.
+func PrepareDirectories(ctx context.Context, root string, cfg DirectoriesConfig) error {
+	dirs := []struct {
+		name string
+		path string
+	}{
+		{"metadata_dir", cfg.MetadataDir},
+		{"cache_dir", cfg.CacheDir},
+		{"snapshots_dir", cfg.SnapshotsDir},
+	}
+	for _, d := range dirs {
+		if d.path == "" {
+			continue
+		}
+		if !filepath.IsAbs(d.path) {
+			return fmt.Errorf("%s must be an absolute path: %q", d.name, d.path)
+		}
+		if err := os.MkdirAll(d.path, 0700); err != nil {
+			return fmt.Errorf("failed to create %s %q: %w", d.name, d.path, err)
+		}
+		if err := checkWritable(d.path); err != nil {
+			return fmt.Errorf("%s %q is not writable: %w", d.name, d.path, err)
+		}
+	}
+
+	if cfg.MetadataDir != "" {
+		if err := migrateMetadataDB(ctx, root, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.CacheDir != "" {
+		if err := migrateCache(ctx, root, cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.SnapshotsDir != "" {
+		if err := migrateSnapshots(ctx, root, cfg); err != nil {
+			return err
+		}
+	}
+
+	// Remote snapshotter is implemented based on overlayfs snapshotter.
+	return overlayutils.Supported(cfg.snapshotterRoot(root))
+}
+
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".soci-write-check-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func migrateMetadataDB(ctx context.Context, root string, cfg DirectoriesConfig) error {
+	oldPath := DirectoriesConfig{}.MetadataDBPath(root)
+	newPath := cfg.MetadataDBPath(root)
+	if oldPath == newPath || !exists(oldPath) {
+		return nil
+	}
+	if exists(newPath) {
+		log.G(ctx).Warnf("metadata DB exists at both %q and %q; using %q", oldPath, newPath, newPath)
+		return nil
+	}
+	if !cfg.Migrate {
+		log.G(ctx).Warnf("found metadata DB at %q which is ignored since metadata_dir is %q; set migrate to move it", oldPath, cfg.MetadataDir)
+		return nil
+	}
+	log.G(ctx).Infof("migrating metadata DB from %q to %q", oldPath, newPath)
+	if err := os.Rename(oldPath, newPath); err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to migrate metadata DB: %w", err)
+	}
+	if err := copyFile(oldPath, newPath); err != nil {
+		os.Remove(newPath)
+		return fmt.Errorf("failed to migrate metadata DB: %w", err)
+	}
+	return os.Remove(oldPath)
+}
+
+// migrateCache removes the cache at the default location. The caches are
+// recreated on every start, so there is nothing to move.
+func migrateCache(ctx context.Context, root string, cfg DirectoriesConfig) error {
+	oldPath := DirectoriesConfig{}.fsRoot(root)
+	if filepath.Clean(oldPath) == filepath.Clean(cfg.CacheDir) || !exists(oldPath) {
+		return nil
+	}
+	if !cfg.Migrate {
+		log.G(ctx).Warnf("found cache at %q which is ignored since cache_dir is %q; set migrate to remove it", oldPath, cfg.CacheDir)
+		return nil
+	}
+	log.G(ctx).Infof("removing cache at %q", oldPath)
+	if err := os.RemoveAll(oldPath); err != nil {
+		return fmt.Errorf("failed to remove cache at %q: %w", oldPath, err)
+	}
+	return nil
+}
+
+// migrateSnapshots moves the snapshots at the default location to the configured
+// snapshots directory. Snapshots are only moved when nothing is mounted on them
+// and both locations are on the same filesystem, since the overlay upper directories
+// can't be copied faithfully.
+func migrateSnapshots(ctx context.Context, root string, cfg DirectoriesConfig) error {
+	oldPath := DirectoriesConfig{}.snapshotterRoot(root)
+	newPath := filepath.Clean(cfg.SnapshotsDir)
+	if oldPath == newPath || !exists(oldPath) {
+		return nil
+	}
+	if !cfg.Migrate {
+		log.G(ctx).Warnf("found snapshots at %q which are ignored since snapshots_dir is %q; set migrate to move them", oldPath, cfg.SnapshotsDir)
+		return nil
+	}
+	entries, err := os.ReadDir(newPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 0 {
+		return fmt.Errorf("cannot migrate snapshots from %q: snapshots_dir %q is not empty", oldPath, newPath)
+	}
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(oldPath))
+	if err != nil {
+		return err
+	}
+	if len(mounts) != 0 {
+		return fmt.Errorf("cannot migrate snapshots from %q: %d mounts are still active under it; unmount them and retry", oldPath, len(mounts))
+	}
+	log.G(ctx).Infof("migrating snapshots from %q to %q", oldPath, newPath)
+	// Rename onto the (empty) new directory so its ownership and permissions are kept from the old one.
+	if err := os.Remove(newPath); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		// Restore the new directory so that the next attempt passes validation.
+		os.Mkdir(newPath, 0700)
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("cannot migrate snapshots from %q to %q across filesystems; move them manually", oldPath, newPath)
+		}
+		return fmt.Errorf("failed to migrate snapshots: %w", err)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
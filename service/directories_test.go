@@ -0,0 +1,67 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateMetadataDB(t *testing.T) {
+	testCases := []struct {
+		name            string
+		migrate         bool
+		expectedMigrate bool
+	}{
+		{
+			name:            "migrate enabled",
+			migrate:         true,
+			expectedMigrate: true,
+		},
+		{
+			name: "migrate disabled",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			cfg := DirectoriesConfig{MetadataDir: t.TempDir(), Migrate: tc.migrate}
+			oldPath := filepath.Join(root, metadataDBName)
+			if err := os.WriteFile(oldPath, []byte("db"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := migrateMetadataDB(context.Background(), root, cfg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if exists(cfg.MetadataDBPath(root)) != tc.expectedMigrate {
+				t.Fatalf("expected migrated: %t", tc.expectedMigrate)
+			}
+			if exists(oldPath) == tc.expectedMigrate {
+				t.Fatalf("expected old metadata DB to exist: %t", !tc.expectedMigrate)
+			}
+		})
+	}
+}
+
+func TestPrepareDirectoriesRelativePath(t *testing.T) {
+	cfg := DirectoriesConfig{CacheDir: "relative/cache"}
+	if err := PrepareDirectories(context.Background(), t.TempDir(), cfg); err == nil {
+		t.Fatal("expected error for relative path")
+	}
+}
@@ -0,0 +1,419 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	orasremote "oras.land/oras-go/v2/registry/remote"
+)
+
+const (
+	imagePrefix   = "/image/"
+	fileSeparator = "/file/"
+
+	// chunkSize is the amount of uncompressed data extracted at a time
+	// while streaming a file.
+	chunkSize = compression.Offset(1 << 22) // 4MiB
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+var (
+	errNotFound   = errors.New("file not found")
+	errWhiteout   = errors.New("file is removed by a whiteout")
+	errNotRegular = errors.New("not a regular file")
+	errBadRange   = errors.New("invalid range")
+	errUnindexed  = errors.New("layer has no ztoc")
+)
+
+// Server is an HTTP handler that serves single files from images in remote
+// registries. It uses the image's SOCI index to locate the file and only
+// fetches the spans of the layer that contain it.
+//
+// Files are served at `GET /image/<ref>/file/<path>`. The optional `range`
+// query parameter selects a byte range of the file as `<start>-<end>`
+// (both inclusive, as in the HTTP Range header; `<end>` may be omitted).
+// The optional `index` query parameter selects the SOCI index by digest
+// instead of discovering it with the Referrers API.
+//
+// Layers without a ztoc (e.g. layers smaller than the minimum layer size
+// when the index was built) can't be searched. Since they may replace or
+// remove the files of the layers below them, files are only served from
+// the layers above the top-most layer without a ztoc.
+type Server struct {
+	hosts      source.RegistryHosts
+	localStore orascontent.Storage
+	resolver   *remote.Resolver
+	platform   platforms.MatchComparer
+}
+
+// Option is an option to configure a Server.
+type Option func(*Server)
+
+// WithPlatform sets the platform used to select a manifest from multi-platform
+// images. It defaults to the platform of the host.
+func WithPlatform(platform platforms.MatchComparer) Option {
+	return func(s *Server) {
+		s.platform = platform
+	}
+}
+
+// WithBlobConfig sets the config used to fetch layer spans from the registry.
+func WithBlobConfig(cfg config.BlobConfig) Option {
+	return func(s *Server) {
+		s.resolver = remote.NewResolver(cfg, nil)
+	}
+}
+
+// NewServer returns a Server that fetches layers from `hosts` and stores
+// SOCI artifacts in `localStore`.
+func NewServer(hosts source.RegistryHosts, localStore orascontent.Storage, opts ...Option) *Server {
+	s := &Server{
+		hosts:      hosts,
+		localStore: localStore,
+		resolver:   remote.NewResolver(config.BlobConfig{}, nil),
+		platform:   platforms.Default(),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
+}
+
+// file is a regular file within a layer that can be read through its ztoc.
+type file struct {
+	toc    *ztoc.Ztoc
+	offset compression.Offset
+	size   compression.Offset
+	sr     *io.SectionReader
+	blob   remote.Blob
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ref, filePath, ok := parsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := log.WithLogger(r.Context(), log.G(r.Context()).WithField("ref", ref).WithField("path", filePath))
+	f, err := s.openFile(ctx, ref, filePath, r.URL.Query().Get("index"))
+	if err != nil {
+		writeError(ctx, w, err)
+		return
+	}
+	defer f.blob.Close()
+
+	start, end := compression.Offset(0), f.size-1
+	rangeParam := r.URL.Query().Get("range")
+	if rangeParam != "" {
+		start, end, err = parseRange(rangeParam, f.size)
+		if err != nil {
+			writeError(ctx, w, err)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, f.size))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(end-start+1), 10))
+	if rangeParam != "" {
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	for offset := start; offset <= end; offset += chunkSize {
+		length := chunkSize
+		if offset+length > end+1 {
+			length = end + 1 - offset
+		}
+		data, err := ztoc.ExtractRange(f.sr, f.toc, f.offset+offset, length)
+		if err != nil {
+			// The status has already been written, so the best we can do is
+			// to cut the response short.
+			log.G(ctx).WithError(err).Error("failed to extract file data")
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to write file data")
+			return
+		}
+	}
+}
+
+// openFile finds the top-most layer of the image containing `filePath`.
+func (s *Server) openFile(ctx context.Context, ref, filePath, indexDigest string) (*file, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image ref %s: %w", ref, err)
+	}
+	repo, err := socifs.NewRemoteStore(refspec)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, manifest, err := s.resolveManifest(ctx, repo, refspec)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexDesc ocispec.Descriptor
+	if indexDigest != "" {
+		dgst, err := digest.Parse(indexDigest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse index digest %s: %w", indexDigest, err)
+		}
+		indexDesc = ocispec.Descriptor{Digest: dgst}
+	} else {
+		indexDesc, err = socifs.NewOCIArtifactClient(repo).SelectReferrer(ctx, manifestDesc, socifs.SelectFirstPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find SOCI index for %s: %w", manifestDesc.Digest, err)
+		}
+	}
+	index, err := socifs.FetchSociArtifacts(ctx, refspec, indexDesc, s.localStore, repo)
+	if errors.Is(err, errdef.ErrAlreadyExists) {
+		// A concurrent request stored the artifacts first, so they are all local now.
+		index, err = socifs.FetchSociArtifacts(ctx, refspec, indexDesc, s.localStore, repo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ztocs := make(map[digest.Digest]ocispec.Descriptor, len(index.Blobs))
+	for _, desc := range index.Blobs {
+		ztocs[digest.Digest(desc.Annotations[soci.IndexAnnotationImageLayerDigest])] = desc
+	}
+
+	target := path.Clean("/" + filePath)
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		layerDesc := manifest.Layers[i]
+		ztocDesc, ok := ztocs[layerDesc.Digest]
+		if !ok {
+			return nil, fmt.Errorf("cannot look up %s below layer %s: %w", target, layerDesc.Digest, errUnindexed)
+		}
+		toc, err := s.getZtoc(ctx, ztocDesc)
+		if err != nil {
+			return nil, err
+		}
+		fm, err := lookup(toc, target)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if errors.Is(err, errWhiteout) {
+			return nil, fmt.Errorf("%s: %w", err, errNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The blob isn't cached, so that the memory used by a request doesn't grow with
+		// the size of the file or the layer.
+		blob, err := s.resolver.Resolve(ctx, s.hosts, refspec, layerDesc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve layer %s: %w", layerDesc.Digest, err)
+		}
+		return &file{
+			toc:    toc,
+			offset: fm.UncompressedOffset,
+			size:   fm.UncompressedSize,
+			sr: io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+				return blob.ReadAt(p, offset)
+			}), 0, blob.Size()),
+			blob: blob,
+		}, nil
+	}
+	return nil, errNotFound
+}
+
+// resolveManifest resolves the image manifest for `refspec`, selecting the
+// manifest for the server's platform if the reference points to an image index.
+func (s *Server) resolveManifest(ctx context.Context, repo *orasremote.Repository, refspec reference.Spec) (ocispec.Descriptor, *ocispec.Manifest, error) {
+	object := refspec.Object
+	if dgst := refspec.Digest(); dgst != "" {
+		object = dgst.String()
+	}
+	desc, err := repo.Resolve(ctx, object)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("cannot resolve %s: %w", refspec, err)
+	}
+
+	b, mediaType, err := soci.FetchManifest(ctx, repo.Manifests(), desc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	if images.IsIndexType(mediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return ocispec.Descriptor{}, nil, fmt.Errorf("cannot parse image index %s: %w", desc.Digest, err)
+		}
+		found := false
+		for _, m := range index.Manifests {
+			if m.Platform != nil && s.platform.Match(*m.Platform) {
+				desc, found = m, true
+				break
+			}
+		}
+		if !found {
+			return ocispec.Descriptor{}, nil, fmt.Errorf("no manifest for the requested platform in %s: %w", refspec, errNotFound)
+		}
+		if b, mediaType, err = soci.FetchManifest(ctx, repo.Manifests(), desc); err != nil {
+			return ocispec.Descriptor{}, nil, err
+		}
+	}
+	if !images.IsManifestType(mediaType) {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("unexpected media type %s of %s", mediaType, refspec)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("cannot parse image manifest %s: %w", desc.Digest, err)
+	}
+	desc.MediaType = mediaType
+	return desc, &manifest, nil
+}
+
+func (s *Server) getZtoc(ctx context.Context, desc ocispec.Descriptor) (*ztoc.Ztoc, error) {
+	rc, err := s.localStore.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch ztoc %s: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	return ztoc.Unmarshal(rc)
+}
+
+// lookup returns the metadata of the regular file `target` in the layer.
+// It returns `errNotFound` if the file isn't in the layer, or `errWhiteout`
+// if the layer hides the file of lower layers with a whiteout.
+func lookup(toc *ztoc.Ztoc, target string) (*ztoc.FileMetadata, error) {
+	entries := make(map[string]*ztoc.FileMetadata, len(toc.FileMetadata))
+	for i := range toc.FileMetadata {
+		entries[path.Clean("/"+toc.FileMetadata[i].Name)] = &toc.FileMetadata[i]
+	}
+
+	fm, ok := entries[target]
+	if !ok {
+		for p := target; p != "/"; p = path.Dir(p) {
+			if _, ok := entries[path.Join(path.Dir(p), whiteoutPrefix+path.Base(p))]; ok {
+				return nil, errWhiteout
+			}
+			if p == target {
+				continue
+			}
+			if _, ok := entries[path.Join(p, whiteoutOpaque)]; ok {
+				return nil, errWhiteout
+			}
+		}
+		if _, ok := entries[path.Join("/", whiteoutOpaque)]; ok {
+			return nil, errWhiteout
+		}
+		return nil, errNotFound
+	}
+	if fm.Type == "hardlink" {
+		if fm, ok = entries[path.Clean("/"+fm.Linkname)]; !ok {
+			return nil, errNotFound
+		}
+	}
+	if fm.Type != "reg" {
+		return nil, fmt.Errorf("%s: %w", target, errNotRegular)
+	}
+	return fm, nil
+}
+
+// parseRange parses a `<start>-<end>` range of a file of size `size`.
+func parseRange(r string, size compression.Offset) (compression.Offset, compression.Offset, error) {
+	startStr, endStr, ok := strings.Cut(r, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%s: %w", r, errBadRange)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", r, errBadRange)
+	}
+	end := int64(size) - 1
+	if endStr != "" {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("%s: %w", r, errBadRange)
+		}
+	}
+	if start < 0 || end < start || end >= int64(size) {
+		return 0, 0, fmt.Errorf("%s: %w", r, errBadRange)
+	}
+	return compression.Offset(start), compression.Offset(end), nil
+}
+
+// parsePath splits `/image/<ref>/file/<path>` into the image ref and the file path.
+func parsePath(p string) (string, string, bool) {
+	if !strings.HasPrefix(p, imagePrefix) {
+		return "", "", false
+	}
+	ref, filePath, ok := strings.Cut(strings.TrimPrefix(p, imagePrefix), fileSeparator)
+	if !ok || ref == "" || filePath == "" {
+		return "", "", false
+	}
+	return ref, filePath, true
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, socifs.ErrNoReferrers):
+		status = http.StatusNotFound
+	case errors.Is(err, errNotRegular):
+		status = http.StatusBadRequest
+	case errors.Is(err, errBadRange):
+		status = http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, errUnindexed):
+		status = http.StatusUnprocessableEntity
+	}
+	log.G(ctx).WithError(err).Debug("failed to serve file")
+	http.Error(w, err.Error(), status)
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
@@ -0,0 +1,190 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package gateway
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func TestParsePath(t *testing.T) {
+	testCases := []struct {
+		name         string
+		path         string
+		expectedRef  string
+		expectedFile string
+		expectedOK   bool
+	}{
+		{
+			name:         "ref with tag",
+			path:         "/image/registry.example.com/repo:latest/file/etc/hosts",
+			expectedRef:  "registry.example.com/repo:latest",
+			expectedFile: "etc/hosts",
+			expectedOK:   true,
+		},
+		{
+			name:         "ref with digest",
+			path:         "/image/registry.example.com/org/repo@sha256:abc/file/bin/sh",
+			expectedRef:  "registry.example.com/org/repo@sha256:abc",
+			expectedFile: "bin/sh",
+			expectedOK:   true,
+		},
+		{
+			name: "missing file path",
+			path: "/image/registry.example.com/repo:latest/file/",
+		},
+		{
+			name: "missing file separator",
+			path: "/image/registry.example.com/repo:latest",
+		},
+		{
+			name: "unknown prefix",
+			path: "/blob/registry.example.com/repo:latest/file/etc/hosts",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, file, ok := parsePath(tc.path)
+			if ok != tc.expectedOK {
+				t.Fatalf("expected ok=%v, got %v", tc.expectedOK, ok)
+			}
+			if ref != tc.expectedRef || file != tc.expectedFile {
+				t.Fatalf("expected (%s, %s), got (%s, %s)", tc.expectedRef, tc.expectedFile, ref, file)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	testCases := []struct {
+		name          string
+		r             string
+		size          compression.Offset
+		expectedStart compression.Offset
+		expectedEnd   compression.Offset
+		expectError   bool
+	}{
+		{
+			name:          "start and end",
+			r:             "10-19",
+			size:          100,
+			expectedStart: 10,
+			expectedEnd:   19,
+		},
+		{
+			name:          "open ended range",
+			r:             "10-",
+			size:          100,
+			expectedStart: 10,
+			expectedEnd:   99,
+		},
+		{
+			name:        "end past the end of the file",
+			r:           "10-100",
+			size:        100,
+			expectError: true,
+		},
+		{
+			name:        "end before start",
+			r:           "20-10",
+			size:        100,
+			expectError: true,
+		},
+		{
+			name:        "not a range",
+			r:           "10",
+			size:        100,
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, err := parseRange(tc.r, tc.size)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if err == nil && (start != tc.expectedStart || end != tc.expectedEnd) {
+				t.Fatalf("expected (%d, %d), got (%d, %d)", tc.expectedStart, tc.expectedEnd, start, end)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	toc := &ztoc.Ztoc{
+		TOC: ztoc.TOC{
+			FileMetadata: []ztoc.FileMetadata{
+				{Name: "./etc/", Type: "dir"},
+				{Name: "./etc/hosts", Type: "reg", UncompressedSize: 10},
+				{Name: "./etc/hostlink", Type: "hardlink", Linkname: "./etc/hosts"},
+				{Name: "./etc/.wh.passwd", Type: "reg"},
+				{Name: "./opt/.wh..wh..opq", Type: "reg"},
+			},
+		},
+	}
+	testCases := []struct {
+		name         string
+		target       string
+		expectedName string
+		expectedErr  error
+	}{
+		{
+			name:         "regular file",
+			target:       "/etc/hosts",
+			expectedName: "./etc/hosts",
+		},
+		{
+			name:         "hardlink resolves to target",
+			target:       "/etc/hostlink",
+			expectedName: "./etc/hosts",
+		},
+		{
+			name:        "directory is not a regular file",
+			target:      "/etc",
+			expectedErr: errNotRegular,
+		},
+		{
+			name:        "whiteout hides file",
+			target:      "/etc/passwd",
+			expectedErr: errWhiteout,
+		},
+		{
+			name:        "opaque directory hides file",
+			target:      "/opt/app/config",
+			expectedErr: errWhiteout,
+		},
+		{
+			name:        "missing file",
+			target:      "/usr/bin/env",
+			expectedErr: errNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm, err := lookup(toc, tc.target)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err == nil && fm.Name != tc.expectedName {
+				t.Fatalf("expected %s, got %s", tc.expectedName, fm.Name)
+			}
+		})
+	}
+}
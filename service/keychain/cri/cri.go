@@ -39,6 +39,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
@@ -49,8 +50,21 @@ import (
 // NewCRIKeychain provides creds passed through CRI PullImage API.
 // This also returns a CRI image service server that works as a proxy backed by the specified CRI service.
 // This server reads all PullImageRequest and uses PullImageRequest.AuthConfig for authenticating snapshots.
-func NewCRIKeychain(ctx context.Context, connectCRI func() (runtime.ImageServiceClient, error)) (resolver.Credential, runtime.ImageServiceServer) {
-	server := &instrumentedService{config: make(map[string]*runtime.AuthConfig)}
+// It also reports how images were lazily pulled in the verbose info of ImageStatus.
+func NewCRIKeychain(ctx context.Context, connectCRI func() (runtime.ImageServiceClient, error), opts ...Option) (resolver.Credential, runtime.ImageServiceServer) {
+	var criOpts options
+	for _, o := range opts {
+		o(&criOpts)
+	}
+	if criOpts.tenants == nil {
+		criOpts.tenants = tenants.New()
+	}
+	server := &instrumentedService{
+		config:  make(map[string]map[string]*runtime.AuthConfig),
+		usage:   criOpts.usage,
+		tenants: criOpts.tenants,
+		pulls:   pullRecords{progress: criOpts.progress},
+	}
 	go func() {
 		log.G(ctx).Debugf("Waiting for CRI service is started...")
 		for i := 0; i < 100; i++ {
@@ -74,10 +88,20 @@ type instrumentedService struct {
 	cri   runtime.ImageServiceClient
 	criMu sync.Mutex
 
-	config   map[string]*runtime.AuthConfig
+	// config is the auth config of each pull by image ref and the namespace of its pod,
+	// so that a pull doesn't replace the credentials provided by other namespaces.
+	config   map[string]map[string]*runtime.AuthConfig
 	configMu sync.Mutex
+
+	pulls pullRecords
+	usage func() (*runtime.FilesystemUsage, error)
+	// tenants records the namespaces pulling and which pulled each image. Only their
+	// auth configs are used for the image.
+	tenants *tenants.Tenants
 }
 
+// credentials returns the credentials of host for refspec from the auth configs of the
+// namespaces which are pulling refspec, or which pulled it if no pull is in progress.
 func (in *instrumentedService) credentials(host string, refspec reference.Spec) (string, string, error) {
 	if host == "docker.io" || host == "registry-1.docker.io" {
 		// Creds of "docker.io" is stored keyed by "https://index.docker.io/v1/".
@@ -85,8 +109,18 @@ func (in *instrumentedService) credentials(host string, refspec reference.Spec)
 	}
 	in.configMu.Lock()
 	defer in.configMu.Unlock()
-	if cfg, ok := in.config[refspec.String()]; ok {
-		return resolver.ParseAuth(cfg, host)
+	configs := in.config[refspec.String()]
+	for _, ns := range in.tenants.Get(refspec) {
+		if _, ok := configs[ns]; !ok {
+			continue
+		}
+		username, secret, err := resolver.ParseAuth(configs[ns], host)
+		if err != nil {
+			return "", "", err
+		}
+		if username != "" || secret != "" {
+			return username, secret, nil
+		}
 	}
 	return "", "", nil
 }
@@ -111,7 +145,19 @@ func (in *instrumentedService) ImageStatus(ctx context.Context, r *runtime.Image
 	if cri == nil {
 		return nil, errors.New("server is not initialized yet")
 	}
-	return cri.ImageStatus(ctx, r)
+	res, err = cri.ImageStatus(ctx, r)
+	if err != nil || !r.GetVerbose() || res.GetImage() == nil {
+		return res, err
+	}
+	if refspec, err := parseReference(r.GetImage().GetImage()); err == nil {
+		if info, ok := in.pulls.get(refspec.String()); ok {
+			if res.Info == nil {
+				res.Info = make(map[string]string)
+			}
+			res.Info[PullInfoKey] = info
+		}
+	}
+	return res, nil
 }
 
 func (in *instrumentedService) PullImage(ctx context.Context, r *runtime.PullImageRequest) (res *runtime.PullImageResponse, err error) {
@@ -123,13 +169,26 @@ func (in *instrumentedService) PullImage(ctx context.Context, r *runtime.PullIma
 	if err != nil {
 		return nil, err
 	}
-	in.configMu.Lock()
-	in.config[refspec.String()] = r.GetAuth()
-	in.configMu.Unlock()
-	return cri.PullImage(ctx, r)
+	namespace := r.GetSandboxConfig().GetMetadata().GetNamespace()
+	restore := in.setConfig(refspec, namespace, r.GetAuth())
+	// the layers are mounted while pulling with the credentials of the namespaces pulling
+	// the image. The namespace is recorded as a tenant of the image once the pull succeeds.
+	done := in.tenants.Pull(refspec, namespace)
+	info := in.pulls.start(refspec.String())
+	res, err = cri.PullImage(ctx, r)
+	in.pulls.complete(info, err)
+	if err != nil {
+		// don't keep credentials which failed to pull the image.
+		restore()
+	}
+	done(err == nil)
+	if err == nil {
+		log.G(ctx).WithField("image", refspec.String()).WithField("durationMs", info.DurationMs).Debug("pulled image through CRI")
+	}
+	return res, err
 }
 
-func (in *instrumentedService) RemoveImage(ctx context.Context, r *runtime.RemoveImageRequest) (_ *runtime.RemoveImageResponse, err error) {
+func (in *instrumentedService) RemoveImage(ctx context.Context, r *runtime.RemoveImageRequest) (*runtime.RemoveImageResponse, error) {
 	cri := in.getCRI()
 	if cri == nil {
 		return nil, errors.New("server is not initialized yet")
@@ -138,10 +197,44 @@ func (in *instrumentedService) RemoveImage(ctx context.Context, r *runtime.Remov
 	if err != nil {
 		return nil, err
 	}
+	res, err := cri.RemoveImage(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	// RemoveImageRequest doesn't identify the namespace removing the image, which is
+	// removed from the node for all namespaces, so all of their credentials are forgotten.
 	in.configMu.Lock()
 	delete(in.config, refspec.String())
 	in.configMu.Unlock()
-	return cri.RemoveImage(ctx, r)
+	in.tenants.Remove(refspec)
+	return res, nil
+}
+
+// setConfig records the auth config of namespace for refspec and returns a function
+// which restores the previous auth config of namespace.
+func (in *instrumentedService) setConfig(refspec reference.Spec, namespace string, auth *runtime.AuthConfig) (restore func()) {
+	in.configMu.Lock()
+	defer in.configMu.Unlock()
+	configs, ok := in.config[refspec.String()]
+	if !ok {
+		configs = make(map[string]*runtime.AuthConfig)
+		in.config[refspec.String()] = configs
+	}
+	prev, hadPrev := configs[namespace]
+	configs[namespace] = auth
+	return func() {
+		in.configMu.Lock()
+		defer in.configMu.Unlock()
+		configs, ok := in.config[refspec.String()]
+		if !ok {
+			return
+		}
+		if hadPrev {
+			configs[namespace] = prev
+		} else {
+			delete(configs, namespace)
+		}
+	}
 }
 
 func (in *instrumentedService) ImageFsInfo(ctx context.Context, r *runtime.ImageFsInfoRequest) (res *runtime.ImageFsInfoResponse, err error) {
@@ -149,7 +242,17 @@ func (in *instrumentedService) ImageFsInfo(ctx context.Context, r *runtime.Image
 	if cri == nil {
 		return nil, errors.New("server is not initialized yet")
 	}
-	return cri.ImageFsInfo(ctx, r)
+	res, err = cri.ImageFsInfo(ctx, r)
+	if err != nil || in.usage == nil {
+		return res, err
+	}
+	usage, err := in.usage()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get disk usage of snapshotter")
+		return res, nil
+	}
+	res.ImageFilesystems = addUsage(res.ImageFilesystems, usage)
+	return res, nil
 }
 
 func parseReference(ref string) (reference.Spec, error) {
@@ -0,0 +1,121 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cri
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
+	"google.golang.org/grpc"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// fakeImageService calls pull for PullImage and succeeds for RemoveImage.
+type fakeImageService struct {
+	runtime.ImageServiceClient
+	pull func(*runtime.PullImageRequest) error
+}
+
+func (f *fakeImageService) PullImage(_ context.Context, r *runtime.PullImageRequest, _ ...grpc.CallOption) (*runtime.PullImageResponse, error) {
+	if err := f.pull(r); err != nil {
+		return nil, err
+	}
+	return &runtime.PullImageResponse{ImageRef: r.GetImage().GetImage()}, nil
+}
+
+func (f *fakeImageService) RemoveImage(context.Context, *runtime.RemoveImageRequest, ...grpc.CallOption) (*runtime.RemoveImageResponse, error) {
+	return &runtime.RemoveImageResponse{}, nil
+}
+
+func pullRequest(ref, namespace, username string) *runtime.PullImageRequest {
+	return &runtime.PullImageRequest{
+		Image: &runtime.ImageSpec{Image: ref},
+		Auth:  &runtime.AuthConfig{Username: username, Password: "password"},
+		SandboxConfig: &runtime.PodSandboxConfig{
+			Metadata: &runtime.PodSandboxMetadata{Namespace: namespace},
+		},
+	}
+}
+
+func TestCredentialsScopedToNamespaces(t *testing.T) {
+	const (
+		ref  = "registry.example.com/app:latest"
+		host = "registry.example.com"
+	)
+	refspec, err := parseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeImageService{}
+	in := &instrumentedService{
+		cri:     fake,
+		config:  make(map[string]map[string]*runtime.AuthConfig),
+		tenants: tenants.New(),
+	}
+	username := func() string {
+		u, _, err := in.credentials(host, refspec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	ctx := context.Background()
+
+	// While team-a pulls the image, its layers are fetched with team-a's credentials.
+	fake.pull = func(*runtime.PullImageRequest) error {
+		if got := username(); got != "user-a" {
+			t.Errorf("expected the credentials of team-a while it pulls, got %q", got)
+		}
+		return nil
+	}
+	if _, err := in.PullImage(ctx, pullRequest(ref, "team-a", "user-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// While team-b pulls the image, only team-b's credentials are used,
+	// and they are forgotten when the pull fails.
+	fake.pull = func(*runtime.PullImageRequest) error {
+		if got := username(); got != "user-b" {
+			t.Errorf("expected the credentials of team-b while it pulls, got %q", got)
+		}
+		return errors.New("unauthorized")
+	}
+	if _, err := in.PullImage(ctx, pullRequest(ref, "team-b", "user-b")); err == nil {
+		t.Fatal("expected the pull of team-b to fail")
+	}
+	if got := username(); got != "user-a" {
+		t.Errorf("expected the credentials of team-a after team-b's pull failed, got %q", got)
+	}
+
+	// A namespace which never pulled the image can't be used for another image.
+	other, err := parseReference("registry.example.com/other:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _, err := in.credentials(host, other); err != nil || u != "" {
+		t.Errorf("expected no credentials for an image which wasn't pulled, got %q (%v)", u, err)
+	}
+
+	if _, err := in.RemoveImage(ctx, &runtime.RemoveImageRequest{Image: &runtime.ImageSpec{Image: ref}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := username(); got != "" {
+		t.Errorf("expected no credentials after removing the image, got %q", got)
+	}
+}
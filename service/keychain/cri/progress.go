@@ -0,0 +1,243 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cri
+
+import (
+	"encoding/json"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/progress"
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
+	"golang.org/x/sys/unix"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+const (
+	// PullInfoKey is the key of the verbose info of CRI ImageStatus that reports
+	// how the image was lazily pulled.
+	PullInfoKey = "sociPull"
+
+	// defaultUsageTTL is how long the disk usage of the snapshotter is cached for,
+	// since kubelet polls ImageFsInfo periodically and walking the cache is expensive.
+	defaultUsageTTL = time.Minute
+
+	// maxPullRecords bounds the number of pulls whose progress is remembered.
+	maxPullRecords = 1024
+)
+
+type options struct {
+	usage    func() (*runtime.FilesystemUsage, error)
+	tenants  *tenants.Tenants
+	progress *progress.Tracker
+}
+
+type Option func(*options)
+
+// WithSnapshotterRoot reports the disk usage of the snapshotter's root directory
+// (e.g. the spans fetched by lazily loaded layers) in CRI ImageFsInfo. It's added to
+// the image filesystem on the same device, since the backend CRI service only accounts
+// for the unpacked layers, which are empty for lazily pulled images.
+func WithSnapshotterRoot(root string) Option {
+	return func(opts *options) {
+		opts.usage = newDirUsage(root, defaultUsageTTL)
+	}
+}
+
+// WithTenants records the namespace of the pod of each pull in t, so that other
+// keychains can scope their credentials to the namespaces pulling or which pulled an
+// image. The CRI keychain always scopes the credentials of pulls this way.
+func WithTenants(t *tenants.Tenants) Option {
+	return func(opts *options) {
+		opts.tenants = t
+	}
+}
+
+// WithPullProgress reports the phases of lazy pulls recorded by the filesystem in t
+// (resolving the SOCI index, fetching ztocs and mounting layers) and the bytes
+// fetched for them in the verbose info of ImageStatus.
+func WithPullProgress(t *progress.Tracker) Option {
+	return func(opts *options) {
+		opts.progress = t
+	}
+}
+
+// PullInfo reports how an image was pulled through the CRI proxy. With a lazy pull,
+// the duration is spent on resolving the image, fetching its SOCI index and ztocs
+// and mounting the layers, rather than downloading them.
+type PullInfo struct {
+	StartedAt   time.Time `json:"startedAt"`
+	CompletedAt time.Time `json:"completedAt,omitempty"`
+	// DurationMs is the duration of the pull in milliseconds.
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+	// Image is the phase the lazy pull reached and the bytes fetched for it.
+	progress.Image
+}
+
+// pullRecords remembers the progress of recent pulls by image ref.
+type pullRecords struct {
+	mu    sync.Mutex
+	pulls map[string]*PullInfo
+	order []string
+	// progress is the progress of the lazy pulls recorded by the filesystem, if any.
+	progress *progress.Tracker
+}
+
+func (p *pullRecords) start(ref string) *PullInfo {
+	info := &PullInfo{StartedAt: time.Now()}
+	p.progress.Reset(ref)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pulls == nil {
+		p.pulls = make(map[string]*PullInfo)
+	}
+	if _, ok := p.pulls[ref]; !ok {
+		p.order = append(p.order, ref)
+		if len(p.order) > maxPullRecords {
+			delete(p.pulls, p.order[0])
+			p.order = p.order[1:]
+		}
+	}
+	p.pulls[ref] = info
+	return info
+}
+
+func (p *pullRecords) complete(info *PullInfo, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info.CompletedAt = time.Now()
+	info.DurationMs = info.CompletedAt.Sub(info.StartedAt).Milliseconds()
+	if err != nil {
+		info.Error = err.Error()
+	}
+}
+
+// get returns the progress of the last pull of ref as JSON.
+func (p *pullRecords) get(ref string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.pulls[ref]
+	if !ok {
+		return "", false
+	}
+	out := *info
+	out.Image, _ = p.progress.Get(ref)
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// newDirUsage returns a function that reports the disk usage of root,
+// computing it at most once per ttl.
+func newDirUsage(root string, ttl time.Duration) func() (*runtime.FilesystemUsage, error) {
+	var (
+		mu      sync.Mutex
+		usage   *runtime.FilesystemUsage
+		updated time.Time
+	)
+	return func() (*runtime.FilesystemUsage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if usage != nil && time.Since(updated) < ttl {
+			return usage, nil
+		}
+		var rootSt unix.Stat_t
+		if err := unix.Lstat(root, &rootSt); err != nil {
+			return nil, err
+		}
+		type inode struct{ dev, ino uint64 }
+		seen := make(map[inode]struct{})
+		var bytes, inodes uint64
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// files can be removed while walking.
+				return nil
+			}
+			var st unix.Stat_t
+			if err := unix.Lstat(path, &st); err != nil {
+				return nil
+			}
+			// don't walk into the layers mounted below root, which would fetch them.
+			if uint64(st.Dev) != uint64(rootSt.Dev) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if st.Nlink > 1 && !d.IsDir() {
+				key := inode{uint64(st.Dev), uint64(st.Ino)}
+				if _, ok := seen[key]; ok {
+					return nil
+				}
+				seen[key] = struct{}{}
+			}
+			bytes += uint64(st.Blocks) * 512
+			inodes++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		updated = time.Now()
+		usage = &runtime.FilesystemUsage{
+			Timestamp:  updated.UnixNano(),
+			FsId:       &runtime.FilesystemIdentifier{Mountpoint: root},
+			UsedBytes:  &runtime.UInt64Value{Value: bytes},
+			InodesUsed: &runtime.UInt64Value{Value: inodes},
+		}
+		return usage, nil
+	}
+}
+
+// addUsage adds the snapshotter's usage to the image filesystem on the same device,
+// or appends it as another image filesystem.
+func addUsage(filesystems []*runtime.FilesystemUsage, usage *runtime.FilesystemUsage) []*runtime.FilesystemUsage {
+	for _, f := range filesystems {
+		if !sameDevice(f.GetFsId().GetMountpoint(), usage.GetFsId().GetMountpoint()) {
+			continue
+		}
+		if f.UsedBytes == nil {
+			f.UsedBytes = &runtime.UInt64Value{}
+		}
+		f.UsedBytes.Value += usage.GetUsedBytes().GetValue()
+		if f.InodesUsed == nil {
+			f.InodesUsed = &runtime.UInt64Value{}
+		}
+		f.InodesUsed.Value += usage.GetInodesUsed().GetValue()
+		return filesystems
+	}
+	return append(filesystems, usage)
+}
+
+func sameDevice(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	var sta, stb unix.Stat_t
+	if err := unix.Stat(a, &sta); err != nil {
+		return false
+	}
+	if err := unix.Stat(b, &stb); err != nil {
+		return false
+	}
+	return sta.Dev == stb.Dev
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cri
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/progress"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+func TestPullRecords(t *testing.T) {
+	p := pullRecords{progress: progress.New()}
+	p.progress.SetPhase("docker.io/library/foo:latest", progress.PhaseResolvingIndex)
+	info := p.start("docker.io/library/foo:latest")
+	p.progress.SetPhase("docker.io/library/foo:latest", progress.PhaseFetchingZtocs)
+	p.progress.AddZtocs("docker.io/library/foo:latest", 2)
+	p.progress.ZtocFetched("docker.io/library/foo:latest", 100)
+	p.complete(info, errors.New("pull failed"))
+
+	s, ok := p.get("docker.io/library/foo:latest")
+	if !ok {
+		t.Fatal("expected pull to be recorded")
+	}
+	var got PullInfo
+	if err := json.Unmarshal([]byte(s), &got); err != nil {
+		t.Fatalf("failed to unmarshal pull info: %v", err)
+	}
+	if got.Error != "pull failed" || got.CompletedAt.IsZero() {
+		t.Fatalf("unexpected pull info %+v", got)
+	}
+	expected := progress.Image{Phase: progress.PhaseFetchingZtocs, ZtocsTotal: 2, ZtocsFetched: 1, BytesFetched: 100}
+	if got.Image != expected {
+		t.Fatalf("expected progress %+v, got %+v", expected, got.Image)
+	}
+
+	for i := 0; i < maxPullRecords; i++ {
+		p.start(fmt.Sprintf("docker.io/library/foo:%d", i))
+	}
+	if _, ok := p.get("docker.io/library/foo:latest"); ok {
+		t.Fatal("expected the oldest pull to be forgotten")
+	}
+	if len(p.pulls) != maxPullRecords {
+		t.Fatalf("expected %d pulls, got %d", maxPullRecords, len(p.pulls))
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "span"), make([]byte, 8192), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	// hardlinks are only counted once.
+	if err := os.Link(filepath.Join(root, "span"), filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to link file: %v", err)
+	}
+	usage, err := newDirUsage(root, time.Minute)()
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if usage.GetInodesUsed().GetValue() != 2 {
+		t.Fatalf("expected 2 inodes, got %d", usage.GetInodesUsed().GetValue())
+	}
+
+	testCases := []struct {
+		name            string
+		mountpoint      string
+		expectedEntries int
+		expectedUsed    uint64
+	}{
+		{
+			name:            "image filesystem on the same device",
+			mountpoint:      filepath.Dir(root),
+			expectedEntries: 1,
+			expectedUsed:    100 + usage.GetUsedBytes().GetValue(),
+		},
+		{
+			name:            "image filesystem on an unknown mountpoint",
+			mountpoint:      filepath.Join(root, "does-not-exist"),
+			expectedEntries: 2,
+			expectedUsed:    100,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filesystems := []*runtime.FilesystemUsage{{
+				FsId:      &runtime.FilesystemIdentifier{Mountpoint: tc.mountpoint},
+				UsedBytes: &runtime.UInt64Value{Value: 100},
+			}}
+			filesystems = addUsage(filesystems, usage)
+			if len(filesystems) != tc.expectedEntries {
+				t.Fatalf("expected %d filesystems, got %d", tc.expectedEntries, len(filesystems))
+			}
+			if used := filesystems[0].GetUsedBytes().GetValue(); used != tc.expectedUsed {
+				t.Fatalf("expected %d bytes used, got %d", tc.expectedUsed, used)
+			}
+		})
+	}
+}
@@ -40,6 +40,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
@@ -60,6 +61,7 @@ const dockerconfigSelector = "type=" + string(corev1.SecretTypeDockerConfigJson)
 
 type options struct {
 	kubeconfigPath string
+	tenants        *tenants.Tenants
 }
 
 type Option func(*options)
@@ -70,6 +72,16 @@ func WithKubeconfigPath(path string) Option {
 	}
 }
 
+// WithTenants only uses the secrets of the tenants of an image as recorded in t (the
+// namespaces pulling it or which pulled it, e.g. through the CRI keychain) for the image.
+// Otherwise, the secrets of all namespaces are used for all images, which isn't suitable
+// for nodes shared by tenants.
+func WithTenants(t *tenants.Tenants) Option {
+	return func(opts *options) {
+		opts.tenants = t
+	}
+}
+
 // NewKubeconfigKeychain provides a keychain which can sync its contents with
 // kubernetes API server by fetching all `kubernetes.io/dockerconfigjson`
 // secrets in the cluster with provided kubeconfig. It's OK that config provides
@@ -87,6 +99,7 @@ func NewKubeconfigKeychain(ctx context.Context, opts ...Option) resolver.Credent
 		o(&kcOpts)
 	}
 	kc := newKeychain(ctx, kcOpts.kubeconfigPath)
+	kc.tenants = kcOpts.tenants
 	return kc.credentials
 }
 
@@ -145,6 +158,9 @@ type keychain struct {
 	config   map[string]*dcfile.ConfigFile
 	configMu sync.Mutex
 
+	// tenants limits the secrets used for an image to the namespaces which pulled it, if it isn't nil.
+	tenants *tenants.Tenants
+
 	// the following entries are used for syncing secrets with API server.
 	// these fields are lazily filled after kubeconfig file is provided.
 	queue    *workqueue.Type
@@ -158,7 +174,13 @@ func (kc *keychain) credentials(host string, refspec reference.Spec) (string, st
 	}
 	kc.configMu.Lock()
 	defer kc.configMu.Unlock()
-	for _, cfg := range kc.config {
+	for key, cfg := range kc.config {
+		if kc.tenants != nil {
+			namespace, _, err := cache.SplitMetaNamespaceKey(key)
+			if err != nil || !kc.tenants.Has(refspec, namespace) {
+				continue
+			}
+		}
 		if acfg, err := cfg.GetAuthConfig(host); err == nil {
 			if acfg.IdentityToken != "" {
 				return "", acfg.IdentityToken, nil
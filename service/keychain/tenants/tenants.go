@@ -0,0 +1,129 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tenants records which tenants (Kubernetes namespaces) pulled each image,
+// so that keychains only use the credentials of those tenants for the image.
+package tenants
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/reference"
+)
+
+// Tenants records the tenants which pulled each image ref.
+type Tenants struct {
+	refs    map[string]map[string]struct{}
+	pulling map[string]map[string]int // image ref -> tenant -> number of pulls in progress
+	mu      sync.Mutex
+}
+
+// New returns an empty record of tenants.
+func New() *Tenants {
+	return &Tenants{
+		refs:    make(map[string]map[string]struct{}),
+		pulling: make(map[string]map[string]int),
+	}
+}
+
+// Pull records that tenant started pulling refspec. While any tenant pulls refspec,
+// only the tenants pulling it are the tenants of refspec, since the layers are fetched
+// on behalf of them. The returned function must be called when the pull completes, and
+// tenant is recorded to have pulled refspec if the pull succeeded.
+func (t *Tenants) Pull(refspec reference.Spec, tenant string) func(succeeded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ref := refspec.String()
+	pulling, ok := t.pulling[ref]
+	if !ok {
+		pulling = make(map[string]int)
+		t.pulling[ref] = pulling
+	}
+	pulling[tenant]++
+	var once sync.Once
+	return func(succeeded bool) {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if pulling[tenant]--; pulling[tenant] == 0 {
+				delete(pulling, tenant)
+			}
+			if len(pulling) == 0 {
+				delete(t.pulling, ref)
+			}
+			if succeeded {
+				t.addLocked(ref, tenant)
+			}
+		})
+	}
+}
+
+// Add records that tenant pulled refspec.
+func (t *Tenants) Add(refspec reference.Spec, tenant string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addLocked(refspec.String(), tenant)
+}
+
+func (t *Tenants) addLocked(ref, tenant string) {
+	tenants, ok := t.refs[ref]
+	if !ok {
+		tenants = make(map[string]struct{})
+		t.refs[ref] = tenants
+	}
+	tenants[tenant] = struct{}{}
+}
+
+// Remove forgets the tenants which pulled refspec, e.g. when the image is removed.
+// Pulls in progress aren't affected.
+func (t *Tenants) Remove(refspec reference.Spec) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.refs, refspec.String())
+}
+
+// Get returns the tenants of refspec sorted by name: the tenants pulling it if any
+// pull is in progress, otherwise the tenants which pulled it.
+func (t *Tenants) Get(refspec reference.Spec) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var tenants []string
+	for tenant := range t.tenantsLocked(refspec.String()) {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// Has returns true if tenant is a tenant of refspec as returned by Get.
+func (t *Tenants) Has(refspec reference.Spec, tenant string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.tenantsLocked(refspec.String())[tenant]
+	return ok
+}
+
+func (t *Tenants) tenantsLocked(ref string) map[string]struct{} {
+	if pulling := t.pulling[ref]; len(pulling) > 0 {
+		tenants := make(map[string]struct{}, len(pulling))
+		for tenant := range pulling {
+			tenants[tenant] = struct{}{}
+		}
+		return tenants
+	}
+	return t.refs[ref]
+}
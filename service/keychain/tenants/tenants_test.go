@@ -0,0 +1,88 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tenants
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestTenants(t *testing.T) {
+	image1, err := reference.Parse("registry.example.com/team-a/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image2, err := reference.Parse("registry.example.com/team-b/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants := New()
+	tenants.Add(image1, "team-a")
+	tenants.Add(image1, "shared")
+	tenants.Add(image2, "team-b")
+
+	if got, expected := tenants.Get(image1), []string{"shared", "team-a"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected tenants %v, got %v", expected, got)
+	}
+	if !tenants.Has(image1, "team-a") {
+		t.Fatal("expected team-a to have pulled image1")
+	}
+	if tenants.Has(image1, "team-b") {
+		t.Fatal("expected team-b not to have pulled image1")
+	}
+
+	tenants.Remove(image1)
+	if got := tenants.Get(image1); len(got) != 0 {
+		t.Fatalf("expected no tenants after removing image1, got %v", got)
+	}
+	if !tenants.Has(image2, "team-b") {
+		t.Fatal("expected removing image1 not to affect image2")
+	}
+}
+
+func TestTenantsPull(t *testing.T) {
+	image, err := reference.Parse("registry.example.com/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenants := New()
+	tenants.Add(image, "team-a")
+
+	// While team-b pulls the image, only team-b is its tenant.
+	done := tenants.Pull(image, "team-b")
+	if got, expected := tenants.Get(image), []string{"team-b"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected tenants %v while pulling, got %v", expected, got)
+	}
+	if tenants.Has(image, "team-a") {
+		t.Fatal("expected team-a not to be a tenant while team-b pulls the image")
+	}
+	done(false)
+	if got, expected := tenants.Get(image), []string{"team-a"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected tenants %v after a failed pull, got %v", expected, got)
+	}
+
+	done = tenants.Pull(image, "team-b")
+	done(true)
+	done(true) // completing a pull twice doesn't change anything
+	if got, expected := tenants.Get(image), []string{"team-a", "team-b"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected tenants %v after a successful pull, got %v", expected, got)
+	}
+}
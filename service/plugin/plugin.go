@@ -40,10 +40,13 @@ import (
 	"path/filepath"
 	"time"
 
+	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/progress"
 	"github.com/awslabs/soci-snapshotter/service"
 	"github.com/awslabs/soci-snapshotter/service/keychain/cri"
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/service/keychain/kubeconfig"
+	"github.com/awslabs/soci-snapshotter/service/keychain/tenants"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/log"
@@ -92,11 +95,20 @@ func init() {
 
 			// Configure keychain
 			credsFuncs := []resolver.Credential{dockerconfig.NewDockerConfigKeychain(ctx)}
+			var fsOpts []socifs.Option
+			// podTenants records the namespaces of the pods which pulled each image through the CRI keychain.
+			var podTenants *tenants.Tenants
+			if config.Config.KubeconfigKeychainConfig.IsolateNamespaces {
+				podTenants = tenants.New()
+			}
 			if config.Config.KubeconfigKeychainConfig.EnableKeychain {
 				var opts []kubeconfig.Option
 				if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
 					opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
 				}
+				if podTenants != nil {
+					opts = append(opts, kubeconfig.WithTenants(podTenants))
+				}
 				credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
 			}
 			if addr := config.CRIKeychainImageServicePath; config.Config.CRIKeychainConfig.EnableKeychain && addr != "" {
@@ -128,7 +140,11 @@ func init() {
 					}
 					return runtime.NewImageServiceClient(conn), nil
 				}
-				criCreds, criServer := cri.NewCRIKeychain(ctx, connectCRI)
+				// pullProgress records the phases of lazy pulls for ImageStatus.
+				pullProgress := progress.New()
+				fsOpts = append(fsOpts, socifs.WithPullProgress(pullProgress))
+				criCreds, criServer := cri.NewCRIKeychain(ctx, connectCRI, cri.WithSnapshotterRoot(root),
+					cri.WithTenants(podTenants), cri.WithPullProgress(pullProgress))
 				// Create a gRPC server
 				rpc := grpc.NewServer()
 				runtime.RegisterImageServiceServer(rpc, criServer)
@@ -156,7 +172,9 @@ func init() {
 			// TODO(ktock): print warn if old configuration is specified.
 			// TODO(ktock): should we respect old configuration?
 			return service.NewSociSnapshotterService(ctx, root, &config.Config,
-				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)))
+				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)),
+				service.WithCredsFuncs(credsFuncs...),
+				service.WithFilesystemOptions(fsOpts...))
 		},
 	})
 }
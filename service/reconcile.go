@@ -0,0 +1,180 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	"github.com/moby/sys/mountinfo"
+	"github.com/opencontainers/go-digest"
+)
+
+// artifactsDBLockTimeout is how long reconciliation waits for the artifacts DB,
+// which is locked while the soci CLI uses it.
+const artifactsDBLockTimeout = 5 * time.Second
+
+// staleArtifactAge is how old an entry of the artifacts DB must be to be removed when
+// its artifact is missing, so that artifacts which the soci CLI is storing right now
+// are left alone.
+const staleArtifactAge = time.Hour
+
+// ReconcileReport is what the startup reconciliation fixed.
+type ReconcileReport struct {
+	// UnmountedMounts are the FUSE mounts of snapshots left by the previous run.
+	UnmountedMounts []string `json:"unmountedMounts,omitempty"`
+	// RemovedTempFiles are the caches and incomplete files left by the previous run.
+	RemovedTempFiles []string `json:"removedTempFiles,omitempty"`
+	// RemovedArtifacts are the digests of the entries of the artifacts DB which
+	// couldn't be loaded or whose artifacts are missing from the content store.
+	RemovedArtifacts []string `json:"removedArtifacts,omitempty"`
+	// Errors are the problems which couldn't be fixed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Fixed returns the number of problems which were fixed.
+func (r ReconcileReport) Fixed() int {
+	return len(r.UnmountedMounts) + len(r.RemovedTempFiles) + len(r.RemovedArtifacts)
+}
+
+// Reconcile repairs the state left by a previous run of the snapshotter which didn't
+// shut down cleanly, before the snapshotter is created: it unmounts the orphaned FUSE
+// mounts of snapshots, removes the caches and temporary files which are only used by a
+// running snapshotter, and removes the entries of the artifacts DB at artifactsDBPath
+// whose artifacts are missing from the content store at contentStorePath. Problems
+// which can't be fixed are recorded in the report and left to the snapshotter, which
+// handles them as before.
+func Reconcile(ctx context.Context, root string, cfg DirectoriesConfig, artifactsDBPath, contentStorePath string) ReconcileReport {
+	var report ReconcileReport
+	addErr := func(err error) {
+		log.G(ctx).WithError(err).Warn("failed to reconcile state of the previous run")
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	snapshotsDir := filepath.Join(cfg.snapshotterRoot(root), "snapshots")
+	unmounted, err := unmountOrphans(snapshotsDir)
+	report.UnmountedMounts = unmounted
+	if err != nil {
+		addErr(err)
+	}
+
+	removed, err := removeSnapshotTempDirs(snapshotsDir)
+	report.RemovedTempFiles = append(report.RemovedTempFiles, removed...)
+	if err != nil {
+		addErr(err)
+	}
+	removed, err = layer.RemoveStaleFiles(cfg.fsRoot(root))
+	report.RemovedTempFiles = append(report.RemovedTempFiles, removed...)
+	if err != nil {
+		addErr(fmt.Errorf("failed to remove stale caches: %w", err))
+	}
+
+	report.RemovedArtifacts, err = soci.RepairDB(artifactsDBPath, artifactsDBLockTimeout, func(ae *soci.ArtifactEntry) bool {
+		if time.Since(ae.CreatedAt) < staleArtifactAge {
+			return false
+		}
+		dgst, err := digest.Parse(ae.Digest)
+		if err != nil {
+			return true
+		}
+		_, err = os.Stat(filepath.Join(contentStorePath, "blobs", dgst.Algorithm().String(), dgst.Encoded()))
+		return os.IsNotExist(err)
+	})
+	if err != nil {
+		addErr(fmt.Errorf("failed to repair artifacts DB: %w", err))
+	}
+
+	for _, m := range report.UnmountedMounts {
+		log.G(ctx).WithField("mountpoint", m).Info("unmounted orphaned mount")
+	}
+	for _, p := range report.RemovedTempFiles {
+		log.G(ctx).WithField("path", p).Debug("removed stale file")
+	}
+	for _, d := range report.RemovedArtifacts {
+		log.G(ctx).WithField("digest", d).Info("removed inconsistent artifacts DB entry")
+	}
+	log.G(ctx).WithField("unmounted", len(report.UnmountedMounts)).
+		WithField("removedFiles", len(report.RemovedTempFiles)).
+		WithField("removedArtifacts", len(report.RemovedArtifacts)).
+		WithField("errors", len(report.Errors)).
+		Info("reconciled state of the previous run")
+	return report
+}
+
+// unmountOrphans unmounts the FUSE mounts under dir, deepest first. Their FUSE servers
+// died with the previous run, so they can only fail reads. Mounts which are busy are
+// lazily detached.
+func unmountOrphans(dir string) ([]string, error) {
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	var unmounted []string
+	var errs []string
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.FSType, "fuse") {
+			continue
+		}
+		err := syscall.Unmount(m.Mountpoint, syscall.MNT_FORCE)
+		if errors.Is(err, syscall.EBUSY) {
+			err = syscall.Unmount(m.Mountpoint, syscall.MNT_DETACH)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", m.Mountpoint, err))
+			continue
+		}
+		unmounted = append(unmounted, m.Mountpoint)
+	}
+	if len(errs) > 0 {
+		return unmounted, fmt.Errorf("failed to unmount %s", strings.Join(errs, "; "))
+	}
+	return unmounted, nil
+}
+
+// removeSnapshotTempDirs removes the temporary directories of snapshots which were
+// being prepared by the previous run.
+func removeSnapshotTempDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "new-") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if err := os.RemoveAll(p); err != nil {
+			return removed, err
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
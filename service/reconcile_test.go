@@ -0,0 +1,145 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestReconcile(t *testing.T) {
+	root := t.TempDir()
+	cfg := DirectoriesConfig{}
+	mkdir := func(p string) string {
+		t.Helper()
+		if err := os.MkdirAll(p, 0700); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	writeFile := func(p string) string {
+		t.Helper()
+		mkdir(filepath.Dir(p))
+		if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	snapshots := filepath.Join(cfg.snapshotterRoot(root), "snapshots")
+	fsRoot := cfg.fsRoot(root)
+	stale := []string{
+		mkdir(filepath.Join(snapshots, "new-123")),
+		mkdir(filepath.Join(fsRoot, "spancache", "ab", "abcdef-1")),
+		mkdir(filepath.Join(fsRoot, "httpcache", "ab", "abcdef-2")),
+		writeFile(filepath.Join(fsRoot, "chunkcache", "wip", "chunk-1")),
+		writeFile(filepath.Join(fsRoot, "spanseed", "sha256", "ab", "sha256", "cd", "wip-1")),
+	}
+	kept := []string{
+		mkdir(filepath.Join(snapshots, "1", "fs")),
+		writeFile(filepath.Join(fsRoot, "chunkcache", "ab", "abcdef")),
+		writeFile(filepath.Join(fsRoot, "spanseed", "sha256", "ab", "sha256", "cd", "0")),
+	}
+
+	contentStore := t.TempDir()
+	present := digest.FromString("present")
+	writeFile(filepath.Join(contentStore, "blobs", "sha256", present.Encoded()))
+	missing := digest.FromString("missing")
+	storing := digest.FromString("storing")
+	dbPath := filepath.Join(t.TempDir(), "artifacts.db")
+	writeArtifacts(t, dbPath, []soci.ArtifactEntry{
+		{Digest: present.String(), CreatedAt: time.Now().Add(-2 * staleArtifactAge)},
+		{Digest: missing.String(), CreatedAt: time.Now().Add(-2 * staleArtifactAge)},
+		{Digest: storing.String(), CreatedAt: time.Now()},
+	})
+
+	report := Reconcile(context.Background(), root, cfg, dbPath, contentStore)
+	if len(report.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", report.Errors)
+	}
+	sort.Strings(stale)
+	sort.Strings(report.RemovedTempFiles)
+	if len(report.RemovedTempFiles) != len(stale) {
+		t.Fatalf("unexpected removed files; expected %v, got %v", stale, report.RemovedTempFiles)
+	}
+	for i, p := range stale {
+		if report.RemovedTempFiles[i] != p {
+			t.Fatalf("unexpected removed files; expected %v, got %v", stale, report.RemovedTempFiles)
+		}
+		if exists(p) {
+			t.Fatalf("stale file %s isn't removed", p)
+		}
+	}
+	for _, p := range kept {
+		if !exists(p) {
+			t.Fatalf("%s is removed", p)
+		}
+	}
+	if len(report.RemovedArtifacts) != 1 || report.RemovedArtifacts[0] != missing.String() {
+		t.Fatalf("unexpected removed artifacts %v", report.RemovedArtifacts)
+	}
+	if report.Fixed() != len(stale)+1 {
+		t.Fatalf("unexpected number of fixes %d", report.Fixed())
+	}
+
+	// the state is consistent after reconciliation.
+	if report := Reconcile(context.Background(), root, cfg, dbPath, contentStore); report.Fixed() != 0 {
+		t.Fatalf("unexpected fixes after reconciliation: %+v", report)
+	}
+}
+
+func writeArtifacts(t *testing.T, path string, entries []soci.ArtifactEntry) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		artifacts, err := tx.CreateBucketIfNotExists([]byte("soci_artifacts"))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			b, err := artifacts.CreateBucket([]byte(e.Digest))
+			if err != nil {
+				return err
+			}
+			createdAt, err := e.CreatedAt.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("size"), []byte{0}); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("created_at"), createdAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNSConfig is config for resolving the addresses of registry hosts.
+type DNSConfig struct {
+	// CacheTTLSec is how long (in seconds) resolved addresses are cached.
+	// Without caching, every new connection to a registry (e.g. for a span
+	// fetch) resolves the registry host again.
+	// CacheTTLSec <= 0 disables caching.
+	CacheTTLSec int64 `toml:"cache_ttl_sec"`
+
+	// Hosts maps host names to static addresses which are used instead of
+	// resolving the host names with DNS (e.g. for split-horizon DNS).
+	Hosts map[string][]string `toml:"hosts"`
+}
+
+func (c DNSConfig) enabled() bool {
+	return c.CacheTTLSec > 0 || len(c.Hosts) > 0
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// dnsResolver dials registry hosts, resolving their addresses with the static
+// overrides and the DNS cache.
+type dnsResolver struct {
+	ttl       time.Duration
+	overrides map[string][]string
+	lookup    func(ctx context.Context, host string) ([]string, error)
+	dialer    *net.Dialer
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+func newDNSResolver(cfg DNSConfig) *dnsResolver {
+	return &dnsResolver{
+		ttl:       time.Duration(cfg.CacheTTLSec) * time.Second,
+		overrides: cfg.Hosts,
+		lookup:    net.DefaultResolver.LookupHost,
+		// Same as the default dialer of http.Transport
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		cache: make(map[string]dnsEntry),
+	}
+}
+
+// lookupHost returns the addresses of host.
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.overrides[host]; ok {
+		return addrs, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if r.ttl <= 0 {
+		return r.lookup(ctx, host)
+	}
+
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	// Failed lookups aren't cached so that they are retried on the next dial.
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext dials addr, trying each of the addresses of its host until one succeeds.
+func (r *dnsResolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.dialContextWith(r.dialer)(ctx, network, addr)
+}
+
+// dialContextWith returns a DialContext that dials the addresses of hosts with dialer.
+func (r *dnsResolver) dialContextWith(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return r.dial(ctx, dialer, network, addr)
+	}
+}
+
+func (r *dnsResolver) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for host %q", host)
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSResolverLookupHost(t *testing.T) {
+	testCases := []struct {
+		name            string
+		cfg             DNSConfig
+		host            string
+		lookupErr       error
+		expectedAddrs   []string
+		expectedLookups int
+	}{
+		{
+			name:            "cache disabled",
+			host:            "registry.example.com",
+			expectedAddrs:   []string{"192.0.2.1"},
+			expectedLookups: 3,
+		},
+		{
+			name:            "cache enabled",
+			cfg:             DNSConfig{CacheTTLSec: 60},
+			host:            "registry.example.com",
+			expectedAddrs:   []string{"192.0.2.1"},
+			expectedLookups: 1,
+		},
+		{
+			name:            "failed lookups are not cached",
+			cfg:             DNSConfig{CacheTTLSec: 60},
+			host:            "registry.example.com",
+			lookupErr:       errors.New("lookup failed"),
+			expectedLookups: 3,
+		},
+		{
+			name: "static override",
+			cfg: DNSConfig{Hosts: map[string][]string{
+				"registry.example.com": {"10.0.0.1", "10.0.0.2"},
+			}},
+			host:          "registry.example.com",
+			expectedAddrs: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:          "ip address",
+			cfg:           DNSConfig{CacheTTLSec: 60},
+			host:          "192.0.2.10",
+			expectedAddrs: []string{"192.0.2.10"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newDNSResolver(tc.cfg)
+			lookups := 0
+			r.lookup = func(ctx context.Context, host string) ([]string, error) {
+				lookups++
+				if tc.lookupErr != nil {
+					return nil, tc.lookupErr
+				}
+				return []string{"192.0.2.1"}, nil
+			}
+			for i := 0; i < 3; i++ {
+				addrs, err := r.lookupHost(context.Background(), tc.host)
+				if !errors.Is(err, tc.lookupErr) {
+					t.Fatalf("expected error %v, got %v", tc.lookupErr, err)
+				}
+				if !reflect.DeepEqual(addrs, tc.expectedAddrs) {
+					t.Fatalf("expected %v, got %v", tc.expectedAddrs, addrs)
+				}
+			}
+			if lookups != tc.expectedLookups {
+				t.Fatalf("expected %d lookups, got %d", tc.expectedLookups, lookups)
+			}
+		})
+	}
+}
+
+func TestDNSResolverCacheExpiry(t *testing.T) {
+	r := newDNSResolver(DNSConfig{CacheTTLSec: 60})
+	lookups := 0
+	r.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"192.0.2.1"}, nil
+	}
+	if _, err := r.lookupHost(context.Background(), "registry.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	r.cache["registry.example.com"] = dnsEntry{
+		addrs:   []string{"192.0.2.1"},
+		expires: time.Now().Add(-time.Second),
+	}
+	if _, err := r.lookupHost(context.Background(), "registry.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 2 {
+		t.Fatalf("expected expired entry to be resolved again; got %d lookups", lookups)
+	}
+}
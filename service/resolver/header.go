@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// requestHeader returns the header fields set on the requests of a registry host.
+// userAgent is overridden by a User-Agent field in headers, and the fields of later
+// headers override the fields of earlier ones.
+func requestHeader(userAgent string, headers ...map[string]string) http.Header {
+	h := make(http.Header)
+	if userAgent != "" {
+		h.Set("User-Agent", userAgent)
+	}
+	for _, hs := range headers {
+		for k, v := range hs {
+			h.Set(k, v)
+		}
+	}
+	return h
+}
+
+func validateHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool { return !isTokenRune(r) }) >= 0 {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n\x00") {
+			return fmt.Errorf("invalid value of header %q", k)
+		}
+	}
+	return nil
+}
+
+// isTokenRune returns whether r may be used in a header name (RFC 7230, section 3.2.6).
+func isTokenRune(r rune) bool {
+	if r >= 0x7f || r <= ' ' {
+		return false
+	}
+	return !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
+
+// headerTransport sets header fields on all requests sent through a registry host's
+// client, including the requests for tokens and the requests redirected to other hosts
+// (e.g. a CDN serving the blobs). The fields replace those set by the caller, e.g. the
+// User-Agent of containerd's resolver.
+type headerTransport struct {
+	rt     http.RoundTripper
+	header http.Header
+}
+
+func newHeaderTransport(rt http.RoundTripper, header http.Header) http.RoundTripper {
+	if len(header) == 0 {
+		return rt
+	}
+	return &headerTransport{rt: rt, header: header}
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	return t.rt.RoundTrip(req)
+}
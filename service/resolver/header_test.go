@@ -0,0 +1,124 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestHeader(t *testing.T) {
+	h := requestHeader("soci/1.0",
+		map[string]string{"X-Trace": "default", "x-gateway-token": "default"},
+		map[string]string{"X-Gateway-Token": "host", "user-agent": "host-agent"})
+	expected := map[string]string{
+		"User-Agent":      "host-agent",
+		"X-Trace":         "default",
+		"X-Gateway-Token": "host",
+	}
+	if len(h) != len(expected) {
+		t.Fatalf("unexpected header %v", h)
+	}
+	for k, v := range expected {
+		if got := h.Values(k); len(got) != 1 || got[0] != v {
+			t.Fatalf("unexpected values of %s: expected %q, got %q", k, v, got)
+		}
+	}
+	if h := requestHeader(""); len(h) != 0 {
+		t.Fatalf("expected no header, got %v", h)
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		expectErr bool
+	}{
+		{
+			name:    "valid",
+			headers: map[string]string{"X-Trace-Id": "abc", "Authorization": "Bearer token"},
+		},
+		{
+			name:      "empty name",
+			headers:   map[string]string{"": "abc"},
+			expectErr: true,
+		},
+		{
+			name:      "name with colon",
+			headers:   map[string]string{"X-Trace:": "abc"},
+			expectErr: true,
+		},
+		{
+			name:      "name with space",
+			headers:   map[string]string{"X Trace": "abc"},
+			expectErr: true,
+		},
+		{
+			name:      "value with newline",
+			headers:   map[string]string{"X-Trace": "abc\r\nX-Injected: 1"},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHeaders(tt.headers)
+			if tt.expectErr && err == nil {
+				t.Fatal("expected error")
+			} else if !tt.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: newHeaderTransport(http.DefaultTransport, requestHeader("soci/1.0", map[string]string{"X-Trace": "abc"})),
+	}
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "containerd/1.6")
+	req.Header.Set("Range", "bytes=0-1")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	res.Body.Close()
+
+	if ua := got.Get("User-Agent"); ua != "soci/1.0" {
+		t.Fatalf("expected the configured User-Agent, got %q", ua)
+	}
+	if v := got.Get("X-Trace"); v != "abc" {
+		t.Fatalf("expected the configured header, got %q", v)
+	}
+	if v := got.Get("Range"); v != "bytes=0-1" {
+		t.Fatalf("expected the headers of the request to be kept, got %q", v)
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "containerd/1.6" {
+		t.Fatalf("expected the request not to be modified, got User-Agent %q", ua)
+	}
+}
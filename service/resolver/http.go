@@ -0,0 +1,207 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// HTTPProtocolAuto negotiates HTTP/2 with registries that support it.
+	HTTPProtocolAuto = ""
+	// HTTPProtocolHTTP2 attempts HTTP/2 even with a custom dialer or TLS config,
+	// which disable it by default.
+	HTTPProtocolHTTP2 = "http2"
+	// HTTPProtocolHTTP1 only uses HTTP/1.1.
+	HTTPProtocolHTTP1 = "http1.1"
+)
+
+// HTTPConfig is config for the HTTP clients of registry hosts. Zero values keep the defaults
+// of the HTTP client. Connections are pooled per registry host, so that span fetches of
+// different layers reuse them. Background fetches have a pool of their own with the same
+// config, so that they don't queue ahead of reads of files.
+type HTTPConfig struct {
+	// MaxIdleConns is the maximum number of idle connections to the host.
+	MaxIdleConns int `toml:"max_idle_conns"`
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections to each address
+	// the host redirects to (e.g. the host itself or a CDN serving its blobs).
+	MaxIdleConnsPerHost int `toml:"max_idle_conns_per_host"`
+
+	// MaxConnsPerHost limits the number of connections to each address, including
+	// connections in use. Requests wait for a connection once it's reached.
+	MaxConnsPerHost int `toml:"max_conns_per_host"`
+
+	// IdleConnTimeoutSec is how long (in seconds) idle connections are kept open.
+	IdleConnTimeoutSec int64 `toml:"idle_conn_timeout_sec"`
+
+	// Protocol is the HTTP protocol used with the host: "http2", "http1.1",
+	// or empty to negotiate it.
+	Protocol string `toml:"protocol"`
+
+	// TCPKeepAliveSec is the interval (in seconds) of TCP keep-alive probes.
+	// A negative value disables them.
+	TCPKeepAliveSec int64 `toml:"tcp_keepalive_sec"`
+}
+
+// merge returns c with the zero values replaced by the values of defaults.
+func (c HTTPConfig) merge(defaults HTTPConfig) HTTPConfig {
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = defaults.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost == 0 {
+		c.MaxIdleConnsPerHost = defaults.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost == 0 {
+		c.MaxConnsPerHost = defaults.MaxConnsPerHost
+	}
+	if c.IdleConnTimeoutSec == 0 {
+		c.IdleConnTimeoutSec = defaults.IdleConnTimeoutSec
+	}
+	if c.Protocol == HTTPProtocolAuto {
+		c.Protocol = defaults.Protocol
+	}
+	if c.TCPKeepAliveSec == 0 {
+		c.TCPKeepAliveSec = defaults.TCPKeepAliveSec
+	}
+	return c
+}
+
+func (c HTTPConfig) validate() error {
+	switch c.Protocol {
+	case HTTPProtocolAuto, HTTPProtocolHTTP2, HTTPProtocolHTTP1:
+	default:
+		return fmt.Errorf("unknown HTTP protocol %q", c.Protocol)
+	}
+	return nil
+}
+
+// transportCache keeps a transport per registry host, so that the connections
+// to the host are pooled across the clients created for each layer.
+type transportCache struct {
+	dns *dnsResolver
+
+	mu         sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+type transportKey struct {
+	host       string
+	background bool
+}
+
+func newTransportCache(dns *dnsResolver) *transportCache {
+	return &transportCache{
+		dns:        dns,
+		transports: make(map[transportKey]*http.Transport),
+	}
+}
+
+// get returns the transport of host, creating it with cfg the first time.
+func (c *transportCache) get(host string, cfg HTTPConfig) (*http.Transport, error) {
+	return c.getPool(transportKey{host: host}, cfg)
+}
+
+// getPriority returns a transport of host which sends the requests of background
+// fetches over their own connections, creating them with cfg the first time.
+func (c *transportCache) getPriority(host string, cfg HTTPConfig) (http.RoundTripper, error) {
+	foreground, err := c.get(host, cfg)
+	if err != nil {
+		return nil, err
+	}
+	background, err := c.getPool(transportKey{host: host, background: true}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &priorityTransport{foreground: foreground, background: background}, nil
+}
+
+func (c *transportCache) getPool(key transportKey, cfg HTTPConfig) (*http.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tr, ok := c.transports[key]; ok {
+		return tr, nil
+	}
+	tr, err := newTransport(cfg, c.dns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP config of host %q: %w", key.host, err)
+	}
+	c.transports[key] = tr
+	return tr, nil
+}
+
+// priorityTransport sends the requests of background fetches with the background
+// transport, and all other requests (e.g. the reads of files) with the foreground one.
+type priorityTransport struct {
+	foreground http.RoundTripper
+	background http.RoundTripper
+}
+
+func (t *priorityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if source.IsBackgroundFetch(req.Context()) {
+		return t.background.RoundTrip(req)
+	}
+	return t.foreground.RoundTrip(req)
+}
+
+func newTransport(cfg HTTPConfig, dns *dnsResolver) (*http.Transport, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	tr := cleanhttp.DefaultPooledTransport()
+	// Same as the dialer of cleanhttp's transport
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if cfg.TCPKeepAliveSec != 0 {
+		dialer.KeepAlive = time.Duration(cfg.TCPKeepAliveSec) * time.Second
+	}
+	tr.DialContext = dialer.DialContext
+	if dns != nil {
+		tr.DialContext = dns.dialContextWith(dialer)
+	}
+	if cfg.MaxIdleConns != 0 {
+		tr.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost != 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxConnsPerHost != 0 {
+		tr.MaxConnsPerHost = cfg.MaxConnsPerHost
+	}
+	if cfg.IdleConnTimeoutSec != 0 {
+		tr.IdleConnTimeout = time.Duration(cfg.IdleConnTimeoutSec) * time.Second
+	}
+	switch cfg.Protocol {
+	case HTTPProtocolHTTP2:
+		tr.ForceAttemptHTTP2 = true
+	case HTTPProtocolHTTP1:
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	}
+	return tr, nil
+}
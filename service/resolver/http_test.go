@@ -0,0 +1,162 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/source"
+)
+
+func TestNewTransport(t *testing.T) {
+	defaults := HTTPConfig{
+		MaxIdleConns:       200,
+		IdleConnTimeoutSec: 30,
+	}
+	tests := []struct {
+		name      string
+		cfg       HTTPConfig
+		check     func(t *testing.T, cfg HTTPConfig)
+		expectErr bool
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg HTTPConfig) {
+				tr, _ := newTransport(cfg, nil)
+				if tr.MaxIdleConns != 200 || tr.IdleConnTimeout != 30*time.Second {
+					t.Fatalf("expected defaults to be applied, got MaxIdleConns=%d IdleConnTimeout=%v", tr.MaxIdleConns, tr.IdleConnTimeout)
+				}
+				if !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+					t.Fatal("expected HTTP/2 to be negotiated")
+				}
+			},
+		},
+		{
+			name: "overrides",
+			cfg: HTTPConfig{
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 5,
+				MaxConnsPerHost:     20,
+			},
+			check: func(t *testing.T, cfg HTTPConfig) {
+				tr, _ := newTransport(cfg, nil)
+				if tr.MaxIdleConns != 10 || tr.MaxIdleConnsPerHost != 5 || tr.MaxConnsPerHost != 20 {
+					t.Fatalf("unexpected connection limits %d/%d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+				}
+				if tr.IdleConnTimeout != 30*time.Second {
+					t.Fatalf("expected default idle timeout, got %v", tr.IdleConnTimeout)
+				}
+			},
+		},
+		{
+			name: "http1.1",
+			cfg:  HTTPConfig{Protocol: HTTPProtocolHTTP1},
+			check: func(t *testing.T, cfg HTTPConfig) {
+				tr, _ := newTransport(cfg, nil)
+				if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil || len(tr.TLSNextProto) != 0 {
+					t.Fatal("expected HTTP/2 to be disabled")
+				}
+			},
+		},
+		{
+			name:      "unknown protocol",
+			cfg:       HTTPConfig{Protocol: "spdy"},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg.merge(defaults)
+			_, err := newTransport(cfg, nil)
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create transport: %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	c := newTransportCache(nil)
+	tr1, err := c.get("registry.example.com", HTTPConfig{})
+	if err != nil {
+		t.Fatalf("failed to get transport: %v", err)
+	}
+	tr2, err := c.get("registry.example.com", HTTPConfig{MaxIdleConns: 1})
+	if err != nil {
+		t.Fatalf("failed to get transport: %v", err)
+	}
+	if tr1 != tr2 {
+		t.Fatal("expected the transport of a host to be reused")
+	}
+	tr3, err := c.get("mirror.example.com", HTTPConfig{})
+	if err != nil {
+		t.Fatalf("failed to get transport: %v", err)
+	}
+	if tr1 == tr3 {
+		t.Fatal("expected hosts to have their own transports")
+	}
+	bg, err := c.getPool(transportKey{host: "registry.example.com", background: true}, HTTPConfig{})
+	if err != nil {
+		t.Fatalf("failed to get transport: %v", err)
+	}
+	if tr1 == bg {
+		t.Fatal("expected background fetches to have their own transport")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestPriorityTransport(t *testing.T) {
+	var got string
+	pool := func(name string) http.RoundTripper {
+		return roundTripFunc(func(*http.Request) (*http.Response, error) {
+			got = name
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+	}
+	tr := &priorityTransport{foreground: pool("foreground"), background: pool("background")}
+	for _, tt := range []struct {
+		ctx      context.Context
+		expected string
+	}{
+		{context.Background(), "foreground"},
+		{source.WithBackgroundFetch(context.Background()), "background"},
+	} {
+		req, err := http.NewRequestWithContext(tt.ctx, http.MethodGet, "https://registry.example.com/v2/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tt.expected {
+			t.Fatalf("expected the request to be sent with the %s transport, got %s", tt.expected, got)
+		}
+	}
+}
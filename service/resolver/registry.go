@@ -33,9 +33,11 @@
 package resolver
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/util/httputil"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	rhttp "github.com/hashicorp/go-retryablehttp"
@@ -46,10 +48,69 @@ const defaultRequestTimeoutSec int64 = 30
 // Config is config for resolving registries.
 type Config struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// DNS is config for resolving the addresses of registry hosts.
+	DNS DNSConfig `toml:"dns"`
+
+	// HTTP is the default config of the HTTP clients of registry hosts.
+	HTTP HTTPConfig `toml:"http"`
+
+	// UserAgent replaces the User-Agent of the requests to registry hosts.
+	UserAgent string `toml:"user_agent"`
+
+	// Headers are header fields set on the requests to all registry hosts, e.g. tracing
+	// headers or tokens of gateways which route on headers.
+	Headers map[string]string `toml:"headers"`
+
+	// TokenCache persists the bearer tokens of registries across restarts.
+	TokenCache TokenCacheConfig `toml:"token_cache"`
+}
+
+// Validate checks the HTTP config of the hosts and mirrors.
+func (c Config) Validate() error {
+	if err := c.HTTP.validate(); err != nil {
+		return fmt.Errorf("resolver.http: %w", err)
+	}
+	if err := validateHeaders(map[string]string{"User-Agent": c.UserAgent}); err != nil {
+		return fmt.Errorf("resolver.user_agent: %w", err)
+	}
+	if err := validateHeaders(c.Headers); err != nil {
+		return fmt.Errorf("resolver.headers: %w", err)
+	}
+	if c.TokenCache.KeyFile != "" && len(c.TokenCache.KeyCommand) > 0 {
+		return fmt.Errorf("resolver.token_cache: key_file and key_command are exclusive")
+	}
+	for name, h := range c.Host {
+		if err := h.HTTP.validate(); err != nil {
+			return fmt.Errorf("resolver.host.%q.http: %w", name, err)
+		}
+		if err := validateHeaders(h.Headers); err != nil {
+			return fmt.Errorf("resolver.host.%q.headers: %w", name, err)
+		}
+		for _, m := range h.Mirrors {
+			if m.Host == "" {
+				return fmt.Errorf("resolver.host.%q: mirror host must not be empty", name)
+			}
+			if err := m.HTTP.validate(); err != nil {
+				return fmt.Errorf("resolver.host.%q.mirrors.%q.http: %w", name, m.Host, err)
+			}
+			if err := validateHeaders(m.Headers); err != nil {
+				return fmt.Errorf("resolver.host.%q.mirrors.%q.headers: %w", name, m.Host, err)
+			}
+		}
+	}
+	return nil
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// HTTP overrides the default HTTP config for the registry host.
+	HTTP HTTPConfig `toml:"http"`
+
+	// Headers are header fields set on the requests to the registry host, in addition
+	// to the default headers. They aren't set on the requests to its mirrors.
+	Headers map[string]string `toml:"headers"`
 }
 
 type MirrorConfig struct {
@@ -64,19 +125,44 @@ type MirrorConfig struct {
 	// RequestTimeoutSec == 0 indicates the default timeout (defaultRequestTimeoutSec).
 	// RequestTimeoutSec < 0 indicates no timeout.
 	RequestTimeoutSec int64 `toml:"request_timeout_sec"`
+
+	// HTTP overrides the default HTTP config for the mirror.
+	HTTP HTTPConfig `toml:"http"`
+
+	// Headers are header fields set on the requests to the mirror, in addition to the
+	// default headers.
+	Headers map[string]string `toml:"headers"`
 }
 
 type Credential func(string, reference.Spec) (string, string, error)
 
 // RegistryHostsFromConfig creates RegistryHosts (a set of registry configuration) from Config.
 func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.RegistryHosts {
+	return RegistryHostsFromConfigWithTokenCache(cfg, nil, credsFuncs...)
+}
+
+// RegistryHostsFromConfigWithTokenCache is RegistryHostsFromConfig with the bearer
+// tokens of the registry hosts kept in tokens, if it isn't nil.
+func RegistryHostsFromConfigWithTokenCache(cfg Config, tokens *TokenCache, credsFuncs ...Credential) source.RegistryHosts {
+	var dns *dnsResolver
+	if cfg.DNS.enabled() {
+		dns = newDNSResolver(cfg.DNS)
+	}
+	transports := newTransportCache(dns)
 	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
 		host := ref.Hostname()
 		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
-			Host: host,
+			Host:    host,
+			HTTP:    cfg.Host[host].HTTP,
+			Headers: cfg.Host[host].Headers,
 		}) {
+			httpTr, err := transports.getPriority(h.Host, h.HTTP.merge(cfg.HTTP))
+			if err != nil {
+				return nil, err
+			}
 			client := rhttp.NewClient()
 			client.Logger = nil // disable logging every request
+			client.HTTPClient.Transport = newHeaderTransport(httputil.NewMetadataEncodingTransport(httpTr), requestHeader(cfg.UserAgent, cfg.Headers, h.Headers))
 			tr := client.StandardClient()
 			if h.RequestTimeoutSec >= 0 {
 				if h.RequestTimeoutSec == 0 {
@@ -85,6 +171,12 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 					tr.Timeout = time.Duration(h.RequestTimeoutSec) * time.Second
 				}
 			} // h.RequestTimeoutSec < 0 means "no timeout"
+			authClient := tr
+			if tokens != nil {
+				c := *tr
+				c.Transport = tokens.transport(tr.Transport)
+				authClient = &c
+			}
 			config := docker.RegistryHost{
 				Client:       tr,
 				Host:         h.Host,
@@ -92,7 +184,7 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 				Path:         "/v2",
 				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
 				Authorizer: docker.NewDockerAuthorizer(
-					docker.WithAuthClient(tr),
+					docker.WithAuthClient(authClient),
 					docker.WithAuthCreds(multiCredsFuncs(ref, credsFuncs...))),
 			}
 			if localhost, _ := docker.MatchLocalhost(config.Host); localhost || h.Insecure {
@@ -108,7 +200,15 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 }
 
 func multiCredsFuncs(ref reference.Spec, credsFuncs ...Credential) func(string) (string, string, error) {
+	f := MultiCredential(credsFuncs...)
 	return func(host string) (string, string, error) {
+		return f(host, ref)
+	}
+}
+
+// MultiCredential returns a Credential which returns the first credentials found by credsFuncs.
+func MultiCredential(credsFuncs ...Credential) Credential {
+	return func(host string, ref reference.Spec) (string, string, error) {
 		for _, f := range credsFuncs {
 			if username, secret, err := f(host, ref); err != nil {
 				return "", "", err
@@ -0,0 +1,305 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/containerd/containerd/log"
+)
+
+const (
+	// tokenCacheID authenticates the encrypted contents of the token cache.
+	tokenCacheID = "registry-tokens"
+
+	// defaultTokenExpiresIn is the lifetime of tokens whose responses have no
+	// expires_in, as specified by the token authentication of the distribution spec.
+	defaultTokenExpiresIn = 60 * time.Second
+
+	// minTokenValidity is how long a cached token must still be valid to be reused, so
+	// that it doesn't expire while the requests authorized with it are sent.
+	minTokenValidity = 10 * time.Second
+)
+
+// TokenCacheConfig is config for persisting the bearer tokens of registries, so that
+// they are reused after a restart instead of being requested again for every layer.
+type TokenCacheConfig struct {
+	// Enable persists the tokens encrypted with AES-256-GCM.
+	Enable bool `toml:"enable"`
+
+	// KeyFile is the path of the file of the 32 byte key, which is raw or hex or
+	// base64 encoded. If neither KeyFile nor KeyCommand is set, the key of
+	// cache_encryption is used.
+	KeyFile string `toml:"key_file"`
+
+	// KeyCommand is a command which prints the key in the same formats as KeyFile.
+	// It's used instead of KeyFile.
+	KeyCommand []string `toml:"key_command"`
+}
+
+// cachedToken is a token and when it expires.
+type cachedToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// TokenCache keeps the bearer tokens fetched by the authorizers of registry hosts and
+// persists them encrypted, so that they are shared by the layers of an image and
+// reused after a restart. Tokens are keyed by the digest of their request, including
+// its scopes and credentials, so they are only reused by the same requests. Refresh
+// tokens aren't kept.
+type TokenCache struct {
+	path   string
+	cipher *cache.Cipher
+
+	mu       sync.Mutex
+	tokens   map[string]cachedToken
+	inflight map[string]chan struct{}
+
+	// writeMu serializes the writes of the file.
+	writeMu sync.Mutex
+}
+
+// NewTokenCache returns a token cache persisted to path, with the unexpired tokens
+// of the file if it exists. The tokens of a file which can't be decrypted, e.g.
+// because the key was rotated, are dropped.
+func NewTokenCache(path string, cipher *cache.Cipher) (*TokenCache, error) {
+	c := &TokenCache{
+		path:     path,
+		cipher:   cipher,
+		tokens:   make(map[string]cachedToken),
+		inflight: make(map[string]chan struct{}),
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read token cache: %w", err)
+	}
+	plaintext, err := cipher.Decrypt(b, tokenCacheID)
+	if err != nil {
+		log.L.WithError(err).Warnf("dropping the token cache %s", path)
+		return c, nil
+	}
+	var tokens map[string]cachedToken
+	if err := json.Unmarshal(plaintext, &tokens); err != nil {
+		log.L.WithError(err).Warnf("dropping the token cache %s", path)
+		return c, nil
+	}
+	now := time.Now()
+	for k, t := range tokens {
+		if t.ExpiresAt.After(now) {
+			c.tokens[k] = t
+		}
+	}
+	return c, nil
+}
+
+// transport returns a transport for the token requests of authorizers, which
+// responds to requests with a cached token and caches the tokens of responses.
+// Concurrent requests of the same token wait for the first one.
+func (c *TokenCache) transport(rt http.RoundTripper) http.RoundTripper {
+	return &tokenCacheTransport{c: c, rt: rt}
+}
+
+type tokenCacheTransport struct {
+	c  *TokenCache
+	rt http.RoundTripper
+}
+
+func (t *tokenCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, req, err := tokenRequestKey(req)
+	if err != nil {
+		return nil, err
+	}
+	c := t.c
+	for {
+		c.mu.Lock()
+		if tok, ok := c.tokens[key]; ok && time.Until(tok.ExpiresAt) > minTokenValidity {
+			c.mu.Unlock()
+			return tok.response(req), nil
+		}
+		done, ok := c.inflight[key]
+		if !ok {
+			done = make(chan struct{})
+			c.inflight[key] = done
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	defer func() {
+		c.mu.Lock()
+		close(c.inflight[key])
+		delete(c.inflight, key)
+		c.mu.Unlock()
+	}()
+
+	res, err := t.rt.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(b))
+	if tok, ok := parseTokenResponse(b, time.Now()); ok {
+		c.add(key, tok)
+	}
+	return res, nil
+}
+
+// add caches tok and writes the cache.
+func (c *TokenCache) add(key string, tok cachedToken) {
+	c.mu.Lock()
+	c.tokens[key] = tok
+	now := time.Now()
+	for k, t := range c.tokens {
+		if !t.ExpiresAt.After(now) {
+			delete(c.tokens, k)
+		}
+	}
+	b, err := json.Marshal(c.tokens)
+	c.mu.Unlock()
+	if err == nil {
+		err = c.write(b)
+	}
+	if err != nil {
+		log.L.WithError(err).Warnf("failed to write the token cache %s", c.path)
+	}
+}
+
+// write replaces the file of the cache with the encrypted plaintext atomically.
+func (c *TokenCache) write(plaintext []byte) (retErr error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	b, err := c.cipher.Encrypt(plaintext, tokenCacheID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), ".tmp-tokens-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// tokenRequestKey returns the key of the token of req, which is the digest of its
+// method, URL (with the service and scopes), Authorization header and body (e.g. the
+// credentials of OAuth requests), and a request whose body can be read again.
+func tokenRequestKey(req *http.Request) (string, *http.Request, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", req.Method, req.URL.String(), req.Header.Get("Authorization"))
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), req, nil
+}
+
+// parseTokenResponse returns the token of the body b of a token response received at
+// now. It expires after expires_in, counted from now rather than issued_at so that
+// the clock of the token server doesn't matter.
+func parseTokenResponse(b []byte, now time.Time) (cachedToken, bool) {
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &tr); err != nil {
+		return cachedToken{}, false
+	}
+	tok := cachedToken{Token: tr.AccessToken}
+	if tr.Token != "" {
+		tok.Token = tr.Token
+	}
+	if tok.Token == "" {
+		return cachedToken{}, false
+	}
+	expiresIn := defaultTokenExpiresIn
+	if tr.ExpiresIn > 0 {
+		expiresIn = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	tok.ExpiresAt = now.Add(expiresIn)
+	return tok, true
+}
+
+// response returns a token response to req with the remaining lifetime of t.
+func (t cachedToken) response(req *http.Request) *http.Response {
+	now := time.Now()
+	b, _ := json.Marshal(map[string]interface{}{
+		"token":        t.Token,
+		"access_token": t.Token,
+		"expires_in":   int(t.ExpiresAt.Sub(now) / time.Second),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{strconv.Itoa(len(b))}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+)
+
+func newTestCipher(t *testing.T) *cache.Cipher {
+	c, err := cache.NewCipher(bytes.Repeat([]byte{1}, cache.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTokenServer returns a token server which issues a new token for every request.
+func newTokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		// let concurrent requests pile up
+		time.Sleep(10 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":         fmt.Sprintf("token-%d", n),
+			"expires_in":    expiresIn,
+			"refresh_token": "refresh",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func fetchToken(client *http.Client, url, auth string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var tr struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+	return tr.Token, nil
+}
+
+func mustFetchToken(t *testing.T, client *http.Client, url, auth string) string {
+	tok, err := fetchToken(client, url, auth)
+	if err != nil {
+		t.Fatalf("failed to fetch token: %v", err)
+	}
+	return tok
+}
+
+func TestTokenCache(t *testing.T) {
+	srv, requests := newTokenServer(t, 300)
+	path := filepath.Join(t.TempDir(), "tokens")
+	tokens, err := NewTokenCache(path, newTestCipher(t))
+	if err != nil {
+		t.Fatalf("failed to create token cache: %v", err)
+	}
+	client := &http.Client{Transport: tokens.transport(http.DefaultTransport)}
+	url := srv.URL + "/token?service=registry&scope=repository:foo:pull"
+
+	var wg sync.WaitGroup
+	got := make([]string, 20)
+	errs := make([]error, len(got))
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], errs[i] = fetchToken(client, url, "")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("failed to fetch token: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Fatalf("expected concurrent requests to share a token request, got %d requests", n)
+	}
+	for _, tok := range got {
+		if tok != "token-1" {
+			t.Fatalf("expected the cached token, got %q", tok)
+		}
+	}
+
+	// other scopes and credentials get their own tokens
+	if tok := mustFetchToken(t, client, srv.URL+"/token?service=registry&scope=repository:bar:pull", ""); tok != "token-2" {
+		t.Fatalf("expected a new token for another scope, got %q", tok)
+	}
+	if tok := mustFetchToken(t, client, url, "Basic dXNlcjpwYXNz"); tok != "token-3" {
+		t.Fatalf("expected a new token for other credentials, got %q", tok)
+	}
+
+	// the tokens are encrypted, without refresh tokens
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read token cache: %v", err)
+	}
+	if bytes.Contains(b, []byte("token-1")) || bytes.Contains(b, []byte("refresh")) {
+		t.Fatal("expected the token cache to be encrypted")
+	}
+
+	// a restarted daemon reuses the tokens
+	tokens, err = NewTokenCache(path, newTestCipher(t))
+	if err != nil {
+		t.Fatalf("failed to load token cache: %v", err)
+	}
+	client = &http.Client{Transport: tokens.transport(http.DefaultTransport)}
+	if tok := mustFetchToken(t, client, url, ""); tok != "token-1" {
+		t.Fatalf("expected the persisted token, got %q", tok)
+	}
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Fatalf("expected no token request after the restart, got %d requests", n)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	// tokens which expire within minTokenValidity aren't reused
+	srv, requests := newTokenServer(t, 5)
+	tokens, err := NewTokenCache(filepath.Join(t.TempDir(), "tokens"), newTestCipher(t))
+	if err != nil {
+		t.Fatalf("failed to create token cache: %v", err)
+	}
+	client := &http.Client{Transport: tokens.transport(http.DefaultTransport)}
+	mustFetchToken(t, client, srv.URL, "")
+	if tok := mustFetchToken(t, client, srv.URL, ""); tok != "token-2" {
+		t.Fatalf("expected a new token, got %q", tok)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 token requests, got %d", n)
+	}
+}
+
+func TestTokenCacheWithAnotherKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	tokens, err := NewTokenCache(path, newTestCipher(t))
+	if err != nil {
+		t.Fatalf("failed to create token cache: %v", err)
+	}
+	tokens.add("key", cachedToken{Token: "token", ExpiresAt: time.Now().Add(time.Hour)})
+
+	other, err := cache.NewCipher(bytes.Repeat([]byte{2}, cache.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = NewTokenCache(path, other)
+	if err != nil {
+		t.Fatalf("expected the tokens to be dropped, got %v", err)
+	}
+	if len(tokens.tokens) != 0 {
+		t.Fatalf("expected no tokens, got %d", len(tokens.tokens))
+	}
+}
+
+func TestTokenCachePostBody(t *testing.T) {
+	srv, requests := newTokenServer(t, 300)
+	tokens, err := NewTokenCache(filepath.Join(t.TempDir(), "tokens"), newTestCipher(t))
+	if err != nil {
+		t.Fatalf("failed to create token cache: %v", err)
+	}
+	client := &http.Client{Transport: tokens.transport(http.DefaultTransport)}
+	post := func(body string) string {
+		res, err := client.Post(srv.URL, "application/x-www-form-urlencoded", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("failed to fetch token: %v", err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		tok, _ := parseTokenResponse(b, time.Now())
+		return tok.Token
+	}
+	post("grant_type=password&password=a")
+	post("grant_type=password&password=a")
+	if tok := post("grant_type=password&password=b"); tok != "token-2" {
+		t.Fatalf("expected a new token for other credentials, got %q", tok)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Fatalf("expected 2 token requests, got %d", n)
+	}
+}
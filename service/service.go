@@ -34,8 +34,10 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 
+	"github.com/awslabs/soci-snapshotter/cache"
 	socifs "github.com/awslabs/soci-snapshotter/fs"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/awslabs/soci-snapshotter/fs/source"
@@ -46,6 +48,9 @@ import (
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 )
 
+// tokenCacheFileName is the name of the file of the token cache in the root directory.
+const tokenCacheFileName = "registry-tokens"
+
 type Option func(*options)
 
 type options struct {
@@ -84,10 +89,14 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 
 	hosts := sOpts.registryHosts
 	if hosts == nil {
+		tokens, err := newTokenCache(root, config)
+		if err != nil {
+			return nil, err
+		}
 		// Use RegistryHosts based on ResolverConfig and keychain
-		hosts = resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+		hosts = resolver.RegistryHostsFromConfigWithTokenCache(resolver.Config(config.ResolverConfig), tokens, sOpts.credsFuncs...)
 	}
-	userxattr, err := overlayutils.NeedsUserXAttr(snapshotterRoot(root))
+	userxattr, err := overlayutils.NeedsUserXAttr(config.DirectoriesConfig.snapshotterRoot(root))
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
 	}
@@ -96,10 +105,20 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 		opq = layer.OverlayOpaqueUser
 	}
 	// Configure filesystem and snapshotter
-	fsOpts := append(sOpts.fsOpts, socifs.WithGetSources(
+	var fsOpts []socifs.Option
+	if len(sOpts.credsFuncs) > 0 {
+		// fetch SOCI artifacts and unpack layers with the same keychain as the layers.
+		fsOpts = append(fsOpts, socifs.WithCredential(socifs.Credential(resolver.MultiCredential(sOpts.credsFuncs...))))
+	}
+	fsOpts = append(fsOpts, sOpts.fsOpts...)
+	fsOpts = append(fsOpts, socifs.WithGetSources(
 		source.FromDefaultLabels(hosts), // provides source info based on default labels
-	), socifs.WithOverlayOpaqueType(opq))
-	fs, err := socifs.NewFilesystem(ctx, fsRoot(root), config.Config, fsOpts...)
+	), socifs.WithOverlayOpaqueType(opq), socifs.WithDiskUsagePaths(
+		filepath.Join(config.DirectoriesConfig.snapshotterRoot(root), "snapshots"),
+		config.DirectoriesConfig.MetadataDBPath(root),
+		filepath.Join(config.DirectoriesConfig.snapshotterRoot(root), "metadata.db"),
+	))
+	fs, err := socifs.NewFilesystem(ctx, config.DirectoriesConfig.fsRoot(root), config.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
@@ -113,8 +132,14 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 	if config.SnapshotterConfig.AllowInvalidMountsOnRestart {
 		snOpts = append(snOpts, snbase.AllowInvalidMountsOnRestart)
 	}
+	if config.SnapshotterConfig.FallbackPull {
+		snOpts = append(snOpts, snbase.WithFallbackPull)
+	}
+	if config.SnapshotterConfig.VirtioFS {
+		snOpts = append(snOpts, snbase.WithVirtioFS)
+	}
 
-	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
+	snapshotter, err = snbase.NewSnapshotter(ctx, config.DirectoriesConfig.snapshotterRoot(root), fs, snOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
 	}
@@ -137,3 +162,22 @@ func Supported(root string) error {
 	// Remote snapshotter is implemented based on overlayfs snapshotter.
 	return overlayutils.Supported(snapshotterRoot(root))
 }
+
+// newTokenCache returns the cache of the bearer tokens of registries, or nil if it
+// isn't enabled. The tokens are encrypted with the key of the token cache, or the key
+// of the layer caches if it has none.
+func newTokenCache(root string, config *Config) (*resolver.TokenCache, error) {
+	tc := config.ResolverConfig.TokenCache
+	if !tc.Enable {
+		return nil, nil
+	}
+	keyFile, keyCommand := tc.KeyFile, tc.KeyCommand
+	if keyFile == "" && len(keyCommand) == 0 {
+		keyFile, keyCommand = config.CacheEncryptionConfig.KeyFile, config.CacheEncryptionConfig.KeyCommand
+	}
+	cipher, err := cache.LoadCipher(keyFile, keyCommand)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token cache key: %w", err)
+	}
+	return resolver.NewTokenCache(filepath.Join(root, tokenCacheFileName), cipher)
+}
@@ -0,0 +1,315 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// walkPageSize is the number of snapshots read per transaction of the metadata DB
+// when walking snapshots, so that a walk over many snapshots doesn't hold a
+// transaction open while the snapshots are sent to the client.
+const walkPageSize = 500
+
+// snapshotIndex indexes the snapshots of the metadata DB by name and by label, so
+// that walks filtered by labels, e.g. by the CRI plugin and the kubelet's image GC,
+// only read the matching snapshots instead of all of them. The snapshotter is the
+// only writer of its metadata DB, so it keeps the index up to date when it changes
+// the DB.
+type snapshotIndex struct {
+	mu sync.RWMutex
+	// labels are the labels of the snapshots by name.
+	labels map[string]map[string]string
+	// byLabel are the names of the snapshots by label key and value.
+	byLabel map[string]map[string]map[string]struct{}
+}
+
+func newSnapshotIndex() *snapshotIndex {
+	return &snapshotIndex{
+		labels:  make(map[string]map[string]string),
+		byLabel: make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+// put adds the snapshot name with labels to the index, replacing its previous labels.
+func (idx *snapshotIndex) put(name string, labels map[string]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(name)
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+		values, ok := idx.byLabel[k]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			idx.byLabel[k] = values
+		}
+		names, ok := values[v]
+		if !ok {
+			names = make(map[string]struct{})
+			values[v] = names
+		}
+		names[name] = struct{}{}
+	}
+	idx.labels[name] = copied
+}
+
+// remove removes the snapshot name from the index.
+func (idx *snapshotIndex) remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(name)
+}
+
+func (idx *snapshotIndex) removeLocked(name string) {
+	labels, ok := idx.labels[name]
+	if !ok {
+		return
+	}
+	for k, v := range labels {
+		names := idx.byLabel[k][v]
+		delete(names, name)
+		if len(names) == 0 {
+			delete(idx.byLabel[k], v)
+		}
+		if len(idx.byLabel[k]) == 0 {
+			delete(idx.byLabel, k)
+		}
+	}
+	delete(idx.labels, name)
+}
+
+// candidates returns the sorted names of the snapshots which may match fs, a list of
+// filters of which any must match. The snapshots still need to be matched against the
+// filters, since only some selectors of the filters are indexed.
+func (idx *snapshotIndex) candidates(fs ...string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var sets []map[string]struct{}
+	for _, f := range fs {
+		set, ok := idx.lookupLocked(f)
+		if !ok {
+			// one of the filters can't be looked up, so all snapshots may match.
+			sets = nil
+			break
+		}
+		sets = append(sets, set)
+	}
+	var names []string
+	if sets == nil {
+		names = make([]string, 0, len(idx.labels))
+		for name := range idx.labels {
+			names = append(names, name)
+		}
+	} else {
+		seen := make(map[string]struct{})
+		for _, set := range sets {
+			for name := range set {
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupLocked returns the smallest set of snapshots which contains all snapshots
+// matching filter. It returns false if filter has no indexed selector which all
+// matching snapshots must match.
+func (idx *snapshotIndex) lookupLocked(filter string) (map[string]struct{}, bool) {
+	selectors, ok := parseSelectors(filter)
+	if !ok {
+		return nil, false
+	}
+	var best map[string]struct{}
+	found := false
+	for _, s := range selectors {
+		var set map[string]struct{}
+		switch {
+		case len(s.fieldpath) == 1 && s.fieldpath[0] == "name" && s.operator == "==":
+			set = make(map[string]struct{})
+			if _, ok := idx.labels[s.value]; ok {
+				set[s.value] = struct{}{}
+			}
+		case len(s.fieldpath) > 1 && s.fieldpath[0] == "labels" && s.operator == "==":
+			set = idx.byLabel[strings.Join(s.fieldpath[1:], ".")][s.value]
+		case len(s.fieldpath) > 1 && s.fieldpath[0] == "labels" && s.operator == "":
+			set = make(map[string]struct{})
+			for _, names := range idx.byLabel[strings.Join(s.fieldpath[1:], ".")] {
+				for name := range names {
+					set[name] = struct{}{}
+				}
+			}
+		default:
+			continue
+		}
+		if !found || len(set) < len(best) {
+			best, found = set, true
+		}
+	}
+	return best, found
+}
+
+// optLabels returns the labels set by opts. The opts were already applied by the
+// storage of the metadata DB, so they don't fail.
+func optLabels(opts []snapshots.Opt) map[string]string {
+	var base snapshots.Info
+	for _, opt := range opts {
+		opt(&base)
+	}
+	return base.Labels
+}
+
+// selector is a selector of a filter, e.g. `labels."containerd.io/gc.root"==x`.
+type selector struct {
+	fieldpath []string
+	// operator is "" if the selector only checks that the field is present.
+	operator string
+	value    string
+}
+
+// parseSelectors parses the comma separated selectors of filter, all of which must
+// match. It only parses the common subset of the filter syntax, and returns false for
+// filters outside of it, e.g. with escaped characters, so that the index is never used
+// with selectors which are parsed differently than by the filters package.
+func parseSelectors(filter string) ([]selector, bool) {
+	var selectors []selector
+	s := strings.TrimSpace(filter)
+	for {
+		var sel selector
+		for {
+			var field string
+			var ok bool
+			if strings.HasPrefix(s, `"`) {
+				field, s, ok = parseQuoted(s)
+			} else {
+				i := strings.IndexFunc(s, func(r rune) bool { return !isFieldRune(r) })
+				if i < 0 {
+					i = len(s)
+				}
+				field, s, ok = s[:i], s[i:], i > 0
+			}
+			if !ok {
+				return nil, false
+			}
+			sel.fieldpath = append(sel.fieldpath, field)
+			if !strings.HasPrefix(s, ".") {
+				break
+			}
+			s = s[1:]
+		}
+		s = strings.TrimSpace(s)
+		for _, op := range []string{"==", "!=", "~="} {
+			if strings.HasPrefix(s, op) {
+				sel.operator = op
+				break
+			}
+		}
+		if sel.operator != "" {
+			s = strings.TrimSpace(s[len(sel.operator):])
+			var ok bool
+			if strings.HasPrefix(s, `"`) {
+				sel.value, s, ok = parseQuoted(s)
+			} else {
+				i := strings.IndexFunc(s, func(r rune) bool { return r == ',' || isSpace(r) })
+				if i < 0 {
+					i = len(s)
+				}
+				sel.value, s = s[:i], s[i:]
+				// values starting or containing quotes are left to the filters package.
+				ok = i > 0 && !strings.ContainsAny(sel.value, `"/|\`)
+			}
+			if !ok {
+				return nil, false
+			}
+		}
+		selectors = append(selectors, sel)
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return selectors, true
+		}
+		if !strings.HasPrefix(s, ",") {
+			return nil, false
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+}
+
+// parseQuoted parses the double quoted string at the start of s, which must not
+// contain escaped characters, and returns it and the rest of s.
+func parseQuoted(s string) (string, string, bool) {
+	end := strings.IndexByte(s[1:], '"')
+	if end < 0 {
+		return "", "", false
+	}
+	quoted := s[1 : end+1]
+	if strings.ContainsRune(quoted, '\\') {
+		return "", "", false
+	}
+	return quoted, s[end+2:], true
+}
+
+func isFieldRune(r rune) bool {
+	return r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9'
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// adaptSnapshot adapts info to be matched by filters, in the same way as the storage
+// of the metadata DB.
+func adaptSnapshot(info snapshots.Info) filters.Adaptor {
+	return filters.AdapterFunc(func(fieldpath []string) (string, bool) {
+		if len(fieldpath) == 0 {
+			return "", false
+		}
+
+		switch fieldpath[0] {
+		case "kind":
+			switch info.Kind {
+			case snapshots.KindActive:
+				return "active", true
+			case snapshots.KindView:
+				return "view", true
+			case snapshots.KindCommitted:
+				return "committed", true
+			}
+		case "name":
+			return info.Name, true
+		case "parent":
+			return info.Parent, true
+		case "labels":
+			if len(info.Labels) == 0 {
+				return "", false
+			}
+
+			v, ok := info.Labels[strings.Join(fieldpath[1:], ".")]
+			return v, ok
+		}
+
+		return "", false
+	})
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotIndexCandidates(t *testing.T) {
+	idx := newSnapshotIndex()
+	idx.put("a", map[string]string{"containerd.io/snapshot.ref": "sha256:1", "foo": "x"})
+	idx.put("b", map[string]string{"containerd.io/snapshot.ref": "sha256:2"})
+	idx.put("c", nil)
+	idx.put("d", map[string]string{"foo": "y"})
+	idx.remove("d")
+	idx.put("b", map[string]string{"containerd.io/snapshot.ref": "sha256:3", "foo": "x"})
+
+	tests := []struct {
+		name    string
+		filters []string
+		want    []string
+	}{
+		{"all", nil, []string{"a", "b", "c"}},
+		{"label", []string{`labels."containerd.io/snapshot.ref"==sha256:1`}, []string{"a"}},
+		{"updated label", []string{`labels."containerd.io/snapshot.ref"==sha256:2`}, nil},
+		{"quoted value", []string{`labels."containerd.io/snapshot.ref"=="sha256:3"`}, []string{"b"}},
+		{"unquoted label", []string{`labels.containerd.io/snapshot.ref==sha256:3`}, []string{"a", "b", "c"}},
+		{"label present", []string{`labels.foo`}, []string{"a", "b"}},
+		{"removed label", []string{`labels.foo==y`}, nil},
+		{"name", []string{`name==c`}, []string{"c"}},
+		{"smallest selector", []string{`labels.foo==x, name==a`}, []string{"a"}},
+		{"any filter", []string{`name==a`, `name==c`}, []string{"a", "c"}},
+		{"unindexed selector", []string{`kind==committed`}, []string{"a", "b", "c"}},
+		{"unindexed filter", []string{`name==a`, `parent==c`}, []string{"a", "b", "c"}},
+		{"escaped value", []string{`labels.foo=="\"x"`}, []string{"a", "b", "c"}},
+		{"regexp value", []string{`labels.foo~=/x/`}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idx.candidates(tt.filters...)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates(%q) = %v; want %v", tt.filters, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSelectors(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []selector
+		ok     bool
+	}{
+		{
+			filter: `labels."containerd.io/gc.root"==x`,
+			want:   []selector{{fieldpath: []string{"labels", "containerd.io/gc.root"}, operator: "==", value: "x"}},
+			ok:     true,
+		},
+		{
+			filter: `kind!=view, labels.a.b`,
+			want: []selector{
+				{fieldpath: []string{"kind"}, operator: "!=", value: "view"},
+				{fieldpath: []string{"labels", "a", "b"}},
+			},
+			ok: true,
+		},
+		{filter: ``},
+		{filter: `name==a b`},
+		{filter: `labels."a==b`},
+		{filter: `name==docker.io/library/busybox`},
+	}
+	for _, tt := range tests {
+		got, ok := parseSelectors(tt.filter)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSelectors(%q) = %+v, %v; want %+v, %v", tt.filter, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// OperationsPath is the path of the endpoint of the snapshotter's API that lists the
+// snapshot operations in progress and the active snapshots, e.g. to debug operations
+// which are stuck.
+const OperationsPath = "/api/v1/operations"
+
+// Operation is a snapshot operation in progress.
+type Operation struct {
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Parent    string    `json:"parent,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	// DurationSec is how long the operation has been running.
+	DurationSec float64 `json:"durationSec"`
+}
+
+// ActiveSnapshot is a snapshot which isn't committed yet, e.g. the snapshot of a
+// layer being unpacked or of a container.
+type ActiveSnapshot struct {
+	Key     string    `json:"key"`
+	Parent  string    `json:"parent,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Operations is the response of the operations endpoint.
+type Operations struct {
+	// InProgress are the operations in progress, longest running first.
+	InProgress []Operation      `json:"inProgress"`
+	Active     []ActiveSnapshot `json:"active"`
+}
+
+// InstrumentedSnapshotter measures the latency and the errors of the operations of a
+// snapshotter, e.g. when it's served over gRPC, and tracks the operations in progress.
+type InstrumentedSnapshotter struct {
+	snapshots.Snapshotter
+
+	mu         sync.Mutex
+	nextID     uint64
+	inProgress map[uint64]Operation
+}
+
+var _ snapshots.Cleaner = &InstrumentedSnapshotter{}
+
+// Instrument returns sn instrumented.
+func Instrument(sn snapshots.Snapshotter) *InstrumentedSnapshotter {
+	return &InstrumentedSnapshotter{Snapshotter: sn, inProgress: make(map[uint64]Operation)}
+}
+
+// track records the operation as in progress. The returned function records its result.
+func (s *InstrumentedSnapshotter) track(operation, key, parent string) func(error) {
+	start := time.Now()
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.inProgress[id] = Operation{Operation: operation, Key: key, Parent: parent, StartedAt: start}
+	s.mu.Unlock()
+	return func(err error) {
+		s.mu.Lock()
+		delete(s.inProgress, id)
+		s.mu.Unlock()
+		commonmetrics.MeasureSnapshotterOperation(operation, start, errorKind(err))
+	}
+}
+
+// errorKind classifies err for the error metric.
+func errorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errdefs.IsNotFound(err):
+		return "not_found"
+	case errdefs.IsAlreadyExists(err):
+		return "already_exists"
+	case errdefs.IsFailedPrecondition(err):
+		return "failed_precondition"
+	case errdefs.IsInvalidArgument(err):
+		return "invalid_argument"
+	case errdefs.IsCanceled(err), errdefs.IsDeadlineExceeded(err):
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+func (s *InstrumentedSnapshotter) Stat(ctx context.Context, key string) (_ snapshots.Info, retErr error) {
+	done := s.track("Stat", key, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Stat(ctx, key)
+}
+
+func (s *InstrumentedSnapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (_ snapshots.Info, retErr error) {
+	done := s.track("Update", info.Name, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Update(ctx, info, fieldpaths...)
+}
+
+func (s *InstrumentedSnapshotter) Usage(ctx context.Context, key string) (_ snapshots.Usage, retErr error) {
+	done := s.track("Usage", key, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Usage(ctx, key)
+}
+
+func (s *InstrumentedSnapshotter) Mounts(ctx context.Context, key string) (_ []mount.Mount, retErr error) {
+	done := s.track("Mounts", key, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Mounts(ctx, key)
+}
+
+func (s *InstrumentedSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, retErr error) {
+	done := s.track("Prepare", key, parent)
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Prepare(ctx, key, parent, opts...)
+}
+
+func (s *InstrumentedSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, retErr error) {
+	done := s.track("View", key, parent)
+	defer func() { done(retErr) }()
+	return s.Snapshotter.View(ctx, key, parent, opts...)
+}
+
+func (s *InstrumentedSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) (retErr error) {
+	done := s.track("Commit", key, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Commit(ctx, name, key, opts...)
+}
+
+func (s *InstrumentedSnapshotter) Remove(ctx context.Context, key string) (retErr error) {
+	done := s.track("Remove", key, "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func (s *InstrumentedSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) (retErr error) {
+	done := s.track("Walk", "", "")
+	defer func() { done(retErr) }()
+	return s.Snapshotter.Walk(ctx, fn, filters...)
+}
+
+// Cleanup cleans up the snapshotter if it supports it.
+func (s *InstrumentedSnapshotter) Cleanup(ctx context.Context) (retErr error) {
+	done := s.track("Cleanup", "", "")
+	defer func() { done(retErr) }()
+	c, ok := s.Snapshotter.(snapshots.Cleaner)
+	if !ok {
+		return fmt.Errorf("snapshotter does not implement Cleanup method: %w", errdefs.ErrNotImplemented)
+	}
+	return c.Cleanup(ctx)
+}
+
+// Operations returns the operations in progress and the active snapshots.
+func (s *InstrumentedSnapshotter) Operations(ctx context.Context) (Operations, error) {
+	now := time.Now()
+	ops := Operations{InProgress: []Operation{}, Active: []ActiveSnapshot{}}
+	s.mu.Lock()
+	for _, op := range s.inProgress {
+		op.DurationSec = now.Sub(op.StartedAt).Seconds()
+		ops.InProgress = append(ops.InProgress, op)
+	}
+	s.mu.Unlock()
+	sort.Slice(ops.InProgress, func(i, j int) bool { return ops.InProgress[i].StartedAt.Before(ops.InProgress[j].StartedAt) })
+
+	// Walk the underlying snapshotter, so that the walk isn't listed as in progress.
+	err := s.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if info.Kind == snapshots.KindActive {
+			ops.Active = append(ops.Active, ActiveSnapshot{Key: info.Name, Parent: info.Parent, Created: info.Created})
+		}
+		return nil
+	})
+	if err != nil {
+		return Operations{}, err
+	}
+	sort.Slice(ops.Active, func(i, j int) bool { return ops.Active[i].Key < ops.Active[j].Key })
+	return ops, nil
+}
+
+// OperationsHandler serves the operations in progress and the active snapshots.
+func (s *InstrumentedSnapshotter) OperationsHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ops, err := s.Operations(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ops); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write operations response")
+		}
+	})
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// blockingSnapshotter blocks Prepare until release is closed.
+type blockingSnapshotter struct {
+	snapshots.Snapshotter
+	started chan struct{}
+	release chan struct{}
+	infos   []snapshots.Info
+}
+
+func (s *blockingSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	close(s.started)
+	<-s.release
+	return nil, fmt.Errorf("parent %q: %w", parent, errdefs.ErrNotFound)
+}
+
+func (s *blockingSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error {
+	for _, info := range s.infos {
+		if err := fn(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestInstrumentedOperations(t *testing.T) {
+	sn := &blockingSnapshotter{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		infos: []snapshots.Info{
+			{Name: "b", Parent: "a", Kind: snapshots.KindActive},
+			{Name: "a", Kind: snapshots.KindCommitted},
+			{Name: "c", Kind: snapshots.KindView},
+		},
+	}
+	s := Instrument(sn)
+	prepareErr := make(chan error, 1)
+	go func() {
+		_, err := s.Prepare(context.Background(), "key", "parent")
+		prepareErr <- err
+	}()
+	select {
+	case <-sn.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Prepare wasn't called")
+	}
+
+	srv := httptest.NewServer(s.OperationsHandler(context.Background()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	var ops Operations
+	if err := json.NewDecoder(resp.Body).Decode(&ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops.InProgress) != 1 || ops.InProgress[0].Operation != "Prepare" ||
+		ops.InProgress[0].Key != "key" || ops.InProgress[0].Parent != "parent" {
+		t.Errorf("unexpected operations in progress: %+v", ops.InProgress)
+	}
+	if len(ops.Active) != 1 || ops.Active[0].Key != "b" || ops.Active[0].Parent != "a" {
+		t.Errorf("unexpected active snapshots: %+v", ops.Active)
+	}
+
+	close(sn.release)
+	if err := <-prepareErr; !errdefs.IsNotFound(err) {
+		t.Errorf("Prepare returned %v; want not found", err)
+	}
+	if kind := errorKind(fmt.Errorf("wrapped: %w", errdefs.ErrNotFound)); kind != "not_found" {
+		t.Errorf("error kind is %q; want not_found", kind)
+	}
+	ops, err = s.Operations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops.InProgress) != 0 {
+		t.Errorf("operations are still in progress after they returned: %+v", ops.InProgress)
+	}
+}
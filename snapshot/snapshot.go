@@ -38,13 +38,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
@@ -101,12 +105,35 @@ type FileSystem interface {
 	MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error
 }
 
+// layerSizer is implemented by file systems which find the sizes of layers whose
+// snapshots don't have the size label, e.g. from the manifests of images pulled
+// without rpull.
+type layerSizer interface {
+	LayerSize(ctx context.Context, labels map[string]string) (int64, error)
+}
+
+// layerPresence is implemented by file systems which know whether the layer of a snapshot
+// is present on the node, e.g. cached by a layer mounted for another snapshot. MountLocal
+// unpacks such layers without fetching them, so they're mounted as plain overlay
+// lowerdirs instead of being lazily loaded.
+type layerPresence interface {
+	LayerPresent(ctx context.Context, labels map[string]string) bool
+}
+
+// layerUsage is implemented by file systems which know the usage of the layers they
+// mount, e.g. from the uncompressed sizes recorded by SOCI indices.
+type layerUsage interface {
+	Usage(mountpoint string) (snapshots.Usage, bool)
+}
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove bool
 	// minLayerSize skips remote mounting of smaller layers
 	minLayerSize                int64
 	allowInvalidMountsOnRestart bool
+	fallbackPull                bool
+	virtiofs                    bool
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -134,9 +161,29 @@ func AllowInvalidMountsOnRestart(config *SnapshotterConfig) error {
 	return nil
 }
 
+// WithFallbackPull unpacks the layers of remote snapshots which can't be restored
+// when the snapshotter restarts, so that the containers of their images can still
+// start even if the layers can't be lazily loaded anymore.
+//
+// This only applies to restarts: when a layer can't be lazily loaded while pulling,
+// Prepare always falls back to unpacking it with FileSystem.MountLocal.
+func WithFallbackPull(config *SnapshotterConfig) error {
+	config.fallbackPull = true
+	return nil
+}
+
+// WithVirtioFS mounts the root filesystems of containers on the host and returns bind
+// mounts of them instead of overlay mounts, so that microVM runtimes can share them with
+// their guests over virtio-fs while the layers are lazily loaded on the host.
+func WithVirtioFS(config *SnapshotterConfig) error {
+	config.virtiofs = true
+	return nil
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
+	index       *snapshotIndex
 	asyncRemove bool
 
 	// fs is a filesystem that this snapshotter recognizes.
@@ -144,6 +191,9 @@ type snapshotter struct {
 	userxattr                   bool  // whether to enable "userxattr" mount option
 	minLayerSize                int64 // minimum layer size for remote mounting
 	allowInvalidMountsOnRestart bool
+	fallbackPull                bool
+	virtiofs                    bool
+	rootfsMu                    sync.Mutex // serializes mounting root filesystems on the host
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -189,11 +239,18 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 	o := &snapshotter{
 		root:                        root,
 		ms:                          ms,
+		index:                       newSnapshotIndex(),
 		asyncRemove:                 config.asyncRemove,
 		fs:                          targetFs,
 		userxattr:                   userxattr,
 		minLayerSize:                config.minLayerSize,
 		allowInvalidMountsOnRestart: config.allowInvalidMountsOnRestart,
+		fallbackPull:                config.fallbackPull,
+		virtiofs:                    config.virtiofs,
+	}
+
+	if err := o.buildIndex(ctx); err != nil {
+		return nil, fmt.Errorf("failed to index snapshots: %w", err)
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
@@ -237,6 +294,7 @@ func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpath
 	if err := t.Commit(); err != nil {
 		return snapshots.Info{}, err
 	}
+	o.index.put(info.Name, info.Labels)
 
 	return info, nil
 }
@@ -293,7 +351,11 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 
 	target, ok := base.Labels[targetSnapshotLabel]
 	if !ok {
-		return o.mounts(ctx, s, parent)
+		mounts, err := o.mounts(ctx, s, parent)
+		if err != nil {
+			return nil, err
+		}
+		return o.rootfsMounts(ctx, s, mounts)
 	}
 
 	// NOTE: If passed labels include a target of the remote snapshot, `Prepare`
@@ -353,21 +415,46 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 }
 
 func (o *snapshotter) skipRemoteSnapshotPrepare(ctx context.Context, labels map[string]string) bool {
-	if o.minLayerSize > 0 {
-		if strVal, ok := labels[source.TargetSizeLabel]; ok {
-			if intVal, err := strconv.ParseInt(strVal, 10, 64); err == nil {
-				if intVal < o.minLayerSize {
-					log.G(ctx).Info("layer size less than runtime min_layer_size, skipping remote snapshot preparation")
-					return true
-				}
-			} else {
-				log.G(ctx).WithError(err).Errorf("config min_layer_size cannot be converted to int: %s", strVal)
-			}
-		}
+	if lp, ok := o.fs.(layerPresence); ok && lp.LayerPresent(ctx, labels) {
+		log.G(ctx).Info("layer is present on the node, unpacking it instead of mounting it remotely")
+		return true
+	}
+	if o.minLayerSize <= 0 {
+		return false
+	}
+	size, ok := o.layerSize(ctx, labels)
+	if !ok {
+		return false
+	}
+	if size < o.minLayerSize {
+		log.G(ctx).Info("layer size less than runtime min_layer_size, skipping remote snapshot preparation")
+		return true
 	}
 	return false
 }
 
+// layerSize returns the size of the layer of a snapshot from its labels, or from the
+// filesystem if the snapshot has no size label. It returns false if the size is unknown.
+func (o *snapshotter) layerSize(ctx context.Context, labels map[string]string) (int64, bool) {
+	if strVal, ok := labels[source.TargetSizeLabel]; ok {
+		size, err := strconv.ParseInt(strVal, 10, 64)
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("layer size label cannot be converted to int: %s", strVal)
+			return 0, false
+		}
+		return size, true
+	}
+	if ls, ok := o.fs.(layerSizer); ok {
+		size, err := ls.LayerSize(ctx, labels)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("failed to get layer size")
+			return 0, false
+		}
+		return size, true
+	}
+	return 0, false
+}
+
 func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
 	s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
 	if err != nil {
@@ -386,11 +473,24 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 		return nil, err
 	}
 	s, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		t.Rollback()
+		return nil, fmt.Errorf("failed to get active mount: %w", err)
+	}
+	_, info, _, err := storage.GetInfo(ctx, key)
 	t.Rollback()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get active mount: %w", err)
 	}
-	return o.mounts(ctx, s, key)
+	mounts, err := o.mounts(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := info.Labels[targetSnapshotLabel]; ok {
+		// layers are unpacked into the overlay's upperdir.
+		return mounts, nil
+	}
+	return o.rootfsMounts(ctx, s, mounts)
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
@@ -423,13 +523,23 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 			return err
 		}
 		usage = snapshots.Usage(du)
+	} else if lu, ok := o.fs.(layerUsage); ok {
+		// report the virtual size of the layer without fetching it.
+		if u, ok := lu.Usage(o.upperPath(id)); ok {
+			usage = u
+		}
 	}
 
 	if _, err = storage.CommitActive(ctx, key, name, usage, opts...); err != nil {
 		return fmt.Errorf("failed to commit snapshot: %w", err)
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err != nil {
+		return err
+	}
+	o.index.remove(key)
+	o.index.put(name, optLabels(opts))
+	return nil
 }
 
 // Remove abandons the snapshot identified by key. The snapshot will
@@ -476,17 +586,80 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err != nil {
+		return err
+	}
+	o.index.remove(key)
+	return nil
 }
 
-// Walk the snapshots.
+// Walk the snapshots. Only the snapshots which may match the filters according to the
+// index are read, a page at a time, and fn is called outside of the transactions, so
+// snapshots created or removed during the walk may or may not be walked.
 func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	filter, err := filters.ParseAll(fs...)
+	if err != nil {
+		return err
+	}
+	names := o.index.candidates(fs...)
+	for len(names) > 0 {
+		n := walkPageSize
+		if n > len(names) {
+			n = len(names)
+		}
+		infos, err := o.readInfos(ctx, names[:n], filter)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if err := fn(ctx, info); err != nil {
+				return err
+			}
+		}
+		names = names[n:]
+	}
+	return nil
+}
+
+// readInfos reads the infos of the named snapshots which match filter in a single
+// transaction. Snapshots which were removed since they were looked up are skipped.
+func (o *snapshotter) readInfos(ctx context.Context, names []string, filter filters.Filter) ([]snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	var infos []snapshots.Info
+	for _, name := range names {
+		_, info, _, err := storage.GetInfo(ctx, name)
+		if errdefs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if filter.Match(adaptSnapshot(info)) {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// buildIndex indexes all snapshots of the metadata DB.
+func (o *snapshotter) buildIndex(ctx context.Context) error {
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
 	if err != nil {
 		return err
 	}
 	defer t.Rollback()
-	return storage.WalkInfo(ctx, fn, fs...)
+	err = storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		o.index.put(info.Name, info.Labels)
+		return nil
+	})
+	if errdefs.IsNotFound(err) {
+		// the DB has no snapshots yet.
+		return nil
+	}
+	return err
 }
 
 // Cleanup cleans up disk resources from removed or abandoned snapshots
@@ -557,6 +730,14 @@ func (o *snapshotter) getCleanupDirectories(ctx context.Context, t storage.Trans
 
 func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string) error {
 
+	// In virtio-fs mode, the root filesystem of a container is mounted on the "rootfs" directory.
+	rootfs := filepath.Join(dir, "rootfs")
+	if mounted, err := mountinfo.Mounted(rootfs); err == nil && mounted {
+		if err := mount.UnmountAll(rootfs, 0); err != nil {
+			log.G(ctx).WithError(err).WithField("dir", rootfs).Warn("failed to unmount root filesystem")
+		}
+	}
+
 	// On a remote snapshot, the layer is mounted on the "fs" directory.
 	// We use Filesystem's Unmount API so that it can do necessary finalization
 	// before/after the unmount.
@@ -641,6 +822,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	if err = t.Commit(); err != nil {
 		return storage.Snapshot{}, fmt.Errorf("commit failed: %w", err)
 	}
+	o.index.put(key, optLabels(opts))
 
 	return s, nil
 }
@@ -733,6 +915,43 @@ func (o *snapshotter) upperPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "fs")
 }
 
+// rootfsPath produces a file path like "{snapshotter.root}/snapshots/{id}/rootfs"
+func (o *snapshotter) rootfsPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "rootfs")
+}
+
+// rootfsMounts returns mounts unchanged unless the snapshotter is in virtio-fs mode.
+// Then, the overlay mount of the active snapshot s is mounted on the host (once) and
+// a bind mount of it is returned, which microVM runtimes share with their guests.
+func (o *snapshotter) rootfsMounts(ctx context.Context, s storage.Snapshot, mounts []mount.Mount) ([]mount.Mount, error) {
+	if !o.virtiofs || s.Kind != snapshots.KindActive || len(mounts) != 1 || mounts[0].Type != "overlay" {
+		return mounts, nil
+	}
+	target := o.rootfsPath(s.ID)
+	o.rootfsMu.Lock()
+	defer o.rootfsMu.Unlock()
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	mounted, err := mountinfo.Mounted(target)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		if err := mount.All(mounts, target); err != nil {
+			return nil, fmt.Errorf("failed to mount root filesystem of snapshot %s: %w", s.ID, err)
+		}
+		log.G(ctx).WithField("path", target).Debug("mounted root filesystem on the host for virtio-fs")
+	}
+	return []mount.Mount{
+		{
+			Source:  target,
+			Type:    "bind",
+			Options: []string{"rw", "rbind"},
+		},
+	}, nil
+}
+
 // workPath produces a file path like "{snapshotter.root}/snapshots/{id}/work"
 func (o *snapshotter) workPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "work")
@@ -762,7 +981,54 @@ func (o *snapshotter) prepareLocalSnapshot(ctx context.Context, key string, labe
 	}
 	mountpoint := o.upperPath(id)
 	log.G(ctx).Infof("preparing local filesystem at mountpoint=%v", mountpoint)
-	return o.fs.MountLocal(ctx, mountpoint, labels, mounts)
+	return o.fs.MountLocal(remote.WithSnapshot(ctx, key), mountpoint, labels, mounts)
+}
+
+// restoreLocalSnapshot unpacks the layer of a remote snapshot, which can't be restored,
+// into the snapshot's directory and turns it into a local snapshot.
+func (o *snapshotter) restoreLocalSnapshot(ctx context.Context, info snapshots.Info) error {
+	id, lowerdirs, err := o.snapshotDirs(ctx, info.Name)
+	if err != nil {
+		return err
+	}
+	// The unpacker applies the layer onto the lower directories like an overlay mount.
+	var options []string
+	if len(lowerdirs) > 0 {
+		options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(lowerdirs, ":")))
+	}
+	mounts := []mount.Mount{{Type: "overlay", Source: "overlay", Options: options}}
+	mountpoint := o.upperPath(id)
+	log.G(ctx).Infof("unpacking layer of remote snapshot at mountpoint=%v", mountpoint)
+	if err := o.fs.MountLocal(remote.WithSnapshot(ctx, info.Name), mountpoint, info.Labels, mounts); err != nil {
+		return err
+	}
+	delete(info.Labels, remoteLabel)
+	_, err = o.Update(ctx, info, "labels."+remoteLabel)
+	return err
+}
+
+// snapshotDirs returns the id of the snapshot with key and the directories of its parents,
+// starting with the nearest one.
+func (o *snapshotter) snapshotDirs(ctx context.Context, key string) (string, []string, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer t.Rollback()
+	id, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	var lowerdirs []string
+	for p := info.Parent; p != ""; {
+		pID, pInfo, _, err := storage.GetInfo(ctx, p)
+		if err != nil {
+			return "", nil, err
+		}
+		lowerdirs = append(lowerdirs, o.upperPath(pID))
+		p = pInfo.Parent
+	}
+	return id, lowerdirs, nil
 }
 
 // prepareRemoteSnapshot tries to prepare the snapshot as a remote snapshot
@@ -773,7 +1039,7 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 		return err
 	}
 	defer t.Rollback()
-	id, _, _, err := storage.GetInfo(ctx, key)
+	id, info, _, err := storage.GetInfo(ctx, key)
 	if err != nil {
 		return err
 	}
@@ -781,6 +1047,16 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 	mountpoint := o.upperPath(id)
 	log.G(ctx).Infof("preparing filesystem mount at mountpoint=%v", mountpoint)
 
+	// the chain ID of the parent layer lets the filesystem check the diffID of the
+	// layer against the image config.
+	ctx = remote.WithSnapshot(ctx, key)
+	if info.Parent == "" {
+		ctx = source.WithParentChainID(ctx, "")
+	} else if _, parent, _, err := storage.GetInfo(ctx, info.Parent); err == nil {
+		if chainID, ok := parent.Labels[targetSnapshotLabel]; ok {
+			ctx = source.WithParentChainID(ctx, chainID)
+		}
+	}
 	return o.fs.Mount(ctx, mountpoint, labels)
 }
 
@@ -840,7 +1116,9 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 	}
 
 	var task []snapshots.Info
+	parents := make(map[string]string)
 	if err := o.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		parents[info.Name] = info.Parent
 		if _, ok := info.Labels[remoteLabel]; ok {
 			task = append(task, info)
 		}
@@ -848,8 +1126,18 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 	}); err != nil && !errdefs.IsNotFound(err) {
 		return err
 	}
+	// Restore parents first, since layers unpacked by the fallback pull are applied onto their parents.
+	sortParentsFirst(task, parents)
 	for _, info := range task {
 		if err := o.prepareRemoteSnapshot(ctx, info.Name, info.Labels); err != nil {
+			if o.fallbackPull {
+				lErr := o.restoreLocalSnapshot(ctx, info)
+				if lErr == nil {
+					logrus.WithError(err).Warnf("failed to restore remote snapshot %s; unpacked the layer instead", info.Name)
+					continue
+				}
+				err = fmt.Errorf("%w; failed to unpack the layer: %v", err, lErr)
+			}
 			if o.allowInvalidMountsOnRestart {
 				logrus.WithError(err).Warnf("failed to restore remote snapshot %s; remove this snapshot manually", info.Name)
 				// This snapshot mount is invalid but allow this.
@@ -864,3 +1152,15 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 
 	return nil
 }
+
+// sortParentsFirst sorts snapshots so that every snapshot comes after its parents.
+// parents maps the names of snapshots to the names of their parents.
+func sortParentsFirst(infos []snapshots.Info, parents map[string]string) {
+	depth := func(name string) (d int) {
+		for p := parents[name]; p != ""; p = parents[p] {
+			d++
+		}
+		return
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return depth(infos[i].Name) < depth(infos[j].Name) })
+}
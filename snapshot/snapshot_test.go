@@ -38,9 +38,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/pkg/testutil"
@@ -389,6 +391,81 @@ func TestFailureDetection(t *testing.T) {
 	}
 }
 
+func TestFallbackPullOnRestart(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fi := bindFileSystem(t)
+	sn, err := NewSnapshotter(ctx, root, fi)
+	if err != nil {
+		t.Fatalf("failed to make new Snapshotter: %q", err)
+	}
+	lower := prepareWithTarget(t, sn, "/tmp/lowerTarget", "/tmp/lowerKey", "", nil)
+	upper := prepareWithTarget(t, sn, "/tmp/upperTarget", "/tmp/upperKey", lower, nil)
+	if err := sn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layers can't be lazily loaded anymore after restarting.
+	fs := fi.(*bindFs)
+	fs.mountFailure = true
+	sn, err = NewSnapshotter(ctx, root, fs, WithFallbackPull)
+	if err != nil {
+		t.Fatalf("failed to restart Snapshotter: %v", err)
+	}
+	defer sn.Close()
+	for _, key := range []string{lower, upper} {
+		info, err := sn.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			t.Errorf("snapshot %q is still remote", key)
+		}
+	}
+
+	// The upper layer is unpacked onto the lower layer.
+	if len(fs.localMounts) != 2 {
+		t.Fatalf("expected 2 unpacked layers, got %d", len(fs.localMounts))
+	}
+	var lowerdirs []string
+	for _, mounts := range fs.localMounts {
+		for _, o := range mounts[0].Options {
+			if strings.HasPrefix(o, "lowerdir=") {
+				lowerdirs = append(lowerdirs, strings.TrimPrefix(o, "lowerdir="))
+			}
+		}
+	}
+	if len(lowerdirs) != 1 || strings.Contains(lowerdirs[0], ":") {
+		t.Errorf("expected the upper layer to be unpacked onto the lower layer, got lowerdirs %v", lowerdirs)
+	}
+}
+
+func TestSortParentsFirst(t *testing.T) {
+	parents := map[string]string{
+		"c": "b",
+		"b": "a",
+		"a": "",
+		"y": "x",
+		"x": "",
+	}
+	infos := []snapshots.Info{{Name: "c"}, {Name: "y"}, {Name: "a"}, {Name: "b"}, {Name: "x"}}
+	sortParentsFirst(infos, parents)
+	pos := make(map[string]int)
+	for i, info := range infos {
+		pos[info.Name] = i
+	}
+	for name, parent := range parents {
+		if parent != "" && pos[parent] > pos[name] {
+			t.Errorf("%q is sorted before its parent %q: %v", name, parent, infos)
+		}
+	}
+}
+
 func bindFileSystem(t *testing.T) FileSystem {
 	root, err := os.MkdirTemp("", "remote")
 	if err != nil {
@@ -398,9 +475,10 @@ func bindFileSystem(t *testing.T) FileSystem {
 		t.Fatalf("failed to write sample file of bind filesystem: %q", err)
 	}
 	return &bindFs{
-		root:   root,
-		t:      t,
-		broken: make(map[string]bool),
+		root:        root,
+		t:           t,
+		broken:      make(map[string]bool),
+		localMounts: make(map[string][]mount.Mount),
 	}
 }
 
@@ -408,10 +486,15 @@ type bindFs struct {
 	t            *testing.T
 	root         string
 	checkFailure bool
+	mountFailure bool
 	broken       map[string]bool
+	localMounts  map[string][]mount.Mount
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if fs.mountFailure {
+		return fmt.Errorf("failed to mount")
+	}
 	if _, ok := labels[brokenLabel]; ok {
 		fs.broken[mountpoint] = true
 	}
@@ -435,6 +518,7 @@ func (fs *bindFs) Unmount(ctx context.Context, mountpoint string) error {
 }
 
 func (fs *bindFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.localMounts[mountpoint] = mounts
 	if _, ok := labels[brokenLabel]; ok {
 		fs.broken[mountpoint] = true
 	}
@@ -748,3 +832,51 @@ func TestOverlayView(t *testing.T) {
 		t.Errorf("expected option %q but received %q", expected, m.Options[0])
 	}
 }
+
+// sizedFs is a filesystem which finds the sizes of layers without size labels,
+// and which knows whether layers are present on the node.
+type sizedFs struct {
+	dummyFs
+	size    int64
+	present bool
+}
+
+func (fs *sizedFs) LayerSize(ctx context.Context, labels map[string]string) (int64, error) {
+	return fs.size, nil
+}
+
+func (fs *sizedFs) LayerPresent(ctx context.Context, labels map[string]string) bool {
+	return fs.present
+}
+
+func TestSkipRemoteSnapshotPrepare(t *testing.T) {
+	tests := []struct {
+		name         string
+		minLayerSize int64
+		labels       map[string]string
+		fsSize       int64
+		present      bool
+		skip         bool
+	}{
+		{name: "no thresholds", labels: map[string]string{source.TargetSizeLabel: "10"}},
+		{name: "smaller than min_layer_size", minLayerSize: 100, labels: map[string]string{source.TargetSizeLabel: "99"}, skip: true},
+		{name: "min_layer_size", minLayerSize: 100, labels: map[string]string{source.TargetSizeLabel: "100"}},
+		{name: "larger than min_layer_size", minLayerSize: 100, labels: map[string]string{source.TargetSizeLabel: "101"}},
+		{name: "invalid size label", minLayerSize: 100, labels: map[string]string{source.TargetSizeLabel: "small"}},
+		{name: "size from filesystem", minLayerSize: 100, fsSize: 50, skip: true},
+		{name: "large size from filesystem", minLayerSize: 100, fsSize: 500},
+		{name: "present layer", labels: map[string]string{source.TargetSizeLabel: "500"}, present: true, skip: true},
+		{name: "present large layer", minLayerSize: 100, fsSize: 500, present: true, skip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &snapshotter{
+				fs:           &sizedFs{size: tt.fsSize, present: tt.present},
+				minLayerSize: tt.minLayerSize,
+			}
+			if skip := o.skipRemoteSnapshotPrepare(context.Background(), tt.labels); skip != tt.skip {
+				t.Fatalf("expected skip %v, got %v", tt.skip, skip)
+			}
+		})
+	}
+}
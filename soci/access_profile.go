@@ -0,0 +1,181 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const (
+	// AccessProfileArtifactType is the artifactType of access profiles, which are pushed
+	// as referrers of image manifests.
+	AccessProfileArtifactType = "application/vnd.amazon.soci.access-profile.v1+json"
+	// AccessProfileMediaType is the mediaType of the blob of an access profile.
+	AccessProfileMediaType = "application/vnd.amazon.soci.access-profile.layer.v1+json"
+
+	// maxAccessProfileSize is the size of the largest access profile which is fetched.
+	maxAccessProfileSize = 16 << 20
+)
+
+var (
+	// ErrNoAccessProfile is returned when an image manifest has no access profile.
+	ErrNoAccessProfile = errors.New("no access profile")
+
+	// accessProfileConfigDescriptor is the descriptor of the config object of the manifests
+	// of access profiles. Its media type is the artifact type, like defaultConfigDescriptor.
+	accessProfileConfigDescriptor = ocispec.Descriptor{
+		MediaType: AccessProfileArtifactType,
+		Digest:    emptyJSONObjectDigest,
+		Size:      2,
+	}
+)
+
+// AccessProfile is the spans of the layers of an image which were read by the containers
+// of the image, aggregated from the access history of the layers on a node. Profiles are
+// pushed as referrers of image manifests, so that other nodes can prefetch these spans.
+type AccessProfile struct {
+	// Layers are the access counts of the spans of each layer, keyed by the digest of the
+	// ztoc of the layer, since the spans of a layer depend on its ztoc.
+	Layers map[string][]SpanAccessCount `json:"layers"`
+}
+
+// LoadAccessProfile returns the access profile of the image imageDigest from the access
+// history in the artifacts DB at path. It fails if the DB is locked by another process
+// for longer than timeout.
+func LoadAccessProfile(path string, timeout time.Duration, imageDigest string) (*AccessProfile, error) {
+	profile := &AccessProfile{Layers: make(map[string][]SpanAccessCount)}
+	err := viewAccessStats(path, timeout, imageDigest, func(image *bolt.Bucket) error {
+		return image.ForEach(func(k, v []byte) error {
+			b := image.Bucket(k)
+			if v != nil || b == nil {
+				return nil
+			}
+			counts, err := readAccessCounts(b)
+			if err != nil {
+				return err
+			}
+			profile.Layers[string(k)] = counts
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ImportAccessProfile adds the access counts of profile to the access history of the image
+// imageDigest in the artifacts DB at path, e.g. once it's fetched from the registry. It
+// fails if the DB is locked by another process for longer than timeout.
+func ImportAccessProfile(path string, timeout time.Duration, imageDigest string, profile *AccessProfile) error {
+	if len(profile.Layers) == 0 {
+		return nil
+	}
+	return addAccessCounts(path, timeout, imageDigest, profile.Layers)
+}
+
+// AccessProfileArtifact packs profile as an OCI 1.0 image manifest which refers to the
+// image manifest subject. It returns the manifest and the blob of the profile; the config
+// of the manifest is the empty JSON object.
+func AccessProfileArtifact(profile *AccessProfile, subject ocispec.Descriptor, created time.Time) (manifest ocispec.Manifest, blob []byte, err error) {
+	blob, err = json.Marshal(profile)
+	if err != nil {
+		return ocispec.Manifest{}, nil, err
+	}
+	manifest.SchemaVersion = 2
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = accessProfileConfigDescriptor
+	manifest.Layers = []ocispec.Descriptor{{
+		MediaType: AccessProfileMediaType,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}}
+	manifest.Subject = &ocispec.Descriptor{
+		MediaType: subject.MediaType,
+		Digest:    subject.Digest,
+		Size:      subject.Size,
+	}
+	manifest.Annotations = map[string]string{
+		ocispec.AnnotationCreated: created.UTC().Format(time.RFC3339),
+	}
+	return manifest, blob, nil
+}
+
+// AccessProfileStorage is a registry repository from which access profiles are fetched.
+type AccessProfileStorage interface {
+	orascontent.Fetcher
+	Referrers(ctx context.Context, desc ocispec.Descriptor, artifactType string, fn func(referrers []ocispec.Descriptor) error) error
+}
+
+// FetchAccessProfile fetches the most recent access profile which refers to the image
+// manifest subject from repo. It returns ErrNoAccessProfile if there is none.
+func FetchAccessProfile(ctx context.Context, repo AccessProfileStorage, subject ocispec.Descriptor) (*AccessProfile, error) {
+	var latest *ocispec.Descriptor
+	err := repo.Referrers(ctx, subject, AccessProfileArtifactType, func(referrers []ocispec.Descriptor) error {
+		for i := range referrers {
+			// RFC 3339 timestamps in UTC sort lexicographically.
+			if latest == nil || referrers[i].Annotations[ocispec.AnnotationCreated] > latest.Annotations[ocispec.AnnotationCreated] {
+				latest = &referrers[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access profiles: %w", err)
+	}
+	if latest == nil {
+		return nil, ErrNoAccessProfile
+	}
+	if latest.Size > maxAccessProfileSize {
+		return nil, fmt.Errorf("access profile manifest %s is too large: %d bytes", latest.Digest, latest.Size)
+	}
+	b, err := orascontent.FetchAll(ctx, repo, *latest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch access profile manifest %s: %w", latest.Digest, err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid access profile manifest %s: %w", latest.Digest, err)
+	}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != AccessProfileMediaType {
+			continue
+		}
+		if desc.Size > maxAccessProfileSize {
+			return nil, fmt.Errorf("access profile %s is too large: %d bytes", desc.Digest, desc.Size)
+		}
+		b, err := orascontent.FetchAll(ctx, repo, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch access profile %s: %w", desc.Digest, err)
+		}
+		var profile AccessProfile
+		if err := json.Unmarshal(b, &profile); err != nil {
+			return nil, fmt.Errorf("invalid access profile %s: %w", desc.Digest, err)
+		}
+		return &profile, nil
+	}
+	return nil, fmt.Errorf("access profile manifest %s has no access profile", latest.Digest)
+}
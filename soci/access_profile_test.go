@@ -0,0 +1,128 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// profileRepo is a repository whose referrers are the access profiles pushed to it.
+type profileRepo struct {
+	*memory.Store
+	referrers []ocispec.Descriptor
+}
+
+func (r *profileRepo) Referrers(_ context.Context, _ ocispec.Descriptor, artifactType string, fn func([]ocispec.Descriptor) error) error {
+	var referrers []ocispec.Descriptor
+	for _, desc := range r.referrers {
+		if desc.ArtifactType == artifactType {
+			referrers = append(referrers, desc)
+		}
+	}
+	return fn(referrers)
+}
+
+func (r *profileRepo) pushProfile(t *testing.T, profile *AccessProfile, subject ocispec.Descriptor, created time.Time) {
+	manifest, blob, err := AccessProfileArtifact(profile, subject, created)
+	if err != nil {
+		t.Fatalf("failed to pack access profile: %v", err)
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType:    manifest.MediaType,
+		ArtifactType: manifest.Config.MediaType,
+		Digest:       digest.FromBytes(manifestBytes),
+		Size:         int64(len(manifestBytes)),
+		Annotations:  manifest.Annotations,
+	}
+	for _, c := range []struct {
+		desc ocispec.Descriptor
+		b    []byte
+	}{{manifest.Layers[0], blob}, {manifestDesc, manifestBytes}} {
+		if err := r.Push(context.Background(), c.desc, bytes.NewReader(c.b)); err != nil {
+			t.Fatalf("failed to push %s: %v", c.desc.Digest, err)
+		}
+	}
+	r.referrers = append(r.referrers, manifestDesc)
+}
+
+func TestAccessProfile(t *testing.T) {
+	const (
+		image    = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		ztocDgst = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	)
+	path := filepath.Join(t.TempDir(), "artifacts.db")
+	for _, accessed := range [][]compression.SpanID{{4, 2}, {2}} {
+		if err := RecordAccessedSpans(path, time.Second, image, ztocDgst, accessed); err != nil {
+			t.Fatalf("failed to record accessed spans: %v", err)
+		}
+	}
+	profile, err := LoadAccessProfile(path, time.Second, image)
+	if err != nil {
+		t.Fatalf("failed to load access profile: %v", err)
+	}
+	expected := &AccessProfile{Layers: map[string][]SpanAccessCount{
+		ztocDgst: {{SpanID: 2, Count: 2}, {SpanID: 4, Count: 1}},
+	}}
+	if !reflect.DeepEqual(profile, expected) {
+		t.Fatalf("expected profile %+v, got %+v", expected, profile)
+	}
+
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.Digest(image), Size: 100}
+	repo := &profileRepo{Store: memory.New()}
+	if _, err := FetchAccessProfile(context.Background(), repo, subject); !errors.Is(err, ErrNoAccessProfile) {
+		t.Fatalf("expected ErrNoAccessProfile, got %v", err)
+	}
+	now := time.Now()
+	repo.pushProfile(t, profile, subject, now)
+	repo.pushProfile(t, &AccessProfile{}, subject, now.Add(-time.Hour))
+	fetched, err := FetchAccessProfile(context.Background(), repo, subject)
+	if err != nil {
+		t.Fatalf("failed to fetch access profile: %v", err)
+	}
+	if !reflect.DeepEqual(fetched, expected) {
+		t.Fatalf("expected the latest profile %+v, got %+v", expected, fetched)
+	}
+
+	// another node imports the profile into its access history.
+	otherPath := filepath.Join(t.TempDir(), "artifacts.db")
+	if err := ImportAccessProfile(otherPath, time.Second, image, fetched); err != nil {
+		t.Fatalf("failed to import access profile: %v", err)
+	}
+	spans, err := AccessedSpans(otherPath, time.Second, image, ztocDgst, 0)
+	if err != nil {
+		t.Fatalf("failed to load accessed spans: %v", err)
+	}
+	if !reflect.DeepEqual(spans, []compression.SpanID{2, 4}) {
+		t.Fatalf("expected spans [2 4], got %v", spans)
+	}
+}
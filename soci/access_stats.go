@@ -0,0 +1,192 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The spans of layers read by the containers of images are stored in the artifacts DB
+// in the following schema.
+//
+// - access_stats
+//       - *image_digest*               : bucket for each image manifest
+//         - *ztoc_digest*              : bucket for each layer of the image, keyed by its ztoc
+//                                        since the spans of a layer depend on its ztoc.
+//           - *span_id* : <uvarint>    : the number of mounts the span was read in.
+//                                        Span IDs are big endian uint32 keys.
+
+var bucketKeyAccessStats = []byte("access_stats")
+
+// SpanAccessCount is the number of mounts of a layer a span was read in.
+type SpanAccessCount struct {
+	SpanID compression.SpanID `json:"spanId"`
+	Count  uint64             `json:"count"`
+}
+
+// RecordAccessedSpans adds one to the access counts of spans of the layer with the ztoc
+// ztocDigest mounted for the image imageDigest, in the artifacts DB at path. The DB is
+// only open while the stats are written, so that it can be used by the CLI; it fails if
+// the DB is locked by another process for longer than timeout.
+func RecordAccessedSpans(path string, timeout time.Duration, imageDigest, ztocDigest string, spans []compression.SpanID) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	counts := make([]SpanAccessCount, len(spans))
+	for i, id := range spans {
+		counts[i] = SpanAccessCount{SpanID: id, Count: 1}
+	}
+	return addAccessCounts(path, timeout, imageDigest, map[string][]SpanAccessCount{ztocDigest: counts})
+}
+
+// AccessedSpans returns the spans of the layer with the ztoc ztocDigest which were read
+// when it was mounted for the image imageDigest, as recorded by RecordAccessedSpans in
+// the artifacts DB at path. The spans read in the most mounts come first, and spans read
+// equally often are in the order of the layer. At most max spans are returned if max is
+// positive. It fails if the DB is locked by another process for longer than timeout.
+func AccessedSpans(path string, timeout time.Duration, imageDigest, ztocDigest string, max int) ([]compression.SpanID, error) {
+	var counts []SpanAccessCount
+	err := viewAccessStats(path, timeout, imageDigest, func(image *bolt.Bucket) (err error) {
+		if b := image.Bucket([]byte(ztocDigest)); b != nil {
+			counts, err = readAccessCounts(b)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(counts) > max {
+		counts = counts[:max]
+	}
+	var spans []compression.SpanID
+	for _, c := range counts {
+		spans = append(spans, c.SpanID)
+	}
+	return spans, nil
+}
+
+// addAccessCounts adds counts, by ztoc digest, to the access counts of the layers of the
+// image imageDigest in the artifacts DB at path.
+func addAccessCounts(path string, timeout time.Duration, imageDigest string, counts map[string][]SpanAccessCount) error {
+	database, err := openAccessStatsDB(path, timeout, false)
+	if err != nil {
+		return err
+	}
+	defer closeAccessStatsDB(database)
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.ArtifactsDB, commonmetrics.DBTxUpdate, time.Now())
+	return database.Update(func(tx *bolt.Tx) error {
+		image, err := tx.CreateBucketIfNotExists(bucketKeyAccessStats)
+		if err != nil {
+			return err
+		}
+		if image, err = image.CreateBucketIfNotExists([]byte(imageDigest)); err != nil {
+			return err
+		}
+		key := make([]byte, 4)
+		val := make([]byte, binary.MaxVarintLen64)
+		for ztocDigest, spans := range counts {
+			b, err := image.CreateBucketIfNotExists([]byte(ztocDigest))
+			if err != nil {
+				return err
+			}
+			for _, s := range spans {
+				binary.BigEndian.PutUint32(key, uint32(s.SpanID))
+				var count uint64
+				if v := b.Get(key); v != nil {
+					count, _ = binary.Uvarint(v)
+				}
+				if err := b.Put(key, val[:binary.PutUvarint(val, count+s.Count)]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// viewAccessStats calls fn with the bucket of the access stats of the image imageDigest
+// in the artifacts DB at path, unless the image has no access stats.
+func viewAccessStats(path string, timeout time.Duration, imageDigest string, fn func(*bolt.Bucket) error) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	database, err := openAccessStatsDB(path, timeout, true)
+	if err != nil {
+		return err
+	}
+	defer closeAccessStatsDB(database)
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.ArtifactsDB, commonmetrics.DBTxView, time.Now())
+	return database.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeyAccessStats)
+		if b != nil {
+			b = b.Bucket([]byte(imageDigest))
+		}
+		if b == nil {
+			return nil
+		}
+		return fn(b)
+	})
+}
+
+// readAccessCounts returns the access counts of the spans of a layer in b, the most
+// read first. Spans read equally often are in the order of the layer.
+func readAccessCounts(b *bolt.Bucket) ([]SpanAccessCount, error) {
+	var counts []SpanAccessCount
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) != 4 {
+			return fmt.Errorf("invalid span ID key %x", k)
+		}
+		count, n := binary.Uvarint(v)
+		if n <= 0 {
+			return fmt.Errorf("invalid access count of span %d", binary.BigEndian.Uint32(k))
+		}
+		counts = append(counts, SpanAccessCount{SpanID: compression.SpanID(binary.BigEndian.Uint32(k)), Count: count})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the keys are in the order of the layer, which is kept for equal counts.
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	return counts, nil
+}
+
+func openAccessStatsDB(path string, timeout time.Duration, readOnly bool) (*bolt.DB, error) {
+	database, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	commonmetrics.AddOpenDBCount(commonmetrics.ArtifactsDB, 1)
+	return database, nil
+}
+
+func closeAccessStatsDB(database *bolt.DB) {
+	txStats := database.Stats().TxStats
+	commonmetrics.AddDBPageAllocations(commonmetrics.ArtifactsDB, txStats.GetPageCount(), txStats.GetPageAlloc())
+	database.Close()
+	commonmetrics.AddOpenDBCount(commonmetrics.ArtifactsDB, -1)
+}
@@ -0,0 +1,75 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func TestAccessedSpans(t *testing.T) {
+	const (
+		image1   = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		image2   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		ztocDgst = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	)
+	path := filepath.Join(t.TempDir(), "artifacts.db")
+
+	spans, err := AccessedSpans(path, time.Second, image1, ztocDgst, 0)
+	if err != nil || spans != nil {
+		t.Fatalf("expected no spans without DB, got %v, %v", spans, err)
+	}
+
+	for _, accessed := range [][]compression.SpanID{{7, 2, 300}, {2, 300}, {300}, nil} {
+		if err := RecordAccessedSpans(path, time.Second, image1, ztocDgst, accessed); err != nil {
+			t.Fatalf("failed to record accessed spans: %v", err)
+		}
+	}
+	if err := RecordAccessedSpans(path, time.Second, image2, ztocDgst, []compression.SpanID{1}); err != nil {
+		t.Fatalf("failed to record accessed spans: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		image string
+		ztoc  string
+		max   int
+		want  []compression.SpanID
+	}{
+		{name: "most accessed first", image: image1, ztoc: ztocDgst, want: []compression.SpanID{300, 2, 7}},
+		{name: "at most max", image: image1, ztoc: ztocDgst, max: 2, want: []compression.SpanID{300, 2}},
+		{name: "other image", image: image2, ztoc: ztocDgst, want: []compression.SpanID{1}},
+		{name: "unknown ztoc", image: image1, ztoc: image2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans, err := AccessedSpans(path, time.Second, tt.image, tt.ztoc, tt.max)
+			if err != nil {
+				t.Fatalf("failed to load accessed spans: %v", err)
+			}
+			if len(spans) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(spans, tt.want) {
+					t.Fatalf("expected spans %v, got %v", tt.want, spans)
+				}
+			}
+		})
+	}
+}
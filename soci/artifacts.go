@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/fs/config"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
@@ -40,6 +41,7 @@ import (
 //         - originalDigest : <string>  : the digest for the image manifest or layer
 //         - imageDigest: <string>      : the digest of the image index
 //         - platform: <string>         : the platform for the index
+//         - imageRef: <string>         : the name of the image the index was built for
 //         - location: <string>         : the location of the artifact
 //         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
 
@@ -61,6 +63,7 @@ var (
 	bucketKeyOriginalDigest = []byte("oci_digest")
 	bucketKeyImageDigest    = []byte("image_digest")
 	bucketKeyPlatform       = []byte("platform")
+	bucketKeyImageRef       = []byte("image_ref")
 	bucketKeyLocation       = []byte("location")
 	bucketKeyType           = []byte("type")
 	bucketKeyMediaType      = []byte("media_type")
@@ -94,6 +97,10 @@ type ArtifactEntry struct {
 	ImageDigest string
 	// Platform is the platform for which the artifact was generated.
 	Platform string
+	// ImageRef is the name of the image for which a SOCI index was generated, so that
+	// indices can be found once the name refers to another image. It is empty for
+	// indices generated before it was recorded.
+	ImageRef string
 	// Location is the file path for the SOCI artifact.
 	Location string
 	// Type is the type of SOCI artifact.
@@ -118,6 +125,7 @@ func NewDB(path string) (*ArtifactsDb, error) {
 			log.G(context.Background()).Errorf("can't open the db")
 			return
 		}
+		commonmetrics.AddOpenDBCount(commonmetrics.ArtifactsDB, 1)
 		db = &ArtifactsDb{db: database}
 	})
 
@@ -128,6 +136,16 @@ func NewDB(path string) (*ArtifactsDb, error) {
 	return db, nil
 }
 
+func (db *ArtifactsDb) view(fn func(*bolt.Tx) error) error {
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.ArtifactsDB, commonmetrics.DBTxView, time.Now())
+	return db.db.View(fn)
+}
+
+func (db *ArtifactsDb) update(fn func(*bolt.Tx) error) error {
+	defer commonmetrics.MeasureDBTransaction(commonmetrics.ArtifactsDB, commonmetrics.DBTxUpdate, time.Now())
+	return db.db.Update(fn)
+}
+
 func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
 	artifactEntries := []ArtifactEntry{}
 	err := db.Walk(func(ae *ArtifactEntry) error {
@@ -143,7 +161,7 @@ func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEn
 
 // Walk applys a function to all ArtifactEntries in the ArtifactsDB
 func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
-	err := db.db.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
 		if err != nil {
 			return nil
@@ -168,7 +186,7 @@ func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 // GetArtifactEntry loads a single ArtifactEntry from the ArtifactsDB by digest
 func (db *ArtifactsDb) GetArtifactEntry(digest string) (*ArtifactEntry, error) {
 	entry := ArtifactEntry{}
-	err := db.db.View(func(tx *bolt.Tx) error {
+	err := db.view(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
 		if err != nil {
 			return err
@@ -198,7 +216,7 @@ func (db *ArtifactsDb) GetArtifactType(digest string) (ArtifactEntryType, error)
 
 // RemoveArtifactEntryByIndexDigest removes an index's artifact entry using its digest
 func (db *ArtifactsDb) RemoveArtifactEntryByIndexDigest(digest string) error {
-	return db.db.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
 		if err != nil {
 			return err
@@ -218,7 +236,7 @@ func (db *ArtifactsDb) RemoveArtifactEntryByIndexDigest(digest string) error {
 
 // RemoveArtifactEntryByIndexDigest removes an index's artifact entry using the image digest
 func (db *ArtifactsDb) RemoveArtifactEntryByImageDigest(digest string) error {
-	return db.db.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		bucket, err := getArtifactsBucket(tx)
 		if err != nil {
 			return err
@@ -254,7 +272,7 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 	if entry == nil {
 		return fmt.Errorf("no entry to write")
 	}
-	err := db.db.Update(func(tx *bolt.Tx) error {
+	err := db.update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(bucketKeySociArtifacts)
 		if err != nil {
 			return err
@@ -303,6 +321,7 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.OriginalDigest = string(artifactBkt.Get(bucketKeyOriginalDigest))
 	ae.ImageDigest = string(artifactBkt.Get(bucketKeyImageDigest))
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
+	ae.ImageRef = string(artifactBkt.Get(bucketKeyImageRef))
 	ae.MediaType = string(artifactBkt.Get(bucketKeyMediaType))
 	ae.CreatedAt = createdAt
 	return &ae, nil
@@ -337,6 +356,7 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyOriginalDigest, []byte(ae.OriginalDigest)},
 		{bucketKeyImageDigest, []byte(ae.ImageDigest)},
 		{bucketKeyPlatform, []byte(ae.Platform)},
+		{bucketKeyImageRef, []byte(ae.ImageRef)},
 		{bucketKeyType, []byte(ae.Type)},
 		{bucketKeyMediaType, []byte(ae.MediaType)},
 		{bucketKeyCreatedAt, createdAt},
@@ -350,3 +370,56 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 
 	return nil
 }
+
+// RepairDB removes the entries of the artifacts DB at path which can't be loaded, or for
+// which remove returns true, e.g. because their artifacts are missing after an unclean
+// shutdown. The DB must not be open in this process. It fails if the DB is locked by
+// another process for longer than timeout. It returns the digests of the removed entries.
+func RepairDB(path string, timeout time.Duration, remove func(*ArtifactEntry) bool) ([]string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	database, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	commonmetrics.AddOpenDBCount(commonmetrics.ArtifactsDB, 1)
+	defer func() {
+		txStats := database.Stats().TxStats
+		commonmetrics.AddDBPageAllocations(commonmetrics.ArtifactsDB, txStats.GetPageCount(), txStats.GetPageAlloc())
+		database.Close()
+		commonmetrics.AddOpenDBCount(commonmetrics.ArtifactsDB, -1)
+	}()
+	start := time.Now()
+	var removed []string
+	err = database.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketKeySociArtifacts)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			// Skip non-buckets
+			if v != nil {
+				continue
+			}
+			ae, err := loadArtifact(bucket.Bucket(k), string(k))
+			if err == nil && !remove(ae) {
+				continue
+			}
+			removed = append(removed, string(k))
+		}
+		// buckets aren't deleted while iterating, since it invalidates the cursor.
+		for _, k := range removed {
+			if err := bucket.DeleteBucket([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	commonmetrics.MeasureDBTransaction(commonmetrics.ArtifactsDB, commonmetrics.DBTxUpdate, start)
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
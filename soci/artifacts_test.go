@@ -114,6 +114,7 @@ func TestArtifactEntry_ReadWrite_Using_ArtifactsDb(t *testing.T) {
 		originalDgst = "sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
 		imageDigest  = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
 		platform     = "linux/amd64"
+		imageRef     = "docker.io/library/busybox:latest"
 	)
 	ae := &ArtifactEntry{
 		Size:           10,
@@ -123,6 +124,7 @@ func TestArtifactEntry_ReadWrite_Using_ArtifactsDb(t *testing.T) {
 		Type:           ArtifactEntryTypeIndex,
 		ImageDigest:    imageDigest,
 		Platform:       platform,
+		ImageRef:       imageRef,
 	}
 	err = db.WriteArtifactEntry(ae)
 	if err != nil {
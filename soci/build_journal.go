@@ -0,0 +1,169 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const buildJournalsDirName = "build-journals"
+
+// BuildJournalsDir returns the default directory of the journals of SOCI index builds.
+func BuildJournalsDir() string {
+	return path.Join(config.SociSnapshotterRootPath, buildJournalsDirName)
+}
+
+// buildJournalOptions are the build options which change the ztocs of a build. A
+// journal is only resumed by a build with the same options.
+type buildJournalOptions struct {
+	SpanSize            int64            `json:"spanSize"`
+	MinLayerSize        int64            `json:"minLayerSize"`
+	BuildToolIdentifier string           `json:"buildToolIdentifier"`
+	DigestAlgorithm     digest.Algorithm `json:"digestAlgorithm"`
+	Reproducible        bool             `json:"reproducible"`
+	ChunkSize           int64            `json:"chunkSize"`
+}
+
+// buildJournal records the ztocs which a build of a SOCI index already pushed to the
+// local store, so that an interrupted build can be resumed without building them again.
+type buildJournal struct {
+	mu   sync.Mutex
+	path string
+
+	ManifestDigest digest.Digest       `json:"manifestDigest"`
+	Platform       string              `json:"platform"`
+	Options        buildJournalOptions `json:"options"`
+	// Ztocs are the descriptors of the ztocs by the digest of their image layer.
+	Ztocs map[digest.Digest]ocispec.Descriptor `json:"ztocs"`
+}
+
+func newBuildJournalOptions(c *buildConfig) buildJournalOptions {
+	return buildJournalOptions{
+		SpanSize:            c.spanSize,
+		MinLayerSize:        c.minLayerSize,
+		BuildToolIdentifier: c.buildToolIdentifier,
+		DigestAlgorithm:     c.digestAlgorithm,
+		Reproducible:        c.reproducible,
+		ChunkSize:           c.chunkSize,
+	}
+}
+
+// buildJournalPath returns the path of the journal of the build of the image manifest
+// manifestDigest in dir.
+func buildJournalPath(dir string, manifestDigest digest.Digest) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", manifestDigest.Algorithm(), manifestDigest.Encoded()))
+}
+
+// openBuildJournal returns the journal of the build of the image manifest manifestDigest
+// in dir. If resume is set, it returns the ztocs recorded by a previous build with the
+// same platform and options. Otherwise, or if there is no such journal, it returns an
+// empty journal, which replaces the previous one once a ztoc is recorded.
+func openBuildJournal(dir string, manifestDigest digest.Digest, platform ocispec.Platform, opts buildJournalOptions, resume bool) (*buildJournal, bool, error) {
+	j := &buildJournal{
+		path:           buildJournalPath(dir, manifestDigest),
+		ManifestDigest: manifestDigest,
+		Platform:       platforms.Format(platform),
+		Options:        opts,
+		Ztocs:          make(map[digest.Digest]ocispec.Descriptor),
+	}
+	if !resume {
+		return j, false, nil
+	}
+	b, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("cannot read build journal: %w", err)
+	}
+	var prev buildJournal
+	if err := json.Unmarshal(b, &prev); err != nil {
+		return nil, false, fmt.Errorf("cannot parse build journal %s: %w", j.path, err)
+	}
+	if prev.ManifestDigest != j.ManifestDigest || prev.Platform != j.Platform || prev.Options != j.Options {
+		return j, false, nil
+	}
+	for layer, desc := range prev.Ztocs {
+		j.Ztocs[layer] = desc
+	}
+	return j, true, nil
+}
+
+// ztoc returns the descriptor of the ztoc recorded for the image layer layerDigest.
+func (j *buildJournal) ztoc(layerDigest digest.Digest) (ocispec.Descriptor, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	desc, ok := j.Ztocs[layerDigest]
+	return desc, ok
+}
+
+// record records the ztoc desc of the image layer layerDigest and writes the journal.
+// The journal is replaced atomically, so that an interrupted write leaves the previous
+// journal.
+func (j *buildJournal) record(layerDigest digest.Digest, desc ocispec.Descriptor) (retErr error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Ztocs[layerDigest] = desc
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(j.path), ".tmp-journal-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), j.path)
+}
+
+// remove removes the journal once the build is complete.
+func (j *buildJournal) remove() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildJournal(t *testing.T) {
+	dir := t.TempDir()
+	manifest := digest.FromString("manifest")
+	platform := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	opts := buildJournalOptions{SpanSize: 1 << 22, MinLayerSize: 10 << 20, DigestAlgorithm: digest.SHA256}
+	layer := digest.FromString("layer")
+	ztocDesc := ocispec.Descriptor{
+		MediaType: SociLayerMediaType,
+		Digest:    digest.FromString("ztoc"),
+		Size:      100,
+		Annotations: map[string]string{
+			IndexAnnotationImageLayerDigest: layer.String(),
+		},
+	}
+
+	j, resumed, err := openBuildJournal(dir, manifest, platform, opts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed {
+		t.Fatal("resumed a build without a journal")
+	}
+	if err := j.record(layer, ztocDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	otherOpts := opts
+	otherOpts.ChunkSize = 1 << 20
+	tests := []struct {
+		name     string
+		platform ocispec.Platform
+		opts     buildJournalOptions
+		resume   bool
+		want     bool
+	}{
+		{"resume", platform, opts, true, true},
+		{"don't resume", platform, opts, false, false},
+		{"other options", platform, otherOpts, true, false},
+		{"other platform", ocispec.Platform{OS: "linux", Architecture: "arm64"}, opts, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, resumed, err := openBuildJournal(dir, manifest, tt.platform, tt.opts, tt.resume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resumed != tt.want {
+				t.Fatalf("resumed is %v; want %v", resumed, tt.want)
+			}
+			desc, ok := j.ztoc(layer)
+			if ok != tt.want {
+				t.Fatalf("ztoc of the layer recorded is %v; want %v", ok, tt.want)
+			}
+			if ok {
+				if diff := cmp.Diff(ztocDesc, desc); diff != "" {
+					t.Errorf("unexpected ztoc descriptor (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+
+	if err := j.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(buildJournalPath(dir, manifest)); !os.IsNotExist(err) {
+		t.Errorf("journal wasn't removed: %v", err)
+	}
+	if err := j.remove(); err != nil {
+		t.Errorf("removing a removed journal failed: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const (
+	// mediaTypeDockerSchema1SignedManifest is the media type of the signed docker schema 1
+	// manifests which some registries still serve for old images.
+	mediaTypeDockerSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// ErrUnsupportedMediaType is returned for images whose media types can't be indexed or
+// lazily loaded, e.g. docker schema 1 images.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// NormalizeMediaType returns mediaType in lower case and without parameters, e.g. the
+// charset which some registries add to the content type of manifests, so that it can be
+// compared with the OCI and Docker media types.
+func NormalizeMediaType(mediaType string) string {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+			mediaType = mediaType[:i]
+		}
+		return strings.ToLower(strings.TrimSpace(mediaType))
+	}
+	return mt
+}
+
+// IsImageIndexType returns whether mediaType is the media type of an OCI image index or a
+// docker manifest list.
+func IsImageIndexType(mediaType string) bool {
+	return images.IsIndexType(NormalizeMediaType(mediaType))
+}
+
+// IsImageManifestType returns whether mediaType is the media type of an OCI image manifest
+// or a docker schema 2 manifest.
+func IsImageManifestType(mediaType string) bool {
+	return images.IsManifestType(NormalizeMediaType(mediaType))
+}
+
+// IsImageLayerType returns whether mediaType is the media type of an OCI or docker image
+// layer.
+func IsImageLayerType(mediaType string) bool {
+	return images.IsLayerType(NormalizeMediaType(mediaType))
+}
+
+// ManifestMediaType returns the normalized media type of the manifest or index b, which
+// was served with mediaType. If mediaType isn't the media type of an image manifest or
+// index, e.g. because the registry served a generic content type, the media type is
+// detected from b, which may be nil if it wasn't fetched. It returns
+// ErrUnsupportedMediaType for docker schema 1 manifests and for contents which are
+// neither image manifests nor indices.
+func ManifestMediaType(mediaType string, b []byte) (string, error) {
+	mt := NormalizeMediaType(mediaType)
+	if images.IsIndexType(mt) || images.IsManifestType(mt) {
+		return mt, nil
+	}
+	if len(b) == 0 {
+		if isDockerSchema1Type(mt) {
+			return "", dockerSchema1Error(mt)
+		}
+		return "", fmt.Errorf("%w %q", ErrUnsupportedMediaType, mediaType)
+	}
+	// schema 1 media types are checked against the content too, since containerd takes
+	// text/plain for schema 1. The media type field of OCI manifests is optional, so
+	// manifests without it are detected from their fields.
+	var m struct {
+		SchemaVersion int               `json:"schemaVersion"`
+		MediaType     string            `json:"mediaType"`
+		Config        json.RawMessage   `json:"config"`
+		Layers        json.RawMessage   `json:"layers"`
+		Manifests     json.RawMessage   `json:"manifests"`
+		FSLayers      []json.RawMessage `json:"fsLayers"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", fmt.Errorf("%w %q: %v", ErrUnsupportedMediaType, mediaType, err)
+	}
+	detected := NormalizeMediaType(m.MediaType)
+	switch {
+	case images.IsIndexType(detected) || images.IsManifestType(detected):
+		return detected, nil
+	case isDockerSchema1Type(detected) || m.SchemaVersion == 1 || m.FSLayers != nil:
+		return "", dockerSchema1Error(images.MediaTypeDockerSchema1Manifest)
+	case m.SchemaVersion == 2 && m.Manifests != nil:
+		return ocispec.MediaTypeImageIndex, nil
+	case m.SchemaVersion == 2 && m.Config != nil && m.Layers != nil:
+		return ocispec.MediaTypeImageManifest, nil
+	}
+	return "", fmt.Errorf("%w %q: not an image manifest or index", ErrUnsupportedMediaType, mediaType)
+}
+
+// FetchManifest fetches the image manifest or index desc from manifests, e.g. the
+// manifests of a remote repository, and returns it and its normalized media type.
+// Manifests must be fetched from the manifests of repositories, since their media
+// types may be generic.
+func FetchManifest(ctx context.Context, manifests orascontent.Fetcher, desc ocispec.Descriptor) ([]byte, string, error) {
+	b, err := orascontent.FetchAll(ctx, manifests, desc)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot fetch %s: %w", desc.Digest, err)
+	}
+	mediaType, err := ManifestMediaType(desc.MediaType, b)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot fetch %s: %w", desc.Digest, err)
+	}
+	return b, mediaType, nil
+}
+
+func isDockerSchema1Type(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema1Manifest || mediaType == mediaTypeDockerSchema1SignedManifest
+}
+
+func dockerSchema1Error(mediaType string) error {
+	return fmt.Errorf("%w %q: docker schema 1 images aren't supported, push the image with a recent client to convert it to schema 2",
+		ErrUnsupportedMediaType, mediaType)
+}
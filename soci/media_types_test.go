@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNormalizeMediaType(t *testing.T) {
+	testCases := []struct {
+		name      string
+		mediaType string
+		expected  string
+	}{
+		{
+			name:      "oci manifest",
+			mediaType: ocispec.MediaTypeImageManifest,
+			expected:  ocispec.MediaTypeImageManifest,
+		},
+		{
+			name:      "docker manifest with charset",
+			mediaType: images.MediaTypeDockerSchema2Manifest + "; charset=utf-8",
+			expected:  images.MediaTypeDockerSchema2Manifest,
+		},
+		{
+			name:      "docker manifest list in upper case",
+			mediaType: "Application/VND.Docker.Distribution.Manifest.List.V2+JSON",
+			expected:  images.MediaTypeDockerSchema2ManifestList,
+		},
+		{
+			name:      "malformed parameters",
+			mediaType: images.MediaTypeDockerSchema2LayerGzip + "; =",
+			expected:  images.MediaTypeDockerSchema2LayerGzip,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := NormalizeMediaType(tc.mediaType); got != tc.expected {
+				t.Fatalf("unexpected media type: expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestManifestMediaType(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mediaType   string
+		content     string
+		expected    string
+		unsupported bool
+	}{
+		{
+			name:      "docker manifest list",
+			mediaType: images.MediaTypeDockerSchema2ManifestList,
+			expected:  images.MediaTypeDockerSchema2ManifestList,
+		},
+		{
+			name:      "docker manifest with charset",
+			mediaType: images.MediaTypeDockerSchema2Manifest + "; charset=utf-8",
+			expected:  images.MediaTypeDockerSchema2Manifest,
+		},
+		{
+			name:      "oci index in upper case",
+			mediaType: "APPLICATION/VND.OCI.IMAGE.INDEX.V1+JSON",
+			expected:  ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:      "docker manifest served as text/plain",
+			mediaType: "text/plain",
+			content:   `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{},"layers":[]}`,
+			expected:  images.MediaTypeDockerSchema2Manifest,
+		},
+		{
+			name:      "oci manifest without media type",
+			mediaType: "application/octet-stream",
+			content:   `{"schemaVersion":2,"config":{},"layers":[]}`,
+			expected:  ocispec.MediaTypeImageManifest,
+		},
+		{
+			name:      "oci index without media type",
+			mediaType: "application/json",
+			content:   `{"schemaVersion":2,"manifests":[]}`,
+			expected:  ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:        "signed docker schema 1 manifest",
+			mediaType:   mediaTypeDockerSchema1SignedManifest,
+			unsupported: true,
+		},
+		{
+			name:        "docker schema 1 manifest served as text/plain",
+			mediaType:   "text/plain",
+			content:     `{"schemaVersion":1,"name":"library/busybox","tag":"latest","fsLayers":[]}`,
+			unsupported: true,
+		},
+		{
+			name:        "unknown media type without content",
+			mediaType:   "application/octet-stream",
+			unsupported: true,
+		},
+		{
+			name:        "not a manifest",
+			mediaType:   "application/json",
+			content:     `{"schemaVersion":2}`,
+			unsupported: true,
+		},
+		{
+			name:        "not json",
+			mediaType:   "text/plain",
+			content:     "not json",
+			unsupported: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ManifestMediaType(tc.mediaType, []byte(tc.content))
+			if tc.unsupported {
+				if !errors.Is(err, ErrUnsupportedMediaType) {
+					t.Fatalf("expected ErrUnsupportedMediaType, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("unexpected media type: expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
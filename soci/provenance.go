@@ -0,0 +1,119 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexAnnotationProvenance is the index annotation for the provenance record of the index.
+const IndexAnnotationProvenance = "com.amazon.soci.provenance"
+
+// ErrNoProvenance is returned by `ProvenanceFromIndex` when the index doesn't have
+// a provenance record, e.g. because it was built by an older version of soci.
+var ErrNoProvenance = errors.New("index has no provenance record")
+
+// Provenance records how a SOCI index was built.
+type Provenance struct {
+	// BuildToolIdentifier identifies the tool that built the index.
+	// It's empty for indices built with `WithReproducible`.
+	BuildToolIdentifier string `json:"buildToolIdentifier,omitempty"`
+	// ImageManifest is the digest of the image manifest the index was built for.
+	ImageManifest digest.Digest `json:"imageManifest"`
+	// Platform is the platform of the image manifest.
+	Platform ocispec.Platform `json:"platform"`
+	// SpanSize is the span size the ztocs were built with.
+	SpanSize int64 `json:"spanSize"`
+	// MinLayerSize is the size below which layers were skipped.
+	MinLayerSize int64 `json:"minLayerSize"`
+	// DigestAlgorithm is the algorithm of the digests of the ztocs and the index.
+	DigestAlgorithm digest.Algorithm `json:"digestAlgorithm"`
+	// Layers records each layer of the image manifest, in order.
+	Layers []LayerProvenance `json:"layers"`
+}
+
+// LayerProvenance records how the ztoc of a layer was built, or why it wasn't.
+type LayerProvenance struct {
+	// Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest"`
+	// MediaType is the media type of the layer.
+	MediaType string `json:"mediaType"`
+	// Size is the size of the layer.
+	Size int64 `json:"size"`
+	// Ztoc is the digest of the ztoc of the layer. It's empty if the layer was skipped.
+	Ztoc digest.Digest `json:"ztoc,omitempty"`
+	// Skipped is the reason why no ztoc was built for the layer.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// newProvenance returns the provenance record of an index built by `b` for the
+// image manifest `manifestDesc`, whose layers are `layers` and whose ztocs are `ztocs`.
+// `ztocs` has an entry per layer, which is nil for skipped layers.
+func (b *IndexBuilder) newProvenance(manifestDesc ocispec.Descriptor, layers []ocispec.Descriptor, ztocs []*ocispec.Descriptor) *Provenance {
+	p := &Provenance{
+		ImageManifest:   manifestDesc.Digest,
+		Platform:        b.config.platform,
+		SpanSize:        b.config.spanSize,
+		MinLayerSize:    b.config.minLayerSize,
+		DigestAlgorithm: b.config.digestAlgorithm,
+		Layers:          make([]LayerProvenance, 0, len(layers)),
+	}
+	if !b.config.reproducible {
+		p.BuildToolIdentifier = b.config.buildToolIdentifier
+	}
+	for i, l := range layers {
+		lp := LayerProvenance{
+			Digest:    l.Digest,
+			MediaType: l.MediaType,
+			Size:      l.Size,
+		}
+		if ztocs[i] != nil {
+			lp.Ztoc = ztocs[i].Digest
+		} else {
+			lp.Skipped = fmt.Sprintf("smaller than the minimum layer size (%d bytes)", b.config.minLayerSize)
+		}
+		p.Layers = append(p.Layers, lp)
+	}
+	return p
+}
+
+// annotation returns the provenance record as the value of `IndexAnnotationProvenance`.
+func (p *Provenance) annotation() (string, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal provenance: %w", err)
+	}
+	return string(b), nil
+}
+
+// ProvenanceFromIndex returns the provenance record of a SOCI index.
+func ProvenanceFromIndex(index *Index) (*Provenance, error) {
+	v, ok := index.Annotations[IndexAnnotationProvenance]
+	if !ok {
+		return nil, ErrNoProvenance
+	}
+	var p Provenance
+	if err := json.Unmarshal([]byte(v), &p); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal provenance: %w", err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestProvenance(t *testing.T) {
+	manifestDesc := ocispec.Descriptor{Digest: digest.FromString("manifest")}
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer1"), Size: 100},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer2"), Size: 1 << 20},
+	}
+	ztocs := []*ocispec.Descriptor{
+		nil,
+		{MediaType: SociLayerMediaType, Digest: digest.FromString("ztoc2")},
+	}
+
+	testCases := []struct {
+		name         string
+		reproducible bool
+		expectedTool string
+	}{
+		{
+			name:         "build tool identifier is recorded",
+			expectedTool: "AWS SOCI CLI v0.1",
+		},
+		{
+			name:         "build tool identifier is left out of reproducible indices",
+			reproducible: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &IndexBuilder{config: &buildConfig{
+				spanSize:            1 << 22,
+				minLayerSize:        1000,
+				buildToolIdentifier: "AWS SOCI CLI v0.1",
+				platform:            ocispec.Platform{OS: "linux", Architecture: "amd64"},
+				digestAlgorithm:     digest.SHA256,
+				reproducible:        tc.reproducible,
+			}}
+			annotation, err := b.newProvenance(manifestDesc, layers, ztocs).annotation()
+			if err != nil {
+				t.Fatalf("cannot create provenance: %v", err)
+			}
+			index := NewIndex(nil, &manifestDesc, map[string]string{IndexAnnotationProvenance: annotation})
+
+			provenance, err := ProvenanceFromIndex(index)
+			if err != nil {
+				t.Fatalf("cannot read provenance: %v", err)
+			}
+			expected := &Provenance{
+				BuildToolIdentifier: tc.expectedTool,
+				ImageManifest:       manifestDesc.Digest,
+				Platform:            ocispec.Platform{OS: "linux", Architecture: "amd64"},
+				SpanSize:            1 << 22,
+				MinLayerSize:        1000,
+				DigestAlgorithm:     digest.SHA256,
+				Layers: []LayerProvenance{
+					{
+						Digest:    layers[0].Digest,
+						MediaType: ocispec.MediaTypeImageLayerGzip,
+						Size:      100,
+						Skipped:   "smaller than the minimum layer size (1000 bytes)",
+					},
+					{
+						Digest:    layers[1].Digest,
+						MediaType: ocispec.MediaTypeImageLayerGzip,
+						Size:      1 << 20,
+						Ztoc:      ztocs[1].Digest,
+					},
+				},
+			}
+			if diff := cmp.Diff(expected, provenance); diff != "" {
+				t.Fatalf("unexpected provenance; diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestProvenanceFromIndexWithoutProvenance(t *testing.T) {
+	index := NewIndex(nil, nil, map[string]string{IndexAnnotationBuildToolIdentifier: "AWS SOCI CLI v0.1"})
+	if _, err := ProvenanceFromIndex(index); !errors.Is(err, ErrNoProvenance) {
+		t.Fatalf("expected %v, got %v", ErrNoProvenance, err)
+	}
+}
@@ -18,14 +18,18 @@ package soci
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	_ "crypto/sha512" // register sha384 and sha512 for go-digest
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/util/fips"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/containerd/containerd/content"
@@ -51,6 +55,18 @@ const (
 	IndexAnnotationImageLayerDigest = "com.amazon.soci.image-layer-digest"
 	// IndexAnnotationBuildToolIdentifier is the index annotation for build tool identifier
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
+	// IndexAnnotationImageLayerDiffID is the index annotation for the diffID (the digest
+	// of the uncompressed contents) of an image layer. It's only set by schema v2 indices.
+	IndexAnnotationImageLayerDiffID = "com.amazon.soci.image-layer-diff-id"
+	// IndexAnnotationImageLayerUncompressedSize is the index annotation for the size of
+	// the uncompressed contents of an image layer. It's only set by schema v2 indices.
+	IndexAnnotationImageLayerUncompressedSize = "com.amazon.soci.image-layer-uncompressed-size"
+	// IndexAnnotationSchemaVersion is the index annotation for the version of the schema
+	// of the annotations of the index. Indices without it are schema v1.
+	IndexAnnotationSchemaVersion = "com.amazon.soci.index-schema-version"
+	// IndexSchemaVersion2 is the schema of indices whose ztoc descriptors record the
+	// diffIDs and uncompressed sizes of the image layers.
+	IndexSchemaVersion2 = "v2"
 
 	defaultSpanSize            = int64(1 << 22) // 4MiB
 	defaultMinLayerSize        = 10 << 20       // 10MiB
@@ -103,6 +119,11 @@ type IndexWithMetadata struct {
 	Platform    *ocispec.Platform
 	ImageDigest digest.Digest
 	CreatedAt   time.Time
+	// DigestAlgorithm is the algorithm used to compute the digest of the index
+	// when it is written. Defaults to `digest.Canonical` if empty.
+	DigestAlgorithm digest.Algorithm
+	// ImageRef is the name of the image the index was built for.
+	ImageRef string
 }
 
 // IndexDescriptorInfo has a soci index descriptor and additional metadata.
@@ -221,6 +242,11 @@ type buildConfig struct {
 	artifactsDb         *ArtifactsDb
 	platform            ocispec.Platform
 	artifactRegistry    bool
+	digestAlgorithm     digest.Algorithm
+	reproducible        bool
+	chunkSize           int64
+	journalDir          string
+	resume              bool
 }
 type indexConfig struct {
 	artifact bool
@@ -277,6 +303,55 @@ func WithOCIArtifactRegistrySupport(c *buildConfig) error {
 	return nil
 }
 
+// WithDigestAlgorithm sets the algorithm used to compute the digests of the ztocs and the SOCI index.
+func WithDigestAlgorithm(alg digest.Algorithm) BuildOption {
+	return func(c *buildConfig) error {
+		if !alg.Available() {
+			return fmt.Errorf("unsupported digest algorithm %q", alg)
+		}
+		if err := fips.CheckDigestAlgorithm(alg); err != nil {
+			return err
+		}
+		c.digestAlgorithm = alg
+		return nil
+	}
+}
+
+// WithReproducible leaves the build tool identifier out of the SOCI index and its ztocs,
+// so that the index of an image only depends on the image and the build options.
+func WithReproducible(c *buildConfig) error {
+	c.reproducible = true
+	return nil
+}
+
+// WithChunkDigests records the digests of the contents of files in chunks of chunkSize
+// in the ztocs, so that the snapshotter can share identical files between layers and images.
+func WithChunkDigests(chunkSize int64) BuildOption {
+	return func(c *buildConfig) error {
+		if chunkSize <= 0 {
+			return fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+		}
+		c.chunkSize = chunkSize
+		return nil
+	}
+}
+
+// WithBuildJournal records the progress of builds in a journal in dir, so that
+// interrupted builds can be resumed with WithResume.
+func WithBuildJournal(dir string) BuildOption {
+	return func(c *buildConfig) error {
+		c.journalDir = dir
+		return nil
+	}
+}
+
+// WithResume resumes an interrupted build from its journal, reusing the ztocs it already
+// built. The journal is ignored if it was written by a build with other options.
+func WithResume(c *buildConfig) error {
+	c.resume = true
+	return nil
+}
+
 // Speicifies the artifacts database
 func WithArtifactsDb(db *ArtifactsDb) BuildOption {
 	return func(c *buildConfig) error {
@@ -302,6 +377,7 @@ func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage,
 		minLayerSize:        defaultMinLayerSize,
 		buildToolIdentifier: defaultBuildToolIdentifier,
 		platform:            defaultPlatform,
+		digestAlgorithm:     digest.Canonical,
 	}
 
 	for _, opt := range opts {
@@ -309,6 +385,9 @@ func NewIndexBuilder(contentStore content.Store, blobStore orascontent.Storage,
 			return nil, err
 		}
 	}
+	if config.resume && config.journalDir == "" {
+		return nil, errors.New("resuming a build requires a build journal")
+	}
 
 	return &IndexBuilder{
 		contentStore: contentStore,
@@ -333,12 +412,25 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		return nil, err
 	}
 
+	var journal *buildJournal
+	if b.config.journalDir != "" {
+		var resumed bool
+		journal, resumed, err = openBuildJournal(b.config.journalDir, imgManifestDesc.Digest,
+			b.config.platform, newBuildJournalOptions(b.config), b.config.resume)
+		if err != nil {
+			return nil, err
+		}
+		if resumed {
+			fmt.Printf("resuming build of %s with %d ztocs\n", imgManifestDesc.Digest, len(journal.Ztocs))
+		}
+	}
+
 	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
 	eg, ctx := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
 		i, l := i, l
 		eg.Go(func() error {
-			desc, err := b.buildSociLayer(ctx, l)
+			desc, err := b.buildOrResumeSociLayer(ctx, l, journal)
 			if err != nil {
 				return fmt.Errorf("could not build zTOC for layer %s: %w", l.Digest.String(), err)
 			}
@@ -357,8 +449,16 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		}
 	}
 
+	provenance, err := b.newProvenance(*imgManifestDesc, manifest.Layers, sociLayersDesc).annotation()
+	if err != nil {
+		return nil, err
+	}
 	annotations := map[string]string{
-		IndexAnnotationBuildToolIdentifier: b.config.buildToolIdentifier,
+		IndexAnnotationProvenance:    provenance,
+		IndexAnnotationSchemaVersion: IndexSchemaVersion2,
+	}
+	if !b.config.reproducible {
+		annotations[IndexAnnotationBuildToolIdentifier] = b.config.buildToolIdentifier
 	}
 
 	refers := &ocispec.Descriptor{
@@ -372,18 +472,66 @@ func (b *IndexBuilder) Build(ctx context.Context, img images.Image) (*IndexWithM
 		indexOpts = append(indexOpts, WithIndexAsArtifact)
 	}
 	index := NewIndex(ztocsDesc, refers, annotations, indexOpts...)
+	if journal != nil {
+		// all ztocs are in the local store, so there's nothing left to resume.
+		if err := journal.remove(); err != nil {
+			return nil, fmt.Errorf("cannot remove build journal: %w", err)
+		}
+	}
 	return &IndexWithMetadata{
-		Index:       index,
-		Platform:    &b.config.platform,
-		ImageDigest: img.Target.Digest,
-		CreatedAt:   time.Now(),
+		Index:           index,
+		Platform:        &b.config.platform,
+		ImageDigest:     img.Target.Digest,
+		ImageRef:        img.Name,
+		CreatedAt:       time.Now(),
+		DigestAlgorithm: b.config.digestAlgorithm,
 	}, nil
 }
 
+// buildOrResumeSociLayer returns the ztoc descriptor of an image layer (`desc`) recorded in
+// journal, if the ztoc is still in the local store. Otherwise, it builds the ztoc and records
+// it in journal. journal may be nil.
+func (b *IndexBuilder) buildOrResumeSociLayer(ctx context.Context, desc ocispec.Descriptor, journal *buildJournal) (*ocispec.Descriptor, error) {
+	if journal == nil {
+		return b.buildSociLayer(ctx, desc)
+	}
+	if ztocDesc, ok := journal.ztoc(desc.Digest); ok {
+		exists, err := b.blobStore.Exists(ctx, ztocDesc)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			// the artifact entry may not have been written before the build was interrupted.
+			entry := &ArtifactEntry{
+				Size:           ztocDesc.Size,
+				Digest:         ztocDesc.Digest.String(),
+				OriginalDigest: desc.Digest.String(),
+				Type:           ArtifactEntryTypeLayer,
+				Location:       desc.Digest.String(),
+				MediaType:      SociLayerMediaType,
+				CreatedAt:      time.Now(),
+			}
+			if err := b.ArtifactsDb.WriteArtifactEntry(entry); err != nil {
+				return nil, err
+			}
+			fmt.Printf("layer %s -> ztoc %s (resumed)\n", desc.Digest, ztocDesc.Digest)
+			return &ztocDesc, nil
+		}
+	}
+	ztocDesc, err := b.buildSociLayer(ctx, desc)
+	if err != nil || ztocDesc == nil {
+		return ztocDesc, err
+	}
+	if err := journal.record(desc.Digest, *ztocDesc); err != nil {
+		return nil, fmt.Errorf("cannot record ztoc in build journal: %w", err)
+	}
+	return ztocDesc, nil
+}
+
 // buildSociLayer builds a ztoc for an image layer (`desc`) and returns ztoc descriptor.
 // It may skip building ztoc (e.g., if layer size < `minLayerSize`) and return nil.
 func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
-	if !images.IsLayerType(desc.MediaType) {
+	if !IsImageLayerType(desc.MediaType) {
 		return nil, errNotLayerType
 	}
 	// check if we need to skip building the zTOC
@@ -392,7 +540,7 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		return nil, nil
 	}
 
-	compressionAlgo, err := images.DiffCompression(ctx, desc.MediaType)
+	compressionAlgo, err := images.DiffCompression(ctx, NormalizeMediaType(desc.MediaType))
 	if err != nil {
 		return nil, fmt.Errorf("could not determine layer compression: %w", err)
 	}
@@ -421,12 +569,23 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 		return nil, errors.New("the size of the temp file doesn't match that of the layer")
 	}
 
-	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, ztoc.WithCompression(compressionAlgo))
+	ztocOpts := []ztoc.BuildOption{ztoc.WithCompression(compressionAlgo)}
+	if b.config.reproducible {
+		ztocOpts = append(ztocOpts, ztoc.WithReproducible())
+	}
+	if b.config.chunkSize > 0 {
+		ztocOpts = append(ztocOpts, ztoc.WithChunkDigests(b.config.chunkSize))
+	}
+	toc, err := b.ztocBuilder.BuildZtoc(tmpFile.Name(), b.config.spanSize, ztocOpts...)
 	if err != nil {
 		return nil, err
 	}
+	diffID, err := layerDiffID(tmpFile, int64(toc.UncompressedArchiveSize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot compute diffID: %w", err)
+	}
 
-	ztocReader, ztocDesc, err := ztoc.Marshal(toc)
+	ztocReader, ztocDesc, err := ztoc.Marshal(toc, ztoc.WithDigestAlgorithm(b.config.digestAlgorithm))
 	if err != nil {
 		return nil, err
 	}
@@ -456,12 +615,64 @@ func (b *IndexBuilder) buildSociLayer(ctx context.Context, desc ocispec.Descript
 
 	ztocDesc.MediaType = SociLayerMediaType
 	ztocDesc.Annotations = map[string]string{
-		IndexAnnotationImageLayerMediaType: desc.MediaType,
-		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+		IndexAnnotationImageLayerMediaType:        desc.MediaType,
+		IndexAnnotationImageLayerDigest:           desc.Digest.String(),
+		IndexAnnotationImageLayerDiffID:           diffID.String(),
+		IndexAnnotationImageLayerUncompressedSize: strconv.FormatInt(int64(toc.UncompressedArchiveSize), 10),
 	}
 	return &ztocDesc, err
 }
 
+// layerDiffID returns the diffID of the gzip compressed layer in f, whose uncompressed
+// contents must be uncompressedSize bytes. DiffIDs are always sha256, like in image configs.
+func layerDiffID(f *os.File, uncompressedSize int64) (digest.Digest, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(digester.Hash(), zr)
+	if err != nil {
+		return "", err
+	}
+	if n != uncompressedSize {
+		return "", fmt.Errorf("uncompressed layer is %d bytes, but the ztoc says %d", n, uncompressedSize)
+	}
+	return digester.Digest(), nil
+}
+
+// ImageLayerDiffID returns the diffID of the image layer of the ztoc descriptor desc of a
+// schema v2 index. It returns false for descriptors of schema v1 indices.
+func ImageLayerDiffID(desc ocispec.Descriptor) (digest.Digest, bool, error) {
+	v, ok := desc.Annotations[IndexAnnotationImageLayerDiffID]
+	if !ok {
+		return "", false, nil
+	}
+	diffID, err := digest.Parse(v)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid %s annotation: %w", IndexAnnotationImageLayerDiffID, err)
+	}
+	return diffID, true, nil
+}
+
+// ImageLayerUncompressedSize returns the uncompressed size of the image layer of the ztoc
+// descriptor desc of a schema v2 index. It returns false for descriptors of schema v1 indices.
+func ImageLayerUncompressedSize(desc ocispec.Descriptor) (int64, bool, error) {
+	v, ok := desc.Annotations[IndexAnnotationImageLayerUncompressedSize]
+	if !ok {
+		return 0, false, nil
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, fmt.Errorf("invalid %s annotation %q", IndexAnnotationImageLayerUncompressedSize, v)
+	}
+	return size, true, nil
+}
+
 // NewIndex returns a new index.
 func NewIndex(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, annotations map[string]string, opts ...IndexOption) *Index {
 	ic := new(indexConfig)
@@ -500,7 +711,12 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) bool {
 
 // GetImageManifestDescriptor gets the descriptor of image manifest
 func GetImageManifestDescriptor(ctx context.Context, cs content.Store, imageTarget ocispec.Descriptor, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
-	if images.IsIndexType(imageTarget.MediaType) {
+	mediaType, err := ManifestMediaType(imageTarget.MediaType, nil)
+	if err != nil {
+		return nil, err
+	}
+	imageTarget.MediaType = mediaType
+	if images.IsIndexType(mediaType) {
 		manifests, err := images.Children(ctx, cs, imageTarget)
 		if err != nil {
 			return nil, err
@@ -510,15 +726,15 @@ func GetImageManifestDescriptor(ctx context.Context, cs content.Store, imageTarg
 				return nil, errors.New("manifest should have proper platform")
 			}
 			if platform.Match(*manifest.Platform) {
+				if manifest.MediaType, err = ManifestMediaType(manifest.MediaType, nil); err != nil {
+					return nil, err
+				}
 				return &manifest, nil
 			}
 		}
 		return nil, errors.New("image manifest not found")
-	} else if images.IsManifestType(imageTarget.MediaType) {
-		return &imageTarget, nil
 	}
-
-	return nil, nil
+	return &imageTarget, nil
 }
 
 // WriteSociIndex writes the SociIndex manifest to oras `store`.
@@ -538,7 +754,17 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, s
 		}
 	}
 
-	dgst := digest.FromBytes(manifest)
+	alg := indexWithMetadata.DigestAlgorithm
+	if alg == "" {
+		alg = digest.Canonical
+	}
+	if !alg.Available() {
+		return fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	if err := fips.CheckDigestAlgorithm(alg); err != nil {
+		return err
+	}
+	dgst := alg.FromBytes(manifest)
 	size := int64(len(manifest))
 
 	err = store.Push(ctx, ocispec.Descriptor{
@@ -564,6 +790,7 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata *IndexWithMetadata, s
 		OriginalDigest: refers.Digest.String(),
 		ImageDigest:    indexWithMetadata.ImageDigest.String(),
 		Platform:       platforms.Format(*indexWithMetadata.Platform),
+		ImageRef:       indexWithMetadata.ImageRef,
 		Type:           ArtifactEntryTypeIndex,
 		Location:       refers.Digest.String(),
 		Size:           size,
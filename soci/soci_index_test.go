@@ -18,9 +18,11 @@ package soci
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"os"
 	"testing"
 
 	"github.com/containerd/containerd/images"
@@ -372,3 +374,63 @@ func TestMarshalIndex(t *testing.T) {
 		})
 	}
 }
+
+func TestLayerDiffID(t *testing.T) {
+	uncompressed := bytes.Repeat([]byte("soci"), 10000)
+	f, err := os.CreateTemp(t.TempDir(), "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(uncompressed); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	diffID, err := layerDiffID(f, int64(len(uncompressed)))
+	if err != nil {
+		t.Fatalf("failed to compute diffID: %v", err)
+	}
+	if expected := digest.FromBytes(uncompressed); diffID != expected {
+		t.Fatalf("unexpected diffID; expected %v, got %v", expected, diffID)
+	}
+	if _, err := layerDiffID(f, int64(len(uncompressed))+1); err == nil {
+		t.Fatalf("expected a mismatching uncompressed size to fail")
+	}
+}
+
+func TestImageLayerAnnotations(t *testing.T) {
+	diffID := digest.FromString("layer")
+	v2 := ocispec.Descriptor{Annotations: map[string]string{
+		IndexAnnotationImageLayerDiffID:           diffID.String(),
+		IndexAnnotationImageLayerUncompressedSize: "1024",
+	}}
+	if d, ok, err := ImageLayerDiffID(v2); err != nil || !ok || d != diffID {
+		t.Fatalf("unexpected diffID %v, %v, %v", d, ok, err)
+	}
+	if size, ok, err := ImageLayerUncompressedSize(v2); err != nil || !ok || size != 1024 {
+		t.Fatalf("unexpected uncompressed size %v, %v, %v", size, ok, err)
+	}
+
+	var v1 ocispec.Descriptor
+	if _, ok, err := ImageLayerDiffID(v1); err != nil || ok {
+		t.Fatalf("expected no diffID for a schema v1 descriptor, got %v, %v", ok, err)
+	}
+	if _, ok, err := ImageLayerUncompressedSize(v1); err != nil || ok {
+		t.Fatalf("expected no uncompressed size for a schema v1 descriptor, got %v, %v", ok, err)
+	}
+
+	invalid := ocispec.Descriptor{Annotations: map[string]string{
+		IndexAnnotationImageLayerDiffID:           "layer",
+		IndexAnnotationImageLayerUncompressedSize: "-1",
+	}}
+	if _, _, err := ImageLayerDiffID(invalid); err == nil {
+		t.Fatalf("expected an invalid diffID to fail")
+	}
+	if _, _, err := ImageLayerUncompressedSize(invalid); err == nil {
+		t.Fatalf("expected an invalid uncompressed size to fail")
+	}
+}
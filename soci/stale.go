@@ -0,0 +1,109 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"sort"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// StaleIndex is a SOCI index which was built for an image ref that now refers to
+// another image without a SOCI index, e.g. because the image was rebuilt and pushed
+// under the same tag.
+type StaleIndex struct {
+	// ImageRef is the name of the image.
+	ImageRef string
+	// Platform is the platform of the index.
+	Platform string
+	// ImageDigest is the digest of the image ImageRef refers to now.
+	ImageDigest digest.Digest
+	// ManifestDigest is the digest of the image manifest of Platform which has no index.
+	ManifestDigest digest.Digest
+	// Index is the most recent index built for a previous image of ImageRef.
+	Index ArtifactEntry
+}
+
+// FindStaleIndices returns the stale indices of img for the platforms ps. Indices built
+// before the image refs of indices were recorded are never stale.
+func FindStaleIndices(ctx context.Context, cs content.Store, artifactsDb *ArtifactsDb, img images.Image, ps []ocispec.Platform) ([]StaleIndex, error) {
+	manifests := make(map[string]digest.Digest)
+	for _, platform := range ps {
+		desc, err := GetImageManifestDescriptor(ctx, cs, img.Target, platforms.OnlyStrict(platform))
+		if err != nil {
+			return nil, err
+		}
+		manifests[platforms.Format(platform)] = desc.Digest
+	}
+	var entries []ArtifactEntry
+	err := artifactsDb.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeIndex {
+			entries = append(entries, *ae)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return staleIndices(entries, img.Name, img.Target.Digest, manifests), nil
+}
+
+// staleIndices returns the stale indices of the image imageDigest named imageRef, whose
+// image manifests by platform are manifests, in the order of the platforms.
+func staleIndices(entries []ArtifactEntry, imageRef string, imageDigest digest.Digest, manifests map[string]digest.Digest) []StaleIndex {
+	indexed := make(map[string]bool)
+	latest := make(map[string]ArtifactEntry)
+	for _, e := range entries {
+		indexed[e.OriginalDigest] = true
+		if e.ImageRef != imageRef || e.ImageDigest == imageDigest.String() {
+			continue
+		}
+		if prev, ok := latest[e.Platform]; !ok || e.CreatedAt.After(prev.CreatedAt) {
+			latest[e.Platform] = e
+		}
+	}
+
+	ps := make([]string, 0, len(manifests))
+	for platform := range manifests {
+		ps = append(ps, platform)
+	}
+	sort.Strings(ps)
+	var stale []StaleIndex
+	for _, platform := range ps {
+		manifestDigest := manifests[platform]
+		if indexed[manifestDigest.String()] {
+			continue
+		}
+		e, ok := latest[platform]
+		if !ok {
+			continue
+		}
+		stale = append(stale, StaleIndex{
+			ImageRef:       imageRef,
+			Platform:       platform,
+			ImageDigest:    imageDigest,
+			ManifestDigest: manifestDigest,
+			Index:          e,
+		})
+	}
+	return stale
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestStaleIndices(t *testing.T) {
+	const (
+		ref   = "example.com/app:latest"
+		amd64 = "linux/amd64"
+		arm64 = "linux/arm64"
+	)
+	var (
+		oldImage    = digest.FromString("old image")
+		newImage    = digest.FromString("new image")
+		oldManifest = digest.FromString("old manifest")
+		newManifest = digest.FromString("new manifest")
+		created     = time.Unix(1700000000, 0)
+	)
+	oldIndex := ArtifactEntry{
+		Digest:         digest.FromString("old index").String(),
+		OriginalDigest: oldManifest.String(),
+		ImageDigest:    oldImage.String(),
+		Platform:       amd64,
+		ImageRef:       ref,
+		Type:           ArtifactEntryTypeIndex,
+		CreatedAt:      created,
+	}
+	olderIndex := oldIndex
+	olderIndex.Digest = digest.FromString("older index").String()
+	olderIndex.CreatedAt = created.Add(-time.Hour)
+	newIndex := oldIndex
+	newIndex.Digest = digest.FromString("new index").String()
+	newIndex.OriginalDigest = newManifest.String()
+	newIndex.ImageDigest = newImage.String()
+	otherRef := oldIndex
+	otherRef.ImageRef = "example.com/other:latest"
+	unrecordedRef := oldIndex
+	unrecordedRef.ImageRef = ""
+
+	tests := []struct {
+		name      string
+		entries   []ArtifactEntry
+		manifests map[string]digest.Digest
+		want      []string
+	}{
+		{
+			name:      "rebuilt image",
+			entries:   []ArtifactEntry{olderIndex, oldIndex},
+			manifests: map[string]digest.Digest{amd64: newManifest},
+			want:      []string{oldIndex.Digest},
+		},
+		{
+			name:      "rebuilt image with an index",
+			entries:   []ArtifactEntry{oldIndex, newIndex},
+			manifests: map[string]digest.Digest{amd64: newManifest},
+		},
+		{
+			name:      "same image",
+			entries:   []ArtifactEntry{oldIndex},
+			manifests: map[string]digest.Digest{amd64: oldManifest},
+		},
+		{
+			name:      "other platform",
+			entries:   []ArtifactEntry{oldIndex},
+			manifests: map[string]digest.Digest{arm64: newManifest},
+		},
+		{
+			name:      "other ref",
+			entries:   []ArtifactEntry{otherRef},
+			manifests: map[string]digest.Digest{amd64: newManifest},
+		},
+		{
+			name:      "ref not recorded",
+			entries:   []ArtifactEntry{unrecordedRef},
+			manifests: map[string]digest.Digest{amd64: newManifest},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale := staleIndices(tt.entries, ref, newImage, tt.manifests)
+			if len(stale) != len(tt.want) {
+				t.Fatalf("got %d stale indices; want %d: %+v", len(stale), len(tt.want), stale)
+			}
+			for i, s := range stale {
+				if s.Index.Digest != tt.want[i] {
+					t.Errorf("stale index %d is %s; want %s", i, s.Index.Digest, tt.want[i])
+				}
+				if s.ImageDigest != newImage || s.ManifestDigest != tt.manifests[s.Platform] {
+					t.Errorf("unexpected digests of the image of stale index %d: %+v", i, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bufferpool provides pools of byte slices for the read path, so that
+// buffers of spans and fetched data are reused instead of allocated per read.
+package bufferpool
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// minClassShift is the log2 of the smallest pooled buffer (4 KiB).
+	minClassShift = 12
+	// maxClassShift is the log2 of the largest pooled buffer (16 MiB).
+	// Larger buffers are allocated and garbage collected as usual.
+	maxClassShift = 24
+
+	// CopyBufferSize is the size of the buffers returned by GetCopyBuffer.
+	CopyBufferSize = 32 * 1024
+)
+
+// pools holds a pool per power of two size class. The pools store *[]byte,
+// so that putting a buffer back doesn't allocate.
+var pools [maxClassShift - minClassShift + 1]sync.Pool
+
+// classOf returns the index of the smallest size class which fits size.
+func classOf(size int) int {
+	if size <= 1<<minClassShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - minClassShift
+}
+
+// Get returns a byte slice of length size. Its contents are undefined.
+// The slice should be returned with Put once it isn't referenced anymore.
+func Get(size int) []byte {
+	c := classOf(size)
+	if c >= len(pools) {
+		return make([]byte, size)
+	}
+	if b, ok := pools[c].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1<<(c+minClassShift))
+}
+
+// Put returns a byte slice obtained from Get to the pool.
+// Slices which weren't obtained from Get are dropped.
+func Put(b []byte) {
+	c := cap(b)
+	if c < 1<<minClassShift || c&(c-1) != 0 {
+		return
+	}
+	class := bits.Len(uint(c)) - 1 - minClassShift
+	if class >= len(pools) {
+		return
+	}
+	b = b[:0]
+	pools[class].Put(&b)
+}
+
+// GetCopyBuffer returns a buffer of CopyBufferSize bytes for io.CopyBuffer.
+func GetCopyBuffer() []byte {
+	return Get(CopyBufferSize)
+}
+
+// CopyN is like io.CopyN, but copies through a pooled buffer instead of allocating one.
+func CopyN(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	buf := GetCopyBuffer()
+	defer Put(buf)
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), buf)
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		// src stopped early; must have been EOF.
+		err = io.EOF
+	}
+	return written, err
+}
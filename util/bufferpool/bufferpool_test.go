@@ -0,0 +1,82 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bufferpool
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for _, tc := range []struct {
+		size        int
+		expectedCap int
+	}{
+		{size: 0, expectedCap: 4096},
+		{size: 1, expectedCap: 4096},
+		{size: 4096, expectedCap: 4096},
+		{size: 4097, expectedCap: 8192},
+		{size: 1 << 22, expectedCap: 1 << 22},
+		{size: 1<<22 + 1, expectedCap: 1 << 23},
+		{size: 1<<24 + 1, expectedCap: 1<<24 + 1},
+	} {
+		b := Get(tc.size)
+		if len(b) != tc.size || cap(b) != tc.expectedCap {
+			t.Fatalf("Get(%d): expected len %d and cap %d, got len %d and cap %d", tc.size, tc.size, tc.expectedCap, len(b), cap(b))
+		}
+		Put(b)
+	}
+}
+
+func TestPutForeignSlice(t *testing.T) {
+	// slices with a capacity which isn't a size class must not be handed out by Get.
+	Put(make([]byte, 5000))
+	if b := Get(4097); cap(b) != 8192 {
+		t.Fatalf("expected cap 8192, got %d", cap(b))
+	}
+}
+
+func TestCopyN(t *testing.T) {
+	var dst bytes.Buffer
+	n, err := CopyN(&dst, strings.NewReader("hello world"), 5)
+	if err != nil || n != 5 || dst.String() != "hello" {
+		t.Fatalf("unexpected result: n=%d err=%v dst=%q", n, err, dst.String())
+	}
+	dst.Reset()
+	n, err = CopyN(&dst, strings.NewReader("short"), 10)
+	if err != io.EOF || n != 5 {
+		t.Fatalf("expected EOF after 5 bytes, got n=%d err=%v", n, err)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const size = 4 << 20 // a typical span
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			Put(Get(size))
+		}
+	})
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = make([]byte, size)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dbutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize is the maximum size of the transactions which copy a DB
+// while compacting it (same as `bbolt compact`).
+const compactTxMaxSize = 65536
+
+// CompactStats are the sizes of a DB file before and after it's compacted.
+type CompactStats struct {
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+}
+
+// Compact copies the contents of src to a new file, leaving out the free pages that
+// bolt never gives back to the filesystem, and replaces the file of src with it.
+// src must not be written to while it's compacted, and must be closed and reopened
+// afterwards since it still refers to the replaced file.
+func Compact(src *bolt.DB) (CompactStats, error) {
+	var stats CompactStats
+	path := src.Path()
+	size, err := FileSize(path)
+	if err != nil {
+		return stats, err
+	}
+	stats.SizeBefore = size
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".compact-*")
+	if err != nil {
+		return stats, fmt.Errorf("failed to create compacted DB: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return stats, err
+	}
+	dst, err := bolt.Open(tmpPath, info.Mode().Perm(), nil)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open compacted DB: %w", err)
+	}
+	if err := bolt.Compact(dst, src, compactTxMaxSize); err != nil {
+		dst.Close()
+		return stats, fmt.Errorf("failed to compact %q: %w", path, err)
+	}
+	if err := dst.Close(); err != nil {
+		return stats, fmt.Errorf("failed to close compacted DB: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return stats, fmt.Errorf("failed to replace %q with compacted DB: %w", path, err)
+	}
+	if stats.SizeAfter, err = FileSize(path); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// CompactFile compacts the DB at path, which must not be open. It fails if the DB is
+// locked by another process for longer than timeout.
+func CompactFile(path string, timeout time.Duration) (CompactStats, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return CompactStats{}, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer db.Close()
+	return Compact(db)
+}
+
+// FileSize returns the size of the DB file at path.
+func FileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// FreeRatio returns the fraction of the file of db taken by free pages, which
+// compacting db would give back to the filesystem.
+func FreeRatio(db *bolt.DB) (float64, error) {
+	size, err := FileSize(db.Path())
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	return float64(db.Stats().FreeAlloc) / float64(size), nil
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dbutil
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCompactFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open DB: %v", err)
+	}
+	value := bytes.Repeat([]byte("a"), 4096)
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 1000; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket-%d", i)))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("key"), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to fill DB: %v", err)
+	}
+	// Keep a single bucket, so that most of the file is free.
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i := 1; i < 1000; i++ {
+			if err := tx.DeleteBucket([]byte(fmt.Sprintf("bucket-%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to delete buckets: %v", err)
+	}
+	if ratio, err := FreeRatio(db); err != nil || ratio < 0.5 {
+		t.Fatalf("expected most of the DB to be free, got %v (err: %v)", ratio, err)
+	}
+	db.Close()
+
+	stats, err := CompactFile(path, time.Second)
+	if err != nil {
+		t.Fatalf("failed to compact DB: %v", err)
+	}
+	if stats.SizeAfter >= stats.SizeBefore {
+		t.Fatalf("expected DB to shrink, got %d -> %d bytes", stats.SizeBefore, stats.SizeAfter)
+	}
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to open compacted DB: %v", err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("bucket-0"))
+		if b == nil || !bytes.Equal(b.Get([]byte("key")), value) {
+			return fmt.Errorf("expected bucket-0 to be kept")
+		}
+		if tx.Bucket([]byte("bucket-1")) != nil {
+			return fmt.Errorf("expected bucket-1 to be deleted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package diagnostics collects the state of the snapshotter into a bundle
+// that can be attached to bug reports.
+//
+// Components register a Provider for the state they own (e.g. active mounts,
+// the background fetch queue). A bundle is a gzipped tar archive containing
+// the goroutine stacks of the process and one JSON file per Provider.
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provider returns the state of a component to include in a bundle.
+// The returned value is encoded as JSON.
+type Provider func() (interface{}, error)
+
+var (
+	providersMu sync.Mutex
+	providers   = make(map[string]Provider)
+)
+
+// Register registers p to be included in bundles as "<name>.json".
+// Registering a name again replaces the previous Provider.
+func Register(name string, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = p
+}
+
+// Unregister removes the Provider registered as name, e.g. when the component it
+// reports on is closed.
+func Unregister(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	delete(providers, name)
+}
+
+// WriteBundle writes a bundle to w.
+func WriteBundle(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+
+	var stacks bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&stacks, 2); err != nil {
+		return fmt.Errorf("failed to collect goroutine stacks: %w", err)
+	}
+	if err := writeFile(tw, "goroutines.txt", stacks.Bytes(), now); err != nil {
+		return err
+	}
+
+	providersMu.Lock()
+	names := make([]string, 0, len(providers))
+	ps := make(map[string]Provider, len(providers))
+	for name, p := range providers {
+		names = append(names, name)
+		ps[name] = p
+	}
+	providersMu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		v, err := ps[name]()
+		if err != nil {
+			v = map[string]string{"error": err.Error()}
+		}
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			b = []byte(fmt.Sprintf("{\"error\": %q}", err.Error()))
+		}
+		if err := writeFile(tw, name+".json", b, now); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// DumpToFile writes a bundle into a new file in dir and returns the path of the file.
+func DumpToFile(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("soci-diagnostics-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := WriteBundle(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// Handler returns an http.Handler which responds with a bundle.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		if err := WriteBundle(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename=soci-diagnostics.tar.gz")
+		w.Write(b.Bytes())
+	})
+}
+
+func writeFile(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWriteBundle(t *testing.T) {
+	Register("ok", func() (interface{}, error) {
+		return map[string]int{"count": 1}, nil
+	})
+	Register("failing", func() (interface{}, error) {
+		return nil, errors.New("provider failed")
+	})
+	Register("unregistered", func() (interface{}, error) {
+		return nil, nil
+	})
+	Unregister("unregistered")
+
+	var b bytes.Buffer
+	if err := WriteBundle(&b); err != nil {
+		t.Fatalf("failed to write bundle: %v", err)
+	}
+	gr, err := gzip.NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = string(content)
+	}
+
+	if _, ok := files["goroutines.txt"]; !ok {
+		t.Fatal("bundle doesn't contain goroutine stacks")
+	}
+	if _, ok := files["unregistered.json"]; ok {
+		t.Fatal("bundle contains an unregistered provider")
+	}
+	expected := map[string]string{
+		"ok.json":      "{\n  \"count\": 1\n}",
+		"failing.json": "{\n  \"error\": \"provider failed\"\n}",
+	}
+	for name, content := range expected {
+		if files[name] != content {
+			t.Fatalf("unexpected content of %s: %q", name, files[name])
+		}
+	}
+}
+
+func TestErrorRing(t *testing.T) {
+	r := NewErrorRing(3)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.AddHook(r)
+
+	logger.Info("not kept")
+	for i := 0; i < 5; i++ {
+		logger.WithError(fmt.Errorf("err-%d", i)).Error(fmt.Sprintf("msg-%d", i))
+	}
+
+	entries := r.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if expected := fmt.Sprintf("msg-%d", i+2); e.Message != expected {
+			t.Fatalf("expected %s, got %s", expected, e.Message)
+		}
+		if expected := fmt.Sprintf("err-%d", i+2); e.Fields[logrus.ErrorKey] != expected {
+			t.Fatalf("expected error field %s, got %v", expected, e.Fields[logrus.ErrorKey])
+		}
+	}
+}
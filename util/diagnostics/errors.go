@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorRing is a logrus.Hook which keeps the most recent warnings and errors
+// logged by the process.
+type ErrorRing struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	next    int
+	full    bool
+}
+
+// LogEntry is a log entry kept by ErrorRing.
+type LogEntry struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// NewErrorRing creates an ErrorRing keeping up to size entries.
+func NewErrorRing(size int) *ErrorRing {
+	return &ErrorRing{entries: make([]LogEntry, size)}
+}
+
+// Levels implements logrus.Hook.
+func (r *ErrorRing) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+// Fire implements logrus.Hook.
+func (r *ErrorRing) Fire(entry *logrus.Entry) error {
+	if len(r.entries) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(entry.Data))
+	for k, v := range entry.Data {
+		// errors don't encode to JSON.
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		} else if _, ok := v.(fmt.Stringer); ok {
+			v = fmt.Sprint(v)
+		}
+		fields[k] = v
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = LogEntry{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Fields:  fields,
+	}
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+	return nil
+}
+
+// Entries returns the kept entries, oldest first.
+func (r *ErrorRing) Entries() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]LogEntry{}, r.entries[:r.next]...)
+	}
+	return append(append([]LogEntry{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Provider returns a Provider of the kept entries.
+func (r *ErrorRing) Provider() Provider {
+	return func() (interface{}, error) {
+		return r.Entries(), nil
+	}
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package exec
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// dockerBackend runs commands in a container with `docker exec`.
+type dockerBackend struct {
+	containerName string
+}
+
+func (b dockerBackend) command(cmd *Cmd, c *exec.Cmd) error {
+	lp, err := exec.LookPath("docker")
+	if err != nil {
+		return fmt.Errorf("docker command not found: %w", err)
+	}
+	var opts []string
+	if cmd.Stdin != nil {
+		opts = append(opts, "-i")
+	}
+	if cmd.Dir != "" {
+		opts = append(opts, "-w", cmd.Dir)
+	}
+	for _, e := range cmd.Env {
+		opts = append(opts, "-e", e)
+	}
+	base := append([]string{"docker", "exec"}, append(opts, b.containerName)...)
+	c.Path = lp
+	c.Args = append(base, cmd.Args...)
+	return nil
+}
+
+func (b dockerBackend) kill() error {
+	return exec.Command("docker", "kill", b.containerName).Run()
+}
+
+// NewHost creates a new Exec which runs commands directly on the host, e.g. to test
+// a containerd and soci-snapshotter installed on the host without docker.
+func NewHost() *Exec {
+	return &Exec{backend: hostBackend{}}
+}
+
+// hostBackend runs commands on the host.
+type hostBackend struct{}
+
+func (hostBackend) command(cmd *Cmd, c *exec.Cmd) error {
+	lp, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return fmt.Errorf("%s command not found: %w", cmd.Path, err)
+	}
+	c.Path = lp
+	c.Args = cmd.Args
+	c.Dir = cmd.Dir
+	if len(cmd.Env) > 0 {
+		c.Env = append(os.Environ(), cmd.Env...)
+	}
+	return nil
+}
+
+// kill doesn't stop the host.
+func (hostBackend) kill() error {
+	return nil
+}
+
+// backupSuffix is the suffix of the copies of the files saved by SaveState.
+const backupSuffix = ".soci-e2e-backup"
+
+// SaveState saves the files (or directories) at paths in the execution environment and
+// stops the systemd units which are active, e.g. a containerd installed on the host,
+// so that tests can change them. The returned function restores the files and starts
+// the stopped units again. Files which didn't exist are removed when restoring.
+func (e Exec) SaveState(paths []string, units []string) (restore func() error, _ error) {
+	var saved, absent, stopped []string
+	restore = func() error {
+		var errs []string
+		for _, p := range absent {
+			if err := e.Command("rm", "-rf", p).Run(); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to remove %v: %v", p, err))
+			}
+		}
+		for _, p := range saved {
+			if err := e.Command("sh", "-c", `rm -rf "$0" && mv "$0`+backupSuffix+`" "$0"`, p).Run(); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to restore %v: %v", p, err))
+			}
+		}
+		for _, u := range stopped {
+			if err := e.Command("systemctl", "start", u).Run(); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to start %v: %v", u, err))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("failed to restore state: %s", strings.Join(errs, "; "))
+		}
+		return nil
+	}
+	for _, p := range paths {
+		if err := e.Command("test", "-e", p).Run(); err != nil {
+			absent = append(absent, p)
+			continue
+		}
+		if err := e.Command("cp", "-a", p, p+backupSuffix).Run(); err != nil {
+			restore()
+			return nil, fmt.Errorf("failed to save %v: %w", p, err)
+		}
+		saved = append(saved, p)
+	}
+	for _, u := range units {
+		if err := e.Command("systemctl", "is-active", "--quiet", u).Run(); err != nil {
+			continue // inactive, or systemd isn't used
+		}
+		if err := e.Command("systemctl", "stop", u).Run(); err != nil {
+			restore()
+			return nil, fmt.Errorf("failed to stop %v: %w", u, err)
+		}
+		stopped = append(stopped, u)
+	}
+	return restore, nil
+}
+
+// NewSSH creates a new Exec which runs commands over ssh on target (e.g. root@172.16.0.2),
+// e.g. in a Firecracker microVM. opts are additional options of ssh (e.g. "-i", keyPath).
+// The lifecycle of the machine is managed by the caller, so Kill doesn't stop it.
+func NewSSH(target string, opts ...string) (*Exec, error) {
+	b := sshBackend{target: target, opts: opts}
+	if err := exec.Command("ssh", b.args(true, "true")...).Run(); err != nil {
+		return nil, fmt.Errorf("%v is unavailable over ssh: %w", target, err)
+	}
+	return &Exec{backend: b}, nil
+}
+
+// sshBackend runs commands over ssh on a remote machine.
+type sshBackend struct {
+	target string
+	opts   []string
+}
+
+// args returns the arguments of ssh which run the shell command line remoteCmd on the target.
+// noStdin prevents ssh from reading its stdin.
+func (b sshBackend) args(noStdin bool, remoteCmd string) []string {
+	args := append([]string{"-T", "-o", "BatchMode=yes"}, b.opts...)
+	if noStdin {
+		args = append(args, "-n")
+	}
+	return append(args, b.target, "--", remoteCmd)
+}
+
+func (b sshBackend) command(cmd *Cmd, c *exec.Cmd) error {
+	lp, err := exec.LookPath("ssh")
+	if err != nil {
+		return fmt.Errorf("ssh command not found: %w", err)
+	}
+	var remoteCmd []string
+	if cmd.Dir != "" {
+		remoteCmd = append(remoteCmd, "cd", shellQuote(cmd.Dir), "&&")
+	}
+	remoteCmd = append(remoteCmd, "exec", "env")
+	for _, e := range cmd.Env {
+		remoteCmd = append(remoteCmd, shellQuote(e))
+	}
+	for _, a := range cmd.Args {
+		remoteCmd = append(remoteCmd, shellQuote(a))
+	}
+	c.Path = lp
+	c.Args = append([]string{"ssh"}, b.args(cmd.Stdin == nil, strings.Join(remoteCmd, " "))...)
+	return nil
+}
+
+func (b sshBackend) kill() error {
+	return nil
+}
+
+// shellQuote quotes s as a single word of a POSIX shell command line.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package exec
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHostCommand(t *testing.T) {
+	dir := t.TempDir()
+	cmd := NewHost().Command("sh", "-c", `echo "$FOO" && pwd`)
+	cmd.Env = []string{"FOO=bar"}
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "bar\n" + dir + "\n"; string(out) != expected {
+		t.Fatalf("unexpected output; expected %q, got %q", expected, out)
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	e := &Exec{backend: sshBackend{target: "root@vm", opts: []string{"-i", "key"}}}
+	cmd := e.Command("echo", "it's", "a b")
+	cmd.Env = []string{"FOO=bar"}
+	cmd.Dir = "/tmp"
+	c := &exec.Cmd{}
+	if err := cmd.backend.command(cmd, c); err != nil {
+		t.Skipf("ssh isn't available: %v", err)
+	}
+	expected := []string{"ssh", "-T", "-o", "BatchMode=yes", "-i", "key", "-n", "root@vm", "--",
+		`cd '/tmp' && exec env 'FOO=bar' 'echo' 'it'\''s' 'a b'`}
+	if !reflect.DeepEqual(c.Args, expected) {
+		t.Fatalf("unexpected args;\nexpected %q\ngot      %q", expected, c.Args)
+	}
+
+	// The remote command line must be parsed back into the same arguments.
+	out, err := exec.Command("sh", "-c", "printf '%s\\n' "+strings.TrimPrefix(expected[len(expected)-1], "cd '/tmp' && exec env ")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); !reflect.DeepEqual(got, []string{"FOO=bar", "echo", "it's", "a b"}) {
+		t.Fatalf("unexpected arguments %q", got)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(existing, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	absent := filepath.Join(dir, "absent.toml")
+
+	e := NewHost()
+	restore, err := e.SaveState([]string{existing, absent}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(absent, []byte("created"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(existing); err != nil || string(b) != "original" {
+		t.Fatalf("expected the original contents to be restored, got %q (%v)", b, err)
+	}
+	if _, err := os.Stat(absent); !os.IsNotExist(err) {
+		t.Fatalf("expected the created file to be removed: %v", err)
+	}
+	if _, err := os.Stat(existing + backupSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected the backup to be removed: %v", err)
+	}
+}
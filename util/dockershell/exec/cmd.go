@@ -43,12 +43,25 @@ func Supported() error {
 	return exec.Command("docker", "version").Run()
 }
 
-// Exec is an executing environment for a container. Commands can be executed in the
-// container using Command method.
+// Exec is an executing environment for a container, the host or a VM. Commands can be
+// executed in the environment using Command method.
 type Exec struct {
 
-	// ContainerName is the name of the target container.
+	// ContainerName is the name of the target container. It's empty if the environment
+	// isn't a container.
 	ContainerName string
+
+	backend backend
+}
+
+// backend runs commands in an execution environment.
+type backend interface {
+
+	// command sets up c to run cmd in the execution environment.
+	command(cmd *Cmd, c *exec.Cmd) error
+
+	// kill stops the execution environment.
+	kill() error
 }
 
 // New creates a new Exec for the specified container.
@@ -56,31 +69,25 @@ func New(containerName string) (*Exec, error) {
 	if err := exec.Command("docker", "inspect", containerName).Run(); err != nil {
 		return nil, fmt.Errorf("container %v is unavailable: %w", containerName, err)
 	}
-	return &Exec{containerName}, nil
+	return &Exec{ContainerName: containerName, backend: dockerBackend{containerName}}, nil
 }
 
 // Command creates a new Cmd for the specified commands.
 func (e Exec) Command(name string, arg ...string) *Cmd {
-	cmd := &Cmd{
-		Path:          name,
-		Args:          append([]string{name}, arg...),
-		dockerExec:    &exec.Cmd{},
-		containerName: e.ContainerName,
+	return &Cmd{
+		Path:    name,
+		Args:    append([]string{name}, arg...),
+		execCmd: &exec.Cmd{},
+		backend: e.backend,
 	}
-	if lp, err := exec.LookPath("docker"); err != nil {
-		cmd.lookPathErr = fmt.Errorf("docker command not found: %w", err)
-	} else {
-		cmd.dockerExec.Path = lp
-	}
-	return cmd
 }
 
-// Kill kills the underlying container.
+// Kill kills the underlying execution environment.
 func (e Exec) Kill() error {
-	return exec.Command("docker", "kill", e.ContainerName).Run()
+	return e.backend.kill()
 }
 
-// Cmd is exec.Cmd-like object which provides the way to execute commands in a container.
+// Cmd is exec.Cmd-like object which provides the way to execute commands in an execution environment.
 type Cmd struct {
 
 	// Path is the path of the command to run.
@@ -102,9 +109,10 @@ type Cmd struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
-	lookPathErr   error
-	dockerExec    *exec.Cmd
-	containerName string
+	execCmd    *exec.Cmd
+	backend    backend
+	prepared   bool
+	prepareErr error
 
 	// TODO: support the following fields
 	// ExtraFiles []*os.File
@@ -113,79 +121,102 @@ type Cmd struct {
 	// ProcessState *os.ProcessState
 }
 
-func (cmd *Cmd) toDocker() *exec.Cmd {
-	var opts []string
-	if cmd.Stdin != nil {
-		opts = append(opts, "-i")
-	}
-	if cmd.Dir != "" {
-		opts = append(opts, "-w", cmd.Dir)
+// toExec returns the exec.Cmd which runs cmd in its execution environment.
+func (cmd *Cmd) toExec() (*exec.Cmd, error) {
+	if !cmd.prepared {
+		cmd.prepareErr = cmd.backend.command(cmd, cmd.execCmd)
+		cmd.prepared = true
 	}
-	for _, e := range cmd.Env {
-		opts = append(opts, "-e", e)
+	if cmd.prepareErr != nil {
+		return nil, cmd.prepareErr
 	}
-	base := append([]string{"docker", "exec"}, append(opts, cmd.containerName)...)
-	cmd.dockerExec.Args = append(base, cmd.Args...)
-	if cmd.dockerExec.Stdin == nil {
-		cmd.dockerExec.Stdin = cmd.Stdin
+	if cmd.execCmd.Stdin == nil {
+		cmd.execCmd.Stdin = cmd.Stdin
 	}
-	if cmd.dockerExec.Stdout == nil {
-		cmd.dockerExec.Stdout = cmd.Stdout
+	if cmd.execCmd.Stdout == nil {
+		cmd.execCmd.Stdout = cmd.Stdout
 	}
-	if cmd.dockerExec.Stderr == nil {
-		cmd.dockerExec.Stderr = cmd.Stderr
+	if cmd.execCmd.Stderr == nil {
+		cmd.execCmd.Stderr = cmd.Stderr
 	}
-	return cmd.dockerExec
+	return cmd.execCmd, nil
 }
 
 // CombinedOutput runs the specified commands and returns the combined output of stdout and stderr.
 func (cmd *Cmd) CombinedOutput() ([]byte, error) {
-	if err := cmd.lookPathErr; err != nil {
+	c, err := cmd.toExec()
+	if err != nil {
 		return nil, err
 	}
-	return cmd.toDocker().CombinedOutput()
+	return c.CombinedOutput()
 }
 
 // Output runs the specified commands and returns its stdout.
 func (cmd *Cmd) Output() ([]byte, error) {
-	if err := cmd.lookPathErr; err != nil {
+	c, err := cmd.toExec()
+	if err != nil {
 		return nil, err
 	}
-	return cmd.toDocker().Output()
+	return c.Output()
 }
 
 // Run runs the specified commands.
 func (cmd *Cmd) Run() error {
-	if err := cmd.lookPathErr; err != nil {
+	c, err := cmd.toExec()
+	if err != nil {
 		return err
 	}
-	return cmd.toDocker().Run()
+	return c.Run()
 }
 
 func (cmd *Cmd) Start() error {
-	return cmd.toDocker().Start()
+	c, err := cmd.toExec()
+	if err != nil {
+		return err
+	}
+	return c.Start()
 }
 
 func (cmd *Cmd) Wait() error {
-	return cmd.toDocker().Wait()
+	c, err := cmd.toExec()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
 }
 
 // StderrPipe returns the pipe that will be connected to stderr of the executed command.
 func (cmd *Cmd) StderrPipe() (io.ReadCloser, error) {
-	return cmd.toDocker().StderrPipe()
+	c, err := cmd.toExec()
+	if err != nil {
+		return nil, err
+	}
+	return c.StderrPipe()
 }
 
 // StdinPipe returns the pipe that will be connected to stdin of the executed command.
 func (cmd *Cmd) StdinPipe() (io.WriteCloser, error) {
-	return cmd.toDocker().StdinPipe()
+	c, err := cmd.toExec()
+	if err != nil {
+		return nil, err
+	}
+	return c.StdinPipe()
 }
 
 // StdoutPipe returns the pipe that will be connected to stdout of the executed command.
 func (cmd *Cmd) StdoutPipe() (io.ReadCloser, error) {
-	return cmd.toDocker().StdoutPipe()
+	c, err := cmd.toExec()
+	if err != nil {
+		return nil, err
+	}
+	return c.StdoutPipe()
 }
 
 // String returns a human-readable description of this command.
 func (cmd *Cmd) String() string {
-	return cmd.toDocker().String()
+	c, err := cmd.toExec()
+	if err != nil {
+		return fmt.Sprintf("%v (%v)", cmd.Args, err)
+	}
+	return c.String()
 }
@@ -0,0 +1,70 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fips reports whether the binary uses FIPS 140 validated crypto and refuses
+// algorithms which aren't FIPS approved when it does.
+//
+// FIPS mode is enabled by building with BoringCrypto and the fips build tag, e.g. with
+// `make build-fips`. In FIPS mode, TLS connections only negotiate FIPS approved versions,
+// cipher suites and curves (see crypto/tls/fipsonly).
+package fips
+
+import (
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// ModeFIPS is the Mode of binaries which use FIPS 140 validated crypto.
+	ModeFIPS = "fips"
+	// ModeStandard is the Mode of binaries which use the Go standard library's crypto.
+	ModeStandard = "standard"
+)
+
+// approvedDigests are the FIPS approved digest algorithms supported by go-digest.
+var approvedDigests = map[digest.Algorithm]struct{}{
+	digest.SHA256: {},
+	digest.SHA384: {},
+	digest.SHA512: {},
+}
+
+// Mode returns the crypto mode of the binary: ModeFIPS or ModeStandard.
+func Mode() string {
+	if Enabled() {
+		return ModeFIPS
+	}
+	return ModeStandard
+}
+
+// CheckDigestAlgorithm returns an error if FIPS mode is enabled and alg isn't FIPS approved.
+func CheckDigestAlgorithm(alg digest.Algorithm) error {
+	if !Enabled() {
+		return nil
+	}
+	if _, ok := approvedDigests[alg]; !ok {
+		return fmt.Errorf("digest algorithm %q is not FIPS approved", alg)
+	}
+	return nil
+}
+
+// Require returns an error if FIPS mode isn't enabled.
+func Require() error {
+	if !Enabled() {
+		return fmt.Errorf("FIPS mode is required, but the binary isn't built with BoringCrypto and the fips build tag")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fips
+
+import (
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestCheckDigestAlgorithm(t *testing.T) {
+	tests := []struct {
+		alg      digest.Algorithm
+		approved bool
+	}{
+		{digest.SHA256, true},
+		{digest.SHA384, true},
+		{digest.SHA512, true},
+		{digest.Algorithm("blake3"), false},
+		{digest.Algorithm("md5"), false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.alg), func(t *testing.T) {
+			err := CheckDigestAlgorithm(tt.alg)
+			// Only FIPS mode refuses algorithms which aren't approved.
+			if refused := err != nil; refused != (Enabled() && !tt.approved) {
+				t.Fatalf("unexpected result in %s mode: %v", Mode(), err)
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	if err := Require(); (err == nil) != Enabled() {
+		t.Fatalf("unexpected result in %s mode: %v", Mode(), err)
+	}
+}
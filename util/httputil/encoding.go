@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package httputil provides HTTP transports shared by the clients of registries.
+package httputil
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetadataAcceptEncoding is the Accept-Encoding of the requests of manifests and
+// referrers, in order of preference.
+const MetadataAcceptEncoding = "zstd, gzip"
+
+// NewMetadataEncodingTransport returns a transport which asks registries to compress
+// the responses of GET requests of manifests and referrers with zstd or gzip, and
+// decompresses them. Large indices compress well, so this saves round trips over
+// high-latency links. Other requests, e.g. the requests of blobs, which are already
+// compressed and read by range, are sent with rt unchanged, as are requests which set
+// their own Accept-Encoding.
+func NewMetadataEncodingTransport(rt http.RoundTripper) http.RoundTripper {
+	return &metadataEncodingTransport{rt: rt}
+}
+
+type metadataEncodingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *metadataEncodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// HEAD requests are skipped, since their Content-Length is the size of manifests.
+	if req.Method != http.MethodGet || !isMetadataPath(req.URL.Path) ||
+		req.Header.Get("Accept-Encoding") != "" || req.Header.Get("Range") != "" {
+		return t.rt.RoundTrip(req)
+	}
+	// RoundTrippers must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", MetadataAcceptEncoding)
+	res, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return res, nil
+	}
+	body, err := decodeBody(encoding, res.Body)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// isMetadataPath returns whether path is the path of a manifest or of the referrers
+// of a manifest in the distribution API.
+func isMetadataPath(path string) bool {
+	return strings.HasPrefix(path, "/v2/") &&
+		(strings.Contains(path, "/manifests/") || strings.Contains(path, "/referrers/"))
+}
+
+// decodeBody returns a reader of the body r encoded with encoding. Closing it closes r.
+func decodeBody(encoding string, r io.ReadCloser) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip response: %w", err)
+		}
+		return &decodedBody{Reader: zr, close: func() { zr.Close() }, body: r}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd response: %w", err)
+		}
+		return &decodedBody{Reader: zr, close: zr.Close, body: r}, nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
+
+type decodedBody struct {
+	io.Reader
+	close func()
+	body  io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.close()
+	return b.body.Close()
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const testManifest = `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`
+
+func encode(t *testing.T, encoding string) []byte {
+	var b bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&b)
+		w.Write([]byte(testManifest))
+		w.Close()
+	case "zstd":
+		w, err := zstd.NewWriter(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(testManifest))
+		w.Close()
+	default:
+		b.WriteString(testManifest)
+	}
+	return b.Bytes()
+}
+
+func TestMetadataEncodingTransport(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		encoding       string
+		expectedAccept string
+	}{
+		{
+			name:           "zstd manifest",
+			method:         http.MethodGet,
+			path:           "/v2/foo/manifests/latest",
+			encoding:       "zstd",
+			expectedAccept: MetadataAcceptEncoding,
+		},
+		{
+			name:           "gzip referrers",
+			method:         http.MethodGet,
+			path:           "/v2/foo/bar/referrers/sha256:abc",
+			encoding:       "gzip",
+			expectedAccept: MetadataAcceptEncoding,
+		},
+		{
+			name:           "uncompressed manifest",
+			method:         http.MethodGet,
+			path:           "/v2/foo/manifests/latest",
+			expectedAccept: MetadataAcceptEncoding,
+		},
+		{
+			name:   "head manifest",
+			method: http.MethodHead,
+			path:   "/v2/foo/manifests/latest",
+		},
+		{
+			name:   "blob",
+			method: http.MethodGet,
+			path:   "/v2/foo/blobs/sha256:abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accept string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accept = r.Header.Get("Accept-Encoding")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(encode(t, tt.encoding))
+			}))
+			defer srv.Close()
+
+			// the default transport would ask for gzip itself.
+			client := &http.Client{Transport: NewMetadataEncodingTransport(&http.Transport{DisableCompression: true})}
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			defer res.Body.Close()
+			if accept != tt.expectedAccept {
+				t.Fatalf("unexpected Accept-Encoding: expected %q, got %q", tt.expectedAccept, accept)
+			}
+			if tt.method == http.MethodHead || tt.expectedAccept == "" {
+				return
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if string(b) != testManifest {
+				t.Fatalf("unexpected body %q", b)
+			}
+			if e := res.Header.Get("Content-Encoding"); e != "" {
+				t.Fatalf("expected Content-Encoding to be removed, got %q", e)
+			}
+		})
+	}
+}
+
+func TestMetadataEncodingTransportKeepsAcceptEncoding(t *testing.T) {
+	var accept string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept-Encoding")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewMetadataEncodingTransport(http.DefaultTransport)}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v2/foo/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	res.Body.Close()
+	if accept != "identity" {
+		t.Fatalf("expected the Accept-Encoding of the request, got %q", accept)
+	}
+	if req.Header.Get("Accept-Encoding") != "identity" {
+		t.Fatal("expected the request not to be modified")
+	}
+}
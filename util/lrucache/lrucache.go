@@ -34,6 +34,7 @@
 package lrucache
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/golang/groupcache/lru"
@@ -46,6 +47,11 @@ type Cache struct {
 	cache *lru.Cache
 	mu    sync.Mutex
 
+	// entries are the contents in the cache, which are tracked to find the unused ones.
+	entries map[string]*refCounter
+	// clock orders the uses of the contents.
+	clock uint64
+
 	// OnEvicted optionally specifies a callback function to be
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key string, value interface{})
@@ -53,15 +59,20 @@ type Cache struct {
 
 // New creates new cache.
 func New(maxEntries int) *Cache {
-	inner := lru.New(maxEntries)
-	inner.OnEvicted = func(key lru.Key, value interface{}) {
+	c := &Cache{
+		cache:   lru.New(maxEntries),
+		entries: make(map[string]*refCounter),
+	}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
 		// Decrease the ref count incremented in Add().
 		// When nobody refers to this value, this value will be finalized via refCounter.
-		value.(*refCounter).finalize()
-	}
-	return &Cache{
-		cache: inner,
+		rc := value.(*refCounter)
+		if c.entries[rc.key] == rc {
+			delete(c.entries, rc.key)
+		}
+		rc.finalize()
 	}
+	return c
 }
 
 // Get retrieves the specified object from the cache and increments the reference counter of the
@@ -76,6 +87,7 @@ func (c *Cache) Get(key string) (value interface{}, done func(), ok bool) {
 	}
 	rc := o.(*refCounter)
 	rc.inc()
+	c.use(rc)
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
 
@@ -89,6 +101,7 @@ func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, don
 	if o, ok := c.cache.Get(key); ok {
 		rc := o.(*refCounter)
 		rc.inc()
+		c.use(rc)
 		return rc.v, c.decreaseOnceFunc(rc), false
 	}
 	rc := &refCounter{
@@ -98,6 +111,8 @@ func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, don
 	}
 	rc.initialize() // Keep this object having at least 1 ref count (will be decreased in OnEviction)
 	rc.inc()        // The client references this object (will be decreased on "done")
+	c.use(rc)
+	c.entries[key] = rc
 	c.cache.Add(key, rc)
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
@@ -110,6 +125,42 @@ func (c *Cache) Remove(key string) {
 	c.cache.Remove(key)
 }
 
+// Clear removes all contents from the cache. OnEvicted callback will be called for each
+// of them when nobody refers to it.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache.Clear()
+}
+
+// Unused returns the keys of the contents nobody but the cache refers to, least
+// recently used first. Removing them finalizes them immediately.
+func (c *Cache) Unused() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var unused []*refCounter
+	for _, rc := range c.entries {
+		rc.mu.Lock()
+		refs := rc.refCounts
+		rc.mu.Unlock()
+		if refs <= 1 {
+			unused = append(unused, rc)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].lastUsed < unused[j].lastUsed })
+	keys := make([]string, 0, len(unused))
+	for _, rc := range unused {
+		keys = append(keys, rc.key)
+	}
+	return keys
+}
+
+// use marks rc as the most recently used content. c.mu must be held.
+func (c *Cache) use(rc *refCounter) {
+	c.clock++
+	rc.lastUsed = c.clock
+}
+
 func (c *Cache) decreaseOnceFunc(rc *refCounter) func() {
 	var once sync.Once
 	return func() {
@@ -125,6 +176,8 @@ type refCounter struct {
 	key       string
 	v         interface{}
 	refCounts int64
+	// lastUsed is the value of the clock of the cache when the content was last used.
+	lastUsed uint64
 
 	mu sync.Mutex
 
@@ -34,6 +34,7 @@ package lrucache
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -114,6 +115,35 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestClear(t *testing.T) {
+	var evicted []string
+	c := New(2)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	done1()
+	_, done2, _ := c.Add("key2", "abcd2")
+
+	c.Clear()
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Fatalf("only unused content must be evicted on clear; got %v", evicted)
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatalf("content in use must be removed on clear")
+	}
+
+	done2()
+	if len(evicted) != 2 || evicted[1] != "key2" {
+		t.Fatalf("content in use must be evicted once it's released; got %v", evicted)
+	}
+	if _, done, added := c.Add("key1", "abcd1"); !added {
+		t.Fatalf("content must be added after clear")
+	} else {
+		done()
+	}
+}
+
 func TestEviction(t *testing.T) {
 	var evicted []string
 	c := New(2)
@@ -166,3 +196,40 @@ func TestEviction(t *testing.T) {
 		return
 	}
 }
+
+func TestUnused(t *testing.T) {
+	var evicted []string
+	c := New(3)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	_, done2, _ := c.Add("key2", "abcd2")
+	_, done3, _ := c.Add("key3", "abcd3")
+	if unused := c.Unused(); len(unused) != 0 {
+		t.Fatalf("all contents are used, but got unused %v", unused)
+	}
+
+	done3()
+	done1()
+	done2()
+	_, done12, _ := c.Get("key1")
+	done12()
+	if unused := c.Unused(); !reflect.DeepEqual(unused, []string{"key2", "key3", "key1"}) {
+		t.Fatalf("unexpected unused contents %v", unused)
+	}
+
+	_, done22, _ := c.Get("key2")
+	if unused := c.Unused(); !reflect.DeepEqual(unused, []string{"key3", "key1"}) {
+		t.Fatalf("unexpected unused contents %v", unused)
+	}
+	done22()
+
+	c.Remove("key3")
+	if !reflect.DeepEqual(evicted, []string{"key3"}) {
+		t.Fatalf("unused content must be evicted immediately, got %v", evicted)
+	}
+	if unused := c.Unused(); !reflect.DeepEqual(unused, []string{"key1", "key2"}) {
+		t.Fatalf("unexpected unused contents %v", unused)
+	}
+}
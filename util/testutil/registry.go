@@ -0,0 +1,555 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Range is a range of bytes of a blob. End is inclusive, like in HTTP Range headers.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// BlobRequest is a request for a blob received by a Registry.
+type BlobRequest struct {
+	Method string
+	// Ranges are the ranges of the request, or nil if the whole blob was requested.
+	Ranges []Range
+}
+
+type registryManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// Registry is an in-process OCI registry which serves blobs and manifests from memory and
+// records the requests for each blob, so that tests can assert exactly which parts of a
+// blob (e.g. which spans of a layer) were fetched. Blobs are served with single and
+// multi-range requests, and referrers are served with the Referrers API. Images can be
+// pushed to it with the distribution API (e.g. with `nerdctl push`).
+type Registry struct {
+	server    *httptest.Server
+	opts      registryOptions
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string]map[string]registryManifest // repository -> tag or digest -> manifest
+	requests  map[digest.Digest][]BlobRequest
+	uploads   map[string]*bytes.Buffer
+	nextID    int
+}
+
+type registryOptions struct {
+	user, pass    string
+	cert          *tls.Certificate
+	address       string
+	noReferrerAPI bool
+}
+
+// RegistryOption configures a Registry.
+type RegistryOption func(*registryOptions)
+
+// WithBasicAuth requires requests to the registry to authenticate with user and pass.
+func WithBasicAuth(user, pass string) RegistryOption {
+	return func(o *registryOptions) {
+		o.user, o.pass = user, pass
+	}
+}
+
+// WithTLSCertificate serves the registry over HTTPS with cert.
+func WithTLSCertificate(cert tls.Certificate) RegistryOption {
+	return func(o *registryOptions) {
+		o.cert = &cert
+	}
+}
+
+// WithListenAddress listens on address (e.g. "0.0.0.0:443") instead of a random port of
+// the loopback interface, e.g. so that the registry is reachable from a VM.
+func WithListenAddress(address string) RegistryOption {
+	return func(o *registryOptions) {
+		o.address = address
+	}
+}
+
+// WithoutReferrersAPI doesn't serve the Referrers API, like registries which don't support OCI 1.1.
+func WithoutReferrersAPI() RegistryOption {
+	return func(o *registryOptions) {
+		o.noReferrerAPI = true
+	}
+}
+
+// NewRegistry starts a new Registry. It must be closed with Close.
+// Like httptest.NewServer, it panics if it can't listen.
+func NewRegistry(opts ...RegistryOption) *Registry {
+	r := &Registry{
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[string]map[string]registryManifest),
+		requests:  make(map[digest.Digest][]BlobRequest),
+		uploads:   make(map[string]*bytes.Buffer),
+	}
+	for _, o := range opts {
+		o(&r.opts)
+	}
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(r.serveHTTP))
+	if r.opts.address != "" {
+		l, err := net.Listen("tcp", r.opts.address)
+		if err != nil {
+			panic(fmt.Sprintf("testutil: failed to listen on %v: %v", r.opts.address, err))
+		}
+		r.server.Listener.Close()
+		r.server.Listener = l
+	}
+	if r.opts.cert != nil {
+		r.server.TLS = &tls.Config{Certificates: []tls.Certificate{*r.opts.cert}}
+		r.server.StartTLS()
+	} else {
+		r.server.Start()
+	}
+	return r
+}
+
+// Close shuts down the registry.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Host returns the host (with port) of the registry, e.g. for image references.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "http://"), "https://")
+}
+
+// PushBlob adds content to the registry and returns its descriptor. Blobs are shared by all repositories.
+func (r *Registry) PushBlob(mediaType string, content []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(content)
+	r.mu.Lock()
+	r.blobs[dgst] = content
+	r.mu.Unlock()
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(content))}
+}
+
+// PushManifest adds the manifest content to repository, referenced by its digest and by tag
+// if it isn't empty, and returns its descriptor.
+func (r *Registry) PushManifest(repository, tag, mediaType string, content []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(content)
+	m := registryManifest{mediaType: mediaType, content: content}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.manifests[repository] == nil {
+		r.manifests[repository] = make(map[string]registryManifest)
+	}
+	r.manifests[repository][dgst.String()] = m
+	if tag != "" {
+		r.manifests[repository][tag] = m
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(content))}
+}
+
+// BlobRequests returns the requests for the blob dgst since the registry started or
+// requests were reset.
+func (r *Registry) BlobRequests(dgst digest.Digest) []BlobRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]BlobRequest(nil), r.requests[dgst]...)
+}
+
+// FetchedRanges returns the ranges of the blob dgst fetched with GET requests, sorted and
+// merged where they overlap or are adjacent.
+func (r *Registry) FetchedRanges(dgst digest.Digest) []Range {
+	r.mu.Lock()
+	size := int64(len(r.blobs[dgst]))
+	var ranges []Range
+	for _, req := range r.requests[dgst] {
+		if req.Method != http.MethodGet {
+			continue
+		}
+		if req.Ranges == nil {
+			ranges = append(ranges, Range{0, size - 1})
+		}
+		ranges = append(ranges, req.Ranges...)
+	}
+	r.mu.Unlock()
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := []Range{ranges[0]}
+	for _, rg := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rg.Start <= last.End+1 {
+			if rg.End > last.End {
+				last.End = rg.End
+			}
+			continue
+		}
+		merged = append(merged, rg)
+	}
+	return merged
+}
+
+// ResetRequests forgets the recorded requests.
+func (r *Registry) ResetRequests() {
+	r.mu.Lock()
+	r.requests = make(map[digest.Digest][]BlobRequest)
+	r.mu.Unlock()
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.opts.user != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != r.opts.user || pass != r.opts.pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="testutil"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPatch, http.MethodPut:
+		r.servePush(w, req, path)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, kind := range []string{"blobs", "manifests", "referrers"} {
+		sep := "/" + kind + "/"
+		i := strings.LastIndex(path, sep)
+		if i < 0 {
+			continue
+		}
+		repository, ref := path[:i], path[i+len(sep):]
+		switch kind {
+		case "blobs":
+			r.serveBlob(w, req, ref)
+		case "manifests":
+			r.serveManifest(w, req, repository, ref)
+		case "referrers":
+			if r.opts.noReferrerAPI {
+				http.NotFound(w, req)
+				return
+			}
+			r.serveReferrers(w, req, repository, ref)
+		}
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, ref string) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	content, ok := r.blobs[dgst]
+	var ranges []Range
+	if ok {
+		ranges, err = parseRanges(req.Header.Get("Range"), int64(len(content)))
+		if err == nil {
+			r.requests[dgst] = append(r.requests[dgst], BlobRequest{Method: req.Method, Ranges: ranges})
+		}
+	}
+	r.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case 1:
+		rg := ranges[0]
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rg.Start, rg.End, len(content)))
+		w.Header().Set("Content-Length", strconv.FormatInt(rg.End-rg.Start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if req.Method == http.MethodGet {
+			w.Write(content[rg.Start : rg.End+1])
+		}
+	default:
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, rg := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  []string{"application/octet-stream"},
+				"Content-Range": []string{fmt.Sprintf("bytes %d-%d/%d", rg.Start, rg.End, len(content))},
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			part.Write(content[rg.Start : rg.End+1])
+		}
+		mw.Close()
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusPartialContent)
+		if req.Method == http.MethodGet {
+			w.Write(buf.Bytes())
+		}
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	r.mu.Lock()
+	m, ok := r.manifests[repository][ref]
+	r.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(m.content)
+	}
+}
+
+// servePush serves the requests of the distribution API which push blobs and manifests.
+func (r *Registry) servePush(w http.ResponseWriter, req *http.Request, path string) {
+	const uploadsSep = "/blobs/uploads/"
+	if i := strings.Index(path, uploadsSep); i >= 0 {
+		repository, id := path[:i], path[i+len(uploadsSep):]
+		r.serveUpload(w, req, repository, id)
+		return
+	}
+	const manifestsSep = "/manifests/"
+	i := strings.LastIndex(path, manifestsSep)
+	if i < 0 || req.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repository, ref := path[:i], path[i+len(manifestsSep):]
+	content, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := ref
+	if dgst, err := digest.Parse(ref); err == nil {
+		if dgst != digest.FromBytes(content) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		tag = ""
+	}
+	desc := r.PushManifest(repository, tag, req.Header.Get("Content-Type"), content)
+	w.Header().Set("Location", "/v2/"+repository+"/manifests/"+desc.Digest.String())
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveUpload serves the requests which upload the blob with the upload id to repository.
+// An empty id starts an upload.
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repository, id string) {
+	created := func(dgst digest.Digest) {
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/"+dgst.String())
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	}
+	query := req.URL.Query()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id == "" {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if mount, err := digest.Parse(query.Get("mount")); err == nil {
+			if _, ok := r.blobs[mount]; ok {
+				created(mount)
+				return
+			}
+		}
+		r.nextID++
+		id = strconv.Itoa(r.nextID)
+		r.uploads[id] = &bytes.Buffer{}
+		if query.Get("digest") == "" {
+			w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+			w.Header().Set("Docker-Upload-UUID", id)
+			w.Header().Set("Range", "0-0")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		// monolithic upload
+	}
+	buf, ok := r.uploads[id]
+	if !ok {
+		http.Error(w, "upload unknown", http.StatusNotFound)
+		return
+	}
+	if _, err := io.Copy(buf, req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method == http.MethodPatch {
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+id)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	delete(r.uploads, id)
+	dgst, err := digest.Parse(query.Get("digest"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dgst != dgst.Algorithm().FromBytes(buf.Bytes()) {
+		http.Error(w, "digest mismatch", http.StatusBadRequest)
+		return
+	}
+	r.blobs[dgst] = buf.Bytes()
+	created(dgst)
+}
+
+// serveReferrers serves the index of the manifests in repository whose subject is ref.
+func (r *Registry) serveReferrers(w http.ResponseWriter, req *http.Request, repository, ref string) {
+	subject, err := digest.Parse(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{},
+	}
+	index.SchemaVersion = 2
+	r.mu.Lock()
+	for key, m := range r.manifests[repository] {
+		if key != digest.FromBytes(m.content).String() {
+			continue // tags
+		}
+		var parsed struct {
+			ArtifactType string              `json:"artifactType"`
+			Config       ocispec.Descriptor  `json:"config"`
+			Subject      *ocispec.Descriptor `json:"subject"`
+			Annotations  map[string]string   `json:"annotations"`
+		}
+		if err := json.Unmarshal(m.content, &parsed); err != nil || parsed.Subject == nil || parsed.Subject.Digest != subject {
+			continue
+		}
+		desc := ocispec.Descriptor{
+			MediaType:    m.mediaType,
+			ArtifactType: parsed.ArtifactType,
+			Digest:       digest.Digest(key),
+			Size:         int64(len(m.content)),
+			Annotations:  parsed.Annotations,
+		}
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = parsed.Config.MediaType
+		}
+		if artifactType == "" || desc.ArtifactType == artifactType {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(index.Manifests, func(i, j int) bool { return index.Manifests[i].Digest < index.Manifests[j].Digest })
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(index)
+	}
+}
+
+// parseRanges parses the Range header h of a request for a blob of size bytes.
+// It returns nil if h is empty.
+func parseRanges(h string, size int64) ([]Range, error) {
+	if h == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(h, "bytes=") {
+		return nil, fmt.Errorf("unsupported range unit in %q", h)
+	}
+	spec := strings.TrimPrefix(h, "bytes=")
+	var ranges []Range
+	for _, s := range strings.Split(spec, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		var rg Range
+		var err error
+		switch {
+		case first == "":
+			// suffix range: the last bytes of the blob
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %w", s, err)
+			}
+			if n > size {
+				n = size
+			}
+			rg = Range{size - n, size - 1}
+		default:
+			if rg.Start, err = strconv.ParseInt(first, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid range %q: %w", s, err)
+			}
+			rg.End = size - 1
+			if last != "" {
+				if rg.End, err = strconv.ParseInt(last, 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid range %q: %w", s, err)
+				}
+				if rg.End >= size {
+					rg.End = size - 1
+				}
+			}
+		}
+		if rg.Start > rg.End || rg.Start >= size {
+			return nil, fmt.Errorf("unsatisfiable range %q for size %d", s, size)
+		}
+		ranges = append(ranges, rg)
+	}
+	return ranges, nil
+}
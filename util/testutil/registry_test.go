@@ -0,0 +1,219 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRegistryBlobRanges(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	content := []byte("0123456789abcdefghij")
+	desc := r.PushBlob(ocispec.MediaTypeImageLayerGzip, content)
+	url := "http://" + r.Host() + "/v2/test/blobs/" + desc.Digest.String()
+
+	get := func(rangeHeader string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("bytes=2-4")
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(b) != "234" {
+		t.Fatalf("unexpected single range response %d %q", resp.StatusCode, b)
+	}
+
+	resp = get("bytes=0-1,10-11")
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected multi range content type %q: %v", resp.Header.Get("Content-Type"), err)
+	}
+	var parts []string
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+" "+string(b))
+	}
+	resp.Body.Close()
+	if expected := []string{"bytes 0-1/20 01", "bytes 10-11/20 ab"}; !reflect.DeepEqual(parts, expected) {
+		t.Fatalf("unexpected parts; expected %q, got %q", expected, parts)
+	}
+
+	resp = get("bytes=30-40")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("unexpected status %d for unsatisfiable range", resp.StatusCode)
+	}
+
+	expectedRequests := []BlobRequest{
+		{Method: http.MethodGet, Ranges: []Range{{2, 4}}},
+		{Method: http.MethodGet, Ranges: []Range{{0, 1}, {10, 11}}},
+	}
+	if got := r.BlobRequests(desc.Digest); !reflect.DeepEqual(got, expectedRequests) {
+		t.Fatalf("unexpected requests; expected %+v, got %+v", expectedRequests, got)
+	}
+	if got, expected := r.FetchedRanges(desc.Digest), []Range{{0, 4}, {10, 11}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected fetched ranges; expected %+v, got %+v", expected, got)
+	}
+
+	r.ResetRequests()
+	resp = get("")
+	resp.Body.Close()
+	if got, expected := r.FetchedRanges(desc.Digest), []Range{{0, 19}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected fetched ranges after reset; expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestRegistryReferrers(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	image := r.PushManifest("test", "latest", ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`))
+	referrer, err := json.Marshal(ocispec.Manifest{
+		Config:  ocispec.Descriptor{MediaType: "application/vnd.example.config"},
+		Subject: &image,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := r.PushManifest("test", "", ocispec.MediaTypeImageManifest, referrer)
+
+	for _, tt := range []struct {
+		query    string
+		expected int
+	}{
+		{"", 1},
+		{"?artifactType=application/vnd.example.config", 1},
+		{"?artifactType=application/vnd.other", 0},
+	} {
+		resp, err := http.Get("http://" + r.Host() + "/v2/test/referrers/" + image.Digest.String() + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var index ocispec.Index
+		err = json.NewDecoder(resp.Body).Decode(&index)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Manifests) != tt.expected {
+			t.Fatalf("%q: expected %d referrers, got %+v", tt.query, tt.expected, index.Manifests)
+		}
+		if tt.expected > 0 && (index.Manifests[0].Digest != desc.Digest || index.Manifests[0].ArtifactType != "application/vnd.example.config") {
+			t.Fatalf("%q: unexpected referrer %+v", tt.query, index.Manifests[0])
+		}
+	}
+}
+
+func TestRegistryPush(t *testing.T) {
+	r := NewRegistry(WithBasicAuth("user", "pass"))
+	defer r.Close()
+	base := "http://" + r.Host()
+
+	do := func(method, url string, body []byte, expected int) *http.Response {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "pass")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s: expected status %d, got %d", method, url, expected, resp.StatusCode)
+		}
+		return resp
+	}
+
+	resp, err := http.Get(base + "/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthenticated requests to be rejected, got %d", resp.StatusCode)
+	}
+
+	// push a blob in chunks
+	content := []byte("0123456789")
+	dgst := digest.FromBytes(content)
+	resp = do(http.MethodPost, base+"/v2/test/blobs/uploads/", nil, http.StatusAccepted)
+	loc := base + resp.Header.Get("Location")
+	resp = do(http.MethodPatch, loc, content[:4], http.StatusAccepted)
+	loc = base + resp.Header.Get("Location")
+	do(http.MethodPut, loc+"?digest="+dgst.String(), content[4:], http.StatusCreated)
+
+	// mount it to another repository
+	do(http.MethodPost, base+"/v2/other/blobs/uploads/?mount="+dgst.String()+"&from=test", nil, http.StatusCreated)
+
+	manifest := []byte(`{"schemaVersion":2}`)
+	resp = do(http.MethodPut, base+"/v2/test/manifests/latest", manifest, http.StatusCreated)
+	if got := resp.Header.Get("Docker-Content-Digest"); got != digest.FromBytes(manifest).String() {
+		t.Fatalf("unexpected manifest digest %q", got)
+	}
+
+	if got := r.blobs[dgst]; !bytes.Equal(got, content) {
+		t.Fatalf("unexpected pushed blob %q", got)
+	}
+	if _, ok := r.manifests["test"]["latest"]; !ok {
+		t.Fatal("pushed manifest isn't tagged")
+	}
+}
+
+func TestRegistryWithoutReferrersAPI(t *testing.T) {
+	r := NewRegistry(WithoutReferrersAPI())
+	defer r.Close()
+	image := r.PushManifest("test", "latest", ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`))
+	resp, err := http.Get("http://" + r.Host() + "/v2/test/referrers/" + image.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the Referrers API to be unsupported, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package compression provides random access into compressed streams.
+//
+// A zinfo is a list of checkpoints of the decompressor state taken at regular
+// intervals (spans) of a compressed stream. With a zinfo, any uncompressed
+// byte range can be decompressed by reading only the spans that contain it,
+// instead of decompressing the stream from the beginning.
+//
+// The package can be used on its own, outside of SOCI, to random-access gzip
+// files:
+//
+//	index, err := compression.NewIndex("archive.tar.gz", 1<<22)
+//	if err != nil {
+//		return err
+//	}
+//	defer index.Close()
+//
+//	f, err := os.Open("archive.tar.gz")
+//	if err != nil {
+//		return err
+//	}
+//	defer f.Close()
+//	st, err := f.Stat()
+//	if err != nil {
+//		return err
+//	}
+//	data, err := index.ExtractRange(f, compression.Offset(st.Size()), 1<<20, 4096)
+//
+// The index can be persisted with `GzipZinfo.Bytes` and loaded again with
+// `NewIndexFromBytes`.
+//
+// `Spans` maps a range of uncompressed bytes to the spans containing it, and
+// `CompressedRange` and `UncompressedRange` map spans to their ranges in the streams,
+// e.g. to tell which bytes of a remote layer have to be fetched to read a file.
+package compression
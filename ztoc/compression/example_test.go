@@ -0,0 +1,76 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func ExampleGzipZinfo_ExtractRange() {
+	dir, err := os.MkdirTemp("", "gzip-zinfo-example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write a gzip file with 1MiB of uncompressed data.
+	var uncompressed []byte
+	for i := 0; i < 1<<20; i++ {
+		uncompressed = append(uncompressed, byte(i%251))
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(uncompressed)
+	gz.Close()
+	filename := filepath.Join(dir, "data.gz")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		panic(err)
+	}
+
+	// Build an index with a checkpoint every 64KiB.
+	index, err := compression.NewIndex(filename, 1<<16)
+	if err != nil {
+		panic(err)
+	}
+	defer index.Close()
+
+	// Persist the index and load it back.
+	indexBytes, err := index.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	loaded, err := compression.NewIndexFromBytes(indexBytes)
+	if err != nil {
+		panic(err)
+	}
+	defer loaded.Close()
+
+	// Extract a range from the middle of the file.
+	r := bytes.NewReader(buf.Bytes())
+	data, err := loaded.ExtractRange(r, compression.Offset(r.Size()), 500000, 8)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(bytes.Equal(data, uncompressed[500000:500008]))
+	// Output: true
+}
@@ -410,70 +410,67 @@ int extract_data_from_file(const char* file, struct gzip_zinfo* index, offset_t
 
 // This is the same as extract_data_fp, but instead of a file, it decompresses
 // data from a buffer which contains the exact data to decompress
-int extract_data_from_buffer(void *d, offset_t datalen,
-                             struct gzip_zinfo *index, offset_t offset,
-                             void *buffer, offset_t len, int first_checkpoint) {
+// extract_data_with_stream extracts data with an initialized raw inflate stream.
+// The caller is responsible for ending the stream.
+static int extract_data_with_stream(z_stream *strm, void *d, offset_t datalen,
+                                    struct gzip_zinfo *index, offset_t offset,
+                                    void *buffer, offset_t len, int first_checkpoint) {
     int ret, skip;
-    z_stream strm;
     unsigned char input[CHUNK], discard[WINSIZE];
     uchar *buf = buffer;
     uchar *data = d;
-    /* proceed only if something reasonable to do */
-    if (len < 0)
-        return 0;
 
     uint8_t bits = get_bits(index, first_checkpoint);
 
-    /* initialize inflate */
-    ret = init_flate(&strm, -15); /* raw inflate */
-    if (ret != Z_OK)
-        return ret;
-
     if (bits) {
         int ret = data[0];
-        inflatePrime(&strm, bits, ret >> (8 - bits));
+        inflatePrime(strm, bits, ret >> (8 - bits));
         data++;
     }
-    (void)inflateSetDictionary(&strm, index->list[first_checkpoint].window,
+    (void)inflateSetDictionary(strm, index->list[first_checkpoint].window,
                                WINSIZE);
     offset -= decode_offset(index->list[first_checkpoint].out);
-    strm.avail_in = 0;
+    strm->avail_in = 0;
     skip = 1; /* while skipping to offset */
     int remaining = datalen;
     do {
         /* define where to put uncompressed data, and how much */
         if (offset == 0 && skip) { /* at offset now */
-            strm.avail_out = len;
-            strm.next_out = buf;
+            strm->avail_out = len;
+            strm->next_out = buf;
             skip = 0; /* only do this once */
         }
         if (offset > WINSIZE) { /* skip WINSIZE bytes */
-            strm.avail_out = WINSIZE;
-            strm.next_out = discard;
+            strm->avail_out = WINSIZE;
+            strm->next_out = discard;
             offset -= WINSIZE;
         } else if (offset != 0) { /* last skip */
-            strm.avail_out = (unsigned)offset;
-            strm.next_out = discard;
+            strm->avail_out = (unsigned)offset;
+            strm->next_out = discard;
             offset = 0;
         }
         /* uncompress until avail_out filled, or end of stream */
         do {
-            if (strm.avail_in == 0) {
+            if (strm->avail_in == 0) {
                 int read = min(remaining, CHUNK);
                 remaining -= read;
                 memcpy(input, data, read);
                 data += read;
-                strm.avail_in = read;
-                strm.next_in = input;
+                strm->avail_in = read;
+                strm->next_in = input;
             }
-            ret = inflate(&strm, Z_NO_FLUSH); /* normal inflate */
+            ret = inflate(strm, Z_NO_FLUSH); /* normal inflate */
+            /* no progress without more input: the compressed data is truncated,
+               e.g. only a prefix of a span was fetched */
+            if (ret == Z_BUF_ERROR && strm->avail_in == 0 && remaining == 0)
+                return GZIP_ZINFO_SHORT_INPUT;
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
-                goto extract_ret;
+                return ret;
             if (ret == Z_STREAM_END)
                 break;
-        } while (strm.avail_out != 0);
+        } while (strm->avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
         if (ret == Z_STREAM_END)
@@ -483,14 +480,64 @@ int extract_data_from_buffer(void *d, offset_t datalen,
     } while (skip);
 
     /* compute number of uncompressed bytes read after offset */
-    ret = skip ? 0 : len - strm.avail_out;
+    return skip ? 0 : len - strm->avail_out;
+}
+
+int extract_data_from_buffer(void *d, offset_t datalen,
+                             struct gzip_zinfo *index, offset_t offset,
+                             void *buffer, offset_t len, int first_checkpoint) {
+    int ret;
+    z_stream strm;
+    /* proceed only if something reasonable to do */
+    if (len < 0)
+        return 0;
+
+    /* initialize inflate */
+    ret = init_flate(&strm, -15); /* raw inflate */
+    if (ret != Z_OK)
+        return ret;
+
+    ret = extract_data_with_stream(&strm, d, datalen, index, offset, buffer, len, first_checkpoint);
 
     /* clean up and return bytes read or error */
-extract_ret:
     (void)inflateEnd(&strm);
     return ret;
 }
 
+z_stream *new_inflate_ctx() {
+    z_stream *strm = malloc(sizeof(z_stream));
+    if (strm == NULL)
+        return NULL;
+    if (init_flate(strm, -15) != Z_OK) { /* raw inflate */
+        free(strm);
+        return NULL;
+    }
+    return strm;
+}
+
+void free_inflate_ctx(z_stream *strm) {
+    if (strm == NULL)
+        return;
+    (void)inflateEnd(strm);
+    free(strm);
+}
+
+int extract_data_from_buffer_with_ctx(z_stream *strm, void *d, offset_t datalen,
+                                      struct gzip_zinfo *index, offset_t offset,
+                                      void *buffer, offset_t len, int first_checkpoint) {
+    int ret;
+    /* proceed only if something reasonable to do */
+    if (len < 0)
+        return 0;
+
+    /* reuse the inflate state of previous extractions */
+    ret = inflateReset(strm);
+    if (ret != Z_OK)
+        return ret;
+
+    return extract_data_with_stream(strm, d, datalen, index, offset, buffer, len, first_checkpoint);
+}
+
 // zinfo - generation/extraction ends.
 
 // zinfo -  zinfo <-> blob conversion starts.
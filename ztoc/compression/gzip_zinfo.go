@@ -17,7 +17,6 @@
 package compression
 
 // #cgo CFLAGS: -I${SRCDIR}/
-// #cgo LDFLAGS: -L${SRCDIR}/../out -l:libz.a
 // #include "gzip_zinfo.h"
 // #include <stdlib.h>
 // #include <stdint.h>
@@ -25,14 +24,48 @@ import "C"
 
 import (
 	"fmt"
+	"io"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
+// ZlibVersion returns the version of the zlib library which is linked into the binary.
+// With zlib-ng, the version ends in ".zlib-ng".
+func ZlibVersion() string {
+	return C.GoString(C.zlibVersion())
+}
+
 // GzipZinfo is a go struct wrapper of the gzip zinfo's C implementation.
 type GzipZinfo struct {
+	// mu guards cZinfo against being freed by Close while it's used, e.g. by
+	// extractions which are still running when the zinfo is closed.
+	mu     sync.RWMutex
 	cZinfo *C.struct_gzip_zinfo
 }
 
+// inflateContext is a raw inflate stream which is reused across span extractions,
+// so that inflate state isn't allocated and initialized for every extraction.
+type inflateContext struct {
+	strm *C.z_stream
+}
+
+// inflateContextPool recycles inflate contexts. Contexts dropped by the pool
+// are freed by their finalizer.
+var inflateContextPool = sync.Pool{
+	New: func() interface{} {
+		strm := C.new_inflate_ctx()
+		if strm == nil {
+			return nil
+		}
+		ctx := &inflateContext{strm: strm}
+		runtime.SetFinalizer(ctx, func(ctx *inflateContext) {
+			C.free_inflate_ctx(ctx.strm)
+		})
+		return ctx
+	},
+}
+
 // newGzipZinfo creates a new instance of `GzipZinfo` from cZinfo byte blob on zTOC.
 func newGzipZinfo(zinfoBytes []byte) (*GzipZinfo, error) {
 	if len(zinfoBytes) == 0 {
@@ -63,15 +96,39 @@ func newGzipZinfoFromFile(gzipFile string, spanSize int64) (*GzipZinfo, error) {
 	}, nil
 }
 
-// Close calls `C.free` on the pointer to `C.struct_gzip_zinfo`.
+// NewIndex builds a `GzipZinfo` for the gzip file `filename`, recording a
+// checkpoint roughly every `spanSize` bytes of uncompressed data. The index can be
+// serialized with `Bytes` and loaded again with `NewIndexFromBytes`, so it only
+// needs to be built once per file. The caller must call `Close` when done.
+func NewIndex(filename string, spanSize int64) (*GzipZinfo, error) {
+	return newGzipZinfoFromFile(filename, spanSize)
+}
+
+// NewIndexFromBytes loads a `GzipZinfo` previously serialized with `Bytes`.
+// The caller must call `Close` when done.
+func NewIndexFromBytes(zinfoBytes []byte) (*GzipZinfo, error) {
+	return newGzipZinfo(zinfoBytes)
+}
+
+// Close calls `C.free` on the pointer to `C.struct_gzip_zinfo`. It waits for the
+// calls which use the zinfo, and the calls after it fail or return zero values.
+// Close may be called more than once, e.g. by a finalizer.
 func (i *GzipZinfo) Close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	if i.cZinfo != nil {
 		C.free(unsafe.Pointer(i.cZinfo))
+		i.cZinfo = nil
 	}
 }
 
 // Bytes returns the byte slice containing the zinfo.
 func (i *GzipZinfo) Bytes() ([]byte, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return nil, ErrZinfoClosed
+	}
 	blobSize := C.get_blob_size(i.cZinfo)
 	bytes := make([]byte, uint64(blobSize))
 	if len(bytes) == 0 {
@@ -87,16 +144,31 @@ func (i *GzipZinfo) Bytes() ([]byte, error) {
 
 // MaxSpanID returns the max span ID.
 func (i *GzipZinfo) MaxSpanID() SpanID {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return 0
+	}
 	return SpanID(C.get_max_span_id(i.cZinfo))
 }
 
 // SpanSize returns the span size of the constructed ztoc.
 func (i *GzipZinfo) SpanSize() Offset {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return 0
+	}
 	return Offset(i.cZinfo.span_size)
 }
 
 // UncompressedOffsetToSpanID returns the ID of the span containing the data pointed by uncompressed offset.
 func (i *GzipZinfo) UncompressedOffsetToSpanID(offset Offset) SpanID {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return 0
+	}
 	return SpanID(C.pt_index_from_ucmp_offset(i.cZinfo, C.long(offset)))
 }
 
@@ -112,21 +184,84 @@ func (i *GzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize
 	if uncompressedSize == 0 {
 		return []byte{}, nil
 	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return nil, ErrZinfoClosed
+	}
 	bytes := make([]byte, uncompressedSize)
-	ret := C.extract_data_from_buffer(
+	ret := i.extractDataFromBuffer(compressedBuf, bytes, uncompressedOffset, spanID, true)
+	if ret == C.GZIP_ZINFO_SHORT_INPUT {
+		return nil, ErrShortInput
+	}
+	if ret <= 0 {
+		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	}
+
+	return bytes, nil
+}
+
+// extractDataFromBuffer extracts len(buf) bytes at uncompressedOffset into buf. If pooled
+// is true, the extraction uses an inflate context from inflateContextPool. The caller
+// must hold i.mu.
+func (i *GzipZinfo) extractDataFromBuffer(compressedBuf, buf []byte, uncompressedOffset Offset, spanID SpanID, pooled bool) C.int {
+	var ctx *inflateContext
+	if pooled {
+		ctx, _ = inflateContextPool.Get().(*inflateContext)
+	}
+	if ctx == nil {
+		return C.extract_data_from_buffer(
+			unsafe.Pointer(&compressedBuf[0]),
+			C.off_t(len(compressedBuf)),
+			i.cZinfo,
+			C.off_t(uncompressedOffset),
+			unsafe.Pointer(&buf[0]),
+			C.off_t(len(buf)),
+			C.int(spanID),
+		)
+	}
+	defer inflateContextPool.Put(ctx)
+	return C.extract_data_from_buffer_with_ctx(
+		ctx.strm,
 		unsafe.Pointer(&compressedBuf[0]),
 		C.off_t(len(compressedBuf)),
 		i.cZinfo,
 		C.off_t(uncompressedOffset),
-		unsafe.Pointer(&bytes[0]),
-		C.off_t(uncompressedSize),
+		unsafe.Pointer(&buf[0]),
+		C.off_t(len(buf)),
 		C.int(spanID),
 	)
-	if ret <= 0 {
-		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+}
+
+// ExtractRange returns `length` bytes of uncompressed data starting at uncompressed
+// `offset` from the gzip stream `r` of size `compressedSize`. Only the spans
+// containing the range are read from `r`, so `r` can be backed by remote storage
+// (e.g. an HTTP range reader) without downloading the whole stream.
+func (i *GzipZinfo) ExtractRange(r io.ReaderAt, compressedSize, offset, length Offset) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid uncompressed offset: %d", offset)
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("invalid uncompressed size: %d", length)
+	}
+	if length == 0 {
+		return []byte{}, nil
 	}
 
-	return bytes, nil
+	spanStart := i.UncompressedOffsetToSpanID(offset)
+	spanEnd := i.UncompressedOffsetToSpanID(offset + length)
+	start := i.StartCompressedOffset(spanStart)
+	end := i.EndCompressedOffset(spanEnd, compressedSize)
+
+	buf := make([]byte, end-start)
+	n, err := r.ReadAt(buf, int64(start))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n != len(buf) {
+		return nil, fmt.Errorf("unexpected data size. read = %d, expected = %d", n, len(buf))
+	}
+	return i.ExtractDataFromBuffer(buf, length, offset, spanStart)
 }
 
 // ExtractDataFromFile wraps `C.extract_data_from_file` and returns the decompressed bytes given the name of the .tar.gz file,
@@ -140,6 +275,11 @@ func (i *GzipZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncom
 	if uncompressedSize == 0 {
 		return []byte{}, nil
 	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return nil, ErrZinfoClosed
+	}
 	bytes := make([]byte, uncompressedSize)
 	ret := C.extract_data_from_file(cstr, i.cZinfo, C.off_t(uncompressedOffset), unsafe.Pointer(&bytes[0]), C.int(uncompressedSize))
 	if ret <= 0 {
@@ -183,15 +323,30 @@ func (i *GzipZinfo) EndUncompressedOffset(spanID SpanID, fileSize Offset) Offset
 
 // getCompressedOffset wraps `C.get_comp_off` and returns the offset for the span in the compressed stream.
 func (i *GzipZinfo) getCompressedOffset(spanID SpanID) Offset {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return 0
+	}
 	return Offset(C.get_comp_off(i.cZinfo, C.int(spanID)))
 }
 
 // hasBits wraps `C.has_bits` and returns true if any data is contained in the previous span.
 func (i *GzipZinfo) hasBits(spanID SpanID) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return false
+	}
 	return C.has_bits(i.cZinfo, C.int(spanID)) != 0
 }
 
 // getUncompressedOffset wraps `C.get_uncomp_off` and returns the offset for the span in the uncompressed stream.
 func (i *GzipZinfo) getUncompressedOffset(spanID SpanID) Offset {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.cZinfo == nil {
+		return 0
+	}
 	return Offset(C.get_ucomp_off(i.cZinfo, C.int(spanID)))
 }
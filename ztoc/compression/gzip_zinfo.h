@@ -81,6 +81,7 @@ enum {
     GZIP_ZINFO_FILE_NOT_FOUND = -80,
     GZIP_ZINFO_INDEX_NULL = -81,
     GZIP_ZINFO_CANNOT_ALLOC = -82,
+    GZIP_ZINFO_SHORT_INPUT = -83,   /* compressed data ends before the requested data */
 };
 
 struct gzip_checkpoint {
@@ -112,6 +113,11 @@ int         has_bits(struct gzip_zinfo *index, int checkpoint);
 int generate_zinfo_from_file(const char* filepath, offset_t span, struct gzip_zinfo** index);
 int extract_data_from_file(const char* file, struct gzip_zinfo* index, offset_t offset, void* buf, int len);
 int extract_data_from_buffer(void* d, offset_t datalen, struct gzip_zinfo* index, offset_t offset, void* buffer, offset_t len, int first_checkpoint);
+// An inflate context is a raw inflate stream which can be reused across extractions
+// to avoid allocating and initializing inflate state for every extraction.
+z_stream* new_inflate_ctx();
+void free_inflate_ctx(z_stream* strm);
+int extract_data_from_buffer_with_ctx(z_stream* strm, void* d, offset_t datalen, struct gzip_zinfo* index, offset_t offset, void* buffer, offset_t len, int first_checkpoint);
 // zinfo - generation/extraction ends.
 
 // zinfo -  zinfo <-> blob conversion starts.
@@ -17,6 +17,14 @@
 package compression
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -169,3 +177,140 @@ func TestExtractDataFromFile(t *testing.T) {
 		})
 	}
 }
+
+// newTestSpan writes a gzip file with size bytes of compressible data and returns its zinfo,
+// along with the uncompressed data and the compressed bytes of span spanID.
+func newTestSpan(tb testing.TB, size int, spanSize int64, spanID SpanID) (*GzipZinfo, []byte, []byte) {
+	uncompressed := make([]byte, size)
+	r := rand.New(rand.NewSource(1))
+	for i := range uncompressed {
+		uncompressed[i] = byte('a' + r.Intn(16))
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(uncompressed)
+	gz.Close()
+	filename := filepath.Join(tb.TempDir(), "data.gz")
+	if err := os.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		tb.Fatalf("failed to write gzip file: %v", err)
+	}
+	zinfo, err := newGzipZinfoFromFile(filename, spanSize)
+	if err != nil {
+		tb.Fatalf("failed to build zinfo: %v", err)
+	}
+	tb.Cleanup(zinfo.Close)
+	if spanID > zinfo.MaxSpanID() {
+		tb.Fatalf("span %d doesn't exist, max span id is %d", spanID, zinfo.MaxSpanID())
+	}
+	start := zinfo.StartCompressedOffset(spanID)
+	end := zinfo.EndCompressedOffset(spanID, Offset(buf.Len()))
+	return zinfo, uncompressed, buf.Bytes()[start:end]
+}
+
+func TestExtractDataFromBufferPooled(t *testing.T) {
+	zinfo, uncompressed, compressedSpan := newTestSpan(t, 1<<20, 1<<16, 3)
+	start := zinfo.StartUncompressedOffset(3)
+	end := zinfo.EndUncompressedOffset(3, Offset(len(uncompressed)))
+	expected := uncompressed[start:end]
+
+	// extract repeatedly so that inflate contexts are reused.
+	for i := 0; i < 10; i++ {
+		for _, pooled := range []bool{true, false} {
+			buf := make([]byte, len(expected))
+			if ret := zinfo.extractDataFromBuffer(compressedSpan, buf, start, 3, pooled); ret <= 0 {
+				t.Fatalf("failed to extract data (pooled: %t); return code: %v", pooled, ret)
+			}
+			if !bytes.Equal(buf, expected) {
+				t.Fatalf("extracted data doesn't match (pooled: %t)", pooled)
+			}
+		}
+	}
+}
+
+func TestGzipZinfoClose(t *testing.T) {
+	zinfo, uncompressed, compressedSpan := newTestSpan(t, 1<<20, 1<<16, 3)
+	start := zinfo.StartUncompressedOffset(3)
+	end := zinfo.EndUncompressedOffset(3, Offset(len(uncompressed)))
+
+	// extractions racing with Close either succeed or fail cleanly.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := zinfo.ExtractDataFromBuffer(compressedSpan, end-start, start, 3); err != nil && !errors.Is(err, ErrZinfoClosed) {
+					t.Errorf("expected extraction to succeed or fail with ErrZinfoClosed, got %v", err)
+				}
+			}
+		}()
+	}
+	zinfo.Close()
+	zinfo.Close()
+	wg.Wait()
+	if _, err := zinfo.ExtractDataFromBuffer(compressedSpan, end-start, start, 3); !errors.Is(err, ErrZinfoClosed) {
+		t.Fatalf("expected ErrZinfoClosed after Close, got %v", err)
+	}
+	if zinfo.MaxSpanID() != 0 {
+		t.Fatalf("expected a closed zinfo to have no spans")
+	}
+}
+
+func TestExtractDataFromSpanPrefix(t *testing.T) {
+	zinfo, uncompressed, compressedSpan := newTestSpan(t, 1<<20, 1<<16, 3)
+	start := zinfo.StartUncompressedOffset(3)
+	end := zinfo.EndUncompressedOffset(3, Offset(len(uncompressed)))
+
+	// the beginning of a span can be extracted from a prefix of the compressed span.
+	prefix := compressedSpan[:len(compressedSpan)/2]
+	data, err := zinfo.ExtractDataFromBuffer(prefix, 1024, start, 3)
+	if err != nil {
+		t.Fatalf("failed to extract data from span prefix: %v", err)
+	}
+	if !bytes.Equal(data, uncompressed[start:start+1024]) {
+		t.Fatal("data extracted from span prefix doesn't match")
+	}
+
+	// the whole span can't.
+	if _, err := zinfo.ExtractDataFromBuffer(prefix, end-start, start, 3); !errors.Is(err, ErrShortInput) {
+		t.Fatalf("expected ErrShortInput extracting the whole span from its prefix, got %v", err)
+	}
+}
+
+func BenchmarkExtractDataFromBuffer(b *testing.B) {
+	zinfo, uncompressed, compressedSpan := newTestSpan(b, 1<<20, 1<<16, 3)
+	start := zinfo.StartUncompressedOffset(3)
+	end := zinfo.EndUncompressedOffset(3, Offset(len(uncompressed)))
+	buf := make([]byte, end-start)
+
+	for _, bc := range []struct {
+		name   string
+		pooled bool
+	}{
+		{name: "pooled", pooled: true},
+		{name: "unpooled", pooled: false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, len(buf))
+				for pb.Next() {
+					if ret := zinfo.extractDataFromBuffer(compressedSpan, buf, start, 3, bc.pooled); ret <= 0 {
+						b.Fatalf("failed to extract data; return code: %v", ret)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestZlibVersion(t *testing.T) {
+	version := ZlibVersion()
+	if version == "" {
+		t.Fatal("zlib version is empty")
+	}
+	if isNg := strings.Contains(version, "zlib-ng"); isNg != (ZlibImplementation == "zlib-ng") {
+		t.Fatalf("zlib version %q doesn't match implementation %q", version, ZlibImplementation)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+// SpanRange is a range of consecutive spans, from First to Last inclusive.
+type SpanRange struct {
+	First SpanID
+	Last  SpanID
+}
+
+// Len returns the number of spans in r.
+func (r SpanRange) Len() int {
+	return int(r.Last-r.First) + 1
+}
+
+// Spans returns the range of the spans of zinfo containing the length uncompressed
+// bytes starting at offset. ok is false if length isn't positive.
+func Spans(zinfo Zinfo, offset, length Offset) (r SpanRange, ok bool) {
+	if length <= 0 {
+		return SpanRange{}, false
+	}
+	return SpanRange{
+		First: zinfo.UncompressedOffsetToSpanID(offset),
+		Last:  zinfo.UncompressedOffsetToSpanID(offset + length - 1),
+	}, true
+}
+
+// CompressedRange returns the range [start, end) of the spans r of zinfo in a compressed
+// stream of size compressedSize, which is what has to be read to extract any uncompressed
+// bytes of the spans.
+func CompressedRange(zinfo Zinfo, r SpanRange, compressedSize Offset) (start, end Offset) {
+	return zinfo.StartCompressedOffset(r.First), zinfo.EndCompressedOffset(r.Last, compressedSize)
+}
+
+// UncompressedRange returns the range [start, end) of the spans r of zinfo in an
+// uncompressed stream of size uncompressedSize.
+func UncompressedRange(zinfo Zinfo, r SpanRange, uncompressedSize Offset) (start, end Offset) {
+	return zinfo.StartUncompressedOffset(r.First), zinfo.EndUncompressedOffset(r.Last, uncompressedSize)
+}
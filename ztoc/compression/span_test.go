@@ -0,0 +1,93 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpans(t *testing.T) {
+	zinfo, uncompressed, compressedSpan := newTestSpan(t, 1<<20, 1<<16, 3)
+	size := Offset(len(uncompressed))
+	start, end := UncompressedRange(zinfo, SpanRange{First: 3, Last: 3}, size)
+	if start != zinfo.StartUncompressedOffset(3) || end != zinfo.EndUncompressedOffset(3, size) {
+		t.Fatalf("unexpected uncompressed range of span 3: [%d, %d)", start, end)
+	}
+
+	tests := []struct {
+		name     string
+		offset   Offset
+		length   Offset
+		expected SpanRange
+		ok       bool
+	}{
+		{
+			name:     "whole span",
+			offset:   start,
+			length:   end - start,
+			expected: SpanRange{First: 3, Last: 3},
+			ok:       true,
+		},
+		{
+			name:     "one byte past the span",
+			offset:   start,
+			length:   end - start + 1,
+			expected: SpanRange{First: 3, Last: 4},
+			ok:       true,
+		},
+		{
+			name:     "last byte of the previous span",
+			offset:   start - 1,
+			length:   2,
+			expected: SpanRange{First: 2, Last: 3},
+			ok:       true,
+		},
+		{
+			name:   "empty range",
+			offset: start,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := Spans(zinfo, tt.offset, tt.length)
+			if ok != tt.ok {
+				t.Fatalf("unexpected ok: expected %t, got %t", tt.ok, ok)
+			}
+			if ok && r != tt.expected {
+				t.Fatalf("unexpected spans: expected %+v, got %+v", tt.expected, r)
+			}
+		})
+	}
+
+	if n := (SpanRange{First: 2, Last: 4}).Len(); n != 3 {
+		t.Fatalf("expected 3 spans, got %d", n)
+	}
+
+	// the compressed range of the span is enough to extract it.
+	cstart, cend := CompressedRange(zinfo, SpanRange{First: 3, Last: 3}, 1<<30)
+	if cend-cstart != Offset(len(compressedSpan)) {
+		t.Fatalf("unexpected compressed size of span 3: expected %d, got %d", len(compressedSpan), cend-cstart)
+	}
+	data, err := zinfo.ExtractDataFromBuffer(compressedSpan, end-start, start, 3)
+	if err != nil {
+		t.Fatalf("failed to extract span: %v", err)
+	}
+	if !bytes.Equal(data, uncompressed[start:end]) {
+		t.Fatal("extracted span doesn't match")
+	}
+}
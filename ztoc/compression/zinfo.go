@@ -17,9 +17,17 @@
 package compression
 
 import (
+	"errors"
 	"fmt"
 )
 
+// ErrShortInput is returned when the compressed data ends before the requested
+// uncompressed data, e.g. because only a prefix of a span was passed.
+var ErrShortInput = errors.New("compressed data ends before the requested data")
+
+// ErrZinfoClosed is returned when a zinfo is used after it's closed.
+var ErrZinfoClosed = errors.New("zinfo is closed")
+
 // Zinfo is the interface for dealing with compressed data efficiently. It chunks
 // a compressed stream (e.g. a gzip file) into spans and records the chunk offset,
 // so that you can interact with the compressed stream per span individually (or in parallel).
@@ -0,0 +1,30 @@
+//go:build zlib_ng
+
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package compression
+
+// zlib-ng is built in zlib compatible mode by `make zlib-ng`. It selects SIMD implementations
+// (e.g. NEON and the CRC32 instructions on ARM64, SSE4/AVX2 on x86-64) for inflate, adler32 and
+// crc32 at runtime, based on the features of the CPU.
+
+// #cgo CFLAGS: -I${SRCDIR}/../../out/zlib-ng/include
+// #cgo LDFLAGS: -L${SRCDIR}/../../out/zlib-ng/lib -l:libz.a
+import "C"
+
+// ZlibImplementation is the zlib implementation linked into the binary.
+const ZlibImplementation = "zlib-ng"
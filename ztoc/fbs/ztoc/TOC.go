@@ -53,8 +53,20 @@ func (rcv *TOC) MetadataLength() int {
 	return 0
 }
 
+func (rcv *TOC) ChunkSize() int64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(6))
+	if o != 0 {
+		return rcv._tab.GetInt64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TOC) MutateChunkSize(n int64) bool {
+	return rcv._tab.MutateInt64Slot(6, n)
+}
+
 func TOCStart(builder *flatbuffers.Builder) {
-	builder.StartObject(1)
+	builder.StartObject(2)
 }
 func TOCAddMetadata(builder *flatbuffers.Builder, metadata flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(metadata), 0)
@@ -62,6 +74,9 @@ func TOCAddMetadata(builder *flatbuffers.Builder, metadata flatbuffers.UOffsetT)
 func TOCStartMetadataVector(builder *flatbuffers.Builder, numElems int) flatbuffers.UOffsetT {
 	return builder.StartVector(4, numElems, 4)
 }
+func TOCAddChunkSize(builder *flatbuffers.Builder, chunkSize int64) {
+	builder.PrependInt64Slot(1, chunkSize, 0)
+}
 func TOCEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
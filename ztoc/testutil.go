@@ -27,7 +27,7 @@ import (
 )
 
 // BuildZtocReader creates the tar gz file for tar entries. It returns ztoc and io.SectionReader of the file.
-func BuildZtocReader(_ *testing.T, ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+func BuildZtocReader(_ testing.TB, ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
 	tarReader := testutil.BuildTarGz(ents, compressionLevel, opts...)
 
 	tarFileName, tarData, err := testutil.WriteTarToTempFile("tmp.*", tarReader)
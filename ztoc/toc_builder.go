@@ -25,6 +25,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
 )
 
 // TarProvider creates a tar reader from a compressed file reader (e.g., a gzip file reader),
@@ -72,21 +73,31 @@ func (tb TocBuilder) CheckCompressionAlgorithm(algorithm string) bool {
 // TocFromFile creates a `TOC` given a layer blob filename and the compression
 // algorithm used by the layer.
 func (tb TocBuilder) TocFromFile(algorithm, filename string) (TOC, compression.Offset, error) {
+	return tb.tocFromFile(algorithm, filename, 0)
+}
+
+// tocFromFile creates a `TOC` like `TocFromFile`, recording the digests of the
+// contents of regular files in chunks of chunkSize if it's positive.
+func (tb TocBuilder) tocFromFile(algorithm, filename string, chunkSize compression.Offset) (TOC, compression.Offset, error) {
 	if !tb.CheckCompressionAlgorithm(algorithm) {
 		return TOC{}, 0, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
 	}
 
-	fm, uncompressedArchiveSize, err := tb.getFileMetadata(algorithm, filename)
+	fm, uncompressedArchiveSize, err := tb.getFileMetadata(algorithm, filename, chunkSize)
 	if err != nil {
 		return TOC{}, 0, err
 	}
 
-	return TOC{FileMetadata: fm}, uncompressedArchiveSize, nil
+	toc := TOC{FileMetadata: fm}
+	if chunkSize > 0 {
+		toc.ChunkSize = chunkSize
+	}
+	return toc, uncompressedArchiveSize, nil
 }
 
 // getFileMetadata creates `FileMetadata` for each file within the compressed file
 // and calculate the uncompressed size of the passed file.
-func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata, compression.Offset, error) {
+func (tb TocBuilder) getFileMetadata(algorithm, filename string, chunkSize compression.Offset) ([]FileMetadata, compression.Offset, error) {
 	// read compress file and create compress tar reader.
 	compressFile, err := os.Open(filename)
 	if err != nil {
@@ -113,7 +124,7 @@ func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata
 
 	// create toc from tar reader.
 	tarSectionReader := io.NewSectionReader(uncompressFile, 0, uncompressFileSize)
-	md, err := metadataFromTarReader(tarSectionReader)
+	md, err := metadataFromTarReader(tarSectionReader, chunkSize)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -121,8 +132,9 @@ func (tb TocBuilder) getFileMetadata(algorithm, filename string) ([]FileMetadata
 }
 
 // metadataFromTarReader reads every file from tar reader `sr` and creates
-// `FileMetadata` for each file.
-func metadataFromTarReader(sr *io.SectionReader) ([]FileMetadata, error) {
+// `FileMetadata` for each file. If chunkSize is positive, the contents of regular
+// files are read to record their chunk digests.
+func metadataFromTarReader(sr *io.SectionReader, chunkSize compression.Offset) ([]FileMetadata, error) {
 	pt := &positionTrackerReader{r: sr}
 	tarRdr := tar.NewReader(pt)
 	var md []FileMetadata
@@ -158,11 +170,34 @@ func metadataFromTarReader(sr *io.SectionReader) ([]FileMetadata, error) {
 			Devminor:           hdr.Devminor,
 			Xattrs:             hdr.PAXRecords,
 		}
+		if chunkSize > 0 && fileType == "reg" && hdr.Size > 0 {
+			metadataEntry.ChunkDigests, err = chunkDigests(tarRdr, chunkSize)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading %s: %w", hdr.Name, err)
+			}
+		}
 		md = append(md, metadataEntry)
 	}
 	return md, nil
 }
 
+// chunkDigests returns the digests of the contents of r in chunks of chunkSize.
+func chunkDigests(r io.Reader, chunkSize compression.Offset) ([]digest.Digest, error) {
+	var dgsts []digest.Digest
+	for {
+		digester := digest.Canonical.Digester()
+		n, err := io.CopyN(digester.Hash(), r, int64(chunkSize))
+		if n > 0 {
+			dgsts = append(dgsts, digester.Digest())
+		}
+		if err == io.EOF {
+			return dgsts, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
 func getType(header *tar.Header) (fileType string, e error) {
 	switch header.Typeflag {
 	case tar.TypeLink:
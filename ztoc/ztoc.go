@@ -63,6 +63,9 @@ type CompressionInfo struct {
 // data (e.g., a gzip tar file).
 type TOC struct {
 	FileMetadata []FileMetadata
+	// ChunkSize is the size of the chunks of regular files whose digests are
+	// recorded in `FileMetadata.ChunkDigests`. 0 if no chunk digests are recorded.
+	ChunkSize compression.Offset
 }
 
 // FileMetadata contains metadata of a file in the compressed data.
@@ -83,6 +86,11 @@ type FileMetadata struct {
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
 	Xattrs map[string]string
+
+	// ChunkDigests are the digests of the uncompressed contents of a regular file,
+	// split into chunks of `TOC.ChunkSize`. Identical files in different layers have
+	// the same chunk digests, so their contents can be shared.
+	ChunkDigests []digest.Digest
 }
 
 // FileExtractConfig contains information used to extract a file from compressed data.
@@ -160,6 +168,37 @@ func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error)
 	return bytes, nil
 }
 
+// ExtractRange extracts `length` bytes starting at `offset` of the uncompressed
+// archive from compressed data (as a reader) and returns the byte data.
+func ExtractRange(r *io.SectionReader, ztoc *Ztoc, offset, length compression.Offset) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length > ztoc.UncompressedArchiveSize {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds of the uncompressed archive of size %d",
+			offset, offset+length, ztoc.UncompressedArchiveSize)
+	}
+	return ExtractFile(r, &FileExtractConfig{
+		UncompressedSize:      length,
+		UncompressedOffset:    offset,
+		Checkpoints:           ztoc.Checkpoints,
+		CompressedArchiveSize: ztoc.CompressedArchiveSize,
+		MaxSpanID:             ztoc.MaxSpanID,
+	})
+}
+
+// ExtractFileRange extracts `length` bytes starting at `offset` of the file
+// `filename` from compressed data (as a reader) and returns the byte data.
+// `offset` is relative to the start of the file.
+func ExtractFileRange(r *io.SectionReader, ztoc *Ztoc, filename string, offset, length compression.Offset) ([]byte, error) {
+	entry, err := GetMetadataEntry(ztoc, filename)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > entry.UncompressedSize {
+		return nil, fmt.Errorf("range [%d, %d) is out of bounds of file %s of size %d",
+			offset, offset+length, filename, entry.UncompressedSize)
+	}
+	return ExtractRange(r, ztoc, entry.UncompressedOffset+offset, length)
+}
+
 // NewGzipZinfo is the go implementation of getting "checkpoints" from compressed data.
 func NewGzipZinfo(b []byte) {
 	panic("unimplemented")
@@ -48,7 +48,9 @@ func NewBuilder(buildToolIdentifier string) *Builder {
 
 // buildConfig contains configuration used when `ztoc.Builder` builds a `Ztoc`.
 type buildConfig struct {
-	algorithm string
+	algorithm    string
+	reproducible bool
+	chunkSize    compression.Offset
 }
 
 // BuildOption specifies a change to `buildConfig` when building a ztoc.
@@ -62,6 +64,32 @@ func WithCompression(algorithm string) BuildOption {
 	}
 }
 
+// WithReproducible leaves out the fields of the ztoc that depend on the tool that
+// built it rather than on the layer, i.e. the build tool identifier, so that
+// different versions of the tool build the same ztoc for a layer.
+//
+// The ztoc is otherwise always the same for the same layer, span size and options:
+// files are recorded in the order of the tar archive, xattrs are sorted by key,
+// and mod times are recorded in UTC.
+func WithReproducible() BuildOption {
+	return func(opt *buildConfig) error {
+		opt.reproducible = true
+		return nil
+	}
+}
+
+// WithChunkDigests records the digests of the contents of regular files in chunks of
+// chunkSize, so that the snapshotter can share the chunks of identical files between layers.
+func WithChunkDigests(chunkSize int64) BuildOption {
+	return func(opt *buildConfig) error {
+		if chunkSize <= 0 {
+			return fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+		}
+		opt.chunkSize = compression.Offset(chunkSize)
+		return nil
+	}
+}
+
 // defaultBuildConfig creates a `buildConfig` with default values.
 func defaultBuildConfig() buildConfig {
 	return buildConfig{
@@ -93,17 +121,22 @@ func (b *Builder) BuildZtoc(filename string, span int64, options ...BuildOption)
 		return nil, err
 	}
 
-	toc, uncompressedArchiveSize, err := b.tocBuilder.TocFromFile(opt.algorithm, filename)
+	toc, uncompressedArchiveSize, err := b.tocBuilder.tocFromFile(opt.algorithm, filename, opt.chunkSize)
 	if err != nil {
 		return nil, err
 	}
 
+	buildToolIdentifier := b.buildToolIdentifier
+	if opt.reproducible {
+		buildToolIdentifier = ""
+	}
+
 	return &Ztoc{
 		Version:                 Version09,
 		TOC:                     toc,
 		CompressedArchiveSize:   fs,
 		UncompressedArchiveSize: uncompressedArchiveSize,
-		BuildToolIdentifier:     b.buildToolIdentifier,
+		BuildToolIdentifier:     buildToolIdentifier,
 		CompressionInfo:         compressionInfo,
 	}, nil
 }
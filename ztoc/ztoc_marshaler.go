@@ -18,6 +18,7 @@ package ztoc
 
 import (
 	"bytes"
+	_ "crypto/sha512" // register sha384 and sha512 for go-digest
 	"fmt"
 	"io"
 	"sort"
@@ -31,16 +32,44 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+type marshalConfig struct {
+	digestAlgorithm digest.Algorithm
+}
+
+// MarshalOption specifies a config change for marshaling a ztoc.
+type MarshalOption func(c *marshalConfig) error
+
+// WithDigestAlgorithm sets the algorithm used to compute the digest of the serialized ztoc.
+// By default, the digest is computed with `digest.Canonical` (sha256).
+func WithDigestAlgorithm(alg digest.Algorithm) MarshalOption {
+	return func(c *marshalConfig) error {
+		if !alg.Available() {
+			return fmt.Errorf("unsupported digest algorithm %q", alg)
+		}
+		c.digestAlgorithm = alg
+		return nil
+	}
+}
+
 // Marshal serializes Ztoc to its flatbuffers schema and returns a reader along with the descriptor (digest and size only).
 // If not successful, it will return an error.
-func Marshal(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
+func Marshal(ztoc *Ztoc, opts ...MarshalOption) (io.Reader, ocispec.Descriptor, error) {
+	config := marshalConfig{
+		digestAlgorithm: digest.Canonical,
+	}
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return nil, ocispec.Descriptor{}, err
+		}
+	}
+
 	flatbuf, err := ztocToFlatbuffer(ztoc)
 	if err != nil {
 		return nil, ocispec.Descriptor{}, err
 	}
 
 	buf := bytes.NewReader(flatbuf)
-	dgst := digest.FromBytes(flatbuf)
+	dgst := config.digestAlgorithm.FromBytes(flatbuf)
 	size := len(flatbuf)
 	return buf, ocispec.Descriptor{
 		Digest: dgst,
@@ -82,6 +111,7 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 	metadata := make([]FileMetadata, toc.MetadataLength())
 	ztoc.TOC = TOC{
 		FileMetadata: metadata,
+		ChunkSize:    compression.Offset(toc.ChunkSize()),
 	}
 
 	for i := 0; i < toc.MetadataLength(); i++ {
@@ -111,6 +141,12 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 			value := string(xattrEntry.Value())
 			me.Xattrs[key] = value
 		}
+		if n := metadataEntry.ChunkDigestsLength(); n > 0 {
+			me.ChunkDigests = make([]digest.Digest, n)
+			for j := 0; j < n; j++ {
+				me.ChunkDigests[j] = digest.Digest(metadataEntry.ChunkDigests(j))
+			}
+		}
 
 		ztoc.FileMetadata[i] = me
 	}
@@ -157,6 +193,7 @@ func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 
 	ztoc_flatbuffers.TOCStart(builder)
 	ztoc_flatbuffers.TOCAddMetadata(builder, metadata)
+	ztoc_flatbuffers.TOCAddChunkSize(builder, int64(ztoc.ChunkSize))
 	toc := ztoc_flatbuffers.TOCEnd(builder)
 
 	// ztoc - zinfo
@@ -206,10 +243,16 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 	linkName := builder.CreateString(me.Linkname)
 	uname := builder.CreateString(me.Uname)
 	gname := builder.CreateString(me.Gname)
-	modTimeBinary, _ := me.ModTime.MarshalText()
+	// Mod times are recorded in UTC, so the ztoc doesn't depend on the time zone
+	// of the machine that built it.
+	modTimeBinary, _ := me.ModTime.UTC().MarshalText()
 	modTime := builder.CreateString(string(modTimeBinary))
 
 	xattrs := prepareXattrsOffset(me, builder)
+	var chunkDigests flatbuffers.UOffsetT
+	if len(me.ChunkDigests) > 0 {
+		chunkDigests = prepareChunkDigestsOffset(me, builder)
+	}
 
 	ztoc_flatbuffers.FileMetadataStart(builder)
 	ztoc_flatbuffers.FileMetadataAddName(builder, name)
@@ -227,6 +270,11 @@ func prepareMetadataOffset(builder *flatbuffers.Builder, me FileMetadata) flatbu
 	ztoc_flatbuffers.FileMetadataAddDevminor(builder, me.Devminor)
 
 	ztoc_flatbuffers.FileMetadataAddXattrs(builder, xattrs)
+	// chunk digests are left out if there are none, so that ztocs without them
+	// are the same as before they were introduced.
+	if len(me.ChunkDigests) > 0 {
+		ztoc_flatbuffers.FileMetadataAddChunkDigests(builder, chunkDigests)
+	}
 
 	off := ztoc_flatbuffers.FileMetadataEnd(builder)
 	return off
@@ -257,6 +305,18 @@ func prepareXattrsOffset(me FileMetadata, builder *flatbuffers.Builder) flatbuff
 	return xattrs
 }
 
+func prepareChunkDigestsOffset(me FileMetadata, builder *flatbuffers.Builder) flatbuffers.UOffsetT {
+	offsets := make([]flatbuffers.UOffsetT, 0, len(me.ChunkDigests))
+	for _, dgst := range me.ChunkDigests {
+		offsets = append(offsets, builder.CreateString(dgst.String()))
+	}
+	ztoc_flatbuffers.FileMetadataStartChunkDigestsVector(builder, len(offsets))
+	for j := len(offsets) - 1; j >= 0; j-- {
+		builder.PrependUOffsetT(offsets[j])
+	}
+	return builder.EndVector(len(offsets))
+}
+
 // compressionAlgorithmToFlatbuf helps convert compression algorithm into flatbuf
 // enum. SOCI/containerd uses lower-case for compression, but our flatbuf capitalizes
 // the first letter. When converting back, we can just `strings.ToLower` so a helper
@@ -24,6 +24,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
@@ -206,6 +207,77 @@ func TestDecompressWithGzipHeaders(t *testing.T) {
 	}
 }
 
+func TestExtractFileRange(t *testing.T) {
+	const spanSize = 1024
+	data := testutil.RandomByteData(10000)
+	ztoc, sr, err := BuildZtocReader(t,
+		[]testutil.TarEntry{
+			testutil.File("file", string(data)),
+		},
+		gzip.DefaultCompression,
+		spanSize,
+	)
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	testcases := []struct {
+		name        string
+		offset      compression.Offset
+		length      compression.Offset
+		expectError bool
+	}{
+		{
+			name:   "extract whole file",
+			offset: 0,
+			length: compression.Offset(len(data)),
+		},
+		{
+			name:   "extract range within a single span",
+			offset: 10,
+			length: 100,
+		},
+		{
+			name:   "extract range spanning multiple spans",
+			offset: 1000,
+			length: 5000,
+		},
+		{
+			name:   "extract empty range",
+			offset: 500,
+			length: 0,
+		},
+		{
+			name:        "range past the end of the file returns error",
+			offset:      9000,
+			length:      2000,
+			expectError: true,
+		},
+		{
+			name:        "negative offset returns error",
+			offset:      -1,
+			length:      10,
+			expectError: true,
+		},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := ExtractFileRange(sr, ztoc, "file", tc.offset, tc.length)
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expect error: %t, actual error: %v", tc.expectError, err)
+			}
+			if err != nil {
+				return
+			}
+			expected := data[tc.offset : tc.offset+tc.length]
+			if !bytes.Equal(b, expected) {
+				t.Fatalf("data mismatched at %d", getPositionOfFirstDiffInByteSlice(expected, b))
+			}
+		})
+	}
+}
+
 func TestZtocGenerationConsistency(t *testing.T) {
 	testcases := []struct {
 		name       string
@@ -301,6 +373,127 @@ func TestZtocGenerationConsistency(t *testing.T) {
 
 }
 
+func TestZtocGenerationReproducible(t *testing.T) {
+	modTime := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	xattrs := map[string]string{
+		"user.a": "1",
+		"user.b": "2",
+		"user.c": "3",
+		"user.d": "4",
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1", string(testutil.RandomByteData(100000)), testutil.WithFileXattrs(xattrs), testutil.WithFileModTime(modTime)),
+		testutil.File("file2", string(testutil.RandomByteData(25)), testutil.WithFileXattrs(xattrs), testutil.WithFileModTime(modTime)),
+	}
+	tarReader := testutil.BuildTarGz(tarEntries, gzip.DefaultCompression)
+	tarGzFilePath, _, err := testutil.WriteTarToTempFile("reproducible.tar.gz", tarReader)
+	if err != nil {
+		t.Fatalf("cannot prepare the .tar.gz file for testing")
+	}
+	defer os.Remove(tarGzFilePath)
+
+	var digests []digest.Digest
+	for _, buildTool := range []string{"AWS SOCI CLI v0.1", "AWS SOCI CLI v0.2"} {
+		ztoc, err := NewBuilder(buildTool).BuildZtoc(tarGzFilePath, 64, WithReproducible())
+		if err != nil {
+			t.Fatalf("can't build ztoc: %v", err)
+		}
+		if ztoc.BuildToolIdentifier != "" {
+			t.Fatalf("unexpected build tool identifier %q", ztoc.BuildToolIdentifier)
+		}
+		_, desc, err := Marshal(ztoc)
+		if err != nil {
+			t.Fatalf("can't marshal ztoc: %v", err)
+		}
+		digests = append(digests, desc.Digest)
+
+		// The same mod times in a different time zone are recorded the same way.
+		for i := range ztoc.FileMetadata {
+			ztoc.FileMetadata[i].ModTime = ztoc.FileMetadata[i].ModTime.In(time.FixedZone("UTC+8", 8*60*60))
+		}
+		_, desc, err = Marshal(ztoc)
+		if err != nil {
+			t.Fatalf("can't marshal ztoc: %v", err)
+		}
+		digests = append(digests, desc.Digest)
+	}
+
+	for _, dgst := range digests[1:] {
+		if dgst != digests[0] {
+			t.Fatalf("ztocs aren't reproducible: got digests %v", digests)
+		}
+	}
+}
+
+func TestZtocChunkDigests(t *testing.T) {
+	const chunkSize = 1000
+	contents := testutil.RandomByteData(2500)
+	tarEntries := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file", string(contents)),
+		testutil.File("empty", ""),
+	}
+	tarReader := testutil.BuildTarGz(tarEntries, gzip.DefaultCompression)
+	tarGzFilePath, _, err := testutil.WriteTarToTempFile("chunks.tar.gz", tarReader)
+	if err != nil {
+		t.Fatalf("cannot prepare the .tar.gz file for testing")
+	}
+	defer os.Remove(tarGzFilePath)
+
+	withoutChunks, err := NewBuilder("test").BuildZtoc(tarGzFilePath, 64)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	ztoc, err := NewBuilder("test").BuildZtoc(tarGzFilePath, 64, WithChunkDigests(chunkSize))
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	expected := map[string][]digest.Digest{
+		"dir/file": {
+			digest.FromBytes(contents[:1000]),
+			digest.FromBytes(contents[1000:2000]),
+			digest.FromBytes(contents[2000:]),
+		},
+	}
+
+	// the chunk digests survive marshaling.
+	r, _, err := Marshal(ztoc)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	unmarshaled, err := Unmarshal(r)
+	if err != nil {
+		t.Fatalf("can't unmarshal ztoc: %v", err)
+	}
+	for _, z := range []*Ztoc{ztoc, unmarshaled} {
+		if z.ChunkSize != chunkSize {
+			t.Fatalf("unexpected chunk size %d", z.ChunkSize)
+		}
+		for _, fm := range z.FileMetadata {
+			if !reflect.DeepEqual(fm.ChunkDigests, expected[fm.Name]) {
+				t.Fatalf("unexpected chunk digests of %s; expected %v, got %v", fm.Name, expected[fm.Name], fm.ChunkDigests)
+			}
+		}
+	}
+
+	// ztocs without chunk digests are the same as before chunk digests were introduced.
+	ztoc.ChunkSize = 0
+	for i := range ztoc.FileMetadata {
+		ztoc.FileMetadata[i].ChunkDigests = nil
+	}
+	_, desc, err := Marshal(ztoc)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	_, expectedDesc, err := Marshal(withoutChunks)
+	if err != nil {
+		t.Fatalf("can't marshal ztoc: %v", err)
+	}
+	if desc.Digest != expectedDesc.Digest {
+		t.Fatalf("ztocs without chunk digests changed")
+	}
+}
+
 func TestZtocGeneration(t *testing.T) {
 	testcases := []struct {
 		name       string
@@ -683,6 +876,64 @@ func TestWriteZtoc(t *testing.T) {
 	}
 }
 
+func TestMarshalZtocDigestAlgorithm(t *testing.T) {
+	ztoc := &Ztoc{
+		Version:             Version09,
+		BuildToolIdentifier: "AWS SOCI CLI",
+		TOC: TOC{
+			FileMetadata: make([]FileMetadata, 2),
+		},
+		CompressionInfo: CompressionInfo{
+			Checkpoints: make([]byte, 1<<10),
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		algorithm   digest.Algorithm
+		expectError bool
+	}{
+		{
+			name:      "sha256",
+			algorithm: digest.SHA256,
+		},
+		{
+			name:      "sha512",
+			algorithm: digest.SHA512,
+		},
+		{
+			name:        "unknown algorithm",
+			algorithm:   digest.Algorithm("md5"),
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, desc, err := Marshal(ztoc, WithDigestAlgorithm(tc.algorithm))
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error occurred when marshaling ztoc: %v", err)
+			}
+			if desc.Digest.Algorithm() != tc.algorithm {
+				t.Fatalf("unexpected digest algorithm; expected %v, got %v", tc.algorithm, desc.Digest.Algorithm())
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := tc.algorithm.FromBytes(b); actual != desc.Digest {
+				t.Fatalf("unexpected digest; expected %v, got %v", desc.Digest, actual)
+			}
+		})
+	}
+}
+
 func TestReadZtocInWrongFormat(t *testing.T) {
 	testCases := []struct {
 		name           string